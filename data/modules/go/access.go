@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	STORAGE_ACCESS_PUBLIC  = "public"
+	STORAGE_ACCESS_PRIVATE = "private"
+	// IMAGE_URL_PRIVATE_EXPIRY_HOURS is the default URL lifetime in private mode, where a URL is the only key to an object
+	IMAGE_URL_PRIVATE_EXPIRY_HOURS = 1
+)
+
+// escapeLike escapes the LIKE wildcards in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// isDerivativeKey reports whether an object key is a thumbnail, poster or variant rendered from an upload
+func isDerivativeKey(objectKey string) bool {
+	return strings.HasPrefix(objectKey, THUMBNAIL_PREFIX) || strings.HasPrefix(objectKey, VARIANT_PREFIX)
+}
+
+// derivativeOriginal strips the derivative prefix, leaving a key under the original's <ownerId>/ folder
+func derivativeOriginal(objectKey string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(objectKey, THUMBNAIL_PREFIX), VARIANT_PREFIX)
+}
+
+// derivativeAttachment finds the attachment a thumbnail, poster or variant key was rendered from, nil if there
+// is none. Derivative keys drop the original's extension, so the record is looked up by name prefix.
+func derivativeAttachment(ctx context.Context, db *sql.DB, objectKey string) (*Attachment, error) {
+	original := derivativeOriginal(objectKey)
+	ownerID := objectOwner(original)
+	base := strings.TrimSuffix(original, path.Ext(original))
+	i := strings.LastIndex(base, "_")
+	if ownerID == "" || i < 0 {
+		return nil, nil
+	}
+	stem := path.Base(base[:i])
+
+	rows, err := db.QueryContext(ctx, `
+SELECT value FROM storage
+WHERE collection = $1 AND user_id = $2 AND (key = $3 OR key LIKE $4)
+LIMIT 10`, ATTACHMENT_COLLECTION, ownerID, stem, escapeLike(stem)+".%")
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up attachment: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("failed to look up attachment: %v", err)
+		}
+		var attachment Attachment
+		if err := json.Unmarshal([]byte(value), &attachment); err != nil {
+			continue
+		}
+		for _, key := range attachment.ObjectKeys() {
+			if key == objectKey {
+				return &attachment, nil
+			}
+		}
+	}
+	return nil, rows.Err()
+}
+
+// objectAttachment returns the attachment an object key belongs to, either as the upload itself or as one of its derivatives
+func objectAttachment(ctx context.Context, db *sql.DB, nk nkruntime.NakamaModule, objectKey string) (*Attachment, error) {
+	if isDerivativeKey(objectKey) {
+		return derivativeAttachment(ctx, db, objectKey)
+	}
+	ownerID := objectOwner(objectKey)
+	if ownerID == "" {
+		return nil, nil
+	}
+	attachment, _, err := readAttachment(ctx, nk, ownerID, objectKey)
+	return attachment, err
+}
+
+// canAccessObject reports whether a user may get a URL for an object. In public mode anyone may.
+// In private mode, the uploader and admins always may. Avatars are visible to every user, and
+// anything else only to members of the channel it was sent to.
+func canAccessObject(ctx context.Context, db *sql.DB, nk nkruntime.NakamaModule, userID, objectKey string) (bool, error) {
+	if !storagePrivate() || isAdmin(ctx) {
+		return true, nil
+	}
+	if userID == "" {
+		return false, nil
+	}
+	if strings.HasPrefix(objectKey, AVATAR_PREFIX) {
+		return true, nil
+	}
+
+	attachment, err := objectAttachment(ctx, db, nk, objectKey)
+	if err != nil {
+		return false, err
+	}
+	if attachment == nil {
+		// Uploads from before attachment records existed are left to their uploader
+		return objectOwner(derivativeOriginal(objectKey)) == userID, nil
+	}
+	if attachment.OwnerID == userID {
+		return true, nil
+	}
+	if attachment.ChannelID == "" {
+		return false, nil
+	}
+	return isChannelMember(ctx, nk, attachment.ChannelID, userID)
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// ACCOUNT_DELETION_COLLECTION holds one system-owned job per user, keyed by user ID, so it outlives the account
+	ACCOUNT_DELETION_COLLECTION = "account_deletions"
+
+	ACCOUNT_DELETION_PENDING   = "pending"
+	ACCOUNT_DELETION_RUNNING   = "running"
+	ACCOUNT_DELETION_COMPLETED = "completed"
+	ACCOUNT_DELETION_FAILED    = "failed"
+
+	// ACCOUNT_DELETION_MODE_DELETE removes the user's messages, ACCOUNT_DELETION_MODE_ANONYMIZE keeps them
+	// without the sender's identity
+	ACCOUNT_DELETION_MODE_DELETE    = "delete"
+	ACCOUNT_DELETION_MODE_ANONYMIZE = "anonymize"
+
+	ACCOUNT_DELETION_DEFAULT_INTERVAL_SECONDS = 30
+	ACCOUNT_DELETION_MAX_ATTEMPTS             = 5
+	ACCOUNT_DELETION_BATCH_SIZE               = 100
+	// ACCOUNT_DELETION_STALE_AFTER is how long a running job may go without progress before another run takes it over
+	ACCOUNT_DELETION_STALE_AFTER = time.Hour
+	// ANONYMIZED_USERNAME replaces the sender name of anonymized messages
+	ANONYMIZED_USERNAME = "Deleted user"
+)
+
+// AccountDeletion is the job that erases a user's data and account, and its progress
+type AccountDeletion struct {
+	UserID      string `json:"userId"`
+	Mode        string `json:"mode"`
+	Status      string `json:"status"`
+	RequestedBy string `json:"requestedBy"`
+	RequestedAt int64  `json:"requestedAt"`
+	StartedAt   int64  `json:"startedAt,omitempty"`
+	CompletedAt int64  `json:"completedAt,omitempty"`
+	// Step is the last step that finished: messages, objects, records or account
+	Step     string `json:"step,omitempty"`
+	Attempts int    `json:"attempts"`
+	// Messages, Objects and Records count what was deleted or anonymized
+	Messages int64  `json:"messages"`
+	Objects  int64  `json:"objects"`
+	Records  int64  `json:"records"`
+	Error    string `json:"error,omitempty"`
+}
+
+// AccountDeletionResponse represents the response for account deletion RPCs
+type AccountDeletionResponse struct {
+	Success  bool             `json:"success"`
+	Deletion *AccountDeletion `json:"deletion,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Code     string           `json:"code,omitempty"`
+}
+
+// readAccountDeletion loads a user's deletion job and its storage version, nil if there is none
+func readAccountDeletion(ctx context.Context, nk nkruntime.NakamaModule, userID string) (*AccountDeletion, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: ACCOUNT_DELETION_COLLECTION, Key: userID}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read account deletion: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	var deletion AccountDeletion
+	if err := json.Unmarshal([]byte(objects[0].Value), &deletion); err != nil {
+		return nil, "", fmt.Errorf("failed to decode account deletion: %v", err)
+	}
+	return &deletion, objects[0].Version, nil
+}
+
+// writeAccountDeletion stores a deletion job, failing if the stored version no longer matches, and returns the new version
+func writeAccountDeletion(ctx context.Context, nk nkruntime.NakamaModule, deletion *AccountDeletion, version string) (string, error) {
+	value, err := json.Marshal(deletion)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode account deletion: %v", err)
+	}
+	acks, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      ACCOUNT_DELETION_COLLECTION,
+		Key:             deletion.UserID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	if err != nil {
+		return "", err
+	}
+	return acks[0].Version, nil
+}
+
+// deleteUserMessages deletes up to a batch of a user's messages the same way delete_message does, returning how many
+func deleteUserMessages(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, userID string) (int64, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT id::TEXT, stream_mode::TEXT || '.' ||
+	CASE WHEN stream_subject::TEXT = $2 THEN '' ELSE stream_subject::TEXT END || '.' ||
+	CASE WHEN stream_descriptor::TEXT = $2 THEN '' ELSE stream_descriptor::TEXT END || '.' || stream_label,
+	username, content::TEXT
+FROM message WHERE sender_id = $1 LIMIT $3`, userID, NIL_UUID, ACCOUNT_DELETION_BATCH_SIZE)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list messages: %v", err)
+	}
+	type userMessage struct {
+		id, channelID string
+		message       *StoredMessage
+	}
+	batch := make([]userMessage, 0, ACCOUNT_DELETION_BATCH_SIZE)
+	for rows.Next() {
+		m := userMessage{message: &StoredMessage{SenderID: userID}}
+		if err := rows.Scan(&m.id, &m.channelID, &m.message.Username, &m.message.Content); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to read message: %v", err)
+		}
+		batch = append(batch, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list messages: %v", err)
+	}
+
+	for _, m := range batch {
+		// Nothing of an erased user's message is kept, not even for moderators
+		if err := deleteChannelMessage(ctx, logger, db, nk, m.channelID, m.id, m.message, "account_deletion", ""); err != nil {
+			return 0, fmt.Errorf("failed to delete message %s: %v", m.id, err)
+		}
+	}
+	if messageArchiveEnabled {
+		if _, err := db.ExecContext(ctx, "DELETE FROM message_archive WHERE sender_id = $1", userID); err != nil {
+			return 0, fmt.Errorf("failed to delete archived messages: %v", err)
+		}
+	}
+	return int64(len(batch)), nil
+}
+
+// anonymizeUserMessages detaches a user's messages, their search entries and edit histories from the user
+func anonymizeUserMessages(ctx context.Context, db *sql.DB, userID string) (int64, error) {
+	result, err := db.ExecContext(ctx, `UPDATE message SET sender_id = $2, username = $3 WHERE sender_id = $1`, userID, NIL_UUID, ANONYMIZED_USERNAME)
+	if err != nil {
+		return 0, fmt.Errorf("failed to anonymize messages: %v", err)
+	}
+	count, _ := result.RowsAffected()
+
+	if messageSearchEnabled {
+		if _, err := db.ExecContext(ctx, `UPDATE message_search SET sender_id = '', username = $2 WHERE sender_id = $1`, userID, ANONYMIZED_USERNAME); err != nil {
+			return count, fmt.Errorf("failed to anonymize search index: %v", err)
+		}
+	}
+	if messageArchiveEnabled {
+		if _, err := db.ExecContext(ctx, `UPDATE message_archive SET sender_id = '', username = $2 WHERE sender_id = $1`, userID, ANONYMIZED_USERNAME); err != nil {
+			return count, fmt.Errorf("failed to anonymize message archive: %v", err)
+		}
+	}
+	return count, scrubMessageHistory(ctx, db, userID, true)
+}
+
+// scrubMessageHistory removes the user from the edit histories of their messages, and unless keepRevisions
+// is set the earlier versions of those messages too
+func scrubMessageHistory(ctx context.Context, db *sql.DB, userID string, keepRevisions bool) error {
+	value := `jsonb_set(value, '{senderId}', '""')`
+	if !keepRevisions {
+		value = `jsonb_set(jsonb_set(value, '{senderId}', '""'), '{revisions}', '[]')`
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE storage SET value = `+value+` WHERE collection = $1 AND value->>'senderId' = $2`,
+		MESSAGE_HISTORY_COLLECTION, userID); err != nil {
+		return fmt.Errorf("failed to scrub message history: %v", err)
+	}
+	return nil
+}
+
+// deleteUserObjects removes every object stored under the user's prefix, thumbnails, avatars and quarantined uploads included
+func deleteUserObjects(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, userID string) (int64, error) {
+	backend, err := getStorageBackend(logger)
+	if err != nil {
+		return 0, fmt.Errorf("failed to initialize storage backend: %v", err)
+	}
+
+	prefix := userID + "/"
+	locations := []struct{ bucket, prefix string }{
+		{serverConfig.Bucket, prefix},
+		{serverConfig.Bucket, THUMBNAIL_PREFIX + prefix},
+		{serverConfig.Bucket, VARIANT_PREFIX + prefix},
+		{serverConfig.QuarantineBucket, QUARANTINE_PREFIX + prefix},
+		{serverConfig.VideoBucket, prefix},
+		{serverConfig.AvatarBucket, AVATAR_PREFIX + prefix},
+		{serverConfig.VoiceBucket, prefix},
+		{serverConfig.ExportBucket, prefix},
+	}
+	var count int64
+	for _, location := range locations {
+		keys := make([]string, 0)
+		if err := backend.ListObjects(ctx, location.bucket, location.prefix, func(object *StoredObject) bool {
+			keys = append(keys, object.Key)
+			return true
+		}); err != nil {
+			return count, fmt.Errorf("failed to list objects in %s: %v", location.bucket, err)
+		}
+		for _, key := range keys {
+			if err := backend.RemoveObject(ctx, location.bucket, key); err != nil {
+				return count, fmt.Errorf("failed to delete object %s: %v", key, err)
+			}
+			count++
+		}
+		forgetImageURLs(ctx, logger, nk, keys...)
+	}
+	return count, nil
+}
+
+// deleteUserRecords removes the storage records the user owns and the system records that exist only for them
+func deleteUserRecords(ctx context.Context, db *sql.DB, userID string) (int64, error) {
+	result, err := db.ExecContext(ctx, `DELETE FROM storage WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete storage records: %v", err)
+	}
+	count, _ := result.RowsAffected()
+
+	result, err = db.ExecContext(ctx, `DELETE FROM storage WHERE user_id = $1 AND collection = $2 AND value->>'userId' = $3`,
+		NIL_UUID, LIVE_LOCATION_COLLECTION, userID)
+	if err != nil {
+		return count, fmt.Errorf("failed to delete live locations: %v", err)
+	}
+	locations, _ := result.RowsAffected()
+	return count + locations, nil
+}
+
+// runAccountDeletion carries out a claimed job. Every step can be repeated, so a failed job is simply run again.
+func runAccountDeletion(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, deletion *AccountDeletion, version string) error {
+	save := func() error {
+		v, err := writeAccountDeletion(ctx, nk, deletion, version)
+		if err != nil {
+			return fmt.Errorf("failed to save progress: %v", err)
+		}
+		version = v
+		return nil
+	}
+
+	if deletion.Mode == ACCOUNT_DELETION_MODE_ANONYMIZE {
+		count, err := anonymizeUserMessages(ctx, db, deletion.UserID)
+		if err != nil {
+			return err
+		}
+		deletion.Messages += count
+	} else {
+		for {
+			count, err := deleteUserMessages(ctx, logger, db, nk, deletion.UserID)
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				break
+			}
+			deletion.Messages += count
+			// Saving progress also marks the job as alive
+			if err := save(); err != nil {
+				return err
+			}
+		}
+		if err := scrubMessageHistory(ctx, db, deletion.UserID, false); err != nil {
+			return err
+		}
+	}
+	deletion.Step = "messages"
+	if err := save(); err != nil {
+		return err
+	}
+
+	count, err := deleteUserObjects(ctx, logger, nk, deletion.UserID)
+	deletion.Objects += count
+	if err != nil {
+		return err
+	}
+	deletion.Step = "objects"
+	if err := save(); err != nil {
+		return err
+	}
+
+	count, err = deleteUserRecords(ctx, db, deletion.UserID)
+	deletion.Records += count
+	if err != nil {
+		return err
+	}
+	deletion.Step = "records"
+	if err := save(); err != nil {
+		return err
+	}
+
+	if err := nk.AccountDeleteId(ctx, deletion.UserID, false); err != nil {
+		return fmt.Errorf("failed to delete account: %v", err)
+	}
+	recordAudit(ctx, logger, db, &AuditEntry{Action: AUDIT_ACTION_ACCOUNT_DELETED, Target: deletion.UserID, Result: AUDIT_RESULT_OK})
+	publishEvent(WEBHOOK_EVENT_ACCOUNT_DELETED, map[string]interface{}{"userId": deletion.UserID})
+	deletion.Step = "account"
+	deletion.Status = ACCOUNT_DELETION_COMPLETED
+	deletion.CompletedAt = time.Now().Unix()
+	deletion.Error = ""
+	return save()
+}
+
+// processAccountDeletions claims and runs the jobs that are due: pending ones, failed ones with attempts left,
+// and running ones that stopped making progress
+func processAccountDeletions(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule) error {
+	rows, err := db.QueryContext(ctx, `
+SELECT key FROM storage
+WHERE collection = $1 AND user_id = $2 AND (
+	value->>'status' = $3
+	OR (value->>'status' = $4 AND (value->>'attempts')::INT < $5)
+	OR (value->>'status' = $6 AND update_time < $7)
+)
+ORDER BY update_time ASC LIMIT $8`,
+		ACCOUNT_DELETION_COLLECTION, NIL_UUID, ACCOUNT_DELETION_PENDING, ACCOUNT_DELETION_FAILED, ACCOUNT_DELETION_MAX_ATTEMPTS,
+		ACCOUNT_DELETION_RUNNING, time.Now().Add(-ACCOUNT_DELETION_STALE_AFTER), ACCOUNT_DELETION_BATCH_SIZE)
+	if err != nil {
+		return fmt.Errorf("failed to list account deletions: %v", err)
+	}
+	userIDs := make([]string, 0)
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read account deletion: %v", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+
+	for _, userID := range userIDs {
+		deletion, version, err := readAccountDeletion(ctx, nk, userID)
+		if err != nil || deletion == nil || deletion.Status == ACCOUNT_DELETION_COMPLETED {
+			continue
+		}
+
+		// The versioned write makes sure only one node runs a job
+		deletion.Status = ACCOUNT_DELETION_RUNNING
+		deletion.Attempts++
+		if deletion.StartedAt == 0 {
+			deletion.StartedAt = time.Now().Unix()
+		}
+		version, err = writeAccountDeletion(ctx, nk, deletion, version)
+		if err != nil {
+			continue
+		}
+
+		logger.Info("Deleting account %s (%s), attempt %d", userID, deletion.Mode, deletion.Attempts)
+		if err := runAccountDeletion(ctx, logger, db, nk, deletion, version); err != nil {
+			logger.Error("Account deletion of %s failed: %v", userID, err)
+			// The job may have been saved since it was claimed, so the failure is recorded over whatever is stored
+			deletion.Status = ACCOUNT_DELETION_FAILED
+			deletion.Error = err.Error()
+			if _, err := writeAccountDeletion(ctx, nk, deletion, ""); err != nil {
+				logger.Error("Failed to record account deletion failure of %s: %v", userID, err)
+			}
+			continue
+		}
+		logger.Info("Account %s deleted: %d messages, %d objects, %d records", userID, deletion.Messages, deletion.Objects, deletion.Records)
+	}
+	return nil
+}
+
+// StartAccountDeletionWorker runs due account deletions every ACCOUNT_DELETION_INTERVAL_SECONDS; 0 disables it
+func StartAccountDeletionWorker(logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule) {
+	seconds := serverConfig.AccountDeletionIntervalSeconds
+	if seconds <= 0 {
+		logger.Info("Account deletion worker disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(seconds) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := processAccountDeletions(context.Background(), logger, db, nk); err != nil {
+				logger.Error("Account deletion worker failed: %v", err)
+			}
+		}
+	}()
+	logger.Info("Account deletion worker scheduled every %d seconds", seconds)
+}
+
+// deletionTarget returns the user an account deletion RPC is about: the caller, or for admins any userId
+func deletionTarget(ctx context.Context, requested string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if requested == "" || requested == userID {
+		if userID == "" {
+			return "", errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Missing required field: userId")
+		}
+		return userID, nil
+	}
+	if !isAdmin(ctx) {
+		return "", errorWithCode(ERROR_CODE_PERMISSION_DENIED, "Permission denied")
+	}
+	if _, err := uuid.Parse(requested); err != nil {
+		return "", errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid userId")
+	}
+	return requested, nil
+}
+
+// RpcRequestAccountDeletion queues the erasure of the caller's account, or for admins any user's. The worker
+// deletes or anonymizes their messages, deletes their stored objects and records, then the account itself.
+func RpcRequestAccountDeletion(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if userIDFromContext(ctx) == "" && !isAdmin(ctx) {
+		return marshalResponse(AccountDeletionResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UserID string `json:"userId"`
+		Mode   string `json:"mode"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(AccountDeletionResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.Mode == "" {
+		request.Mode = ACCOUNT_DELETION_MODE_DELETE
+	}
+	if request.Mode != ACCOUNT_DELETION_MODE_DELETE && request.Mode != ACCOUNT_DELETION_MODE_ANONYMIZE {
+		return marshalResponse(AccountDeletionResponse{Success: false, Error: fmt.Sprintf("mode must be %s or %s", ACCOUNT_DELETION_MODE_DELETE, ACCOUNT_DELETION_MODE_ANONYMIZE), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	targetID, err := deletionTarget(ctx, request.UserID)
+	if err != nil {
+		return marshalResponse(AccountDeletionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	existing, version, err := readAccountDeletion(ctx, nk, targetID)
+	if err != nil {
+		return marshalResponse(AccountDeletionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if existing != nil && existing.Status != ACCOUNT_DELETION_FAILED {
+		return marshalResponse(AccountDeletionResponse{Success: false, Deletion: existing, Error: "Account deletion already requested", Code: ERROR_CODE_CONFLICT})
+	}
+	if existing == nil {
+		users, err := nk.UsersGetId(ctx, []string{targetID}, nil)
+		if err != nil {
+			return marshalResponse(AccountDeletionResponse{Success: false, Error: fmt.Sprintf("Failed to look up user: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+		if len(users) == 0 {
+			return marshalResponse(AccountDeletionResponse{Success: false, Error: "User not found", Code: ERROR_CODE_NOT_FOUND})
+		}
+		version = "*"
+	}
+
+	// Asking again after a failure starts a fresh set of attempts
+	deletion := &AccountDeletion{
+		UserID:      targetID,
+		Mode:        request.Mode,
+		Status:      ACCOUNT_DELETION_PENDING,
+		RequestedBy: userIDFromContext(ctx),
+		RequestedAt: time.Now().Unix(),
+	}
+	if _, err := writeAccountDeletion(ctx, nk, deletion, version); err != nil {
+		return marshalResponse(AccountDeletionResponse{Success: false, Error: fmt.Sprintf("Failed to request account deletion: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	logger.Info("Account deletion of %s (%s) requested by %s", targetID, request.Mode, deletion.RequestedBy)
+	return marshalResponse(AccountDeletionResponse{Success: true, Deletion: deletion})
+}
+
+// RpcGetAccountDeletionStatus returns the deletion job of the caller, or for admins any userId
+func RpcGetAccountDeletionStatus(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if userIDFromContext(ctx) == "" && !isAdmin(ctx) {
+		return marshalResponse(AccountDeletionResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UserID string `json:"userId"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(AccountDeletionResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	targetID, err := deletionTarget(ctx, request.UserID)
+	if err != nil {
+		return marshalResponse(AccountDeletionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	deletion, _, err := readAccountDeletion(ctx, nk, targetID)
+	if err != nil {
+		return marshalResponse(AccountDeletionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if deletion == nil {
+		return marshalResponse(AccountDeletionResponse{Success: false, Error: "Account deletion not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	return marshalResponse(AccountDeletionResponse{Success: true, Deletion: deletion})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	LEADERBOARD_WEEKLY_MESSAGES = "weekly_messages"
+	LEADERBOARD_WEEKLY_MEDIA    = "weekly_media"
+	// ACTIVITY_RESET_SCHEDULE resets the weekly leaderboards at midnight UTC between Sunday and Monday
+	ACTIVITY_RESET_SCHEDULE = "0 0 * * 1"
+	ACTIVITY_COLLECTION     = "activity_stats"
+	ACTIVITY_KEY            = "stats"
+	ACTIVITY_WRITE_ATTEMPTS = 3
+	ACTIVITY_MAX_CHANNELS   = 200
+	ACTIVITY_DEFAULT_LIMIT  = 10
+)
+
+// ACTIVITY_LEADERBOARDS are created at startup; clients read them with Nakama's leaderboard API
+var ACTIVITY_LEADERBOARDS = []string{LEADERBOARD_WEEKLY_MESSAGES, LEADERBOARD_WEEKLY_MEDIA}
+
+// ChannelActivity is a user's activity in one channel
+type ChannelActivity struct {
+	ChannelID    string `json:"channelId"`
+	Messages     int64  `json:"messages"`
+	Media        int64  `json:"media"`
+	WeekMessages int64  `json:"weekMessages"`
+	WeekMedia    int64  `json:"weekMedia"`
+	LastAt       int64  `json:"lastAt"`
+}
+
+// ActivityStats is a user's message activity, kept per user and updated after every message they send.
+// Weekly counters follow the leaderboards' UTC week; streaks count consecutive UTC days with a message.
+type ActivityStats struct {
+	Week          string                      `json:"week"`
+	WeekMessages  int64                       `json:"weekMessages"`
+	WeekMedia     int64                       `json:"weekMedia"`
+	TotalMessages int64                       `json:"totalMessages"`
+	TotalMedia    int64                       `json:"totalMedia"`
+	LastActiveDay string                      `json:"lastActiveDay,omitempty"`
+	Streak        int                         `json:"streak"`
+	LongestStreak int                         `json:"longestStreak"`
+	Channels      map[string]*ChannelActivity `json:"channels"`
+}
+
+// ActivityStatsResponse represents the response for get_my_stats
+type ActivityStatsResponse struct {
+	Success       bool               `json:"success"`
+	Week          string             `json:"week,omitempty"`
+	WeekMessages  int64              `json:"weekMessages"`
+	WeekMedia     int64              `json:"weekMedia"`
+	TotalMessages int64              `json:"totalMessages"`
+	TotalMedia    int64              `json:"totalMedia"`
+	Streak        int                `json:"streak"`
+	LongestStreak int                `json:"longestStreak"`
+	Ranks         map[string]int64   `json:"ranks,omitempty"`
+	Channels      []*ChannelActivity `json:"channels,omitempty"`
+	Error         string             `json:"error,omitempty"`
+	Code          string             `json:"code,omitempty"`
+}
+
+// InitializeActivityLeaderboards creates the weekly leaderboards; creating one that exists does nothing
+func InitializeActivityLeaderboards(ctx context.Context, nk nkruntime.NakamaModule) error {
+	for _, id := range ACTIVITY_LEADERBOARDS {
+		if err := nk.LeaderboardCreate(ctx, id, true, "desc", "incr", ACTIVITY_RESET_SCHEDULE, map[string]interface{}{"activity": true}, true); err != nil {
+			return fmt.Errorf("failed to create leaderboard %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// activityWeek names the UTC week a time falls in, as in "2024-W07"
+func activityWeek(t time.Time) string {
+	year, week := t.UTC().ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+// isMediaMessage reports whether a message carries an uploaded file
+func isMediaMessage(content string) bool {
+	var body struct {
+		ObjectKey string `json:"objectKey"`
+	}
+	return json.Unmarshal([]byte(content), &body) == nil && body.ObjectKey != ""
+}
+
+// currentStreak is the streak as of today: it is broken once a whole UTC day passes without a message
+func (s *ActivityStats) currentStreak(now time.Time) int {
+	today := now.UTC().Format("2006-01-02")
+	yesterday := now.UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	if s.LastActiveDay != today && s.LastActiveDay != yesterday {
+		return 0
+	}
+	return s.Streak
+}
+
+// record counts one message in the stats, starting a new week or streak when due
+func (s *ActivityStats) record(channelID string, media bool, now time.Time) {
+	if week := activityWeek(now); s.Week != week {
+		s.Week, s.WeekMessages, s.WeekMedia = week, 0, 0
+		for _, c := range s.Channels {
+			c.WeekMessages, c.WeekMedia = 0, 0
+		}
+	}
+	if today := now.UTC().Format("2006-01-02"); s.LastActiveDay != today {
+		s.Streak = s.currentStreak(now) + 1
+		s.LastActiveDay = today
+		if s.Streak > s.LongestStreak {
+			s.LongestStreak = s.Streak
+		}
+	}
+
+	if s.Channels == nil {
+		s.Channels = map[string]*ChannelActivity{}
+	}
+	channel, ok := s.Channels[channelID]
+	if !ok {
+		// Forget the channel gone quiet the longest to keep the record bounded
+		if len(s.Channels) >= ACTIVITY_MAX_CHANNELS {
+			oldest := ""
+			for id, c := range s.Channels {
+				if oldest == "" || c.LastAt < s.Channels[oldest].LastAt {
+					oldest = id
+				}
+			}
+			delete(s.Channels, oldest)
+		}
+		channel = &ChannelActivity{ChannelID: channelID}
+		s.Channels[channelID] = channel
+	}
+
+	s.WeekMessages++
+	s.TotalMessages++
+	channel.Messages++
+	channel.WeekMessages++
+	if media {
+		s.WeekMedia++
+		s.TotalMedia++
+		channel.Media++
+		channel.WeekMedia++
+	}
+	channel.LastAt = now.Unix()
+}
+
+// readActivityStats loads a user's stats with their storage version, "*" when there are none yet
+func readActivityStats(ctx context.Context, nk nkruntime.NakamaModule, userID string) (*ActivityStats, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: ACTIVITY_COLLECTION, Key: ACTIVITY_KEY, UserID: userID}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read activity stats: %v", err)
+	}
+	stats := &ActivityStats{Channels: map[string]*ChannelActivity{}}
+	if len(objects) == 0 {
+		return stats, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), stats); err != nil {
+		return nil, "", fmt.Errorf("failed to decode activity stats: %v", err)
+	}
+	return stats, objects[0].Version, nil
+}
+
+// recordActivity is the sent-message hook that counts a message on the weekly leaderboards and in the
+// sender's stats. Server messages are not counted.
+func recordActivity(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage) {
+	if message.SenderID == "" {
+		return
+	}
+	media := isMediaMessage(message.Content)
+
+	if _, err := nk.LeaderboardRecordWrite(ctx, LEADERBOARD_WEEKLY_MESSAGES, message.SenderID, message.Username, 1, 0, nil, nil); err != nil {
+		logger.Warn("Failed to count message %s on %s: %v", message.MessageID, LEADERBOARD_WEEKLY_MESSAGES, err)
+	}
+	if media {
+		if _, err := nk.LeaderboardRecordWrite(ctx, LEADERBOARD_WEEKLY_MEDIA, message.SenderID, message.Username, 1, 0, nil, nil); err != nil {
+			logger.Warn("Failed to count message %s on %s: %v", message.MessageID, LEADERBOARD_WEEKLY_MEDIA, err)
+		}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < ACTIVITY_WRITE_ATTEMPTS; attempt++ {
+		stats, version, err := readActivityStats(ctx, nk, message.SenderID)
+		if err != nil {
+			logger.Warn("Failed to count message %s in activity stats: %v", message.MessageID, err)
+			return
+		}
+		stats.record(message.ChannelID, media, time.Now())
+
+		value, _ := json.Marshal(stats)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      ACTIVITY_COLLECTION,
+			Key:             ACTIVITY_KEY,
+			UserID:          message.SenderID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return
+		}
+	}
+	logger.Warn("Failed to count message %s in activity stats: %v", message.MessageID, lastErr)
+}
+
+// RpcGetMyStats returns the caller's message activity with their most active channels this week, and their
+// rank on each weekly leaderboard they are on
+func RpcGetMyStats(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ActivityStatsResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Limit int `json:"limit"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(ActivityStatsResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.Limit <= 0 {
+		request.Limit = ACTIVITY_DEFAULT_LIMIT
+	}
+	if request.Limit > ACTIVITY_MAX_CHANNELS {
+		request.Limit = ACTIVITY_MAX_CHANNELS
+	}
+
+	stats, _, err := readActivityStats(ctx, nk, userID)
+	if err != nil {
+		return marshalResponse(ActivityStatsResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	// A week without messages leaves the previous week's counters in storage
+	now := time.Now()
+	if stats.Week != activityWeek(now) {
+		stats.Week, stats.WeekMessages, stats.WeekMedia = activityWeek(now), 0, 0
+		for _, c := range stats.Channels {
+			c.WeekMessages, c.WeekMedia = 0, 0
+		}
+	}
+
+	channels := make([]*ChannelActivity, 0, len(stats.Channels))
+	for _, c := range stats.Channels {
+		channels = append(channels, c)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		if channels[i].WeekMessages != channels[j].WeekMessages {
+			return channels[i].WeekMessages > channels[j].WeekMessages
+		}
+		if channels[i].Messages != channels[j].Messages {
+			return channels[i].Messages > channels[j].Messages
+		}
+		return channels[i].LastAt > channels[j].LastAt
+	})
+	if len(channels) > request.Limit {
+		channels = channels[:request.Limit]
+	}
+
+	ranks := map[string]int64{}
+	for _, id := range ACTIVITY_LEADERBOARDS {
+		_, owned, _, _, err := nk.LeaderboardRecordsList(ctx, id, []string{userID}, 1, "", 0)
+		if err != nil {
+			logger.Warn("Failed to read %s rank of %s: %v", id, userID, err)
+			continue
+		}
+		if len(owned) > 0 {
+			ranks[id] = owned[0].Rank
+		}
+	}
+
+	return marshalResponse(ActivityStatsResponse{
+		Success:       true,
+		Week:          stats.Week,
+		WeekMessages:  stats.WeekMessages,
+		WeekMedia:     stats.WeekMedia,
+		TotalMessages: stats.TotalMessages,
+		TotalMedia:    stats.TotalMedia,
+		Streak:        stats.currentStreak(now),
+		LongestStreak: stats.LongestStreak,
+		Ranks:         ranks,
+		Channels:      channels,
+	})
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	ARCHIVE_DEFAULT_HOT_DAYS       = 90
+	ARCHIVE_DEFAULT_INTERVAL_HOURS = 24
+	ARCHIVE_CONTENT_TYPE           = "application/gzip"
+	ARCHIVE_STATS_DUMPS            = 100
+	// ARCHIVE_LOCK_ID is the advisory lock that keeps two nodes from rolling over the same month
+	ARCHIVE_LOCK_ID = 7239001
+)
+
+// messageArchiveEnabled is set once the archive tables exist; until then messages are not archived
+var messageArchiveEnabled bool
+
+// archiveSchema creates message_archive, a module-owned copy of every chat message for compliance queries, and
+// message_archive_dumps, the monthly dumps older rows were rolled into. Edits replace the archived content;
+// deletions are recorded in deleted_at and deleted_by, keeping what moderators can still read of the message.
+var archiveSchema = []string{
+	`CREATE TABLE IF NOT EXISTS message_archive (
+		message_id  UUID PRIMARY KEY,
+		channel_id  VARCHAR(256) NOT NULL,
+		stream_mode SMALLINT NOT NULL,
+		sender_id   VARCHAR(64) NOT NULL DEFAULT '',
+		username    VARCHAR(128) NOT NULL DEFAULT '',
+		content     JSONB NOT NULL DEFAULT '{}',
+		create_time TIMESTAMPTZ NOT NULL,
+		update_time TIMESTAMPTZ NOT NULL,
+		deleted_at  TIMESTAMPTZ,
+		deleted_by  VARCHAR(64) NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS message_archive_channel_time_idx ON message_archive (channel_id, create_time DESC)`,
+	`CREATE INDEX IF NOT EXISTS message_archive_sender_time_idx ON message_archive (sender_id, create_time DESC)`,
+	`CREATE INDEX IF NOT EXISTS message_archive_time_idx ON message_archive (create_time)`,
+	`CREATE TABLE IF NOT EXISTS message_archive_dumps (
+		object_key  VARCHAR(256) PRIMARY KEY,
+		month       DATE NOT NULL,
+		row_count   BIGINT NOT NULL,
+		byte_count  BIGINT NOT NULL,
+		create_time TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS message_archive_dumps_month_idx ON message_archive_dumps (month DESC)`,
+}
+
+// archiveBackfill copies chat messages sent before the archive existed, using the same channel ID encoding as Nakama
+const archiveBackfill = `
+INSERT INTO message_archive (message_id, channel_id, stream_mode, sender_id, username, content, create_time, update_time)
+SELECT id, stream_mode::TEXT || '.' || subject || '.' || descriptor || '.' || stream_label, stream_mode, sender, username, content, create_time, update_time FROM (
+	SELECT id, stream_mode, stream_label, username, content, create_time, update_time,
+		CASE WHEN stream_subject::TEXT = '00000000-0000-0000-0000-000000000000' THEN '' ELSE stream_subject::TEXT END AS subject,
+		CASE WHEN stream_descriptor::TEXT = '00000000-0000-0000-0000-000000000000' THEN '' ELSE stream_descriptor::TEXT END AS descriptor,
+		CASE WHEN sender_id::TEXT = '00000000-0000-0000-0000-000000000000' THEN '' ELSE sender_id::TEXT END AS sender
+	FROM message WHERE code = 0
+) m
+ON CONFLICT (message_id) DO NOTHING`
+
+// ArchivedMessage is one line of a monthly dump
+type ArchivedMessage struct {
+	MessageID string          `json:"messageId"`
+	ChannelID string          `json:"channelId"`
+	SenderID  string          `json:"senderId"`
+	Username  string          `json:"username"`
+	Content   json.RawMessage `json:"content"`
+	CreatedAt int64           `json:"createdAt"`
+	UpdatedAt int64           `json:"updatedAt"`
+	DeletedAt int64           `json:"deletedAt,omitempty"`
+	DeletedBy string          `json:"deletedBy,omitempty"`
+}
+
+// ArchiveDump is a month of messages rolled out of the hot table into the archive bucket
+type ArchiveDump struct {
+	ObjectKey string `json:"objectKey"`
+	Month     string `json:"month"`
+	Rows      int64  `json:"rows"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// ArchiveStats describes the hot table and the dumps for archive_stats
+type ArchiveStats struct {
+	HotDays      int            `json:"hotDays"`
+	Bucket       string         `json:"bucket"`
+	HotRows      int64          `json:"hotRows"`
+	DeletedRows  int64          `json:"deletedRows"`
+	HotBytes     int64          `json:"hotBytes"`
+	OldestAt     int64          `json:"oldestAt,omitempty"`
+	NewestAt     int64          `json:"newestAt,omitempty"`
+	ColdRows     int64          `json:"coldRows"`
+	ColdBytes    int64          `json:"coldBytes"`
+	ColdDumps    int64          `json:"coldDumps"`
+	RecentDumps  []*ArchiveDump `json:"recentDumps,omitempty"`
+	RolledMonths []*ArchiveDump `json:"rolledMonths,omitempty"`
+}
+
+// ArchiveResponse represents the response for archive_stats
+type ArchiveResponse struct {
+	Success bool          `json:"success"`
+	Stats   *ArchiveStats `json:"stats,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Code    string        `json:"code,omitempty"`
+}
+
+// InitializeMessageArchive creates the archive tables and, when they are new, fills them from existing messages
+func InitializeMessageArchive(ctx context.Context, logger nkruntime.Logger, db *sql.DB) error {
+	var existing sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('message_archive')::TEXT").Scan(&existing); err != nil {
+		return fmt.Errorf("failed to check archive table: %v", err)
+	}
+	for _, statement := range archiveSchema {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create archive table: %v", err)
+		}
+	}
+	messageArchiveEnabled = true
+	if existing.Valid {
+		return nil
+	}
+
+	result, err := db.ExecContext(ctx, archiveBackfill)
+	if err != nil {
+		return fmt.Errorf("failed to archive existing messages: %v", err)
+	}
+	count, _ := result.RowsAffected()
+	logger.Info("Message archive created with %d existing messages", count)
+	return nil
+}
+
+// archiveSentMessage is the sent-message hook that copies a message into the archive
+func archiveSentMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage) {
+	if !messageArchiveEnabled {
+		return
+	}
+	ref, err := parseChannelID(message.ChannelID)
+	if err != nil {
+		return
+	}
+	if _, err := db.ExecContext(ctx, `
+INSERT INTO message_archive (message_id, channel_id, stream_mode, sender_id, username, content, create_time, update_time)
+VALUES ($1, $2, $3, $4, $5, $6::JSONB, to_timestamp($7), to_timestamp($7))
+ON CONFLICT (message_id) DO NOTHING`,
+		message.MessageID, message.ChannelID, ref.Mode, message.SenderID, message.Username, message.Content, message.CreatedAt,
+	); err != nil {
+		logger.Warn("Failed to archive message %s: %v", message.MessageID, err)
+	}
+}
+
+// archiveEditedMessage replaces the archived content of an edited message
+func archiveEditedMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, messageID string, content map[string]interface{}) {
+	if !messageArchiveEnabled {
+		return
+	}
+	encoded, _ := json.Marshal(content)
+	if _, err := db.ExecContext(ctx, "UPDATE message_archive SET content = $2::JSONB, update_time = now() WHERE message_id = $1", messageID, string(encoded)); err != nil {
+		logger.Warn("Failed to archive edit of message %s: %v", messageID, err)
+	}
+}
+
+// archiveDeletedMessage records a deletion in the archive. keptContent replaces the content, so what is erased
+// from the message's history, as on account deletion, is erased from the archive too.
+func archiveDeletedMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, messageID, deletedBy, keptContent string) {
+	if !messageArchiveEnabled {
+		return
+	}
+	if keptContent == "" || !json.Valid([]byte(keptContent)) {
+		keptContent = "{}"
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE message_archive SET content = $3::JSONB, deleted_at = now(), deleted_by = $2 WHERE message_id = $1",
+		messageID, deletedBy, keptContent); err != nil {
+		logger.Warn("Failed to archive deletion of message %s: %v", messageID, err)
+	}
+}
+
+// unarchiveMessage removes a message from the archive, for disappearing messages that must leave no copy
+func unarchiveMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, messageID string) {
+	if !messageArchiveEnabled {
+		return
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM message_archive WHERE message_id = $1", messageID); err != nil {
+		logger.Warn("Failed to unarchive message %s: %v", messageID, err)
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rollOverMonth moves the archived messages of one month into a gzipped JSON Lines dump in the archive bucket.
+// The rows are deleted in the transaction that records the dump, so a failed upload loses nothing. It returns
+// nil when another node holds the rollover lock.
+func rollOverMonth(ctx context.Context, db *sql.DB, backend StorageBackend, month time.Time) (*ArchiveDump, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", ARCHIVE_LOCK_ID).Scan(&locked); err != nil {
+		return nil, fmt.Errorf("failed to lock archive: %v", err)
+	}
+	if !locked {
+		return nil, nil
+	}
+
+	// Dumps can be large, so they are built on disk rather than in memory
+	file, err := os.CreateTemp("", "message-archive-*.jsonl.gz")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dump: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	end := month.AddDate(0, 1, 0)
+	rows, err := tx.QueryContext(ctx, `
+SELECT message_id::TEXT, channel_id, sender_id, username, content::TEXT, create_time, update_time, deleted_at, deleted_by
+FROM message_archive WHERE create_time >= $1 AND create_time < $2 ORDER BY create_time, message_id`, month, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archived messages: %v", err)
+	}
+	counter := &countingWriter{w: file}
+	gz := gzip.NewWriter(counter)
+	encoder := json.NewEncoder(gz)
+	var count int64
+	for rows.Next() {
+		var m ArchivedMessage
+		var content string
+		var createTime, updateTime time.Time
+		var deletedAt sql.NullTime
+		if err := rows.Scan(&m.MessageID, &m.ChannelID, &m.SenderID, &m.Username, &content, &createTime, &updateTime, &deletedAt, &m.DeletedBy); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read archived message: %v", err)
+		}
+		m.Content = json.RawMessage(content)
+		m.CreatedAt, m.UpdatedAt = createTime.Unix(), updateTime.Unix()
+		if deletedAt.Valid {
+			m.DeletedAt = deletedAt.Time.Unix()
+		}
+		if err := encoder.Encode(&m); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to write dump: %v", err)
+		}
+		count++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read archived messages: %v", err)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write dump: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to write dump: %v", err)
+	}
+
+	// The random part keeps dump keys from being guessed from the month and rollover time
+	now := time.Now()
+	dump := &ArchiveDump{
+		ObjectKey: fmt.Sprintf("messages/%s/%d-%s.jsonl.gz", month.Format("2006-01"), now.Unix(), uuid.New().String()),
+		Month:     month.Format("2006-01"),
+		Rows:      count,
+		Bytes:     counter.n,
+		CreatedAt: now.Unix(),
+	}
+	if err := backend.PutObject(ctx, serverConfig.ArchiveBucket, dump.ObjectKey, file, dump.Bytes, ARCHIVE_CONTENT_TYPE); err != nil {
+		return nil, fmt.Errorf("failed to upload dump: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM message_archive WHERE create_time >= $1 AND create_time < $2", month, end); err != nil {
+		return nil, fmt.Errorf("failed to remove archived messages: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO message_archive_dumps (object_key, month, row_count, byte_count, create_time) VALUES ($1, $2, $3, $4, $5)",
+		dump.ObjectKey, month, dump.Rows, dump.Bytes, now); err != nil {
+		return nil, fmt.Errorf("failed to record dump: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		// The object stays behind unreferenced, and the rows are dumped again by the next run
+		return nil, fmt.Errorf("failed to commit rollover: %v", err)
+	}
+	return dump, nil
+}
+
+// runArchiveRollover rolls every whole month older than ARCHIVE_HOT_DAYS out of the hot table, oldest first
+func runArchiveRollover(ctx context.Context, logger nkruntime.Logger, db *sql.DB) ([]*ArchiveDump, error) {
+	if !messageArchiveEnabled {
+		return nil, nil
+	}
+	cutoff := time.Now().UTC().AddDate(0, 0, -serverConfig.ArchiveHotDays)
+	// Only months that ended before the cutoff are rolled, so each month becomes one dump
+	before := time.Date(cutoff.Year(), cutoff.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	backend, err := getStorageBackend(logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize storage backend: %v", err)
+	}
+	if err := backend.EnsureBucket(ctx, logger, serverConfig.ArchiveBucket); err != nil {
+		return nil, fmt.Errorf("failed to ensure bucket exists: %v", err)
+	}
+
+	var dumps []*ArchiveDump
+	for {
+		var oldest sql.NullTime
+		if err := db.QueryRowContext(ctx, "SELECT min(create_time) FROM message_archive WHERE create_time < $1", before).Scan(&oldest); err != nil {
+			return dumps, fmt.Errorf("failed to find archived months: %v", err)
+		}
+		if !oldest.Valid {
+			return dumps, nil
+		}
+		t := oldest.Time.UTC()
+		month := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		dump, err := rollOverMonth(ctx, db, backend, month)
+		if err != nil {
+			return dumps, fmt.Errorf("failed to roll over %s: %v", month.Format("2006-01"), err)
+		}
+		if dump == nil {
+			// Another node is rolling over
+			return dumps, nil
+		}
+		logger.Info("Message archive %s rolled over: %d messages, %d bytes in %s", dump.Month, dump.Rows, dump.Bytes, dump.ObjectKey)
+		dumps = append(dumps, dump)
+	}
+}
+
+// StartArchiveRollover runs the rollover every ARCHIVE_INTERVAL_HOURS; 0 disables it
+func StartArchiveRollover(logger nkruntime.Logger, db *sql.DB) {
+	hours := serverConfig.ArchiveIntervalHours
+	if hours <= 0 || !messageArchiveEnabled {
+		logger.Info("Message archive rollover disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := runArchiveRollover(context.Background(), logger, db); err != nil {
+				logger.Error("Message archive rollover failed: %v", err)
+			}
+		}
+	}()
+	logger.Info("Message archive rollover scheduled every %d hours", hours)
+}
+
+// RpcArchiveStats describes the archive: the hot table and the monthly dumps. Admin only.
+// With "rollover": true it first rolls over the months that are due.
+func RpcArchiveStats(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(ArchiveResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+	if !messageArchiveEnabled {
+		return marshalResponse(ArchiveResponse{Success: false, Error: "Message archive is disabled", Code: ERROR_CODE_REJECTED})
+	}
+
+	var request struct {
+		Rollover bool `json:"rollover"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(ArchiveResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+
+	stats := &ArchiveStats{HotDays: serverConfig.ArchiveHotDays, Bucket: serverConfig.ArchiveBucket}
+	if request.Rollover {
+		dumps, err := runArchiveRollover(ctx, logger, db)
+		if err != nil {
+			return marshalResponse(ArchiveResponse{Success: false, Error: fmt.Sprintf("Archive rollover failed: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+		stats.RolledMonths = dumps
+	}
+
+	var oldest, newest sql.NullTime
+	if err := db.QueryRowContext(ctx, `
+SELECT count(*), count(deleted_at), min(create_time), max(create_time), pg_total_relation_size('message_archive')
+FROM message_archive`).Scan(&stats.HotRows, &stats.DeletedRows, &oldest, &newest, &stats.HotBytes); err != nil {
+		return marshalResponse(ArchiveResponse{Success: false, Error: fmt.Sprintf("Failed to read archive stats: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	if oldest.Valid {
+		stats.OldestAt, stats.NewestAt = oldest.Time.Unix(), newest.Time.Unix()
+	}
+	if err := db.QueryRowContext(ctx, "SELECT count(*), COALESCE(sum(row_count), 0), COALESCE(sum(byte_count), 0) FROM message_archive_dumps").
+		Scan(&stats.ColdDumps, &stats.ColdRows, &stats.ColdBytes); err != nil {
+		return marshalResponse(ArchiveResponse{Success: false, Error: fmt.Sprintf("Failed to read archive stats: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT object_key, month, row_count, byte_count, create_time FROM message_archive_dumps ORDER BY month DESC, create_time DESC LIMIT $1", ARCHIVE_STATS_DUMPS)
+	if err != nil {
+		return marshalResponse(ArchiveResponse{Success: false, Error: fmt.Sprintf("Failed to list archive dumps: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		dump := &ArchiveDump{}
+		var month, createTime time.Time
+		if err := rows.Scan(&dump.ObjectKey, &month, &dump.Rows, &dump.Bytes, &createTime); err != nil {
+			return marshalResponse(ArchiveResponse{Success: false, Error: fmt.Sprintf("Failed to list archive dumps: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+		dump.Month, dump.CreatedAt = month.Format("2006-01"), createTime.Unix()
+		stats.RecentDumps = append(stats.RecentDumps, dump)
+	}
+	return marshalResponse(ArchiveResponse{Success: true, Stats: stats})
+}
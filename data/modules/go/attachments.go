@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	ATTACHMENT_COLLECTION         = "attachments"
+	ATTACHMENT_LIST_DEFAULT_LIMIT = 50
+	ATTACHMENT_LIST_MAX_LIMIT     = 100
+)
+
+// Attachment records who uploaded an object, where it lives and which message references it
+type Attachment struct {
+	OwnerID     string                 `json:"ownerId"`
+	ObjectKey   string                 `json:"objectKey"`
+	Bucket      string                 `json:"bucket"`
+	ContentType string                 `json:"contentType"`
+	Size        int64                  `json:"size"`
+	ETag        string                 `json:"etag,omitempty"`
+	ChannelID   string                 `json:"channelId,omitempty"`
+	MessageID   string                 `json:"messageId,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt   int64                  `json:"createdAt"`
+	// ContentHash is the content_hashes key of inline uploads other uploads of the same bytes may share
+	ContentHash string `json:"contentHash,omitempty"`
+	// Envelope is set on end-to-end encrypted uploads, whose object is ciphertext the server cannot read
+	Envelope *KeyEnvelope `json:"envelope,omitempty"`
+	// DeletedAt marks a tombstone: the objects are gone and no new URLs are issued for them
+	DeletedAt int64  `json:"deletedAt,omitempty"`
+	DeletedBy string `json:"deletedBy,omitempty"`
+}
+
+// BucketOf returns the bucket one of ObjectKeys is stored in. Derivatives are images, so they stay in the image
+// bucket when the original went elsewhere.
+func (a *Attachment) BucketOf(key string) string {
+	if key == a.ObjectKey && a.Bucket != "" {
+		return a.Bucket
+	}
+	return bucketForKey(key)
+}
+
+// ObjectKeys lists the stored object and the derivatives recorded in its metadata (thumbnails, poster, variants).
+// Tombstones keep nothing alive.
+func (a *Attachment) ObjectKeys() []string {
+	if a.DeletedAt != 0 {
+		return nil
+	}
+	keys := []string{a.ObjectKey}
+	for _, field := range []string{"thumbnails", "variants"} {
+		switch derivatives := a.Metadata[field].(type) {
+		case map[string]string:
+			for _, key := range derivatives {
+				keys = append(keys, key)
+			}
+		case map[string]interface{}:
+			for _, key := range derivatives {
+				if s, ok := key.(string); ok {
+					keys = append(keys, s)
+				}
+			}
+		}
+	}
+	if poster, ok := a.Metadata["posterKey"].(string); ok {
+		keys = append(keys, poster)
+	}
+	return keys
+}
+
+// AttachmentListResponse represents the response for list_my_attachments
+type AttachmentListResponse struct {
+	Success     bool          `json:"success"`
+	Attachments []*Attachment `json:"attachments,omitempty"`
+	Cursor      string        `json:"cursor,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Code        string        `json:"code,omitempty"`
+}
+
+// objectOwner returns the user ID an object key was uploaded under, "" for server uploads ("anonymous/...")
+func objectOwner(objectKey string) string {
+	i := strings.Index(objectKey, "/")
+	if i <= 0 {
+		return ""
+	}
+	if _, err := uuid.Parse(objectKey[:i]); err != nil {
+		return ""
+	}
+	return objectKey[:i]
+}
+
+// attachmentKey derives the storage key from an object key; objects are stored as <ownerId>/<name>
+// so the name is unique within the owner's records
+func attachmentKey(objectKey string) string {
+	return path.Base(objectKey)
+}
+
+// attachmentWrite builds the storage write for an attachment, readable only by its owner
+func attachmentWrite(attachment *Attachment, version string) *nkruntime.StorageWrite {
+	value, _ := json.Marshal(attachment)
+	return &nkruntime.StorageWrite{
+		Collection:      ATTACHMENT_COLLECTION,
+		Key:             attachmentKey(attachment.ObjectKey),
+		UserID:          attachment.OwnerID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}
+}
+
+// saveAttachment records a successful upload
+func saveAttachment(ctx context.Context, nk nkruntime.NakamaModule, attachment *Attachment) error {
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{attachmentWrite(attachment, "")}); err != nil {
+		return err
+	}
+	countUpload(nk, attachment)
+	publishUpload(attachment)
+	return nil
+}
+
+// readAttachment loads the attachment record for an object, nil if there is none
+func readAttachment(ctx context.Context, nk nkruntime.NakamaModule, ownerID, objectKey string) (*Attachment, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{
+		Collection: ATTACHMENT_COLLECTION,
+		Key:        attachmentKey(objectKey),
+		UserID:     ownerID,
+	}})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	var attachment Attachment
+	if err := json.Unmarshal([]byte(objects[0].Value), &attachment); err != nil {
+		return nil, "", err
+	}
+	return &attachment, objects[0].Version, nil
+}
+
+// linkMessageAttachment stores the ID of the first message that references one of the sender's uploads
+func linkMessageAttachment(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, senderID, channelID, messageID, content string) {
+	var body struct {
+		ObjectKey string `json:"objectKey"`
+	}
+	if err := json.Unmarshal([]byte(content), &body); err != nil || body.ObjectKey == "" {
+		return
+	}
+	// Only the owner's own messages claim an attachment, forwarding someone else's object does not
+	if senderID == "" || !strings.HasPrefix(body.ObjectKey, senderID+"/") {
+		return
+	}
+
+	attachment, version, err := readAttachment(ctx, nk, senderID, body.ObjectKey)
+	if err != nil {
+		logger.Warn("Failed to read attachment %s: %v", body.ObjectKey, err)
+		return
+	}
+	if attachment == nil || attachment.MessageID != "" || attachment.DeletedAt != 0 {
+		return
+	}
+	attachment.MessageID = messageID
+	if attachment.ChannelID == "" {
+		attachment.ChannelID = channelID
+	}
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{attachmentWrite(attachment, version)}); err != nil {
+		logger.Warn("Failed to link attachment %s to message %s: %v", body.ObjectKey, messageID, err)
+	}
+}
+
+// linkSentAttachment is the sent-message hook that links attachments to the message that carried them
+func linkSentAttachment(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage) {
+	linkMessageAttachment(ctx, logger, nk, message.SenderID, message.ChannelID, message.MessageID, message.Content)
+}
+
+// RpcListMyAttachments pages through the caller's uploads
+func RpcListMyAttachments(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(AttachmentListResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Limit  int    `json:"limit"`
+		Cursor string `json:"cursor"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(AttachmentListResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.Limit <= 0 {
+		request.Limit = ATTACHMENT_LIST_DEFAULT_LIMIT
+	}
+	if request.Limit > ATTACHMENT_LIST_MAX_LIMIT {
+		request.Limit = ATTACHMENT_LIST_MAX_LIMIT
+	}
+
+	objects, cursor, err := nk.StorageList(ctx, userID, userID, ATTACHMENT_COLLECTION, request.Limit, request.Cursor)
+	if err != nil {
+		return marshalResponse(AttachmentListResponse{Success: false, Error: fmt.Sprintf("Failed to list attachments: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	attachments := make([]*Attachment, 0, len(objects))
+	for _, object := range objects {
+		var attachment Attachment
+		if err := json.Unmarshal([]byte(object.Value), &attachment); err != nil {
+			logger.Warn("Skipping unreadable attachment %s: %v", object.Key, err)
+			continue
+		}
+		if attachment.DeletedAt != 0 {
+			continue
+		}
+		attachments = append(attachments, &attachment)
+	}
+
+	return marshalResponse(AttachmentListResponse{Success: true, Attachments: attachments, Cursor: cursor})
+}
+
+// RpcDeleteImage removes an upload and its derivatives from storage and tombstones its attachment record.
+// Only the uploader or an admin may delete.
+func (s *Services) RpcDeleteImage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+
+	var request struct {
+		ObjectKey string `json:"objectKey"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ObjectKey == "" {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: "Missing required field: objectKey", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if isDerivativeKey(request.ObjectKey) {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: "Thumbnails and variants are deleted with their image, pass the original objectKey", Code: ERROR_CODE_REJECTED})
+	}
+
+	// Objects without an owning user (server uploads) can only be deleted by admins
+	ownerID := objectOwner(request.ObjectKey)
+	if (ownerID == "" || ownerID != userID) && !isAdmin(ctx) {
+		// Users whose upload was deduplicated to someone else's object delete their reference to it
+		if ownerID != "" && userID != "" {
+			return s.releaseSharedUpload(ctx, logger, nk, ownerID, request.ObjectKey, userID)
+		}
+		return marshalResponse(ImageUploadResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var attachment *Attachment
+	var version string
+	if ownerID != "" {
+		var err error
+		attachment, version, err = readAttachment(ctx, nk, ownerID, request.ObjectKey)
+		if err != nil {
+			return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to read attachment: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+		if attachment != nil && attachment.DeletedAt != 0 {
+			return marshalResponse(ImageUploadResponse{Success: true, ObjectKey: request.ObjectKey})
+		}
+	}
+	if attachment == nil {
+		// Uploads made before attachment records existed still get a tombstone
+		attachment = &Attachment{OwnerID: ownerID, ObjectKey: request.ObjectKey, Bucket: s.Config.bucketForKey(request.ObjectKey)}
+	}
+
+	if _, err := s.Storage.Backend(logger); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	if err := s.purgeAttachment(ctx, logger, nk, attachment, version, userID); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	logger.Info("Deleted %s (owner %s) by %s", request.ObjectKey, ownerID, userID)
+	return marshalResponse(ImageUploadResponse{Success: true, ObjectKey: request.ObjectKey})
+}
+
+// releaseSharedUpload answers delete_image for a user who does not own the object: if one of their uploads was
+// deduplicated to it, that reference is dropped, and the object is deleted once no references are left
+func (s *Services) releaseSharedUpload(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, ownerID, objectKey, userID string) (string, error) {
+	attachment, version, err := readAttachment(ctx, nk, ownerID, objectKey)
+	if err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to read attachment: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	if attachment == nil || attachment.DeletedAt != 0 || attachment.ContentHash == "" {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+	held, remaining, err := releaseContentHash(ctx, nk, attachment.ContentHash, objectKey, userID)
+	if err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if !held {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	if remaining == 0 {
+		if _, err := s.Storage.Backend(logger); err != nil {
+			return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+		}
+		if err := s.purgeAttachment(ctx, logger, nk, attachment, version, userID); err != nil {
+			return marshalResponse(ImageUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		logger.Info("Deleted %s (owner %s) with the last reference, held by %s", objectKey, ownerID, userID)
+	}
+	return marshalResponse(ImageUploadResponse{Success: true, ObjectKey: objectKey})
+}
+
+// purgeAttachment removes an attachment's objects from storage and tombstones its record
+func (s *Services) purgeAttachment(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, attachment *Attachment, version, deletedBy string) error {
+	// A deduplicated object stays while other uploads still refer to it, unless someone else (an admin) deletes it
+	if attachment.ContentHash != "" {
+		if deletedBy == "" || deletedBy == attachment.OwnerID {
+			_, remaining, err := releaseContentHash(ctx, nk, attachment.ContentHash, attachment.ObjectKey, attachment.OwnerID)
+			if err != nil {
+				return fmt.Errorf("Failed to release upload: %v", err)
+			}
+			if remaining > 0 {
+				return nil
+			}
+		} else {
+			forgetContentHash(ctx, logger, nk, attachment.ContentHash, attachment.ObjectKey)
+		}
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return errorWithCode(ERROR_CODE_STORAGE_UNAVAILABLE, "Failed to initialize storage backend: %v", err)
+	}
+	keys := attachment.ObjectKeys()
+	for _, key := range keys {
+		if err := backend.RemoveObject(ctx, attachment.BucketOf(key), key); err != nil {
+			return errorWithCode(ERROR_CODE_STORAGE_UNAVAILABLE, "Failed to delete object: %v", err)
+		}
+	}
+	forgetImageURLs(ctx, logger, nk, keys...)
+
+	if attachment.OwnerID != "" {
+		attachment.DeletedAt = s.Clock.Now().Unix()
+		attachment.DeletedBy = deletedBy
+		if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{attachmentWrite(attachment, version)}); err != nil {
+			return fmt.Errorf("Failed to record deletion: %v", err)
+		}
+	}
+	return nil
+}
+
+// isObjectDeleted reports whether an object key has been tombstoned by delete_image
+func isObjectDeleted(ctx context.Context, nk nkruntime.NakamaModule, objectKey string) (bool, error) {
+	ownerID := objectOwner(objectKey)
+	if ownerID == "" || isDerivativeKey(objectKey) {
+		return false, nil
+	}
+	attachment, _, err := readAttachment(ctx, nk, ownerID, objectKey)
+	if err != nil {
+		return false, err
+	}
+	return attachment != nil && attachment.DeletedAt != 0, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRpcDeleteImage(t *testing.T) {
+	objectKey := testOwnerID + "/1710072000000_photo.png"
+	thumbnail := THUMBNAIL_PREFIX + testOwnerID + "/1710072000000_photo_256.jpg"
+	tests := []struct {
+		name    string
+		env     map[string]string
+		setup   func(t *testing.T, h *testHarness)
+		userID  string
+		payload string
+		code    string
+		// removed is whether the objects are gone and the attachment is a tombstone afterwards
+		removed bool
+	}{
+		{name: "owner", userID: testOwnerID, payload: `{"objectKey":"` + objectKey + `"}`, removed: true},
+		{
+			name:    "admin",
+			env:     map[string]string{"ADMIN_USER_IDS": testAdminID},
+			userID:  testAdminID,
+			payload: `{"objectKey":"` + objectKey + `"}`,
+			removed: true,
+		},
+		{name: "another user", userID: testOtherID, payload: `{"objectKey":"` + objectKey + `"}`, code: ERROR_CODE_PERMISSION_DENIED},
+		{name: "server upload by a user", userID: testOwnerID, payload: `{"objectKey":"anonymous/1710072000000_photo.png"}`, code: ERROR_CODE_PERMISSION_DENIED},
+		{name: "thumbnail", userID: testOwnerID, payload: `{"objectKey":"` + thumbnail + `"}`, code: ERROR_CODE_REJECTED},
+		{name: "bad json", userID: testOwnerID, payload: `"`, code: ERROR_CODE_PAYLOAD_INVALID},
+		{name: "missing key", userID: testOwnerID, payload: `{}`, code: ERROR_CODE_PAYLOAD_INVALID},
+		{
+			name: "storage unavailable",
+			setup: func(t *testing.T, h *testHarness) {
+				h.services.Storage = fixedStorage{err: errors.New("no credentials")}
+			},
+			userID:  testOwnerID,
+			payload: `{"objectKey":"` + objectKey + `"}`,
+			code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+		},
+		{
+			name:    "remove fails",
+			setup:   func(t *testing.T, h *testHarness) { h.s3.failures["RemoveObject"] = errors.New("connection reset") },
+			userID:  testOwnerID,
+			payload: `{"objectKey":"` + objectKey + `"}`,
+			code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHarness(t, tt.env)
+			bucket := h.services.Config.Bucket
+			h.s3.seed(t, bucket, objectKey, testPNG(t))
+			h.s3.seed(t, bucket, thumbnail, testPNG(t))
+			h.saveAttachment(t, &Attachment{
+				OwnerID:     testOwnerID,
+				ObjectKey:   objectKey,
+				Bucket:      bucket,
+				ContentType: "image/png",
+				Metadata:    map[string]interface{}{"thumbnails": map[string]string{"256": thumbnail}},
+				CreatedAt:   testNow.Unix(),
+			})
+			if tt.setup != nil {
+				tt.setup(t, h)
+			}
+			h.clock.Advance(time.Hour)
+			out := h.call(t, h.services.RpcDeleteImage, tt.userID, tt.payload)
+			assertGolden(t, out)
+
+			if success, code := decodeResponse(t, out); success != (tt.code == "") || code != tt.code {
+				t.Fatalf("success = %v, code = %q, want code %q", success, code, tt.code)
+			}
+			for _, key := range []string{objectKey, thumbnail} {
+				if gone := h.s3.object(bucket, key) == nil; gone != tt.removed {
+					t.Errorf("%s removed = %v, want %v", key, gone, tt.removed)
+				}
+			}
+			attachment := h.nk.attachment(t, testOwnerID, objectKey)
+			if !tt.removed {
+				if attachment.DeletedAt != 0 {
+					t.Errorf("attachment was tombstoned: %+v", attachment)
+				}
+				return
+			}
+			if attachment.DeletedAt != h.clock.Now().Unix() || attachment.DeletedBy != tt.userID {
+				t.Errorf("tombstone = deleted at %d by %q, want at %d by %q", attachment.DeletedAt, attachment.DeletedBy, h.clock.Now().Unix(), tt.userID)
+			}
+
+			// Deleting again is a no-op that still succeeds
+			if success, code := decodeResponse(t, h.call(t, h.services.RpcDeleteImage, tt.userID, tt.payload)); !success {
+				t.Errorf("second delete failed with %s", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// audioFrame is one compressed packet on a clip's timeline.
+// Packet sizes follow loudness closely enough in VBR codecs to draw a waveform without decoding.
+type audioFrame struct {
+	Duration time.Duration
+	Bytes    int
+}
+
+// OPUS_SAMPLE_RATE is the rate Ogg Opus granule positions are counted in
+const OPUS_SAMPLE_RATE = 48000
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// opusPacketDuration reads the frame size and count from an Opus packet's TOC byte (RFC 6716 section 3.1)
+func opusPacketDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frame time.Duration
+	switch {
+	case config < 12:
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+	return frame * time.Duration(frames)
+}
+
+// probeOggOpus reads the pages of the first logical stream of an Ogg Opus file
+func probeOggOpus(rs io.Reader) (*MediaInfo, error) {
+	r := bufio.NewReader(rs)
+	info := &MediaInfo{Container: "ogg"}
+	header := make([]byte, 27)
+	segments := make([]byte, 255)
+	var serial uint32
+	var lastGranule int64 = -1
+	var preSkip int64
+	var packet []byte
+	packets := 0
+
+	for page := 0; ; page++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF && page > 0 {
+				break
+			}
+			return nil, errMediaUnsupported
+		}
+		if string(header[:4]) != "OggS" {
+			return nil, errMediaUnsupported
+		}
+		pageSerial := binary.LittleEndian.Uint32(header[14:18])
+		if page == 0 {
+			serial = pageSerial
+		}
+		count := int(header[26])
+		if _, err := io.ReadFull(r, segments[:count]); err != nil {
+			return nil, errMediaUnsupported
+		}
+		bodyLen := 0
+		for _, s := range segments[:count] {
+			bodyLen += int(s)
+		}
+		body := make([]byte, bodyLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, errMediaUnsupported
+		}
+		if pageSerial != serial {
+			continue
+		}
+		if granule := int64(binary.LittleEndian.Uint64(header[6:14])); granule != -1 {
+			lastGranule = granule
+		}
+
+		// Reassemble packets, a segment shorter than 255 bytes ends one
+		offset := 0
+		for _, s := range segments[:count] {
+			packet = append(packet, body[offset:offset+int(s)]...)
+			offset += int(s)
+			if s == 255 {
+				continue
+			}
+			switch packets {
+			case 0:
+				if len(packet) < 19 || string(packet[:8]) != "OpusHead" {
+					return nil, fmt.Errorf("only Opus is supported in Ogg")
+				}
+				preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+				info.AudioCodec = "opus"
+			case 1:
+				// OpusTags
+			default:
+				info.Frames = append(info.Frames, audioFrame{Duration: opusPacketDuration(packet), Bytes: len(packet)})
+			}
+			packets++
+			packet = packet[:0]
+		}
+	}
+
+	if info.AudioCodec == "" || lastGranule < preSkip {
+		return nil, errMediaUnsupported
+	}
+	info.Duration = time.Duration(lastGranule-preSkip) * time.Second / OPUS_SAMPLE_RATE
+	return info, nil
+}
+
+// probeADTS walks the frame headers of a raw AAC (ADTS) stream
+func probeADTS(rs io.Reader) (*MediaInfo, error) {
+	r := bufio.NewReader(rs)
+	info := &MediaInfo{Container: "adts", AudioCodec: "aac"}
+
+	// Some encoders prepend an ID3v2 tag
+	if head, err := r.Peek(10); err == nil && bytes.Equal(head[:3], []byte("ID3")) {
+		size := int(head[6])<<21 | int(head[7])<<14 | int(head[8])<<7 | int(head[9])
+		if _, err := r.Discard(10 + size); err != nil {
+			return nil, errMediaUnsupported
+		}
+	}
+
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errMediaUnsupported
+		}
+		if header[0] != 0xFF || header[1]&0xF0 != 0xF0 {
+			return nil, errMediaUnsupported
+		}
+		rateIndex := int(header[2]>>2) & 0x0F
+		if rateIndex >= len(adtsSampleRates) {
+			return nil, errMediaUnsupported
+		}
+		frameLength := int(header[3]&0x03)<<11 | int(header[4])<<3 | int(header[5])>>5
+		if frameLength < len(header) {
+			return nil, errMediaUnsupported
+		}
+		blocks := int(header[6]&0x03) + 1
+		duration := time.Duration(blocks*1024) * time.Second / time.Duration(adtsSampleRates[rateIndex])
+		info.Frames = append(info.Frames, audioFrame{Duration: duration, Bytes: frameLength})
+		info.Duration += duration
+		if _, err := r.Discard(frameLength - len(header)); err != nil {
+			return nil, errMediaUnsupported
+		}
+	}
+
+	if len(info.Frames) == 0 {
+		return nil, errMediaUnsupported
+	}
+	return info, nil
+}
+
+// mp4AudioFrames pairs the per-sample sizes (stsz) with the sample durations (stts) of an MP4 track
+func mp4AudioFrames(timescale uint32, stts, stsz []byte) []audioFrame {
+	if timescale == 0 || len(stts) < 8 || len(stsz) < 12 {
+		return nil
+	}
+	fixedSize := binary.BigEndian.Uint32(stsz[4:8])
+	count := int(binary.BigEndian.Uint32(stsz[8:12]))
+	if fixedSize == 0 && len(stsz) < 12+4*count {
+		return nil
+	}
+	if fixedSize != 0 && count > MEDIA_PROBE_MAX_HEADER {
+		return nil
+	}
+
+	frames := make([]audioFrame, 0, count)
+	entries := int(binary.BigEndian.Uint32(stts[4:8]))
+	for e := 0; e < entries && 16+8*e <= len(stts) && len(frames) < count; e++ {
+		samples := int(binary.BigEndian.Uint32(stts[8+8*e : 12+8*e]))
+		delta := binary.BigEndian.Uint32(stts[12+8*e : 16+8*e])
+		duration := time.Duration(delta) * time.Second / time.Duration(timescale)
+		for i := 0; i < samples && len(frames) < count; i++ {
+			size := fixedSize
+			if size == 0 {
+				n := len(frames)
+				size = binary.BigEndian.Uint32(stsz[12+4*n : 16+4*n])
+			}
+			frames = append(frames, audioFrame{Duration: duration, Bytes: int(size)})
+		}
+	}
+	return frames
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	AUDIT_DEFAULT_LIMIT = 50
+	AUDIT_MAX_LIMIT     = 200
+	AUDIT_RESULT_OK     = "ok"
+	// AUDIT_ACTION_ACCOUNT_DELETED is recorded by the deletion worker, which acts outside of any RPC
+	AUDIT_ACTION_ACCOUNT_DELETED = "account_deleted"
+)
+
+// AUDITED_RPCS are the privileged RPCs recorded in the audit log, with the payload field naming each one's target.
+// Every call is recorded, including refused ones, so attempts show up next to the actions that went through.
+var AUDITED_RPCS = map[string]string{
+	"delete_message":           "messageId",
+	"delete_image":             "objectKey",
+	"ban_user":                 "userId",
+	"unmute_user":              "userId",
+	"kick_member":              "userId",
+	"promote_admin":            "userId",
+	"transfer_ownership":       "userId",
+	"create_invite_link":       "groupId",
+	"revoke_invite_link":       "inviteId",
+	"resolve_report":           "reportId",
+	"set_channel_ttl":          "channelId",
+	"update_channel_settings":  "channelId",
+	"create_broadcast_channel": "name",
+	"set_broadcast_publishers": "groupId",
+	"schedule_event":           "title",
+	"cancel_event":             "eventId",
+	"award_event_points":       "userId",
+	"upload_sticker_pack":      "packId",
+	"list_reports":             "",
+	"list_flagged_uploads":     "",
+	"list_malware_incidents":   "",
+	"export_chat":              "channelId",
+	"request_account_deletion": "userId",
+	"reload_storage_backend":   "",
+	"run_orphan_gc":            "",
+	"archive_stats":            "",
+	"storage_health":           "",
+	"query_audit_log":          "",
+}
+
+// auditEnabled is set once the audit table exists; until then nothing is recorded
+var auditEnabled bool
+
+// auditSchema creates audit_log. The module only ever inserts into it; rows are never updated or deleted.
+var auditSchema = []string{
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id           UUID PRIMARY KEY,
+		action       VARCHAR(128) NOT NULL,
+		actor_id     VARCHAR(64) NOT NULL DEFAULT '',
+		target       VARCHAR(512) NOT NULL DEFAULT '',
+		payload_hash VARCHAR(64) NOT NULL DEFAULT '',
+		result       VARCHAR(32) NOT NULL DEFAULT '',
+		create_time  TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_time_idx ON audit_log (create_time DESC, id DESC)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_actor_time_idx ON audit_log (actor_id, create_time DESC, id DESC)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_target_time_idx ON audit_log (target, create_time DESC, id DESC)`,
+}
+
+// AuditEntry is one recorded action. ActorID is empty for server-to-server calls and background jobs.
+type AuditEntry struct {
+	ID          string `json:"id"`
+	Action      string `json:"action"`
+	ActorID     string `json:"actorId"`
+	Target      string `json:"target,omitempty"`
+	PayloadHash string `json:"payloadHash,omitempty"`
+	Result      string `json:"result"`
+	CreatedAt   int64  `json:"createdAt"`
+}
+
+// AuditLogResponse represents the response for query_audit_log
+type AuditLogResponse struct {
+	Success bool          `json:"success"`
+	Entries []*AuditEntry `json:"entries,omitempty"`
+	Cursor  string        `json:"cursor,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Code    string        `json:"code,omitempty"`
+}
+
+// auditCursor is the position after the last entry of a page; entries are ordered newest first
+type auditCursor struct {
+	CreateTime int64  `json:"t"`
+	ID         string `json:"id"`
+}
+
+// InitializeAuditLog creates the audit table
+func InitializeAuditLog(ctx context.Context, db *sql.DB) error {
+	for _, statement := range auditSchema {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create audit table: %v", err)
+		}
+	}
+	auditEnabled = true
+	return nil
+}
+
+// hashPayload returns the hex SHA-256 of an RPC payload, so entries can be matched to requests without storing them
+func hashPayload(payload string) string {
+	if payload == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordAudit appends an entry to the audit log
+func recordAudit(ctx context.Context, logger nkruntime.Logger, db *sql.DB, entry *AuditEntry) {
+	if !auditEnabled {
+		return
+	}
+	if _, err := db.ExecContext(ctx, `
+INSERT INTO audit_log (id, action, actor_id, target, payload_hash, result, create_time)
+VALUES ($1, $2, $3, $4, $5, $6, now())`,
+		uuid.New().String(), entry.Action, entry.ActorID, entry.Target, entry.PayloadHash, entry.Result,
+	); err != nil {
+		logger.Error("Failed to record %s by %q in the audit log: %v", entry.Action, entry.ActorID, err)
+	}
+}
+
+// auditTarget reads the target of an audited call from its payload
+func auditTarget(field, payload string) string {
+	if field == "" {
+		return ""
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return ""
+	}
+	target, _ := fields[field].(string)
+	return target
+}
+
+// withAudit records every call of an audited RPC with its outcome
+func withAudit(id string, fn rpcFunction) rpcFunction {
+	field, audited := AUDITED_RPCS[id]
+	if !audited {
+		return fn
+	}
+	return func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+		response, err := fn(ctx, logger, db, nk, payload)
+		result := responseCode(response, err)
+		if result == "" {
+			result = AUDIT_RESULT_OK
+		}
+		recordAudit(ctx, logger, db, &AuditEntry{
+			Action:      id,
+			ActorID:     userIDFromContext(ctx),
+			Target:      auditTarget(field, payload),
+			PayloadHash: hashPayload(payload),
+			Result:      result,
+		})
+		return response, err
+	}
+}
+
+// RpcQueryAuditLog lists audit entries newest first, filtered by action, actor, target and time range. Admins only.
+func RpcQueryAuditLog(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(AuditLogResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+	if !auditEnabled {
+		return marshalResponse(AuditLogResponse{Success: false, Error: "Audit log is unavailable", Code: ERROR_CODE_REJECTED})
+	}
+
+	var request struct {
+		Action  string `json:"action"`
+		ActorID string `json:"actorId"`
+		Target  string `json:"target"`
+		Result  string `json:"result"`
+		From    int64  `json:"from"`
+		To      int64  `json:"to"`
+		Limit   int    `json:"limit"`
+		Cursor  string `json:"cursor"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(AuditLogResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.Limit <= 0 {
+		request.Limit = AUDIT_DEFAULT_LIMIT
+	}
+	if request.Limit > AUDIT_MAX_LIMIT {
+		request.Limit = AUDIT_MAX_LIMIT
+	}
+
+	query := strings.Builder{}
+	query.WriteString("SELECT id::TEXT, action, actor_id, target, payload_hash, result, create_time FROM audit_log WHERE true")
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if request.Action != "" {
+		query.WriteString(" AND action = " + arg(request.Action))
+	}
+	if request.ActorID != "" {
+		query.WriteString(" AND actor_id = " + arg(request.ActorID))
+	}
+	if request.Target != "" {
+		query.WriteString(" AND target = " + arg(request.Target))
+	}
+	if request.Result != "" {
+		query.WriteString(" AND result = " + arg(request.Result))
+	}
+	if request.From > 0 {
+		query.WriteString(" AND create_time >= to_timestamp(" + arg(request.From) + ")")
+	}
+	if request.To > 0 {
+		query.WriteString(" AND create_time < to_timestamp(" + arg(request.To) + ")")
+	}
+	if request.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(request.Cursor)
+		var cursor auditCursor
+		if err == nil {
+			err = json.Unmarshal(raw, &cursor)
+		}
+		if err != nil || cursor.ID == "" {
+			return marshalResponse(AuditLogResponse{Success: false, Error: "Invalid cursor", Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		t := arg(time.UnixMicro(cursor.CreateTime).UTC())
+		query.WriteString(fmt.Sprintf(" AND (create_time < %s OR (create_time = %s AND id < %s))", t, t, arg(cursor.ID)))
+	}
+	// One extra row tells whether there is another page
+	query.WriteString(" ORDER BY create_time DESC, id DESC LIMIT " + arg(request.Limit+1))
+
+	rows, err := db.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		logger.Error("Audit log query failed: %v", err)
+		return marshalResponse(AuditLogResponse{Success: false, Error: "Failed to query audit log", Code: ERROR_CODE_INTERNAL})
+	}
+	defer rows.Close()
+
+	entries := make([]*AuditEntry, 0, request.Limit)
+	var last time.Time
+	next := ""
+	for rows.Next() {
+		if len(entries) == request.Limit {
+			encoded, _ := json.Marshal(auditCursor{CreateTime: last.UnixMicro(), ID: entries[len(entries)-1].ID})
+			next = base64.RawURLEncoding.EncodeToString(encoded)
+			break
+		}
+		var entry AuditEntry
+		if err := rows.Scan(&entry.ID, &entry.Action, &entry.ActorID, &entry.Target, &entry.PayloadHash, &entry.Result, &last); err != nil {
+			logger.Error("Failed to read audit entry: %v", err)
+			return marshalResponse(AuditLogResponse{Success: false, Error: "Failed to query audit log", Code: ERROR_CODE_INTERNAL})
+		}
+		entry.CreatedAt = last.Unix()
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("Audit log query failed: %v", err)
+		return marshalResponse(AuditLogResponse{Success: false, Error: "Failed to query audit log", Code: ERROR_CODE_INTERNAL})
+	}
+
+	return marshalResponse(AuditLogResponse{Success: true, Entries: entries, Cursor: next})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"strconv"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	AVATAR_COLLECTION   = "avatars"
+	AVATAR_KEY          = "current"
+	AVATAR_PREFIX       = "avatars/"
+	AVATAR_JPEG_QUALITY = 85
+	AVATAR_DEFAULT_SIZE = 256
+)
+
+// AVATAR_SIZES are the square renditions, in pixels, made of every avatar
+var AVATAR_SIZES = []int{64, 256}
+
+// Avatar is the per-user record of the current avatar objects, publicly readable
+type Avatar struct {
+	// ObjectKeys maps each size in AVATAR_SIZES, as a string, to its object key
+	ObjectKeys map[string]string `json:"objectKeys"`
+	UpdatedAt  int64             `json:"updatedAt"`
+}
+
+// AvatarResponse represents the response for set_avatar and get_avatar_url
+type AvatarResponse struct {
+	Success    bool              `json:"success"`
+	UserID     string            `json:"userId,omitempty"`
+	AvatarURL  string            `json:"avatarUrl,omitempty"`
+	ExpiresAt  int64             `json:"expiresAt,omitempty"`
+	ObjectKeys map[string]string `json:"objectKeys,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Code       string            `json:"code,omitempty"`
+}
+
+// readAvatar loads a user's avatar record, nil if they have none
+func readAvatar(ctx context.Context, nk nkruntime.NakamaModule, userID string) (*Avatar, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: AVATAR_COLLECTION, Key: AVATAR_KEY, UserID: userID}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read avatar: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	var avatar Avatar
+	if err := json.Unmarshal([]byte(objects[0].Value), &avatar); err != nil {
+		return nil, fmt.Errorf("failed to decode avatar: %v", err)
+	}
+	return &avatar, nil
+}
+
+// renderAvatar crops an image to its centered square and renders it as JPEG at every avatar size.
+// Transparent areas become white, since JPEG has no alpha channel.
+func renderAvatar(data []byte) (map[int][]byte, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	if format == "jpeg" {
+		src = orientImage(src, jpegOrientation(data))
+	}
+
+	square := cropSquare(src)
+	flat := image.NewRGBA(square.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), square, square.Bounds().Min, draw.Over)
+
+	renditions := make(map[int][]byte, len(AVATAR_SIZES))
+	for _, px := range AVATAR_SIZES {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeImage(flat, px, px), &jpeg.Options{Quality: AVATAR_JPEG_QUALITY}); err != nil {
+			return nil, fmt.Errorf("failed to encode %dpx avatar: %v", px, err)
+		}
+		renditions[px] = buf.Bytes()
+	}
+	return renditions, nil
+}
+
+// RpcSetAvatar makes one of the caller's uploaded images their avatar.
+// The image is cropped to a square, stored at every size under avatars/ and set as the account's avatar_url.
+func (s *Services) RpcSetAvatar(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(AvatarResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ObjectKey string `json:"objectKey"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ObjectKey == "" {
+		return marshalResponse(AvatarResponse{Success: false, Error: "Missing required field: objectKey", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	attachment, _, err := readAttachment(ctx, nk, userID, request.ObjectKey)
+	if err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("Failed to read upload: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	if attachment == nil || attachment.DeletedAt != 0 {
+		return marshalResponse(AvatarResponse{Success: false, Error: "Upload not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	if !isImageContentType(attachment.ContentType) {
+		return marshalResponse(AvatarResponse{Success: false, Error: "Avatar must be an image", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	object, err := backend.GetObject(ctx, attachment.Bucket, attachment.ObjectKey)
+	if err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("Failed to read image: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	data, err := io.ReadAll(io.LimitReader(object, s.Config.uploadMaxBytesFor(attachment.ContentType)))
+	object.Close()
+	if err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("Failed to read image: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	renditions, err := renderAvatar(data)
+	if err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	previous, err := readAvatar(ctx, nk, userID)
+	if err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	// Every avatar gets new keys so caches holding the old image never serve it for the new one
+	now := s.Clock.Now()
+	avatar := &Avatar{ObjectKeys: make(map[string]string, len(renditions)), UpdatedAt: now.Unix()}
+	for px, rendition := range renditions {
+		key := fmt.Sprintf("%s%s/%d_%d.jpg", AVATAR_PREFIX, userID, now.UnixNano(), px)
+		if err := backend.PutObject(ctx, s.Config.bucketForKey(key), key, bytes.NewReader(rendition), int64(len(rendition)), "image/jpeg"); err != nil {
+			return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("Failed to store avatar: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+		}
+		avatar.ObjectKeys[strconv.Itoa(px)] = key
+	}
+
+	value, _ := json.Marshal(avatar)
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      AVATAR_COLLECTION,
+		Key:             AVATAR_KEY,
+		UserID:          userID,
+		Value:           string(value),
+		PermissionRead:  2,
+		PermissionWrite: 0,
+	}}); err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("Failed to save avatar: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	// Like group avatars, the account stores the object key; clients resolve it with get_avatar_url
+	defaultKey := avatar.ObjectKeys[strconv.Itoa(AVATAR_DEFAULT_SIZE)]
+	if err := nk.AccountUpdateId(ctx, userID, "", nil, "", "", "", "", defaultKey); err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("Failed to update account: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	if previous != nil {
+		var keys []string
+		for _, key := range previous.ObjectKeys {
+			if err := backend.RemoveObject(ctx, s.Config.bucketForKey(key), key); err != nil {
+				logger.Warn("Failed to delete old avatar %s: %v", key, err)
+			}
+			keys = append(keys, key)
+		}
+		forgetImageURLs(ctx, logger, nk, keys...)
+	}
+
+	response := AvatarResponse{Success: true, UserID: userID, ObjectKeys: avatar.ObjectKeys}
+	if issued, err := s.presignImageURL(ctx, logger, nk, defaultKey); err != nil {
+		logger.Warn("Failed to sign avatar URL for %s: %v", userID, err)
+	} else {
+		response.AvatarURL, response.ExpiresAt = issued.URL, issued.ExpiresAt
+	}
+	logger.Info("Avatar of %s set from %s", userID, request.ObjectKey)
+	return marshalResponse(response)
+}
+
+// RpcGetAvatarUrl returns a signed URL for a user's avatar at 64 or 256 pixels, the caller's own by default
+func (s *Services) RpcGetAvatarUrl(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	var request struct {
+		UserID string `json:"userId"`
+		Size   int    `json:"size"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.UserID == "" {
+		request.UserID = userIDFromContext(ctx)
+	}
+	if request.UserID == "" {
+		return marshalResponse(AvatarResponse{Success: false, Error: "Missing required field: userId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Size == 0 {
+		request.Size = AVATAR_DEFAULT_SIZE
+	}
+
+	avatar, err := readAvatar(ctx, nk, request.UserID)
+	if err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if avatar == nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: "User has no avatar", Code: ERROR_CODE_REJECTED})
+	}
+	key, ok := avatar.ObjectKeys[strconv.Itoa(request.Size)]
+	if !ok {
+		return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("size must be one of %v", AVATAR_SIZES), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	if _, err := s.Storage.Backend(logger); err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	issued, err := s.presignImageURL(ctx, logger, nk, key)
+	if err != nil {
+		return marshalResponse(AvatarResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(AvatarResponse{Success: true, UserID: request.UserID, AvatarURL: issued.URL, ExpiresAt: issued.ExpiresAt, ObjectKeys: avatar.ObjectKeys})
+}
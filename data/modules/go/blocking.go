@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/heroiclabs/nakama-common/rtapi"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	BLOCK_COLLECTION     = "blocks"
+	BLOCK_KEY            = "users"
+	BLOCK_WRITE_ATTEMPTS = 3
+	BLOCK_MAX_USERS      = 1000
+
+	ERROR_CODE_USER_BLOCKED = "USER_BLOCKED"
+	// CHANNEL_JOIN_TYPE_DM is the ChannelJoin type of direct chats, whose target is the other user's ID
+	CHANNEL_JOIN_TYPE_DM = 2
+	// BLOCK_REJECT_STATUS is the grpc status (PERMISSION_DENIED) of socket errors for blocked direct chats
+	BLOCK_REJECT_STATUS = 7
+)
+
+// BlockList is the record of users someone has blocked
+type BlockList struct {
+	UserIDs []string `json:"userIds"`
+}
+
+// BlockResponse represents the response for blocking RPCs
+type BlockResponse struct {
+	Success        bool     `json:"success"`
+	BlockedUserIDs []string `json:"blockedUserIds"`
+	Error          string   `json:"error,omitempty"`
+	Code           string   `json:"code,omitempty"`
+}
+
+// readBlockList loads the users a user has blocked
+func readBlockList(ctx context.Context, nk nkruntime.NakamaModule, userID string) (*BlockList, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: BLOCK_COLLECTION, Key: BLOCK_KEY, UserID: userID}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read block list: %v", err)
+	}
+	list := &BlockList{UserIDs: []string{}}
+	if len(objects) == 0 {
+		return list, "", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), list); err != nil {
+		return nil, "", fmt.Errorf("failed to decode block list: %v", err)
+	}
+	return list, objects[0].Version, nil
+}
+
+// hasBlocked reports whether blockerID has blocked userID
+func hasBlocked(ctx context.Context, nk nkruntime.NakamaModule, blockerID, userID string) (bool, error) {
+	list, _, err := readBlockList(ctx, nk, blockerID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range list.UserIDs {
+		if id == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// updateBlockList applies fn to a user's block list, retrying on concurrent modification
+func updateBlockList(ctx context.Context, nk nkruntime.NakamaModule, userID string, fn func(*BlockList) error) (*BlockList, error) {
+	var lastErr error
+	for attempt := 0; attempt < BLOCK_WRITE_ATTEMPTS; attempt++ {
+		list, version, err := readBlockList(ctx, nk, userID)
+		if err != nil {
+			return nil, err
+		}
+		if version == "" {
+			version = "*"
+		}
+		if err := fn(list); err != nil {
+			return nil, err
+		}
+
+		value, _ := json.Marshal(list)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      BLOCK_COLLECTION,
+			Key:             BLOCK_KEY,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return list, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to update block list: %v", lastErr)
+}
+
+// parseBlockRequest decodes a {"userId"} payload
+func parseBlockRequest(payload string) (string, error) {
+	var request struct {
+		UserID string `json:"userId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return "", errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Failed to parse request: %v", err)
+	}
+	if request.UserID == "" {
+		return "", errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Missing required field: userId")
+	}
+	return request.UserID, nil
+}
+
+// RpcBlockUser stops a user from sending the caller direct messages or opening a direct chat with them
+func RpcBlockUser(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(BlockResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	targetID, err := parseBlockRequest(payload)
+	if err != nil {
+		return marshalResponse(BlockResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if targetID == userID {
+		return marshalResponse(BlockResponse{Success: false, Error: "You cannot block yourself", Code: ERROR_CODE_REJECTED})
+	}
+	if found, err := existingUsers(ctx, nk, []string{targetID}); err != nil || len(found) == 0 {
+		return marshalResponse(BlockResponse{Success: false, Error: "User not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	list, err := updateBlockList(ctx, nk, userID, func(l *BlockList) error {
+		for _, id := range l.UserIDs {
+			if id == targetID {
+				return nil
+			}
+		}
+		if len(l.UserIDs) >= BLOCK_MAX_USERS {
+			return errorWithCode(ERROR_CODE_REJECTED, "you can block at most %d users", BLOCK_MAX_USERS)
+		}
+		l.UserIDs = append(l.UserIDs, targetID)
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(BlockResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	// Mirror into Nakama's friend graph so friend lists show the user as blocked
+	if err := nk.FriendsBlock(ctx, userID, usernameFromContext(ctx), []string{targetID}, nil); err != nil {
+		logger.Warn("Failed to mark %s as blocked in friends of %s: %v", targetID, userID, err)
+	}
+	return marshalResponse(BlockResponse{Success: true, BlockedUserIDs: list.UserIDs})
+}
+
+// RpcUnblockUser lifts a block
+func RpcUnblockUser(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(BlockResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	targetID, err := parseBlockRequest(payload)
+	if err != nil {
+		return marshalResponse(BlockResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	removed := false
+	list, err := updateBlockList(ctx, nk, userID, func(l *BlockList) error {
+		removed = false
+		kept := make([]string, 0, len(l.UserIDs))
+		for _, id := range l.UserIDs {
+			if id == targetID {
+				removed = true
+				continue
+			}
+			kept = append(kept, id)
+		}
+		l.UserIDs = kept
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(BlockResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	if removed {
+		if err := nk.FriendsDelete(ctx, userID, usernameFromContext(ctx), []string{targetID}, nil); err != nil {
+			logger.Warn("Failed to clear block of %s in friends of %s: %v", targetID, userID, err)
+		}
+	}
+	return marshalResponse(BlockResponse{Success: true, BlockedUserIDs: list.UserIDs})
+}
+
+// RpcListBlockedUsers returns the IDs of the users the caller has blocked
+func RpcListBlockedUsers(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(BlockResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	list, _, err := readBlockList(ctx, nk, userID)
+	if err != nil {
+		return marshalResponse(BlockResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(BlockResponse{Success: true, BlockedUserIDs: list.UserIDs})
+}
+
+// checkBlocked is the send check that stops direct messages to someone who blocked the sender.
+// Group and room messages still go through; clients hide them.
+func checkBlocked(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, senderID, channelID string, content map[string]interface{}) (bool, error) {
+	peer := dmPeer(channelID, senderID)
+	if peer == "" || senderID == "" {
+		return false, nil
+	}
+	blocked, err := hasBlocked(ctx, nk, peer, senderID)
+	if err != nil {
+		logger.Warn("Failed to check blocks of %s: %v", peer, err)
+		return false, nil
+	}
+	if blocked {
+		return false, &MessageRejectedError{Code: ERROR_CODE_USER_BLOCKED, Message: "You cannot message this user"}
+	}
+	return false, nil
+}
+
+// BeforeChannelJoin refuses to open a direct chat with someone who blocked the caller
+func BeforeChannelJoin(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *rtapi.Envelope) (*rtapi.Envelope, error) {
+	join := in.GetChannelJoin()
+	userID := userIDFromContext(ctx)
+	if join == nil || join.Type != CHANNEL_JOIN_TYPE_DM || userID == "" {
+		return in, nil
+	}
+	blocked, err := hasBlocked(ctx, nk, join.Target, userID)
+	if err != nil {
+		logger.Warn("Failed to check blocks of %s: %v", join.Target, err)
+		return in, nil
+	}
+	if blocked {
+		body, _ := json.Marshal(&MessageRejectedError{Code: ERROR_CODE_USER_BLOCKED, Message: "You cannot message this user"})
+		return nil, nkruntime.NewError(string(body), BLOCK_REJECT_STATUS)
+	}
+	return in, nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	BROADCAST_COLLECTION            = "broadcast_channels"
+	BROADCAST_DEFAULT_MAX_COUNT     = 10000
+	BROADCAST_MAX_PUBLISHERS        = 50
+	BROADCAST_MAX_TITLE             = 100
+	BROADCAST_MAX_MESSAGE           = 4000
+	BROADCAST_LIST_DEFAULT_LIMIT    = 50
+	BROADCAST_LIST_MAX_LIMIT        = 100
+	BROADCAST_FANOUT_TIMEOUT        = 10 * time.Minute
+	NOTIFICATION_CODE_ANNOUNCEMENT  = 107
+	BROADCAST_ANNOUNCEMENT_MSG_TYPE = "announcement"
+)
+
+// BroadcastChannel is the public record of a broadcast channel, keyed by group ID. Who may post is kept in the
+// channel's settings, where the send checks look for it.
+type BroadcastChannel struct {
+	GroupID     string `json:"groupId"`
+	ChannelID   string `json:"channelId"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	CreatedBy   string `json:"createdBy"`
+	CreatedAt   int64  `json:"createdAt"`
+}
+
+// BroadcastResponse represents the response for broadcast channel RPCs
+type BroadcastResponse struct {
+	Success    bool                `json:"success"`
+	Channel    *BroadcastChannel   `json:"channel,omitempty"`
+	Channels   []*BroadcastChannel `json:"channels,omitempty"`
+	Publishers []string            `json:"publishers,omitempty"`
+	MessageID  string              `json:"messageId,omitempty"`
+	Cursor     string              `json:"cursor,omitempty"`
+	Code       string              `json:"code,omitempty"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// readBroadcastChannel loads the record of a broadcast channel, nil if the group is not one
+func readBroadcastChannel(ctx context.Context, nk nkruntime.NakamaModule, groupID string) (*BroadcastChannel, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: BROADCAST_COLLECTION, Key: groupID}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read broadcast channel: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	var channel BroadcastChannel
+	if err := json.Unmarshal([]byte(objects[0].Value), &channel); err != nil {
+		return nil, fmt.Errorf("failed to decode broadcast channel: %v", err)
+	}
+	return &channel, nil
+}
+
+// setBroadcastPublishers makes users the publishers of a broadcast channel. Posting in a group channel takes
+// membership, so publishers who are not members yet are added to the group.
+func setBroadcastPublishers(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, channel *BroadcastChannel, userIDs []string) ([]string, error) {
+	unique := make([]string, 0, len(userIDs))
+	seen := map[string]bool{}
+	for _, id := range userIDs {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	publishers := []string{}
+	if len(unique) > 0 {
+		var err error
+		if publishers, err = existingUsers(ctx, nk, unique); err != nil {
+			return nil, err
+		}
+	}
+	if len(publishers) != len(unique) {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Unknown user in publisherIds")
+	}
+
+	var joining []string
+	for _, id := range publishers {
+		if state, err := groupState(ctx, nk, channel.GroupID, id); err != nil || state < GROUP_STATE_SUPERADMIN || state > GROUP_STATE_MEMBER {
+			joining = append(joining, id)
+		}
+	}
+	if len(joining) > 0 {
+		// Added by the system, since server admins need not belong to the group themselves
+		if err := nk.GroupUsersAdd(ctx, "", channel.GroupID, joining); err != nil {
+			return nil, fmt.Errorf("failed to add publishers to the group: %v", err)
+		}
+		notifyGroupChange(ctx, logger, nk, channel.GroupID, "added", fmt.Sprintf("You can now post in %s", channel.Name), joining)
+	}
+
+	if _, err := updateChannelSettings(ctx, nk, channel.ChannelID, func(s *ChannelSettings) error {
+		s.PostPolicy = CHANNEL_POST_PUBLISHERS
+		s.Publishers = publishers
+		s.UpdatedBy = userIDFromContext(ctx)
+		s.UpdatedAt = time.Now().Unix()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return publishers, nil
+}
+
+// RpcCreateBroadcastChannel creates an open group whose channel only its publishers can post in. Subscribers join
+// it like any open group. Called server to server, ownerId names the account that owns the group. Admin only.
+func RpcCreateBroadcastChannel(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(BroadcastResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		Name         string   `json:"name"`
+		Description  string   `json:"description"`
+		OwnerID      string   `json:"ownerId"`
+		PublisherIDs []string `json:"publisherIds"`
+		MaxCount     int      `json:"maxCount"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		return marshalResponse(BroadcastResponse{Success: false, Error: "Missing required field: name", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Name) > GROUP_CHAT_MAX_NAME {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("name cannot exceed %d bytes", GROUP_CHAT_MAX_NAME), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.PublisherIDs) > BROADCAST_MAX_PUBLISHERS {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("At most %d publishers are allowed", BROADCAST_MAX_PUBLISHERS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	ownerID := userIDFromContext(ctx)
+	if ownerID == "" {
+		ownerID = request.OwnerID
+	}
+	if ownerID == "" {
+		return marshalResponse(BroadcastResponse{Success: false, Error: "Missing required field: ownerId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.MaxCount <= 0 {
+		request.MaxCount = BROADCAST_DEFAULT_MAX_COUNT
+	}
+
+	group, err := nk.GroupCreate(ctx, ownerID, request.Name, ownerID, "", request.Description, "", true, map[string]interface{}{"chat": true, "broadcast": true}, request.MaxCount)
+	if err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("Failed to create group: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	channel := &BroadcastChannel{
+		GroupID:     group.Id,
+		ChannelID:   groupChannelID(group.Id),
+		Name:        group.Name,
+		Description: request.Description,
+		CreatedBy:   ownerID,
+		CreatedAt:   time.Now().Unix(),
+	}
+	value, _ := json.Marshal(channel)
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      BROADCAST_COLLECTION,
+		Key:             group.Id,
+		Value:           string(value),
+		PermissionRead:  2,
+		PermissionWrite: 0,
+	}}); err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("Failed to save broadcast channel: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	// Announcements fan out to every subscriber themselves; the per-message pushes would repeat them
+	if _, err := updateChannelSettings(ctx, nk, channel.ChannelID, func(s *ChannelSettings) error {
+		s.NotificationLevel = CHANNEL_NOTIFY_NONE
+		return nil
+	}); err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	publishers, err := setBroadcastPublishers(ctx, logger, nk, channel, request.PublisherIDs)
+	if err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	logger.Info("Broadcast channel %s created by %s with %d publishers", group.Id, ownerID, len(publishers))
+	return marshalResponse(BroadcastResponse{Success: true, Channel: channel, Publishers: publishers})
+}
+
+// RpcSetBroadcastPublishers replaces the publishers of a broadcast channel. Admin only.
+func RpcSetBroadcastPublishers(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(BroadcastResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		GroupID      string   `json:"groupId"`
+		PublisherIDs []string `json:"publisherIds"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.GroupID == "" {
+		return marshalResponse(BroadcastResponse{Success: false, Error: "Missing required field: groupId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.PublisherIDs) > BROADCAST_MAX_PUBLISHERS {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("At most %d publishers are allowed", BROADCAST_MAX_PUBLISHERS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	channel, err := readBroadcastChannel(ctx, nk, request.GroupID)
+	if err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if channel == nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: "Broadcast channel not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	publishers, err := setBroadcastPublishers(ctx, logger, nk, channel, request.PublisherIDs)
+	if err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	logger.Info("Publishers of broadcast channel %s set by %s: %v", request.GroupID, userIDFromContext(ctx), publishers)
+	return marshalResponse(BroadcastResponse{Success: true, Channel: channel, Publishers: publishers})
+}
+
+// RpcListBroadcastChannels pages through the broadcast channels, for users to find ones to subscribe to
+func RpcListBroadcastChannels(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if userIDFromContext(ctx) == "" && !isAdmin(ctx) {
+		return marshalResponse(BroadcastResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Limit  int    `json:"limit"`
+		Cursor string `json:"cursor"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.Limit <= 0 {
+		request.Limit = BROADCAST_LIST_DEFAULT_LIMIT
+	}
+	if request.Limit > BROADCAST_LIST_MAX_LIMIT {
+		request.Limit = BROADCAST_LIST_MAX_LIMIT
+	}
+
+	objects, cursor, err := nk.StorageList(ctx, "", "", BROADCAST_COLLECTION, request.Limit, request.Cursor)
+	if err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("Failed to list broadcast channels: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	channels := make([]*BroadcastChannel, 0, len(objects))
+	for _, object := range objects {
+		var channel BroadcastChannel
+		if err := json.Unmarshal([]byte(object.Value), &channel); err != nil {
+			logger.Warn("Skipping unreadable broadcast channel %s: %v", object.Key, err)
+			continue
+		}
+		channels = append(channels, &channel)
+	}
+	return marshalResponse(BroadcastResponse{Success: true, Channels: channels, Cursor: cursor})
+}
+
+// RpcBroadcastAnnouncement posts an announcement to a broadcast channel and notifies every subscriber with a
+// persistent notification and a push. Publishers post as themselves; server to server calls post as the server.
+func RpcBroadcastAnnouncement(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" && !isAdmin(ctx) {
+		return marshalResponse(BroadcastResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		GroupID string `json:"groupId"`
+		Title   string `json:"title"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	request.Title = strings.TrimSpace(request.Title)
+	request.Message = strings.TrimSpace(request.Message)
+	if request.GroupID == "" || request.Message == "" {
+		return marshalResponse(BroadcastResponse{Success: false, Error: "Missing required fields: groupId or message", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Title) > BROADCAST_MAX_TITLE {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("title cannot exceed %d bytes", BROADCAST_MAX_TITLE), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Message) > BROADCAST_MAX_MESSAGE {
+		return marshalResponse(BroadcastResponse{Success: false, Error: fmt.Sprintf("message cannot exceed %d bytes", BROADCAST_MAX_MESSAGE), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	channel, err := readBroadcastChannel(ctx, nk, request.GroupID)
+	if err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if channel == nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: "Broadcast channel not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	content := map[string]interface{}{"type": BROADCAST_ANNOUNCEMENT_MSG_TYPE, "message": request.Message}
+	if request.Title != "" {
+		content["title"] = request.Title
+	}
+	// The send checks turn away anyone who is not a publisher
+	message, err := sendMessageAs(ctx, logger, db, nk, userID, usernameFromContext(ctx), channel.ChannelID, content)
+	if err != nil {
+		return marshalResponse(BroadcastResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	go fanOutAnnouncement(logger, nk, channel, message, request.Title, request.Message)
+
+	logger.Info("Announcement %s posted to broadcast channel %s by %s", message.MessageID, channel.GroupID, userID)
+	return marshalResponse(BroadcastResponse{Success: true, Channel: channel, MessageID: message.MessageID})
+}
+
+// fanOutAnnouncement notifies the subscribers of a broadcast channel of an announcement, a page of members at a
+// time. Unlike the pushes of ordinary messages it reaches every subscriber, online or not.
+func fanOutAnnouncement(logger nkruntime.Logger, nk nkruntime.NakamaModule, channel *BroadcastChannel, message *SentMessage, title, body string) {
+	ctx, cancel := context.WithTimeout(context.Background(), BROADCAST_FANOUT_TIMEOUT)
+	defer cancel()
+
+	subject := title
+	if subject == "" {
+		subject = fmt.Sprintf("New announcement in %s", channel.Name)
+	}
+	push := &PushMessage{
+		Title: subject,
+		Body:  truncateRunes(body, MESSAGE_PREVIEW_RUNES),
+		Data:  map[string]string{"channelId": channel.ChannelID, "messageId": message.MessageID, "groupId": channel.GroupID},
+	}
+
+	notified := 0
+	cursor := ""
+	for {
+		users, next, err := nk.GroupUsersList(ctx, channel.GroupID, GROUP_LIST_PAGE_SIZE, nil, cursor)
+		if err != nil {
+			logger.Error("Failed to list subscribers of %s, announcement %s reached %d: %v", channel.GroupID, message.MessageID, notified, err)
+			return
+		}
+		subscribers := make([]string, 0, len(users))
+		for _, u := range users {
+			if u.User != nil && u.State != nil && u.State.Value <= GROUP_STATE_MEMBER && u.User.Id != message.SenderID {
+				subscribers = append(subscribers, u.User.Id)
+			}
+		}
+
+		if len(subscribers) > 0 {
+			notifications := make([]*nkruntime.NotificationSend, 0, len(subscribers))
+			for _, id := range subscribers {
+				notifications = append(notifications, &nkruntime.NotificationSend{
+					UserID:  id,
+					Subject: subject,
+					Content: map[string]interface{}{
+						"groupId":   channel.GroupID,
+						"channelId": channel.ChannelID,
+						"messageId": message.MessageID,
+						"title":     title,
+						"message":   body,
+					},
+					Code:       NOTIFICATION_CODE_ANNOUNCEMENT,
+					Sender:     message.SenderID,
+					Persistent: true,
+				})
+			}
+			if err := nk.NotificationsSend(ctx, notifications); err != nil {
+				logger.Warn("Failed to notify subscribers of %s of announcement %s: %v", channel.GroupID, message.MessageID, err)
+			}
+			if len(pushProviders) > 0 {
+				if devices, _, err := readPushDevices(ctx, nk, subscribers); err != nil {
+					logger.Warn("Failed to load push tokens for announcement %s: %v", message.MessageID, err)
+				} else {
+					filterPushDevices(ctx, logger, nk, channel.ChannelID, devices, nil)
+					sendPushes(ctx, logger, nk, "announcement "+message.MessageID, devices, func(string) *PushMessage { return push })
+				}
+			}
+			notified += len(subscribers)
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	logger.Info("Announcement %s sent to %d subscribers of %s", message.MessageID, notified, channel.GroupID)
+}
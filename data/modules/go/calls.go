@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// CALL_MATCH_MODULE is the name the call match handler is registered under
+	CALL_MATCH_MODULE = "call"
+	CALL_TICK_RATE    = 5
+	// CALL_DEFAULT_MAX_PARTICIPANTS caps a call including the caller, overridable with CALL_MAX_PARTICIPANTS
+	CALL_DEFAULT_MAX_PARTICIPANTS = 8
+	// CALL_DEFAULT_RING_SECONDS is how long a call rings before it ends unanswered
+	CALL_DEFAULT_RING_SECONDS = 45
+	CALL_MAX_SIGNAL_BYTES     = 64 * 1024
+	NOTIFICATION_CODE_CALL    = 105
+
+	// Opcodes clients send. OFFER, ANSWER and ICE_CANDIDATE carry a "to" user ID and are relayed to that participant only.
+	CALL_OPCODE_OFFER         = 1
+	CALL_OPCODE_ANSWER        = 2
+	CALL_OPCODE_ICE_CANDIDATE = 3
+	CALL_OPCODE_MEDIA_STATE   = 4
+
+	// Opcodes the server sends
+	CALL_OPCODE_PARTICIPANTS        = 10
+	CALL_OPCODE_PARTICIPANT_JOINED  = 11
+	CALL_OPCODE_PARTICIPANT_LEFT    = 12
+	CALL_OPCODE_PARTICIPANT_UPDATED = 13
+	CALL_OPCODE_DECLINED            = 14
+	CALL_OPCODE_ENDED               = 15
+	CALL_OPCODE_ERROR               = 16
+
+	// Reasons a call ends with
+	CALL_END_COMPLETED = "completed"
+	CALL_END_CANCELLED = "cancelled"
+	CALL_END_DECLINED  = "declined"
+	CALL_END_NO_ANSWER = "no_answer"
+	CALL_END_SHUTDOWN  = "shutdown"
+)
+
+// CallConfig is what start_call passes to a new call match
+type CallConfig struct {
+	CallerID       string   `json:"callerId"`
+	CallerUsername string   `json:"callerUsername"`
+	ChannelID      string   `json:"channelId,omitempty"`
+	Video          bool     `json:"video"`
+	Invitees       []string `json:"invitees"`
+}
+
+// CallParticipant is someone connected to a call and the media they are sending
+type CallParticipant struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+	Audio    bool   `json:"audio"`
+	Video    bool   `json:"video"`
+	JoinedAt int64  `json:"joinedAt"`
+}
+
+// CallSnapshot is sent to a participant when they join
+type CallSnapshot struct {
+	MatchID      string             `json:"matchId"`
+	CallerID     string             `json:"callerId"`
+	ChannelID    string             `json:"channelId,omitempty"`
+	Video        bool               `json:"video"`
+	Participants []*CallParticipant `json:"participants"`
+	// Pending lists the invitees who have neither joined nor declined
+	Pending []string `json:"pending"`
+}
+
+// CallResponse represents the response for call RPCs
+type CallResponse struct {
+	Success bool   `json:"success"`
+	MatchID string `json:"matchId,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// callState is the state of a call match
+type callState struct {
+	matchID string
+	config  CallConfig
+	// invited holds everyone allowed to join, the caller included, minus those who declined
+	invited      map[string]bool
+	participants map[string]*CallParticipant
+	presences    map[string]nkruntime.Presence
+	// answered is set once a second participant has joined
+	answered   bool
+	ringUntil  int64
+	maxMembers int
+}
+
+func (s *callState) pending() []string {
+	pending := make([]string, 0, len(s.invited))
+	for _, id := range s.config.Invitees {
+		if s.invited[id] && s.participants[id] == nil {
+			pending = append(pending, id)
+		}
+	}
+	return pending
+}
+
+func (s *callState) snapshot() *CallSnapshot {
+	participants := make([]*CallParticipant, 0, len(s.participants))
+	for _, p := range s.participants {
+		participants = append(participants, p)
+	}
+	return &CallSnapshot{
+		MatchID:      s.matchID,
+		CallerID:     s.config.CallerID,
+		ChannelID:    s.config.ChannelID,
+		Video:        s.config.Video,
+		Participants: participants,
+		Pending:      s.pending(),
+	}
+}
+
+func (s *callState) presenceList() []nkruntime.Presence {
+	presences := make([]nkruntime.Presence, 0, len(s.presences))
+	for _, p := range s.presences {
+		presences = append(presences, p)
+	}
+	return presences
+}
+
+// broadcastCall sends a message to the given presences, or to everyone in the call when presences is nil
+func broadcastCall(logger nkruntime.Logger, dispatcher nkruntime.MatchDispatcher, opCode int64, message interface{}, presences []nkruntime.Presence) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		logger.Warn("Failed to encode call message: %v", err)
+		return
+	}
+	if err := dispatcher.BroadcastMessage(opCode, data, presences, nil, true); err != nil {
+		logger.Warn("Failed to send call message %d: %v", opCode, err)
+	}
+}
+
+// notifyCall sends a call notification to the given users
+func notifyCall(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, subject string, content map[string]interface{}, senderID string, persistent bool, userIDs []string) {
+	notifications := make([]*nkruntime.NotificationSend, 0, len(userIDs))
+	for _, id := range userIDs {
+		notifications = append(notifications, &nkruntime.NotificationSend{
+			UserID:     id,
+			Subject:    subject,
+			Content:    content,
+			Code:       NOTIFICATION_CODE_CALL,
+			Sender:     senderID,
+			Persistent: persistent,
+		})
+	}
+	if len(notifications) == 0 {
+		return
+	}
+	if err := nk.NotificationsSend(ctx, notifications); err != nil {
+		logger.Warn("Failed to send call notifications: %v", err)
+	}
+}
+
+// endCall tells everyone connected that the call is over and stops invitees' phones from ringing.
+// Returning its nil result from a match callback terminates the match.
+func endCall(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, dispatcher nkruntime.MatchDispatcher, s *callState, reason string) interface{} {
+	broadcastCall(logger, dispatcher, CALL_OPCODE_ENDED, map[string]interface{}{"reason": reason}, nil)
+
+	if pending := s.pending(); len(pending) > 0 {
+		subject := "Call ended"
+		if reason == CALL_END_NO_ANSWER {
+			subject = "Missed call"
+		}
+		content := map[string]interface{}{
+			"type":      "call_ended",
+			"matchId":   s.matchID,
+			"callerId":  s.config.CallerID,
+			"channelId": s.config.ChannelID,
+			"video":     s.config.Video,
+			"reason":    reason,
+		}
+		notifyCall(ctx, logger, nk, subject, content, s.config.CallerID, reason == CALL_END_NO_ANSWER, pending)
+	}
+
+	logger.Info("Call %s ended: %s", s.matchID, reason)
+	return nil
+}
+
+// CallMatch is the authoritative match handler for a voice or video call. It only admits invited users,
+// relays WebRTC signaling between participants and ends the call when it is no longer needed.
+type CallMatch struct{}
+
+// NewCallMatch creates the call match handler
+func NewCallMatch(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule) (nkruntime.Match, error) {
+	return &CallMatch{}, nil
+}
+
+func (m *CallMatch) MatchInit(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, params map[string]interface{}) (interface{}, int, string) {
+	var config CallConfig
+	if encoded, ok := params["config"].(string); ok {
+		if err := json.Unmarshal([]byte(encoded), &config); err != nil {
+			logger.Error("Failed to decode call config: %v", err)
+		}
+	}
+	matchID, _ := ctx.Value(nkruntime.RUNTIME_CTX_MATCH_ID).(string)
+
+	invited := make(map[string]bool, len(config.Invitees)+1)
+	invited[config.CallerID] = true
+	for _, id := range config.Invitees {
+		invited[id] = true
+	}
+
+	state := &callState{
+		matchID:      matchID,
+		config:       config,
+		invited:      invited,
+		participants: make(map[string]*CallParticipant),
+		presences:    make(map[string]nkruntime.Presence),
+		ringUntil:    int64(serverConfig.CallRingTimeoutSeconds * CALL_TICK_RATE),
+		maxMembers:   serverConfig.CallMaxParticipants,
+	}
+	label, _ := json.Marshal(map[string]string{"type": CALL_MATCH_MODULE})
+	return state, CALL_TICK_RATE, string(label)
+}
+
+func (m *CallMatch) MatchJoinAttempt(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, dispatcher nkruntime.MatchDispatcher, tick int64, state interface{}, presence nkruntime.Presence, metadata map[string]string) (interface{}, bool, string) {
+	s := state.(*callState)
+	userID := presence.GetUserId()
+	if !s.invited[userID] {
+		return s, false, "Not invited to this call"
+	}
+	if existing, ok := s.presences[userID]; ok && existing.GetSessionId() != presence.GetSessionId() {
+		return s, false, "Already in this call on another device"
+	}
+	if s.participants[userID] == nil && len(s.participants) >= s.maxMembers {
+		return s, false, "Call is full"
+	}
+	return s, true, ""
+}
+
+func (m *CallMatch) MatchJoin(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, dispatcher nkruntime.MatchDispatcher, tick int64, state interface{}, presences []nkruntime.Presence) interface{} {
+	s := state.(*callState)
+	for _, p := range presences {
+		participant := &CallParticipant{
+			UserID:   p.GetUserId(),
+			Username: p.GetUsername(),
+			Audio:    true,
+			Video:    s.config.Video,
+			JoinedAt: time.Now().Unix(),
+		}
+		others := s.presenceList()
+		s.participants[participant.UserID] = participant
+		s.presences[participant.UserID] = p
+		if len(s.participants) >= 2 {
+			s.answered = true
+		}
+
+		broadcastCall(logger, dispatcher, CALL_OPCODE_PARTICIPANTS, s.snapshot(), []nkruntime.Presence{p})
+		if len(others) > 0 {
+			broadcastCall(logger, dispatcher, CALL_OPCODE_PARTICIPANT_JOINED, participant, others)
+		}
+	}
+	return s
+}
+
+func (m *CallMatch) MatchLeave(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, dispatcher nkruntime.MatchDispatcher, tick int64, state interface{}, presences []nkruntime.Presence) interface{} {
+	s := state.(*callState)
+	for _, p := range presences {
+		userID := p.GetUserId()
+		if existing, ok := s.presences[userID]; !ok || existing.GetSessionId() != p.GetSessionId() {
+			continue
+		}
+		delete(s.presences, userID)
+		delete(s.participants, userID)
+		// Someone who hangs up is not rung again
+		delete(s.invited, userID)
+		broadcastCall(logger, dispatcher, CALL_OPCODE_PARTICIPANT_LEFT, map[string]string{"userId": userID}, nil)
+	}
+
+	if s.answered && len(s.participants) < 2 {
+		return endCall(ctx, logger, nk, dispatcher, s, CALL_END_COMPLETED)
+	}
+	if !s.answered && len(s.participants) == 0 {
+		return endCall(ctx, logger, nk, dispatcher, s, CALL_END_CANCELLED)
+	}
+	return s
+}
+
+func (m *CallMatch) MatchLoop(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, dispatcher nkruntime.MatchDispatcher, tick int64, state interface{}, messages []nkruntime.MatchData) interface{} {
+	s := state.(*callState)
+	if !s.answered && tick >= s.ringUntil {
+		return endCall(ctx, logger, nk, dispatcher, s, CALL_END_NO_ANSWER)
+	}
+
+	for _, message := range messages {
+		sender := []nkruntime.Presence{message}
+		switch message.GetOpCode() {
+		case CALL_OPCODE_OFFER, CALL_OPCODE_ANSWER, CALL_OPCODE_ICE_CANDIDATE:
+			if err := relayCallSignal(dispatcher, s, message); err != nil {
+				broadcastCall(logger, dispatcher, CALL_OPCODE_ERROR, map[string]interface{}{"opCode": message.GetOpCode(), "error": err.Error()}, sender)
+			}
+		case CALL_OPCODE_MEDIA_STATE:
+			participant := s.participants[message.GetUserId()]
+			var media struct {
+				Audio *bool `json:"audio"`
+				Video *bool `json:"video"`
+			}
+			if participant == nil || json.Unmarshal(message.GetData(), &media) != nil {
+				broadcastCall(logger, dispatcher, CALL_OPCODE_ERROR, map[string]interface{}{"opCode": message.GetOpCode(), "error": "Invalid media state"}, sender)
+				continue
+			}
+			if media.Audio != nil {
+				participant.Audio = *media.Audio
+			}
+			if media.Video != nil {
+				participant.Video = *media.Video
+			}
+			broadcastCall(logger, dispatcher, CALL_OPCODE_PARTICIPANT_UPDATED, participant, nil)
+		default:
+			broadcastCall(logger, dispatcher, CALL_OPCODE_ERROR, map[string]interface{}{"opCode": message.GetOpCode(), "error": "Unknown opcode"}, sender)
+		}
+	}
+	return s
+}
+
+// relayCallSignal forwards an offer, answer or ICE candidate to the participant named in its "to" field,
+// stamping it with the sender so a participant cannot pose as someone else
+func relayCallSignal(dispatcher nkruntime.MatchDispatcher, s *callState, message nkruntime.MatchData) error {
+	if len(message.GetData()) > CALL_MAX_SIGNAL_BYTES {
+		return errorWithCode(ERROR_CODE_PAYLOAD_TOO_LARGE, "Signal exceeds %d bytes", CALL_MAX_SIGNAL_BYTES)
+	}
+	var signal map[string]interface{}
+	if err := json.Unmarshal(message.GetData(), &signal); err != nil {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid signal: %v", err)
+	}
+	to, _ := signal["to"].(string)
+	target, ok := s.presences[to]
+	if !ok || to == message.GetUserId() {
+		return errorWithCode(ERROR_CODE_NOT_FOUND, "Participant not found")
+	}
+
+	signal["from"] = message.GetUserId()
+	data, err := json.Marshal(signal)
+	if err != nil {
+		return err
+	}
+	return dispatcher.BroadcastMessage(message.GetOpCode(), data, []nkruntime.Presence{target}, message, true)
+}
+
+func (m *CallMatch) MatchTerminate(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, dispatcher nkruntime.MatchDispatcher, tick int64, state interface{}, graceSeconds int) interface{} {
+	s := state.(*callState)
+	endCall(ctx, logger, nk, dispatcher, s, CALL_END_SHUTDOWN)
+	return s
+}
+
+// callSignalError is how MatchSignal refuses a signal: the code and message decline_call answers with
+func callSignalError(code, message string) string {
+	body, _ := json.Marshal(map[string]string{"code": code, "error": message})
+	return string(body)
+}
+
+// MatchSignal handles declines sent by decline_call as {"type": "decline", "userId": "..."}
+func (m *CallMatch) MatchSignal(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, dispatcher nkruntime.MatchDispatcher, tick int64, state interface{}, data string) (interface{}, string) {
+	s := state.(*callState)
+	var signal struct {
+		Type   string `json:"type"`
+		UserID string `json:"userId"`
+	}
+	if err := json.Unmarshal([]byte(data), &signal); err != nil || signal.Type != "decline" {
+		return s, callSignalError(ERROR_CODE_PAYLOAD_INVALID, "Unknown signal")
+	}
+	if !s.invited[signal.UserID] || signal.UserID == s.config.CallerID {
+		return s, callSignalError(ERROR_CODE_PERMISSION_DENIED, "Not invited to this call")
+	}
+	if s.participants[signal.UserID] != nil {
+		return s, callSignalError(ERROR_CODE_CONFLICT, "You have already joined this call")
+	}
+
+	delete(s.invited, signal.UserID)
+	broadcastCall(logger, dispatcher, CALL_OPCODE_DECLINED, map[string]string{"userId": signal.UserID}, nil)
+	if !s.answered && len(s.pending()) == 0 {
+		return endCall(ctx, logger, nk, dispatcher, s, CALL_END_DECLINED), ""
+	}
+	return s, ""
+}
+
+// RpcStartCall creates a call match and rings the invited users. The caller joins the returned matchId
+// over the socket like any invitee; the call ends if nobody answers within CALL_RING_TIMEOUT_SECONDS.
+func RpcStartCall(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(CallResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UserIDs   []string `json:"userIds"`
+		ChannelID string   `json:"channelId"`
+		Video     bool     `json:"video"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(CallResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	invitees := make([]string, 0, len(request.UserIDs))
+	seen := map[string]bool{userID: true}
+	for _, id := range request.UserIDs {
+		if !seen[id] {
+			seen[id] = true
+			invitees = append(invitees, id)
+		}
+	}
+	if len(invitees) == 0 {
+		return marshalResponse(CallResponse{Success: false, Error: "Missing required field: userIds", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if maxMembers := serverConfig.CallMaxParticipants; len(invitees) >= maxMembers {
+		return marshalResponse(CallResponse{Success: false, Error: fmt.Sprintf("At most %d users can be invited to a call", maxMembers-1), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	users, err := nk.UsersGetId(ctx, invitees, nil)
+	if err != nil {
+		return marshalResponse(CallResponse{Success: false, Error: fmt.Sprintf("Failed to look up users: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	if len(users) != len(invitees) {
+		return marshalResponse(CallResponse{Success: false, Error: "Unknown user in userIds", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	// A call started from a channel may only ring its members
+	if request.ChannelID != "" {
+		for _, id := range append([]string{userID}, invitees...) {
+			member, err := isChannelMember(ctx, nk, request.ChannelID, id)
+			if err != nil {
+				return marshalResponse(CallResponse{Success: false, Error: fmt.Sprintf("Invalid channelId: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+			}
+			if !member {
+				if id == userID {
+					return marshalResponse(CallResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+				}
+				return marshalResponse(CallResponse{Success: false, Error: fmt.Sprintf("User %s is not a member of this channel", id), Code: ERROR_CODE_REJECTED})
+			}
+		}
+	}
+
+	for _, id := range invitees {
+		blocked, err := hasBlocked(ctx, nk, id, userID)
+		if err != nil {
+			logger.Warn("Failed to check blocks of %s: %v", id, err)
+			continue
+		}
+		if blocked {
+			return marshalResponse(CallResponse{Success: false, Code: ERROR_CODE_USER_BLOCKED, Error: "You cannot call this user"})
+		}
+	}
+
+	config := CallConfig{
+		CallerID:       userID,
+		CallerUsername: usernameFromContext(ctx),
+		ChannelID:      request.ChannelID,
+		Video:          request.Video,
+		Invitees:       invitees,
+	}
+	encoded, _ := json.Marshal(config)
+	matchID, err := nk.MatchCreate(ctx, CALL_MATCH_MODULE, map[string]interface{}{"config": string(encoded)})
+	if err != nil {
+		return marshalResponse(CallResponse{Success: false, Error: fmt.Sprintf("Failed to create call: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	content := map[string]interface{}{
+		"type":           "call_invite",
+		"matchId":        matchID,
+		"callerId":       userID,
+		"callerUsername": config.CallerUsername,
+		"channelId":      request.ChannelID,
+		"video":          request.Video,
+		"participants":   append([]string{userID}, invitees...),
+	}
+	notifyCall(ctx, logger, nk, "Incoming call", content, userID, false, invitees)
+	logger.Info("Call %s started by %s with %d invitees", matchID, userID, len(invitees))
+
+	return marshalResponse(CallResponse{Success: true, MatchID: matchID})
+}
+
+// RpcDeclineCall turns down a call the caller was invited to. The call ends once every invitee has declined.
+func RpcDeclineCall(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(CallResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		MatchID string `json:"matchId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(CallResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.MatchID == "" {
+		return marshalResponse(CallResponse{Success: false, Error: "Missing required field: matchId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	signal, _ := json.Marshal(map[string]string{"type": "decline", "userId": userID})
+	result, err := nk.MatchSignal(ctx, request.MatchID, string(signal))
+	if err != nil {
+		return marshalResponse(CallResponse{Success: false, Error: "Call not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	if result != "" {
+		var refused struct {
+			Code  string `json:"code"`
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal([]byte(result), &refused)
+		return marshalResponse(CallResponse{Success: false, Error: refused.Error, Code: refused.Code})
+	}
+
+	return marshalResponse(CallResponse{Success: true, MatchID: request.MatchID})
+}
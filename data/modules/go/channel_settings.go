@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	CHANNEL_SETTINGS_COLLECTION     = "channel_settings"
+	CHANNEL_SETTINGS_WRITE_ATTEMPTS = 3
+	CHANNEL_SLOW_MODE_MAX           = 6 * 60 * 60
+
+	CHANNEL_POST_EVERYONE   = "everyone"
+	CHANNEL_POST_ADMINS     = "admins"
+	CHANNEL_POST_PUBLISHERS = "publishers"
+
+	CHANNEL_NOTIFY_ALL      = "all"
+	CHANNEL_NOTIFY_MENTIONS = "mentions"
+	CHANNEL_NOTIFY_NONE     = "none"
+
+	ERROR_CODE_SLOW_MODE          = "SLOW_MODE"
+	ERROR_CODE_POSTING_RESTRICTED = "POSTING_RESTRICTED"
+)
+
+// ChannelSettings is the server-side configuration of a channel, keyed by channel ID
+type ChannelSettings struct {
+	ChannelID string `json:"channelId"`
+	// MessageTTL is how many seconds messages live before the sweeper deletes them, 0 keeps them forever
+	MessageTTL int64 `json:"messageTtl,omitempty"`
+	// SlowModeSeconds is how long members wait between two messages, 0 turns slow mode off. Channel admins are exempt.
+	SlowModeSeconds int64 `json:"slowModeSeconds,omitempty"`
+	// PostPolicy is who may post: everyone (the default), only channel admins, or only the publishers of a
+	// broadcast channel
+	PostPolicy string `json:"postPolicy,omitempty"`
+	// Publishers are the users who may post in a broadcast channel, set by set_broadcast_publishers
+	Publishers []string `json:"publishers,omitempty"`
+	// NotificationLevel is which messages are pushed to members: all (the default), mentions only, or none
+	NotificationLevel string `json:"notificationLevel,omitempty"`
+	UpdatedBy         string `json:"updatedBy,omitempty"`
+	UpdatedAt         int64  `json:"updatedAt,omitempty"`
+}
+
+// ChannelSettingsResponse represents the response for get_channel_settings and update_channel_settings
+type ChannelSettingsResponse struct {
+	Success  bool             `json:"success"`
+	Settings *ChannelSettings `json:"settings,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Code     string           `json:"code,omitempty"`
+}
+
+// withDefaults fills in the default of every unset setting, for clients
+func (s *ChannelSettings) withDefaults() *ChannelSettings {
+	settings := *s
+	if settings.PostPolicy == "" {
+		settings.PostPolicy = CHANNEL_POST_EVERYONE
+	}
+	if settings.NotificationLevel == "" {
+		settings.NotificationLevel = CHANNEL_NOTIFY_ALL
+	}
+	return &settings
+}
+
+// isPublisher reports whether a user may post in a broadcast channel
+func (s *ChannelSettings) isPublisher(userID string) bool {
+	for _, id := range s.Publishers {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// readChannelSettings loads a channel's settings, defaults if none were saved
+func readChannelSettings(ctx context.Context, nk nkruntime.NakamaModule, channelID string) (*ChannelSettings, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: CHANNEL_SETTINGS_COLLECTION, Key: channelID}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read channel settings: %v", err)
+	}
+	settings := &ChannelSettings{ChannelID: channelID}
+	if len(objects) == 0 {
+		return settings, "", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), settings); err != nil {
+		return nil, "", fmt.Errorf("failed to decode channel settings: %v", err)
+	}
+	return settings, objects[0].Version, nil
+}
+
+// updateChannelSettings applies fn to a channel's settings, retrying on concurrent modification
+func updateChannelSettings(ctx context.Context, nk nkruntime.NakamaModule, channelID string, fn func(*ChannelSettings) error) (*ChannelSettings, error) {
+	var lastErr error
+	for attempt := 0; attempt < CHANNEL_SETTINGS_WRITE_ATTEMPTS; attempt++ {
+		settings, version, err := readChannelSettings(ctx, nk, channelID)
+		if err != nil {
+			return nil, err
+		}
+		if version == "" {
+			version = "*"
+		}
+		if err := fn(settings); err != nil {
+			return nil, err
+		}
+
+		value, _ := json.Marshal(settings)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      CHANNEL_SETTINGS_COLLECTION,
+			Key:             channelID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return settings, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to update channel settings: %v", lastErr)
+}
+
+// canAdministerChannel reports whether a user may change a channel's settings:
+// either participant of a direct chat, group admins, and server admins anywhere
+func canAdministerChannel(ctx context.Context, nk nkruntime.NakamaModule, channelID, userID string) bool {
+	ref, err := parseChannelID(channelID)
+	if err != nil {
+		return false
+	}
+	if ref.Mode == STREAM_MODE_DM && (ref.Subject == userID || ref.Subcontext == userID) {
+		return true
+	}
+	return canModerateChannel(ctx, nk, channelID, userID)
+}
+
+// slowModeLimiter remembers when each user last posted in each slow mode channel
+type slowModeLimiter struct {
+	mu        sync.Mutex
+	last      map[string]time.Time
+	lastPrune time.Time
+}
+
+var slowModeState = &slowModeLimiter{last: map[string]time.Time{}}
+
+// allow records a message if interval has passed since the user's last one in the channel, and otherwise
+// returns how long they still have to wait
+func (l *slowModeLimiter) allow(userID, channelID string, interval time.Duration, now time.Time) (bool, time.Duration) {
+	key := userID + "|" + channelID
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > CHANNEL_SLOW_MODE_MAX*time.Second {
+		for k, t := range l.last {
+			if now.Sub(t) > CHANNEL_SLOW_MODE_MAX*time.Second {
+				delete(l.last, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	if last, ok := l.last[key]; ok && now.Sub(last) < interval {
+		return false, interval - now.Sub(last)
+	}
+	l.last[key] = now
+	return true, 0
+}
+
+// checkChannelPolicy is the send check that enforces a channel's post policy and slow mode. It runs last,
+// so a message rejected by another check does not use up the sender's slow mode slot.
+func checkChannelPolicy(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, senderID, channelID string, content map[string]interface{}) (bool, error) {
+	// Server messages (announcements, event results) are never restricted
+	if senderID == "" {
+		return false, nil
+	}
+	settings, _, err := readChannelSettings(ctx, nk, channelID)
+	if err != nil {
+		logger.Warn("Failed to check settings of %s: %v", channelID, err)
+		return false, nil
+	}
+	if settings.PostPolicy == CHANNEL_POST_PUBLISHERS {
+		if !settings.isPublisher(senderID) {
+			return false, &MessageRejectedError{Code: ERROR_CODE_POSTING_RESTRICTED, Message: "Only publishers can post in this channel"}
+		}
+		return false, nil
+	}
+	if settings.PostPolicy != CHANNEL_POST_ADMINS && settings.SlowModeSeconds <= 0 {
+		return false, nil
+	}
+	if canAdministerChannel(ctx, nk, channelID, senderID) {
+		return false, nil
+	}
+
+	if settings.PostPolicy == CHANNEL_POST_ADMINS {
+		return false, &MessageRejectedError{Code: ERROR_CODE_POSTING_RESTRICTED, Message: "Only channel admins can post in this channel"}
+	}
+	if ok, wait := slowModeState.allow(senderID, channelID, time.Duration(settings.SlowModeSeconds)*time.Second, time.Now()); !ok {
+		seconds := int64((wait + time.Second - 1) / time.Second)
+		return false, &MessageRejectedError{Code: ERROR_CODE_SLOW_MODE, Message: fmt.Sprintf("Slow mode is on, wait %d seconds", seconds), RetryAfter: seconds}
+	}
+	return false, nil
+}
+
+// RpcGetChannelSettings returns a channel's settings to its members
+func RpcGetChannelSettings(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: "Missing required field: channelId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil || !member {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+
+	settings, _, err := readChannelSettings(ctx, nk, request.ChannelID)
+	if err != nil {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(ChannelSettingsResponse{Success: true, Settings: settings.withDefaults()})
+}
+
+// RpcUpdateChannelSettings changes the settings given in the request and keeps the others. Channel admins only.
+func RpcUpdateChannelSettings(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" && !isAdmin(ctx) {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID         string  `json:"channelId"`
+		MessageTTL        *int64  `json:"messageTtl"`
+		SlowModeSeconds   *int64  `json:"slowModeSeconds"`
+		PostPolicy        *string `json:"postPolicy"`
+		NotificationLevel *string `json:"notificationLevel"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: "Missing required field: channelId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if ttl := request.MessageTTL; ttl != nil && *ttl != 0 && (*ttl < CHANNEL_TTL_MIN || *ttl > CHANNEL_TTL_MAX) {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: fmt.Sprintf("messageTtl must be 0 or between %d and %d", CHANNEL_TTL_MIN, CHANNEL_TTL_MAX), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if slow := request.SlowModeSeconds; slow != nil && (*slow < 0 || *slow > CHANNEL_SLOW_MODE_MAX) {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: fmt.Sprintf("slowModeSeconds must be between 0 and %d", CHANNEL_SLOW_MODE_MAX), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if policy := request.PostPolicy; policy != nil && *policy != CHANNEL_POST_EVERYONE && *policy != CHANNEL_POST_ADMINS {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: fmt.Sprintf("postPolicy must be %s or %s", CHANNEL_POST_EVERYONE, CHANNEL_POST_ADMINS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if level := request.NotificationLevel; level != nil && *level != CHANNEL_NOTIFY_ALL && *level != CHANNEL_NOTIFY_MENTIONS && *level != CHANNEL_NOTIFY_NONE {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: fmt.Sprintf("notificationLevel must be %s, %s or %s", CHANNEL_NOTIFY_ALL, CHANNEL_NOTIFY_MENTIONS, CHANNEL_NOTIFY_NONE), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if !canAdministerChannel(ctx, nk, request.ChannelID, userID) {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	settings, err := updateChannelSettings(ctx, nk, request.ChannelID, func(s *ChannelSettings) error {
+		if request.MessageTTL != nil {
+			s.MessageTTL = *request.MessageTTL
+		}
+		if request.SlowModeSeconds != nil {
+			s.SlowModeSeconds = *request.SlowModeSeconds
+		}
+		if request.PostPolicy != nil {
+			// Broadcast channels are set up by server admins and stay that way for group admins
+			if s.PostPolicy == CHANNEL_POST_PUBLISHERS && !isAdmin(ctx) {
+				return errorWithCode(ERROR_CODE_PERMISSION_DENIED, "Permission denied")
+			}
+			s.PostPolicy = *request.PostPolicy
+			s.Publishers = nil
+		}
+		if request.NotificationLevel != nil {
+			s.NotificationLevel = *request.NotificationLevel
+		}
+		s.UpdatedBy = userID
+		s.UpdatedAt = time.Now().Unix()
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(ChannelSettingsResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	event := &ChannelEvent{
+		Type:      "settings_changed",
+		ChannelID: request.ChannelID,
+		SenderID:  userID,
+		Username:  usernameFromContext(ctx),
+		Content:   settings.withDefaults(),
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := sendChannelEvent(nk, event); err != nil {
+		logger.Warn("Failed to send settings_changed event for %s: %v", request.ChannelID, err)
+	}
+
+	logger.Info("Settings of %s updated by %s", request.ChannelID, userID)
+	return marshalResponse(ChannelSettingsResponse{Success: true, Settings: settings.withDefaults()})
+}
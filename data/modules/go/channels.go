@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/heroiclabs/nakama-common/rtapi"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Group membership states as reported by Nakama
+const (
+	GROUP_STATE_SUPERADMIN   = 0
+	GROUP_STATE_ADMIN        = 1
+	GROUP_STATE_MEMBER       = 2
+	GROUP_STATE_JOIN_REQUEST = 3
+	GROUP_LIST_PAGE_SIZE     = 100
+)
+
+// MESSAGE_TEXT_FIELDS are the message content fields that carry user-written text
+var MESSAGE_TEXT_FIELDS = []string{"message", "text", "caption"}
+
+// MESSAGE_PREVIEW_RUNES is the length of message previews in notifications
+const MESSAGE_PREVIEW_RUNES = 100
+
+// SentMessage is a chat message that has just been delivered, over the socket or by the server
+type SentMessage struct {
+	ChannelID string
+	MessageID string
+	SenderID  string
+	Username  string
+	Content   string
+	CreatedAt int64
+}
+
+// MessageRejectedError is returned by a send check when a message must not be sent
+type MessageRejectedError struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Terms   []string `json:"terms,omitempty"`
+	// RetryAfter is how many seconds to wait before the message may be sent again
+	RetryAfter int64 `json:"retryAfter,omitempty"`
+}
+
+func (e *MessageRejectedError) Error() string { return e.Message }
+
+// MESSAGE_REJECT_STATUS is the grpc status (INVALID_ARGUMENT) of socket errors for rejected messages
+const MESSAGE_REJECT_STATUS = 3
+
+// sendCheck inspects a message before it is sent. It may change content in place and reports whether it did;
+// a *MessageRejectedError stops the message.
+type sendCheck func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, senderID, channelID string, content map[string]interface{}) (bool, error)
+
+// SEND_CHECKS run in order before every message, over the socket and in flush_outbox
+var SEND_CHECKS = []sendCheck{
+	stripLinkPreview,
+	checkBlocked,
+	checkReplyTo,
+	filterProfanity,
+	checkChannelPolicy,
+	checkSpam,
+	chargePremiumSticker,
+}
+
+// sentMessageHook reacts to a delivered message; failures are logged, the message is already sent
+type sentMessageHook func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage)
+
+// SENT_MESSAGE_HOOKS run in order after every message. Nakama allows one after-hook per message type,
+// so AfterChannelMessageSend and server-side senders dispatch through this list.
+var SENT_MESSAGE_HOOKS = []sentMessageHook{
+	linkSentAttachment,
+	notifyMentions,
+	trackThreadReply,
+	pushSentMessage,
+	indexSentMessage,
+	archiveSentMessage,
+	unfurlSentMessage,
+	publishSentMessage,
+	recordActivity,
+}
+
+// ChannelRef is a parsed chat channel ID in Nakama's "mode.subject.subcontext.label" format
+type ChannelRef struct {
+	Mode       uint8
+	Subject    string
+	Subcontext string
+	Label      string
+}
+
+// ChannelEvent is a live update that is not a chat message (reactions, typing, receipts) sent over a channel's stream
+type ChannelEvent struct {
+	Type      string      `json:"type"`
+	ChannelID string      `json:"channelId"`
+	MessageID string      `json:"messageId,omitempty"`
+	SenderID  string      `json:"senderId,omitempty"`
+	Username  string      `json:"username,omitempty"`
+	Content   interface{} `json:"content,omitempty"`
+	CreatedAt int64       `json:"createdAt"`
+}
+
+// parseChannelID splits a channel ID into its stream components
+func parseChannelID(channelID string) (*ChannelRef, error) {
+	parts := strings.SplitN(channelID, ".", 4)
+	if len(parts) != 4 {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "invalid channel id")
+	}
+	mode, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "invalid channel id")
+	}
+
+	ref := &ChannelRef{Mode: uint8(mode), Subject: parts[1], Subcontext: parts[2], Label: parts[3]}
+	switch ref.Mode {
+	case STREAM_MODE_CHANNEL:
+		if ref.Label == "" {
+			return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "invalid room channel id")
+		}
+	case STREAM_MODE_GROUP:
+		if ref.Subject == "" {
+			return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "invalid group channel id")
+		}
+	case STREAM_MODE_DM:
+		if ref.Subject == "" || ref.Subcontext == "" {
+			return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "invalid direct channel id")
+		}
+	default:
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "unsupported channel type")
+	}
+	return ref, nil
+}
+
+// ID formats the reference back into a channel ID
+func (c *ChannelRef) ID() string {
+	return fmt.Sprintf("%d.%s.%s.%s", c.Mode, c.Subject, c.Subcontext, c.Label)
+}
+
+// groupState returns the caller's membership state in a group, or -1 if they are not in it
+func groupState(ctx context.Context, nk nkruntime.NakamaModule, groupID, userID string) (int, error) {
+	cursor := ""
+	for {
+		groups, next, err := nk.UserGroupsList(ctx, userID, GROUP_LIST_PAGE_SIZE, nil, cursor)
+		if err != nil {
+			return -1, fmt.Errorf("failed to list user groups: %v", err)
+		}
+		for _, g := range groups {
+			if g.Group != nil && g.Group.Id == groupID && g.State != nil {
+				return int(g.State.Value), nil
+			}
+		}
+		if next == "" {
+			return -1, nil
+		}
+		cursor = next
+	}
+}
+
+// isChannelMember reports whether a user may read and post in a channel.
+// Rooms are open to everyone, group channels require membership and DMs are limited to their two users.
+func isChannelMember(ctx context.Context, nk nkruntime.NakamaModule, channelID, userID string) (bool, error) {
+	ref, err := parseChannelID(channelID)
+	if err != nil {
+		return false, err
+	}
+
+	switch ref.Mode {
+	case STREAM_MODE_CHANNEL:
+		return true, nil
+	case STREAM_MODE_GROUP:
+		state, err := groupState(ctx, nk, ref.Subject, userID)
+		if err != nil {
+			return false, err
+		}
+		return state >= GROUP_STATE_SUPERADMIN && state <= GROUP_STATE_MEMBER, nil
+	case STREAM_MODE_DM:
+		return ref.Subject == userID || ref.Subcontext == userID, nil
+	}
+	return false, nil
+}
+
+// sendChannelEvent broadcasts an event as stream data to every session that has joined the chat channel
+func sendChannelEvent(nk nkruntime.NakamaModule, event *ChannelEvent) error {
+	ref, err := parseChannelID(event.ChannelID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nk.StreamSend(ref.Mode, ref.Subject, ref.Subcontext, ref.Label, string(data), nil, true)
+}
+
+// messagePreview returns the first text field of decoded message content, shortened for notifications
+func messagePreview(content map[string]interface{}) string {
+	for _, field := range MESSAGE_TEXT_FIELDS {
+		text, ok := content[field].(string)
+		if !ok || text == "" {
+			continue
+		}
+		if utf8.RuneCountInString(text) > MESSAGE_PREVIEW_RUNES {
+			return string([]rune(text)[:MESSAGE_PREVIEW_RUNES]) + "…"
+		}
+		return text
+	}
+	return ""
+}
+
+// runSendChecks passes a message about to be sent through every SEND_CHECKS entry
+func runSendChecks(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, senderID, channelID string, content map[string]interface{}) (bool, error) {
+	changed := false
+	for _, check := range SEND_CHECKS {
+		modified, err := check(ctx, logger, db, nk, senderID, channelID, content)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || modified
+	}
+	return changed, nil
+}
+
+// BeforeChannelMessageSend runs the send checks on socket messages before Nakama stores them.
+// Rejections reach the client as a socket error whose message is the JSON-encoded MessageRejectedError.
+func BeforeChannelMessageSend(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *rtapi.Envelope) (*rtapi.Envelope, error) {
+	send := in.GetChannelMessageSend()
+	if send == nil {
+		return in, nil
+	}
+
+	var content map[string]interface{}
+	if err := json.Unmarshal([]byte(send.Content), &content); err != nil {
+		// Nakama rejects content that is not a JSON object on its own
+		return in, nil
+	}
+	senderID := userIDFromContext(ctx)
+	changed, err := runSendChecks(ctx, logger, db, nk, senderID, send.ChannelId, content)
+	if err != nil {
+		body, _ := json.Marshal(err)
+		return nil, nkruntime.NewError(string(body), MESSAGE_REJECT_STATUS)
+	}
+	if changed {
+		encoded, _ := json.Marshal(content)
+		send.Content = string(encoded)
+	}
+	// Nakama may still fail to store the message, so the sticker is only kept once AfterChannelMessageSend sees it
+	if pack, err := premiumStickerPack(ctx, nk, content); err == nil && pack != nil && senderID != "" {
+		awaitStickerAck(logger, nk, senderID, send.ChannelId, send.Content)
+	}
+	return in, nil
+}
+
+// runSentMessageHooks passes a delivered message to every SENT_MESSAGE_HOOKS entry
+func runSentMessageHooks(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage) {
+	for _, hook := range SENT_MESSAGE_HOOKS {
+		hook(ctx, logger, db, nk, message)
+	}
+}
+
+// sendMessageAs sends a message to a channel on behalf of a user from an RPC. Server-side sends skip the socket
+// hooks, so the message gets the send checks and sent-message hooks here; a rejection is the *MessageRejectedError.
+func sendMessageAs(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, userID, username, channelID string, content map[string]interface{}) (*SentMessage, error) {
+	if _, err := runSendChecks(ctx, logger, db, nk, userID, channelID, content); err != nil {
+		return nil, err
+	}
+	ack, err := nk.ChannelMessageSend(ctx, channelID, content, userID, username, true)
+	if err != nil {
+		refundPremiumSticker(ctx, logger, nk, userID, content)
+		return nil, fmt.Errorf("Failed to send message: %v", err)
+	}
+
+	encoded, _ := json.Marshal(content)
+	message := &SentMessage{
+		ChannelID: channelID,
+		MessageID: ack.MessageId,
+		SenderID:  userID,
+		Username:  username,
+		Content:   string(encoded),
+		CreatedAt: time.Now().Unix(),
+	}
+	if ack.CreateTime != nil {
+		message.CreatedAt = ack.CreateTime.Seconds
+	}
+	runSentMessageHooks(ctx, logger, db, nk, message)
+	return message, nil
+}
+
+// AfterChannelMessageSend runs the sent-message hooks for messages sent over the socket
+func AfterChannelMessageSend(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, out, in *rtapi.Envelope) error {
+	send := in.GetChannelMessageSend()
+	ack := out.GetChannelMessageAck()
+	if send == nil || ack == nil {
+		return nil
+	}
+	settleStickerCharge(userIDFromContext(ctx), send.ChannelId, send.Content)
+	message := &SentMessage{
+		ChannelID: send.ChannelId,
+		MessageID: ack.MessageId,
+		SenderID:  userIDFromContext(ctx),
+		Username:  usernameFromContext(ctx),
+		Content:   send.Content,
+		CreatedAt: time.Now().Unix(),
+	}
+	if ack.CreateTime != nil {
+		message.CreatedAt = ack.CreateTime.Seconds
+	}
+	runSentMessageHooks(ctx, logger, db, nk, message)
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestParseChannelID(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    *ChannelRef
+		wantErr bool
+	}{
+		{id: "2...general", want: &ChannelRef{Mode: STREAM_MODE_CHANNEL, Label: "general"}},
+		{id: "3.group-1..", want: &ChannelRef{Mode: STREAM_MODE_GROUP, Subject: "group-1"}},
+		{id: "4.user-a.user-b.", want: &ChannelRef{Mode: STREAM_MODE_DM, Subject: "user-a", Subcontext: "user-b"}},
+		{id: "2...label.with.dots", want: &ChannelRef{Mode: STREAM_MODE_CHANNEL, Label: "label.with.dots"}},
+		{id: "", wantErr: true},
+		{id: "2.general", wantErr: true},
+		{id: "x...general", wantErr: true},
+		{id: "2...", wantErr: true},
+		{id: "3...", wantErr: true},
+		{id: "4.user-a..", wantErr: true},
+		{id: "5.a.b.c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			got, err := parseChannelID(tt.id)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseChannelID(%q) = %+v, want an error", tt.id, got)
+				}
+				if code := errorCodeOf(err); code != ERROR_CODE_PAYLOAD_INVALID {
+					t.Errorf("error code = %q, want %q", code, ERROR_CODE_PAYLOAD_INVALID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseChannelID(%q) failed: %v", tt.id, err)
+			}
+			if *got != *tt.want {
+				t.Errorf("parseChannelID(%q) = %+v, want %+v", tt.id, got, tt.want)
+			}
+			if got.ID() != tt.id {
+				t.Errorf("ID() = %q, want %q", got.ID(), tt.id)
+			}
+		})
+	}
+}
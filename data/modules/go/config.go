@@ -0,0 +1,658 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+// IMAGE_PIPELINE_SETTINGS maps the pipeline channel types to the env vars naming their stages
+var IMAGE_PIPELINE_SETTINGS = map[string]string{
+	"":        "IMAGE_PIPELINE",
+	"room":    "IMAGE_PIPELINE_ROOM",
+	"group":   "IMAGE_PIPELINE_GROUP",
+	"dm":      "IMAGE_PIPELINE_DM",
+	"sticker": "IMAGE_PIPELINE_STICKER",
+}
+
+// BUCKET_KINDS are the kinds of objects kept in buckets of their own. Each is configured with
+// STORAGE_<SETTING>_BUCKET, STORAGE_<SETTING>_EXPIRE_DAYS, STORAGE_<SETTING>_TRANSITION_DAYS and
+// STORAGE_<SETTING>_TRANSITION_TIER. Bucket names default to the local MinIO setup; S3 and GCS bucket names
+// are global, so deployments override them. Only media buckets get a public read policy in public mode; the
+// others are always private and reached through presigned URLs.
+var BUCKET_KINDS = []struct {
+	Kind, Setting, DefaultName string
+	DefaultLifecycle           BucketLifecycle
+	Public                     bool
+}{
+	{"image", "IMAGE", "chat-images", BucketLifecycle{}, true},
+	{"video", "VIDEO", "chat-video", BucketLifecycle{}, true},
+	{"voice", "VOICE", "chat-voice", BucketLifecycle{}, false},
+	{"avatar", "AVATAR", "chat-avatars", BucketLifecycle{}, true},
+	{"sticker", "STICKER", "stickers", BucketLifecycle{}, false},
+	// Exports are removed by the export cleanup job after EXPORT_RETENTION_HOURS; expiry catches any it missed
+	{"export", "EXPORT", "exports", BucketLifecycle{ExpireDays: 7}, false},
+	// Monthly message dumps; compliance retention is set with STORAGE_ARCHIVE_EXPIRE_DAYS
+	{"archive", "ARCHIVE", "chat-archive", BucketLifecycle{}, false},
+	// Flagged uploads waiting for review, only reachable by admins
+	{"quarantine", "QUARANTINE", "chat-quarantine", BucketLifecycle{}, false},
+}
+
+// BucketConfig is a bucket and the lifecycle rules applied to it at startup
+type BucketConfig struct {
+	Name      string
+	Kinds     []string
+	Lifecycle BucketLifecycle
+	// Public is set when every kind kept in the bucket may be read publicly
+	Public bool
+}
+
+// Config is the module configuration, loaded once in InitModule. Each field is read from the env var of the
+// same name in SCREAMING_SNAKE_CASE. The storage connection settings (STORAGE_SETTINGS) are not part of it:
+// they are read whenever the backend is built, so rotated credentials are picked up without a restart.
+type Config struct {
+	// AdminUserIDs are the users allowed to call admin RPCs (ADMIN_USER_IDS, comma separated)
+	AdminUserIDs map[string]bool
+
+	// Storage
+	StorageAccessMode string
+	Bucket            string
+	VideoBucket       string
+	VoiceBucket       string
+	AvatarBucket      string
+	StickerBucket     string
+	ExportBucket      string
+	ArchiveBucket     string
+	QuarantineBucket  string
+	// Buckets lists every bucket once, with its lifecycle rules
+	Buckets                       []*BucketConfig
+	StorageReloadIntervalSeconds  int
+	StorageRetryAttempts          int
+	StorageBreakerFailures        int
+	StorageBreakerCooldownSeconds int
+	StorageHealthTimeoutSeconds   int
+	StorageHealthSlowMs           int
+	StorageHealthIntervalSeconds  int
+
+	// Uploads
+	UploadMaxBytes           int64
+	InlineUploadMaxBytes     int
+	UploadDailyQuotaBytes    int64
+	UploadRateLimitPerMinute int
+	UploadDedupEnabled       bool
+	UploadMaxConcurrent      int
+	MultipartPartMB          int
+
+	// Images
+	ImageMaxBytes                 int64
+	ImageMaxInputDimension        int
+	ImageVariantMaxDimension      int
+	ImageMaxDimension             int
+	ImageJPEGQuality              int
+	ImageURLExpiryHours           int
+	ImagePipelines                map[string]string
+	ImagePreserveMetadataChannels map[string]bool
+	ImageWatermarkPath            string
+	ImageWatermarkOpacity         float64
+	ImageNSFWEndpoint             string
+	ImageNSFWThreshold            float64
+	ThumbnailSizes                string
+	ImageModerationProvider       string
+	ImageModerationBlocklist      string
+	ImageModerationMaxDistance    int
+
+	// Malware scanning
+	MalwareScanner      string
+	ClamdAddress        string
+	MalwareScanFailOpen bool
+
+	// Video and voice
+	VideoMaxBytes           int64
+	VideoMaxDurationSeconds int
+	VideoMaxDimension       int
+	VideoAllowedCodecs      []string
+	VoiceMaxDurationSeconds int
+
+	// Stickers
+	StickerPackMaxBytes int
+	StickerBaseURL      string
+
+	// Messages
+	LinkPreviewEnabled    bool
+	ProfanityWords        []string
+	ProfanityMode         string
+	EphemeralSweepSeconds int
+
+	// Live location
+	LiveLocationSweepSeconds       int
+	LiveLocationMinIntervalSeconds int
+
+	// Calls
+	CallMaxParticipants    int
+	CallRingTimeoutSeconds int
+
+	// Exports, cleanup and account deletion
+	ExportMaxMessages              int
+	ExportMaxAttachmentBytes       int
+	ExportURLExpirySeconds         int
+	ExportRetentionHours           int
+	ExportCleanupIntervalHours     int
+	OrphanGCMinAgeDays             int
+	OrphanGCIntervalHours          int
+	AccountDeletionIntervalSeconds int
+
+	// Push
+	FCMServiceAccountFile string
+	FCMProjectID          string
+	APNSKeyFile           string
+	APNSKeyID             string
+	APNSTeamID            string
+	APNSTopic             string
+	APNSSandbox           bool
+
+	// Translation
+	TranslationProvider           string
+	TranslationMaxChars           int
+	TranslationRateLimitPerMinute int
+	DeepLAPIKey                   string
+	DeepLAPIURL                   string
+	GoogleTranslateAPIKey         string
+	LibreTranslateURL             string
+	LibreTranslateAPIKey          string
+
+	// Webhooks
+	WebhookURLs        []string
+	WebhookSecret      string
+	WebhookEvents      []string
+	WebhookMaxAttempts int
+
+	// Invite links
+	InviteLinkSecret  string
+	InviteLinkBaseURL string
+
+	// Message archive
+	ArchiveHotDays       int
+	ArchiveIntervalHours int
+
+	// Spam filter
+	SpamFilter                 bool
+	SpamRatePerMinute          int
+	SpamBurst                  int
+	SpamDuplicateWindowSeconds int
+	SpamDuplicateMax           int
+	SpamMaxLinks               int
+	SpamMuteAfter              int
+	SpamMuteMinutes            int
+	SpamReportAfter            int
+
+	// Logging
+	LogRPCPayloads bool
+}
+
+// serverConfig is the loaded configuration; it is set in InitModule, before any RPC runs
+var serverConfig *Config
+
+// runtimeEnv holds the runtime.env values from Nakama's config, which take precedence over the process environment
+var runtimeEnv map[string]string
+
+// lookupEnv returns a setting from Nakama's runtime env or, failing that, the process environment
+func lookupEnv(name string) (string, bool) {
+	if v, ok := runtimeEnv[name]; ok {
+		return v, true
+	}
+	return os.LookupEnv(name)
+}
+
+// configLoader reads settings, collecting every invalid value so they are all reported at once
+type configLoader struct {
+	errors []string
+}
+
+func (l *configLoader) fail(format string, args ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+// string returns a setting, def when it is unset or empty
+func (l *configLoader) string(name, def string) string {
+	if v, _ := lookupEnv(name); strings.TrimSpace(v) != "" {
+		return strings.TrimSpace(v)
+	}
+	return def
+}
+
+func (l *configLoader) int(name string, def int) int {
+	v := l.string(name, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		l.fail("%s is not an integer: %q", name, v)
+		return def
+	}
+	return n
+}
+
+func (l *configLoader) float(name string, def float64) float64 {
+	v := l.string(name, "")
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		l.fail("%s is not a number: %q", name, v)
+		return def
+	}
+	return f
+}
+
+func (l *configLoader) bool(name string, def bool) bool {
+	v := l.string(name, "")
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.fail("%s is not true or false: %q", name, v)
+		return def
+	}
+	return b
+}
+
+// list splits a comma separated setting, dropping empty entries
+func (l *configLoader) list(name, def string) []string {
+	var values []string
+	for _, v := range strings.Split(l.string(name, def), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// positive checks that a size or limit setting is above zero
+func (l *configLoader) positive(name string, v int64) {
+	if v <= 0 {
+		l.fail("%s must be positive", name)
+	}
+}
+
+// oneOf checks a setting against its allowed values
+func (l *configLoader) oneOf(name, v string, allowed ...string) {
+	for _, a := range allowed {
+		if v == a {
+			return
+		}
+	}
+	l.fail("%s must be one of %s, got %q", name, strings.Join(allowed, ", "), v)
+}
+
+// LoadConfig reads the configuration from Nakama's runtime env and the process environment, filling in defaults
+// and rejecting invalid values
+func LoadConfig(ctx context.Context) (*Config, error) {
+	runtimeEnv, _ = ctx.Value(nkruntime.RUNTIME_CTX_ENV).(map[string]string)
+	l := &configLoader{}
+	c := &Config{AdminUserIDs: map[string]bool{}, ImagePipelines: map[string]string{}, ImagePreserveMetadataChannels: map[string]bool{}}
+
+	for _, id := range l.list("ADMIN_USER_IDS", "") {
+		c.AdminUserIDs[id] = true
+	}
+
+	c.StorageAccessMode = strings.ToLower(l.string("STORAGE_ACCESS_MODE", STORAGE_ACCESS_PUBLIC))
+	l.oneOf("STORAGE_ACCESS_MODE", c.StorageAccessMode, STORAGE_ACCESS_PUBLIC, STORAGE_ACCESS_PRIVATE)
+	c.loadBuckets(l)
+	if backend := strings.ToLower(l.string("STORAGE_BACKEND", "minio")); STORAGE_BACKENDS[backend] == nil {
+		l.fail("unknown STORAGE_BACKEND: %s", backend)
+	}
+	c.StorageReloadIntervalSeconds = l.int("STORAGE_RELOAD_INTERVAL_SECONDS", STORAGE_DEFAULT_RELOAD_INTERVAL_SECONDS)
+	c.StorageRetryAttempts = l.int("STORAGE_RETRY_ATTEMPTS", STORAGE_RETRY_DEFAULT_ATTEMPTS)
+	l.positive("STORAGE_RETRY_ATTEMPTS", int64(c.StorageRetryAttempts))
+	c.StorageBreakerFailures = l.int("STORAGE_BREAKER_FAILURES", STORAGE_BREAKER_DEFAULT_FAILURES)
+	l.positive("STORAGE_BREAKER_FAILURES", int64(c.StorageBreakerFailures))
+	c.StorageBreakerCooldownSeconds = l.int("STORAGE_BREAKER_COOLDOWN_SECONDS", STORAGE_BREAKER_DEFAULT_COOLDOWN_SECONDS)
+	c.StorageHealthTimeoutSeconds = l.int("STORAGE_HEALTH_TIMEOUT_SECONDS", STORAGE_HEALTH_DEFAULT_TIMEOUT_SECONDS)
+	l.positive("STORAGE_HEALTH_TIMEOUT_SECONDS", int64(c.StorageHealthTimeoutSeconds))
+	c.StorageHealthSlowMs = l.int("STORAGE_HEALTH_SLOW_MS", STORAGE_HEALTH_DEFAULT_SLOW_MS)
+	c.StorageHealthIntervalSeconds = l.int("STORAGE_HEALTH_INTERVAL_SECONDS", STORAGE_HEALTH_DEFAULT_INTERVAL_SECONDS)
+
+	c.UploadMaxBytes = int64(l.int("UPLOAD_MAX_BYTES", UPLOAD_DEFAULT_MAX_BYTES))
+	l.positive("UPLOAD_MAX_BYTES", c.UploadMaxBytes)
+	c.InlineUploadMaxBytes = l.int("INLINE_UPLOAD_MAX_BYTES", INLINE_UPLOAD_DEFAULT_MAX_BYTES)
+	l.positive("INLINE_UPLOAD_MAX_BYTES", int64(c.InlineUploadMaxBytes))
+	c.UploadDailyQuotaBytes = int64(l.int("UPLOAD_DAILY_QUOTA_BYTES", UPLOAD_DEFAULT_DAILY_QUOTA))
+	c.UploadRateLimitPerMinute = l.int("UPLOAD_RATE_LIMIT_PER_MINUTE", UPLOAD_DEFAULT_RATE_PER_MINUTE)
+	c.UploadDedupEnabled = l.bool("UPLOAD_DEDUP_ENABLED", true)
+	c.UploadMaxConcurrent = l.int("UPLOAD_MAX_CONCURRENT", UPLOAD_DEFAULT_MAX_CONCURRENT)
+	l.positive("UPLOAD_MAX_CONCURRENT", int64(c.UploadMaxConcurrent))
+	c.MultipartPartMB = l.int("MULTIPART_PART_MB", MULTIPART_DEFAULT_PART_MB)
+
+	c.ImageMaxBytes = int64(l.int("IMAGE_MAX_BYTES", int(c.UploadMaxBytes)))
+	l.positive("IMAGE_MAX_BYTES", c.ImageMaxBytes)
+	c.ImageMaxInputDimension = l.int("IMAGE_MAX_INPUT_DIMENSION", IMAGE_DEFAULT_MAX_INPUT_DIMENSION)
+	l.positive("IMAGE_MAX_INPUT_DIMENSION", int64(c.ImageMaxInputDimension))
+	c.ImageVariantMaxDimension = l.int("IMAGE_VARIANT_MAX_DIMENSION", VARIANT_DEFAULT_MAX_DIMENSION)
+	l.positive("IMAGE_VARIANT_MAX_DIMENSION", int64(c.ImageVariantMaxDimension))
+	c.ImageMaxDimension = l.int("IMAGE_MAX_DIMENSION", IMAGE_DEFAULT_MAX_DIMENSION)
+	l.positive("IMAGE_MAX_DIMENSION", int64(c.ImageMaxDimension))
+	c.ImageJPEGQuality = l.int("IMAGE_JPEG_QUALITY", IMAGE_DEFAULT_JPEG_QUALITY)
+	if c.ImageJPEGQuality < 1 || c.ImageJPEGQuality > 100 {
+		l.fail("IMAGE_JPEG_QUALITY must be between 1 and 100")
+	}
+	// Private mode defaults to short-lived URLs, since a URL is the only key to an object
+	expiryHours := IMAGE_URL_DEFAULT_EXPIRY_HOURS
+	if c.StorageAccessMode == STORAGE_ACCESS_PRIVATE {
+		expiryHours = IMAGE_URL_PRIVATE_EXPIRY_HOURS
+	}
+	c.ImageURLExpiryHours = l.int("IMAGE_URL_EXPIRY_HOURS", expiryHours)
+	l.positive("IMAGE_URL_EXPIRY_HOURS", int64(c.ImageURLExpiryHours))
+	for channelType, name := range IMAGE_PIPELINE_SETTINGS {
+		// An empty pipeline is meaningful: it turns processing off for that channel type
+		if spec, ok := lookupEnv(name); ok {
+			c.ImagePipelines[channelType] = spec
+		}
+	}
+	for _, channelID := range l.list("IMAGE_PRESERVE_METADATA_CHANNELS", "") {
+		c.ImagePreserveMetadataChannels[channelID] = true
+	}
+	c.ImageWatermarkPath = l.string("IMAGE_WATERMARK_PATH", "")
+	c.ImageWatermarkOpacity = l.float("IMAGE_WATERMARK_OPACITY", IMAGE_DEFAULT_WATERMARK_OPACITY)
+	if c.ImageWatermarkOpacity <= 0 || c.ImageWatermarkOpacity > 1 {
+		l.fail("IMAGE_WATERMARK_OPACITY must be in (0, 1]")
+	}
+	c.ImageNSFWEndpoint = l.string("IMAGE_NSFW_ENDPOINT", "")
+	c.ImageNSFWThreshold = l.float("IMAGE_NSFW_THRESHOLD", IMAGE_DEFAULT_NSFW_THRESHOLD)
+	c.ThumbnailSizes = l.string("THUMBNAIL_SIZES", THUMBNAIL_DEFAULT_SIZES)
+	c.ImageModerationProvider = l.string("IMAGE_MODERATION_PROVIDER", "phash")
+	c.ImageModerationBlocklist = l.string("IMAGE_MODERATION_BLOCKLIST", "")
+	c.ImageModerationMaxDistance = l.int("IMAGE_MODERATION_MAX_DISTANCE", MODERATION_DEFAULT_MAX_DISTANCE)
+
+	c.MalwareScanner = l.string("MALWARE_SCANNER", "")
+	c.ClamdAddress = l.string("CLAMD_ADDRESS", CLAMD_DEFAULT_ADDRESS)
+	c.MalwareScanFailOpen = l.bool("MALWARE_SCAN_FAIL_OPEN", false)
+
+	c.VideoMaxBytes = int64(l.int("VIDEO_MAX_BYTES", VIDEO_DEFAULT_MAX_BYTES))
+	l.positive("VIDEO_MAX_BYTES", c.VideoMaxBytes)
+	c.VideoMaxDurationSeconds = l.int("VIDEO_MAX_DURATION_SECONDS", VIDEO_DEFAULT_MAX_DURATION)
+	l.positive("VIDEO_MAX_DURATION_SECONDS", int64(c.VideoMaxDurationSeconds))
+	c.VideoMaxDimension = l.int("VIDEO_MAX_DIMENSION", VIDEO_DEFAULT_MAX_DIMENSION)
+	l.positive("VIDEO_MAX_DIMENSION", int64(c.VideoMaxDimension))
+	c.VideoAllowedCodecs = l.list("VIDEO_ALLOWED_CODECS", VIDEO_DEFAULT_CODECS)
+	c.VoiceMaxDurationSeconds = l.int("VOICE_MAX_DURATION_SECONDS", VOICE_DEFAULT_MAX_DURATION)
+	l.positive("VOICE_MAX_DURATION_SECONDS", int64(c.VoiceMaxDurationSeconds))
+
+	c.StickerPackMaxBytes = l.int("STICKER_PACK_MAX_BYTES", STICKER_PACK_DEFAULT_MAX_BYTES)
+	l.positive("STICKER_PACK_MAX_BYTES", int64(c.StickerPackMaxBytes))
+	c.StickerBaseURL = l.string("STICKER_BASE_URL", "")
+
+	c.LinkPreviewEnabled = l.bool("LINK_PREVIEW_ENABLED", true)
+	c.ProfanityWords = l.list("PROFANITY_WORDS", "")
+	c.ProfanityMode = l.string("PROFANITY_MODE", PROFANITY_MODE_MASK)
+	l.oneOf("PROFANITY_MODE", c.ProfanityMode, PROFANITY_MODE_MASK, PROFANITY_MODE_REJECT)
+	c.EphemeralSweepSeconds = l.int("EPHEMERAL_SWEEP_SECONDS", EPHEMERAL_DEFAULT_SWEEP_SECONDS)
+
+	c.LiveLocationSweepSeconds = l.int("LIVE_LOCATION_SWEEP_SECONDS", LIVE_LOCATION_DEFAULT_SWEEP_SECONDS)
+	c.LiveLocationMinIntervalSeconds = l.int("LIVE_LOCATION_MIN_INTERVAL_SECONDS", LIVE_LOCATION_DEFAULT_MIN_INTERVAL_SECONDS)
+
+	c.CallMaxParticipants = l.int("CALL_MAX_PARTICIPANTS", CALL_DEFAULT_MAX_PARTICIPANTS)
+	if c.CallMaxParticipants < 2 {
+		l.fail("CALL_MAX_PARTICIPANTS must be at least 2")
+	}
+	c.CallRingTimeoutSeconds = l.int("CALL_RING_TIMEOUT_SECONDS", CALL_DEFAULT_RING_SECONDS)
+	l.positive("CALL_RING_TIMEOUT_SECONDS", int64(c.CallRingTimeoutSeconds))
+
+	c.ExportMaxMessages = l.int("EXPORT_MAX_MESSAGES", EXPORT_DEFAULT_MAX_MESSAGES)
+	l.positive("EXPORT_MAX_MESSAGES", int64(c.ExportMaxMessages))
+	c.ExportMaxAttachmentBytes = l.int("EXPORT_MAX_ATTACHMENT_BYTES", EXPORT_DEFAULT_MAX_ATTACHMENT_BYTES)
+	c.ExportURLExpirySeconds = l.int("EXPORT_URL_EXPIRY_SECONDS", EXPORT_DEFAULT_URL_EXPIRY_SECONDS)
+	l.positive("EXPORT_URL_EXPIRY_SECONDS", int64(c.ExportURLExpirySeconds))
+	if c.ExportURLExpirySeconds > EXPORT_MAX_URL_EXPIRY_SECONDS {
+		l.fail("EXPORT_URL_EXPIRY_SECONDS cannot be more than %d", EXPORT_MAX_URL_EXPIRY_SECONDS)
+	}
+	c.ExportRetentionHours = l.int("EXPORT_RETENTION_HOURS", EXPORT_DEFAULT_RETENTION_HOURS)
+	l.positive("EXPORT_RETENTION_HOURS", int64(c.ExportRetentionHours))
+	c.ExportCleanupIntervalHours = l.int("EXPORT_CLEANUP_INTERVAL_HOURS", EXPORT_DEFAULT_CLEANUP_INTERVAL_HOURS)
+	c.OrphanGCMinAgeDays = l.int("ORPHAN_GC_MIN_AGE_DAYS", ORPHAN_GC_DEFAULT_MIN_AGE_DAYS)
+	l.positive("ORPHAN_GC_MIN_AGE_DAYS", int64(c.OrphanGCMinAgeDays))
+	c.OrphanGCIntervalHours = l.int("ORPHAN_GC_INTERVAL_HOURS", ORPHAN_GC_DEFAULT_INTERVAL_HOURS)
+	c.AccountDeletionIntervalSeconds = l.int("ACCOUNT_DELETION_INTERVAL_SECONDS", ACCOUNT_DELETION_DEFAULT_INTERVAL_SECONDS)
+
+	c.FCMServiceAccountFile = l.string("FCM_SERVICE_ACCOUNT_FILE", "")
+	c.FCMProjectID = l.string("FCM_PROJECT_ID", "")
+	c.APNSKeyFile = l.string("APNS_KEY_FILE", "")
+	c.APNSKeyID = l.string("APNS_KEY_ID", "")
+	c.APNSTeamID = l.string("APNS_TEAM_ID", "")
+	c.APNSTopic = l.string("APNS_TOPIC", "")
+	c.APNSSandbox = l.bool("APNS_SANDBOX", false)
+
+	c.TranslationProvider = l.string("TRANSLATION_PROVIDER", "")
+	if c.TranslationProvider != "" {
+		l.oneOf("TRANSLATION_PROVIDER", c.TranslationProvider, "deepl", "google", "libretranslate")
+	}
+	c.TranslationMaxChars = l.int("TRANSLATION_MAX_CHARS", TRANSLATION_DEFAULT_MAX_CHARS)
+	l.positive("TRANSLATION_MAX_CHARS", int64(c.TranslationMaxChars))
+	c.TranslationRateLimitPerMinute = l.int("TRANSLATION_RATE_LIMIT_PER_MINUTE", TRANSLATION_DEFAULT_RATE_PER_MINUTE)
+	c.DeepLAPIKey = envSecret("DEEPL_API_KEY", "")
+	c.DeepLAPIURL = l.string("DEEPL_API_URL", "")
+	c.GoogleTranslateAPIKey = envSecret("GOOGLE_TRANSLATE_API_KEY", "")
+	c.LibreTranslateURL = l.string("LIBRETRANSLATE_URL", "")
+	c.LibreTranslateAPIKey = envSecret("LIBRETRANSLATE_API_KEY", "")
+
+	c.WebhookURLs = l.list("WEBHOOK_URLS", "")
+	for _, u := range c.WebhookURLs {
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			l.fail("WEBHOOK_URLS must be http or https URLs, got %q", u)
+		}
+	}
+	// The secret may come from a file, like the storage credentials
+	c.WebhookSecret = envSecret("WEBHOOK_SECRET", "")
+	if len(c.WebhookURLs) > 0 && c.WebhookSecret == "" {
+		l.fail("WEBHOOK_SECRET is required when WEBHOOK_URLS is set")
+	}
+	c.WebhookEvents = l.list("WEBHOOK_EVENTS", "")
+	for _, event := range c.WebhookEvents {
+		l.oneOf("WEBHOOK_EVENTS", event, WEBHOOK_EVENTS...)
+	}
+	c.WebhookMaxAttempts = l.int("WEBHOOK_MAX_ATTEMPTS", WEBHOOK_DEFAULT_MAX_ATTEMPTS)
+	l.positive("WEBHOOK_MAX_ATTEMPTS", int64(c.WebhookMaxAttempts))
+
+	c.InviteLinkSecret = envSecret("INVITE_LINK_SECRET", "")
+	c.InviteLinkBaseURL = l.string("INVITE_LINK_BASE_URL", "")
+	if u := c.InviteLinkBaseURL; u != "" && !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		l.fail("INVITE_LINK_BASE_URL must be an http or https URL, got %q", u)
+	}
+
+	c.ArchiveHotDays = l.int("ARCHIVE_HOT_DAYS", ARCHIVE_DEFAULT_HOT_DAYS)
+	l.positive("ARCHIVE_HOT_DAYS", int64(c.ArchiveHotDays))
+	c.ArchiveIntervalHours = l.int("ARCHIVE_INTERVAL_HOURS", ARCHIVE_DEFAULT_INTERVAL_HOURS)
+
+	// Zero turns off a single heuristic or escalation step
+	c.SpamFilter = l.bool("SPAM_FILTER", true)
+	c.SpamRatePerMinute = l.int("SPAM_RATE_PER_MINUTE", SPAM_DEFAULT_RATE_PER_MINUTE)
+	c.SpamBurst = l.int("SPAM_BURST", SPAM_DEFAULT_BURST)
+	if c.SpamRatePerMinute > 0 {
+		l.positive("SPAM_BURST", int64(c.SpamBurst))
+	}
+	c.SpamDuplicateWindowSeconds = l.int("SPAM_DUPLICATE_WINDOW_SECONDS", SPAM_DEFAULT_DUPLICATE_WINDOW_SECONDS)
+	c.SpamDuplicateMax = l.int("SPAM_DUPLICATE_MAX", SPAM_DEFAULT_DUPLICATE_MAX)
+	c.SpamMaxLinks = l.int("SPAM_MAX_LINKS", SPAM_DEFAULT_MAX_LINKS)
+	c.SpamMuteAfter = l.int("SPAM_MUTE_AFTER", SPAM_DEFAULT_MUTE_AFTER)
+	c.SpamMuteMinutes = l.int("SPAM_MUTE_MINUTES", SPAM_DEFAULT_MUTE_MINUTES)
+	if c.SpamMuteAfter > 0 {
+		l.positive("SPAM_MUTE_MINUTES", int64(c.SpamMuteMinutes))
+	}
+	c.SpamReportAfter = l.int("SPAM_REPORT_AFTER", SPAM_DEFAULT_REPORT_AFTER)
+
+	c.LogRPCPayloads = l.bool("LOG_RPC_PAYLOADS", false)
+
+	if len(l.errors) > 0 {
+		sort.Strings(l.errors)
+		return nil, fmt.Errorf("invalid configuration: %s", strings.Join(l.errors, "; "))
+	}
+	return c, nil
+}
+
+// loadBuckets reads the bucket of each kind of object. Kinds may share a bucket as long as they agree on its
+// lifecycle, since rules apply to the whole bucket.
+func (c *Config) loadBuckets(l *configLoader) {
+	names := map[string]string{}
+	byName := map[string]*BucketConfig{}
+	for _, kind := range BUCKET_KINDS {
+		setting := "STORAGE_" + kind.Setting + "_"
+		name := l.string(setting+"BUCKET", kind.DefaultName)
+		if kind.Kind == "image" {
+			// The image bucket predates the other kinds and keeps its original settings
+			name = l.string(setting+"BUCKET", l.string("STORAGE_BUCKET", l.string("MINIO_BUCKET", kind.DefaultName)))
+		}
+		lifecycle := BucketLifecycle{
+			ExpireDays:     l.int(setting+"EXPIRE_DAYS", kind.DefaultLifecycle.ExpireDays),
+			TransitionDays: l.int(setting+"TRANSITION_DAYS", kind.DefaultLifecycle.TransitionDays),
+			TransitionTier: l.string(setting+"TRANSITION_TIER", kind.DefaultLifecycle.TransitionTier),
+		}
+		if lifecycle.ExpireDays < 0 || lifecycle.TransitionDays < 0 {
+			l.fail("%sEXPIRE_DAYS and %sTRANSITION_DAYS cannot be negative", setting, setting)
+		}
+		if lifecycle.TransitionDays > 0 && lifecycle.TransitionTier == "" {
+			l.fail("%sTRANSITION_DAYS needs %sTRANSITION_TIER", setting, setting)
+		}
+		if lifecycle.TransitionDays > 0 && lifecycle.ExpireDays > 0 && lifecycle.ExpireDays <= lifecycle.TransitionDays {
+			l.fail("%sEXPIRE_DAYS must be greater than %sTRANSITION_DAYS", setting, setting)
+		}
+
+		if bucket, ok := byName[name]; ok {
+			if bucket.Lifecycle != lifecycle {
+				l.fail("%s and %s share bucket %s but not its lifecycle rules", names[name], setting+"BUCKET", name)
+			}
+			bucket.Kinds = append(bucket.Kinds, kind.Kind)
+			bucket.Public = bucket.Public && kind.Public
+		} else {
+			names[name] = setting + "BUCKET"
+			byName[name] = &BucketConfig{Name: name, Kinds: []string{kind.Kind}, Lifecycle: lifecycle, Public: kind.Public}
+			c.Buckets = append(c.Buckets, byName[name])
+		}
+
+		switch kind.Kind {
+		case "image":
+			c.Bucket = name
+		case "video":
+			c.VideoBucket = name
+		case "voice":
+			c.VoiceBucket = name
+		case "avatar":
+			c.AvatarBucket = name
+		case "sticker":
+			c.StickerBucket = name
+		case "export":
+			c.ExportBucket = name
+		case "archive":
+			c.ArchiveBucket = name
+		case "quarantine":
+			c.QuarantineBucket = name
+		}
+	}
+}
+
+// storagePrivate reports whether STORAGE_ACCESS_MODE is "private": buckets get no public read policy and
+// URLs are only issued to users allowed to see the object
+func storagePrivate() bool {
+	return serverConfig.StorageAccessMode == STORAGE_ACCESS_PRIVATE
+}
+
+// bucketPublic reports whether a bucket gets the public read policy: a media bucket in public mode
+func bucketPublic(bucket string) bool {
+	if storagePrivate() {
+		return false
+	}
+	for _, b := range serverConfig.Buckets {
+		if b.Name == bucket {
+			return b.Public
+		}
+	}
+	return false
+}
+
+// ClientConfig is the part of the configuration the app needs to check uploads before sending them
+type ClientConfig struct {
+	MaxUploadBytes          int64    `json:"maxUploadBytes"`
+	MaxInlineUploadBytes    int      `json:"maxInlineUploadBytes"`
+	MaxImageBytes           int64    `json:"maxImageBytes"`
+	MaxImageDimension       int      `json:"maxImageDimension"`
+	MaxImageVariantSize     int      `json:"maxImageVariantSize"`
+	MaxVideoBytes           int64    `json:"maxVideoBytes"`
+	MaxVideoDurationSeconds int      `json:"maxVideoDurationSeconds"`
+	MaxVideoDimension       int      `json:"maxVideoDimension"`
+	MaxVoiceDurationSeconds int      `json:"maxVoiceDurationSeconds"`
+	MaxStickerPackBytes     int      `json:"maxStickerPackBytes"`
+	MultipartPartBytes      int64    `json:"multipartPartBytes"`
+	AllowedImageTypes       []string `json:"allowedImageTypes"`
+	AllowedUploadTypes      []string `json:"allowedUploadTypes"`
+	AllowedVoiceTypes       []string `json:"allowedVoiceTypes"`
+	DailyUploadQuotaBytes   int64    `json:"dailyUploadQuotaBytes"`
+	UploadsPerMinute        int      `json:"uploadsPerMinute"`
+	ImageURLExpirySeconds   int64    `json:"imageUrlExpirySeconds"`
+	CallMaxParticipants     int      `json:"callMaxParticipants"`
+	CallRingTimeoutSeconds  int      `json:"callRingTimeoutSeconds"`
+	LinkPreviews            bool     `json:"linkPreviews"`
+	MessageSearch           bool     `json:"messageSearch"`
+	Translation             bool     `json:"translation"`
+	InviteLinks             bool     `json:"inviteLinks"`
+}
+
+// ServerConfigResponse represents the response for get_server_config
+type ServerConfigResponse struct {
+	Success bool          `json:"success"`
+	Config  *ClientConfig `json:"config,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Code    string        `json:"code,omitempty"`
+}
+
+// sortedContentTypes lists the content types of an allow list in order
+func sortedContentTypes(types map[string]bool) []string {
+	list := make([]string, 0, len(types))
+	for contentType, allowed := range types {
+		if allowed {
+			list = append(list, contentType)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// RpcGetServerConfig returns the limits and features the app should know about before uploading or sending
+func RpcGetServerConfig(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	c := serverConfig
+	voiceTypes := make(map[string]bool, len(ALLOWED_VOICE_CONTENT_TYPES))
+	for contentType := range ALLOWED_VOICE_CONTENT_TYPES {
+		voiceTypes[contentType] = true
+	}
+	return marshalResponse(ServerConfigResponse{Success: true, Config: &ClientConfig{
+		MaxUploadBytes:          c.UploadMaxBytes,
+		MaxInlineUploadBytes:    c.InlineUploadMaxBytes,
+		MaxImageBytes:           c.ImageMaxBytes,
+		MaxImageDimension:       c.ImageMaxInputDimension,
+		MaxImageVariantSize:     c.ImageVariantMaxDimension,
+		MaxVideoBytes:           c.VideoMaxBytes,
+		MaxVideoDurationSeconds: c.VideoMaxDurationSeconds,
+		MaxVideoDimension:       c.VideoMaxDimension,
+		MaxVoiceDurationSeconds: c.VoiceMaxDurationSeconds,
+		MaxStickerPackBytes:     c.StickerPackMaxBytes,
+		MultipartPartBytes:      multipartPartBytes(),
+		AllowedImageTypes:       sortedContentTypes(ALLOWED_IMAGE_CONTENT_TYPES),
+		AllowedUploadTypes:      sortedContentTypes(ALLOWED_UPLOAD_CONTENT_TYPES),
+		AllowedVoiceTypes:       sortedContentTypes(voiceTypes),
+		DailyUploadQuotaBytes:   c.UploadDailyQuotaBytes,
+		UploadsPerMinute:        c.UploadRateLimitPerMinute,
+		ImageURLExpirySeconds:   int64(imageURLExpiry().Seconds()),
+		CallMaxParticipants:     c.CallMaxParticipants,
+		CallRingTimeoutSeconds:  c.CallRingTimeoutSeconds,
+		LinkPreviews:            c.LinkPreviewEnabled,
+		MessageSearch:           messageSearchEnabled,
+		Translation:             translationProvider != nil,
+		InviteLinks:             serverConfig.InviteLinkSecret != "",
+	}})
+}
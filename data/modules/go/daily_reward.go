@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	DAILY_REWARD_COLLECTION = "wallet_claims"
+	DAILY_REWARD_KEY        = "daily"
+
+	// DAILY_REWARD_MIN_INTERVAL stops timezone hopping from yielding two claims in a few hours
+	DAILY_REWARD_MIN_INTERVAL = 20 * time.Hour
+	// DAILY_REWARD_TIMEZONE_LOCK is how long a claim timezone sticks before an account timezone change is honoured
+	DAILY_REWARD_TIMEZONE_LOCK = 7 * 24 * time.Hour
+)
+
+// DAILY_REWARD_SCHEDULE is the coin reward per streak day; streaks past the end keep the last value
+var DAILY_REWARD_SCHEDULE = []int64{10, 15, 20, 25, 30, 40, 50}
+
+// DailyRewardState is the per-user claim record, writable only by the server
+type DailyRewardState struct {
+	LastClaimDay      string `json:"lastClaimDay"`
+	LastClaimAt       int64  `json:"lastClaimAt"`
+	Streak            int    `json:"streak"`
+	Timezone          string `json:"timezone"`
+	TimezoneChangedAt int64  `json:"timezoneChangedAt"`
+}
+
+// DailyRewardResponse represents the response for daily reward RPCs
+type DailyRewardResponse struct {
+	Success     bool   `json:"success"`
+	CanClaim    bool   `json:"canClaim"`
+	Reward      int64  `json:"reward,omitempty"`
+	NextReward  int64  `json:"nextReward"`
+	Streak      int    `json:"streak"`
+	NextClaimAt int64  `json:"nextClaimAt,omitempty"`
+	Balance     int64  `json:"balance,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Code        string `json:"code,omitempty"`
+}
+
+// dailyRewardFor returns the reward for the given streak day
+func dailyRewardFor(streak int) int64 {
+	if streak < 1 {
+		streak = 1
+	}
+	if streak > len(DAILY_REWARD_SCHEDULE) {
+		streak = len(DAILY_REWARD_SCHEDULE)
+	}
+	return DAILY_REWARD_SCHEDULE[streak-1]
+}
+
+// readDailyRewardState loads the claim record and its storage version ("*" when none exists yet)
+func readDailyRewardState(ctx context.Context, nk nkruntime.NakamaModule, userID string) (*DailyRewardState, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{
+		Collection: DAILY_REWARD_COLLECTION,
+		Key:        DAILY_REWARD_KEY,
+		UserID:     userID,
+	}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read claim state: %v", err)
+	}
+	state := &DailyRewardState{}
+	if len(objects) == 0 {
+		return state, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), state); err != nil {
+		return nil, "", fmt.Errorf("failed to decode claim state: %v", err)
+	}
+	return state, objects[0].Version, nil
+}
+
+// resolveClaimTimezone picks the timezone the claim day is computed in from the caller's account
+func resolveClaimTimezone(ctx context.Context, nk nkruntime.NakamaModule, userID string, state *DailyRewardState, now time.Time) *time.Location {
+	accountTZ := ""
+	if account, err := nk.AccountGetId(ctx, userID); err == nil && account.User != nil {
+		accountTZ = account.User.Timezone
+	}
+	return claimTimezone(state, accountTZ, now)
+}
+
+// claimTimezone applies an account timezone to the claim record. Account timezone changes only take effect
+// once the previous one has been locked in for a while; unknown timezones fall back to UTC.
+func claimTimezone(state *DailyRewardState, accountTZ string, now time.Time) *time.Location {
+	if accountTZ != state.Timezone && (state.TimezoneChangedAt == 0 || now.Sub(time.Unix(state.TimezoneChangedAt, 0)) >= DAILY_REWARD_TIMEZONE_LOCK) {
+		state.Timezone = accountTZ
+		state.TimezoneChangedAt = now.Unix()
+	}
+
+	loc, err := time.LoadLocation(state.Timezone)
+	if err != nil || state.Timezone == "" {
+		return time.UTC
+	}
+	return loc
+}
+
+// dailyClaimStatus works out whether a claim is allowed now and what streak it would produce
+func dailyClaimStatus(state *DailyRewardState, loc *time.Location, now time.Time) (canClaim bool, streak int, nextClaimAt time.Time) {
+	today := now.In(loc).Format("2006-01-02")
+	yesterday := now.In(loc).AddDate(0, 0, -1).Format("2006-01-02")
+
+	earliest := time.Unix(state.LastClaimAt, 0).Add(DAILY_REWARD_MIN_INTERVAL)
+	local := now.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+
+	if state.LastClaimDay == today {
+		nextClaimAt = midnight
+		if earliest.After(nextClaimAt) {
+			nextClaimAt = earliest
+		}
+		return false, state.Streak, nextClaimAt
+	}
+	if state.LastClaimAt > 0 && now.Before(earliest) {
+		return false, state.Streak, earliest
+	}
+
+	streak = 1
+	if state.LastClaimDay == yesterday {
+		streak = state.Streak + 1
+	}
+	return true, streak, now
+}
+
+// RpcGetDailyRewardStatus reports whether the caller can claim today and the current streak
+func RpcGetDailyRewardStatus(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(DailyRewardResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	state, _, err := readDailyRewardState(ctx, nk, userID)
+	if err != nil {
+		return marshalResponse(DailyRewardResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	now := time.Now()
+	loc := resolveClaimTimezone(ctx, nk, userID, state, now)
+	canClaim, streak, nextClaimAt := dailyClaimStatus(state, loc, now)
+
+	response := DailyRewardResponse{Success: true, CanClaim: canClaim, Streak: streak}
+	if canClaim {
+		response.NextReward = dailyRewardFor(streak)
+	} else {
+		response.NextReward = dailyRewardFor(streak + 1)
+		response.NextClaimAt = nextClaimAt.Unix()
+	}
+	return marshalResponse(response)
+}
+
+// RpcClaimDailyReward credits the streak-scaled daily reward, at most once per account per day
+func RpcClaimDailyReward(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(DailyRewardResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	state, version, err := readDailyRewardState(ctx, nk, userID)
+	if err != nil {
+		return marshalResponse(DailyRewardResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	now := time.Now()
+	loc := resolveClaimTimezone(ctx, nk, userID, state, now)
+	canClaim, streak, nextClaimAt := dailyClaimStatus(state, loc, now)
+	if !canClaim {
+		return marshalResponse(DailyRewardResponse{
+			Success:     false,
+			Streak:      streak,
+			NextReward:  dailyRewardFor(streak + 1),
+			NextClaimAt: nextClaimAt.Unix(),
+			Error:       "Daily reward already claimed",
+			Code:        ERROR_CODE_CONFLICT,
+		})
+	}
+
+	reward := dailyRewardFor(streak)
+	today := now.In(loc).Format("2006-01-02")
+	state.LastClaimDay = today
+	state.LastClaimAt = now.Unix()
+	state.Streak = streak
+	stateJSON, _ := json.Marshal(state)
+
+	update := &nkruntime.WalletUpdate{
+		UserID:    userID,
+		Changeset: map[string]int64{WALLET_CURRENCY: reward},
+		Metadata:  map[string]interface{}{"reason": "daily_reward", "day": today, "streak": streak},
+	}
+	if err := validateWalletUpdates([]*nkruntime.WalletUpdate{update}); err != nil {
+		return marshalResponse(DailyRewardResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	// The version check on the claim record makes concurrent claims fail together with their wallet credit
+	_, results, err := nk.MultiUpdate(ctx, nil, []*nkruntime.StorageWrite{{
+		Collection:      DAILY_REWARD_COLLECTION,
+		Key:             DAILY_REWARD_KEY,
+		UserID:          userID,
+		Value:           string(stateJSON),
+		Version:         version,
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}}, nil, []*nkruntime.WalletUpdate{update}, true)
+	if errors.Is(err, nkruntime.ErrStorageRejectedVersion) {
+		logger.Warn("Daily claim for %s lost to a concurrent claim", userID)
+		return marshalResponse(DailyRewardResponse{Success: false, Error: "Daily reward already claimed", Code: ERROR_CODE_CONFLICT})
+	}
+	if err != nil {
+		logger.Error("Failed to claim daily reward for %s: %v", userID, err)
+		return marshalResponse(DailyRewardResponse{Success: false, Error: "Failed to claim daily reward, please try again", Code: ERROR_CODE_INTERNAL})
+	}
+
+	_, _, nextClaimAt = dailyClaimStatus(state, loc, now)
+	logger.Info("User %s claimed daily reward of %d coins (streak %d)", userID, reward, streak)
+	return marshalResponse(DailyRewardResponse{
+		Success:     true,
+		Reward:      reward,
+		Streak:      streak,
+		NextReward:  dailyRewardFor(streak + 1),
+		NextClaimAt: nextClaimAt.Unix(),
+		Balance:     balanceFor(results, userID),
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestDailyRewardFor(t *testing.T) {
+	tests := []struct {
+		streak int
+		want   int64
+	}{
+		{0, 10},
+		{1, 10},
+		{2, 15},
+		{7, 50},
+		{30, 50},
+	}
+	for _, tt := range tests {
+		if got := dailyRewardFor(tt.streak); got != tt.want {
+			t.Errorf("dailyRewardFor(%d) = %d, want %d", tt.streak, got, tt.want)
+		}
+	}
+}
+
+func TestDailyClaimStatus(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	bangkok := time.FixedZone("UTC+7", 7*60*60)
+
+	tests := []struct {
+		name         string
+		state        DailyRewardState
+		loc          *time.Location
+		now          string
+		wantClaim    bool
+		wantStreak   int
+		wantNextTime string
+	}{
+		{
+			name:       "first claim",
+			now:        "2024-03-10T12:00:00Z",
+			wantClaim:  true,
+			wantStreak: 1,
+		},
+		{
+			name:       "claimed yesterday continues the streak",
+			state:      DailyRewardState{LastClaimDay: "2024-03-09", LastClaimAt: at("2024-03-09T08:00:00Z").Unix(), Streak: 3},
+			now:        "2024-03-10T12:00:00Z",
+			wantClaim:  true,
+			wantStreak: 4,
+		},
+		{
+			name:       "missed a day resets the streak",
+			state:      DailyRewardState{LastClaimDay: "2024-03-08", LastClaimAt: at("2024-03-08T08:00:00Z").Unix(), Streak: 5},
+			now:        "2024-03-10T12:00:00Z",
+			wantClaim:  true,
+			wantStreak: 1,
+		},
+		{
+			name:         "claimed today waits for midnight",
+			state:        DailyRewardState{LastClaimDay: "2024-03-10", LastClaimAt: at("2024-03-10T01:00:00Z").Unix(), Streak: 2},
+			now:          "2024-03-10T12:00:00Z",
+			wantStreak:   2,
+			wantNextTime: "2024-03-11T00:00:00Z",
+		},
+		{
+			name:         "late claim today waits for the minimum interval",
+			state:        DailyRewardState{LastClaimDay: "2024-03-10", LastClaimAt: at("2024-03-10T10:00:00Z").Unix(), Streak: 2},
+			now:          "2024-03-10T23:30:00Z",
+			wantStreak:   2,
+			wantNextTime: "2024-03-11T06:00:00Z",
+		},
+		{
+			name:         "new day within the minimum interval",
+			state:        DailyRewardState{LastClaimDay: "2024-03-09", LastClaimAt: at("2024-03-09T20:00:00Z").Unix(), Streak: 3},
+			now:          "2024-03-10T12:00:00Z",
+			wantStreak:   3,
+			wantNextTime: "2024-03-10T16:00:00Z",
+		},
+		{
+			name:       "days follow the claim timezone",
+			state:      DailyRewardState{LastClaimDay: "2024-03-10", LastClaimAt: at("2024-03-09T20:00:00Z").Unix(), Streak: 2},
+			loc:        bangkok,
+			now:        "2024-03-10T18:00:00Z",
+			wantClaim:  true,
+			wantStreak: 3,
+		},
+		{
+			name:         "same state in UTC is still today",
+			state:        DailyRewardState{LastClaimDay: "2024-03-10", LastClaimAt: at("2024-03-09T20:00:00Z").Unix(), Streak: 2},
+			now:          "2024-03-10T18:00:00Z",
+			wantStreak:   2,
+			wantNextTime: "2024-03-11T00:00:00Z",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := tt.loc
+			if loc == nil {
+				loc = time.UTC
+			}
+			state := tt.state
+			canClaim, streak, next := dailyClaimStatus(&state, loc, at(tt.now))
+			if canClaim != tt.wantClaim || streak != tt.wantStreak {
+				t.Fatalf("dailyClaimStatus = (%v, %d), want (%v, %d)", canClaim, streak, tt.wantClaim, tt.wantStreak)
+			}
+			if tt.wantNextTime != "" && !next.Equal(at(tt.wantNextTime)) {
+				t.Errorf("next claim at %v, want %s", next.UTC(), tt.wantNextTime)
+			}
+		})
+	}
+}
+
+func TestClaimTimezone(t *testing.T) {
+	now := time.Unix(1710000000, 0)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name        string
+		state       DailyRewardState
+		accountTZ   string
+		wantTZ      string
+		wantLoc     string
+		wantChanged int64
+	}{
+		{
+			name:        "first timezone is taken at once",
+			accountTZ:   "Asia/Tokyo",
+			wantTZ:      "Asia/Tokyo",
+			wantLoc:     "Asia/Tokyo",
+			wantChanged: now.Unix(),
+		},
+		{
+			name:        "recent timezone is locked",
+			state:       DailyRewardState{Timezone: "Asia/Tokyo", TimezoneChangedAt: now.Add(-day).Unix()},
+			accountTZ:   "Europe/London",
+			wantTZ:      "Asia/Tokyo",
+			wantLoc:     "Asia/Tokyo",
+			wantChanged: now.Add(-day).Unix(),
+		},
+		{
+			name:        "change after the lock",
+			state:       DailyRewardState{Timezone: "Asia/Tokyo", TimezoneChangedAt: now.Add(-DAILY_REWARD_TIMEZONE_LOCK).Unix()},
+			accountTZ:   "Europe/London",
+			wantTZ:      "Europe/London",
+			wantLoc:     "Europe/London",
+			wantChanged: now.Unix(),
+		},
+		{
+			name:    "no timezone is UTC",
+			wantLoc: "UTC",
+		},
+		{
+			name:        "unknown timezone is UTC",
+			accountTZ:   "Mars/Olympus",
+			wantTZ:      "Mars/Olympus",
+			wantLoc:     "UTC",
+			wantChanged: now.Unix(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := tt.state
+			loc := claimTimezone(&state, tt.accountTZ, now)
+			if loc.String() != tt.wantLoc {
+				t.Errorf("location = %s, want %s", loc, tt.wantLoc)
+			}
+			if state.Timezone != tt.wantTZ || state.TimezoneChangedAt != tt.wantChanged {
+				t.Errorf("state timezone = (%q, %d), want (%q, %d)", state.Timezone, state.TimezoneChangedAt, tt.wantTZ, tt.wantChanged)
+			}
+		})
+	}
+}
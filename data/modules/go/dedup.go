@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	CONTENT_HASH_COLLECTION     = "content_hashes"
+	CONTENT_HASH_WRITE_ATTEMPTS = 3
+)
+
+// ContentHash indexes an uploaded image by the SHA-256 of its bytes, so identical uploads share one object.
+// System-owned and keyed by contentHashKey.
+type ContentHash struct {
+	ObjectKey   string                 `json:"objectKey"`
+	ContentType string                 `json:"contentType"`
+	Size        int64                  `json:"size"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	// RefCount is the number of uploads resolved to the object; it is deleted when the last one is
+	RefCount int `json:"refCount"`
+	// Uploaders counts those uploads per user, so each user can only release their own
+	Uploaders map[string]int `json:"uploaders"`
+	CreatedAt int64          `json:"createdAt"`
+}
+
+// contentHashKey is the index key of an upload's bytes. Channel types with their own image pipeline store
+// different results for the same bytes, so they get their own entries.
+func contentHashKey(data io.Reader, channelType string) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, data); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(hash.Sum(nil))
+	if _, ok := imagePipelines[channelType]; ok && channelType != "" {
+		return channelType + "_" + key, nil
+	}
+	return key, nil
+}
+
+// readContentHash loads an index entry, nil if the bytes were never uploaded
+func readContentHash(ctx context.Context, nk nkruntime.NakamaModule, key string) (*ContentHash, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: CONTENT_HASH_COLLECTION, Key: key}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read content hash: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	var entry ContentHash
+	if err := json.Unmarshal([]byte(objects[0].Value), &entry); err != nil {
+		return nil, "", fmt.Errorf("failed to decode content hash: %v", err)
+	}
+	return &entry, objects[0].Version, nil
+}
+
+func writeContentHash(ctx context.Context, nk nkruntime.NakamaModule, key string, entry *ContentHash, version string) error {
+	value, _ := json.Marshal(entry)
+	_, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      CONTENT_HASH_COLLECTION,
+		Key:             key,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// sharedAttachment returns the live attachment an index entry points to, nil if its object was deleted
+// or the entry was left behind by a race between two uploads of the same bytes
+func sharedAttachment(ctx context.Context, nk nkruntime.NakamaModule, key string, entry *ContentHash) (*Attachment, error) {
+	attachment, _, err := readAttachment(ctx, nk, objectOwner(entry.ObjectKey), entry.ObjectKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment: %v", err)
+	}
+	if attachment == nil || attachment.DeletedAt != 0 || attachment.ContentHash != key {
+		return nil, nil
+	}
+	return attachment, nil
+}
+
+// indexUpload records a new upload as the object for its bytes, with the uploader holding the first reference.
+// An entry left behind by a deleted object is replaced, a live one is kept.
+func indexUpload(ctx context.Context, nk nkruntime.NakamaModule, key string, attachment *Attachment) error {
+	current, version, err := readContentHash(ctx, nk, key)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		version = "*"
+	} else if shared, err := sharedAttachment(ctx, nk, key, current); err != nil || shared != nil {
+		return err
+	}
+
+	entry := &ContentHash{
+		ObjectKey:   attachment.ObjectKey,
+		ContentType: attachment.ContentType,
+		Size:        attachment.Size,
+		Metadata:    attachment.Metadata,
+		RefCount:    1,
+		Uploaders:   map[string]int{attachment.OwnerID: 1},
+		CreatedAt:   attachment.CreatedAt,
+	}
+	return writeContentHash(ctx, nk, key, entry, version)
+}
+
+// acquireDuplicate returns the stored object for bytes uploaded before and takes a reference to it for userID,
+// nil if there is none the user may reuse. In private mode an object is only reused by its uploader or in the
+// channel it was sent to, so nobody gains access to an image through its hash.
+func acquireDuplicate(ctx context.Context, nk nkruntime.NakamaModule, key, userID, channelID string) (*ContentHash, error) {
+	for attempt := 0; attempt < CONTENT_HASH_WRITE_ATTEMPTS; attempt++ {
+		entry, version, err := readContentHash(ctx, nk, key)
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		attachment, err := sharedAttachment(ctx, nk, key, entry)
+		if err != nil || attachment == nil {
+			return nil, err
+		}
+		if storagePrivate() && attachment.OwnerID != userID && (channelID == "" || attachment.ChannelID != channelID) {
+			return nil, nil
+		}
+
+		entry.RefCount++
+		if entry.Uploaders == nil {
+			entry.Uploaders = map[string]int{}
+		}
+		entry.Uploaders[userID]++
+		if err := writeContentHash(ctx, nk, key, entry, version); err == nil {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// releaseContentHash drops one of holder's references to a deduplicated object. It reports whether holder had
+// one and how many references remain; at zero the entry is deleted and the object may be removed.
+func releaseContentHash(ctx context.Context, nk nkruntime.NakamaModule, key, objectKey, holder string) (bool, int, error) {
+	var lastErr error
+	for attempt := 0; attempt < CONTENT_HASH_WRITE_ATTEMPTS; attempt++ {
+		entry, version, err := readContentHash(ctx, nk, key)
+		if err != nil {
+			return false, 0, err
+		}
+		// The entry was replaced or removed, so nothing else shares the object
+		if entry == nil || entry.ObjectKey != objectKey {
+			return false, 0, nil
+		}
+		if entry.Uploaders[holder] == 0 {
+			return false, entry.RefCount, nil
+		}
+
+		entry.RefCount--
+		if entry.Uploaders[holder]--; entry.Uploaders[holder] == 0 {
+			delete(entry.Uploaders, holder)
+		}
+		if entry.RefCount <= 0 {
+			lastErr = nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: CONTENT_HASH_COLLECTION, Key: key, Version: version}})
+		} else {
+			lastErr = writeContentHash(ctx, nk, key, entry, version)
+		}
+		if lastErr == nil {
+			return true, entry.RefCount, nil
+		}
+	}
+	return false, 0, fmt.Errorf("failed to release content hash: %v", lastErr)
+}
+
+// forgetContentHash removes the index entry of an object deleted regardless of its references
+func forgetContentHash(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, key, objectKey string) {
+	entry, version, err := readContentHash(ctx, nk, key)
+	if err != nil || entry == nil || entry.ObjectKey != objectKey {
+		return
+	}
+	if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: CONTENT_HASH_COLLECTION, Key: key, Version: version}}); err != nil {
+		logger.Warn("Failed to forget content hash of %s: %v", objectKey, err)
+	}
+}
+
+// duplicateUploadResponse answers upload_image with the object an earlier upload of the same bytes stored
+func (s *Services) duplicateUploadResponse(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, entry *ContentHash) (ImageUploadResponse, error) {
+	issued, err := s.presignImageURL(ctx, logger, nk, entry.ObjectKey)
+	if err != nil {
+		return ImageUploadResponse{}, err
+	}
+	metadata := make(map[string]interface{}, len(entry.Metadata))
+	thumbnails := map[string]string{}
+	for k, v := range entry.Metadata {
+		if k != "thumbnails" {
+			metadata[k] = v
+			continue
+		}
+		if stored, ok := v.(map[string]interface{}); ok {
+			for size, key := range stored {
+				if s, ok := key.(string); ok {
+					thumbnails[size] = s
+				}
+			}
+		}
+	}
+	return ImageUploadResponse{
+		Success:      true,
+		ImageURL:     issued.URL,
+		ObjectKey:    entry.ObjectKey,
+		Thumbnails:   thumbnails,
+		Metadata:     metadata,
+		ExpiresAt:    issued.ExpiresAt,
+		Deduplicated: true,
+	}, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// DRAFTS_COLLECTION holds one object per user and channel, keyed by channel ID
+	DRAFTS_COLLECTION     = "drafts"
+	DRAFT_MAX_TEXT        = 16 * 1024
+	DRAFT_MAX_ATTACHMENTS = 10
+	DRAFT_LIST_LIMIT      = 100
+	DRAFT_MAX_CHANNELS    = 100
+)
+
+// Draft is a half-written message, shared by all of a user's devices
+type Draft struct {
+	ChannelID  string   `json:"channelId"`
+	Text       string   `json:"text"`
+	ObjectKeys []string `json:"objectKeys,omitempty"`
+	UpdatedAt  int64    `json:"updatedAt"`
+	// Version is the storage version; clients send it back with save_draft to detect edits on another device
+	Version string `json:"version,omitempty"`
+}
+
+// DraftResponse represents the response for save_draft and get_drafts
+type DraftResponse struct {
+	Success bool     `json:"success"`
+	Draft   *Draft   `json:"draft,omitempty"`
+	Drafts  []*Draft `json:"drafts,omitempty"`
+	// Current is the newer draft saved from another device when save_draft fails with CONFLICT
+	Current *Draft `json:"current,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// decodeDraft turns a storage object into a draft carrying its version
+func decodeDraft(object *api.StorageObject) (*Draft, error) {
+	var draft Draft
+	if err := json.Unmarshal([]byte(object.Value), &draft); err != nil {
+		return nil, fmt.Errorf("failed to decode draft: %v", err)
+	}
+	draft.ChannelID = object.Key
+	draft.Version = object.Version
+	return &draft, nil
+}
+
+// readDraft loads a user's draft in a channel, nil when there is none
+func readDraft(ctx context.Context, nk nkruntime.NakamaModule, userID, channelID string) (*Draft, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: DRAFTS_COLLECTION, Key: channelID, UserID: userID}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read draft: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	return decodeDraft(objects[0])
+}
+
+// RpcSaveDraft stores the caller's draft in a channel, or removes it when both text and objectKeys are empty.
+// A request carrying the version it last read is refused with CONFLICT if another device saved in between,
+// and the response holds that newer draft; without a version the save always wins.
+func RpcSaveDraft(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(DraftResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID  string   `json:"channelId"`
+		Text       string   `json:"text"`
+		ObjectKeys []string `json:"objectKeys"`
+		Version    string   `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(DraftResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" {
+		return marshalResponse(DraftResponse{Success: false, Error: "Missing required field: channelId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Text) > DRAFT_MAX_TEXT {
+		return marshalResponse(DraftResponse{Success: false, Error: fmt.Sprintf("text cannot exceed %d bytes", DRAFT_MAX_TEXT), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.ObjectKeys) > DRAFT_MAX_ATTACHMENTS {
+		return marshalResponse(DraftResponse{Success: false, Error: fmt.Sprintf("objectKeys cannot exceed %d", DRAFT_MAX_ATTACHMENTS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	// Pending attachments are the caller's own uploads, not yet sent anywhere
+	for _, key := range request.ObjectKeys {
+		if objectOwner(key) != userID {
+			return marshalResponse(DraftResponse{Success: false, Error: fmt.Sprintf("Permission denied: %s is not your upload", key), Code: ERROR_CODE_PERMISSION_DENIED})
+		}
+	}
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil {
+		return marshalResponse(DraftResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if !member {
+		return marshalResponse(DraftResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+
+	// failed answers a rejected write or delete, telling a version mismatch apart from a storage error
+	failed := func(action string, writeErr error) (string, error) {
+		current, err := readDraft(ctx, nk, userID, request.ChannelID)
+		if err != nil {
+			return marshalResponse(DraftResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		currentVersion := "*"
+		if current != nil {
+			currentVersion = current.Version
+		}
+		if request.Version == "" || request.Version == currentVersion {
+			return marshalResponse(DraftResponse{Success: false, Error: fmt.Sprintf("Failed to %s draft: %v", action, writeErr), Code: ERROR_CODE_INTERNAL})
+		}
+		return marshalResponse(DraftResponse{
+			Success: false,
+			Error:   "Draft was already changed on another device",
+			Code:    ERROR_CODE_CONFLICT,
+			Current: current,
+		})
+	}
+
+	if request.Text == "" && len(request.ObjectKeys) == 0 {
+		if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: DRAFTS_COLLECTION, Key: request.ChannelID, UserID: userID, Version: request.Version}}); err != nil {
+			return failed("delete", err)
+		}
+		return marshalResponse(DraftResponse{Success: true})
+	}
+
+	draft := &Draft{ChannelID: request.ChannelID, Text: request.Text, ObjectKeys: request.ObjectKeys, UpdatedAt: time.Now().Unix()}
+	value, _ := json.Marshal(draft)
+	acks, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      DRAFTS_COLLECTION,
+		Key:             request.ChannelID,
+		UserID:          userID,
+		Value:           string(value),
+		Version:         request.Version,
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}})
+	if err != nil {
+		return failed("save", err)
+	}
+	draft.Version = acks[0].Version
+	return marshalResponse(DraftResponse{Success: true, Draft: draft})
+}
+
+// RpcGetDrafts returns the caller's drafts, in the given channels or in all channels, newest first
+func RpcGetDrafts(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(DraftResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelIDs []string `json:"channelIds"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(DraftResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if len(request.ChannelIDs) > DRAFT_MAX_CHANNELS {
+		return marshalResponse(DraftResponse{Success: false, Error: fmt.Sprintf("channelIds cannot exceed %d", DRAFT_MAX_CHANNELS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	var objects []*api.StorageObject
+	if len(request.ChannelIDs) > 0 {
+		reads := make([]*nkruntime.StorageRead, 0, len(request.ChannelIDs))
+		for _, id := range request.ChannelIDs {
+			reads = append(reads, &nkruntime.StorageRead{Collection: DRAFTS_COLLECTION, Key: id, UserID: userID})
+		}
+		read, err := nk.StorageRead(ctx, reads)
+		if err != nil {
+			return marshalResponse(DraftResponse{Success: false, Error: fmt.Sprintf("Failed to read drafts: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+		objects = read
+	} else {
+		cursor := ""
+		for {
+			page, next, err := nk.StorageList(ctx, userID, userID, DRAFTS_COLLECTION, DRAFT_LIST_LIMIT, cursor)
+			if err != nil {
+				return marshalResponse(DraftResponse{Success: false, Error: fmt.Sprintf("Failed to list drafts: %v", err), Code: ERROR_CODE_INTERNAL})
+			}
+			objects = append(objects, page...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+
+	drafts := make([]*Draft, 0, len(objects))
+	for _, object := range objects {
+		draft, err := decodeDraft(object)
+		if err != nil {
+			logger.Warn("Skipping draft %s of %s: %v", object.Key, userID, err)
+			continue
+		}
+		drafts = append(drafts, draft)
+	}
+	sort.Slice(drafts, func(i, j int) bool { return drafts[i].UpdatedAt > drafts[j].UpdatedAt })
+	return marshalResponse(DraftResponse{Success: true, Drafts: drafts})
+}
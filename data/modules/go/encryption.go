@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// ENCRYPTED_CONTENT_TYPE is what encrypted attachments are stored as, whatever the plaintext was
+	ENCRYPTED_CONTENT_TYPE = "application/octet-stream"
+	ENCRYPTED_FILE_EXT     = ".enc"
+	// ENVELOPE_MAX_RECIPIENTS bounds the wrapped keys of one envelope, one per member device is plenty
+	ENVELOPE_MAX_RECIPIENTS = 512
+	ENVELOPE_MAX_FIELD      = 2048
+)
+
+// ENVELOPE_ALGORITHMS are the content ciphers an envelope may declare, as JOSE names
+var ENVELOPE_ALGORITHMS = map[string]bool{
+	"A256GCM": true,
+	"XC20P":   true,
+}
+
+// KeyEnvelope carries what recipients need to decrypt an end-to-end encrypted attachment. The client encrypts the
+// file with a random content key and wraps that key for each recipient; the server stores the envelope as is and
+// never sees the content key.
+type KeyEnvelope struct {
+	Algorithm string `json:"algorithm"`
+	Nonce     string `json:"nonce"`
+	// WrappedKeys maps a recipient (user or device ID, as the clients agree) to the content key wrapped for it
+	WrappedKeys map[string]string `json:"wrappedKeys"`
+}
+
+// validateEnvelope checks an envelope is complete and within its size limits. The wrapped keys are opaque.
+func validateEnvelope(envelope *KeyEnvelope) error {
+	if !ENVELOPE_ALGORITHMS[envelope.Algorithm] {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Unsupported encryption algorithm: %s", envelope.Algorithm)
+	}
+	if envelope.Nonce == "" || len(envelope.WrappedKeys) == 0 {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Missing required fields: envelope.nonce or envelope.wrappedKeys")
+	}
+	if len(envelope.Nonce) > ENVELOPE_MAX_FIELD {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid envelope nonce")
+	}
+	if len(envelope.WrappedKeys) > ENVELOPE_MAX_RECIPIENTS {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "At most %d wrapped keys are allowed", ENVELOPE_MAX_RECIPIENTS)
+	}
+	for recipient, key := range envelope.WrappedKeys {
+		if recipient == "" || key == "" || len(recipient) > ENVELOPE_MAX_FIELD || len(key) > ENVELOPE_MAX_FIELD {
+			return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid wrapped key for recipient %q", recipient)
+		}
+	}
+	return nil
+}
+
+// checkEncryptedUpload validates the envelope of an encrypted upload. The envelope is only handed to channel
+// members, so encrypted uploads must name a channel the uploader belongs to.
+func checkEncryptedUpload(ctx context.Context, nk nkruntime.NakamaModule, userID, channelID string, envelope *KeyEnvelope) error {
+	if err := validateEnvelope(envelope); err != nil {
+		return err
+	}
+	if channelID == "" {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Missing required field: channelId")
+	}
+	member, err := isChannelMember(ctx, nk, channelID, userID)
+	if err != nil {
+		return fmt.Errorf("Failed to check channel membership: %v", err)
+	}
+	if !member {
+		return errorWithCode(ERROR_CODE_NOT_A_MEMBER, "Not a member of this channel")
+	}
+	return nil
+}
+
+// encryptedObjectKey names an encrypted upload. The client's file name is left out, it would leak what the file is.
+func encryptedObjectKey(userID string, at time.Time) string {
+	return uploadObjectKey(userID, at, uuid.New().String()+ENCRYPTED_FILE_EXT, ENCRYPTED_CONTENT_TYPE)
+}
+
+// attachmentEnvelope returns the key envelope of an encrypted object and whether the object is encrypted at all.
+// The envelope is only returned to the uploader and members of the attachment's channel.
+func attachmentEnvelope(ctx context.Context, db *sql.DB, nk nkruntime.NakamaModule, userID, objectKey string) (*KeyEnvelope, bool, error) {
+	attachment, err := objectAttachment(ctx, db, nk, objectKey)
+	if err != nil || attachment == nil || attachment.Envelope == nil {
+		return nil, false, err
+	}
+	if userID == "" {
+		return nil, true, nil
+	}
+	if attachment.OwnerID == userID {
+		return attachment.Envelope, true, nil
+	}
+	member, err := isChannelMember(ctx, nk, attachment.ChannelID, userID)
+	if err != nil {
+		return nil, true, err
+	}
+	if !member {
+		return nil, true, nil
+	}
+	return attachment.Envelope, true, nil
+}
+
+// uploadEncryptedImage stores an inline upload of client-encrypted bytes. The ciphertext cannot be checked,
+// processed or deduplicated, so it streams into storage as an opaque blob and its envelope goes into the
+// attachment record.
+func (s *Services) uploadEncryptedImage(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, request *ImageUploadRequest) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	if request.ImageData == "" {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: "Missing required field: imageData", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if base64.StdEncoding.DecodedLen(len(request.ImageData)) > s.Config.InlineUploadMaxBytes {
+		return marshalResponse(ImageUploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Image exceeds the inline upload limit of %d bytes, use request_upload_url instead", s.Config.InlineUploadMaxBytes),
+			Code:    ERROR_CODE_PAYLOAD_TOO_LARGE,
+		})
+	}
+	if err := checkEncryptedUpload(ctx, nk, userID, request.ChannelID, request.Envelope); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	now := s.Clock.Now()
+	objectKey := encryptedObjectKey(userID, now)
+	if err := backend.EnsureBucket(ctx, logger, s.Config.bucketForKey(objectKey)); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to ensure bucket exists: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	release, err := s.acquireUploadSlot(ctx)
+	if err != nil {
+		logger.Warn("Turned away encrypted upload %s: %v", objectKey, err)
+		return marshalResponse(ImageUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	defer release()
+
+	source := newBase64Source(request.ImageData)
+	size := source.Size()
+	maxSize := size
+	if maxSize < 0 {
+		maxSize = int64(base64.StdEncoding.DecodedLen(len(request.ImageData)))
+	}
+	if err := s.reserveUploadQuota(ctx, nk, userID, maxSize); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	err = backend.PutObject(ctx, s.Config.bucketForKey(objectKey), objectKey, source, size, ENCRYPTED_CONTENT_TYPE)
+	if source.err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to decode base64 image: %v", source.err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to upload image: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	if size < 0 {
+		size = maxSize
+		if info, err := backend.StatObject(ctx, s.Config.bucketForKey(objectKey), objectKey); err == nil {
+			size = info.Size
+		}
+	}
+
+	attachment := &Attachment{
+		OwnerID:     userID,
+		ObjectKey:   objectKey,
+		Bucket:      s.Config.bucketForKey(objectKey),
+		ContentType: ENCRYPTED_CONTENT_TYPE,
+		Size:        size,
+		ChannelID:   request.ChannelID,
+		CreatedAt:   now.Unix(),
+		Envelope:    request.Envelope,
+	}
+	if err := saveAttachment(ctx, nk, attachment); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to record upload: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	issued, err := s.presignImageURL(ctx, logger, nk, objectKey)
+	if err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to generate presigned URL: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	logger.Info("Encrypted upload stored: %s (%d bytes)", objectKey, size)
+	return marshalResponse(ImageUploadResponse{
+		Success:   true,
+		ImageURL:  issued.URL,
+		ObjectKey: objectKey,
+		ExpiresAt: issued.ExpiresAt,
+		Encrypted: true,
+		Envelope:  request.Envelope,
+	})
+}
+
+// confirmEncryptedUpload records a presigned upload of ciphertext. Like inline encrypted uploads it is stored
+// as is, without validation, processing or thumbnails.
+func (s *Services) confirmEncryptedUpload(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, userID string, pending *PendingUpload, info *StoredObject) (string, error) {
+	attachment := s.pendingAttachment(userID, pending, info)
+	if err := recordUpload(ctx, nk, pending, attachment); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to record upload: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	issued, err := s.presignImageURL(ctx, logger, nk, pending.ObjectKey)
+	if err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to generate presigned URL: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	logger.Info("Confirmed encrypted upload %s (%d bytes)", pending.ObjectKey, info.Size)
+	return marshalResponse(ImageUploadResponse{
+		Success:   true,
+		ImageURL:  issued.URL,
+		ObjectKey: pending.ObjectKey,
+		ExpiresAt: issued.ExpiresAt,
+		Encrypted: true,
+		Envelope:  pending.Envelope,
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	EPHEMERAL_DEFAULT_SWEEP_SECONDS = 60
+	// EPHEMERAL_SWEEP_BATCH caps how many messages one channel loses per sweep, the rest go next time
+	EPHEMERAL_SWEEP_BATCH = 500
+	CHANNEL_TTL_MIN       = 60
+	CHANNEL_TTL_MAX       = 90 * 24 * 60 * 60
+)
+
+// ChannelTTLResponse represents the response for set_channel_ttl and get_channel_ttl
+type ChannelTTLResponse struct {
+	Success    bool   `json:"success"`
+	ChannelID  string `json:"channelId,omitempty"`
+	TTLSeconds int64  `json:"ttlSeconds"`
+	Error      string `json:"error,omitempty"`
+	Code       string `json:"code,omitempty"`
+}
+
+// expiredMessage is a persisted message past its channel's TTL
+type expiredMessage struct {
+	MessageID string
+	StoredMessage
+}
+
+// listExpiredMessages returns the oldest messages of a channel created before cutoff
+func listExpiredMessages(ctx context.Context, db *sql.DB, channelID string, cutoff time.Time) ([]*expiredMessage, error) {
+	ref, err := parseChannelID(channelID)
+	if err != nil {
+		return nil, err
+	}
+	subject, descriptor := messageStreamColumns(ref)
+
+	rows, err := db.QueryContext(ctx, `
+SELECT id, sender_id, username, content FROM message
+WHERE stream_mode = $1 AND stream_subject = $2 AND stream_descriptor = $3 AND stream_label = $4 AND create_time < $5
+ORDER BY create_time ASC LIMIT $6`,
+		ref.Mode, subject, descriptor, ref.Label, cutoff, EPHEMERAL_SWEEP_BATCH)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expired messages: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []*expiredMessage
+	for rows.Next() {
+		message := &expiredMessage{}
+		if err := rows.Scan(&message.MessageID, &message.SenderID, &message.Username, &message.Content); err != nil {
+			return nil, fmt.Errorf("failed to read expired message: %v", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// purgeMessageAttachment deletes the upload a message carried, if the message is the one it is linked to.
+// Forwarded copies of an object never delete it.
+func (s *Services) purgeMessageAttachment(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, message *expiredMessage) error {
+	var body struct {
+		ObjectKey string `json:"objectKey"`
+	}
+	if err := json.Unmarshal([]byte(message.Content), &body); err != nil || body.ObjectKey == "" {
+		return nil
+	}
+	if objectOwner(body.ObjectKey) != message.SenderID {
+		return nil
+	}
+	attachment, version, err := readAttachment(ctx, nk, message.SenderID, body.ObjectKey)
+	if err != nil {
+		return err
+	}
+	if attachment == nil || attachment.DeletedAt != 0 || attachment.MessageID != message.MessageID {
+		return nil
+	}
+	return s.purgeAttachment(ctx, logger, nk, attachment, version, "")
+}
+
+// expireChannel deletes a channel's messages older than its TTL with everything stored about them
+func (s *Services) expireChannel(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, settings *ChannelSettings) (int, error) {
+	cutoff := s.Clock.Now().Add(-time.Duration(settings.MessageTTL) * time.Second)
+	messages, err := listExpiredMessages(ctx, db, settings.ChannelID, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, message := range messages {
+		if err := s.purgeMessageAttachment(ctx, logger, nk, message); err != nil {
+			// Keep the message so the next sweep retries rather than orphaning the object
+			logger.Warn("Failed to delete attachment of expired message %s: %v", message.MessageID, err)
+			continue
+		}
+		// Removing through the runtime tells connected clients the message is gone
+		if _, err := nk.ChannelMessageRemove(ctx, settings.ChannelID, message.MessageID, message.SenderID, message.Username, true); err != nil {
+			logger.Warn("Failed to remove expired message %s: %v", message.MessageID, err)
+			continue
+		}
+		if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{
+			{Collection: REACTION_COLLECTION, Key: message.MessageID},
+			{Collection: MESSAGE_HISTORY_COLLECTION, Key: message.MessageID},
+		}); err != nil {
+			logger.Warn("Failed to delete records of expired message %s: %v", message.MessageID, err)
+		}
+		unindexMessage(ctx, logger, db, message.MessageID)
+		unarchiveMessage(ctx, logger, db, message.MessageID)
+		removed++
+	}
+	return removed, nil
+}
+
+// runEphemeralSweep expires messages in every channel that has a TTL
+func (s *Services) runEphemeralSweep(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule) error {
+	var channels []*ChannelSettings
+	err := listAllStorage(ctx, nk, CHANNEL_SETTINGS_COLLECTION, func(value string) {
+		var settings ChannelSettings
+		if err := json.Unmarshal([]byte(value), &settings); err == nil && settings.MessageTTL > 0 {
+			channels = append(channels, &settings)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list channel settings: %v", err)
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+
+	if _, err := s.Storage.Backend(logger); err != nil {
+		return fmt.Errorf("failed to initialize storage backend: %v", err)
+	}
+	for _, settings := range channels {
+		removed, err := s.expireChannel(ctx, logger, db, nk, settings)
+		if err != nil {
+			logger.Warn("Failed to expire messages of %s: %v", settings.ChannelID, err)
+			continue
+		}
+		if removed > 0 {
+			logger.Info("Expired %d messages in %s", removed, settings.ChannelID)
+		}
+	}
+	return nil
+}
+
+// StartEphemeralSweeper deletes expired messages every EPHEMERAL_SWEEP_SECONDS; 0 disables it
+func (s *Services) StartEphemeralSweeper(logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule) {
+	seconds := s.Config.EphemeralSweepSeconds
+	if seconds <= 0 {
+		logger.Info("Ephemeral message sweeper disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(seconds) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.runEphemeralSweep(context.Background(), logger, db, nk); err != nil {
+				logger.Error("Ephemeral message sweep failed: %v", err)
+			}
+		}
+	}()
+	logger.Info("Ephemeral message sweeper scheduled every %d seconds", seconds)
+}
+
+// RpcSetChannelTTL makes a channel's messages disappear after ttlSeconds; 0 turns it off. Channel admins only.
+func RpcSetChannelTTL(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" && !isAdmin(ctx) {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID  string `json:"channelId"`
+		TTLSeconds *int64 `json:"ttlSeconds"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" || request.TTLSeconds == nil {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: "Missing required fields: channelId or ttlSeconds", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	ttl := *request.TTLSeconds
+	if ttl != 0 && (ttl < CHANNEL_TTL_MIN || ttl > CHANNEL_TTL_MAX) {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: fmt.Sprintf("ttlSeconds must be 0 or between %d and %d", CHANNEL_TTL_MIN, CHANNEL_TTL_MAX), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if !canAdministerChannel(ctx, nk, request.ChannelID, userID) {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	if _, err := updateChannelSettings(ctx, nk, request.ChannelID, func(s *ChannelSettings) error {
+		s.MessageTTL = ttl
+		s.UpdatedBy = userID
+		s.UpdatedAt = time.Now().Unix()
+		return nil
+	}); err != nil {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	event := &ChannelEvent{
+		Type:      "ttl_changed",
+		ChannelID: request.ChannelID,
+		SenderID:  userID,
+		Username:  usernameFromContext(ctx),
+		Content:   map[string]int64{"ttlSeconds": ttl},
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := sendChannelEvent(nk, event); err != nil {
+		logger.Warn("Failed to send ttl_changed event for %s: %v", request.ChannelID, err)
+	}
+
+	logger.Info("Message TTL of %s set to %d seconds by %s", request.ChannelID, ttl, userID)
+	return marshalResponse(ChannelTTLResponse{Success: true, ChannelID: request.ChannelID, TTLSeconds: ttl})
+}
+
+// RpcGetChannelTTL returns a channel's message TTL so clients can hide messages before the sweeper reaches them
+func RpcGetChannelTTL(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: "Missing required field: channelId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil || !member {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+
+	settings, _, err := readChannelSettings(ctx, nk, request.ChannelID)
+	if err != nil {
+		return marshalResponse(ChannelTTLResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(ChannelTTLResponse{Success: true, ChannelID: request.ChannelID, TTLSeconds: settings.MessageTTL})
+}
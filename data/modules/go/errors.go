@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Error codes every failed RPC response carries in "code", next to the English "error". Specific checks have
+// their own codes (UPLOAD_QUOTA_EXCEEDED, UPLOAD_FLAGGED, MESSAGE_REJECTED, ...).
+const (
+	ERROR_CODE_UNAUTHENTICATED     = "UNAUTHENTICATED"
+	ERROR_CODE_PERMISSION_DENIED   = "PERMISSION_DENIED"
+	ERROR_CODE_NOT_A_MEMBER        = "NOT_A_MEMBER"
+	ERROR_CODE_PAYLOAD_INVALID     = "PAYLOAD_INVALID"
+	ERROR_CODE_PAYLOAD_TOO_LARGE   = "PAYLOAD_TOO_LARGE"
+	ERROR_CODE_NOT_FOUND           = "NOT_FOUND"
+	ERROR_CODE_CONFLICT            = "CONFLICT"
+	ERROR_CODE_STORAGE_UNAVAILABLE = "STORAGE_UNAVAILABLE"
+	ERROR_CODE_INTERNAL            = "INTERNAL"
+	// ERROR_CODE_BUSY is a request turned away because the server is at capacity, safe to retry later
+	ERROR_CODE_BUSY = "BUSY"
+	// ERROR_CODE_REJECTED is a well-formed request refused by a rule, e.g. reporting yourself
+	ERROR_CODE_REJECTED = "REJECTED"
+)
+
+// rpcFunction is the signature of RPC handlers
+type rpcFunction = func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error)
+
+// CodedError is an error meant for clients, carrying the code its RPC response reports
+type CodedError struct {
+	Code    string
+	Message string
+}
+
+func (e *CodedError) Error() string { return e.Message }
+
+// errorWithCode formats a client facing error with its code
+func errorWithCode(code, format string, args ...interface{}) error {
+	return &CodedError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorCodeOf returns the code to report for an error returned by a helper. Errors that do not carry a code
+// are server failures.
+func errorCodeOf(err error) string {
+	var coded *CodedError
+	var rejected *MessageRejectedError
+	var quota *QuotaError
+	var friend *FriendRequestError
+	var malware *MalwareError
+	var moderation *ModerationError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &coded):
+		return coded.Code
+	case errors.As(err, &rejected):
+		return rejected.Code
+	case errors.As(err, &quota):
+		return quota.Code
+	case errors.As(err, &friend):
+		return friend.Code
+	case errors.As(err, &malware):
+		return ERROR_CODE_UPLOAD_INFECTED
+	case errors.As(err, &moderation):
+		return ERROR_CODE_UPLOAD_FLAGGED
+	case errors.Is(err, errStorageCircuitOpen):
+		return ERROR_CODE_STORAGE_UNAVAILABLE
+	}
+	return ERROR_CODE_INTERNAL
+}
+
+// withErrorCodes makes sure every failed response of an RPC carries a code. Each failure site sets its own;
+// one that does not is reported as INTERNAL and logged so it gets fixed. An error returned by the RPC itself is
+// answered with the same JSON envelope, so clients only ever parse one shape.
+func withErrorCodes(fn rpcFunction) rpcFunction {
+	return func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+		response, err := fn(ctx, logger, db, nk, payload)
+		if err != nil {
+			if _, ok := err.(*nkruntime.Error); ok {
+				return response, err
+			}
+			return marshalResponse(map[string]interface{}{"success": false, "error": err.Error(), "code": errorCodeOf(err)})
+		}
+		if !strings.Contains(response, `"success":false`) {
+			return response, nil
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(response), &fields); err != nil || string(fields["success"]) != "false" {
+			return response, nil
+		}
+		var code string
+		_ = json.Unmarshal(fields["code"], &code)
+		if code != "" {
+			return response, nil
+		}
+		logger.Warn("Failed response without an error code: %s", fields["error"])
+		fields["code"], _ = json.Marshal(ERROR_CODE_INTERNAL)
+		encoded, _ := json.Marshal(fields)
+		return string(encoded), nil
+	}
+}
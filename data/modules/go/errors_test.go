@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"plain error", errors.New("boom"), ERROR_CODE_INTERNAL},
+		{"coded", errorWithCode(ERROR_CODE_NOT_FOUND, "message not found"), ERROR_CODE_NOT_FOUND},
+		{"wrapped coded", fmt.Errorf("loading: %w", errorWithCode(ERROR_CODE_PERMISSION_DENIED, "no")), ERROR_CODE_PERMISSION_DENIED},
+		{"message rejected", &MessageRejectedError{Code: ERROR_CODE_SPAM_DETECTED, Message: "spam"}, ERROR_CODE_SPAM_DETECTED},
+		{"quota", &QuotaError{Code: ERROR_CODE_UPLOAD_QUOTA_EXCEEDED, Message: "quota"}, ERROR_CODE_UPLOAD_QUOTA_EXCEEDED},
+		{"friend request", &FriendRequestError{Code: ERROR_CODE_FRIEND_REQUESTS_RESTRICTED, Message: "no"}, ERROR_CODE_FRIEND_REQUESTS_RESTRICTED},
+		{"malware", &MalwareError{}, ERROR_CODE_UPLOAD_INFECTED},
+		{"moderation", &ModerationError{}, ERROR_CODE_UPLOAD_FLAGGED},
+		{"circuit open", fmt.Errorf("put: %w", errStorageCircuitOpen), ERROR_CODE_STORAGE_UNAVAILABLE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorCodeOf(tt.err); got != tt.want {
+				t.Errorf("errorCodeOf(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithErrorCodes(t *testing.T) {
+	nkErr := nkruntime.NewError("unavailable", 14)
+	tests := []struct {
+		name     string
+		response string
+		err      error
+		want     map[string]interface{}
+		wantErr  error
+		wantWarn bool
+	}{
+		{
+			name:     "success passes through",
+			response: `{"success":true,"url":"x"}`,
+			want:     map[string]interface{}{"success": true, "url": "x"},
+		},
+		{
+			name:     "failure with code passes through",
+			response: `{"success":false,"error":"Message not found","code":"NOT_FOUND"}`,
+			want:     map[string]interface{}{"success": false, "error": "Message not found", "code": ERROR_CODE_NOT_FOUND},
+		},
+		{
+			name:     "failure without code becomes internal",
+			response: `{"success":false,"error":"Something broke"}`,
+			want:     map[string]interface{}{"success": false, "error": "Something broke", "code": ERROR_CODE_INTERNAL},
+			wantWarn: true,
+		},
+		{
+			name: "returned error becomes the envelope",
+			err:  errorWithCode(ERROR_CODE_UNAUTHENTICATED, "No user ID in context"),
+			want: map[string]interface{}{"success": false, "error": "No user ID in context", "code": ERROR_CODE_UNAUTHENTICATED},
+		},
+		{
+			name: "returned plain error is internal",
+			err:  errors.New("failed to read"),
+			want: map[string]interface{}{"success": false, "error": "failed to read", "code": ERROR_CODE_INTERNAL},
+		},
+		{
+			name:    "nakama errors are kept",
+			err:     nkErr,
+			wantErr: nkErr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := newTestLogger()
+			rpc := withErrorCodes(func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+				return tt.response, tt.err
+			})
+			response, err := rpc(context.Background(), logger, nil, nil, "{}")
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal([]byte(response), &got); err != nil {
+				t.Fatalf("response %q is not JSON: %v", response, err)
+			}
+			for key, want := range tt.want {
+				if got[key] != want {
+					t.Errorf("%s = %v, want %v", key, got[key], want)
+				}
+			}
+			warned := false
+			for _, line := range logger.Lines() {
+				warned = warned || strings.HasPrefix(line, "WARN ")
+			}
+			if warned != tt.wantWarn {
+				t.Errorf("warned = %v, want %v (log: %v)", warned, tt.wantWarn, logger.Lines())
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/heroiclabs/nakama-common/api"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	EVENT_CATEGORY          = 10
+	EVENT_MIN_DURATION      = time.Hour
+	EVENT_RESULTS_TOP       = 10
+	EVENT_LIST_LIMIT        = 100
+	EVENT_CHANNEL_PREFIX    = "event-"
+	EVENT_MAX_POINTS        = 1000
+	NOTIFICATION_CODE_EVENT = 101
+)
+
+// CommunityEvent is the client view of a scheduled community event
+type CommunityEvent struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Channel     string `json:"channel"`
+	ChannelID   string `json:"channelId"`
+	StartTime   int64  `json:"startTime"`
+	EndTime     int64  `json:"endTime"`
+	Size        uint32 `json:"size"`
+	MaxSize     uint32 `json:"maxSize"`
+	CanEnter    bool   `json:"canEnter"`
+}
+
+// EventStanding is a single leaderboard entry of an event
+type EventStanding struct {
+	Rank     int64  `json:"rank"`
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+	Score    int64  `json:"score"`
+}
+
+// EventResponse represents the response for community event RPCs
+type EventResponse struct {
+	Success   bool             `json:"success"`
+	Event     *CommunityEvent  `json:"event,omitempty"`
+	Events    []CommunityEvent `json:"events,omitempty"`
+	Standings []EventStanding  `json:"standings,omitempty"`
+	Cursor    string           `json:"cursor,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	Code      string           `json:"code,omitempty"`
+}
+
+// eventChannelName is the chat room dedicated to an event
+func eventChannelName(eventID string) string {
+	return EVENT_CHANNEL_PREFIX + eventID
+}
+
+// communityEventFromTournament converts a tournament into the client event view
+func communityEventFromTournament(t *api.Tournament) CommunityEvent {
+	event := CommunityEvent{
+		ID:          t.Id,
+		Title:       t.Title,
+		Description: t.Description,
+		Channel:     eventChannelName(t.Id),
+		ChannelID:   roomChannelID(eventChannelName(t.Id)),
+		Size:        t.Size,
+		MaxSize:     t.MaxSize,
+		CanEnter:    t.CanEnter,
+	}
+	if t.StartTime != nil {
+		event.StartTime = t.StartTime.Seconds
+	}
+	if t.EndTime != nil {
+		event.EndTime = t.EndTime.Seconds
+	}
+	return event
+}
+
+// isCommunityEvent reports whether a tournament was created by schedule_event
+func isCommunityEvent(t *api.Tournament) bool {
+	if t == nil || t.Category != EVENT_CATEGORY {
+		return false
+	}
+	var metadata map[string]interface{}
+	if err := json.Unmarshal([]byte(t.Metadata), &metadata); err != nil {
+		return false
+	}
+	flag, _ := metadata["communityEvent"].(bool)
+	return flag
+}
+
+// getCommunityEvent loads an event by ID, returning nil when it does not exist
+func getCommunityEvent(ctx context.Context, nk nkruntime.NakamaModule, eventID string) (*api.Tournament, error) {
+	tournaments, err := nk.TournamentsGetId(ctx, []string{eventID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event: %v", err)
+	}
+	if len(tournaments) == 0 || !isCommunityEvent(tournaments[0]) {
+		return nil, nil
+	}
+	return tournaments[0], nil
+}
+
+// eventStandings lists the top records of an event
+func eventStandings(ctx context.Context, nk nkruntime.NakamaModule, eventID string, limit int) ([]EventStanding, error) {
+	records, _, _, _, err := nk.TournamentRecordsList(ctx, eventID, nil, limit, "", 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list event records: %v", err)
+	}
+	standings := make([]EventStanding, 0, len(records))
+	for _, r := range records {
+		standing := EventStanding{Rank: r.Rank, UserID: r.OwnerId, Score: r.Score}
+		if r.Username != nil {
+			standing.Username = r.Username.Value
+		}
+		standings = append(standings, standing)
+	}
+	return standings, nil
+}
+
+// RpcScheduleEvent creates a time-boxed community event backed by a tournament (admin only)
+func RpcScheduleEvent(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(EventResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		StartTime   int64  `json:"startTime"`
+		EndTime     int64  `json:"endTime"`
+		MaxSize     int    `json:"maxSize"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if strings.TrimSpace(request.Title) == "" || request.EndTime == 0 {
+		return marshalResponse(EventResponse{Success: false, Error: "Missing required fields: title or endTime", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	now := time.Now().Unix()
+	if request.StartTime < now {
+		request.StartTime = now
+	}
+	duration := request.EndTime - request.StartTime
+	if duration < int64(EVENT_MIN_DURATION.Seconds()) {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Event must last at least %s", EVENT_MIN_DURATION), Code: ERROR_CODE_REJECTED})
+	}
+
+	eventID := uuid.New().String()
+	metadata := map[string]interface{}{
+		"communityEvent": true,
+		"channel":        eventChannelName(eventID),
+		"createdBy":      userIDFromContext(ctx),
+	}
+	if err := nk.TournamentCreate(ctx, eventID, true, "desc", "incr", "", metadata,
+		request.Title, request.Description, EVENT_CATEGORY,
+		int(request.StartTime), int(request.EndTime), int(duration), request.MaxSize, 0, true, true); err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to create event: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	tournament, err := getCommunityEvent(ctx, nk, eventID)
+	if err != nil || tournament == nil {
+		return marshalResponse(EventResponse{Success: false, Error: "Event created but could not be read back", Code: ERROR_CODE_REJECTED})
+	}
+	event := communityEventFromTournament(tournament)
+
+	// Seed the event channel so early joiners see what the event is about
+	content := map[string]interface{}{
+		"type":      "event_scheduled",
+		"eventId":   eventID,
+		"title":     request.Title,
+		"text":      request.Description,
+		"startTime": event.StartTime,
+		"endTime":   event.EndTime,
+	}
+	if _, err := nk.ChannelMessageSend(ctx, event.ChannelID, content, "", "", true); err != nil {
+		logger.Warn("Failed to post event announcement for %s: %v", eventID, err)
+	}
+
+	logger.Info("Community event %s scheduled: %s", eventID, request.Title)
+	return marshalResponse(EventResponse{Success: true, Event: &event})
+}
+
+// RpcCancelEvent deletes a community event before it finishes (admin only)
+func RpcCancelEvent(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(EventResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		EventID string `json:"eventId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	tournament, err := getCommunityEvent(ctx, nk, request.EventID)
+	if err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if tournament == nil {
+		return marshalResponse(EventResponse{Success: false, Error: "Event not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	if err := nk.TournamentDelete(ctx, request.EventID); err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to cancel event: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	content := map[string]interface{}{"type": "event_cancelled", "eventId": request.EventID, "title": tournament.Title}
+	if _, err := nk.ChannelMessageSend(ctx, roomChannelID(eventChannelName(request.EventID)), content, "", "", true); err != nil {
+		logger.Warn("Failed to post event cancellation for %s: %v", request.EventID, err)
+	}
+
+	logger.Info("Community event %s cancelled", request.EventID)
+	return marshalResponse(EventResponse{Success: true})
+}
+
+// RpcAwardEventPoints adds points to a participant's event score (admin only)
+func RpcAwardEventPoints(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(EventResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		EventID string `json:"eventId"`
+		UserID  string `json:"userId"`
+		Points  int64  `json:"points"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.EventID == "" || request.UserID == "" {
+		return marshalResponse(EventResponse{Success: false, Error: "Missing required fields: eventId or userId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Points <= 0 || request.Points > EVENT_MAX_POINTS {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Points must be between 1 and %d", EVENT_MAX_POINTS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	users, err := nk.UsersGetId(ctx, []string{request.UserID}, nil)
+	if err != nil || len(users) == 0 {
+		return marshalResponse(EventResponse{Success: false, Error: "User not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	// Events require joining before a score is written, so enter users who were awarded points without joining.
+	// Joining again is a no-op.
+	if err := nk.TournamentJoin(ctx, request.EventID, request.UserID, users[0].Username); err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to enter user into event: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	metadata := map[string]interface{}{"lastReason": request.Reason}
+	if _, err := nk.TournamentRecordWrite(ctx, request.EventID, request.UserID, users[0].Username, request.Points, 0, metadata, nil); err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to award points: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	logger.Info("Awarded %d points to %s in event %s", request.Points, request.UserID, request.EventID)
+	return marshalResponse(EventResponse{Success: true})
+}
+
+// RpcListEvents lists active and upcoming community events
+func RpcListEvents(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	var request struct {
+		Cursor string `json:"cursor"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+
+	list, err := nk.TournamentList(ctx, EVENT_CATEGORY, EVENT_CATEGORY, 0, 0, EVENT_LIST_LIMIT, request.Cursor)
+	if err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to list events: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	events := make([]CommunityEvent, 0, len(list.Tournaments))
+	for _, t := range list.Tournaments {
+		if isCommunityEvent(t) {
+			events = append(events, communityEventFromTournament(t))
+		}
+	}
+	return marshalResponse(EventResponse{Success: true, Events: events, Cursor: list.Cursor})
+}
+
+// RpcJoinEvent enters the caller into a community event
+func RpcJoinEvent(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(EventResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		EventID string `json:"eventId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	tournament, err := getCommunityEvent(ctx, nk, request.EventID)
+	if err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if tournament == nil {
+		return marshalResponse(EventResponse{Success: false, Error: "Event not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	if err := nk.TournamentJoin(ctx, request.EventID, userID, usernameFromContext(ctx)); err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to join event: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	event := communityEventFromTournament(tournament)
+	logger.Info("User %s joined event %s", userID, request.EventID)
+	return marshalResponse(EventResponse{Success: true, Event: &event})
+}
+
+// RpcGetEventStandings returns the current top participants of an event
+func RpcGetEventStandings(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	var request struct {
+		EventID string `json:"eventId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	tournament, err := getCommunityEvent(ctx, nk, request.EventID)
+	if err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if tournament == nil {
+		return marshalResponse(EventResponse{Success: false, Error: "Event not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	standings, err := eventStandings(ctx, nk, request.EventID, EVENT_RESULTS_TOP)
+	if err != nil {
+		return marshalResponse(EventResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	event := communityEventFromTournament(tournament)
+	return marshalResponse(EventResponse{Success: true, Event: &event, Standings: standings})
+}
+
+// OnEventTournamentEnd posts the final results of a community event to its channel and notifies the winners
+func OnEventTournamentEnd(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, tournament *api.Tournament, end, reset int64) error {
+	if !isCommunityEvent(tournament) {
+		return nil
+	}
+
+	standings, err := eventStandings(ctx, nk, tournament.Id, EVENT_RESULTS_TOP)
+	if err != nil {
+		logger.Error("Failed to collect results for event %s: %v", tournament.Id, err)
+		return err
+	}
+
+	content := map[string]interface{}{
+		"type":      "event_results",
+		"eventId":   tournament.Id,
+		"title":     tournament.Title,
+		"standings": standings,
+		"endedAt":   end,
+	}
+	if _, err := nk.ChannelMessageSend(ctx, roomChannelID(eventChannelName(tournament.Id)), content, "", "", true); err != nil {
+		logger.Error("Failed to post results for event %s: %v", tournament.Id, err)
+	}
+
+	notifications := make([]*nkruntime.NotificationSend, 0, len(standings))
+	for _, s := range standings {
+		notifications = append(notifications, &nkruntime.NotificationSend{
+			UserID:     s.UserID,
+			Subject:    fmt.Sprintf("%s has ended", tournament.Title),
+			Content:    map[string]interface{}{"eventId": tournament.Id, "rank": s.Rank, "score": s.Score},
+			Code:       NOTIFICATION_CODE_EVENT,
+			Persistent: true,
+		})
+	}
+	if len(notifications) > 0 {
+		if err := nk.NotificationsSend(ctx, notifications); err != nil {
+			logger.Warn("Failed to notify winners of event %s: %v", tournament.Id, err)
+		}
+	}
+
+	logger.Info("Community event %s closed with %d ranked participants", tournament.Id, len(standings))
+	return nil
+}
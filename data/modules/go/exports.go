@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	EXPORT_DEFAULT_MAX_MESSAGES = 50000
+	// EXPORT_DEFAULT_MAX_ATTACHMENT_BYTES caps the attachments copied into one archive; the rest are listed as skipped
+	EXPORT_DEFAULT_MAX_ATTACHMENT_BYTES = 512 << 20
+	EXPORT_DEFAULT_URL_EXPIRY_SECONDS   = 15 * 60
+	// EXPORT_MAX_URL_EXPIRY_SECONDS keeps download links short-lived; the export bucket itself is never public
+	EXPORT_MAX_URL_EXPIRY_SECONDS = 60 * 60
+	// EXPORT_DEFAULT_RETENTION_HOURS is how long archives stay in the exports bucket before cleanup removes them
+	EXPORT_DEFAULT_RETENTION_HOURS        = 24
+	EXPORT_DEFAULT_CLEANUP_INTERVAL_HOURS = 1
+	EXPORT_CONTENT_TYPE                   = "application/zip"
+)
+
+// ExportedAttachment describes an attachment of an exported channel and where the archive holds it
+type ExportedAttachment struct {
+	ObjectKey   string `json:"objectKey"`
+	MessageID   string `json:"messageId,omitempty"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	// Path is the file in the archive, empty when the object was skipped
+	Path    string `json:"path,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// ChatExport is the messages.json of an export archive
+type ChatExport struct {
+	ChannelID   string                `json:"channelId"`
+	ExportedBy  string                `json:"exportedBy"`
+	ExportedAt  int64                 `json:"exportedAt"`
+	Messages    []*ThreadMessage      `json:"messages"`
+	Attachments []*ExportedAttachment `json:"attachments"`
+	// Truncated is set when the channel has more than EXPORT_MAX_MESSAGES messages; the oldest are exported
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ExportResponse represents the response for export_chat
+type ExportResponse struct {
+	Success bool   `json:"success"`
+	URL     string `json:"url,omitempty"`
+	// ExpiresAt is when URL stops working, in Unix seconds
+	ExpiresAt       int64  `json:"expiresAt,omitempty"`
+	ObjectKey       string `json:"objectKey,omitempty"`
+	Size            int64  `json:"size,omitempty"`
+	MessageCount    int    `json:"messageCount"`
+	AttachmentCount int    `json:"attachmentCount"`
+	Truncated       bool   `json:"truncated,omitempty"`
+	Error           string `json:"error,omitempty"`
+	Code            string `json:"code,omitempty"`
+}
+
+// exportMessages lists up to limit messages of a channel, oldest first, and whether there were more
+func exportMessages(ctx context.Context, db *sql.DB, ref *ChannelRef, limit int) ([]*ThreadMessage, bool, error) {
+	subject, descriptor := messageStreamColumns(ref)
+	rows, err := db.QueryContext(ctx, `
+SELECT id::TEXT, sender_id::TEXT, username, content::TEXT, create_time, update_time FROM message
+WHERE stream_mode = $1 AND stream_subject = $2 AND stream_descriptor = $3 AND stream_label = $4
+ORDER BY create_time ASC, id ASC LIMIT $5`,
+		ref.Mode, subject, descriptor, ref.Label, limit+1)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := make([]*ThreadMessage, 0)
+	for rows.Next() {
+		if len(messages) == limit {
+			return messages, true, nil
+		}
+		message, _, err := scanThreadMessage(rows)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read message: %v", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, false, rows.Err()
+}
+
+// channelAttachments lists the live attachments linked to messages of a channel
+func channelAttachments(ctx context.Context, db *sql.DB, channelID string) ([]*Attachment, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT value::TEXT FROM storage
+WHERE collection = $1 AND value->>'channelId' = $2 AND COALESCE((value->>'deletedAt')::BIGINT, 0) = 0
+ORDER BY create_time ASC`, ATTACHMENT_COLLECTION, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachments: %v", err)
+	}
+	defer rows.Close()
+
+	attachments := make([]*Attachment, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("failed to read attachment: %v", err)
+		}
+		var attachment Attachment
+		if err := json.Unmarshal([]byte(value), &attachment); err != nil {
+			continue
+		}
+		attachments = append(attachments, &attachment)
+	}
+	return attachments, rows.Err()
+}
+
+// copyAttachment streams one stored object into the archive
+func copyAttachment(ctx context.Context, backend StorageBackend, archive *zip.Writer, attachment *Attachment, name string) error {
+	object, err := backend.GetObject(ctx, attachment.BucketOf(attachment.ObjectKey), attachment.ObjectKey)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	// Images and video are compressed already
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Unix(attachment.CreatedAt, 0)})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, object)
+	return err
+}
+
+// writeChatArchive writes the attachments and then messages.json, which records what was copied, to w
+func writeChatArchive(ctx context.Context, logger nkruntime.Logger, backend StorageBackend, w io.Writer, export *ChatExport, attachments []*Attachment) error {
+	archive := zip.NewWriter(w)
+	budget := int64(serverConfig.ExportMaxAttachmentBytes)
+
+	for _, attachment := range attachments {
+		exported := &ExportedAttachment{
+			ObjectKey:   attachment.ObjectKey,
+			MessageID:   attachment.MessageID,
+			ContentType: attachment.ContentType,
+			Size:        attachment.Size,
+		}
+		export.Attachments = append(export.Attachments, exported)
+
+		switch {
+		// Quarantined objects are evidence for moderators, not part of the chat
+		case strings.HasPrefix(attachment.ObjectKey, QUARANTINE_PREFIX):
+			exported.Skipped = "quarantined"
+		case attachment.Size > budget:
+			exported.Skipped = "size limit reached"
+		default:
+			name := "attachments/" + attachment.ObjectKey
+			if err := copyAttachment(ctx, backend, archive, attachment, name); err != nil {
+				logger.Warn("Failed to export attachment %s: %v", attachment.ObjectKey, err)
+				exported.Skipped = "unavailable"
+				continue
+			}
+			budget -= attachment.Size
+			exported.Path = name
+		}
+	}
+
+	entry, err := archive.Create("messages.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(export); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// runExportCleanup removes archives older than EXPORT_RETENTION_HOURS from the exports bucket
+func runExportCleanup(ctx context.Context, logger nkruntime.Logger) error {
+	backend, err := getStorageBackend(logger)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-time.Duration(serverConfig.ExportRetentionHours) * time.Hour)
+
+	expired := make([]string, 0)
+	if err := backend.ListObjects(ctx, serverConfig.ExportBucket, "", func(object *StoredObject) bool {
+		if object.LastModified.Before(cutoff) {
+			expired = append(expired, object.Key)
+		}
+		return true
+	}); err != nil {
+		return fmt.Errorf("failed to list exports: %v", err)
+	}
+
+	for _, key := range expired {
+		if err := backend.RemoveObject(ctx, serverConfig.ExportBucket, key); err != nil {
+			logger.Warn("Failed to remove export %s: %v", key, err)
+		}
+	}
+	if len(expired) > 0 {
+		logger.Info("Removed %d expired chat exports", len(expired))
+	}
+	return nil
+}
+
+// StartExportCleanup removes expired archives every EXPORT_CLEANUP_INTERVAL_HOURS; 0 disables it
+func StartExportCleanup(logger nkruntime.Logger) {
+	hours := serverConfig.ExportCleanupIntervalHours
+	if hours <= 0 {
+		logger.Info("Export cleanup disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := runExportCleanup(context.Background(), logger); err != nil {
+				logger.Error("Export cleanup failed: %v", err)
+			}
+		}
+	}()
+	logger.Info("Export cleanup scheduled every %d hours", hours)
+}
+
+// RpcExportChat packs a channel's messages and attachments into a zip archive in the private exports bucket
+// and returns a short-lived URL to download it. Members may export their channels; admins any channel.
+func RpcExportChat(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" && !isAdmin(ctx) {
+		return marshalResponse(ExportResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" {
+		return marshalResponse(ExportResponse{Success: false, Error: "Missing required field: channelId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	ref, err := parseChannelID(request.ChannelID)
+	if err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Invalid channelId: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if !isAdmin(ctx) {
+		member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+		if err != nil || !member {
+			return marshalResponse(ExportResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+		}
+	}
+
+	messages, truncated, err := exportMessages(ctx, db, ref, serverConfig.ExportMaxMessages)
+	if err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Failed to export messages: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	attachments, err := channelAttachments(ctx, db, request.ChannelID)
+	if err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Failed to export attachments: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	backend, err := getStorageBackend(logger)
+	if err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	if err := backend.EnsureBucket(ctx, logger, serverConfig.ExportBucket); err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Failed to ensure bucket exists: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	// Archives can be large, so they are built on disk rather than in memory
+	file, err := os.CreateTemp("", "chat-export-*.zip")
+	if err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Failed to create export: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	export := &ChatExport{
+		ChannelID:   request.ChannelID,
+		ExportedBy:  userID,
+		ExportedAt:  time.Now().Unix(),
+		Messages:    messages,
+		Attachments: []*ExportedAttachment{},
+		Truncated:   truncated,
+	}
+	if err := writeChatArchive(ctx, logger, backend, file, export, attachments); err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Failed to create export: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Failed to create export: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	owner := userID
+	if owner == "" {
+		owner = "admin"
+	}
+	objectKey := fmt.Sprintf("%s/%s.zip", owner, uuid.New().String())
+	if err := backend.PutObject(ctx, serverConfig.ExportBucket, objectKey, file, size, EXPORT_CONTENT_TYPE); err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Failed to upload export: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	expiry := time.Duration(serverConfig.ExportURLExpirySeconds) * time.Second
+	url, err := backend.PresignGet(ctx, serverConfig.ExportBucket, objectKey, expiry)
+	if err != nil {
+		return marshalResponse(ExportResponse{Success: false, Error: fmt.Sprintf("Failed to generate presigned URL: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	copied := 0
+	for _, a := range export.Attachments {
+		if a.Path != "" {
+			copied++
+		}
+	}
+	logger.Info("Channel %s exported by %s: %d messages, %d attachments, %d bytes", request.ChannelID, owner, len(messages), copied, size)
+
+	return marshalResponse(ExportResponse{
+		Success:         true,
+		URL:             url,
+		ExpiresAt:       time.Now().Add(expiry).Unix(),
+		ObjectKey:       objectKey,
+		Size:            size,
+		MessageCount:    len(messages),
+		AttachmentCount: copied,
+		Truncated:       truncated,
+	})
+}
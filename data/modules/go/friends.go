@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/heroiclabs/nakama-common/api"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	PRIVACY_COLLECTION = "privacy"
+	PRIVACY_KEY        = "settings"
+
+	// Who may send a user friend requests
+	FRIEND_REQUESTS_EVERYONE           = "everyone"
+	FRIEND_REQUESTS_FRIENDS_OF_FRIENDS = "friends_of_friends"
+	FRIEND_REQUESTS_NOBODY             = "nobody"
+
+	// Friend states of Nakama's user_edge table, as seen from the source user
+	FRIEND_STATE_MUTUAL          = 0
+	FRIEND_STATE_INVITE_SENT     = 1
+	FRIEND_STATE_INVITE_RECEIVED = 2
+	FRIEND_STATE_BLOCKED         = 3
+
+	NOTIFICATION_CODE_FRIEND              = 106
+	ERROR_CODE_FRIEND_REQUESTS_RESTRICTED = "FRIEND_REQUESTS_RESTRICTED"
+	// FRIEND_REJECT_STATUS is the grpc status (PERMISSION_DENIED) of AddFriends calls refused by the before hook
+	FRIEND_REJECT_STATUS = 7
+)
+
+// PrivacySettings is a user's own record of who may contact them
+type PrivacySettings struct {
+	// FriendRequests is who may send friend requests: everyone (the default), friends_of_friends or nobody
+	FriendRequests string `json:"friendRequests"`
+}
+
+// PrivacySettingsResponse represents the response for privacy settings RPCs
+type PrivacySettingsResponse struct {
+	Success  bool             `json:"success"`
+	Settings *PrivacySettings `json:"settings,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Code     string           `json:"code,omitempty"`
+}
+
+// FriendResponse represents the response for friend request RPCs
+type FriendResponse struct {
+	Success bool   `json:"success"`
+	UserID  string `json:"userId,omitempty"`
+	// State is pending after a new request, friends once both sides accepted and declined after a refusal
+	State string `json:"state,omitempty"`
+	// ChannelID is the direct chat opened when the request was accepted
+	ChannelID string `json:"channelId,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// FriendRequestError is returned when a friend request is not allowed
+type FriendRequestError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *FriendRequestError) Error() string { return e.Message }
+
+// readPrivacySettings loads a user's privacy settings, defaults if none were saved
+func readPrivacySettings(ctx context.Context, nk nkruntime.NakamaModule, userID string) (*PrivacySettings, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: PRIVACY_COLLECTION, Key: PRIVACY_KEY, UserID: userID}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read privacy settings: %v", err)
+	}
+	settings := &PrivacySettings{FriendRequests: FRIEND_REQUESTS_EVERYONE}
+	if len(objects) == 0 {
+		return settings, nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), settings); err != nil {
+		return nil, fmt.Errorf("failed to decode privacy settings: %v", err)
+	}
+	return settings, nil
+}
+
+// friendState returns the state of the edge from userID to otherID, -1 when they have none
+func friendState(ctx context.Context, db *sql.DB, userID, otherID string) (int, error) {
+	var state int
+	err := db.QueryRowContext(ctx, `SELECT state FROM user_edge WHERE source_id = $1 AND destination_id = $2`, userID, otherID).Scan(&state)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to read friend state: %v", err)
+	}
+	return state, nil
+}
+
+// haveMutualFriend reports whether two users have a friend in common
+func haveMutualFriend(ctx context.Context, db *sql.DB, userID, otherID string) (bool, error) {
+	var found int
+	err := db.QueryRowContext(ctx, `
+		SELECT 1 FROM user_edge a
+		JOIN user_edge b ON b.source_id = a.destination_id
+		WHERE a.source_id = $1 AND a.state = $3 AND b.destination_id = $2 AND b.state = $3
+		LIMIT 1`, userID, otherID, FRIEND_STATE_MUTUAL).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up mutual friends: %v", err)
+	}
+	return true, nil
+}
+
+// checkFriendRequest enforces the target's privacy settings and blocks on a friend request.
+// Accepting a request the target sent is always allowed.
+func checkFriendRequest(ctx context.Context, db *sql.DB, nk nkruntime.NakamaModule, senderID, targetID string) error {
+	if senderID == targetID {
+		return &FriendRequestError{Code: ERROR_CODE_PAYLOAD_INVALID, Message: "Invalid userId: cannot add yourself as a friend"}
+	}
+	state, err := friendState(ctx, db, senderID, targetID)
+	if err != nil {
+		return err
+	}
+	if state == FRIEND_STATE_INVITE_RECEIVED || state == FRIEND_STATE_MUTUAL {
+		return nil
+	}
+
+	blocked, err := hasBlocked(ctx, nk, targetID, senderID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return &FriendRequestError{Code: ERROR_CODE_USER_BLOCKED, Message: "You cannot add this user"}
+	}
+
+	settings, err := readPrivacySettings(ctx, nk, targetID)
+	if err != nil {
+		return err
+	}
+	switch settings.FriendRequests {
+	case FRIEND_REQUESTS_NOBODY:
+		return &FriendRequestError{Code: ERROR_CODE_FRIEND_REQUESTS_RESTRICTED, Message: "This user is not accepting friend requests"}
+	case FRIEND_REQUESTS_FRIENDS_OF_FRIENDS:
+		mutual, err := haveMutualFriend(ctx, db, senderID, targetID)
+		if err != nil {
+			return err
+		}
+		if !mutual {
+			return &FriendRequestError{Code: ERROR_CODE_FRIEND_REQUESTS_RESTRICTED, Message: "This user accepts friend requests from friends of friends only"}
+		}
+	}
+	return nil
+}
+
+// notifyFriend sends a friend notification of the given type to a user
+func notifyFriend(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, userID, subject, kind, senderID, senderUsername, channelID string) {
+	content := map[string]interface{}{
+		"type":     kind,
+		"userId":   senderID,
+		"username": senderUsername,
+	}
+	if channelID != "" {
+		content["channelId"] = channelID
+	}
+	if err := nk.NotificationSend(ctx, userID, subject, content, NOTIFICATION_CODE_FRIEND, senderID, true); err != nil {
+		logger.Warn("Failed to send %s notification to %s: %v", kind, userID, err)
+	}
+}
+
+// openFriendDM creates the direct chat of two new friends by posting its first message
+func openFriendDM(ctx context.Context, nk nkruntime.NakamaModule, userID, friendID string) (string, error) {
+	channelID, err := nk.ChannelIdBuild(ctx, userID, friendID, nkruntime.DirectMessage)
+	if err != nil {
+		return "", fmt.Errorf("failed to build direct channel ID: %v", err)
+	}
+	content := map[string]interface{}{
+		"type":    "friend_accepted",
+		"userIds": []string{friendID, userID},
+	}
+	if _, err := nk.ChannelMessageSend(ctx, channelID, content, "", "", true); err != nil {
+		return "", fmt.Errorf("failed to open direct channel: %v", err)
+	}
+	return channelID, nil
+}
+
+// afterFriendAdd follows up on userID adding targetID: the target hears about a new request, or when this
+// accepted the target's request, the pair gets a direct chat and the target hears it was accepted.
+// It returns the new direct channel, if any.
+func afterFriendAdd(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, userID, username, targetID string) string {
+	state, err := friendState(ctx, db, userID, targetID)
+	if err != nil {
+		logger.Warn("Failed to read friend state of %s and %s: %v", userID, targetID, err)
+		return ""
+	}
+
+	switch state {
+	case FRIEND_STATE_INVITE_SENT:
+		notifyFriend(ctx, logger, nk, targetID, "New friend request", "friend_request", userID, username, "")
+	case FRIEND_STATE_MUTUAL:
+		channelID, err := openFriendDM(ctx, nk, userID, targetID)
+		if err != nil {
+			logger.Warn("Failed to open direct chat of %s and %s: %v", userID, targetID, err)
+		}
+		notifyFriend(ctx, logger, nk, targetID, "Friend request accepted", "friend_accepted", userID, username, channelID)
+		return channelID
+	}
+	return ""
+}
+
+// resolveFriendTargets returns the user IDs an AddFriends request names by ID or username
+func resolveFriendTargets(ctx context.Context, nk nkruntime.NakamaModule, ids, usernames []string) ([]string, error) {
+	targets := append([]string{}, ids...)
+	if len(usernames) > 0 {
+		users, err := nk.UsersGetUsername(ctx, usernames)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up users: %v", err)
+		}
+		for _, u := range users {
+			targets = append(targets, u.Id)
+		}
+	}
+	return targets, nil
+}
+
+// BeforeAddFriends applies the friend request rules to clients calling Nakama's AddFriends API directly
+func BeforeAddFriends(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *api.AddFriendsRequest) (*api.AddFriendsRequest, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return in, nil
+	}
+	targets, err := resolveFriendTargets(ctx, nk, in.Ids, in.Usernames)
+	if err != nil {
+		logger.Warn("Failed to resolve friend targets of %s: %v", userID, err)
+		return in, nil
+	}
+	for _, targetID := range targets {
+		if err := checkFriendRequest(ctx, db, nk, userID, targetID); err != nil {
+			rejected, ok := err.(*FriendRequestError)
+			if !ok {
+				logger.Warn("Failed to check friend request from %s to %s: %v", userID, targetID, err)
+				continue
+			}
+			body, _ := json.Marshal(rejected)
+			return nil, nkruntime.NewError(string(body), FRIEND_REJECT_STATUS)
+		}
+	}
+	return in, nil
+}
+
+// AfterAddFriends sends the friend notifications and opens direct chats for AddFriends API calls
+func AfterAddFriends(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *api.AddFriendsRequest) error {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return nil
+	}
+	targets, err := resolveFriendTargets(ctx, nk, in.Ids, in.Usernames)
+	if err != nil {
+		logger.Warn("Failed to resolve friend targets of %s: %v", userID, err)
+		return nil
+	}
+	for _, targetID := range targets {
+		afterFriendAdd(ctx, logger, db, nk, userID, usernameFromContext(ctx), targetID)
+	}
+	return nil
+}
+
+// RpcSendFriendRequest asks a user, by userId or username, to become the caller's friend.
+// If they already asked the caller, this accepts their request instead.
+func RpcSendFriendRequest(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(FriendResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UserID   string `json:"userId"`
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(FriendResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UserID == "" && request.Username == "" {
+		return marshalResponse(FriendResponse{Success: false, Error: "Missing required field: userId or username", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	if request.UserID != "" {
+		if _, err := uuid.Parse(request.UserID); err != nil {
+			return marshalResponse(FriendResponse{Success: false, Error: "Invalid userId", Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		request.Username = ""
+	}
+	var users []*api.User
+	var err error
+	if request.UserID != "" {
+		users, err = nk.UsersGetId(ctx, []string{request.UserID}, nil)
+	} else {
+		users, err = nk.UsersGetUsername(ctx, []string{request.Username})
+	}
+	if err != nil {
+		return marshalResponse(FriendResponse{Success: false, Error: fmt.Sprintf("Failed to look up user: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	if len(users) == 0 {
+		return marshalResponse(FriendResponse{Success: false, Error: "User not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	targetID := users[0].Id
+
+	state, err := friendState(ctx, db, userID, targetID)
+	if err != nil {
+		return marshalResponse(FriendResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	switch state {
+	case FRIEND_STATE_MUTUAL:
+		return marshalResponse(FriendResponse{Success: false, Error: "You are already friends", Code: ERROR_CODE_CONFLICT})
+	case FRIEND_STATE_INVITE_SENT:
+		return marshalResponse(FriendResponse{Success: false, Error: "Friend request already sent", Code: ERROR_CODE_CONFLICT})
+	case FRIEND_STATE_BLOCKED:
+		return marshalResponse(FriendResponse{Success: false, Error: "Unblock this user before adding them", Code: ERROR_CODE_REJECTED})
+	}
+	if err := checkFriendRequest(ctx, db, nk, userID, targetID); err != nil {
+		if rejected, ok := err.(*FriendRequestError); ok {
+			return marshalResponse(FriendResponse{Success: false, Code: rejected.Code, Error: rejected.Message})
+		}
+		return marshalResponse(FriendResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	username := usernameFromContext(ctx)
+	if err := nk.FriendsAdd(ctx, userID, username, []string{targetID}, nil); err != nil {
+		return marshalResponse(FriendResponse{Success: false, Error: fmt.Sprintf("Failed to add friend: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	channelID := afterFriendAdd(ctx, logger, db, nk, userID, username, targetID)
+
+	response := FriendResponse{Success: true, UserID: targetID, State: "pending"}
+	if state == FRIEND_STATE_INVITE_RECEIVED {
+		response.State = "friends"
+		response.ChannelID = channelID
+	}
+	logger.Info("User %s sent a friend request to %s", userID, targetID)
+	return marshalResponse(response)
+}
+
+// RpcRespondFriendRequest accepts or declines a friend request the caller received
+func RpcRespondFriendRequest(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(FriendResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UserID string `json:"userId"`
+		Accept bool   `json:"accept"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(FriendResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UserID == "" {
+		return marshalResponse(FriendResponse{Success: false, Error: "Missing required field: userId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	state, err := friendState(ctx, db, userID, request.UserID)
+	if err != nil {
+		return marshalResponse(FriendResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if state != FRIEND_STATE_INVITE_RECEIVED {
+		return marshalResponse(FriendResponse{Success: false, Error: "Friend request not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	username := usernameFromContext(ctx)
+	if !request.Accept {
+		if err := nk.FriendsDelete(ctx, userID, username, []string{request.UserID}, nil); err != nil {
+			return marshalResponse(FriendResponse{Success: false, Error: fmt.Sprintf("Failed to decline friend request: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+		logger.Info("User %s declined the friend request of %s", userID, request.UserID)
+		return marshalResponse(FriendResponse{Success: true, UserID: request.UserID, State: "declined"})
+	}
+
+	if err := nk.FriendsAdd(ctx, userID, username, []string{request.UserID}, nil); err != nil {
+		return marshalResponse(FriendResponse{Success: false, Error: fmt.Sprintf("Failed to accept friend request: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	channelID := afterFriendAdd(ctx, logger, db, nk, userID, username, request.UserID)
+
+	logger.Info("User %s accepted the friend request of %s", userID, request.UserID)
+	return marshalResponse(FriendResponse{Success: true, UserID: request.UserID, State: "friends", ChannelID: channelID})
+}
+
+// RpcGetPrivacySettings returns the caller's privacy settings
+func RpcGetPrivacySettings(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PrivacySettingsResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	settings, err := readPrivacySettings(ctx, nk, userID)
+	if err != nil {
+		return marshalResponse(PrivacySettingsResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(PrivacySettingsResponse{Success: true, Settings: settings})
+}
+
+// RpcUpdatePrivacySettings changes the settings given in the request and keeps the others
+func RpcUpdatePrivacySettings(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PrivacySettingsResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		FriendRequests *string `json:"friendRequests"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PrivacySettingsResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if fr := request.FriendRequests; fr != nil && *fr != FRIEND_REQUESTS_EVERYONE && *fr != FRIEND_REQUESTS_FRIENDS_OF_FRIENDS && *fr != FRIEND_REQUESTS_NOBODY {
+		return marshalResponse(PrivacySettingsResponse{Success: false, Error: fmt.Sprintf("friendRequests must be %s, %s or %s", FRIEND_REQUESTS_EVERYONE, FRIEND_REQUESTS_FRIENDS_OF_FRIENDS, FRIEND_REQUESTS_NOBODY), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	settings, err := readPrivacySettings(ctx, nk, userID)
+	if err != nil {
+		return marshalResponse(PrivacySettingsResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if request.FriendRequests != nil {
+		settings.FriendRequests = *request.FriendRequests
+	}
+
+	value, _ := json.Marshal(settings)
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      PRIVACY_COLLECTION,
+		Key:             PRIVACY_KEY,
+		UserID:          userID,
+		Value:           string(value),
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}}); err != nil {
+		return marshalResponse(PrivacySettingsResponse{Success: false, Error: fmt.Sprintf("Failed to save privacy settings: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	logger.Info("Privacy settings of %s updated", userID)
+	return marshalResponse(PrivacySettingsResponse{Success: true, Settings: settings})
+}
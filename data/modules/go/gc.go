@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	ORPHAN_GC_DEFAULT_INTERVAL_HOURS = 24
+	ORPHAN_GC_DEFAULT_MIN_AGE_DAYS   = 7
+	ORPHAN_GC_LIST_PAGE_SIZE         = 100
+	ORPHAN_GC_DRY_RUN_SAMPLE         = 100
+)
+
+// OrphanGCReport summarizes one garbage collection pass
+type OrphanGCReport struct {
+	Scanned    int      `json:"scanned"`
+	Referenced int      `json:"referenced"`
+	Orphaned   int      `json:"orphaned"`
+	Deleted    int      `json:"deleted"`
+	Keys       []string `json:"keys,omitempty"`
+}
+
+// OrphanGCResponse represents the response for run_orphan_gc
+type OrphanGCResponse struct {
+	Success bool                       `json:"success"`
+	Buckets map[string]*OrphanGCReport `json:"buckets,omitempty"`
+	Error   string                     `json:"error,omitempty"`
+	Code    string                     `json:"code,omitempty"`
+}
+
+// referencedObjects collects every object key kept alive by an attachment record, a moderation flag or an avatar, per bucket
+func referencedObjects(ctx context.Context, nk nkruntime.NakamaModule) (map[string]map[string]bool, error) {
+	referenced := map[string]map[string]bool{}
+	keep := func(bucket string, keys ...string) {
+		if referenced[bucket] == nil {
+			referenced[bucket] = map[string]bool{}
+		}
+		for _, key := range keys {
+			referenced[bucket][key] = true
+		}
+	}
+
+	err := listAllStorage(ctx, nk, ATTACHMENT_COLLECTION, func(value string) {
+		var attachment Attachment
+		if err := json.Unmarshal([]byte(value), &attachment); err == nil {
+			for _, key := range attachment.ObjectKeys() {
+				keep(attachment.BucketOf(key), key)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Quarantined uploads stay until an admin reviews them
+	err = listAllStorage(ctx, nk, MODERATION_FLAG_COLLECTION, func(value string) {
+		var flag FlaggedUpload
+		if err := json.Unmarshal([]byte(value), &flag); err == nil {
+			keep(flag.Bucket, flag.QuarantineKey)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = listAllStorage(ctx, nk, AVATAR_COLLECTION, func(value string) {
+		var avatar Avatar
+		if err := json.Unmarshal([]byte(value), &avatar); err == nil {
+			for _, key := range avatar.ObjectKeys {
+				keep(bucketForKey(key), key)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return referenced, nil
+}
+
+// listAllStorage calls fn with the value of every object in a collection, across all users
+func listAllStorage(ctx context.Context, nk nkruntime.NakamaModule, collection string, fn func(value string)) error {
+	cursor := ""
+	for {
+		// An empty user ID lists the collection across all users
+		objects, next, err := nk.StorageList(ctx, "", "", collection, ORPHAN_GC_LIST_PAGE_SIZE, cursor)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			fn(object.Value)
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// collectOrphans removes objects older than minAge that no attachment record references
+func collectOrphans(ctx context.Context, logger nkruntime.Logger, bucket string, referenced map[string]bool, minAge time.Duration, dryRun bool) (*OrphanGCReport, error) {
+	report := &OrphanGCReport{}
+	cutoff := time.Now().Add(-minAge)
+
+	backend, err := getStorageBackend(logger)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	err = backend.ListObjects(ctx, bucket, "", func(object *StoredObject) bool {
+		report.Scanned++
+		if referenced[object.Key] {
+			report.Referenced++
+			return true
+		}
+		// Young objects may belong to an upload that has not been recorded yet
+		if object.LastModified.After(cutoff) {
+			return true
+		}
+		report.Orphaned++
+		if dryRun {
+			if len(report.Keys) < ORPHAN_GC_DRY_RUN_SAMPLE {
+				report.Keys = append(report.Keys, object.Key)
+			}
+			return true
+		}
+		orphans = append(orphans, object.Key)
+		return true
+	})
+	if err != nil {
+		logger.Warn("Orphan GC failed to list %s: %v", bucket, err)
+	}
+
+	for _, key := range orphans {
+		if err := backend.RemoveObject(ctx, bucket, key); err != nil {
+			logger.Warn("Orphan GC failed to delete %s/%s: %v", bucket, key, err)
+			continue
+		}
+		report.Deleted++
+	}
+	return report, nil
+}
+
+// ORPHAN_GC_KINDS are the kinds of objects referencedObjects knows every reference to. Sticker packs and
+// exports are tracked on their own, so a bucket shared with them is never swept.
+var ORPHAN_GC_KINDS = map[string]bool{"image": true, "video": true, "voice": true, "avatar": true, "quarantine": true}
+
+// orphanGCBuckets lists the buckets that only hold ORPHAN_GC_KINDS
+func orphanGCBuckets() []string {
+	var buckets []string
+	for _, bucket := range serverConfig.Buckets {
+		sweep := true
+		for _, kind := range bucket.Kinds {
+			sweep = sweep && ORPHAN_GC_KINDS[kind]
+		}
+		if sweep {
+			buckets = append(buckets, bucket.Name)
+		}
+	}
+	return buckets
+}
+
+// runOrphanGC sweeps every bucket of uploads, voice clips and avatars
+func runOrphanGC(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, dryRun bool) (map[string]*OrphanGCReport, error) {
+	if _, err := getStorageBackend(logger); err != nil {
+		return nil, err
+	}
+	referenced, err := referencedObjects(ctx, nk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load object references: %v", err)
+	}
+
+	minAge := time.Duration(serverConfig.OrphanGCMinAgeDays) * 24 * time.Hour
+	reports := map[string]*OrphanGCReport{}
+	for _, bucket := range orphanGCBuckets() {
+		report, err := collectOrphans(ctx, logger, bucket, referenced[bucket], minAge, dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sweep %s: %v", bucket, err)
+		}
+		reports[bucket] = report
+		logger.Info("Orphan GC %s: scanned %d, orphaned %d, deleted %d", bucket, report.Scanned, report.Orphaned, report.Deleted)
+	}
+	return reports, nil
+}
+
+// StartOrphanGC runs the orphan sweep every ORPHAN_GC_INTERVAL_HOURS; 0 disables it
+func StartOrphanGC(logger nkruntime.Logger, nk nkruntime.NakamaModule) {
+	hours := serverConfig.OrphanGCIntervalHours
+	if hours <= 0 {
+		logger.Info("Orphan GC disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := runOrphanGC(context.Background(), logger, nk, false); err != nil {
+				logger.Error("Orphan GC failed: %v", err)
+			}
+			if err := pruneOutboxDeliveries(context.Background(), logger, nk); err != nil {
+				logger.Error("Outbox pruning failed: %v", err)
+			}
+		}
+	}()
+	logger.Info("Orphan GC scheduled every %d hours", hours)
+}
+
+// RpcRunOrphanGC runs a sweep on demand (admin only); dryRun lists what would be deleted
+func RpcRunOrphanGC(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(OrphanGCResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		DryRun bool `json:"dryRun"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(OrphanGCResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+
+	reports, err := runOrphanGC(ctx, logger, nk, request.DryRun)
+	if err != nil {
+		return marshalResponse(OrphanGCResponse{Success: false, Error: fmt.Sprintf("Orphan GC failed: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	return marshalResponse(OrphanGCResponse{Success: true, Buckets: reports})
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	GROUP_CHAT_DEFAULT_MAX_COUNT = 100
+	GROUP_CHAT_MAX_NAME          = 64
+	GROUP_INVITE_MAX_USERS       = 50
+	NOTIFICATION_CODE_GROUP      = 103
+)
+
+// GroupChatResponse represents the response for group chat RPCs
+type GroupChatResponse struct {
+	Success bool     `json:"success"`
+	GroupID string   `json:"groupId,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Code    string   `json:"code,omitempty"`
+}
+
+// groupMemberRequest is the payload of RPCs that act on one member of a group
+type groupMemberRequest struct {
+	GroupID string `json:"groupId"`
+	UserID  string `json:"userId"`
+}
+
+// requireGroupRole returns an error unless the user's state in the group is maxState or better (lower)
+func requireGroupRole(ctx context.Context, nk nkruntime.NakamaModule, groupID, userID string, maxState int) error {
+	state, err := groupState(ctx, nk, groupID, userID)
+	if err != nil {
+		return err
+	}
+	if state < GROUP_STATE_SUPERADMIN || state > maxState {
+		return errorWithCode(ERROR_CODE_PERMISSION_DENIED, "Permission denied")
+	}
+	return nil
+}
+
+// notifyGroupChange tells users what happened to their membership of a group
+func notifyGroupChange(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, groupID, action, subject string, userIDs []string) {
+	senderID := userIDFromContext(ctx)
+	notifications := make([]*nkruntime.NotificationSend, 0, len(userIDs))
+	for _, id := range userIDs {
+		notifications = append(notifications, &nkruntime.NotificationSend{
+			UserID:  id,
+			Subject: subject,
+			Content: map[string]interface{}{
+				"groupId":   groupID,
+				"channelId": groupChannelID(groupID),
+				"action":    action,
+				"by":        senderID,
+			},
+			Code:       NOTIFICATION_CODE_GROUP,
+			Sender:     senderID,
+			Persistent: true,
+		})
+	}
+	if len(notifications) == 0 {
+		return
+	}
+	if err := nk.NotificationsSend(ctx, notifications); err != nil {
+		logger.Warn("Failed to send %s notifications for group %s: %v", action, groupID, err)
+	}
+}
+
+// existingUsers drops IDs that do not belong to an account, and duplicates
+func existingUsers(ctx context.Context, nk nkruntime.NakamaModule, userIDs []string) ([]string, error) {
+	users, err := nk.UsersGetId(ctx, userIDs, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up users: %v", err)
+	}
+	ids := make([]string, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.Id)
+	}
+	return ids, nil
+}
+
+// addGroupMembers adds users to a group on behalf of the caller and notifies them
+func addGroupMembers(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, groupID, groupName string, userIDs []string) ([]string, error) {
+	callerID := userIDFromContext(ctx)
+	others := make([]string, 0, len(userIDs))
+	for _, id := range userIDs {
+		if id != callerID {
+			others = append(others, id)
+		}
+	}
+	if len(others) == 0 {
+		return nil, nil
+	}
+	added, err := existingUsers(ctx, nk, others)
+	if err != nil {
+		return nil, err
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+	if err := nk.GroupUsersAdd(ctx, callerID, groupID, added); err != nil {
+		return nil, fmt.Errorf("failed to add members: %v", err)
+	}
+	notifyGroupChange(ctx, logger, nk, groupID, "added", fmt.Sprintf("You were added to %s", groupName), added)
+	return added, nil
+}
+
+// parseGroupMemberRequest decodes a groupId/userId payload
+func parseGroupMemberRequest(payload string) (*groupMemberRequest, error) {
+	var request groupMemberRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Failed to parse request: %v", err)
+	}
+	if request.GroupID == "" || request.UserID == "" {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Missing required fields: groupId or userId")
+	}
+	return &request, nil
+}
+
+// groupName returns a group's display name for notifications
+func groupName(ctx context.Context, nk nkruntime.NakamaModule, groupID string) string {
+	groups, err := nk.GroupsGetId(ctx, []string{groupID})
+	if err != nil || len(groups) == 0 {
+		return "a group"
+	}
+	return groups[0].Name
+}
+
+// RpcCreateGroupChat creates a private group chat owned by the caller and adds the initial members
+func RpcCreateGroupChat(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		MemberIDs   []string `json:"memberIds"`
+		Open        bool     `json:"open"`
+		MaxCount    int      `json:"maxCount"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Missing required field: name", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Name) > GROUP_CHAT_MAX_NAME {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("name cannot exceed %d bytes", GROUP_CHAT_MAX_NAME), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.MemberIDs) > GROUP_INVITE_MAX_USERS {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("memberIds cannot exceed %d", GROUP_INVITE_MAX_USERS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.MaxCount <= 0 {
+		request.MaxCount = GROUP_CHAT_DEFAULT_MAX_COUNT
+	}
+
+	group, err := nk.GroupCreate(ctx, userID, request.Name, userID, "", request.Description, "", request.Open, map[string]interface{}{"chat": true}, request.MaxCount)
+	if err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("Failed to create group: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	added, err := addGroupMembers(ctx, logger, nk, group.Id, group.Name, request.MemberIDs)
+	if err != nil {
+		logger.Error("Failed to add initial members to group %s: %v", group.Id, err)
+	}
+
+	logger.Info("Group chat %s created by %s with %d members", group.Id, userID, len(added)+1)
+	return marshalResponse(GroupChatResponse{Success: true, GroupID: group.Id, Added: added})
+}
+
+// RpcInviteMembers adds users to a group chat; only admins may add members
+func RpcInviteMembers(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		GroupID string   `json:"groupId"`
+		UserIDs []string `json:"userIds"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.GroupID == "" || len(request.UserIDs) == 0 {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Missing required fields: groupId or userIds", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.UserIDs) > GROUP_INVITE_MAX_USERS {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("userIds cannot exceed %d", GROUP_INVITE_MAX_USERS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := requireGroupRole(ctx, nk, request.GroupID, userID, GROUP_STATE_ADMIN); err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	added, err := addGroupMembers(ctx, logger, nk, request.GroupID, groupName(ctx, nk, request.GroupID), request.UserIDs)
+	if err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(GroupChatResponse{Success: true, GroupID: request.GroupID, Added: added})
+}
+
+// RpcKickMember removes a member from a group chat. Admins can kick members; only the owner can kick admins.
+func RpcKickMember(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	request, err := parseGroupMemberRequest(payload)
+	if err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if request.UserID == userID {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Use leave instead of kicking yourself", Code: ERROR_CODE_REJECTED})
+	}
+
+	callerState, err := groupState(ctx, nk, request.GroupID, userID)
+	if err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	targetState, err := groupState(ctx, nk, request.GroupID, request.UserID)
+	if err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if targetState < GROUP_STATE_SUPERADMIN {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "User is not a member of this group", Code: ERROR_CODE_REJECTED})
+	}
+	if callerState < GROUP_STATE_SUPERADMIN || callerState > GROUP_STATE_ADMIN || callerState >= targetState {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	if err := nk.GroupUsersKick(ctx, userID, request.GroupID, []string{request.UserID}); err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("Failed to kick member: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	notifyGroupChange(ctx, logger, nk, request.GroupID, "kicked", fmt.Sprintf("You were removed from %s", groupName(ctx, nk, request.GroupID)), []string{request.UserID})
+	return marshalResponse(GroupChatResponse{Success: true, GroupID: request.GroupID})
+}
+
+// RpcPromoteAdmin makes a member an admin of a group chat
+func RpcPromoteAdmin(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	request, err := parseGroupMemberRequest(payload)
+	if err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if err := requireGroupRole(ctx, nk, request.GroupID, userID, GROUP_STATE_ADMIN); err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	targetState, err := groupState(ctx, nk, request.GroupID, request.UserID)
+	if err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if targetState != GROUP_STATE_MEMBER {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "User is not a regular member of this group", Code: ERROR_CODE_REJECTED})
+	}
+
+	if err := nk.GroupUsersPromote(ctx, userID, request.GroupID, []string{request.UserID}); err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("Failed to promote member: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	notifyGroupChange(ctx, logger, nk, request.GroupID, "promoted", fmt.Sprintf("You are now an admin of %s", groupName(ctx, nk, request.GroupID)), []string{request.UserID})
+	return marshalResponse(GroupChatResponse{Success: true, GroupID: request.GroupID})
+}
+
+// RpcTransferOwnership hands the group to another member; the caller stays on as an admin
+func RpcTransferOwnership(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	request, err := parseGroupMemberRequest(payload)
+	if err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if request.UserID == userID {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "You already own this group", Code: ERROR_CODE_CONFLICT})
+	}
+	if err := requireGroupRole(ctx, nk, request.GroupID, userID, GROUP_STATE_SUPERADMIN); err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	targetState, err := groupState(ctx, nk, request.GroupID, request.UserID)
+	if err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if targetState < GROUP_STATE_SUPERADMIN || targetState > GROUP_STATE_MEMBER {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "User is not a member of this group", Code: ERROR_CODE_REJECTED})
+	}
+
+	// Nakama promotes one step at a time: member, admin, superadmin
+	for state := targetState; state > GROUP_STATE_SUPERADMIN; state-- {
+		if err := nk.GroupUsersPromote(ctx, userID, request.GroupID, []string{request.UserID}); err != nil {
+			return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("Failed to promote new owner: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+	}
+	// With two superadmins the caller can now step down
+	if err := nk.GroupUsersDemote(ctx, request.UserID, request.GroupID, []string{userID}); err != nil {
+		logger.Error("Failed to demote previous owner %s of group %s: %v", userID, request.GroupID, err)
+	}
+
+	notifyGroupChange(ctx, logger, nk, request.GroupID, "ownership", fmt.Sprintf("You now own %s", groupName(ctx, nk, request.GroupID)), []string{request.UserID})
+	logger.Info("Group %s transferred from %s to %s", request.GroupID, userID, request.UserID)
+	return marshalResponse(GroupChatResponse{Success: true, GroupID: request.GroupID})
+}
+
+// RpcSetGroupAvatar sets a group's avatar to an image the caller uploaded with upload_image or confirm_upload,
+// so the avatar went through the same validation, moderation and metadata stripping as chat images.
+// The group's avatarUrl holds the object key; clients resolve it with get_image_url.
+func RpcSetGroupAvatar(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		GroupID   string `json:"groupId"`
+		ObjectKey string `json:"objectKey"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.GroupID == "" || request.ObjectKey == "" {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Missing required fields: groupId or objectKey", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := requireGroupRole(ctx, nk, request.GroupID, userID, GROUP_STATE_ADMIN); err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	attachment, version, err := readAttachment(ctx, nk, userID, request.ObjectKey)
+	if err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("Failed to read upload: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	if attachment == nil || attachment.DeletedAt != 0 {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Upload not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	if !isImageContentType(attachment.ContentType) {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Avatar must be an image", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	groups, err := nk.GroupsGetId(ctx, []string{request.GroupID})
+	if err != nil || len(groups) == 0 {
+		return marshalResponse(GroupChatResponse{Success: false, Error: "Group not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	group := groups[0]
+	// Tie the upload to the group so members may fetch it when storage is private
+	if attachment.ChannelID == "" {
+		attachment.ChannelID = groupChannelID(group.Id)
+		if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{attachmentWrite(attachment, version)}); err != nil {
+			logger.Warn("Failed to link avatar %s to group %s: %v", request.ObjectKey, group.Id, err)
+		}
+	}
+	open := group.Open != nil && group.Open.Value
+	if err := nk.GroupUpdate(ctx, group.Id, userID, "", "", "", "", request.ObjectKey, open, nil, 0); err != nil {
+		return marshalResponse(GroupChatResponse{Success: false, Error: fmt.Sprintf("Failed to update group: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	return marshalResponse(GroupChatResponse{Success: true, GroupID: group.Id})
+}
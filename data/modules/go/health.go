@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	STORAGE_HEALTH_OK       = "ok"
+	STORAGE_HEALTH_DEGRADED = "degraded"
+	STORAGE_HEALTH_DOWN     = "down"
+	// STORAGE_HEALTH_PREFIX holds the probe objects written by the write check, each removed right away
+	STORAGE_HEALTH_PREFIX                   = "healthcheck/"
+	STORAGE_HEALTH_DEFAULT_INTERVAL_SECONDS = 60
+	STORAGE_HEALTH_DEFAULT_TIMEOUT_SECONDS  = 5
+	STORAGE_HEALTH_DEFAULT_SLOW_MS          = 1000
+	// STORAGE_HEALTH_UNAVAILABLE_STATUS is the grpc status (UNAVAILABLE, HTTP 503) storage_health fails with when storage is down
+	STORAGE_HEALTH_UNAVAILABLE_STATUS = 14
+)
+
+// StorageCheck is the outcome of one step of a storage health check
+type StorageCheck struct {
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// StorageHealthResponse represents the response for storage_health
+type StorageHealthResponse struct {
+	Success bool `json:"success"`
+	// Status is ok, degraded (every check passed but one was slower than STORAGE_HEALTH_SLOW_MS) or down
+	Status    string          `json:"status,omitempty"`
+	Backend   string          `json:"backend,omitempty"`
+	Bucket    string          `json:"bucket,omitempty"`
+	Checks    []*StorageCheck `json:"checks,omitempty"`
+	LatencyMs int64           `json:"latencyMs,omitempty"`
+	CheckedAt int64           `json:"checkedAt,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Code      string          `json:"code,omitempty"`
+}
+
+// lastStorageHealth is the latest result of the periodic self-check
+var lastStorageHealth struct {
+	sync.Mutex
+	report *StorageHealthResponse
+}
+
+// timeStorageCheck runs one check and records how long it took
+func timeStorageCheck(name string, check func() error) *StorageCheck {
+	start := time.Now()
+	err := check()
+	result := &StorageCheck{Name: name, OK: err == nil, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// checkStorageHealth verifies the image bucket can be listed, which needs valid credentials, and that an object
+// can be written, read back and removed, timing every step
+func checkStorageHealth(ctx context.Context, logger nkruntime.Logger) *StorageHealthResponse {
+	report := &StorageHealthResponse{Success: true, Bucket: serverConfig.Bucket, CheckedAt: time.Now().Unix()}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(serverConfig.StorageHealthTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	var backend StorageBackend
+	if check := timeStorageCheck("initialize", func() (err error) {
+		backend, err = getStorageBackend(logger)
+		return err
+	}); !check.OK {
+		report.Checks = append(report.Checks, check)
+		report.Status = STORAGE_HEALTH_DOWN
+		return report
+	}
+	report.Backend = backend.Name()
+
+	report.Checks = append(report.Checks, timeStorageCheck("list", func() error {
+		return backend.ListObjects(ctx, serverConfig.Bucket, "", func(*StoredObject) bool { return false })
+	}))
+
+	key := STORAGE_HEALTH_PREFIX + uuid.New().String()
+	probe := []byte("ok")
+	report.Checks = append(report.Checks, timeStorageCheck("write", func() error {
+		return backend.PutObject(ctx, serverConfig.Bucket, key, bytes.NewReader(probe), int64(len(probe)), "text/plain")
+	}))
+	if report.Checks[len(report.Checks)-1].OK {
+		report.Checks = append(report.Checks, timeStorageCheck("read", func() error {
+			info, err := backend.StatObject(ctx, serverConfig.Bucket, key)
+			if err == nil && info.Size != int64(len(probe)) {
+				err = fmt.Errorf("probe object has %d bytes, wrote %d", info.Size, len(probe))
+			}
+			return err
+		}))
+		report.Checks = append(report.Checks, timeStorageCheck("remove", func() error {
+			return backend.RemoveObject(ctx, serverConfig.Bucket, key)
+		}))
+	}
+
+	report.Status = STORAGE_HEALTH_OK
+	slow := int64(serverConfig.StorageHealthSlowMs)
+	for _, check := range report.Checks {
+		report.LatencyMs += check.LatencyMs
+		if !check.OK {
+			report.Status = STORAGE_HEALTH_DOWN
+		} else if check.LatencyMs > slow && report.Status == STORAGE_HEALTH_OK {
+			report.Status = STORAGE_HEALTH_DEGRADED
+		}
+	}
+	return report
+}
+
+// recordStorageHealth keeps a self-check result, reports it as the storage_healthy gauge and logs status changes
+func recordStorageHealth(logger nkruntime.Logger, nk nkruntime.NakamaModule, report *StorageHealthResponse) {
+	lastStorageHealth.Lock()
+	previous := lastStorageHealth.report
+	lastStorageHealth.report = report
+	lastStorageHealth.Unlock()
+
+	healthy := 0.0
+	if report.Status != STORAGE_HEALTH_DOWN {
+		healthy = 1
+	}
+	nk.MetricsGaugeSet("storage_healthy", map[string]string{"backend": report.Backend}, healthy)
+
+	if previous == nil || previous.Status != report.Status {
+		if report.Status == STORAGE_HEALTH_DOWN {
+			failed, _ := json.Marshal(report.Checks)
+			logger.Error("Object storage is down: %s", failed)
+		} else {
+			logger.Info("Object storage is %s (%d ms)", report.Status, report.LatencyMs)
+		}
+	}
+}
+
+// StartStorageHealthCheck checks object storage every STORAGE_HEALTH_INTERVAL_SECONDS; 0 disables it
+func StartStorageHealthCheck(logger nkruntime.Logger, nk nkruntime.NakamaModule) {
+	seconds := serverConfig.StorageHealthIntervalSeconds
+	if seconds <= 0 {
+		logger.Info("Storage health check disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(seconds) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			recordStorageHealth(logger, nk, checkStorageHealth(context.Background(), logger))
+		}
+	}()
+	logger.Info("Storage health check scheduled every %d seconds", seconds)
+}
+
+// RpcStorageHealth checks object storage now (admin only), or returns the last self-check with {"cached": true}.
+// When storage is down it fails with UNAVAILABLE (HTTP 503) so readiness probes can use it as is.
+func RpcStorageHealth(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(StorageHealthResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		Cached bool `json:"cached"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(StorageHealthResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+
+	var report *StorageHealthResponse
+	if request.Cached {
+		lastStorageHealth.Lock()
+		report = lastStorageHealth.report
+		lastStorageHealth.Unlock()
+	}
+	if report == nil {
+		report = checkStorageHealth(ctx, logger)
+	}
+
+	response, err := marshalResponse(report)
+	if report.Status == STORAGE_HEALTH_DOWN {
+		return "", nkruntime.NewError(response, STORAGE_HEALTH_UNAVAILABLE_STATUS)
+	}
+	return response, err
+}
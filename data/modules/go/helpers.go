@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Nakama's built-in stream modes used for chat channels
+const (
+	STREAM_MODE_CHANNEL = 2
+	STREAM_MODE_GROUP   = 3
+	STREAM_MODE_DM      = 4
+)
+
+// userIDFromContext returns the calling user's ID, or "" for server-to-server calls
+func userIDFromContext(ctx context.Context) string {
+	if uid, ok := ctx.Value(nkruntime.RUNTIME_CTX_USER_ID).(string); ok {
+		return uid
+	}
+	return ""
+}
+
+// usernameFromContext returns the calling user's username, or "" for server-to-server calls
+func usernameFromContext(ctx context.Context) string {
+	if username, ok := ctx.Value(nkruntime.RUNTIME_CTX_USERNAME).(string); ok {
+		return username
+	}
+	return ""
+}
+
+// sessionIDFromContext returns the calling session ID, only set for RPCs sent over the socket
+func sessionIDFromContext(ctx context.Context) string {
+	if sid, ok := ctx.Value(nkruntime.RUNTIME_CTX_SESSION_ID).(string); ok {
+		return sid
+	}
+	return ""
+}
+
+// isAdmin reports whether the caller may use admin RPCs.
+// Server-to-server calls (http key) are always trusted; users must be listed in ADMIN_USER_IDS.
+func isAdmin(ctx context.Context) bool {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return true
+	}
+	return serverConfig.AdminUserIDs[userID]
+}
+
+// roomChannelID builds the channel ID of a named chat room, matching Nakama's stream encoding
+func roomChannelID(room string) string {
+	return fmt.Sprintf("%d...%s", STREAM_MODE_CHANNEL, room)
+}
+
+// groupChannelID builds the channel ID of a group's chat, matching Nakama's stream encoding
+func groupChannelID(groupID string) string {
+	return fmt.Sprintf("%d.%s..", STREAM_MODE_GROUP, groupID)
+}
+
+// marshalResponse encodes an RPC response payload
+func marshalResponse(response interface{}) (string, error) {
+	responseJSON, _ := json.Marshal(response)
+	return string(responseJSON), nil
+}
+
+// hashedStorageKey derives a fixed-length storage key from a value that may be longer than keys allow
+func hashedStorageKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// envSecret reads a secret from the file named by NAME_FILE, such as a mounted Kubernetes or Docker secret,
+// falling back to the NAME setting and then def. The file is read on every call, so rotated secrets are seen.
+func envSecret(name, def string) string {
+	if path, _ := lookupEnv(name + "_FILE"); path != "" {
+		if v, err := os.ReadFile(path); err == nil {
+			if secret := strings.TrimSpace(string(v)); secret != "" {
+				return secret
+			}
+		}
+	}
+	if v, _ := lookupEnv(name); v != "" {
+		return v
+	}
+	return def
+}
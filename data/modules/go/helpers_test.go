@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+// testLogger records formatted log lines so tests can assert on what was logged
+type testLogger struct {
+	mu     *sync.Mutex
+	lines  *[]string
+	fields map[string]interface{}
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{mu: &sync.Mutex{}, lines: &[]string{}, fields: map[string]interface{}{}}
+}
+
+func (l *testLogger) log(level, format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.lines = append(*l.lines, level+" "+fmt.Sprintf(format, v...))
+}
+
+// Lines returns everything logged through this logger or the loggers derived from it
+func (l *testLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), *l.lines...)
+}
+
+func (l *testLogger) Debug(format string, v ...interface{}) { l.log("DEBUG", format, v...) }
+func (l *testLogger) Info(format string, v ...interface{})  { l.log("INFO", format, v...) }
+func (l *testLogger) Warn(format string, v ...interface{})  { l.log("WARN", format, v...) }
+func (l *testLogger) Error(format string, v ...interface{}) { l.log("ERROR", format, v...) }
+
+func (l *testLogger) WithField(key string, v interface{}) nkruntime.Logger {
+	return l.WithFields(map[string]interface{}{key: v})
+}
+
+func (l *testLogger) WithFields(fields map[string]interface{}) nkruntime.Logger {
+	merged := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &testLogger{mu: l.mu, lines: l.lines, fields: merged}
+}
+
+func (l *testLogger) Fields() map[string]interface{} { return l.fields }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const IMAGE_DEFAULT_JPEG_QUALITY = 85
+
+// ImageAsset is the image travelling through the processing pipeline
+type ImageAsset struct {
+	Data        []byte
+	ContentType string
+	Format      string
+	Image       image.Image
+	Metadata    map[string]interface{}
+	// ChannelID and ChannelType ("room", "group", "dm") are empty when the upload is not tied to a channel
+	ChannelID   string
+	ChannelType string
+	// Derivatives are extra renditions, such as thumbnails, stored next to the original by name
+	Derivatives map[string]*ImageDerivative
+	// Moderation is set by the moderation stage; flagged assets are quarantined instead of stored
+	Moderation *ModerationVerdict
+	modified   bool
+}
+
+// ImageStage is a single configurable image processing step
+type ImageStage interface {
+	Name() string
+	Process(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) error
+}
+
+// IMAGE_STAGE_FACTORIES maps the stage names usable in IMAGE_PIPELINE to their constructors
+var IMAGE_STAGE_FACTORIES = map[string]func() (ImageStage, error){
+	"exif_strip": newExifStripStage,
+	"resize":     newResizeStage,
+	"blurhash":   newBlurhashStage,
+	"watermark":  newWatermarkStage,
+	"nsfw_scan":  newNSFWScanStage,
+	"moderation": newModerationStage,
+	"thumbnails": newThumbnailStage,
+}
+
+// imagePipelines holds the stages per channel type, "" being the deployment default
+var imagePipelines = map[string][]ImageStage{}
+
+// newImageAsset wraps uploaded bytes for processing
+func newImageAsset(data []byte, contentType string) *ImageAsset {
+	return &ImageAsset{Data: data, ContentType: contentType, Metadata: map[string]interface{}{}}
+}
+
+// Decode decodes the image pixels on first use so metadata-only stages stay cheap
+func (a *ImageAsset) Decode() error {
+	if a.Image != nil {
+		return nil
+	}
+	img, format, err := image.Decode(bytes.NewReader(a.Data))
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+	a.Image = img
+	a.Format = format
+	return nil
+}
+
+// SetImage replaces the pixels; the asset is re-encoded when the pipeline finishes
+func (a *ImageAsset) SetImage(img image.Image) {
+	a.Image = img
+	a.modified = true
+}
+
+// IsAnimated reports whether the asset is a multi-frame GIF, which pixel stages leave untouched
+func (a *ImageAsset) IsAnimated() bool {
+	if a.ContentType != "image/gif" {
+		return false
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(a.Data))
+	return err == nil && len(g.Image) > 1
+}
+
+// IsWebP reports whether the asset is WebP, which the standard library cannot decode, so pixel stages leave it untouched
+func (a *ImageAsset) IsWebP() bool {
+	return a.ContentType == "image/webp"
+}
+
+// Flush writes modified pixels back into Data in the asset's format. The object key was chosen from the
+// uploaded content type before the pipeline ran, so a GIF stays a GIF; anything else that is not JPEG becomes PNG.
+func (a *ImageAsset) Flush() error {
+	if !a.modified {
+		return nil
+	}
+	var buf bytes.Buffer
+	switch a.Format {
+	case "jpeg":
+		if err := jpeg.Encode(&buf, a.Image, &jpeg.Options{Quality: serverConfig.ImageJPEGQuality}); err != nil {
+			return fmt.Errorf("failed to encode jpeg: %v", err)
+		}
+		a.ContentType = "image/jpeg"
+	case "gif":
+		// Animated GIFs never reach here, pixel stages leave them untouched
+		if err := gif.Encode(&buf, a.Image, nil); err != nil {
+			return fmt.Errorf("failed to encode gif: %v", err)
+		}
+		a.ContentType = "image/gif"
+	default:
+		if err := png.Encode(&buf, a.Image); err != nil {
+			return fmt.Errorf("failed to encode png: %v", err)
+		}
+		a.Format = "png"
+		a.ContentType = "image/png"
+	}
+	a.Data = buf.Bytes()
+	a.modified = false
+	return nil
+}
+
+// buildImagePipeline parses a comma separated list of stage names
+func buildImagePipeline(spec string) ([]ImageStage, error) {
+	stages := []ImageStage{}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		factory, ok := IMAGE_STAGE_FACTORIES[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown image pipeline stage: %s", name)
+		}
+		stage, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure image stage %s: %v", name, err)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// LoadImagePipelines builds the pipelines from IMAGE_PIPELINE and its per channel type overrides
+// (IMAGE_PIPELINE_ROOM, IMAGE_PIPELINE_GROUP, IMAGE_PIPELINE_DM), plus IMAGE_PIPELINE_STICKER for sticker packs
+func LoadImagePipelines(logger nkruntime.Logger) error {
+	pipelines := map[string][]ImageStage{}
+	for channelType, spec := range serverConfig.ImagePipelines {
+		env := IMAGE_PIPELINE_SETTINGS[channelType]
+		stages, err := buildImagePipeline(spec)
+		if err != nil {
+			return fmt.Errorf("%s: %v", env, err)
+		}
+		pipelines[channelType] = stages
+		logger.Info("Image pipeline %s: [%s]", env, spec)
+	}
+	imagePipelines = pipelines
+	return nil
+}
+
+// channelTypeOf maps a channel ID to the pipeline channel type, "" when unknown
+func channelTypeOf(channelID string) string {
+	ref, err := parseChannelID(channelID)
+	if err != nil {
+		return ""
+	}
+	switch ref.Mode {
+	case STREAM_MODE_CHANNEL:
+		return "room"
+	case STREAM_MODE_GROUP:
+		return "group"
+	case STREAM_MODE_DM:
+		return "dm"
+	}
+	return ""
+}
+
+// imagePipelineFor returns the stages configured for a channel type, falling back to the default pipeline
+func imagePipelineFor(channelType string) []ImageStage {
+	if stages, ok := imagePipelines[channelType]; ok && channelType != "" {
+		return stages
+	}
+	return imagePipelines[""]
+}
+
+// pipelineStage returns the stage with the given name from a pipeline, nil if it is not configured
+func pipelineStage(stages []ImageStage, name string) ImageStage {
+	for _, stage := range stages {
+		if stage.Name() == name {
+			return stage
+		}
+	}
+	return nil
+}
+
+// runImagePipeline runs every stage in order and re-encodes the image if any stage changed its pixels
+func runImagePipeline(ctx context.Context, logger nkruntime.Logger, stages []ImageStage, asset *ImageAsset) error {
+	for _, stage := range stages {
+		if err := stage.Process(ctx, logger, asset); err != nil {
+			return fmt.Errorf("%s: %v", stage.Name(), err)
+		}
+	}
+	if err := asset.Flush(); err != nil {
+		return err
+	}
+	if asset.Image != nil {
+		asset.Metadata["width"] = asset.Image.Bounds().Dx()
+		asset.Metadata["height"] = asset.Image.Bounds().Dy()
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	IMAGE_DEFAULT_MAX_DIMENSION     = 2048
+	IMAGE_BLURHASH_SAMPLE_SIZE      = 32
+	IMAGE_DEFAULT_WATERMARK_OPACITY = 0.5
+	IMAGE_WATERMARK_MAX_FRACTION    = 0.2
+	IMAGE_DEFAULT_NSFW_THRESHOLD    = 0.8
+	IMAGE_NSFW_TIMEOUT              = 5 * time.Second
+)
+
+// exifStripStage removes EXIF and other embedded metadata (GPS position, camera, timestamps) and bakes the
+// EXIF orientation into the pixels so the image still displays upright. Channels listed in
+// IMAGE_PRESERVE_METADATA_CHANNELS are trusted and keep their files untouched.
+type exifStripStage struct {
+	preserve map[string]bool
+}
+
+func newExifStripStage() (ImageStage, error) {
+	return &exifStripStage{preserve: serverConfig.ImagePreserveMetadataChannels}, nil
+}
+
+func (s *exifStripStage) Name() string { return "exif_strip" }
+
+func (s *exifStripStage) Process(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) error {
+	if asset.ChannelID != "" && s.preserve[asset.ChannelID] {
+		return nil
+	}
+
+	// Data still holds the uploaded bytes until the pipeline flushes, so the tag applies to the current pixels
+	if orientation := jpegOrientation(asset.Data); orientation > 1 {
+		if err := asset.Decode(); err != nil {
+			return err
+		}
+		logger.Debug("Applying EXIF orientation %d", orientation)
+		asset.SetImage(orientImage(asset.Image, orientation))
+	}
+
+	// Re-encoding already drops all metadata
+	if asset.modified {
+		return nil
+	}
+	var stripped []byte
+	var err error
+	switch asset.ContentType {
+	case "image/jpeg", "image/jpg":
+		stripped, err = stripJPEGMetadata(asset.Data)
+	case "image/png":
+		stripped, err = stripPNGMetadata(asset.Data)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logger.Debug("Stripped %d bytes of image metadata", len(asset.Data)-len(stripped))
+	asset.Data = stripped
+	return nil
+}
+
+// resizeStage downscales images larger than IMAGE_MAX_DIMENSION
+type resizeStage struct {
+	maxDimension int
+}
+
+func newResizeStage() (ImageStage, error) {
+	return &resizeStage{maxDimension: serverConfig.ImageMaxDimension}, nil
+}
+
+func (s *resizeStage) Name() string { return "resize" }
+
+func (s *resizeStage) Process(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) error {
+	if asset.IsAnimated() || asset.IsWebP() {
+		return nil
+	}
+	if err := asset.Decode(); err != nil {
+		return err
+	}
+	b := asset.Image.Bounds()
+	width, height := fitWithin(b.Dx(), b.Dy(), s.maxDimension)
+	if width == b.Dx() && height == b.Dy() {
+		return nil
+	}
+	logger.Debug("Resizing image from %dx%d to %dx%d", b.Dx(), b.Dy(), width, height)
+	asset.SetImage(resizeImage(asset.Image, width, height))
+	return nil
+}
+
+// blurhashStage computes a BlurHash placeholder clients can render while the image loads
+type blurhashStage struct{}
+
+func newBlurhashStage() (ImageStage, error) { return &blurhashStage{}, nil }
+
+func (s *blurhashStage) Name() string { return "blurhash" }
+
+func (s *blurhashStage) Process(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) error {
+	if asset.IsWebP() {
+		return nil
+	}
+	if err := asset.Decode(); err != nil {
+		return err
+	}
+	b := asset.Image.Bounds()
+	width, height := fitWithin(b.Dx(), b.Dy(), IMAGE_BLURHASH_SAMPLE_SIZE)
+	asset.Metadata["blurhash"] = encodeBlurhash(resizeImage(asset.Image, width, height), 4, 3)
+	return nil
+}
+
+// watermarkStage stamps the PNG at IMAGE_WATERMARK_PATH into the bottom-right corner
+type watermarkStage struct {
+	mark    image.Image
+	opacity float64
+}
+
+func newWatermarkStage() (ImageStage, error) {
+	path := serverConfig.ImageWatermarkPath
+	if path == "" {
+		return nil, fmt.Errorf("IMAGE_WATERMARK_PATH is not set")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open watermark: %v", err)
+	}
+	defer f.Close()
+	mark, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode watermark: %v", err)
+	}
+
+	return &watermarkStage{mark: mark, opacity: serverConfig.ImageWatermarkOpacity}, nil
+}
+
+func (s *watermarkStage) Name() string { return "watermark" }
+
+func (s *watermarkStage) Process(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) error {
+	if asset.IsAnimated() || asset.IsWebP() {
+		return nil
+	}
+	if err := asset.Decode(); err != nil {
+		return err
+	}
+
+	b := asset.Image.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), asset.Image, b.Min, draw.Src)
+
+	var mark image.Image = s.mark
+	maxWidth := int(float64(b.Dx()) * IMAGE_WATERMARK_MAX_FRACTION)
+	if mb := mark.Bounds(); mb.Dx() > maxWidth && maxWidth > 0 {
+		width, height := fitWithin(mb.Dx(), mb.Dy(), maxWidth)
+		mark = resizeImage(mark, width, height)
+	}
+
+	mb := mark.Bounds()
+	margin := b.Dx() / 50
+	target := image.Rect(b.Dx()-mb.Dx()-margin, b.Dy()-mb.Dy()-margin, b.Dx()-margin, b.Dy()-margin)
+	alpha := image.NewUniform(color.Alpha{A: uint8(s.opacity * 255)})
+	draw.DrawMask(canvas, target, mark, mb.Min, alpha, image.Point{}, draw.Over)
+
+	asset.SetImage(canvas)
+	return nil
+}
+
+// nsfwClassifier is the client of the IMAGE_NSFW_ENDPOINT classifier. The nsfw_scan stage rejects what it
+// finds unsafe; the moderation stage's nsfw provider quarantines it instead.
+type nsfwClassifier struct {
+	endpoint  string
+	threshold float64
+	client    *http.Client
+}
+
+// nsfwResult is the classifier's answer; Reason is optional
+type nsfwResult struct {
+	Score  float64 `json:"score"`
+	NSFW   bool    `json:"nsfw"`
+	Reason string  `json:"reason"`
+}
+
+func newNSFWClassifier() (*nsfwClassifier, error) {
+	endpoint := serverConfig.ImageNSFWEndpoint
+	if endpoint == "" {
+		return nil, fmt.Errorf("IMAGE_NSFW_ENDPOINT is not set")
+	}
+	return &nsfwClassifier{
+		endpoint:  endpoint,
+		threshold: serverConfig.ImageNSFWThreshold,
+		client:    &http.Client{Timeout: IMAGE_NSFW_TIMEOUT},
+	}, nil
+}
+
+// classify sends the image to the classifier and reports whether it is unsafe
+func (c *nsfwClassifier) classify(ctx context.Context, asset *ImageAsset) (*nsfwResult, bool, error) {
+	// Classify what will actually be stored, including changes made by earlier stages
+	if err := asset.Flush(); err != nil {
+		return nil, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(asset.Data))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", asset.ContentType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("classifier unavailable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("classifier returned status %d", resp.StatusCode)
+	}
+
+	var result nsfwResult
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&result); err != nil {
+		return nil, false, fmt.Errorf("invalid classifier response: %v", err)
+	}
+	asset.Metadata["nsfwScore"] = result.Score
+	return &result, result.NSFW || result.Score >= c.threshold, nil
+}
+
+// nsfwScanStage rejects images the classifier finds unsafe
+type nsfwScanStage struct {
+	classifier *nsfwClassifier
+}
+
+func newNSFWScanStage() (ImageStage, error) {
+	classifier, err := newNSFWClassifier()
+	if err != nil {
+		return nil, err
+	}
+	return &nsfwScanStage{classifier: classifier}, nil
+}
+
+func (s *nsfwScanStage) Name() string { return "nsfw_scan" }
+
+func (s *nsfwScanStage) Process(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) error {
+	result, unsafe, err := s.classifier.classify(ctx, asset)
+	if err != nil {
+		return err
+	}
+	if unsafe {
+		logger.Warn("Image rejected by NSFW scan (score %.2f)", result.Score)
+		return fmt.Errorf("image was flagged as unsafe")
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// fitWithin scales width and height down to fit in a square of maxSize, keeping the aspect ratio
+func fitWithin(width, height, maxSize int) (int, int) {
+	if width <= maxSize && height <= maxSize {
+		return width, height
+	}
+	if width >= height {
+		return maxSize, int(math.Max(1, math.Round(float64(height)*float64(maxSize)/float64(width))))
+	}
+	return int(math.Max(1, math.Round(float64(width)*float64(maxSize)/float64(height)))), maxSize
+}
+
+// cropSquare cuts the largest centered square out of src
+func cropSquare(src image.Image) image.Image {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), src, image.Pt(x0, y0), draw.Src)
+	return dst
+}
+
+// resizeImage scales src to width x height, averaging every source pixel that maps onto a destination pixel
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+
+	for y := 0; y < height; y++ {
+		sy0 := sb.Min.Y + y*sh/height
+		sy1 := sb.Min.Y + (y+1)*sh/height
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < width; x++ {
+			sx0 := sb.Min.X + x*sw/width
+			sx1 := sb.Min.X + (x+1)*sw/width
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r / n) >> 8),
+				G: uint8((g / n) >> 8),
+				B: uint8((b / n) >> 8),
+				A: uint8((a / n) >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// stripJPEGMetadata drops EXIF/XMP (APP1), IPTC (APP13) and comment segments without re-encoding the image.
+// JFIF (APP0), ICC profiles (APP2) and Adobe (APP14) segments are kept since they affect colour rendering.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, fmt.Errorf("malformed jpeg segment")
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		// Start of scan: the rest is entropy-coded image data
+		if marker == 0xDA {
+			out.Write(data[pos:])
+			return out.Bytes(), nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, fmt.Errorf("malformed jpeg segment")
+		}
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	return nil, fmt.Errorf("jpeg has no image data")
+}
+
+// stripPNGMetadata drops text, EXIF and timestamp chunks from a PNG
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	signature := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+	if !bytes.HasPrefix(data, signature) {
+		return nil, fmt.Errorf("not a png")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(signature)
+	pos := len(signature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("malformed png chunk")
+		}
+		switch string(data[pos+4 : pos+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	return out.Bytes(), nil
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, 1 when it has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == 0xDA {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return 1
+		}
+		if segment := data[pos+4 : end]; marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos = end
+	}
+	return 1
+}
+
+// exifOrientation reads the Orientation tag (0x0112) from IFD0 of a TIFF-structured EXIF block
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8 : entry+10])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orientImage applies an EXIF orientation to src so it displays upright without the tag
+func orientImage(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	sb := src.Bounds()
+	w, h := sb.Dx(), sb.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated 90 clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated 90 counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, src.At(sb.Min.X+sx, sb.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+const blurhashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// encodeBlurhash computes the BlurHash (https://blurha.sh) of an image with the given component counts
+func encodeBlurhash(img image.Image, xComponents, yComponents int) string {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1.0
+			}
+			var r, g, bl float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					cr, cg, cb, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+					r += basis * srgbToLinear(int(cr>>8))
+					g += basis * srgbToLinear(int(cg>>8))
+					bl += basis * srgbToLinear(int(cb>>8))
+				}
+			}
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{r * scale, g * scale, bl * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, f := range factors[1:] {
+			for _, c := range f {
+				actualMax = math.Max(actualMax, math.Abs(c))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83((linearToSRGB(dc[0])<<16)+(linearToSRGB(dc[1])<<8)+linearToSRGB(dc[2]), 4))
+	for _, f := range factors[1:] {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+	out := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		out[i-1] = blurhashCharacters[digit]
+	}
+	return string(out)
+}
+
+func srgbToLinear(value int) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// INVITE_COLLECTION holds one system-owned record per invite link, keyed by invite ID
+	INVITE_COLLECTION     = "invite_links"
+	INVITE_ID_BYTES       = 12
+	INVITE_SIGNATURE_SIZE = 16
+	INVITE_DEFAULT_TTL    = 7 * 24 * time.Hour
+	INVITE_MAX_TTL        = 30 * 24 * time.Hour
+	INVITE_MAX_USES       = 10000
+	INVITE_WRITE_ATTEMPTS = 3
+	INVITE_ROLE_MEMBER    = "member"
+	INVITE_ROLE_ADMIN     = "admin"
+)
+
+// InviteLink is a shareable invitation to a group chat. The token handed out is the ID with its signature, so
+// the group ID never appears in the link and a guessed ID is useless without the secret.
+type InviteLink struct {
+	ID        string `json:"id"`
+	GroupID   string `json:"groupId"`
+	Role      string `json:"role"`
+	CreatedBy string `json:"createdBy"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	// MaxUses is the number of joins allowed, 0 for no limit
+	MaxUses   int    `json:"maxUses"`
+	Uses      int    `json:"uses"`
+	RevokedAt int64  `json:"revokedAt,omitempty"`
+	RevokedBy string `json:"revokedBy,omitempty"`
+}
+
+// InviteLinkResponse represents the response for the invite link RPCs
+type InviteLinkResponse struct {
+	Success bool        `json:"success"`
+	Invite  *InviteLink `json:"invite,omitempty"`
+	Token   string      `json:"token,omitempty"`
+	URL     string      `json:"url,omitempty"`
+	GroupID string      `json:"groupId,omitempty"`
+	// AlreadyMember is set by join_via_invite when the caller was in the group; the invite is not used up
+	AlreadyMember bool   `json:"alreadyMember,omitempty"`
+	Error         string `json:"error,omitempty"`
+	Code          string `json:"code,omitempty"`
+}
+
+// inviteSignature signs an invite ID with INVITE_LINK_SECRET
+func inviteSignature(id string) string {
+	mac := hmac.New(sha256.New, []byte(serverConfig.InviteLinkSecret))
+	mac.Write([]byte("invite:" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:INVITE_SIGNATURE_SIZE])
+}
+
+// inviteToken returns the token of an invite, "<id>.<signature>"
+func inviteToken(id string) string {
+	return id + "." + inviteSignature(id)
+}
+
+// inviteURL returns the link to share, empty when INVITE_LINK_BASE_URL is not set
+func inviteURL(token string) string {
+	if serverConfig.InviteLinkBaseURL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(serverConfig.InviteLinkBaseURL, "/") + "/" + token
+}
+
+// parseInviteToken checks a token's signature and returns its invite ID
+func parseInviteToken(token string) (string, error) {
+	id, signature, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok || id == "" || !hmac.Equal([]byte(signature), []byte(inviteSignature(id))) {
+		return "", errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid invite token")
+	}
+	return id, nil
+}
+
+// readInviteLink loads an invite with its storage version
+func readInviteLink(ctx context.Context, nk nkruntime.NakamaModule, id string) (*InviteLink, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: INVITE_COLLECTION, Key: id}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read invite link: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, "", errorWithCode(ERROR_CODE_NOT_FOUND, "Invite link not found")
+	}
+	var invite InviteLink
+	if err := json.Unmarshal([]byte(objects[0].Value), &invite); err != nil {
+		return nil, "", fmt.Errorf("failed to decode invite link: %v", err)
+	}
+	return &invite, objects[0].Version, nil
+}
+
+// writeInviteLink saves an invite if it is still at version, "*" for a new one
+func writeInviteLink(ctx context.Context, nk nkruntime.NakamaModule, invite *InviteLink, version string) error {
+	value, _ := json.Marshal(invite)
+	_, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      INVITE_COLLECTION,
+		Key:             invite.ID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// updateInviteLink applies fn to an invite, retrying on concurrent modification
+func updateInviteLink(ctx context.Context, nk nkruntime.NakamaModule, id string, fn func(*InviteLink) error) (*InviteLink, error) {
+	var lastErr error
+	for attempt := 0; attempt < INVITE_WRITE_ATTEMPTS; attempt++ {
+		invite, version, err := readInviteLink(ctx, nk, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(invite); err != nil {
+			return nil, err
+		}
+		if lastErr = writeInviteLink(ctx, nk, invite, version); lastErr == nil {
+			return invite, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to update invite link: %v", lastErr)
+}
+
+// checkInvitesEnabled refuses invite RPCs until INVITE_LINK_SECRET is set
+func checkInvitesEnabled() error {
+	if serverConfig.InviteLinkSecret == "" {
+		return errorWithCode(ERROR_CODE_REJECTED, "Invite links are disabled")
+	}
+	return nil
+}
+
+// RpcCreateInviteLink creates an invite link to a group chat. Group admins may create member invites;
+// only the owner may create invites that make the joiner an admin.
+func RpcCreateInviteLink(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	if err := checkInvitesEnabled(); err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	var request struct {
+		GroupID          string `json:"groupId"`
+		ExpiresInSeconds int64  `json:"expiresInSeconds"`
+		MaxUses          int    `json:"maxUses"`
+		Role             string `json:"role"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.GroupID == "" {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: "Missing required field: groupId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Role == "" {
+		request.Role = INVITE_ROLE_MEMBER
+	}
+	if request.Role != INVITE_ROLE_MEMBER && request.Role != INVITE_ROLE_ADMIN {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: fmt.Sprintf("Invalid role: %s", request.Role), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	ttl := INVITE_DEFAULT_TTL
+	if request.ExpiresInSeconds != 0 {
+		ttl = time.Duration(request.ExpiresInSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > INVITE_MAX_TTL {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: fmt.Sprintf("expiresInSeconds must be between 1 and %d", int64(INVITE_MAX_TTL/time.Second)), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.MaxUses < 0 || request.MaxUses > INVITE_MAX_USES {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: fmt.Sprintf("maxUses must be between 0 and %d", INVITE_MAX_USES), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	maxState := GROUP_STATE_ADMIN
+	if request.Role == INVITE_ROLE_ADMIN {
+		maxState = GROUP_STATE_SUPERADMIN
+	}
+	if err := requireGroupRole(ctx, nk, request.GroupID, userID, maxState); err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	raw := make([]byte, INVITE_ID_BYTES)
+	if _, err := rand.Read(raw); err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: fmt.Sprintf("Failed to create invite link: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	now := time.Now()
+	invite := &InviteLink{
+		ID:        base64.RawURLEncoding.EncodeToString(raw),
+		GroupID:   request.GroupID,
+		Role:      request.Role,
+		CreatedBy: userID,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		MaxUses:   request.MaxUses,
+	}
+	if err := writeInviteLink(ctx, nk, invite, "*"); err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: fmt.Sprintf("Failed to create invite link: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	token := inviteToken(invite.ID)
+	logger.Info("Invite link %s to group %s created by %s", invite.ID, invite.GroupID, userID)
+	return marshalResponse(InviteLinkResponse{Success: true, Invite: invite, Token: token, URL: inviteURL(token), GroupID: invite.GroupID})
+}
+
+// RpcRevokeInviteLink stops an invite link from being used. Its creator and the group's admins may revoke it.
+func RpcRevokeInviteLink(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	if err := checkInvitesEnabled(); err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	var request struct {
+		InviteID string `json:"inviteId"`
+		Token    string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.InviteID == "" && request.Token != "" {
+		id, err := parseInviteToken(request.Token)
+		if err != nil {
+			return marshalResponse(InviteLinkResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		request.InviteID = id
+	}
+	if request.InviteID == "" {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: "Missing required field: inviteId or token", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	invite, err := updateInviteLink(ctx, nk, request.InviteID, func(invite *InviteLink) error {
+		if invite.CreatedBy != userID {
+			if err := requireGroupRole(ctx, nk, invite.GroupID, userID, GROUP_STATE_ADMIN); err != nil {
+				return err
+			}
+		}
+		if invite.RevokedAt == 0 {
+			invite.RevokedAt = time.Now().Unix()
+			invite.RevokedBy = userID
+		}
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	logger.Info("Invite link %s to group %s revoked by %s", invite.ID, invite.GroupID, userID)
+	return marshalResponse(InviteLinkResponse{Success: true, Invite: invite, GroupID: invite.GroupID})
+}
+
+// RpcJoinViaInvite adds the caller to the group of an invite link, with the invite's role. A use is counted
+// before the join and given back if the join fails, so concurrent joins cannot go over maxUses.
+func RpcJoinViaInvite(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	if err := checkInvitesEnabled(); err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	var request struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Token == "" {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: "Missing required field: token", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	id, err := parseInviteToken(request.Token)
+	if err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	invite, _, err := readInviteLink(ctx, nk, id)
+	if err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	state, err := groupState(ctx, nk, invite.GroupID, userID)
+	if err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if state >= GROUP_STATE_SUPERADMIN && state <= GROUP_STATE_MEMBER {
+		return marshalResponse(InviteLinkResponse{Success: true, GroupID: invite.GroupID, AlreadyMember: true})
+	}
+
+	invite, err = updateInviteLink(ctx, nk, id, func(invite *InviteLink) error {
+		if invite.RevokedAt != 0 {
+			return errorWithCode(ERROR_CODE_REJECTED, "Invite link has been revoked")
+		}
+		if time.Now().Unix() >= invite.ExpiresAt {
+			return errorWithCode(ERROR_CODE_REJECTED, "Invite link has expired")
+		}
+		if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+			return errorWithCode(ERROR_CODE_REJECTED, "Invite link has no uses left")
+		}
+		invite.Uses++
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(InviteLinkResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	// The invite's creator vouches for the joiner, so the join skips approval of closed groups
+	err = nk.GroupUsersAdd(ctx, "", invite.GroupID, []string{userID})
+	if err == nil && invite.Role == INVITE_ROLE_ADMIN {
+		err = nk.GroupUsersPromote(ctx, "", invite.GroupID, []string{userID})
+	}
+	if err != nil {
+		if _, releaseErr := updateInviteLink(ctx, nk, id, func(invite *InviteLink) error {
+			if invite.Uses > 0 {
+				invite.Uses--
+			}
+			return nil
+		}); releaseErr != nil {
+			logger.Warn("Failed to give back a use of invite link %s: %v", id, releaseErr)
+		}
+		return marshalResponse(InviteLinkResponse{Success: false, Error: fmt.Sprintf("Failed to join group: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	logger.Info("User %s joined group %s via invite link %s", userID, invite.GroupID, invite.ID)
+	return marshalResponse(InviteLinkResponse{Success: true, GroupID: invite.GroupID})
+}
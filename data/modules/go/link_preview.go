@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+	"golang.org/x/net/html"
+)
+
+const (
+	LINK_PREVIEW_COLLECTION = "link_previews"
+	LINK_PREVIEW_FIELD      = "linkPreview"
+	LINK_PREVIEW_TIMEOUT    = 5 * time.Second
+	LINK_PREVIEW_MAX_BODY   = 512 * 1024
+	LINK_PREVIEW_REDIRECTS  = 3
+	LINK_PREVIEW_CACHE_TTL  = 24 * time.Hour
+	// Failed fetches are cached too, for less time, so a dead link is not fetched for every message
+	LINK_PREVIEW_FAILURE_TTL   = time.Hour
+	LINK_PREVIEW_MAX_URL       = 2048
+	LINK_PREVIEW_TITLE_RUNES   = 200
+	LINK_PREVIEW_SUMMARY_RUNES = 500
+	LINK_PREVIEW_USER_AGENT    = "Mozilla/5.0 (compatible; NakamaLinkPreview/1.0)"
+	// LINK_PREVIEW_MAX_CONCURRENT bounds the background unfurls per node
+	LINK_PREVIEW_MAX_CONCURRENT = 16
+)
+
+// linkPreviewSlots holds one token per background unfurl in progress
+var linkPreviewSlots = make(chan struct{}, LINK_PREVIEW_MAX_CONCURRENT)
+
+// linkPattern finds http(s) URLs in message text
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// errLinkAddressBlocked is returned when a link resolves to a loopback, private or otherwise internal address
+var errLinkAddressBlocked = errors.New("link points to a private address")
+
+// LinkPreview is the Open Graph summary of a page, attached to messages under "linkPreview"
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"imageUrl,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+}
+
+// cachedLinkPreview is the stored result of fetching a URL, successful or not
+type cachedLinkPreview struct {
+	Preview   *LinkPreview `json:"preview,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	FetchedAt int64        `json:"fetchedAt"`
+}
+
+// LinkPreviewResponse represents the response for unfurl_link
+type LinkPreviewResponse struct {
+	Success bool         `json:"success"`
+	Preview *LinkPreview `json:"preview,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Code    string       `json:"code,omitempty"`
+}
+
+// linkPreviewClient fetches pages for previews. It refuses to connect to internal addresses,
+// checked on the resolved IP so DNS names and redirects cannot point it at the server's own network.
+var linkPreviewClient = &http.Client{
+	Timeout: LINK_PREVIEW_TIMEOUT,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: LINK_PREVIEW_TIMEOUT,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+					return errLinkAddressBlocked
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   LINK_PREVIEW_TIMEOUT,
+		ResponseHeaderTimeout: LINK_PREVIEW_TIMEOUT,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= LINK_PREVIEW_REDIRECTS {
+			return fmt.Errorf("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("unsupported redirect to %s", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+// linkPreviewsEnabled reports whether messages are unfurled, on unless LINK_PREVIEW_ENABLED is "false"
+func linkPreviewsEnabled() bool {
+	return serverConfig.LinkPreviewEnabled
+}
+
+// firstLink returns the first URL in a message's text fields
+func firstLink(content map[string]interface{}) string {
+	for _, field := range MESSAGE_TEXT_FIELDS {
+		text, ok := content[field].(string)
+		if !ok {
+			continue
+		}
+		if match := linkPattern.FindString(text); match != "" {
+			// Trailing punctuation belongs to the sentence, not the link
+			return strings.TrimRight(match, ".,;:!?)]}'")
+		}
+	}
+	return ""
+}
+
+// truncateRunes shortens s to at most n runes
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
+
+// parseLinkPreview reads the Open Graph and Twitter card tags of an HTML document, falling back to <title>
+// and the description meta tag. Parsing stops at <body> since the tags live in <head>.
+func parseLinkPreview(pageURL *url.URL, body io.Reader) *LinkPreview {
+	meta := map[string]string{}
+	title := ""
+	tokenizer := html.NewTokenizer(body)
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		if token.Data == "body" {
+			break
+		}
+		if token.Data == "title" && title == "" {
+			if tokenizer.Next() == html.TextToken {
+				title = strings.TrimSpace(string(tokenizer.Text()))
+			}
+			continue
+		}
+		if token.Data != "meta" {
+			continue
+		}
+		var name, value string
+		for _, attr := range token.Attr {
+			switch attr.Key {
+			case "property", "name":
+				name = strings.ToLower(attr.Val)
+			case "content":
+				value = strings.TrimSpace(attr.Val)
+			}
+		}
+		if name != "" && value != "" && meta[name] == "" {
+			meta[name] = value
+		}
+	}
+
+	pick := func(keys ...string) string {
+		for _, key := range keys {
+			if meta[key] != "" {
+				return meta[key]
+			}
+		}
+		return ""
+	}
+	preview := &LinkPreview{
+		URL:         pageURL.String(),
+		Title:       truncateRunes(pick("og:title", "twitter:title"), LINK_PREVIEW_TITLE_RUNES),
+		Description: truncateRunes(pick("og:description", "twitter:description", "description"), LINK_PREVIEW_SUMMARY_RUNES),
+		SiteName:    truncateRunes(pick("og:site_name"), LINK_PREVIEW_TITLE_RUNES),
+	}
+	if preview.Title == "" {
+		preview.Title = truncateRunes(title, LINK_PREVIEW_TITLE_RUNES)
+	}
+	if image := pick("og:image:secure_url", "og:image", "twitter:image"); image != "" {
+		if ref, err := pageURL.Parse(image); err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+			preview.ImageURL = ref.String()
+		}
+	}
+	return preview
+}
+
+// fetchLinkPreview downloads a page and extracts its preview
+func fetchLinkPreview(ctx context.Context, link string) (*LinkPreview, error) {
+	pageURL, err := url.Parse(link)
+	if err != nil || (pageURL.Scheme != "http" && pageURL.Scheme != "https") || pageURL.Host == "" {
+		return nil, fmt.Errorf("invalid url")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", LINK_PREVIEW_USER_AGENT)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := linkPreviewClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch link: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("link returned status %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.Contains(contentType, "html") {
+		return nil, fmt.Errorf("link is not a web page (%s)", contentType)
+	}
+
+	// Keep the link as written in the message, but resolve relative images against the final page
+	preview := parseLinkPreview(resp.Request.URL, io.LimitReader(resp.Body, LINK_PREVIEW_MAX_BODY))
+	preview.URL = link
+	if preview.Title == "" && preview.Description == "" && preview.ImageURL == "" {
+		return nil, fmt.Errorf("link has no preview")
+	}
+	return preview, nil
+}
+
+// getLinkPreview returns the preview of a URL from the cache, fetching and caching it when missing or stale
+func getLinkPreview(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, link string) (*LinkPreview, error) {
+	key := hashedStorageKey(link)
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: LINK_PREVIEW_COLLECTION, Key: key}})
+	if err != nil {
+		logger.Warn("Failed to read link preview cache: %v", err)
+	} else if len(objects) > 0 {
+		var cached cachedLinkPreview
+		if err := json.Unmarshal([]byte(objects[0].Value), &cached); err == nil {
+			ttl := LINK_PREVIEW_CACHE_TTL
+			if cached.Preview == nil {
+				ttl = LINK_PREVIEW_FAILURE_TTL
+			}
+			if time.Since(time.Unix(cached.FetchedAt, 0)) < ttl {
+				if cached.Preview == nil {
+					return nil, errors.New(cached.Error)
+				}
+				return cached.Preview, nil
+			}
+		}
+	}
+
+	preview, fetchErr := fetchLinkPreview(ctx, link)
+	cached := cachedLinkPreview{Preview: preview, FetchedAt: time.Now().Unix()}
+	if fetchErr != nil {
+		cached.Error = fetchErr.Error()
+	}
+	value, _ := json.Marshal(cached)
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      LINK_PREVIEW_COLLECTION,
+		Key:             key,
+		Value:           string(value),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		logger.Warn("Failed to cache link preview: %v", err)
+	}
+	return preview, fetchErr
+}
+
+// attachLinkPreview adds the preview of link to a message, unless the message was edited to drop the link meanwhile
+func attachLinkPreview(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, channelID, messageID, link string) {
+	preview, err := getLinkPreview(ctx, logger, nk, link)
+	if err != nil {
+		logger.Debug("No preview for %s: %v", link, err)
+		return
+	}
+
+	message, err := readChannelMessage(ctx, db, channelID, messageID)
+	if err != nil || message == nil {
+		return
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal([]byte(message.Content), &content); err != nil || firstLink(content) != link {
+		return
+	}
+	content[LINK_PREVIEW_FIELD] = preview
+	if _, err := nk.ChannelMessageUpdate(ctx, channelID, messageID, content, message.SenderID, message.Username, true); err != nil {
+		logger.Warn("Failed to attach link preview to message %s: %v", messageID, err)
+	}
+}
+
+// scheduleLinkPreview unfurls the first link of a message in the background so the sender is not kept waiting.
+// When LINK_PREVIEW_MAX_CONCURRENT unfurls are already running the message goes without a preview.
+func scheduleLinkPreview(logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, channelID, messageID string, content map[string]interface{}) {
+	if !linkPreviewsEnabled() {
+		return
+	}
+	link := firstLink(content)
+	if link == "" || len(link) > LINK_PREVIEW_MAX_URL {
+		return
+	}
+	// Waiting for a slot would hold up the send, and queueing would let a burst of links pile up goroutines
+	select {
+	case linkPreviewSlots <- struct{}{}:
+	default:
+		logger.Debug("Skipping preview of %s, %d unfurls in progress", link, LINK_PREVIEW_MAX_CONCURRENT)
+		return
+	}
+	go func() {
+		defer func() { <-linkPreviewSlots }()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*LINK_PREVIEW_TIMEOUT)
+		defer cancel()
+		attachLinkPreview(ctx, logger, db, nk, channelID, messageID, link)
+	}()
+}
+
+// stripLinkPreview is the send check that drops a client's linkPreview. Only the server attaches previews,
+// after fetching the page itself, so a client cannot pass off a made-up title or image for a link.
+func stripLinkPreview(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, senderID, channelID string, content map[string]interface{}) (bool, error) {
+	if _, ok := content[LINK_PREVIEW_FIELD]; !ok {
+		return false, nil
+	}
+	delete(content, LINK_PREVIEW_FIELD)
+	return true, nil
+}
+
+// unfurlSentMessage is the sent-message hook that attaches link previews. Every send path, socket or RPC, runs
+// stripLinkPreview first, so a sent message never carries a preview yet.
+func unfurlSentMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage) {
+	var content map[string]interface{}
+	if err := json.Unmarshal([]byte(message.Content), &content); err != nil {
+		return
+	}
+	scheduleLinkPreview(logger, db, nk, message.ChannelID, message.MessageID, content)
+}
+
+// RpcUnfurlLink returns the preview of a URL, for composing a message before it is sent
+func RpcUnfurlLink(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if userIDFromContext(ctx) == "" {
+		return marshalResponse(LinkPreviewResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(LinkPreviewResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.URL == "" {
+		return marshalResponse(LinkPreviewResponse{Success: false, Error: "Missing required field: url", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.URL) > LINK_PREVIEW_MAX_URL {
+		return marshalResponse(LinkPreviewResponse{Success: false, Error: fmt.Sprintf("url cannot exceed %d bytes", LINK_PREVIEW_MAX_URL), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	preview, err := getLinkPreview(ctx, logger, nk, request.URL)
+	if err != nil {
+		return marshalResponse(LinkPreviewResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(LinkPreviewResponse{Success: true, Preview: preview})
+}
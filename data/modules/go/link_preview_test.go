@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStripLinkPreview(t *testing.T) {
+	tests := []struct {
+		name    string
+		content map[string]interface{}
+		want    map[string]interface{}
+		changed bool
+	}{
+		{
+			name:    "no preview",
+			content: map[string]interface{}{"message": "look https://example.com"},
+			want:    map[string]interface{}{"message": "look https://example.com"},
+		},
+		{
+			name: "client preview is dropped",
+			content: map[string]interface{}{
+				"message":          "look https://example.com",
+				LINK_PREVIEW_FIELD: map[string]interface{}{"url": "https://example.com", "title": "Not what it seems"},
+			},
+			want:    map[string]interface{}{"message": "look https://example.com"},
+			changed: true,
+		},
+		{
+			name:    "null preview is dropped",
+			content: map[string]interface{}{"message": "hi", LINK_PREVIEW_FIELD: nil},
+			want:    map[string]interface{}{"message": "hi"},
+			changed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, err := stripLinkPreview(context.Background(), newTestLogger(), nil, nil, "user-1", "2...general", tt.content)
+			if err != nil {
+				t.Fatalf("stripLinkPreview failed: %v", err)
+			}
+			if changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			if !reflect.DeepEqual(tt.content, tt.want) {
+				t.Errorf("content = %v, want %v", tt.content, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleLinkPreviewSkipsWhenBusy(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"LINK_PREVIEW_ENABLED": "true"})
+	for i := 0; i < LINK_PREVIEW_MAX_CONCURRENT; i++ {
+		linkPreviewSlots <- struct{}{}
+	}
+	t.Cleanup(func() {
+		for i := 0; i < LINK_PREVIEW_MAX_CONCURRENT; i++ {
+			<-linkPreviewSlots
+		}
+	})
+
+	scheduleLinkPreview(h.logger, nil, h.nk, "2...general", "message-1", map[string]interface{}{"message": "look https://example.com"})
+	lines := h.logger.Lines()
+	if len(lines) != 1 || !strings.Contains(lines[0], "Skipping preview of https://example.com") {
+		t.Errorf("logged %q, want the skipped preview", lines)
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	LIVE_LOCATION_COLLECTION  = "live_locations"
+	LIVE_LOCATION_STREAM_MODE = 101
+	// LIVE_LOCATION_DEFAULT_DURATION_SECONDS applies when start_live_location has no durationSeconds
+	LIVE_LOCATION_DEFAULT_DURATION_SECONDS = 15 * 60
+	LIVE_LOCATION_MIN_DURATION_SECONDS     = 60
+	LIVE_LOCATION_MAX_DURATION_SECONDS     = 8 * 3600
+	// LIVE_LOCATION_DEFAULT_MIN_INTERVAL_SECONDS is the shortest time between two relayed updates of a session
+	LIVE_LOCATION_DEFAULT_MIN_INTERVAL_SECONDS = 5
+	LIVE_LOCATION_DEFAULT_SWEEP_SECONDS        = 60
+	LIVE_LOCATION_SWEEP_PAGE_SIZE              = 100
+	LOCATION_MAX_LABEL                         = 200
+	// LOCATION_MESSAGE_TYPE and LIVE_LOCATION_MESSAGE_TYPE are the content types of location messages
+	LOCATION_MESSAGE_TYPE         = "location"
+	LIVE_LOCATION_MESSAGE_TYPE    = "live_location"
+	ERROR_CODE_LOCATION_THROTTLED = "LOCATION_THROTTLED"
+)
+
+// LocationPoint is a position reported by a device
+type LocationPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Accuracy is the radius of uncertainty in meters
+	Accuracy float64 `json:"accuracy,omitempty"`
+	// Heading is degrees clockwise from north, Speed meters per second
+	Heading   float64 `json:"heading,omitempty"`
+	Speed     float64 `json:"speed,omitempty"`
+	UpdatedAt int64   `json:"updatedAt,omitempty"`
+}
+
+// LiveLocation is the system-owned record of a live-location session, keyed by its ID
+type LiveLocation struct {
+	ID        string         `json:"id"`
+	ChannelID string         `json:"channelId"`
+	MessageID string         `json:"messageId,omitempty"`
+	UserID    string         `json:"userId"`
+	Username  string         `json:"username,omitempty"`
+	Position  *LocationPoint `json:"position"`
+	StartedAt int64          `json:"startedAt"`
+	ExpiresAt int64          `json:"expiresAt"`
+}
+
+// LiveLocationEvent is sent over a session's stream: location_update, or live_location_ended when the sharer
+// stops or the session expires
+type LiveLocationEvent struct {
+	Type           string         `json:"type"`
+	LiveLocationID string         `json:"liveLocationId"`
+	ChannelID      string         `json:"channelId"`
+	UserID         string         `json:"userId"`
+	Position       *LocationPoint `json:"position,omitempty"`
+	ExpiresAt      int64          `json:"expiresAt,omitempty"`
+	CreatedAt      int64          `json:"createdAt"`
+}
+
+// LocationResponse represents the response for location RPCs
+type LocationResponse struct {
+	Success      bool          `json:"success"`
+	MessageID    string        `json:"messageId,omitempty"`
+	LiveLocation *LiveLocation `json:"liveLocation,omitempty"`
+	// RetryAfter is how many seconds to wait before the next update is relayed
+	RetryAfter int64  `json:"retryAfter,omitempty"`
+	Code       string `json:"code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// locationThrottle remembers when each live-location session last relayed an update
+type locationThrottle struct {
+	mu        sync.Mutex
+	last      map[string]time.Time
+	lastPrune time.Time
+}
+
+var liveLocationUpdates = &locationThrottle{last: map[string]time.Time{}}
+
+// allow reports whether an update of a session may be relayed now, and otherwise how long to wait
+func (t *locationThrottle) allow(sessionID string, interval time.Duration, now time.Time) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.lastPrune) > time.Minute {
+		for k, last := range t.last {
+			if now.Sub(last) > interval {
+				delete(t.last, k)
+			}
+		}
+		t.lastPrune = now
+	}
+
+	if last, ok := t.last[sessionID]; ok && now.Sub(last) < interval {
+		return false, interval - now.Sub(last)
+	}
+	t.last[sessionID] = now
+	return true, 0
+}
+
+// forget drops the state of an ended session
+func (t *locationThrottle) forget(sessionID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.last, sessionID)
+}
+
+// validate checks that a point is a position on earth
+func (p *LocationPoint) validate() error {
+	for _, v := range []float64{p.Latitude, p.Longitude, p.Accuracy, p.Heading, p.Speed} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid location")
+		}
+	}
+	if p.Latitude < -90 || p.Latitude > 90 || p.Longitude < -180 || p.Longitude > 180 {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "latitude must be between -90 and 90 and longitude between -180 and 180")
+	}
+	if p.Accuracy < 0 || p.Speed < 0 || p.Heading < 0 || p.Heading >= 360 {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid accuracy, heading or speed")
+	}
+	return nil
+}
+
+// readLiveLocation loads a live-location session, nil if there is none or it has ended
+func readLiveLocation(ctx context.Context, nk nkruntime.NakamaModule, id string) (*LiveLocation, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid liveLocationId")
+	}
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: LIVE_LOCATION_COLLECTION, Key: id}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read live location: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	var live LiveLocation
+	if err := json.Unmarshal([]byte(objects[0].Value), &live); err != nil {
+		return nil, fmt.Errorf("failed to decode live location: %v", err)
+	}
+	if time.Now().Unix() >= live.ExpiresAt {
+		return nil, nil
+	}
+	return &live, nil
+}
+
+// writeLiveLocation stores a live-location session. Only its sharer changes it, so writes are unconditional.
+func writeLiveLocation(ctx context.Context, nk nkruntime.NakamaModule, live *LiveLocation) error {
+	value, _ := json.Marshal(live)
+	_, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      LIVE_LOCATION_COLLECTION,
+		Key:             live.ID,
+		Value:           string(value),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// sendLiveLocationEvent relays an event to the sessions watching a live location
+func sendLiveLocationEvent(nk nkruntime.NakamaModule, event *LiveLocationEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nk.StreamSend(LIVE_LOCATION_STREAM_MODE, event.LiveLocationID, "", "", string(data), nil, true)
+}
+
+// endLiveLocation tells watchers and the channel that a session ended, closes its stream and deletes its record
+func endLiveLocation(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, live *LiveLocation) error {
+	now := time.Now().Unix()
+	if err := sendLiveLocationEvent(nk, &LiveLocationEvent{
+		Type: "live_location_ended", LiveLocationID: live.ID, ChannelID: live.ChannelID, UserID: live.UserID, CreatedAt: now,
+	}); err != nil {
+		logger.Warn("Failed to send live_location_ended for %s: %v", live.ID, err)
+	}
+	if err := sendChannelEvent(nk, &ChannelEvent{
+		Type: "live_location_ended", ChannelID: live.ChannelID, MessageID: live.MessageID, SenderID: live.UserID, Username: live.Username,
+		Content: map[string]interface{}{"liveLocationId": live.ID}, CreatedAt: now,
+	}); err != nil {
+		logger.Warn("Failed to send live_location_ended event to %s: %v", live.ChannelID, err)
+	}
+	liveLocationUpdates.forget(live.ID)
+	if err := nk.StreamClose(LIVE_LOCATION_STREAM_MODE, live.ID, "", ""); err != nil {
+		logger.Warn("Failed to close live location stream %s: %v", live.ID, err)
+	}
+	if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: LIVE_LOCATION_COLLECTION, Key: live.ID}}); err != nil {
+		return fmt.Errorf("failed to delete live location: %v", err)
+	}
+	return nil
+}
+
+// runLiveLocationSweep ends the sessions whose time is up
+func runLiveLocationSweep(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule) error {
+	now := time.Now().Unix()
+	var expired []*LiveLocation
+	cursor := ""
+	for {
+		objects, next, err := nk.StorageList(ctx, "", "", LIVE_LOCATION_COLLECTION, LIVE_LOCATION_SWEEP_PAGE_SIZE, cursor)
+		if err != nil {
+			return fmt.Errorf("failed to list live locations: %v", err)
+		}
+		for _, object := range objects {
+			var live LiveLocation
+			if err := json.Unmarshal([]byte(object.Value), &live); err == nil && now >= live.ExpiresAt {
+				expired = append(expired, &live)
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	// Ending deletes records, so the listing finishes first
+	for _, live := range expired {
+		if err := endLiveLocation(ctx, logger, nk, live); err != nil {
+			logger.Warn("Failed to end live location %s: %v", live.ID, err)
+		}
+	}
+	if len(expired) > 0 {
+		logger.Info("Ended %d expired live locations", len(expired))
+	}
+	return nil
+}
+
+// StartLiveLocationSweeper ends expired live-location sessions every LIVE_LOCATION_SWEEP_SECONDS; 0 disables it.
+// Expired sessions stop accepting updates right away either way.
+func StartLiveLocationSweeper(logger nkruntime.Logger, nk nkruntime.NakamaModule) {
+	seconds := serverConfig.LiveLocationSweepSeconds
+	if seconds <= 0 {
+		logger.Info("Live location sweeper disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(seconds) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := runLiveLocationSweep(context.Background(), logger, nk); err != nil {
+				logger.Error("Live location sweep failed: %v", err)
+			}
+		}
+	}()
+	logger.Info("Live location sweeper scheduled every %d seconds", seconds)
+}
+
+// checkLocationChannel verifies the caller belongs to the channel a location is shared in
+func checkLocationChannel(ctx context.Context, nk nkruntime.NakamaModule, userID, channelID string) error {
+	if channelID == "" {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Missing required field: channelId")
+	}
+	member, err := isChannelMember(ctx, nk, channelID, userID)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return errorWithCode(ERROR_CODE_NOT_A_MEMBER, "Not a member of this channel")
+	}
+	return nil
+}
+
+// RpcShareLocation sends a static location to a channel as a message from the caller
+func RpcShareLocation(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(LocationResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+		LocationPoint
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := request.validate(); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	request.Name, request.Address = strings.TrimSpace(request.Name), strings.TrimSpace(request.Address)
+	if utf8.RuneCountInString(request.Name) > LOCATION_MAX_LABEL || utf8.RuneCountInString(request.Address) > LOCATION_MAX_LABEL {
+		return marshalResponse(LocationResponse{Success: false, Error: fmt.Sprintf("name and address cannot exceed %d characters", LOCATION_MAX_LABEL), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := checkLocationChannel(ctx, nk, userID, request.ChannelID); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	content := map[string]interface{}{
+		"type":      LOCATION_MESSAGE_TYPE,
+		"latitude":  request.Latitude,
+		"longitude": request.Longitude,
+	}
+	if request.Accuracy > 0 {
+		content["accuracy"] = request.Accuracy
+	}
+	// The place name is the message's text, so it is filtered and previewed like any other
+	if request.Name != "" {
+		content["text"] = request.Name
+	}
+	if request.Address != "" {
+		content["address"] = request.Address
+	}
+	message, err := sendMessageAs(ctx, logger, db, nk, userID, usernameFromContext(ctx), request.ChannelID, content)
+	if err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(LocationResponse{Success: true, MessageID: message.MessageID})
+}
+
+// RpcStartLiveLocation starts sharing the caller's position with a channel for durationSeconds. The channel gets a
+// live_location message; members call watch_live_location to receive the updates.
+func RpcStartLiveLocation(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(LocationResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+		LocationPoint
+		DurationSeconds int64 `json:"durationSeconds"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := request.validate(); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if request.DurationSeconds == 0 {
+		request.DurationSeconds = LIVE_LOCATION_DEFAULT_DURATION_SECONDS
+	}
+	if request.DurationSeconds < LIVE_LOCATION_MIN_DURATION_SECONDS || request.DurationSeconds > LIVE_LOCATION_MAX_DURATION_SECONDS {
+		return marshalResponse(LocationResponse{Success: false, Error: fmt.Sprintf("durationSeconds must be between %d and %d", LIVE_LOCATION_MIN_DURATION_SECONDS, LIVE_LOCATION_MAX_DURATION_SECONDS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := checkLocationChannel(ctx, nk, userID, request.ChannelID); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	now := time.Now()
+	position := request.LocationPoint
+	position.UpdatedAt = now.Unix()
+	live := &LiveLocation{
+		ID:        uuid.New().String(),
+		ChannelID: request.ChannelID,
+		UserID:    userID,
+		Username:  usernameFromContext(ctx),
+		Position:  &position,
+		StartedAt: now.Unix(),
+		ExpiresAt: now.Unix() + request.DurationSeconds,
+	}
+	// The session exists before its message, so members can watch as soon as they see it
+	if err := writeLiveLocation(ctx, nk, live); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: fmt.Sprintf("Failed to store live location: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	content := map[string]interface{}{
+		"type":           LIVE_LOCATION_MESSAGE_TYPE,
+		"liveLocationId": live.ID,
+		"latitude":       position.Latitude,
+		"longitude":      position.Longitude,
+		"expiresAt":      live.ExpiresAt,
+	}
+	message, err := sendMessageAs(ctx, logger, db, nk, userID, live.Username, request.ChannelID, content)
+	if err != nil {
+		if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: LIVE_LOCATION_COLLECTION, Key: live.ID}}); err != nil {
+			logger.Warn("Failed to delete live location %s of a message that was not sent: %v", live.ID, err)
+		}
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	live.MessageID = message.MessageID
+	if err := writeLiveLocation(ctx, nk, live); err != nil {
+		logger.Warn("Failed to link live location %s to message %s: %v", live.ID, message.MessageID, err)
+	}
+
+	logger.Info("User %s started sharing live location %s in %s until %d", userID, live.ID, request.ChannelID, live.ExpiresAt)
+	return marshalResponse(LocationResponse{Success: true, MessageID: message.MessageID, LiveLocation: live})
+}
+
+// RpcUpdateLiveLocation relays a new position of the caller's live location to its watchers. Updates closer together
+// than LIVE_LOCATION_MIN_INTERVAL_SECONDS are refused with LOCATION_THROTTLED and retryAfter.
+func RpcUpdateLiveLocation(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(LocationResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		LiveLocationID string `json:"liveLocationId"`
+		LocationPoint
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.LiveLocationID == "" {
+		return marshalResponse(LocationResponse{Success: false, Error: "Missing required field: liveLocationId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := request.validate(); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	live, err := readLiveLocation(ctx, nk, request.LiveLocationID)
+	if err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if live == nil {
+		return marshalResponse(LocationResponse{Success: false, Error: "Live location not found or has ended", Code: ERROR_CODE_NOT_FOUND})
+	}
+	if live.UserID != userID {
+		return marshalResponse(LocationResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	interval := time.Duration(serverConfig.LiveLocationMinIntervalSeconds) * time.Second
+	now := time.Now()
+	if ok, wait := liveLocationUpdates.allow(live.ID, interval, now); !ok {
+		return marshalResponse(LocationResponse{
+			Success:    false,
+			Error:      "Location updates are too frequent",
+			Code:       ERROR_CODE_LOCATION_THROTTLED,
+			RetryAfter: int64(math.Ceil(wait.Seconds())),
+		})
+	}
+
+	position := request.LocationPoint
+	position.UpdatedAt = now.Unix()
+	live.Position = &position
+	if err := writeLiveLocation(ctx, nk, live); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: fmt.Sprintf("Failed to store live location: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	if err := sendLiveLocationEvent(nk, &LiveLocationEvent{
+		Type: "location_update", LiveLocationID: live.ID, ChannelID: live.ChannelID, UserID: userID,
+		Position: &position, ExpiresAt: live.ExpiresAt, CreatedAt: now.Unix(),
+	}); err != nil {
+		logger.Warn("Failed to relay live location %s: %v", live.ID, err)
+	}
+	return marshalResponse(LocationResponse{Success: true, LiveLocation: live})
+}
+
+// RpcStopLiveLocation ends the caller's live location before it expires. Channel admins can stop anyone's.
+func RpcStopLiveLocation(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(LocationResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		LiveLocationID string `json:"liveLocationId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.LiveLocationID == "" {
+		return marshalResponse(LocationResponse{Success: false, Error: "Missing required field: liveLocationId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	live, err := readLiveLocation(ctx, nk, request.LiveLocationID)
+	if err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if live == nil {
+		return marshalResponse(LocationResponse{Success: false, Error: "Live location not found or has ended", Code: ERROR_CODE_NOT_FOUND})
+	}
+	if live.UserID != userID && !canModerateChannel(ctx, nk, live.ChannelID, userID) {
+		return marshalResponse(LocationResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	if err := endLiveLocation(ctx, logger, nk, live); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	logger.Info("Live location %s stopped by %s", live.ID, userID)
+	return marshalResponse(LocationResponse{Success: true})
+}
+
+// RpcWatchLiveLocation joins the calling socket session to a live location's stream and returns its last position.
+// Only members of the channel it is shared in may watch.
+func RpcWatchLiveLocation(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(LocationResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		LiveLocationID string `json:"liveLocationId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.LiveLocationID == "" {
+		return marshalResponse(LocationResponse{Success: false, Error: "Missing required field: liveLocationId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	live, err := readLiveLocation(ctx, nk, request.LiveLocationID)
+	if err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if live == nil {
+		return marshalResponse(LocationResponse{Success: false, Error: "Live location not found or has ended", Code: ERROR_CODE_NOT_FOUND})
+	}
+	if err := checkLocationChannel(ctx, nk, userID, live.ChannelID); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	sessionID := sessionIDFromContext(ctx)
+	if sessionID == "" {
+		return marshalResponse(LocationResponse{Success: false, Error: "watch_live_location must be called over the socket", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if _, err := nk.StreamUserJoin(LIVE_LOCATION_STREAM_MODE, live.ID, "", "", userID, sessionID, true, false, ""); err != nil {
+		return marshalResponse(LocationResponse{Success: false, Error: fmt.Sprintf("Failed to join live location stream: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	return marshalResponse(LocationResponse{Success: true, LiveLocation: live})
+}
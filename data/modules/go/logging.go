@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// REQUEST_ID_HEADER lets HTTP callers pass their own correlation ID
+	REQUEST_ID_HEADER     = "X-Request-Id"
+	REQUEST_ID_MAX_LENGTH = 128
+	// LOG_MAX_VALUE_BYTES is the longest payload string logged as is; longer ones are logged by length only
+	LOG_MAX_VALUE_BYTES = 256
+	LOG_REDACTED        = "[redacted]"
+)
+
+var (
+	// logBase64Pattern matches runs long enough to be encoded file content rather than IDs or keys
+	logBase64Pattern = regexp.MustCompile(`(data:[a-z]+/[a-z0-9.+-]+;base64,)?[A-Za-z0-9+/_-]{200,}={0,2}`)
+	// logCredentialPattern matches secrets written as name=value or "name": "value", keeping an auth scheme
+	logCredentialPattern = regexp.MustCompile(`(?i)((?:password|secret|token|authorization|api[_-]?key|access[_-]?key|secret[_-]?key|x-amz-signature|x-amz-credential|x-goog-signature)"?\s*[=:]\s*"?(?:(?:bearer|basic)\s+)?)[^\s"&,}]+`)
+	logBearerPattern     = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`)
+	requestIDPattern     = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+)
+
+// LOG_SECRET_FIELDS are payload fields whose values are never logged, matched by lowercase name suffix
+var LOG_SECRET_FIELDS = []string{"password", "secret", "token", "signature", "privatekey", "accesskey", "apikey", "credentials", "authorization", "envelope", "envelopes", "wrappedkey"}
+
+// redactLogText blanks credentials and encoded file content in a formatted log message
+func redactLogText(text string) string {
+	text = logBase64Pattern.ReplaceAllStringFunc(text, func(match string) string {
+		return fmt.Sprintf("[%d bytes redacted]", len(match))
+	})
+	text = logBearerPattern.ReplaceAllString(text, "${1} "+LOG_REDACTED)
+	return logCredentialPattern.ReplaceAllString(text, "${1}"+LOG_REDACTED)
+}
+
+// isSecretField reports whether a payload field holds a credential
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, suffix := range LOG_SECRET_FIELDS {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValue returns a payload value safe to log: secret fields are blanked and long strings, such as
+// base64 file data, are replaced by their length
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if isSecretField(name) {
+				v[name] = LOG_REDACTED
+			} else {
+				v[name] = redactValue(field)
+			}
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+		return v
+	case string:
+		if len(v) > LOG_MAX_VALUE_BYTES {
+			return fmt.Sprintf("[%d bytes]", len(v))
+		}
+		return redactLogText(v)
+	}
+	return value
+}
+
+// redactPayload returns an RPC payload in a form safe to log
+func redactPayload(payload string) string {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(payload), &decoded); err != nil {
+		if len(payload) > LOG_MAX_VALUE_BYTES {
+			return fmt.Sprintf("[%d bytes, not JSON]", len(payload))
+		}
+		return redactLogText(payload)
+	}
+	redacted, _ := json.Marshal(redactValue(decoded))
+	return string(redacted)
+}
+
+// redactingLogger redacts every message before handing it to Nakama's logger
+type redactingLogger struct {
+	nkruntime.Logger
+}
+
+func (l *redactingLogger) Debug(format string, v ...interface{}) {
+	l.Logger.Debug("%s", redactLogText(fmt.Sprintf(format, v...)))
+}
+
+func (l *redactingLogger) Info(format string, v ...interface{}) {
+	l.Logger.Info("%s", redactLogText(fmt.Sprintf(format, v...)))
+}
+
+func (l *redactingLogger) Warn(format string, v ...interface{}) {
+	l.Logger.Warn("%s", redactLogText(fmt.Sprintf(format, v...)))
+}
+
+func (l *redactingLogger) Error(format string, v ...interface{}) {
+	l.Logger.Error("%s", redactLogText(fmt.Sprintf(format, v...)))
+}
+
+func (l *redactingLogger) WithField(key string, v interface{}) nkruntime.Logger {
+	return &redactingLogger{l.Logger.WithField(key, v)}
+}
+
+func (l *redactingLogger) WithFields(fields map[string]interface{}) nkruntime.Logger {
+	return &redactingLogger{l.Logger.WithFields(fields)}
+}
+
+// redactLogs wraps a logger so everything logged through it is redacted
+func redactLogs(logger nkruntime.Logger) nkruntime.Logger {
+	if _, ok := logger.(*redactingLogger); ok {
+		return logger
+	}
+	return &redactingLogger{logger}
+}
+
+// requestID returns the caller's X-Request-Id when it is a sensible ID, or a new one
+func requestID(ctx context.Context) string {
+	if headers, ok := ctx.Value(nkruntime.RUNTIME_CTX_HEADERS).(map[string][]string); ok {
+		for name, values := range headers {
+			if strings.EqualFold(name, REQUEST_ID_HEADER) && len(values) > 0 {
+				if id := values[0]; len(id) <= REQUEST_ID_MAX_LENGTH && requestIDPattern.MatchString(id) {
+					return id
+				}
+			}
+		}
+	}
+	return uuid.New().String()
+}
+
+// withRequestLog gives every call of an RPC a request ID and a logger that adds it, the RPC and the caller to
+// each line and redacts secrets and file content. When the call returns, its outcome and latency are logged.
+func withRequestLog(id string, fn rpcFunction) rpcFunction {
+	return func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+		logger = redactLogs(logger.WithFields(map[string]interface{}{
+			"request_id": requestID(ctx),
+			"rpc":        id,
+			"user_id":    userIDFromContext(ctx),
+		}))
+		if serverConfig.LogRPCPayloads {
+			logger.Debug("RPC payload: %s", redactPayload(payload))
+		}
+
+		start := time.Now()
+		response, err := fn(ctx, logger, db, nk, payload)
+		outcome := responseCode(response, err)
+		if outcome == "" {
+			outcome = METRIC_RESULT_OK
+		}
+		done := logger.WithFields(map[string]interface{}{
+			"outcome":       outcome,
+			"latency_ms":    time.Since(start).Milliseconds(),
+			"payload_bytes": len(payload),
+		})
+		if outcome == ERROR_CODE_INTERNAL {
+			done.Error("RPC failed")
+		} else {
+			done.Info("RPC completed")
+		}
+		return response, err
+	}
+}
@@ -7,277 +7,466 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"os"
-	"strconv"
+	"io"
 	"strings"
-	"time"
 
 	nkruntime "github.com/heroiclabs/nakama-common/runtime"
-	minio "github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
-const BUCKET_NAME = "chat-images"
-
-var minioClient *minio.Client
-
 // ImageUploadRequest represents the request payload for image upload
 type ImageUploadRequest struct {
 	ImageData   string `json:"imageData"`
 	ContentType string `json:"contentType"`
 	FileName    string `json:"fileName"`
+	ChannelID   string `json:"channelId,omitempty"`
+	// Envelope marks ImageData as client-encrypted ciphertext, see uploadEncryptedImage
+	Envelope *KeyEnvelope `json:"envelope,omitempty"`
 }
 
 // ImageUploadResponse represents the response for image upload
 type ImageUploadResponse struct {
-	Success   bool   `json:"success"`
-	ImageURL  string `json:"imageUrl,omitempty"`
-	ObjectKey string `json:"objectKey,omitempty"`
-	Error     string `json:"error,omitempty"`
+	Success    bool                   `json:"success"`
+	ImageURL   string                 `json:"imageUrl,omitempty"`
+	ObjectKey  string                 `json:"objectKey,omitempty"`
+	Thumbnails map[string]string      `json:"thumbnails,omitempty"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	// ExpiresAt is when ImageURL stops working, in Unix seconds
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// Deduplicated is set when the same bytes were uploaded before and their object is returned
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	// Encrypted is set for ciphertext objects; Envelope is only included for the uploader and channel members
+	Encrypted bool         `json:"encrypted,omitempty"`
+	Envelope  *KeyEnvelope `json:"envelope,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	Code      string       `json:"code,omitempty"`
 }
 
-// InitializeMinioClient initializes the Minio client
-func InitializeMinioClient(logger nkruntime.Logger) error {
-	endpoint := os.Getenv("MINIO_ENDPOINT")
-	if endpoint == "" {
-		endpoint = "minio:9000"
+// RpcUploadImage handles image upload via RPC
+func (s *Services) RpcUploadImage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	// Parse request payload
+	var request ImageUploadRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to parse request: %v", err),
+			Code:    ERROR_CODE_PAYLOAD_INVALID,
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
 	}
 
-	accessKey := os.Getenv("MINIO_ACCESS_KEY")
-	if accessKey == "" {
-		accessKey = "minioadmin"
+	// Encrypted uploads skip every check that needs to read the image
+	if request.Envelope != nil {
+		return s.uploadEncryptedImage(ctx, logger, nk, &request)
 	}
 
-	secretKey := os.Getenv("MINIO_SECRET_KEY")
-	if secretKey == "" {
-		secretKey = "minioadmin"
+	if request.ImageData == "" || request.ContentType == "" || request.FileName == "" {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   "Missing required fields: imageData, contentType, or fileName",
+			Code:    ERROR_CODE_PAYLOAD_INVALID,
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
 	}
 
-	useSSL := os.Getenv("MINIO_USE_SSL") == "true"
-
-	logger.Info("Initializing Minio client with endpoint: %s", endpoint)
-
-	// Parse endpoint
-	endpointParts := strings.Split(endpoint, ":")
-	endPoint := endpointParts[0]
-	port := 9000
-	if len(endpointParts) > 1 {
-		if p, err := strconv.Atoi(endpointParts[1]); err == nil {
-			port = p
+	// Large images must use the presigned upload flow instead of inline base64
+	if base64.StdEncoding.DecodedLen(len(request.ImageData)) > s.Config.InlineUploadMaxBytes {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Image exceeds the inline upload limit of %d bytes, use request_upload_url instead", s.Config.InlineUploadMaxBytes),
+			Code:    ERROR_CODE_PAYLOAD_TOO_LARGE,
 		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
 	}
 
-	// Initialize Minio client
-	var err error
-	endpointURL := fmt.Sprintf("%s:%d", endPoint, port)
-	minioClient, err = minio.New(endpointURL, &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
-		Secure: useSSL,
-		Region: "us-east-1",
-	})
+	logger.Info("Processing image upload: %s, type: %s", request.FileName, request.ContentType)
+
+	backend, err := s.Storage.Backend(logger)
 	if err != nil {
-		return fmt.Errorf("failed to create Minio client: %v", err)
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to initialize storage backend: %v", err),
+			Code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
 	}
 
-	logger.Info("Minio client initialized successfully")
-	return nil
-}
-
-// EnsureBucketExists ensures the bucket exists, creates it if it doesn't
-func EnsureBucketExists(ctx context.Context, logger nkruntime.Logger) error {
-	exists, err := minioClient.BucketExists(ctx, BUCKET_NAME)
-	if err != nil {
-		return fmt.Errorf("failed to check bucket existence: %v", err)
+	// Ensure bucket exists
+	if err := backend.EnsureBucket(ctx, logger, s.Config.Bucket); err != nil {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to ensure bucket exists: %v", err),
+			Code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
 	}
 
-	if !exists {
-		logger.Info("Bucket %s does not exist, creating...", BUCKET_NAME)
-		err = minioClient.MakeBucket(ctx, BUCKET_NAME, minio.MakeBucketOptions{Region: "us-east-1"})
-		if err != nil {
-			return fmt.Errorf("failed to create bucket: %v", err)
-		}
-		logger.Info("Bucket %s created successfully", BUCKET_NAME)
-
-		// Set bucket policy to allow public read
-		policy := `{
-			"Version": "2012-10-17",
-			"Statement": [
-				{
-					"Effect": "Allow",
-					"Principal": {"AWS": ["*"]},
-					"Action": ["s3:GetObject"],
-					"Resource": ["arn:aws:s3:::` + BUCKET_NAME + `/*"]
-				}
-			]
-		}`
-		err = minioClient.SetBucketPolicy(ctx, BUCKET_NAME, policy)
-		if err != nil {
-			logger.Warn("Failed to set bucket policy: %v", err)
-		} else {
-			logger.Info("Bucket policy set for %s", BUCKET_NAME)
+	// Get user ID from context (Nakama sets user_id in context)
+	userId := "anonymous"
+	if uid := ctx.Value("user_id"); uid != nil {
+		if uidStr, ok := uid.(string); ok {
+			userId = uidStr
 		}
 	}
+	// Generate unique object key
+	now := s.Clock.Now()
+	objectKey := uploadObjectKey(userId, now, request.FileName, request.ContentType)
 
-	return nil
-}
+	logger.Info("Uploading image with object key: %s", objectKey)
 
-// RpcUploadImage handles image upload via RPC
-func RpcUploadImage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
-	logger.Info("Received image upload request")
+	// Bound the uploads being decoded and stored at once
+	release, err := s.acquireUploadSlot(ctx)
+	if err != nil {
+		logger.Warn("Turned away image upload %s: %v", objectKey, err)
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCodeOf(err),
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
+	}
+	defer release()
 
-	// Parse request payload
-	var request ImageUploadRequest
-	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+	// The payload is decoded while it is read instead of into memory. Its size is unknown up front only
+	// when the base64 has line breaks, quota and limits are then charged for the largest size it can decode to.
+	source := newBase64Source(request.ImageData)
+	imageSize := source.Size()
+	maxSize := imageSize
+	if maxSize < 0 {
+		maxSize = int64(base64.StdEncoding.DecodedLen(len(request.ImageData)))
+	}
+	decodeFailed := func() (string, error) {
 		response := ImageUploadResponse{
 			Success: false,
-			Error:   fmt.Sprintf("Failed to parse request: %v", err),
+			Error:   fmt.Sprintf("Failed to decode base64 image: %v", source.err),
+			Code:    ERROR_CODE_PAYLOAD_INVALID,
 		}
 		responseJSON, _ := json.Marshal(response)
 		return string(responseJSON), nil
 	}
 
-	if request.ImageData == "" || request.ContentType == "" || request.FileName == "" {
+	// Check the bytes really are an allowed image, whatever the client claims
+	contentType, err := validateImage(source, request.ContentType, maxSize)
+	if source.err != nil {
+		return decodeFailed()
+	}
+	if err != nil {
+		logger.Warn("Rejected image upload %s: %v", objectKey, err)
 		response := ImageUploadResponse{
 			Success: false,
-			Error:   "Missing required fields: imageData, contentType, or fileName",
+			Error:   err.Error(),
+			Code:    errorCodeOf(err),
 		}
 		responseJSON, _ := json.Marshal(response)
 		return string(responseJSON), nil
 	}
+	request.ContentType = contentType
 
-	logger.Info("Processing image upload: %s, type: %s", request.FileName, request.ContentType)
+	// Charge the upload against the user's daily quota and rate limit
+	if err := s.reserveUploadQuota(ctx, nk, userIDFromContext(ctx), maxSize); err != nil {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCodeOf(err),
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
+	}
 
-	// Initialize Minio client if not already initialized
-	if minioClient == nil {
-		if err := InitializeMinioClient(logger); err != nil {
-			response := ImageUploadResponse{
-				Success: false,
-				Error:   fmt.Sprintf("Failed to initialize Minio client: %v", err),
+	// Identical bytes uploaded before are answered with the object already stored
+	var hashKey string
+	if s.Config.UploadDedupEnabled && userId != "anonymous" {
+		source.Seek(0, io.SeekStart)
+		if hashKey, err = contentHashKey(source, channelTypeOf(request.ChannelID)); err != nil {
+			return decodeFailed()
+		}
+		entry, err := acquireDuplicate(ctx, nk, hashKey, userId, request.ChannelID)
+		if err != nil {
+			logger.Warn("Failed to look up duplicate of %s: %v", objectKey, err)
+		} else if entry != nil {
+			logger.Info("Image %s is a duplicate of %s (%d references)", objectKey, entry.ObjectKey, entry.RefCount)
+			response, err := s.duplicateUploadResponse(ctx, logger, nk, entry)
+			if err != nil {
+				response = ImageUploadResponse{
+					Success: false,
+					Error:   fmt.Sprintf("Failed to generate presigned URL: %v", err),
+					Code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+				}
 			}
 			responseJSON, _ := json.Marshal(response)
 			return string(responseJSON), nil
 		}
 	}
 
-	// Ensure bucket exists
-	if err := EnsureBucketExists(ctx, logger); err != nil {
+	// Scan what the client sent before anything is stored
+	source.Seek(0, io.SeekStart)
+	if err := scanUpload(ctx, logger, nk, &MalwareIncident{
+		OwnerID:     userIDFromContext(ctx),
+		ObjectKey:   objectKey,
+		ContentType: request.ContentType,
+		Size:        maxSize,
+		ChannelID:   request.ChannelID,
+	}, source); err != nil {
+		if source.err != nil {
+			return decodeFailed()
+		}
 		response := ImageUploadResponse{
 			Success: false,
-			Error:   fmt.Sprintf("Failed to ensure bucket exists: %v", err),
+			Error:   err.Error(),
+			Code:    errorCodeOf(err),
 		}
 		responseJSON, _ := json.Marshal(response)
 		return string(responseJSON), nil
 	}
+	source.Seek(0, io.SeekStart)
 
-	// Generate unique object key
-	timestamp := time.Now().UnixMilli()
-	// Get user ID from context (Nakama sets user_id in context)
-	userId := "anonymous"
-	if uid := ctx.Value("user_id"); uid != nil {
-		if uidStr, ok := uid.(string); ok {
-			userId = uidStr
+	// Run the image processing stages configured for this deployment and channel type. Only they need the
+	// decoded image in memory; without any the payload streams straight into storage.
+	asset := newImageAsset(nil, request.ContentType)
+	asset.ChannelID = request.ChannelID
+	asset.ChannelType = channelTypeOf(request.ChannelID)
+	var body io.Reader = source
+	if stages := imagePipelineFor(asset.ChannelType); len(stages) > 0 {
+		if asset.Data, err = io.ReadAll(source); err != nil {
+			return decodeFailed()
+		}
+		if err := runImagePipeline(ctx, logger, stages, asset); err != nil {
+			response := ImageUploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Image processing failed: %v", err),
+				Code:    ERROR_CODE_INTERNAL,
+			}
+			responseJSON, _ := json.Marshal(response)
+			return string(responseJSON), nil
 		}
+		request.ContentType = asset.ContentType
+		body = bytes.NewReader(asset.Data)
+		imageSize = int64(len(asset.Data))
 	}
-	objectKey := fmt.Sprintf("%s/%d_%s", userId, timestamp, request.FileName)
 
-	logger.Info("Uploading image with object key: %s", objectKey)
-
-	// Decode base64 image data
-	imageData, err := base64.StdEncoding.DecodeString(request.ImageData)
-	if err != nil {
+	// Flagged images are kept out of reach until an admin reviews them
+	if asset.isFlagged() {
+		err := s.quarantineUpload(ctx, logger, nk, userIDFromContext(ctx), objectKey, request.ChannelID, asset)
 		response := ImageUploadResponse{
 			Success: false,
-			Error:   fmt.Sprintf("Failed to decode base64 image: %v", err),
+			Error:   err.Error(),
+			Code:    errorCodeOf(err),
 		}
 		responseJSON, _ := json.Marshal(response)
 		return string(responseJSON), nil
 	}
 
-	imageSize := int64(len(imageData))
 	logger.Info("Image size: %d bytes", imageSize)
 
-	// Upload to Minio
-	_, err = minioClient.PutObject(ctx, BUCKET_NAME, objectKey, bytes.NewReader(imageData), imageSize, minio.PutObjectOptions{
-		ContentType: request.ContentType,
-	})
+	// Upload to object storage
+	err = backend.PutObject(ctx, s.Config.bucketForKey(objectKey), objectKey, body, imageSize, request.ContentType)
+	if source.err != nil {
+		return decodeFailed()
+	}
 	if err != nil {
 		response := ImageUploadResponse{
 			Success: false,
 			Error:   fmt.Sprintf("Failed to upload image: %v", err),
+			Code:    ERROR_CODE_STORAGE_UNAVAILABLE,
 		}
 		responseJSON, _ := json.Marshal(response)
 		return string(responseJSON), nil
 	}
+	if imageSize < 0 {
+		if info, err := backend.StatObject(ctx, s.Config.bucketForKey(objectKey), objectKey); err == nil {
+			imageSize = info.Size
+		} else {
+			imageSize = maxSize
+		}
+	}
 
 	logger.Info("Image uploaded successfully: %s", objectKey)
 
-	// Generate presigned URL (expires in 7 days)
-	imageURL, err := minioClient.PresignedGetObject(ctx, BUCKET_NAME, objectKey, 7*24*time.Hour, nil)
+	// Thumbnails are best effort, the original is already stored
+	thumbnails, err := s.storeDerivatives(ctx, logger, objectKey, asset)
+	if err != nil {
+		logger.Warn("Failed to store thumbnails for %s: %v", objectKey, err)
+	}
+
+	// Record who uploaded the object; server-to-server uploads have no owner
+	if userId != "anonymous" {
+		attachment := &Attachment{
+			OwnerID:     userId,
+			ObjectKey:   objectKey,
+			Bucket:      s.Config.bucketForKey(objectKey),
+			ContentType: request.ContentType,
+			Size:        imageSize,
+			ChannelID:   request.ChannelID,
+			Metadata:    map[string]interface{}{},
+			CreatedAt:   now.Unix(),
+			ContentHash: hashKey,
+		}
+		for k, v := range asset.Metadata {
+			attachment.Metadata[k] = v
+		}
+		if len(thumbnails) > 0 {
+			attachment.Metadata["thumbnails"] = thumbnails
+		}
+		if err := saveAttachment(ctx, nk, attachment); err != nil {
+			response := ImageUploadResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Failed to record upload: %v", err),
+				Code:    ERROR_CODE_INTERNAL,
+			}
+			responseJSON, _ := json.Marshal(response)
+			return string(responseJSON), nil
+		}
+		if hashKey != "" {
+			if err := indexUpload(ctx, nk, hashKey, attachment); err != nil {
+				logger.Warn("Failed to index %s by content hash: %v", objectKey, err)
+			}
+		}
+	}
+
+	// Generate presigned URL (expires in 7 days by default)
+	issued, err := s.presignImageURL(ctx, logger, nk, objectKey)
 	if err != nil {
 		response := ImageUploadResponse{
 			Success: false,
 			Error:   fmt.Sprintf("Failed to generate presigned URL: %v", err),
+			Code:    ERROR_CODE_STORAGE_UNAVAILABLE,
 		}
 		responseJSON, _ := json.Marshal(response)
 		return string(responseJSON), nil
 	}
 
-	logger.Info("Generated image URL: %s", imageURL.String())
-
 	response := ImageUploadResponse{
-		Success:   true,
-		ImageURL:  imageURL.String(),
-		ObjectKey: objectKey,
+		Success:    true,
+		ImageURL:   issued.URL,
+		ObjectKey:  objectKey,
+		Thumbnails: thumbnails,
+		Metadata:   asset.Metadata,
+		ExpiresAt:  issued.ExpiresAt,
 	}
 
 	responseJSON, _ := json.Marshal(response)
 	return string(responseJSON), nil
 }
 
-// RpcGetImageUrl gets presigned URL for existing image
-func RpcGetImageUrl(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
-	logger.Info("Received get image URL request")
-
+// RpcGetImageUrl gets presigned URL for existing image, or for a batch of images given as objectKeys
+func (s *Services) RpcGetImageUrl(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
 	// Parse request payload
 	var request struct {
-		ObjectKey string `json:"objectKey"`
+		ObjectKey  string   `json:"objectKey"`
+		ObjectKeys []string `json:"objectKeys"`
 	}
 	if err := json.Unmarshal([]byte(payload), &request); err != nil {
 		response := ImageUploadResponse{
 			Success: false,
 			Error:   fmt.Sprintf("Failed to parse request: %v", err),
+			Code:    ERROR_CODE_PAYLOAD_INVALID,
 		}
 		responseJSON, _ := json.Marshal(response)
 		return string(responseJSON), nil
 	}
 
+	// A screen full of images is one call rather than one per image
+	if request.ObjectKey == "" && request.ObjectKeys != nil {
+		return s.imageURLsResponse(ctx, logger, db, nk, request.ObjectKeys)
+	}
+
 	if request.ObjectKey == "" {
 		response := ImageUploadResponse{
 			Success: false,
 			Error:   "Missing required field: objectKey",
+			Code:    ERROR_CODE_PAYLOAD_INVALID,
 		}
 		responseJSON, _ := json.Marshal(response)
 		return string(responseJSON), nil
 	}
 
-	// Initialize Minio client if not already initialized
-	if minioClient == nil {
-		if err := InitializeMinioClient(logger); err != nil {
-			response := ImageUploadResponse{
-				Success: false,
-				Error:   fmt.Sprintf("Failed to initialize Minio client: %v", err),
-			}
-			responseJSON, _ := json.Marshal(response)
-			return string(responseJSON), nil
+	// Quarantined images are only reachable through list_flagged_uploads
+	if strings.HasPrefix(request.ObjectKey, QUARANTINE_PREFIX) && !isAdmin(ctx) {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   "Permission denied",
+			Code:    ERROR_CODE_PERMISSION_DENIED,
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
+	}
+
+	// In private mode only the uploader, admins and members of the attachment's channel get a URL
+	allowed, err := canAccessObject(ctx, db, nk, userIDFromContext(ctx), request.ObjectKey)
+	if err != nil {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to check image: %v", err),
+			Code:    ERROR_CODE_INTERNAL,
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
+	}
+	if !allowed {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   "Permission denied",
+			Code:    ERROR_CODE_PERMISSION_DENIED,
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
+	}
+
+	// Deleted images keep a tombstone so old keys stop resolving
+	deleted, err := isObjectDeleted(ctx, nk, request.ObjectKey)
+	if err != nil {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to check image: %v", err),
+			Code:    ERROR_CODE_INTERNAL,
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
+	}
+	if deleted {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   "Image has been deleted",
+			Code:    ERROR_CODE_NOT_FOUND,
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
+	}
+
+	if _, err := s.Storage.Backend(logger); err != nil {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to initialize storage backend: %v", err),
+			Code:    ERROR_CODE_STORAGE_UNAVAILABLE,
 		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
 	}
 
-	// Generate presigned URL (expires in 7 days)
-	imageURL, err := minioClient.PresignedGetObject(ctx, BUCKET_NAME, request.ObjectKey, 7*24*time.Hour, nil)
+	// The key envelope of an encrypted image goes to channel members only
+	envelope, encrypted, err := attachmentEnvelope(ctx, db, nk, userIDFromContext(ctx), request.ObjectKey)
+	if err != nil {
+		response := ImageUploadResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Failed to check image: %v", err),
+			Code:    ERROR_CODE_INTERNAL,
+		}
+		responseJSON, _ := json.Marshal(response)
+		return string(responseJSON), nil
+	}
+
+	// Reuse a recently issued URL so clients and CDNs see the same one
+	issued, err := s.presignImageURL(ctx, logger, nk, request.ObjectKey)
 	if err != nil {
 		response := ImageUploadResponse{
 			Success: false,
 			Error:   fmt.Sprintf("Failed to generate presigned URL: %v", err),
+			Code:    ERROR_CODE_STORAGE_UNAVAILABLE,
 		}
 		responseJSON, _ := json.Marshal(response)
 		return string(responseJSON), nil
@@ -285,8 +474,11 @@ func RpcGetImageUrl(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk
 
 	response := ImageUploadResponse{
 		Success:   true,
-		ImageURL:  imageURL.String(),
+		ImageURL:  issued.URL,
 		ObjectKey: request.ObjectKey,
+		ExpiresAt: issued.ExpiresAt,
+		Encrypted: encrypted,
+		Envelope:  envelope,
 	}
 
 	responseJSON, _ := json.Marshal(response)
@@ -295,17 +487,636 @@ func RpcGetImageUrl(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk
 
 // InitModule initializes the module
 func InitModule(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, initializer nkruntime.Initializer) error {
+	// Background workers keep this logger, so it redacts like the ones RPCs and hooks get
+	logger = redactLogs(logger)
 	logger.Info("Image Upload Module loaded")
 
+	config, err := LoadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	serverConfig = config
+	services := newServices(config)
+
+	// Every RPC registered below is logged, reports failures with an error code and is metered
+	initializer = &rpcInitializer{initializer}
+	metrics = nk
+
+	if err := LoadImagePipelines(logger); err != nil {
+		return fmt.Errorf("failed to load image pipelines: %v", err)
+	}
+	if err := InitializeMalwareScanner(logger); err != nil {
+		return fmt.Errorf("failed to initialize malware scanner: %v", err)
+	}
+	if err := InitializeTranslation(logger); err != nil {
+		return fmt.Errorf("failed to initialize translation: %v", err)
+	}
+	InitializeWebhooks(logger)
+	if err := InitializeActivityLeaderboards(ctx, nk); err != nil {
+		return err
+	}
+
+	// Create the storage backend and buckets up front. If this fails, RPCs create the backend and buckets on
+	// first use, and the lifecycle rules are applied at the next start.
+	if err := ConfigureBuckets(ctx, logger); err != nil {
+		logger.Warn("Failed to configure storage buckets: %v", err)
+	}
+
 	// Register RPC functions
-	if err := initializer.RegisterRpc("upload_image", RpcUploadImage); err != nil {
+	if err := initializer.RegisterRpc("upload_image", services.RpcUploadImage); err != nil {
 		return fmt.Errorf("failed to register upload_image RPC: %v", err)
 	}
 
-	if err := initializer.RegisterRpc("get_image_url", RpcGetImageUrl); err != nil {
+	if err := initializer.RegisterRpc("get_image_url", services.RpcGetImageUrl); err != nil {
 		return fmt.Errorf("failed to register get_image_url RPC: %v", err)
 	}
 
-	logger.Info("RPC functions registered: upload_image, get_image_url")
+	if err := initializer.RegisterRpc("request_upload_url", services.RpcRequestUploadURL); err != nil {
+		return fmt.Errorf("failed to register request_upload_url RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("confirm_upload", services.RpcConfirmUpload); err != nil {
+		return fmt.Errorf("failed to register confirm_upload RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("upload_video", services.RpcUploadVideo); err != nil {
+		return fmt.Errorf("failed to register upload_video RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("upload_voice", services.RpcUploadVoice); err != nil {
+		return fmt.Errorf("failed to register upload_voice RPC: %v", err)
+	}
+
+	logger.Info("RPC functions registered: upload_image, get_image_url, request_upload_url, confirm_upload, upload_video, upload_voice")
+
+	// Register party RPC functions
+	if err := initializer.RegisterRpc("party_create", RpcPartyCreate); err != nil {
+		return fmt.Errorf("failed to register party_create RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("party_join", RpcPartyJoin); err != nil {
+		return fmt.Errorf("failed to register party_join RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("party_leave", RpcPartyLeave); err != nil {
+		return fmt.Errorf("failed to register party_leave RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("party_get", RpcPartyGet); err != nil {
+		return fmt.Errorf("failed to register party_get RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("party_send_message", RpcPartySendMessage); err != nil {
+		return fmt.Errorf("failed to register party_send_message RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("party_convert_to_group", RpcPartyConvertToGroup); err != nil {
+		return fmt.Errorf("failed to register party_convert_to_group RPC: %v", err)
+	}
+
+	logger.Info("Party RPC functions registered: party_create, party_join, party_leave, party_get, party_send_message, party_convert_to_group")
+
+	// Register wallet RPC functions
+	if err := initializer.RegisterRpc("wallet_get", RpcWalletGet); err != nil {
+		return fmt.Errorf("failed to register wallet_get RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("wallet_spend", RpcWalletSpend); err != nil {
+		return fmt.Errorf("failed to register wallet_spend RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("wallet_gift", RpcWalletGift); err != nil {
+		return fmt.Errorf("failed to register wallet_gift RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("wallet_history", RpcWalletHistory); err != nil {
+		return fmt.Errorf("failed to register wallet_history RPC: %v", err)
+	}
+
+	logger.Info("Wallet RPC functions registered: wallet_get, wallet_spend, wallet_gift, wallet_history")
+
+	// Register daily reward RPC functions
+	if err := initializer.RegisterRpc("claim_daily_reward", RpcClaimDailyReward); err != nil {
+		return fmt.Errorf("failed to register claim_daily_reward RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("get_daily_reward_status", RpcGetDailyRewardStatus); err != nil {
+		return fmt.Errorf("failed to register get_daily_reward_status RPC: %v", err)
+	}
+
+	logger.Info("Daily reward RPC functions registered: claim_daily_reward, get_daily_reward_status")
+
+	// Register community event RPC functions
+	if err := initializer.RegisterRpc("schedule_event", RpcScheduleEvent); err != nil {
+		return fmt.Errorf("failed to register schedule_event RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("cancel_event", RpcCancelEvent); err != nil {
+		return fmt.Errorf("failed to register cancel_event RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("award_event_points", RpcAwardEventPoints); err != nil {
+		return fmt.Errorf("failed to register award_event_points RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("list_events", RpcListEvents); err != nil {
+		return fmt.Errorf("failed to register list_events RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("join_event", RpcJoinEvent); err != nil {
+		return fmt.Errorf("failed to register join_event RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("get_event_standings", RpcGetEventStandings); err != nil {
+		return fmt.Errorf("failed to register get_event_standings RPC: %v", err)
+	}
+
+	if err := initializer.RegisterTournamentEnd(OnEventTournamentEnd); err != nil {
+		return fmt.Errorf("failed to register tournament end hook: %v", err)
+	}
+
+	logger.Info("Community event RPC functions registered: schedule_event, cancel_event, award_event_points, list_events, join_event, get_event_standings")
+
+	// Register outbox RPC function
+	if err := initializer.RegisterRpc("flush_outbox", RpcFlushOutbox); err != nil {
+		return fmt.Errorf("failed to register flush_outbox RPC: %v", err)
+	}
+
+	logger.Info("Outbox RPC function registered: flush_outbox")
+
+	// Register attachment functions
+	if err := initializer.RegisterRpc("list_my_attachments", RpcListMyAttachments); err != nil {
+		return fmt.Errorf("failed to register list_my_attachments RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("delete_image", services.RpcDeleteImage); err != nil {
+		return fmt.Errorf("failed to register delete_image RPC: %v", err)
+	}
+
+	logger.Info("Attachment RPC functions registered: list_my_attachments, delete_image")
+
+	// Register send checks (blocking, profanity filter)
+	if err := initializer.RegisterBeforeRt("ChannelMessageSend", BeforeChannelMessageSend); err != nil {
+		return fmt.Errorf("failed to register ChannelMessageSend before hook: %v", err)
+	}
+
+	logger.Info("Send checks registered: ChannelMessageSend before hook")
+
+	// Register sent message hooks (attachment linking, mentions, push)
+	if err := initializer.RegisterAfterRt("ChannelMessageSend", AfterChannelMessageSend); err != nil {
+		return fmt.Errorf("failed to register ChannelMessageSend after hook: %v", err)
+	}
+
+	logger.Info("Sent message hooks registered: ChannelMessageSend after hook")
+
+	// Register moderation functions
+	if err := initializer.RegisterRpc("list_flagged_uploads", RpcListFlaggedUploads); err != nil {
+		return fmt.Errorf("failed to register list_flagged_uploads RPC: %v", err)
+	}
+
+	logger.Info("Moderation RPC function registered: list_flagged_uploads")
+
+	// Register reaction functions
+	if err := initializer.RegisterRpc("add_reaction", RpcAddReaction); err != nil {
+		return fmt.Errorf("failed to register add_reaction RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("remove_reaction", RpcRemoveReaction); err != nil {
+		return fmt.Errorf("failed to register remove_reaction RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("list_reactions", RpcListReactions); err != nil {
+		return fmt.Errorf("failed to register list_reactions RPC: %v", err)
+	}
+
+	logger.Info("Reaction RPC functions registered: add_reaction, remove_reaction, list_reactions")
+
+	// Register thread functions
+	if err := initializer.RegisterRpc("get_thread", RpcGetThread); err != nil {
+		return fmt.Errorf("failed to register get_thread RPC: %v", err)
+	}
+
+	logger.Info("Thread RPC function registered: get_thread")
+
+	// Register typing indicator
+	if err := initializer.RegisterRpc("typing", RpcTyping); err != nil {
+		return fmt.Errorf("failed to register typing RPC: %v", err)
+	}
+
+	logger.Info("Typing RPC function registered: typing")
+
+	// Register group chat functions
+	if err := initializer.RegisterRpc("create_group_chat", RpcCreateGroupChat); err != nil {
+		return fmt.Errorf("failed to register create_group_chat RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("invite_members", RpcInviteMembers); err != nil {
+		return fmt.Errorf("failed to register invite_members RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("kick_member", RpcKickMember); err != nil {
+		return fmt.Errorf("failed to register kick_member RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("promote_admin", RpcPromoteAdmin); err != nil {
+		return fmt.Errorf("failed to register promote_admin RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("transfer_ownership", RpcTransferOwnership); err != nil {
+		return fmt.Errorf("failed to register transfer_ownership RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("set_group_avatar", RpcSetGroupAvatar); err != nil {
+		return fmt.Errorf("failed to register set_group_avatar RPC: %v", err)
+	}
+
+	logger.Info("Group chat RPC functions registered: create_group_chat, invite_members, kick_member, promote_admin, transfer_ownership, set_group_avatar")
+
+	// Register blocking functions
+	if err := initializer.RegisterRpc("block_user", RpcBlockUser); err != nil {
+		return fmt.Errorf("failed to register block_user RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("unblock_user", RpcUnblockUser); err != nil {
+		return fmt.Errorf("failed to register unblock_user RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("list_blocked_users", RpcListBlockedUsers); err != nil {
+		return fmt.Errorf("failed to register list_blocked_users RPC: %v", err)
+	}
+
+	if err := initializer.RegisterBeforeRt("ChannelJoin", BeforeChannelJoin); err != nil {
+		return fmt.Errorf("failed to register ChannelJoin before hook: %v", err)
+	}
+
+	logger.Info("Blocking functions registered: block_user, unblock_user, list_blocked_users, ChannelJoin before hook")
+
+	// Register message edit functions
+	if err := initializer.RegisterRpc("edit_message", RpcEditMessage); err != nil {
+		return fmt.Errorf("failed to register edit_message RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("delete_message", RpcDeleteMessage); err != nil {
+		return fmt.Errorf("failed to register delete_message RPC: %v", err)
+	}
+
+	// Socket edits and removes would bypass the RPCs' checks
+	if err := initializer.RegisterBeforeRt("ChannelMessageUpdate", BeforeChannelMessageChange); err != nil {
+		return fmt.Errorf("failed to register ChannelMessageUpdate before hook: %v", err)
+	}
+	if err := initializer.RegisterBeforeRt("ChannelMessageRemove", BeforeChannelMessageChange); err != nil {
+		return fmt.Errorf("failed to register ChannelMessageRemove before hook: %v", err)
+	}
+
+	logger.Info("Message RPC functions registered: edit_message, delete_message, ChannelMessageUpdate and ChannelMessageRemove before hooks")
+
+	// Register message search
+	if err := InitializeMessageSearch(ctx, logger, db); err != nil {
+		logger.Error("Message search disabled: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("search_messages", RpcSearchMessages); err != nil {
+		return fmt.Errorf("failed to register search_messages RPC: %v", err)
+	}
+
+	logger.Info("Search RPC function registered: search_messages")
+
+	// Register message archive
+	if err := InitializeMessageArchive(ctx, logger, db); err != nil {
+		logger.Error("Message archive disabled: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("archive_stats", RpcArchiveStats); err != nil {
+		return fmt.Errorf("failed to register archive_stats RPC: %v", err)
+	}
+
+	logger.Info("Archive RPC function registered: archive_stats")
+
+	// Register sync functions
+	if err := initializer.RegisterRpc("sync_since", services.RpcSyncSince); err != nil {
+		return fmt.Errorf("failed to register sync_since RPC: %v", err)
+	}
+
+	logger.Info("Sync RPC function registered: sync_since")
+
+	// Register read receipt functions
+	if err := initializer.RegisterRpc("mark_read", RpcMarkRead); err != nil {
+		return fmt.Errorf("failed to register mark_read RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("get_read_state", RpcGetReadState); err != nil {
+		return fmt.Errorf("failed to register get_read_state RPC: %v", err)
+	}
+	logger.Info("Read receipt RPC functions registered: mark_read, get_read_state")
+
+	// Register push notification functions
+	InitializePushProviders(logger)
+
+	if err := initializer.RegisterRpc("register_push_token", RpcRegisterPushToken); err != nil {
+		return fmt.Errorf("failed to register register_push_token RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("unregister_push_token", RpcUnregisterPushToken); err != nil {
+		return fmt.Errorf("failed to register unregister_push_token RPC: %v", err)
+	}
+
+	logger.Info("Push RPC functions registered: register_push_token, unregister_push_token")
+
+	// Register report and ban functions
+	if err := initializer.RegisterRpc("report_message", RpcReportMessage); err != nil {
+		return fmt.Errorf("failed to register report_message RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("report_user", RpcReportUser); err != nil {
+		return fmt.Errorf("failed to register report_user RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("list_reports", RpcListReports); err != nil {
+		return fmt.Errorf("failed to register list_reports RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("resolve_report", RpcResolveReport); err != nil {
+		return fmt.Errorf("failed to register resolve_report RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("ban_user", RpcBanUser); err != nil {
+		return fmt.Errorf("failed to register ban_user RPC: %v", err)
+	}
+	logger.Info("Report RPC functions registered: report_message, report_user, list_reports, resolve_report, ban_user")
+
+	// Register disappearing message functions
+	if err := initializer.RegisterRpc("set_channel_ttl", RpcSetChannelTTL); err != nil {
+		return fmt.Errorf("failed to register set_channel_ttl RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("get_channel_ttl", RpcGetChannelTTL); err != nil {
+		return fmt.Errorf("failed to register get_channel_ttl RPC: %v", err)
+	}
+	logger.Info("Disappearing message RPC functions registered: set_channel_ttl, get_channel_ttl")
+	services.StartEphemeralSweeper(logger, db, nk)
+
+	// Register channel settings functions
+	if err := initializer.RegisterRpc("get_channel_settings", RpcGetChannelSettings); err != nil {
+		return fmt.Errorf("failed to register get_channel_settings RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("update_channel_settings", RpcUpdateChannelSettings); err != nil {
+		return fmt.Errorf("failed to register update_channel_settings RPC: %v", err)
+	}
+	logger.Info("Channel settings RPC functions registered: get_channel_settings, update_channel_settings")
+
+	// Register link preview functions
+	if err := initializer.RegisterRpc("unfurl_link", RpcUnfurlLink); err != nil {
+		return fmt.Errorf("failed to register unfurl_link RPC: %v", err)
+	}
+	logger.Info("Link preview RPC function registered: unfurl_link")
+
+	// Register avatar functions
+	if err := initializer.RegisterRpc("set_avatar", services.RpcSetAvatar); err != nil {
+		return fmt.Errorf("failed to register set_avatar RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("get_avatar_url", services.RpcGetAvatarUrl); err != nil {
+		return fmt.Errorf("failed to register get_avatar_url RPC: %v", err)
+	}
+	logger.Info("Avatar RPC functions registered: set_avatar, get_avatar_url")
+
+	// Register sticker functions
+	if err := initializer.RegisterRpc("upload_sticker_pack", RpcUploadStickerPack); err != nil {
+		return fmt.Errorf("failed to register upload_sticker_pack RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("list_sticker_packs", RpcListStickerPacks); err != nil {
+		return fmt.Errorf("failed to register list_sticker_packs RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("send_sticker", RpcSendSticker); err != nil {
+		return fmt.Errorf("failed to register send_sticker RPC: %v", err)
+	}
+	logger.Info("Sticker RPC functions registered: upload_sticker_pack, list_sticker_packs, send_sticker")
+
+	// Register poll functions
+	if err := initializer.RegisterRpc("create_poll", RpcCreatePoll); err != nil {
+		return fmt.Errorf("failed to register create_poll RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("vote_poll", RpcVotePoll); err != nil {
+		return fmt.Errorf("failed to register vote_poll RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("get_poll_results", RpcGetPollResults); err != nil {
+		return fmt.Errorf("failed to register get_poll_results RPC: %v", err)
+	}
+	logger.Info("Poll RPC functions registered: create_poll, vote_poll, get_poll_results")
+
+	// Register location functions
+	if err := initializer.RegisterRpc("share_location", RpcShareLocation); err != nil {
+		return fmt.Errorf("failed to register share_location RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("start_live_location", RpcStartLiveLocation); err != nil {
+		return fmt.Errorf("failed to register start_live_location RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("update_live_location", RpcUpdateLiveLocation); err != nil {
+		return fmt.Errorf("failed to register update_live_location RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("stop_live_location", RpcStopLiveLocation); err != nil {
+		return fmt.Errorf("failed to register stop_live_location RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("watch_live_location", RpcWatchLiveLocation); err != nil {
+		return fmt.Errorf("failed to register watch_live_location RPC: %v", err)
+	}
+	StartLiveLocationSweeper(logger, nk)
+	logger.Info("Location RPC functions registered: share_location, start_live_location, update_live_location, stop_live_location, watch_live_location")
+
+	// Register call signaling
+	if err := initializer.RegisterMatch(CALL_MATCH_MODULE, NewCallMatch); err != nil {
+		return fmt.Errorf("failed to register call match handler: %v", err)
+	}
+	if err := initializer.RegisterRpc("start_call", RpcStartCall); err != nil {
+		return fmt.Errorf("failed to register start_call RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("decline_call", RpcDeclineCall); err != nil {
+		return fmt.Errorf("failed to register decline_call RPC: %v", err)
+	}
+	logger.Info("Call match handler and RPC functions registered: start_call, decline_call")
+
+	// Register presence functions
+	if err := initializer.RegisterEventSessionStart(PresenceSessionStart(nk)); err != nil {
+		return fmt.Errorf("failed to register presence session start handler: %v", err)
+	}
+	if err := initializer.RegisterEventSessionEnd(PresenceSessionEnd(nk)); err != nil {
+		return fmt.Errorf("failed to register presence session end handler: %v", err)
+	}
+	if err := initializer.RegisterRpc("get_presence", RpcGetPresence); err != nil {
+		return fmt.Errorf("failed to register get_presence RPC: %v", err)
+	}
+	logger.Info("Presence session handlers and RPC function registered: get_presence")
+
+	// Register friend request functions
+	if err := initializer.RegisterRpc("send_friend_request", RpcSendFriendRequest); err != nil {
+		return fmt.Errorf("failed to register send_friend_request RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("respond_friend_request", RpcRespondFriendRequest); err != nil {
+		return fmt.Errorf("failed to register respond_friend_request RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("get_privacy_settings", RpcGetPrivacySettings); err != nil {
+		return fmt.Errorf("failed to register get_privacy_settings RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("update_privacy_settings", RpcUpdatePrivacySettings); err != nil {
+		return fmt.Errorf("failed to register update_privacy_settings RPC: %v", err)
+	}
+	if err := initializer.RegisterBeforeAddFriends(BeforeAddFriends); err != nil {
+		return fmt.Errorf("failed to register AddFriends before hook: %v", err)
+	}
+	if err := initializer.RegisterAfterAddFriends(AfterAddFriends); err != nil {
+		return fmt.Errorf("failed to register AddFriends after hook: %v", err)
+	}
+	logger.Info("Friend RPC functions registered: send_friend_request, respond_friend_request, get_privacy_settings, update_privacy_settings, AddFriends hooks")
+
+	// Register chat export
+	if err := initializer.RegisterRpc("export_chat", RpcExportChat); err != nil {
+		return fmt.Errorf("failed to register export_chat RPC: %v", err)
+	}
+	StartExportCleanup(logger)
+	logger.Info("Export RPC function registered: export_chat")
+
+	// Register account deletion functions
+	if err := initializer.RegisterRpc("request_account_deletion", RpcRequestAccountDeletion); err != nil {
+		return fmt.Errorf("failed to register request_account_deletion RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("get_account_deletion_status", RpcGetAccountDeletionStatus); err != nil {
+		return fmt.Errorf("failed to register get_account_deletion_status RPC: %v", err)
+	}
+	StartAccountDeletionWorker(logger, db, nk)
+	logger.Info("Account deletion RPC functions registered: request_account_deletion, get_account_deletion_status")
+
+	// Register audit log functions
+	if err := InitializeAuditLog(ctx, db); err != nil {
+		logger.Error("Audit log disabled: %v", err)
+	}
+	if err := initializer.RegisterRpc("query_audit_log", RpcQueryAuditLog); err != nil {
+		return fmt.Errorf("failed to register query_audit_log RPC: %v", err)
+	}
+	logger.Info("Audit log RPC function registered: query_audit_log")
+
+	// Register server config function
+	if err := initializer.RegisterRpc("get_server_config", RpcGetServerConfig); err != nil {
+		return fmt.Errorf("failed to register get_server_config RPC: %v", err)
+	}
+	logger.Info("Server config RPC function registered: get_server_config")
+
+	// Register malware incident functions
+	if err := initializer.RegisterRpc("list_malware_incidents", RpcListMalwareIncidents); err != nil {
+		return fmt.Errorf("failed to register list_malware_incidents RPC: %v", err)
+	}
+	logger.Info("Malware RPC function registered: list_malware_incidents")
+
+	// Register image variant function
+	if err := initializer.RegisterRpc("get_image_variant", services.RpcGetImageVariant); err != nil {
+		return fmt.Errorf("failed to register get_image_variant RPC: %v", err)
+	}
+	logger.Info("Image variant RPC function registered: get_image_variant")
+
+	// Register translation functions
+	if err := initializer.RegisterRpc("translate_message", RpcTranslateMessage); err != nil {
+		return fmt.Errorf("failed to register translate_message RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("set_translation_language", RpcSetTranslationLanguage); err != nil {
+		return fmt.Errorf("failed to register set_translation_language RPC: %v", err)
+	}
+	logger.Info("Translation RPC functions registered: translate_message, set_translation_language")
+
+	// Register broadcast channel functions
+	if err := initializer.RegisterRpc("create_broadcast_channel", RpcCreateBroadcastChannel); err != nil {
+		return fmt.Errorf("failed to register create_broadcast_channel RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("set_broadcast_publishers", RpcSetBroadcastPublishers); err != nil {
+		return fmt.Errorf("failed to register set_broadcast_publishers RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("list_broadcast_channels", RpcListBroadcastChannels); err != nil {
+		return fmt.Errorf("failed to register list_broadcast_channels RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("broadcast_announcement", RpcBroadcastAnnouncement); err != nil {
+		return fmt.Errorf("failed to register broadcast_announcement RPC: %v", err)
+	}
+	logger.Info("Broadcast RPC functions registered: create_broadcast_channel, set_broadcast_publishers, list_broadcast_channels, broadcast_announcement")
+
+	// Register activity stats function
+	if err := initializer.RegisterRpc("get_my_stats", RpcGetMyStats); err != nil {
+		return fmt.Errorf("failed to register get_my_stats RPC: %v", err)
+	}
+	logger.Info("Activity RPC function registered: get_my_stats")
+
+	// Register draft functions
+	if err := initializer.RegisterRpc("save_draft", RpcSaveDraft); err != nil {
+		return fmt.Errorf("failed to register save_draft RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("get_drafts", RpcGetDrafts); err != nil {
+		return fmt.Errorf("failed to register get_drafts RPC: %v", err)
+	}
+	logger.Info("Draft RPC functions registered: save_draft, get_drafts")
+
+	// Register invite link functions
+	if err := initializer.RegisterRpc("create_invite_link", RpcCreateInviteLink); err != nil {
+		return fmt.Errorf("failed to register create_invite_link RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("revoke_invite_link", RpcRevokeInviteLink); err != nil {
+		return fmt.Errorf("failed to register revoke_invite_link RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("join_via_invite", RpcJoinViaInvite); err != nil {
+		return fmt.Errorf("failed to register join_via_invite RPC: %v", err)
+	}
+	logger.Info("Invite link RPC functions registered: create_invite_link, revoke_invite_link, join_via_invite")
+
+	// Register spam filter function
+	if err := initializer.RegisterRpc("unmute_user", RpcUnmuteUser); err != nil {
+		return fmt.Errorf("failed to register unmute_user RPC: %v", err)
+	}
+	logger.Info("Spam RPC function registered: unmute_user")
+
+	// Register notification preference functions
+	if err := initializer.RegisterRpc("set_notification_prefs", RpcSetNotificationPrefs); err != nil {
+		return fmt.Errorf("failed to register set_notification_prefs RPC: %v", err)
+	}
+	if err := initializer.RegisterRpc("get_notification_prefs", RpcGetNotificationPrefs); err != nil {
+		return fmt.Errorf("failed to register get_notification_prefs RPC: %v", err)
+	}
+	logger.Info("Notification preference RPC functions registered: set_notification_prefs, get_notification_prefs")
+
+	// Register image URL refresh
+	if err := initializer.RegisterRpc("refresh_image_urls", services.RpcRefreshImageUrls); err != nil {
+		return fmt.Errorf("failed to register refresh_image_urls RPC: %v", err)
+	}
+	logger.Info("Image URL RPC function registered: refresh_image_urls")
+
+	// Register multipart upload functions
+	if err := initializer.RegisterRpc("begin_multipart_upload", services.RpcBeginMultipartUpload); err != nil {
+		return fmt.Errorf("failed to register begin_multipart_upload RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("upload_part", services.RpcUploadPart); err != nil {
+		return fmt.Errorf("failed to register upload_part RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("complete_multipart_upload", services.RpcCompleteMultipartUpload); err != nil {
+		return fmt.Errorf("failed to register complete_multipart_upload RPC: %v", err)
+	}
+
+	if err := initializer.RegisterRpc("abort_multipart_upload", services.RpcAbortMultipartUpload); err != nil {
+		return fmt.Errorf("failed to register abort_multipart_upload RPC: %v", err)
+	}
+	logger.Info("Multipart upload RPC functions registered: begin_multipart_upload, upload_part, complete_multipart_upload, abort_multipart_upload")
+
+	// Register storage health check
+	if err := initializer.RegisterRpc("storage_health", RpcStorageHealth); err != nil {
+		return fmt.Errorf("failed to register storage_health RPC: %v", err)
+	}
+	logger.Info("Storage health RPC function registered: storage_health")
+
+	StartStorageHealthCheck(logger, nk)
+
+	// Register storage reload functions
+	if err := initializer.RegisterRpc("reload_storage_backend", RpcReloadStorageBackend); err != nil {
+		return fmt.Errorf("failed to register reload_storage_backend RPC: %v", err)
+	}
+	logger.Info("Storage reload RPC function registered: reload_storage_backend")
+
+	StartStorageReload(logger)
+
+	// Register orphan garbage collection
+	if err := initializer.RegisterRpc("run_orphan_gc", RpcRunOrphanGC); err != nil {
+		return fmt.Errorf("failed to register run_orphan_gc RPC: %v", err)
+	}
+
+	StartOrphanGC(logger, nk)
+	StartArchiveRollover(logger, db)
 	return nil
 }
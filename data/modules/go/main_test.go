@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRpcUploadImage(t *testing.T) {
+	image := testPNG(t)
+	tests := []struct {
+		name    string
+		env     map[string]string
+		setup   func(t *testing.T, h *testHarness)
+		userID  string
+		payload string
+		code    string
+	}{
+		{name: "ok", userID: testOwnerID, payload: uploadPayload(image, "image/png", "photo.png")},
+		{name: "server upload", payload: uploadPayload(image, "image/png", "photo.png")},
+		{name: "bad json", userID: testOwnerID, payload: `{"imageData":`, code: ERROR_CODE_PAYLOAD_INVALID},
+		{name: "missing fields", userID: testOwnerID, payload: `{"contentType":"image/png"}`, code: ERROR_CODE_PAYLOAD_INVALID},
+		{name: "bad base64", userID: testOwnerID, payload: `{"imageData":"!!!!","contentType":"image/png","fileName":"a.png"}`, code: ERROR_CODE_PAYLOAD_INVALID},
+		{
+			name:    "over inline limit",
+			env:     map[string]string{"INLINE_UPLOAD_MAX_BYTES": "16"},
+			userID:  testOwnerID,
+			payload: uploadPayload(image, "image/png", "photo.png"),
+			code:    ERROR_CODE_PAYLOAD_TOO_LARGE,
+		},
+		{name: "content mismatch", userID: testOwnerID, payload: uploadPayload(image, "image/jpeg", "photo.jpg"), code: ERROR_CODE_REJECTED},
+		{
+			name:    "quota exceeded",
+			env:     map[string]string{"UPLOAD_DAILY_QUOTA_BYTES": "10"},
+			userID:  testOwnerID,
+			payload: uploadPayload(image, "image/png", "photo.png"),
+			code:    ERROR_CODE_UPLOAD_QUOTA_EXCEEDED,
+		},
+		{
+			name: "storage unavailable",
+			setup: func(t *testing.T, h *testHarness) {
+				h.services.Storage = fixedStorage{err: errors.New("no credentials")}
+			},
+			userID:  testOwnerID,
+			payload: uploadPayload(image, "image/png", "photo.png"),
+			code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+		},
+		{
+			name:    "bucket unavailable",
+			setup:   func(t *testing.T, h *testHarness) { h.s3.failures["EnsureBucket"] = errors.New("access denied") },
+			userID:  testOwnerID,
+			payload: uploadPayload(image, "image/png", "photo.png"),
+			code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+		},
+		{
+			name:    "put fails",
+			setup:   func(t *testing.T, h *testHarness) { h.s3.failures["PutObject"] = errors.New("connection reset") },
+			userID:  testOwnerID,
+			payload: uploadPayload(image, "image/png", "photo.png"),
+			code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+		},
+		{
+			name:    "presign fails",
+			setup:   func(t *testing.T, h *testHarness) { h.s3.failures["PresignGet"] = errors.New("clock skew") },
+			userID:  testOwnerID,
+			payload: uploadPayload(image, "image/png", "photo.png"),
+			code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+		},
+		{
+			name:    "quota write fails",
+			setup:   func(t *testing.T, h *testHarness) { h.nk.writeErr = errors.New("database is down") },
+			userID:  testOwnerID,
+			payload: uploadPayload(image, "image/png", "photo.png"),
+			code:    ERROR_CODE_INTERNAL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHarness(t, tt.env)
+			if tt.setup != nil {
+				tt.setup(t, h)
+			}
+			out := h.call(t, h.services.RpcUploadImage, tt.userID, tt.payload)
+			assertGolden(t, out)
+
+			success, code := decodeResponse(t, out)
+			if success != (tt.code == "") || code != tt.code {
+				t.Fatalf("success = %v, code = %q, want code %q", success, code, tt.code)
+			}
+			if !success {
+				return
+			}
+			owner := tt.userID
+			if owner == "" {
+				owner = "anonymous"
+			}
+			objectKey := uploadObjectKey(owner, testNow, "photo.png", "image/png")
+			if stored := h.s3.object(h.services.Config.Bucket, objectKey); !bytes.Equal(stored, image) {
+				t.Errorf("stored %d bytes under %s, want the %d uploaded", len(stored), objectKey, len(image))
+			}
+			if tt.userID != "" {
+				attachment := h.nk.attachment(t, tt.userID, objectKey)
+				if attachment == nil || attachment.CreatedAt != testNow.Unix() || attachment.Size != int64(len(image)) {
+					t.Errorf("attachment = %+v, want one created at %d of %d bytes", attachment, testNow.Unix(), len(image))
+				}
+			}
+		})
+	}
+}
+
+func TestRpcUploadImageDeduplicates(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"UPLOAD_DEDUP_ENABLED": "true"})
+	image := testPNG(t)
+
+	first := h.call(t, h.services.RpcUploadImage, testOwnerID, uploadPayload(image, "image/png", "photo.png"))
+	h.clock.Advance(time.Minute)
+	second := h.call(t, h.services.RpcUploadImage, testOwnerID, uploadPayload(image, "image/png", "again.png"))
+	assertGolden(t, second)
+
+	if success, code := decodeResponse(t, first); !success {
+		t.Fatalf("first upload failed with %s: %s", code, first)
+	}
+	again := uploadObjectKey(testOwnerID, h.clock.Now(), "again.png", "image/png")
+	if h.s3.object(h.services.Config.Bucket, again) != nil {
+		t.Errorf("duplicate was stored again under %s", again)
+	}
+}
+
+// testWebP returns a lossless WebP header for a width x height image. Go cannot decode it,
+// which is what the pixel stages have to cope with.
+func testWebP(width, height int) []byte {
+	chunk := make([]byte, 10)
+	chunk[0] = 0x2F
+	binary.LittleEndian.PutUint32(chunk[1:5], uint32(width-1)|uint32(height-1)<<14)
+	data := []byte("RIFF\x00\x00\x00\x00WEBPVP8L")
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(chunk)))
+	data = append(data, chunk...)
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-8))
+	return data
+}
+
+func TestRpcUploadImageWebP(t *testing.T) {
+	h := newTestHarness(t, map[string]string{
+		"IMAGE_PIPELINE":      "exif_strip,resize,blurhash,thumbnails",
+		"IMAGE_MAX_DIMENSION": "16",
+	})
+	previousPipelines := imagePipelines
+	t.Cleanup(func() { imagePipelines = previousPipelines })
+	if err := LoadImagePipelines(h.logger); err != nil {
+		t.Fatalf("LoadImagePipelines failed: %v", err)
+	}
+	image := testWebP(64, 48)
+
+	out := h.call(t, h.services.RpcUploadImage, testOwnerID, uploadPayload(image, "image/webp", "photo.webp"))
+	assertGolden(t, out)
+
+	if success, code := decodeResponse(t, out); !success {
+		t.Fatalf("upload failed with %s: %s", code, out)
+	}
+	objectKey := uploadObjectKey(testOwnerID, testNow, "photo.webp", "image/webp")
+	if stored := h.s3.object(h.services.Config.Bucket, objectKey); !bytes.Equal(stored, image) {
+		t.Errorf("stored %d bytes under %s, want the %d uploaded unchanged", len(stored), objectKey, len(image))
+	}
+	if strings.Contains(out, THUMBNAIL_PREFIX) {
+		t.Errorf("thumbnails were rendered for a WebP: %s", out)
+	}
+}
+
+func TestRpcUploadImageResizesGIF(t *testing.T) {
+	h := newTestHarness(t, map[string]string{"IMAGE_PIPELINE": "resize", "IMAGE_MAX_DIMENSION": "2"})
+	previousPipelines := imagePipelines
+	t.Cleanup(func() { imagePipelines = previousPipelines })
+	if err := LoadImagePipelines(h.logger); err != nil {
+		t.Fatalf("LoadImagePipelines failed: %v", err)
+	}
+	var original bytes.Buffer
+	if err := gif.Encode(&original, image.NewPaletted(image.Rect(0, 0, 4, 3), palette.Plan9), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out := h.call(t, h.services.RpcUploadImage, testOwnerID, uploadPayload(original.Bytes(), "image/gif", "photo.gif"))
+	if success, code := decodeResponse(t, out); !success {
+		t.Fatalf("upload failed with %s: %s", code, out)
+	}
+	// The key keeps .gif, so the resized copy has to stay a GIF
+	objectKey := uploadObjectKey(testOwnerID, testNow, "photo.gif", "image/gif")
+	stored := h.s3.object(h.services.Config.Bucket, objectKey)
+	config, format, err := image.DecodeConfig(bytes.NewReader(stored))
+	if err != nil || format != "gif" || config.Width != 2 {
+		t.Errorf("stored %s as %q %dx%d (%v), want a 2px wide gif", objectKey, format, config.Width, config.Height, err)
+	}
+}
+
+func TestRpcGetImageUrl(t *testing.T) {
+	objectKey := testOwnerID + "/1710072000000_photo.png"
+	tests := []struct {
+		name    string
+		env     map[string]string
+		setup   func(t *testing.T, h *testHarness)
+		userID  string
+		payload string
+		code    string
+	}{
+		{name: "ok", userID: testOwnerID, payload: `{"objectKey":"` + objectKey + `"}`},
+		{name: "bad json", userID: testOwnerID, payload: `[`, code: ERROR_CODE_PAYLOAD_INVALID},
+		{name: "missing key", userID: testOwnerID, payload: `{}`, code: ERROR_CODE_PAYLOAD_INVALID},
+		{
+			name: "deleted",
+			setup: func(t *testing.T, h *testHarness) {
+				h.saveAttachment(t, &Attachment{OwnerID: testOwnerID, ObjectKey: objectKey, DeletedAt: testNow.Unix(), DeletedBy: testOwnerID})
+			},
+			userID:  testOwnerID,
+			payload: `{"objectKey":"` + objectKey + `"}`,
+			code:    ERROR_CODE_NOT_FOUND,
+		},
+		{name: "quarantined", userID: testOwnerID, payload: `{"objectKey":"` + QUARANTINE_PREFIX + objectKey + `"}`, code: ERROR_CODE_PERMISSION_DENIED},
+		{
+			name: "private to another user",
+			env:  map[string]string{"STORAGE_ACCESS_MODE": STORAGE_ACCESS_PRIVATE},
+			setup: func(t *testing.T, h *testHarness) {
+				h.saveAttachment(t, &Attachment{OwnerID: testOwnerID, ObjectKey: objectKey})
+			},
+			userID:  testOtherID,
+			payload: `{"objectKey":"` + objectKey + `"}`,
+			code:    ERROR_CODE_PERMISSION_DENIED,
+		},
+		{
+			name: "storage unavailable",
+			setup: func(t *testing.T, h *testHarness) {
+				h.services.Storage = fixedStorage{err: errors.New("no credentials")}
+			},
+			userID:  testOwnerID,
+			payload: `{"objectKey":"` + objectKey + `"}`,
+			code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+		},
+		{
+			name:    "presign fails",
+			setup:   func(t *testing.T, h *testHarness) { h.s3.failures["PresignGet"] = errors.New("clock skew") },
+			userID:  testOwnerID,
+			payload: `{"objectKey":"` + objectKey + `"}`,
+			code:    ERROR_CODE_STORAGE_UNAVAILABLE,
+		},
+		{
+			name: "batch",
+			setup: func(t *testing.T, h *testHarness) {
+				h.saveAttachment(t, &Attachment{OwnerID: testOwnerID, ObjectKey: testOwnerID + "/gone.png", DeletedAt: testNow.Unix()})
+			},
+			userID:  testOwnerID,
+			payload: `{"objectKeys":["` + objectKey + `","` + objectKey + `","` + testOwnerID + `/gone.png","` + QUARANTINE_PREFIX + objectKey + `"]}`,
+		},
+		{name: "empty batch", userID: testOwnerID, payload: `{"objectKeys":[]}`, code: ERROR_CODE_PAYLOAD_INVALID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHarness(t, tt.env)
+			h.s3.seed(t, h.services.Config.Bucket, objectKey, testPNG(t))
+			if tt.setup != nil {
+				tt.setup(t, h)
+			}
+			out := h.call(t, h.services.RpcGetImageUrl, tt.userID, tt.payload)
+			assertGolden(t, out)
+
+			if success, code := decodeResponse(t, out); success != (tt.code == "") || code != tt.code {
+				t.Errorf("success = %v, code = %q, want code %q", success, code, tt.code)
+			}
+		})
+	}
+}
+
+func TestRpcGetImageUrlReusesFreshURLs(t *testing.T) {
+	h := newTestHarness(t, nil)
+	objectKey := testOwnerID + "/1710072000000_photo.png"
+	payload := `{"objectKey":"` + objectKey + `"}`
+	expiry := h.services.Config.imageURLExpiry()
+
+	first := h.call(t, h.services.RpcGetImageUrl, testOwnerID, payload)
+	h.clock.Advance(expiry / 4)
+	if again := h.call(t, h.services.RpcGetImageUrl, testOwnerID, payload); again != first {
+		t.Errorf("URL was not reused while fresh:\n%s\n%s", first, again)
+	}
+
+	// A node that restarted still finds the URL in storage
+	imageURLs = &imageURLCache{entries: map[string]*IssuedURL{}}
+	if again := h.call(t, h.services.RpcGetImageUrl, testOwnerID, payload); again != first {
+		t.Errorf("URL was not reused from storage:\n%s\n%s", first, again)
+	}
+
+	h.clock.Advance(expiry / 2)
+	if again := h.call(t, h.services.RpcGetImageUrl, testOwnerID, payload); again == first {
+		t.Errorf("URL with less than half its lifetime left was reused: %s", again)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	MALWARE_INCIDENT_COLLECTION = "malware_incidents"
+	MALWARE_SCAN_TIMEOUT        = 60 * time.Second
+	MALWARE_LIST_DEFAULT_LIMIT  = 50
+	MALWARE_LIST_MAX_LIMIT      = 100
+	ERROR_CODE_UPLOAD_INFECTED  = "UPLOAD_INFECTED"
+	CLAMD_DEFAULT_ADDRESS       = "clamav:3310"
+	// CLAMD_CHUNK_BYTES is the size of the INSTREAM chunks sent to clamd
+	CLAMD_CHUNK_BYTES = 64 * 1024
+)
+
+// ScanVerdict is a scanner's opinion of an upload
+type ScanVerdict struct {
+	Infected  bool
+	Signature string
+}
+
+// MalwareScanner checks upload bytes for malware. Scan reads data to the end.
+type MalwareScanner interface {
+	Name() string
+	Scan(ctx context.Context, data io.Reader) (*ScanVerdict, error)
+}
+
+// MALWARE_SCANNERS maps the MALWARE_SCANNER values to their constructors
+var MALWARE_SCANNERS = map[string]func() (MalwareScanner, error){
+	"clamav": newClamdScanner,
+}
+
+// malwareScanner is the configured scanner, nil when scanning is off
+var malwareScanner MalwareScanner
+
+// MalwareIncident is the record written when an infected upload is rejected. The file itself is not kept.
+type MalwareIncident struct {
+	IncidentID  string `json:"incidentId"`
+	OwnerID     string `json:"ownerId,omitempty"`
+	ObjectKey   string `json:"objectKey"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	ChannelID   string `json:"channelId,omitempty"`
+	Scanner     string `json:"scanner"`
+	Signature   string `json:"signature"`
+	CreatedAt   int64  `json:"createdAt"`
+}
+
+// MalwareError is returned when an upload was rejected as infected
+type MalwareError struct {
+	Incident *MalwareIncident
+}
+
+func (e *MalwareError) Error() string { return "File was rejected by the malware scanner" }
+
+// MalwareIncidentListResponse represents the response for list_malware_incidents
+type MalwareIncidentListResponse struct {
+	Success   bool               `json:"success"`
+	Incidents []*MalwareIncident `json:"incidents,omitempty"`
+	Cursor    string             `json:"cursor,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	Code      string             `json:"code,omitempty"`
+}
+
+// InitializeMalwareScanner builds the scanner named by MALWARE_SCANNER, leaving scanning off when it is empty
+func InitializeMalwareScanner(logger nkruntime.Logger) error {
+	name := serverConfig.MalwareScanner
+	if name == "" {
+		logger.Info("Malware scanning disabled")
+		return nil
+	}
+	factory, ok := MALWARE_SCANNERS[name]
+	if !ok {
+		return fmt.Errorf("unknown MALWARE_SCANNER: %s", name)
+	}
+	scanner, err := factory()
+	if err != nil {
+		return err
+	}
+	malwareScanner = scanner
+	logger.Info("Malware scanning enabled with %s", name)
+	return nil
+}
+
+// scanUpload runs an upload through the malware scanner before it is kept. Infected uploads are recorded as
+// an incident and answered with a *MalwareError. When the scanner fails the upload is refused, unless
+// MALWARE_SCAN_FAIL_OPEN lets it through unscanned.
+func scanUpload(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, incident *MalwareIncident, data io.Reader) error {
+	if malwareScanner == nil {
+		return nil
+	}
+	verdict, err := malwareScanner.Scan(ctx, data)
+	if err != nil {
+		if serverConfig.MalwareScanFailOpen {
+			logger.Warn("Malware scan of %s failed, storing it unscanned: %v", incident.ObjectKey, err)
+			return nil
+		}
+		logger.Error("Malware scan of %s failed: %v", incident.ObjectKey, err)
+		return fmt.Errorf("Failed to scan upload for malware")
+	}
+	if !verdict.Infected {
+		return nil
+	}
+
+	incident.IncidentID = uuid.New().String()
+	incident.Scanner = malwareScanner.Name()
+	incident.Signature = verdict.Signature
+	incident.CreatedAt = time.Now().Unix()
+	value, _ := json.Marshal(incident)
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      MALWARE_INCIDENT_COLLECTION,
+		Key:             incident.IncidentID,
+		Value:           string(value),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		logger.Error("Failed to record malware incident for %s: %v", incident.ObjectKey, err)
+	}
+
+	logger.Warn("Rejected infected upload %s from %s: %s", incident.ObjectKey, incident.OwnerID, incident.Signature)
+	publishEvent(WEBHOOK_EVENT_UPLOAD_INFECTED, incident)
+	return &MalwareError{Incident: incident}
+}
+
+// scanStoredUpload scans a presigned upload, which reaches storage before the server sees it. Infected and
+// unscannable objects are removed together with their pending record.
+func (s *Services) scanStoredUpload(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, userID string, pending *PendingUpload, info *StoredObject) error {
+	// Ciphertext cannot be scanned, and the server must not be able to read it anyway
+	if malwareScanner == nil || pending.Envelope != nil {
+		return nil
+	}
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return fmt.Errorf("Failed to initialize storage backend: %v", err)
+	}
+	object, err := backend.GetObject(ctx, s.Config.bucketForKey(pending.ObjectKey), pending.ObjectKey)
+	if err != nil {
+		return fmt.Errorf("Failed to read upload: %v", err)
+	}
+	defer object.Close()
+
+	err = scanUpload(ctx, logger, nk, &MalwareIncident{
+		OwnerID:     userID,
+		ObjectKey:   pending.ObjectKey,
+		ContentType: pending.ContentType,
+		Size:        info.Size,
+		ChannelID:   pending.ChannelID,
+	}, object)
+	if err != nil {
+		s.rejectPendingUpload(ctx, logger, nk, userID, pending)
+	}
+	return err
+}
+
+// clamdScanner streams uploads to a ClamAV daemon over TCP with the INSTREAM command
+type clamdScanner struct {
+	address string
+}
+
+func newClamdScanner() (MalwareScanner, error) {
+	if serverConfig.ClamdAddress == "" {
+		return nil, fmt.Errorf("CLAMD_ADDRESS is not set")
+	}
+	return &clamdScanner{address: serverConfig.ClamdAddress}, nil
+}
+
+func (c *clamdScanner) Name() string { return "clamav" }
+
+func (c *clamdScanner) Scan(ctx context.Context, data io.Reader) (*ScanVerdict, error) {
+	ctx, cancel := context.WithTimeout(ctx, MALWARE_SCAN_TIMEOUT)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, fmt.Errorf("clamd unavailable: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Each chunk is prefixed with its length as a 4 byte big endian integer, a zero length ends the stream
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("failed to send to clamd: %v", err)
+	}
+	chunk := make([]byte, 4+CLAMD_CHUNK_BYTES)
+	for {
+		n, err := io.ReadFull(data, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				// clamd closes the stream once it goes over StreamMaxLength; its reply says so
+				return nil, c.reply(conn, fmt.Errorf("failed to send to clamd: %v", err))
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upload: %v", err)
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, fmt.Errorf("failed to send to clamd: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return nil, fmt.Errorf("failed to read clamd reply: %v", err)
+	}
+	// Replies are "stream: OK", "stream: <signature> FOUND" or "<reason> ERROR"
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		return &ScanVerdict{Infected: true, Signature: strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")}, nil
+	case reply == "stream: OK":
+		return &ScanVerdict{}, nil
+	}
+	return nil, fmt.Errorf("clamd: %s", reply)
+}
+
+// reply returns the error clamd reported before closing the connection, or err when it said nothing
+func (c *clamdScanner) reply(conn net.Conn, err error) error {
+	reply, _ := bufio.NewReader(conn).ReadString(0)
+	if reply = strings.TrimSpace(strings.TrimRight(reply, "\x00")); reply != "" {
+		return fmt.Errorf("clamd: %s", reply)
+	}
+	return err
+}
+
+// RpcListMalwareIncidents pages through the records of rejected infected uploads (admin only)
+func RpcListMalwareIncidents(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(MalwareIncidentListResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		Limit  int    `json:"limit"`
+		Cursor string `json:"cursor"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(MalwareIncidentListResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.Limit <= 0 {
+		request.Limit = MALWARE_LIST_DEFAULT_LIMIT
+	}
+	if request.Limit > MALWARE_LIST_MAX_LIMIT {
+		request.Limit = MALWARE_LIST_MAX_LIMIT
+	}
+
+	objects, cursor, err := nk.StorageList(ctx, "", "", MALWARE_INCIDENT_COLLECTION, request.Limit, request.Cursor)
+	if err != nil {
+		return marshalResponse(MalwareIncidentListResponse{Success: false, Error: fmt.Sprintf("Failed to list malware incidents: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	incidents := make([]*MalwareIncident, 0, len(objects))
+	for _, object := range objects {
+		var incident MalwareIncident
+		if err := json.Unmarshal([]byte(object.Value), &incident); err != nil {
+			logger.Warn("Skipping unreadable malware incident %s: %v", object.Key, err)
+			continue
+		}
+		incidents = append(incidents, &incident)
+	}
+
+	return marshalResponse(MalwareIncidentListResponse{Success: true, Incidents: incidents, Cursor: cursor})
+}
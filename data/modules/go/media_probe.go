@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	// MEDIA_PROBE_MAX_HEADER bounds how much container metadata is read into memory
+	MEDIA_PROBE_MAX_HEADER = 16 * 1024 * 1024
+)
+
+var errMediaUnsupported = errors.New("unsupported or corrupt media container")
+
+// MediaInfo is what the container probes extract without decoding any frames
+type MediaInfo struct {
+	Container  string
+	Duration   time.Duration
+	VideoCodec string
+	AudioCodec string
+	Width      int
+	Height     int
+	// Frames is the packet timeline of the audio track, only filled for audio content types
+	Frames []audioFrame
+}
+
+// MP4 sample entry fourccs mapped to codec names
+var mp4Codecs = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"vp08": "vp8",
+	"vp09": "vp9",
+	"av01": "av1",
+	"mp4a": "aac",
+	"Opus": "opus",
+}
+
+// Matroska codec IDs mapped to codec names
+var webmCodecs = map[string]string{
+	"V_VP8":    "vp8",
+	"V_VP9":    "vp9",
+	"V_AV1":    "av1",
+	"A_OPUS":   "opus",
+	"A_VORBIS": "vorbis",
+}
+
+// probeMedia reads container metadata for the given content type
+func probeMedia(r io.ReadSeeker, contentType string) (*MediaInfo, error) {
+	switch contentType {
+	case "video/mp4":
+		return probeMP4(r)
+	case "video/webm":
+		return probeWebM(r)
+	case "audio/mp4", "audio/m4a", "audio/x-m4a":
+		return probeMP4(r)
+	case "audio/ogg", "audio/opus":
+		return probeOggOpus(r)
+	case "audio/aac", "audio/aacp":
+		return probeADTS(r)
+	}
+	return nil, fmt.Errorf("no probe for content type %s", contentType)
+}
+
+// probeMP4 walks the top-level ISO BMFF boxes to the moov box, which may sit at either end of the file
+func probeMP4(r io.ReadSeeker) (*MediaInfo, error) {
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			if err == io.EOF {
+				return nil, errMediaUnsupported
+			}
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		headerLen := int64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(r, header[8:16]); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerLen = 16
+		}
+		if size != 0 && size < headerLen {
+			return nil, errMediaUnsupported
+		}
+
+		if boxType == "moov" {
+			if size == 0 || size-headerLen > MEDIA_PROBE_MAX_HEADER {
+				return nil, errMediaUnsupported
+			}
+			moov := make([]byte, size-headerLen)
+			if _, err := io.ReadFull(r, moov); err != nil {
+				return nil, err
+			}
+			return parseMP4Moov(moov)
+		}
+		if size == 0 {
+			return nil, errMediaUnsupported
+		}
+		if _, err := r.Seek(size-headerLen, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// mp4Boxes splits a buffer into its child boxes
+func mp4Boxes(data []byte, fn func(boxType string, body []byte) error) error {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data[:4]))
+		boxType := string(data[4:8])
+		headerLen := 8
+		if size == 1 {
+			if len(data) < 16 {
+				return errMediaUnsupported
+			}
+			size = int(binary.BigEndian.Uint64(data[8:16]))
+			headerLen = 16
+		} else if size == 0 {
+			size = len(data)
+		}
+		if size < headerLen || size > len(data) {
+			return errMediaUnsupported
+		}
+		if err := fn(boxType, data[headerLen:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+func parseMP4Moov(moov []byte) (*MediaInfo, error) {
+	info := &MediaInfo{Container: "mp4"}
+	err := mp4Boxes(moov, func(boxType string, body []byte) error {
+		switch boxType {
+		case "mvhd":
+			duration, err := parseMP4Mvhd(body)
+			if err != nil {
+				return err
+			}
+			info.Duration = duration
+		case "trak":
+			return parseMP4Trak(body, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func parseMP4Mvhd(body []byte) (time.Duration, error) {
+	if len(body) < 20 {
+		return 0, errMediaUnsupported
+	}
+	var timescale, duration uint64
+	if body[0] == 1 {
+		if len(body) < 32 {
+			return 0, errMediaUnsupported
+		}
+		timescale = uint64(binary.BigEndian.Uint32(body[20:24]))
+		duration = binary.BigEndian.Uint64(body[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(body[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(body[16:20]))
+	}
+	if timescale == 0 {
+		return 0, errMediaUnsupported
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+}
+
+// parseMP4Trak reads the handler and first sample entry of a track (trak > mdia > hdlr, minf > stbl > stsd),
+// plus the sample table of sound tracks
+func parseMP4Trak(trak []byte, info *MediaInfo) error {
+	var handler string
+	var entry []byte
+	var entryType string
+	var timescale uint32
+	var stts, stsz []byte
+	err := mp4Boxes(trak, func(boxType string, body []byte) error {
+		if boxType != "mdia" {
+			return nil
+		}
+		return mp4Boxes(body, func(boxType string, body []byte) error {
+			switch boxType {
+			case "hdlr":
+				if len(body) >= 12 {
+					handler = string(body[8:12])
+				}
+			case "mdhd":
+				if len(body) >= 24 && body[0] == 1 {
+					timescale = binary.BigEndian.Uint32(body[20:24])
+				} else if len(body) >= 16 {
+					timescale = binary.BigEndian.Uint32(body[12:16])
+				}
+			case "minf":
+				return mp4Boxes(body, func(boxType string, body []byte) error {
+					if boxType != "stbl" {
+						return nil
+					}
+					return mp4Boxes(body, func(boxType string, body []byte) error {
+						switch boxType {
+						case "stts":
+							stts = body
+						case "stsz":
+							stsz = body
+						}
+						// stsd is a full box followed by an entry count, then the sample entries
+						if boxType != "stsd" || len(body) < 8 {
+							return nil
+						}
+						return mp4Boxes(body[8:], func(boxType string, body []byte) error {
+							if entryType == "" {
+								entryType, entry = boxType, body
+							}
+							return nil
+						})
+					})
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	codec, ok := mp4Codecs[entryType]
+	if !ok {
+		codec = entryType
+	}
+	switch handler {
+	case "vide":
+		if info.VideoCodec != "" {
+			return nil
+		}
+		info.VideoCodec = codec
+		// Visual sample entries carry the coded width and height after 24 bytes of reserved fields
+		if len(entry) >= 28 {
+			info.Width = int(binary.BigEndian.Uint16(entry[24:26]))
+			info.Height = int(binary.BigEndian.Uint16(entry[26:28]))
+		}
+	case "soun":
+		if info.AudioCodec == "" {
+			info.AudioCodec = codec
+			info.Frames = mp4AudioFrames(timescale, stts, stsz)
+		}
+	}
+	return nil
+}
+
+// Matroska element IDs used by the WebM probe
+const (
+	ebmlIDHeader        = 0x1A45DFA3
+	ebmlIDDocType       = 0x4282
+	ebmlIDSegment       = 0x18538067
+	ebmlIDInfo          = 0x1549A966
+	ebmlIDTimecodeScale = 0x2AD7B1
+	ebmlIDDuration      = 0x4489
+	ebmlIDTracks        = 0x1654AE6B
+	ebmlIDTrackEntry    = 0xAE
+	ebmlIDTrackType     = 0x83
+	ebmlIDCodecID       = 0x86
+	ebmlIDVideo         = 0xE0
+	ebmlIDPixelWidth    = 0xB0
+	ebmlIDPixelHeight   = 0xBA
+	ebmlIDCluster       = 0x1F43B675
+)
+
+// ebmlUnknownSize marks an element whose size was not known when it was written (live recordings)
+const ebmlUnknownSize = -1
+
+// readEBMLVint reads a variable length integer; keepMarker keeps the length bit as element IDs do
+func readEBMLVint(r io.ByteReader, keepMarker bool) (int64, int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	mask := byte(0x80)
+	for length <= 8 && first&mask == 0 {
+		length++
+		mask >>= 1
+	}
+	if length > 8 {
+		return 0, 0, errMediaUnsupported
+	}
+	value := int64(first)
+	if !keepMarker {
+		value = int64(first & (mask - 1))
+	}
+	allOnes := value == int64(mask-1)
+	for i := 1; i < length; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		value = value<<8 | int64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return ebmlUnknownSize, length, nil
+	}
+	return value, length, nil
+}
+
+// ebmlElements iterates the elements of an in-memory master element body
+func ebmlElements(data []byte, fn func(id int64, body []byte) error) error {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		id, _, err := readEBMLVint(r, true)
+		if err != nil {
+			return errMediaUnsupported
+		}
+		size, _, err := readEBMLVint(r, false)
+		if err != nil || size == ebmlUnknownSize || size > int64(r.Len()) {
+			return errMediaUnsupported
+		}
+		body := data[len(data)-r.Len() : len(data)-r.Len()+int(size)]
+		if err := fn(id, body); err != nil {
+			return err
+		}
+		r.Seek(size, io.SeekCurrent)
+	}
+	return nil
+}
+
+func ebmlUint(body []byte) uint64 {
+	var v uint64
+	for _, b := range body {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func ebmlFloat(body []byte) float64 {
+	switch len(body) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(body)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(body))
+	}
+	return 0
+}
+
+// probeWebM streams through the EBML header and segment until Info and Tracks have been read
+func probeWebM(rs io.ReadSeeker) (*MediaInfo, error) {
+	r := bufio.NewReader(rs)
+	info := &MediaInfo{Container: "webm"}
+	timecodeScale := uint64(1000000)
+	var duration float64
+	seenInfo, seenTracks := false, false
+
+	readBody := func(size int64) ([]byte, error) {
+		if size == ebmlUnknownSize || size > MEDIA_PROBE_MAX_HEADER {
+			return nil, errMediaUnsupported
+		}
+		body := make([]byte, size)
+		_, err := io.ReadFull(r, body)
+		return body, err
+	}
+
+	for !(seenInfo && seenTracks) {
+		id, _, err := readEBMLVint(r, true)
+		if err != nil {
+			break
+		}
+		size, _, err := readEBMLVint(r, false)
+		if err != nil {
+			return nil, errMediaUnsupported
+		}
+
+		switch id {
+		case ebmlIDHeader:
+			body, err := readBody(size)
+			if err != nil {
+				return nil, err
+			}
+			docType := ""
+			ebmlElements(body, func(id int64, body []byte) error {
+				if id == ebmlIDDocType {
+					docType = string(body)
+				}
+				return nil
+			})
+			if docType != "webm" && docType != "matroska" {
+				return nil, errMediaUnsupported
+			}
+		case ebmlIDSegment:
+			// Descend into the segment without consuming its body
+		case ebmlIDInfo:
+			body, err := readBody(size)
+			if err != nil {
+				return nil, err
+			}
+			err = ebmlElements(body, func(id int64, body []byte) error {
+				switch id {
+				case ebmlIDTimecodeScale:
+					timecodeScale = ebmlUint(body)
+				case ebmlIDDuration:
+					duration = ebmlFloat(body)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			seenInfo = true
+		case ebmlIDTracks:
+			body, err := readBody(size)
+			if err != nil {
+				return nil, err
+			}
+			if err := parseWebMTracks(body, info); err != nil {
+				return nil, err
+			}
+			seenTracks = true
+		case ebmlIDCluster:
+			// Media data starts here; metadata we have not seen yet is not coming
+			seenInfo, seenTracks = true, true
+		default:
+			if size == ebmlUnknownSize {
+				return nil, errMediaUnsupported
+			}
+			if _, err := r.Discard(int(size)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !seenTracks || (info.VideoCodec == "" && info.AudioCodec == "") {
+		return nil, errMediaUnsupported
+	}
+	info.Duration = time.Duration(duration * float64(timecodeScale))
+	return info, nil
+}
+
+func parseWebMTracks(body []byte, info *MediaInfo) error {
+	return ebmlElements(body, func(id int64, body []byte) error {
+		if id != ebmlIDTrackEntry {
+			return nil
+		}
+		var trackType uint64
+		var codecID string
+		var width, height int
+		err := ebmlElements(body, func(id int64, body []byte) error {
+			switch id {
+			case ebmlIDTrackType:
+				trackType = ebmlUint(body)
+			case ebmlIDCodecID:
+				codecID = string(bytes.TrimRight(body, "\x00"))
+			case ebmlIDVideo:
+				return ebmlElements(body, func(id int64, body []byte) error {
+					switch id {
+					case ebmlIDPixelWidth:
+						width = int(ebmlUint(body))
+					case ebmlIDPixelHeight:
+						height = int(ebmlUint(body))
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		codec, ok := webmCodecs[codecID]
+		if !ok {
+			codec = codecID
+		}
+		switch trackType {
+		case 1:
+			if info.VideoCodec == "" {
+				info.VideoCodec, info.Width, info.Height = codec, width, height
+			}
+		case 2:
+			if info.AudioCodec == "" {
+				info.AudioCodec = codec
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// MENTION_MAX caps the users notified per message so one message cannot page a whole room
+	MENTION_MAX               = 10
+	MENTION_PREVIEW_RUNES     = 100
+	NOTIFICATION_CODE_MENTION = 102
+)
+
+// mentionPattern matches @username at the start of the text or after a character that cannot be part of a username or e-mail
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@.])@([\w.\-]{1,128})`)
+
+// parseMentions returns the distinct usernames mentioned in text, in order of appearance
+func parseMentions(text string) []string {
+	var usernames []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		// A sentence can end right after a mention: "thanks @bob."
+		username := strings.TrimRight(match[1], ".-")
+		if username == "" || seen[strings.ToLower(username)] {
+			continue
+		}
+		seen[strings.ToLower(username)] = true
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
+
+// resolveMentions returns the IDs of the channel members mentioned in a message, excluding the sender
+func resolveMentions(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, message *SentMessage, content map[string]interface{}) []string {
+	var usernames []string
+	for _, field := range MESSAGE_TEXT_FIELDS {
+		if text, ok := content[field].(string); ok {
+			usernames = append(usernames, parseMentions(text)...)
+		}
+	}
+	if len(usernames) == 0 {
+		return nil
+	}
+	if len(usernames) > MENTION_MAX {
+		usernames = usernames[:MENTION_MAX]
+	}
+
+	users, err := nk.UsersGetUsername(ctx, usernames)
+	if err != nil {
+		logger.Warn("Failed to resolve mentions in message %s: %v", message.MessageID, err)
+		return nil
+	}
+
+	ids := make([]string, 0, len(users))
+	seen := make(map[string]bool)
+	for _, user := range users {
+		if user.Id == message.SenderID || seen[user.Id] {
+			continue
+		}
+		// Mentioning someone outside the channel must not leak the message to them
+		member, err := isChannelMember(ctx, nk, message.ChannelID, user.Id)
+		if err != nil || !member {
+			continue
+		}
+		if blocked, err := hasBlocked(ctx, nk, user.Id, message.SenderID); err != nil || blocked {
+			continue
+		}
+		seen[user.Id] = true
+		ids = append(ids, user.Id)
+	}
+	return ids
+}
+
+// notifyMentions is the sent-message hook that sends a notification to every channel member mentioned with @username
+func notifyMentions(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage) {
+	var content map[string]interface{}
+	if err := json.Unmarshal([]byte(message.Content), &content); err != nil {
+		return
+	}
+	mentioned := resolveMentions(ctx, logger, nk, message, content)
+	if len(mentioned) == 0 {
+		return
+	}
+
+	preview := messagePreview(content)
+	notifications := make([]*nkruntime.NotificationSend, 0, len(mentioned))
+	for _, id := range mentioned {
+		notifications = append(notifications, &nkruntime.NotificationSend{
+			UserID:  id,
+			Subject: fmt.Sprintf("%s mentioned you", message.Username),
+			Content: map[string]interface{}{
+				"channelId": message.ChannelID,
+				"messageId": message.MessageID,
+				"senderId":  message.SenderID,
+				"username":  message.Username,
+				"preview":   preview,
+			},
+			Code:       NOTIFICATION_CODE_MENTION,
+			Sender:     message.SenderID,
+			Persistent: true,
+		})
+	}
+	if err := nk.NotificationsSend(ctx, notifications); err != nil {
+		logger.Warn("Failed to send mention notifications for message %s: %v", message.MessageID, err)
+	}
+}
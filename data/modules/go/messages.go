@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/rtapi"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	MESSAGE_HISTORY_COLLECTION = "message_history"
+	MESSAGE_HISTORY_MAX_EDITS  = 50
+	MESSAGE_WRITE_ATTEMPTS     = 3
+	// NIL_UUID fills the stream subject and descriptor columns of room messages
+	NIL_UUID = "00000000-0000-0000-0000-000000000000"
+)
+
+// StoredMessage is the part of a persisted channel message needed to authorize edits
+type StoredMessage struct {
+	SenderID string
+	Username string
+	Content  string
+}
+
+// MessageRevision is one earlier version of an edited message
+type MessageRevision struct {
+	Content  string `json:"content"`
+	EditedAt int64  `json:"editedAt"`
+	EditedBy string `json:"editedBy"`
+}
+
+// MessageHistory is the audit record of a message's edits and deletion, keyed by message ID
+type MessageHistory struct {
+	ChannelID string            `json:"channelId"`
+	MessageID string            `json:"messageId"`
+	SenderID  string            `json:"senderId"`
+	Revisions []MessageRevision `json:"revisions"`
+	DeletedAt int64             `json:"deletedAt,omitempty"`
+	DeletedBy string            `json:"deletedBy,omitempty"`
+	// DeletedContent keeps the last content of a deleted message for moderators
+	DeletedContent string `json:"deletedContent,omitempty"`
+}
+
+// MessageResponse represents the response for edit_message and delete_message
+type MessageResponse struct {
+	Success   bool   `json:"success"`
+	MessageID string `json:"messageId,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// messageStreamColumns returns the stream subject and descriptor a channel's messages are stored under
+func messageStreamColumns(ref *ChannelRef) (string, string) {
+	subject, descriptor := ref.Subject, ref.Subcontext
+	if subject == "" {
+		subject = NIL_UUID
+	}
+	if descriptor == "" {
+		descriptor = NIL_UUID
+	}
+	return subject, descriptor
+}
+
+// readChannelMessage loads a persisted message of a channel, nil if there is none.
+// The runtime cannot fetch a single message, so this reads Nakama's message table directly.
+func readChannelMessage(ctx context.Context, db *sql.DB, channelID, messageID string) (*StoredMessage, error) {
+	ref, err := parseChannelID(channelID)
+	if err != nil {
+		return nil, err
+	}
+	subject, descriptor := messageStreamColumns(ref)
+
+	var message StoredMessage
+	err = db.QueryRowContext(ctx, `
+SELECT sender_id, username, content FROM message
+WHERE id = $1 AND stream_mode = $2 AND stream_subject = $3 AND stream_descriptor = $4 AND stream_label = $5`,
+		messageID, ref.Mode, subject, descriptor, ref.Label,
+	).Scan(&message.SenderID, &message.Username, &message.Content)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	return &message, nil
+}
+
+// canModerateChannel reports whether a user may delete other people's messages in a channel: group admins, and server admins anywhere
+func canModerateChannel(ctx context.Context, nk nkruntime.NakamaModule, channelID, userID string) bool {
+	if isAdmin(ctx) {
+		return true
+	}
+	ref, err := parseChannelID(channelID)
+	if err != nil || ref.Mode != STREAM_MODE_GROUP {
+		return false
+	}
+	state, err := groupState(ctx, nk, ref.Subject, userID)
+	return err == nil && state >= GROUP_STATE_SUPERADMIN && state <= GROUP_STATE_ADMIN
+}
+
+// updateMessageHistory applies fn to a message's history record, retrying on concurrent modification
+func updateMessageHistory(ctx context.Context, nk nkruntime.NakamaModule, channelID, messageID, senderID string, fn func(*MessageHistory)) error {
+	var lastErr error
+	for attempt := 0; attempt < MESSAGE_WRITE_ATTEMPTS; attempt++ {
+		objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: MESSAGE_HISTORY_COLLECTION, Key: messageID}})
+		if err != nil {
+			return fmt.Errorf("failed to read message history: %v", err)
+		}
+		history := &MessageHistory{ChannelID: channelID, MessageID: messageID, SenderID: senderID}
+		version := "*"
+		if len(objects) > 0 {
+			if err := json.Unmarshal([]byte(objects[0].Value), history); err != nil {
+				return fmt.Errorf("failed to decode message history: %v", err)
+			}
+			version = objects[0].Version
+		}
+		fn(history)
+		if len(history.Revisions) > MESSAGE_HISTORY_MAX_EDITS {
+			history.Revisions = history.Revisions[len(history.Revisions)-MESSAGE_HISTORY_MAX_EDITS:]
+		}
+
+		value, _ := json.Marshal(history)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      MESSAGE_HISTORY_COLLECTION,
+			Key:             messageID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to update message history: %v", lastErr)
+}
+
+// sendMessageEvent tells the channel that a message changed so clients can reconcile their caches
+func sendMessageEvent(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, eventType, channelID, messageID string, content interface{}) {
+	event := &ChannelEvent{
+		Type:      eventType,
+		ChannelID: channelID,
+		MessageID: messageID,
+		SenderID:  userIDFromContext(ctx),
+		Username:  usernameFromContext(ctx),
+		Content:   content,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := sendChannelEvent(nk, event); err != nil {
+		logger.Warn("Failed to send %s event for %s: %v", eventType, messageID, err)
+	}
+}
+
+// RpcEditMessage replaces the content of one of the caller's messages and keeps the previous version
+func RpcEditMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(MessageResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string                 `json:"channelId"`
+		MessageID string                 `json:"messageId"`
+		Content   map[string]interface{} `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(MessageResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" || request.MessageID == "" || len(request.Content) == 0 {
+		return marshalResponse(MessageResponse{Success: false, Error: "Missing required fields: channelId, messageId, or content", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	message, err := readChannelMessage(ctx, db, request.ChannelID, request.MessageID)
+	if err != nil {
+		return marshalResponse(MessageResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if message == nil {
+		return marshalResponse(MessageResponse{Success: false, Error: "Message not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	// Moderators may remove messages but never put words in someone else's mouth
+	if message.SenderID != userID {
+		return marshalResponse(MessageResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil || !member {
+		return marshalResponse(MessageResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+
+	if _, err := applyProfanityFilter(ctx, logger, nk, request.Content); err != nil {
+		return marshalResponse(MessageResponse{Success: false, Code: errorCodeOf(err), Error: err.Error()})
+	}
+	// Previews are the server's to attach; the edit may have changed the link
+	delete(request.Content, LINK_PREVIEW_FIELD)
+	keepThreadFields(message.Content, request.Content)
+
+	now := time.Now().Unix()
+	if err := updateMessageHistory(ctx, nk, request.ChannelID, request.MessageID, message.SenderID, func(h *MessageHistory) {
+		h.Revisions = append(h.Revisions, MessageRevision{Content: message.Content, EditedAt: now, EditedBy: userID})
+	}); err != nil {
+		return marshalResponse(MessageResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	if _, err := nk.ChannelMessageUpdate(ctx, request.ChannelID, request.MessageID, request.Content, message.SenderID, message.Username, true); err != nil {
+		return marshalResponse(MessageResponse{Success: false, Error: fmt.Sprintf("Failed to edit message: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	reindexMessage(ctx, logger, db, request.MessageID, request.Content)
+	archiveEditedMessage(ctx, logger, db, request.MessageID, request.Content)
+	dropTranslations(ctx, logger, nk, request.MessageID)
+	scheduleLinkPreview(logger, db, nk, request.ChannelID, request.MessageID, request.Content)
+	sendMessageEvent(ctx, logger, nk, "message_edited", request.ChannelID, request.MessageID, request.Content)
+	return marshalResponse(MessageResponse{Success: true, MessageID: request.MessageID})
+}
+
+// RpcDeleteMessage removes a message. Authors can delete their own messages, group admins any message in their group.
+func RpcDeleteMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(MessageResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+		MessageID string `json:"messageId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(MessageResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" || request.MessageID == "" {
+		return marshalResponse(MessageResponse{Success: false, Error: "Missing required fields: channelId or messageId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	message, err := readChannelMessage(ctx, db, request.ChannelID, request.MessageID)
+	if err != nil {
+		return marshalResponse(MessageResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if message == nil {
+		return marshalResponse(MessageResponse{Success: false, Error: "Message not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	if message.SenderID != userID && !canModerateChannel(ctx, nk, request.ChannelID, userID) {
+		return marshalResponse(MessageResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	if err := deleteChannelMessage(ctx, logger, db, nk, request.ChannelID, request.MessageID, message, userID, message.Content); err != nil {
+		return marshalResponse(MessageResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(MessageResponse{Success: true, MessageID: request.MessageID})
+}
+
+// BeforeChannelMessageChange turns away socket ChannelMessageUpdate and ChannelMessageRemove, which would skip
+// the message history, the profanity filter and the moderator rules. Clients edit and delete with the RPCs.
+func BeforeChannelMessageChange(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *rtapi.Envelope) (*rtapi.Envelope, error) {
+	rejected := &MessageRejectedError{Code: ERROR_CODE_REJECTED, Message: "Edit messages with edit_message"}
+	if in.GetChannelMessageRemove() != nil {
+		rejected.Message = "Delete messages with delete_message"
+	}
+	body, _ := json.Marshal(rejected)
+	return nil, nkruntime.NewError(string(body), MESSAGE_REJECT_STATUS)
+}
+
+// deleteChannelMessage removes a message with its reactions, search entry and thread link, records the deletion
+// in the message's history and tells the channel. keptContent is what moderators can still read of the message.
+func deleteChannelMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, channelID, messageID string, message *StoredMessage, deletedBy, keptContent string) error {
+	if err := updateMessageHistory(ctx, nk, channelID, messageID, message.SenderID, func(h *MessageHistory) {
+		h.DeletedAt = time.Now().Unix()
+		h.DeletedBy = deletedBy
+		h.DeletedContent = keptContent
+	}); err != nil {
+		return err
+	}
+
+	// Nakama only removes a message on behalf of its sender
+	if _, err := nk.ChannelMessageRemove(ctx, channelID, messageID, message.SenderID, message.Username, true); err != nil {
+		return fmt.Errorf("Failed to delete message: %v", err)
+	}
+	if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: REACTION_COLLECTION, Key: messageID}}); err != nil {
+		logger.Warn("Failed to delete reactions of message %s: %v", messageID, err)
+	}
+
+	unindexMessage(ctx, logger, db, messageID)
+	archiveDeletedMessage(ctx, logger, db, messageID, deletedBy, keptContent)
+	dropTranslations(ctx, logger, nk, messageID)
+	untrackThreadReply(ctx, logger, db, nk, channelID, messageID, message.Content)
+	sendMessageEvent(ctx, logger, nk, "message_deleted", channelID, messageID, nil)
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/heroiclabs/nakama-common/rtapi"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestBeforeChannelMessageChange(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      *rtapi.Envelope
+		message string
+	}{
+		{
+			name:    "update",
+			in:      &rtapi.Envelope{Message: &rtapi.Envelope_ChannelMessageUpdate{ChannelMessageUpdate: &rtapi.ChannelMessageUpdate{ChannelId: "2...general", MessageId: "m1", Content: `{"message":"x"}`}}},
+			message: "Edit messages with edit_message",
+		},
+		{
+			name:    "remove",
+			in:      &rtapi.Envelope{Message: &rtapi.Envelope_ChannelMessageRemove{ChannelMessageRemove: &rtapi.ChannelMessageRemove{ChannelId: "2...general", MessageId: "m1"}}},
+			message: "Delete messages with delete_message",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := BeforeChannelMessageChange(context.Background(), newTestLogger(), nil, nil, tt.in)
+			if out != nil {
+				t.Fatalf("envelope passed through: %v", out)
+			}
+			rtErr, ok := err.(*nkruntime.Error)
+			if !ok {
+				t.Fatalf("error = %v, want a runtime error", err)
+			}
+			if rtErr.Code != MESSAGE_REJECT_STATUS {
+				t.Errorf("status = %d, want %d", rtErr.Code, MESSAGE_REJECT_STATUS)
+			}
+			var body MessageRejectedError
+			if err := json.Unmarshal([]byte(rtErr.Message), &body); err != nil {
+				t.Fatalf("error message %q is not JSON: %v", rtErr.Message, err)
+			}
+			if body.Code != ERROR_CODE_REJECTED || body.Message != tt.message {
+				t.Errorf("body = %+v, want code %s and message %q", body, ERROR_CODE_REJECTED, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/rtapi"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Metric names, exported through Nakama's metrics (Prometheus when metrics.prometheus_port is set)
+const (
+	METRIC_RPC_CALLS        = "rpc_calls_total"
+	METRIC_RPC_LATENCY      = "rpc_latency"
+	METRIC_UPLOADS          = "uploads_total"
+	METRIC_UPLOAD_BYTES     = "upload_bytes_total"
+	METRIC_STORAGE_LATENCY  = "storage_latency"
+	METRIC_STORAGE_FAILURES = "storage_failures_total"
+	METRIC_RESULT_OK        = "ok"
+)
+
+// metrics receives the module's metrics; it is set in InitModule, before any RPC runs
+var metrics nkruntime.NakamaModule
+
+// responseCode returns the error code of an RPC result, "" when it succeeded
+func responseCode(response string, err error) string {
+	if err != nil {
+		if rpcErr, ok := err.(*nkruntime.Error); ok {
+			response = rpcErr.Message
+		} else {
+			return ERROR_CODE_INTERNAL
+		}
+	} else if !strings.Contains(response, `"success":false`) {
+		return ""
+	}
+	var body struct {
+		Success *bool  `json:"success"`
+		Code    string `json:"code"`
+	}
+	if json.Unmarshal([]byte(response), &body) != nil || body.Success == nil || *body.Success {
+		if err != nil {
+			return ERROR_CODE_INTERNAL
+		}
+		return ""
+	}
+	return body.Code
+}
+
+// withMetrics counts the calls of an RPC by outcome, the error code for failures, and records how long they took
+func withMetrics(id string, fn rpcFunction) rpcFunction {
+	return func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+		start := time.Now()
+		response, err := fn(ctx, logger, db, nk, payload)
+		result := responseCode(response, err)
+		if result == "" {
+			result = METRIC_RESULT_OK
+		}
+		nk.MetricsCounterAdd(METRIC_RPC_CALLS, map[string]string{"rpc": id, "result": result}, 1)
+		nk.MetricsTimerRecord(METRIC_RPC_LATENCY, map[string]string{"rpc": id}, time.Since(start))
+		return response, err
+	}
+}
+
+// rpcInitializer registers every RPC with request logging, error codes, metrics and, for privileged RPCs,
+// audit entries. Hooks and event handlers get a redacting logger.
+type rpcInitializer struct {
+	nkruntime.Initializer
+}
+
+func (i *rpcInitializer) RegisterRpc(id string, fn rpcFunction) error {
+	return i.Initializer.RegisterRpc(id, withRequestLog(id, withMetrics(id, withAudit(id, withErrorCodes(fn)))))
+}
+
+func (i *rpcInitializer) RegisterBeforeRt(id string, fn func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *rtapi.Envelope) (*rtapi.Envelope, error)) error {
+	return i.Initializer.RegisterBeforeRt(id, func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *rtapi.Envelope) (*rtapi.Envelope, error) {
+		return fn(ctx, redactLogs(logger), db, nk, in)
+	})
+}
+
+func (i *rpcInitializer) RegisterAfterRt(id string, fn func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, out, in *rtapi.Envelope) error) error {
+	return i.Initializer.RegisterAfterRt(id, func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, out, in *rtapi.Envelope) error {
+		return fn(ctx, redactLogs(logger), db, nk, out, in)
+	})
+}
+
+func (i *rpcInitializer) RegisterBeforeAddFriends(fn func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *api.AddFriendsRequest) (*api.AddFriendsRequest, error)) error {
+	return i.Initializer.RegisterBeforeAddFriends(func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *api.AddFriendsRequest) (*api.AddFriendsRequest, error) {
+		return fn(ctx, redactLogs(logger), db, nk, in)
+	})
+}
+
+func (i *rpcInitializer) RegisterAfterAddFriends(fn func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *api.AddFriendsRequest) error) error {
+	return i.Initializer.RegisterAfterAddFriends(func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, in *api.AddFriendsRequest) error {
+		return fn(ctx, redactLogs(logger), db, nk, in)
+	})
+}
+
+func (i *rpcInitializer) RegisterTournamentEnd(fn func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, tournament *api.Tournament, end, reset int64) error) error {
+	return i.Initializer.RegisterTournamentEnd(func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, tournament *api.Tournament, end, reset int64) error {
+		return fn(ctx, redactLogs(logger), db, nk, tournament, end, reset)
+	})
+}
+
+func (i *rpcInitializer) RegisterEventSessionStart(fn func(ctx context.Context, logger nkruntime.Logger, evt *api.Event)) error {
+	return i.Initializer.RegisterEventSessionStart(func(ctx context.Context, logger nkruntime.Logger, evt *api.Event) {
+		fn(ctx, redactLogs(logger), evt)
+	})
+}
+
+func (i *rpcInitializer) RegisterEventSessionEnd(fn func(ctx context.Context, logger nkruntime.Logger, evt *api.Event)) error {
+	return i.Initializer.RegisterEventSessionEnd(func(ctx context.Context, logger nkruntime.Logger, evt *api.Event) {
+		fn(ctx, redactLogs(logger), evt)
+	})
+}
+
+// uploadKind groups content types for upload metrics
+func uploadKind(contentType string) string {
+	switch {
+	case isImageContentType(contentType):
+		return "image"
+	case isVideoContentType(contentType):
+		return "video"
+	case strings.HasPrefix(contentType, "audio/"):
+		return "audio"
+	case contentType == ENCRYPTED_CONTENT_TYPE:
+		return "encrypted"
+	}
+	return "other"
+}
+
+// countUpload records a stored upload in the upload counters
+func countUpload(nk nkruntime.NakamaModule, attachment *Attachment) {
+	tags := map[string]string{"kind": uploadKind(attachment.ContentType)}
+	nk.MetricsCounterAdd(METRIC_UPLOADS, tags, 1)
+	nk.MetricsCounterAdd(METRIC_UPLOAD_BYTES, tags, attachment.Size)
+}
+
+// meteredBackend records the latency and failures of every object storage call
+type meteredBackend struct {
+	StorageBackend
+}
+
+func (b *meteredBackend) observe(operation string, start time.Time, err error) {
+	if metrics == nil {
+		return
+	}
+	tags := map[string]string{"backend": b.Name(), "operation": operation}
+	metrics.MetricsTimerRecord(METRIC_STORAGE_LATENCY, tags, time.Since(start))
+	if err != nil {
+		metrics.MetricsCounterAdd(METRIC_STORAGE_FAILURES, tags, 1)
+	}
+}
+
+func (b *meteredBackend) EnsureBucket(ctx context.Context, logger nkruntime.Logger, bucket string) error {
+	start := time.Now()
+	err := b.StorageBackend.EnsureBucket(ctx, logger, bucket)
+	b.observe("ensure_bucket", start, err)
+	return err
+}
+
+func (b *meteredBackend) SetBucketLifecycle(ctx context.Context, logger nkruntime.Logger, bucket string, rules BucketLifecycle) error {
+	start := time.Now()
+	err := b.StorageBackend.SetBucketLifecycle(ctx, logger, bucket, rules)
+	b.observe("set_bucket_lifecycle", start, err)
+	return err
+}
+
+func (b *meteredBackend) PutObject(ctx context.Context, bucket, key string, data io.Reader, size int64, contentType string) error {
+	start := time.Now()
+	err := b.StorageBackend.PutObject(ctx, bucket, key, data, size, contentType)
+	b.observe("put_object", start, err)
+	return err
+}
+
+func (b *meteredBackend) GetObject(ctx context.Context, bucket, key string) (io.ReadSeekCloser, error) {
+	start := time.Now()
+	object, err := b.StorageBackend.GetObject(ctx, bucket, key)
+	b.observe("get_object", start, err)
+	return object, err
+}
+
+func (b *meteredBackend) StatObject(ctx context.Context, bucket, key string) (*StoredObject, error) {
+	start := time.Now()
+	info, err := b.StorageBackend.StatObject(ctx, bucket, key)
+	b.observe("stat_object", start, err)
+	return info, err
+}
+
+func (b *meteredBackend) RemoveObject(ctx context.Context, bucket, key string) error {
+	start := time.Now()
+	err := b.StorageBackend.RemoveObject(ctx, bucket, key)
+	b.observe("remove_object", start, err)
+	return err
+}
+
+func (b *meteredBackend) ListObjects(ctx context.Context, bucket, prefix string, fn func(*StoredObject) bool) error {
+	start := time.Now()
+	err := b.StorageBackend.ListObjects(ctx, bucket, prefix, fn)
+	b.observe("list_objects", start, err)
+	return err
+}
+
+func (b *meteredBackend) PresignGet(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	start := time.Now()
+	url, err := b.StorageBackend.PresignGet(ctx, bucket, key, expiry)
+	b.observe("presign_get", start, err)
+	return url, err
+}
+
+func (b *meteredBackend) PresignPut(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	start := time.Now()
+	url, err := b.StorageBackend.PresignPut(ctx, bucket, key, expiry)
+	b.observe("presign_put", start, err)
+	return url, err
+}
+
+func (b *meteredBackend) NewMultipartUpload(ctx context.Context, bucket, key, contentType string) (string, error) {
+	start := time.Now()
+	uploadID, err := b.StorageBackend.NewMultipartUpload(ctx, bucket, key, contentType)
+	b.observe("new_multipart_upload", start, err)
+	return uploadID, err
+}
+
+func (b *meteredBackend) PutObjectPart(ctx context.Context, bucket, key, uploadID string, number int, data io.Reader, size int64) (string, error) {
+	start := time.Now()
+	etag, err := b.StorageBackend.PutObjectPart(ctx, bucket, key, uploadID, number, data, size)
+	b.observe("put_object_part", start, err)
+	return etag, err
+}
+
+func (b *meteredBackend) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []ObjectPart) error {
+	start := time.Now()
+	err := b.StorageBackend.CompleteMultipartUpload(ctx, bucket, key, uploadID, parts)
+	b.observe("complete_multipart_upload", start, err)
+	return err
+}
+
+func (b *meteredBackend) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	start := time.Now()
+	err := b.StorageBackend.AbortMultipartUpload(ctx, bucket, key, uploadID)
+	b.observe("abort_multipart_upload", start, err)
+	return err
+}
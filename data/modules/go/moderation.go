@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	MODERATION_FLAG_COLLECTION      = "moderation_flags"
+	QUARANTINE_PREFIX               = "quarantine/"
+	MODERATION_DEFAULT_MAX_DISTANCE = 10
+	MODERATION_REVIEW_URL_EXPIRY    = time.Hour
+	MODERATION_LIST_DEFAULT_LIMIT   = 50
+	MODERATION_LIST_MAX_LIMIT       = 100
+	ERROR_CODE_UPLOAD_FLAGGED       = "UPLOAD_FLAGGED"
+)
+
+// ModerationVerdict is a provider's opinion of an image
+type ModerationVerdict struct {
+	Flagged  bool    `json:"flagged"`
+	Provider string  `json:"provider"`
+	Reason   string  `json:"reason,omitempty"`
+	Score    float64 `json:"score,omitempty"`
+}
+
+// ModerationProvider classifies images for the moderation stage
+type ModerationProvider interface {
+	Name() string
+	Check(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) (*ModerationVerdict, error)
+}
+
+// MODERATION_PROVIDERS maps the IMAGE_MODERATION_PROVIDER values to their constructors
+var MODERATION_PROVIDERS = map[string]func() (ModerationProvider, error){
+	"phash": newPHashBlocklist,
+	"nsfw":  newNSFWProvider,
+}
+
+// FlaggedUpload is the report written when an upload is quarantined
+type FlaggedUpload struct {
+	FlagID        string  `json:"flagId"`
+	OwnerID       string  `json:"ownerId,omitempty"`
+	ObjectKey     string  `json:"objectKey"`
+	QuarantineKey string  `json:"quarantineKey"`
+	Bucket        string  `json:"bucket"`
+	ContentType   string  `json:"contentType"`
+	Size          int64   `json:"size"`
+	ChannelID     string  `json:"channelId,omitempty"`
+	Provider      string  `json:"provider"`
+	Reason        string  `json:"reason,omitempty"`
+	Score         float64 `json:"score,omitempty"`
+	CreatedAt     int64   `json:"createdAt"`
+	// ReviewURL is filled in for admins by list_flagged_uploads and never stored
+	ReviewURL string `json:"reviewUrl,omitempty"`
+}
+
+// ModerationError is returned when an upload was quarantined instead of stored
+type ModerationError struct {
+	Flag *FlaggedUpload
+}
+
+func (e *ModerationError) Error() string { return "Image was flagged and is held for review" }
+
+// moderationErrorCode returns the client facing code of a moderation error, "" for other errors
+func moderationErrorCode(err error) string {
+	if _, ok := err.(*ModerationError); ok {
+		return ERROR_CODE_UPLOAD_FLAGGED
+	}
+	return ""
+}
+
+// FlaggedUploadListResponse represents the response for list_flagged_uploads
+type FlaggedUploadListResponse struct {
+	Success bool             `json:"success"`
+	Flags   []*FlaggedUpload `json:"flags,omitempty"`
+	Cursor  string           `json:"cursor,omitempty"`
+	Error   string           `json:"error,omitempty"`
+	Code    string           `json:"code,omitempty"`
+}
+
+// moderationStage asks the configured provider about every image. Flagged images are not rejected here;
+// the upload RPCs quarantine them so admins can review them.
+type moderationStage struct {
+	provider ModerationProvider
+}
+
+func newModerationStage() (ImageStage, error) {
+	name := serverConfig.ImageModerationProvider
+	factory, ok := MODERATION_PROVIDERS[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown IMAGE_MODERATION_PROVIDER: %s", name)
+	}
+	provider, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	return &moderationStage{provider: provider}, nil
+}
+
+func (s *moderationStage) Name() string { return "moderation" }
+
+func (s *moderationStage) Process(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) error {
+	verdict, err := s.provider.Check(ctx, logger, asset)
+	if err != nil {
+		return err
+	}
+	verdict.Provider = s.provider.Name()
+	asset.Moderation = verdict
+	if verdict.Flagged {
+		logger.Warn("Image flagged by %s moderation: %s", verdict.Provider, verdict.Reason)
+	}
+	return nil
+}
+
+// pHashBlocklist flags images whose difference hash is close to one listed in IMAGE_MODERATION_BLOCKLIST
+type pHashBlocklist struct {
+	hashes      []uint64
+	maxDistance int
+}
+
+func newPHashBlocklist() (ModerationProvider, error) {
+	path := serverConfig.ImageModerationBlocklist
+	if path == "" {
+		return nil, fmt.Errorf("IMAGE_MODERATION_BLOCKLIST is not set")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blocklist: %v", err)
+	}
+	defer f.Close()
+
+	// One 64 bit hash per line in hex, # starts a comment
+	hashes := []uint64{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if text == "" {
+			continue
+		}
+		hash, err := strconv.ParseUint(text, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash on blocklist line %d", line)
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %v", err)
+	}
+	return &pHashBlocklist{
+		hashes:      hashes,
+		maxDistance: serverConfig.ImageModerationMaxDistance,
+	}, nil
+}
+
+func (p *pHashBlocklist) Name() string { return "phash" }
+
+func (p *pHashBlocklist) Check(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) (*ModerationVerdict, error) {
+	// WebP pixels cannot be hashed; the nsfw provider still sees the bytes
+	if asset.IsWebP() {
+		logger.Debug("Skipping phash moderation of a WebP image")
+		return &ModerationVerdict{}, nil
+	}
+	if err := asset.Decode(); err != nil {
+		return nil, err
+	}
+	hash := differenceHash(asset.Image)
+	for _, blocked := range p.hashes {
+		if distance := bits.OnesCount64(hash ^ blocked); distance <= p.maxDistance {
+			return &ModerationVerdict{Flagged: true, Reason: fmt.Sprintf("matches blocklisted hash %016x (distance %d)", blocked, distance)}, nil
+		}
+	}
+	return &ModerationVerdict{}, nil
+}
+
+// differenceHash computes the 64 bit dHash of an image: one bit per horizontally adjacent pixel pair of a
+// 9x8 grayscale thumbnail. Re-encoded, resized or slightly edited copies stay within a few bits.
+func differenceHash(img image.Image) uint64 {
+	small := resizeImage(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if luminance(small, x, y) > luminance(small, x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func luminance(img *image.RGBA, x, y int) uint32 {
+	c := img.RGBAAt(x, y)
+	return (299*uint32(c.R) + 587*uint32(c.G) + 114*uint32(c.B)) / 1000
+}
+
+// nsfwProvider flags the images the nsfw_scan classifier finds unsafe, so they are reviewed instead of rejected
+type nsfwProvider struct {
+	classifier *nsfwClassifier
+}
+
+func newNSFWProvider() (ModerationProvider, error) {
+	classifier, err := newNSFWClassifier()
+	if err != nil {
+		return nil, err
+	}
+	return &nsfwProvider{classifier: classifier}, nil
+}
+
+func (p *nsfwProvider) Name() string { return "nsfw" }
+
+func (p *nsfwProvider) Check(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) (*ModerationVerdict, error) {
+	result, unsafe, err := p.classifier.classify(ctx, asset)
+	if err != nil {
+		return nil, err
+	}
+	verdict := &ModerationVerdict{Flagged: unsafe, Score: result.Score, Reason: result.Reason}
+	if unsafe && verdict.Reason == "" {
+		verdict.Reason = fmt.Sprintf("score %.2f", result.Score)
+	}
+	return verdict, nil
+}
+
+// isFlagged reports whether the moderation stage flagged an asset
+func (a *ImageAsset) isFlagged() bool {
+	return a.Moderation != nil && a.Moderation.Flagged
+}
+
+// quarantineUpload stores a flagged image under quarantine/ in the private quarantine bucket instead of its
+// real key and writes the report admins review. Returns the *ModerationError the upload RPCs pass on to the client.
+func (s *Services) quarantineUpload(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, ownerID, objectKey, channelID string, asset *ImageAsset) error {
+	flag := &FlaggedUpload{
+		FlagID:        uuid.New().String(),
+		OwnerID:       ownerID,
+		ObjectKey:     objectKey,
+		QuarantineKey: QUARANTINE_PREFIX + objectKey,
+		Bucket:        s.Config.QuarantineBucket,
+		ContentType:   asset.ContentType,
+		Size:          int64(len(asset.Data)),
+		ChannelID:     channelID,
+		Provider:      asset.Moderation.Provider,
+		Reason:        asset.Moderation.Reason,
+		Score:         asset.Moderation.Score,
+		CreatedAt:     s.Clock.Now().Unix(),
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage backend: %v", err)
+	}
+	if err := backend.EnsureBucket(ctx, logger, flag.Bucket); err != nil {
+		return fmt.Errorf("failed to ensure quarantine bucket exists: %v", err)
+	}
+	if err := backend.PutObject(ctx, flag.Bucket, flag.QuarantineKey, bytes.NewReader(asset.Data), flag.Size, flag.ContentType); err != nil {
+		return fmt.Errorf("failed to quarantine upload: %v", err)
+	}
+	value, _ := json.Marshal(flag)
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      MODERATION_FLAG_COLLECTION,
+		Key:             flag.FlagID,
+		Value:           string(value),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		return fmt.Errorf("failed to record flagged upload: %v", err)
+	}
+
+	logger.Warn("Quarantined upload %s from %s: %s", objectKey, ownerID, flag.Reason)
+	return &ModerationError{Flag: flag}
+}
+
+// RpcListFlaggedUploads pages through quarantined uploads with short-lived URLs to review them (admin only)
+func RpcListFlaggedUploads(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(FlaggedUploadListResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		Limit  int    `json:"limit"`
+		Cursor string `json:"cursor"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(FlaggedUploadListResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.Limit <= 0 {
+		request.Limit = MODERATION_LIST_DEFAULT_LIMIT
+	}
+	if request.Limit > MODERATION_LIST_MAX_LIMIT {
+		request.Limit = MODERATION_LIST_MAX_LIMIT
+	}
+
+	backend, err := getStorageBackend(logger)
+	if err != nil {
+		return marshalResponse(FlaggedUploadListResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	objects, cursor, err := nk.StorageList(ctx, "", "", MODERATION_FLAG_COLLECTION, request.Limit, request.Cursor)
+	if err != nil {
+		return marshalResponse(FlaggedUploadListResponse{Success: false, Error: fmt.Sprintf("Failed to list flagged uploads: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	flags := make([]*FlaggedUpload, 0, len(objects))
+	for _, object := range objects {
+		var flag FlaggedUpload
+		if err := json.Unmarshal([]byte(object.Value), &flag); err != nil {
+			logger.Warn("Skipping unreadable flag %s: %v", object.Key, err)
+			continue
+		}
+		if url, err := backend.PresignGet(ctx, flag.Bucket, flag.QuarantineKey, MODERATION_REVIEW_URL_EXPIRY); err == nil {
+			flag.ReviewURL = url
+		}
+		flags = append(flags, &flag)
+	}
+
+	return marshalResponse(FlaggedUploadListResponse{Success: true, Flags: flags, Cursor: cursor})
+}
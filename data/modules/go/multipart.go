@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// MULTIPART_MIN_PART_BYTES is the smallest part S3 compatible stores accept, the last part aside
+	MULTIPART_MIN_PART_BYTES  = 5 * 1024 * 1024
+	MULTIPART_MAX_PARTS       = 10000
+	MULTIPART_EXPIRY          = 24 * time.Hour
+	MULTIPART_WRITE_ATTEMPTS  = 3
+	MULTIPART_DEFAULT_PART_MB = 5
+)
+
+// MultipartUpload is a pending upload sent to the server in parts. It is kept in the pending upload
+// collection so that, once assembled, confirm_upload and upload_video finish it like a presigned upload.
+type MultipartUpload struct {
+	PendingUpload
+	// StorageUploadID is the storage backend's ID of the multipart upload
+	StorageUploadID string `json:"storageUploadId"`
+	PartSize        int64  `json:"partSize"`
+	PartCount       int    `json:"partCount"`
+	// Parts maps the number of every received part to its ETag
+	Parts     map[int]string `json:"parts"`
+	Assembled bool           `json:"assembled,omitempty"`
+}
+
+// MultipartUploadResponse represents the response for the multipart upload RPCs
+type MultipartUploadResponse struct {
+	Success       bool   `json:"success"`
+	UploadID      string `json:"uploadId,omitempty"`
+	ObjectKey     string `json:"objectKey,omitempty"`
+	PartSize      int64  `json:"partSize,omitempty"`
+	PartCount     int    `json:"partCount,omitempty"`
+	ReceivedParts []int  `json:"receivedParts,omitempty"`
+	MissingParts  []int  `json:"missingParts,omitempty"`
+	Assembled     bool   `json:"assembled,omitempty"`
+	ExpiresAt     int64  `json:"expiresAt,omitempty"`
+	Error         string `json:"error,omitempty"`
+	Code          string `json:"code,omitempty"`
+}
+
+// multipartPartBytes is the size of every part but the last, MULTIPART_PART_MB (5 MiB by default, never less).
+// Parts travel base64-encoded in an RPC, so Nakama's socket.max_request_size_bytes must fit one.
+func multipartPartBytes() int64 {
+	size := int64(serverConfig.MultipartPartMB) * 1024 * 1024
+	if size < MULTIPART_MIN_PART_BYTES {
+		return MULTIPART_MIN_PART_BYTES
+	}
+	return size
+}
+
+// partLength is the exact size part number n must have
+func (u *MultipartUpload) partLength(n int) int64 {
+	if n == u.PartCount {
+		return u.ExpectedSize - int64(u.PartCount-1)*u.PartSize
+	}
+	return u.PartSize
+}
+
+// response describes the upload's progress so clients can resume by sending only the missing parts
+func (u *MultipartUpload) response() MultipartUploadResponse {
+	response := MultipartUploadResponse{
+		Success:   true,
+		UploadID:  u.UploadID,
+		ObjectKey: u.ObjectKey,
+		PartSize:  u.PartSize,
+		PartCount: u.PartCount,
+		Assembled: u.Assembled,
+		ExpiresAt: u.ExpiresAt,
+	}
+	for n := 1; n <= u.PartCount; n++ {
+		if _, ok := u.Parts[n]; ok {
+			response.ReceivedParts = append(response.ReceivedParts, n)
+		} else {
+			response.MissingParts = append(response.MissingParts, n)
+		}
+	}
+	return response
+}
+
+// readMultipartUpload loads a user's multipart upload, nil if there is none with that ID
+func readMultipartUpload(ctx context.Context, nk nkruntime.NakamaModule, userID, uploadID string) (*MultipartUpload, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{
+		Collection: PENDING_UPLOAD_COLLECTION,
+		Key:        uploadID,
+		UserID:     userID,
+	}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read upload: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	var upload MultipartUpload
+	if err := json.Unmarshal([]byte(objects[0].Value), &upload); err != nil {
+		return nil, "", fmt.Errorf("failed to decode upload: %v", err)
+	}
+	// Presigned uploads share the collection but are not sent in parts
+	if upload.StorageUploadID == "" {
+		return nil, "", nil
+	}
+	return &upload, objects[0].Version, nil
+}
+
+// writeMultipartUpload stores the upload record; version "*" creates it
+func writeMultipartUpload(ctx context.Context, nk nkruntime.NakamaModule, userID string, upload *MultipartUpload, version string) error {
+	value, _ := json.Marshal(upload)
+	_, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      PENDING_UPLOAD_COLLECTION,
+		Key:             upload.UploadID,
+		UserID:          userID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// updateMultipartUpload applies fn to the upload record, retrying when parts arriving in parallel race
+func updateMultipartUpload(ctx context.Context, nk nkruntime.NakamaModule, userID, uploadID string, fn func(*MultipartUpload) error) (*MultipartUpload, error) {
+	var lastErr error
+	for attempt := 0; attempt < MULTIPART_WRITE_ATTEMPTS; attempt++ {
+		upload, version, err := readMultipartUpload(ctx, nk, userID, uploadID)
+		if err != nil {
+			return nil, err
+		}
+		if upload == nil {
+			return nil, errorWithCode(ERROR_CODE_NOT_FOUND, "Upload not found")
+		}
+		if err := fn(upload); err != nil {
+			return nil, err
+		}
+		if lastErr = writeMultipartUpload(ctx, nk, userID, upload, version); lastErr == nil {
+			return upload, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to update upload: %v", lastErr)
+}
+
+// RpcBeginMultipartUpload starts an upload sent through upload_part, for files too large to send in one request.
+// Calling it again with just the uploadId returns the parts received so far, so clients can resume.
+func (s *Services) RpcBeginMultipartUpload(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UploadID    string `json:"uploadId"`
+		FileName    string `json:"fileName"`
+		ContentType string `json:"contentType"`
+		Size        int64  `json:"size"`
+		ChannelID   string `json:"channelId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	if request.UploadID != "" {
+		upload, _, err := readMultipartUpload(ctx, nk, userID, request.UploadID)
+		if err != nil {
+			return marshalResponse(MultipartUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		if upload == nil {
+			return marshalResponse(MultipartUploadResponse{Success: false, Error: "Upload not found", Code: ERROR_CODE_NOT_FOUND})
+		}
+		return marshalResponse(upload.response())
+	}
+
+	if request.FileName == "" || request.ContentType == "" || request.Size <= 0 {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Missing required fields: fileName, contentType, or size", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if !ALLOWED_UPLOAD_CONTENT_TYPES[request.ContentType] {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Unsupported content type: %s", request.ContentType), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if maxBytes := s.Config.uploadMaxBytesFor(request.ContentType); request.Size > maxBytes {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("File exceeds the maximum size of %d bytes", maxBytes), Code: ERROR_CODE_PAYLOAD_TOO_LARGE})
+	}
+	partSize := multipartPartBytes()
+	partCount := int((request.Size + partSize - 1) / partSize)
+	if partCount > MULTIPART_MAX_PARTS {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("File needs more than %d parts", MULTIPART_MAX_PARTS), Code: ERROR_CODE_PAYLOAD_TOO_LARGE})
+	}
+	if err := s.reserveUploadQuota(ctx, nk, userID, request.Size); err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	now := s.Clock.Now()
+	objectKey := uploadObjectKey(userID, now, request.FileName, request.ContentType)
+	if err := backend.EnsureBucket(ctx, logger, s.Config.bucketForKey(objectKey)); err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to ensure bucket exists: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	upload := &MultipartUpload{
+		PendingUpload: PendingUpload{
+			UploadID:     uuid.New().String(),
+			ObjectKey:    objectKey,
+			ContentType:  request.ContentType,
+			ExpectedSize: request.Size,
+			ChannelID:    request.ChannelID,
+			CreatedAt:    now.Unix(),
+			ExpiresAt:    now.Add(MULTIPART_EXPIRY).Unix(),
+		},
+		PartSize:  partSize,
+		PartCount: partCount,
+		Parts:     map[int]string{},
+	}
+
+	storageUploadID, err := backend.NewMultipartUpload(ctx, s.Config.bucketForKey(upload.ObjectKey), upload.ObjectKey, upload.ContentType)
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to start upload: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	upload.StorageUploadID = storageUploadID
+	if err := writeMultipartUpload(ctx, nk, userID, upload, "*"); err != nil {
+		_ = backend.AbortMultipartUpload(ctx, s.Config.bucketForKey(upload.ObjectKey), upload.ObjectKey, storageUploadID)
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to record pending upload: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	logger.Info("Started multipart upload of %s (%d bytes in %d parts)", upload.ObjectKey, request.Size, partCount)
+	return marshalResponse(upload.response())
+}
+
+// RpcUploadPart stores one base64-encoded part of a multipart upload. Parts may arrive in any order and be re-sent.
+func (s *Services) RpcUploadPart(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UploadID   string `json:"uploadId"`
+		PartNumber int    `json:"partNumber"`
+		Data       string `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UploadID == "" || request.PartNumber == 0 || request.Data == "" {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Missing required fields: uploadId, partNumber, or data", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	upload, _, err := readMultipartUpload(ctx, nk, userID, request.UploadID)
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if upload == nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Upload not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	if upload.Assembled {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Upload is already complete", Code: ERROR_CODE_CONFLICT})
+	}
+	if s.Clock.Now().Unix() > upload.ExpiresAt {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Upload has expired", Code: ERROR_CODE_REJECTED})
+	}
+	if request.PartNumber < 1 || request.PartNumber > upload.PartCount {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("partNumber must be between 1 and %d", upload.PartCount), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	data, err := base64.StdEncoding.DecodeString(request.Data)
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to decode base64 data: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if want := upload.partLength(request.PartNumber); int64(len(data)) != want {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Part %d must be %d bytes, got %d", request.PartNumber, want, len(data)), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	etag, err := backend.PutObjectPart(ctx, s.Config.bucketForKey(upload.ObjectKey), upload.ObjectKey, upload.StorageUploadID, request.PartNumber, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to store part: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	upload, err = updateMultipartUpload(ctx, nk, userID, request.UploadID, func(u *MultipartUpload) error {
+		if u.Assembled {
+			return errorWithCode(ERROR_CODE_CONFLICT, "Upload is already complete")
+		}
+		u.Parts[request.PartNumber] = etag
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(upload.response())
+}
+
+// RpcCompleteMultipartUpload assembles the parts into the object once all have arrived.
+// The upload is then confirmed like a presigned one, with confirm_upload or upload_video.
+func (s *Services) RpcCompleteMultipartUpload(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UploadID == "" {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Missing required field: uploadId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	upload, _, err := readMultipartUpload(ctx, nk, userID, request.UploadID)
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if upload == nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Upload not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	// Completing twice is harmless, so clients that lost the first response can retry
+	if upload.Assembled {
+		return marshalResponse(upload.response())
+	}
+	if response := upload.response(); len(response.MissingParts) > 0 {
+		response.Success = false
+		response.Error = fmt.Sprintf("%d parts have not been uploaded", len(response.MissingParts))
+		return marshalResponse(response)
+	}
+
+	parts := make([]ObjectPart, 0, len(upload.Parts))
+	for number, etag := range upload.Parts {
+		parts = append(parts, ObjectPart{Number: number, ETag: etag})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	if err := backend.CompleteMultipartUpload(ctx, s.Config.bucketForKey(upload.ObjectKey), upload.ObjectKey, upload.StorageUploadID, parts); err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to assemble upload: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	upload, err = updateMultipartUpload(ctx, nk, userID, request.UploadID, func(u *MultipartUpload) error {
+		u.Assembled = true
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	logger.Info("Assembled multipart upload %s from %d parts", upload.ObjectKey, len(parts))
+	return marshalResponse(upload.response())
+}
+
+// RpcAbortMultipartUpload discards an unfinished multipart upload and the parts stored so far
+func (s *Services) RpcAbortMultipartUpload(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UploadID == "" {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Missing required field: uploadId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	upload, _, err := readMultipartUpload(ctx, nk, userID, request.UploadID)
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if upload == nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: "Upload not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	if upload.Assembled {
+		s.rejectPendingUpload(ctx, logger, nk, userID, &upload.PendingUpload)
+	} else {
+		if err := backend.AbortMultipartUpload(ctx, s.Config.bucketForKey(upload.ObjectKey), upload.ObjectKey, upload.StorageUploadID); err != nil {
+			logger.Warn("Failed to abort multipart upload %s: %v", upload.ObjectKey, err)
+		}
+		if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: PENDING_UPLOAD_COLLECTION, Key: upload.UploadID, UserID: userID}}); err != nil {
+			return marshalResponse(MultipartUploadResponse{Success: false, Error: fmt.Sprintf("Failed to delete upload: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+	}
+
+	logger.Info("Aborted multipart upload %s", upload.ObjectKey)
+	return marshalResponse(MultipartUploadResponse{Success: true, UploadID: upload.UploadID})
+}
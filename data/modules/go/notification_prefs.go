@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	NOTIFICATION_PREFS_COLLECTION     = "notification_prefs"
+	NOTIFICATION_PREFS_KEY            = "prefs"
+	NOTIFICATION_PREFS_WRITE_ATTEMPTS = 3
+	NOTIFICATION_PREFS_MAX_WINDOWS    = 14
+	// NOTIFICATION_PREFS_MAX_CHANNELS bounds the per-channel entries a user can keep
+	NOTIFICATION_PREFS_MAX_CHANNELS = 500
+)
+
+// dndTimePattern matches a wall clock time such as "22:30"
+var dndTimePattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+// DNDWindow is a recurring quiet period in the user's timezone. Start and End are "HH:MM"; a window whose end
+// is not after its start runs past midnight. Days are the weekdays it starts on, 0 for Sunday; none means every day.
+type DNDWindow struct {
+	Days  []int  `json:"days,omitempty"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// ChannelNotifyPref is a user's own setting for one channel, on top of the channel's notificationLevel
+type ChannelNotifyPref struct {
+	// Mode is all (the default), mentions or none
+	Mode string `json:"mode,omitempty"`
+	// MutedUntil silences the channel entirely until this unix time
+	MutedUntil int64 `json:"mutedUntil,omitempty"`
+}
+
+// NotificationPrefs is the per-user record of when and for which channels pushes are sent
+type NotificationPrefs struct {
+	Timezone  string                        `json:"timezone,omitempty"`
+	DND       []DNDWindow                   `json:"dnd,omitempty"`
+	Channels  map[string]*ChannelNotifyPref `json:"channels,omitempty"`
+	UpdatedAt int64                         `json:"updatedAt,omitempty"`
+}
+
+// NotificationPrefsResponse represents the response for notification preference RPCs
+type NotificationPrefsResponse struct {
+	Success bool               `json:"success"`
+	Prefs   *NotificationPrefs `json:"prefs,omitempty"`
+	// InDND tells whether a DND window is in effect right now
+	InDND bool   `json:"inDnd"`
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// minutesOf turns a validated "HH:MM" into minutes after midnight
+func minutesOf(clock string) int {
+	var hour, minute int
+	fmt.Sscanf(clock, "%d:%d", &hour, &minute)
+	return hour*60 + minute
+}
+
+// location is the timezone DND windows are read in, UTC when unset or unknown
+func (p *NotificationPrefs) location() *time.Location {
+	if p.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// inDND reports whether now falls in one of the DND windows
+func (p *NotificationPrefs) inDND(now time.Time) bool {
+	local := now.In(p.location())
+	minute := local.Hour()*60 + local.Minute()
+	today := int(local.Weekday())
+	yesterday := (today + 6) % 7
+	for _, w := range p.DND {
+		start, end := minutesOf(w.Start), minutesOf(w.End)
+		startsOn := func(day int) bool {
+			if len(w.Days) == 0 {
+				return true
+			}
+			for _, d := range w.Days {
+				if d == day {
+					return true
+				}
+			}
+			return false
+		}
+		if start < end {
+			if startsOn(today) && minute >= start && minute < end {
+				return true
+			}
+			continue
+		}
+		// Overnight: the evening part belongs to today's window, the morning part to yesterday's
+		if (startsOn(today) && minute >= start) || (startsOn(yesterday) && minute < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPush reports whether a message in a channel may be pushed to the user; mentioned is whether it mentions them
+func (p *NotificationPrefs) allowsPush(channelID string, mentioned bool, now time.Time) bool {
+	if p.inDND(now) {
+		return false
+	}
+	pref := p.Channels[channelID]
+	if pref == nil {
+		return true
+	}
+	if pref.MutedUntil > now.Unix() {
+		return false
+	}
+	switch pref.Mode {
+	case CHANNEL_NOTIFY_NONE:
+		return false
+	case CHANNEL_NOTIFY_MENTIONS:
+		return mentioned
+	}
+	return true
+}
+
+// readNotificationPrefs loads the preferences of the given users, keyed by user ID; users without any are left out
+func readNotificationPrefs(ctx context.Context, nk nkruntime.NakamaModule, userIDs []string) (map[string]*NotificationPrefs, map[string]string, error) {
+	reads := make([]*nkruntime.StorageRead, 0, len(userIDs))
+	for _, id := range userIDs {
+		reads = append(reads, &nkruntime.StorageRead{Collection: NOTIFICATION_PREFS_COLLECTION, Key: NOTIFICATION_PREFS_KEY, UserID: id})
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read notification preferences: %v", err)
+	}
+	prefs := make(map[string]*NotificationPrefs, len(objects))
+	versions := make(map[string]string, len(objects))
+	for _, object := range objects {
+		var p NotificationPrefs
+		if err := json.Unmarshal([]byte(object.Value), &p); err != nil {
+			continue
+		}
+		prefs[object.UserId] = &p
+		versions[object.UserId] = object.Version
+	}
+	return prefs, versions, nil
+}
+
+// filterPushDevices drops the devices of users whose preferences keep a channel's message from being pushed now.
+// mentioned lists the users the message mentions. If the preferences cannot be read, every device is kept.
+func filterPushDevices(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, channelID string, devices map[string]*PushDevices, mentioned map[string]bool) {
+	userIDs := make([]string, 0, len(devices))
+	for id := range devices {
+		userIDs = append(userIDs, id)
+	}
+	prefs, _, err := readNotificationPrefs(ctx, nk, userIDs)
+	if err != nil {
+		logger.Warn("Failed to apply notification preferences in %s: %v", channelID, err)
+		return
+	}
+	now := time.Now()
+	for id, p := range prefs {
+		if !p.allowsPush(channelID, mentioned[id], now) {
+			delete(devices, id)
+		}
+	}
+}
+
+// RpcGetNotificationPrefs returns the caller's notification preferences
+func RpcGetNotificationPrefs(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(NotificationPrefsResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	stored, _, err := readNotificationPrefs(ctx, nk, []string{userID})
+	if err != nil {
+		return marshalResponse(NotificationPrefsResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	prefs := stored[userID]
+	if prefs == nil {
+		prefs = &NotificationPrefs{}
+	}
+	return marshalResponse(NotificationPrefsResponse{Success: true, Prefs: prefs, InDND: prefs.inDND(time.Now())})
+}
+
+// RpcSetNotificationPrefs updates the caller's notification preferences. timezone and dnd replace what is stored
+// when present; channels are merged by channel ID, and a null entry clears that channel's setting.
+func RpcSetNotificationPrefs(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(NotificationPrefsResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Timezone *string                       `json:"timezone"`
+		DND      *[]DNDWindow                  `json:"dnd"`
+		Channels map[string]*ChannelNotifyPref `json:"channels"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(NotificationPrefsResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Timezone != nil && *request.Timezone != "" {
+		if _, err := time.LoadLocation(*request.Timezone); err != nil {
+			return marshalResponse(NotificationPrefsResponse{Success: false, Error: fmt.Sprintf("Unknown timezone: %s", *request.Timezone), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.DND != nil {
+		if len(*request.DND) > NOTIFICATION_PREFS_MAX_WINDOWS {
+			return marshalResponse(NotificationPrefsResponse{Success: false, Error: fmt.Sprintf("dnd cannot exceed %d windows", NOTIFICATION_PREFS_MAX_WINDOWS), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		for _, w := range *request.DND {
+			if !dndTimePattern.MatchString(w.Start) || !dndTimePattern.MatchString(w.End) {
+				return marshalResponse(NotificationPrefsResponse{Success: false, Error: "dnd start and end must be HH:MM", Code: ERROR_CODE_PAYLOAD_INVALID})
+			}
+			for _, d := range w.Days {
+				if d < 0 || d > 6 {
+					return marshalResponse(NotificationPrefsResponse{Success: false, Error: "dnd days must be between 0 (Sunday) and 6", Code: ERROR_CODE_PAYLOAD_INVALID})
+				}
+			}
+		}
+	}
+	for channelID, pref := range request.Channels {
+		if _, err := parseChannelID(channelID); err != nil {
+			return marshalResponse(NotificationPrefsResponse{Success: false, Error: fmt.Sprintf("Invalid channel ID: %s", channelID), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		if pref != nil && pref.Mode != "" && pref.Mode != CHANNEL_NOTIFY_ALL && pref.Mode != CHANNEL_NOTIFY_MENTIONS && pref.Mode != CHANNEL_NOTIFY_NONE {
+			return marshalResponse(NotificationPrefsResponse{Success: false, Error: fmt.Sprintf("mode must be %s, %s or %s", CHANNEL_NOTIFY_ALL, CHANNEL_NOTIFY_MENTIONS, CHANNEL_NOTIFY_NONE), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < NOTIFICATION_PREFS_WRITE_ATTEMPTS; attempt++ {
+		stored, versions, err := readNotificationPrefs(ctx, nk, []string{userID})
+		if err != nil {
+			return marshalResponse(NotificationPrefsResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		prefs, version := stored[userID], versions[userID]
+		if prefs == nil {
+			prefs, version = &NotificationPrefs{}, "*"
+		}
+
+		now := time.Now()
+		if request.Timezone != nil {
+			prefs.Timezone = *request.Timezone
+		}
+		if request.DND != nil {
+			prefs.DND = *request.DND
+		}
+		if prefs.Channels == nil {
+			prefs.Channels = map[string]*ChannelNotifyPref{}
+		}
+		for channelID, pref := range request.Channels {
+			if pref == nil {
+				delete(prefs.Channels, channelID)
+				continue
+			}
+			prefs.Channels[channelID] = pref
+		}
+		// Entries that no longer change anything are dropped to keep the record small
+		for channelID, pref := range prefs.Channels {
+			if (pref.Mode == "" || pref.Mode == CHANNEL_NOTIFY_ALL) && pref.MutedUntil <= now.Unix() {
+				delete(prefs.Channels, channelID)
+			}
+		}
+		if len(prefs.Channels) > NOTIFICATION_PREFS_MAX_CHANNELS {
+			return marshalResponse(NotificationPrefsResponse{Success: false, Error: fmt.Sprintf("channels cannot exceed %d", NOTIFICATION_PREFS_MAX_CHANNELS), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		prefs.UpdatedAt = now.Unix()
+
+		value, _ := json.Marshal(prefs)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      NOTIFICATION_PREFS_COLLECTION,
+			Key:             NOTIFICATION_PREFS_KEY,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return marshalResponse(NotificationPrefsResponse{Success: true, Prefs: prefs, InDND: prefs.inDND(now)})
+		}
+	}
+	return marshalResponse(NotificationPrefsResponse{Success: false, Error: fmt.Sprintf("Failed to save notification preferences: %v", lastErr), Code: ERROR_CODE_INTERNAL})
+}
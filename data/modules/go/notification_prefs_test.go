@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestNotificationPrefsInDND(t *testing.T) {
+	// 2024-03-10 is a Sunday
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	night := DNDWindow{Start: "22:00", End: "07:00"}
+	lunch := DNDWindow{Start: "12:00", End: "13:00"}
+	weekdayNights := DNDWindow{Days: []int{1, 2, 3, 4, 5}, Start: "23:00", End: "06:00"}
+
+	tests := []struct {
+		name  string
+		prefs NotificationPrefs
+		now   string
+		want  bool
+	}{
+		{"no windows", NotificationPrefs{}, "2024-03-10T12:30:00Z", false},
+		{"inside a daytime window", NotificationPrefs{DND: []DNDWindow{lunch}}, "2024-03-10T12:30:00Z", true},
+		{"start is inclusive", NotificationPrefs{DND: []DNDWindow{lunch}}, "2024-03-10T12:00:00Z", true},
+		{"end is exclusive", NotificationPrefs{DND: []DNDWindow{lunch}}, "2024-03-10T13:00:00Z", false},
+		{"overnight evening part", NotificationPrefs{DND: []DNDWindow{night}}, "2024-03-10T23:15:00Z", true},
+		{"overnight morning part", NotificationPrefs{DND: []DNDWindow{night}}, "2024-03-10T06:59:00Z", true},
+		{"after an overnight window", NotificationPrefs{DND: []DNDWindow{night}}, "2024-03-10T07:00:00Z", false},
+		{"any window matches", NotificationPrefs{DND: []DNDWindow{lunch, night}}, "2024-03-10T02:00:00Z", true},
+		{"weekday window on Sunday evening", NotificationPrefs{DND: []DNDWindow{weekdayNights}}, "2024-03-10T23:30:00Z", false},
+		{"weekday window on Monday morning started Sunday", NotificationPrefs{DND: []DNDWindow{weekdayNights}}, "2024-03-11T03:00:00Z", false},
+		{"weekday window on Monday evening", NotificationPrefs{DND: []DNDWindow{weekdayNights}}, "2024-03-11T23:30:00Z", true},
+		{"weekday window on Saturday morning started Friday", NotificationPrefs{DND: []DNDWindow{weekdayNights}}, "2024-03-09T05:00:00Z", true},
+		{"window read in the user's timezone", NotificationPrefs{Timezone: "Asia/Bangkok", DND: []DNDWindow{night}}, "2024-03-10T16:00:00Z", true},
+		{"same instant in UTC", NotificationPrefs{DND: []DNDWindow{night}}, "2024-03-10T16:00:00Z", false},
+		{"unknown timezone is UTC", NotificationPrefs{Timezone: "Mars/Olympus", DND: []DNDWindow{lunch}}, "2024-03-10T12:30:00Z", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.prefs.inDND(at(tt.now)); got != tt.want {
+				t.Errorf("inDND(%s) = %v, want %v", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotificationPrefsAllowsPush(t *testing.T) {
+	now := time.Date(2024, 3, 10, 15, 0, 0, 0, time.UTC)
+	prefs := NotificationPrefs{Channels: map[string]*ChannelNotifyPref{
+		"muted":    {MutedUntil: now.Add(time.Hour).Unix()},
+		"unmuted":  {MutedUntil: now.Add(-time.Hour).Unix()},
+		"none":     {Mode: CHANNEL_NOTIFY_NONE},
+		"mentions": {Mode: CHANNEL_NOTIFY_MENTIONS},
+		"all":      {Mode: CHANNEL_NOTIFY_ALL},
+	}}
+	quiet := prefs
+	quiet.DND = []DNDWindow{{Start: "14:00", End: "16:00"}}
+
+	tests := []struct {
+		name      string
+		prefs     NotificationPrefs
+		channelID string
+		mentioned bool
+		want      bool
+	}{
+		{"no preference", prefs, "other", false, true},
+		{"muted channel", prefs, "muted", true, false},
+		{"expired mute", prefs, "unmuted", false, true},
+		{"mode none", prefs, "none", true, false},
+		{"mentions only without mention", prefs, "mentions", false, false},
+		{"mentions only with mention", prefs, "mentions", true, true},
+		{"mode all", prefs, "all", false, true},
+		{"dnd wins over mentions", quiet, "mentions", true, false},
+		{"dnd wins over no preference", quiet, "other", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.prefs.allowsPush(tt.channelID, tt.mentioned, now); got != tt.want {
+				t.Errorf("allowsPush(%q, %v) = %v, want %v", tt.channelID, tt.mentioned, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinutesOf(t *testing.T) {
+	tests := map[string]int{"00:00": 0, "07:30": 450, "23:59": 1439}
+	for clock, want := range tests {
+		if got := minutesOf(clock); got != want {
+			t.Errorf("minutesOf(%q) = %d, want %d", clock, got, want)
+		}
+	}
+}
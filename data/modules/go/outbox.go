@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	OUTBOX_COLLECTION     = "outbox_delivered"
+	OUTBOX_MAX_BATCH      = 50
+	OUTBOX_MAX_CLIENT_ID  = 128
+	OUTBOX_STATUS_SENT    = "sent"
+	OUTBOX_STATUS_DUP     = "duplicate"
+	OUTBOX_STATUS_FAILED  = "failed"
+	OUTBOX_STATUS_BLOCKED = "blocked"
+	// OUTBOX_RETENTION is how long a delivered client ID is remembered. Clients replay their outbox well within it.
+	OUTBOX_RETENTION = 7 * 24 * time.Hour
+)
+
+// OutboxItem is a message composed while the client was offline
+type OutboxItem struct {
+	ClientID        string                 `json:"clientId"`
+	ChannelID       string                 `json:"channelId"`
+	Content         map[string]interface{} `json:"content"`
+	ClientTimestamp int64                  `json:"clientTimestamp"`
+}
+
+// OutboxResult is the delivery outcome of one outbox item
+type OutboxResult struct {
+	ClientID  string `json:"clientId"`
+	Status    string `json:"status"`
+	MessageID string `json:"messageId,omitempty"`
+	CreatedAt int64  `json:"createdAt,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// OutboxResponse represents the response for flush_outbox
+type OutboxResponse struct {
+	Success bool           `json:"success"`
+	Results []OutboxResult `json:"results,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Code    string         `json:"code,omitempty"`
+}
+
+// outboxDelivery is the dedup record kept per delivered client message ID
+type outboxDelivery struct {
+	ChannelID string `json:"channelId"`
+	MessageID string `json:"messageId"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// readOutboxDeliveries loads the dedup records for the given client IDs
+func readOutboxDeliveries(ctx context.Context, nk nkruntime.NakamaModule, userID string, items []OutboxItem) (map[string]outboxDelivery, error) {
+	reads := make([]*nkruntime.StorageRead, 0, len(items))
+	for _, item := range items {
+		reads = append(reads, &nkruntime.StorageRead{Collection: OUTBOX_COLLECTION, Key: item.ClientID, UserID: userID})
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delivered messages: %v", err)
+	}
+
+	delivered := make(map[string]outboxDelivery, len(objects))
+	for _, obj := range objects {
+		var d outboxDelivery
+		if err := json.Unmarshal([]byte(obj.Value), &d); err == nil {
+			delivered[obj.Key] = d
+		}
+	}
+	return delivered, nil
+}
+
+// reserveOutboxItem claims a client ID before sending so concurrent flushes cannot deliver it twice
+func reserveOutboxItem(ctx context.Context, nk nkruntime.NakamaModule, userID string, item OutboxItem) (string, error) {
+	value, _ := json.Marshal(outboxDelivery{ChannelID: item.ChannelID})
+	acks, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      OUTBOX_COLLECTION,
+		Key:             item.ClientID,
+		UserID:          userID,
+		Value:           string(value),
+		Version:         "*",
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}})
+	if err != nil {
+		return "", err
+	}
+	return acks[0].Version, nil
+}
+
+// RpcFlushOutbox replays messages queued offline, skipping any already delivered and keeping per-channel order
+func RpcFlushOutbox(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(OutboxResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Items []OutboxItem `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(OutboxResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Items) == 0 {
+		return marshalResponse(OutboxResponse{Success: true, Results: []OutboxResult{}})
+	}
+	if len(request.Items) > OUTBOX_MAX_BATCH {
+		return marshalResponse(OutboxResponse{Success: false, Error: fmt.Sprintf("Batch cannot exceed %d items", OUTBOX_MAX_BATCH), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	seen := make(map[string]bool, len(request.Items))
+	for _, item := range request.Items {
+		if item.ClientID == "" || len(item.ClientID) > OUTBOX_MAX_CLIENT_ID {
+			return marshalResponse(OutboxResponse{Success: false, Error: "Every item needs a clientId of at most 128 characters", Code: ERROR_CODE_REJECTED})
+		}
+		if seen[item.ClientID] {
+			return marshalResponse(OutboxResponse{Success: false, Error: fmt.Sprintf("Duplicate clientId in batch: %s", item.ClientID), Code: ERROR_CODE_REJECTED})
+		}
+		seen[item.ClientID] = true
+	}
+
+	// Deliver in the order the messages were composed; ties keep the order the client sent them in
+	items := make([]OutboxItem, len(request.Items))
+	copy(items, request.Items)
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].ClientTimestamp < items[j].ClientTimestamp
+	})
+
+	delivered, err := readOutboxDeliveries(ctx, nk, userID, items)
+	if err != nil {
+		return marshalResponse(OutboxResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	username := usernameFromContext(ctx)
+	membership := make(map[string]bool)
+	blocked := make(map[string]bool)
+	results := make(map[string]OutboxResult, len(items))
+
+	for _, item := range items {
+		result := OutboxResult{ClientID: item.ClientID}
+
+		if d, ok := delivered[item.ClientID]; ok {
+			result.Status = OUTBOX_STATUS_DUP
+			result.MessageID = d.MessageID
+			result.CreatedAt = d.CreatedAt
+			results[item.ClientID] = result
+			continue
+		}
+
+		// Once an item fails, later items in the same channel are held back so they are never delivered out of order
+		if blocked[item.ChannelID] {
+			result.Status = OUTBOX_STATUS_BLOCKED
+			result.Code = ERROR_CODE_REJECTED
+			result.Error = "An earlier message in this channel failed"
+			results[item.ClientID] = result
+			continue
+		}
+
+		fail := func(code, msg string) {
+			result.Status = OUTBOX_STATUS_FAILED
+			result.Code = code
+			result.Error = msg
+			results[item.ClientID] = result
+			blocked[item.ChannelID] = true
+		}
+
+		if len(item.Content) == 0 {
+			fail(ERROR_CODE_PAYLOAD_INVALID, "Missing content")
+			continue
+		}
+		member, checked := membership[item.ChannelID]
+		if !checked {
+			member, err = isChannelMember(ctx, nk, item.ChannelID, userID)
+			if err != nil {
+				fail(errorCodeOf(err), err.Error())
+				continue
+			}
+			membership[item.ChannelID] = member
+		}
+		if !member {
+			fail(ERROR_CODE_NOT_A_MEMBER, "Not a member of this channel")
+			continue
+		}
+
+		version, err := reserveOutboxItem(ctx, nk, userID, item)
+		if err != nil {
+			// Another flush claimed this client ID between our read and write
+			result.Status = OUTBOX_STATUS_DUP
+			results[item.ClientID] = result
+			continue
+		}
+
+		content := make(map[string]interface{}, len(item.Content)+2)
+		for k, v := range item.Content {
+			content[k] = v
+		}
+		content["clientId"] = item.ClientID
+		if item.ClientTimestamp > 0 {
+			content["clientTimestamp"] = item.ClientTimestamp
+		}
+
+		message, err := sendMessageAs(ctx, logger, db, nk, userID, username, item.ChannelID, content)
+		if err != nil {
+			// Release the client ID so the item can be retried
+			_ = nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: OUTBOX_COLLECTION, Key: item.ClientID, UserID: userID, Version: version}})
+			fail(errorCodeOf(err), err.Error())
+			continue
+		}
+
+		record := outboxDelivery{ChannelID: item.ChannelID, MessageID: message.MessageID, CreatedAt: message.CreatedAt}
+		value, _ := json.Marshal(record)
+		if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      OUTBOX_COLLECTION,
+			Key:             item.ClientID,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		}}); err != nil {
+			logger.Warn("Failed to record delivery of %s: %v", item.ClientID, err)
+		}
+
+		result.Status = OUTBOX_STATUS_SENT
+		result.MessageID = record.MessageID
+		result.CreatedAt = record.CreatedAt
+		results[item.ClientID] = result
+	}
+
+	// Report results in the order the client submitted them
+	ordered := make([]OutboxResult, 0, len(request.Items))
+	for _, item := range request.Items {
+		ordered = append(ordered, results[item.ClientID])
+	}
+
+	logger.Info("Flushed outbox for %s: %d items", userID, len(ordered))
+	return marshalResponse(OutboxResponse{Success: true, Results: ordered})
+}
+
+// pruneOutboxDeliveries drops the dedup records last written more than OUTBOX_RETENTION ago. A record only
+// holding a reservation is dropped too, so a client ID whose flush died mid-send can be replayed again.
+func pruneOutboxDeliveries(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule) error {
+	cutoff := time.Now().Add(-OUTBOX_RETENTION).Unix()
+	var expired []*nkruntime.StorageDelete
+	cursor := ""
+	for {
+		objects, next, err := nk.StorageList(ctx, "", "", OUTBOX_COLLECTION, ORPHAN_GC_LIST_PAGE_SIZE, cursor)
+		if err != nil {
+			return fmt.Errorf("failed to list delivered messages: %v", err)
+		}
+		for _, object := range objects {
+			if object.UpdateTime != nil && object.UpdateTime.Seconds < cutoff {
+				// The version keeps a record rewritten since the listing
+				expired = append(expired, &nkruntime.StorageDelete{Collection: OUTBOX_COLLECTION, Key: object.Key, UserID: object.UserId, Version: object.Version})
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	// Deleting while listing would shift the cursor, so the listing finishes first
+	for start := 0; start < len(expired); start += ORPHAN_GC_LIST_PAGE_SIZE {
+		end := min(start+ORPHAN_GC_LIST_PAGE_SIZE, len(expired))
+		if err := nk.StorageDelete(ctx, expired[start:end]); err != nil {
+			return fmt.Errorf("failed to delete delivered messages: %v", err)
+		}
+	}
+	if len(expired) > 0 {
+		logger.Info("Pruned %d outbox delivery records", len(expired))
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	PARTY_COLLECTION       = "parties"
+	PARTY_STREAM_MODE      = 100
+	PARTY_DEFAULT_MAX_SIZE = 8
+	PARTY_MAX_SIZE_LIMIT   = 32
+	PARTY_WRITE_ATTEMPTS   = 3
+)
+
+// Party is a short-lived group of users sharing a chat stream
+type Party struct {
+	ID        string   `json:"id"`
+	Label     string   `json:"label"`
+	LeaderID  string   `json:"leaderId"`
+	Members   []string `json:"members"`
+	MaxSize   int      `json:"maxSize"`
+	CreatedAt int64    `json:"createdAt"`
+}
+
+// PartyResponse represents the response for party RPCs
+type PartyResponse struct {
+	Success bool     `json:"success"`
+	Party   *Party   `json:"party,omitempty"`
+	Online  []string `json:"online,omitempty"`
+	GroupID string   `json:"groupId,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Code    string   `json:"code,omitempty"`
+}
+
+// PartyEvent is the payload sent over the party stream
+type PartyEvent struct {
+	Type      string      `json:"type"`
+	PartyID   string      `json:"partyId"`
+	SenderID  string      `json:"senderId,omitempty"`
+	Username  string      `json:"username,omitempty"`
+	Content   interface{} `json:"content,omitempty"`
+	CreatedAt int64       `json:"createdAt"`
+}
+
+func (p *Party) hasMember(userID string) bool {
+	for _, m := range p.Members {
+		if m == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Party) removeMember(userID string) {
+	members := p.Members[:0]
+	for _, m := range p.Members {
+		if m != userID {
+			members = append(members, m)
+		}
+	}
+	p.Members = members
+}
+
+// readParty loads a party and its storage version
+func readParty(ctx context.Context, nk nkruntime.NakamaModule, partyID string) (*Party, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{
+		Collection: PARTY_COLLECTION,
+		Key:        partyID,
+	}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read party: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+
+	var party Party
+	if err := json.Unmarshal([]byte(objects[0].Value), &party); err != nil {
+		return nil, "", fmt.Errorf("failed to decode party: %v", err)
+	}
+	return &party, objects[0].Version, nil
+}
+
+// writeParty stores a party, failing if the stored version no longer matches
+func writeParty(ctx context.Context, nk nkruntime.NakamaModule, party *Party, version string) error {
+	value, err := json.Marshal(party)
+	if err != nil {
+		return fmt.Errorf("failed to encode party: %v", err)
+	}
+	_, err = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      PARTY_COLLECTION,
+		Key:             party.ID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// deleteParty removes the party record and closes its stream
+func deleteParty(ctx context.Context, nk nkruntime.NakamaModule, partyID string) error {
+	if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{
+		Collection: PARTY_COLLECTION,
+		Key:        partyID,
+	}}); err != nil {
+		return fmt.Errorf("failed to delete party: %v", err)
+	}
+	return nk.StreamClose(PARTY_STREAM_MODE, partyID, "", "")
+}
+
+// updateParty applies fn to the stored party, retrying on concurrent modification.
+// If fn leaves the party without members the party is deleted instead.
+func updateParty(ctx context.Context, nk nkruntime.NakamaModule, partyID string, fn func(*Party) error) (*Party, error) {
+	var lastErr error
+	for attempt := 0; attempt < PARTY_WRITE_ATTEMPTS; attempt++ {
+		party, version, err := readParty(ctx, nk, partyID)
+		if err != nil {
+			return nil, err
+		}
+		if party == nil {
+			return nil, errorWithCode(ERROR_CODE_NOT_FOUND, "party not found")
+		}
+		if err := fn(party); err != nil {
+			return nil, err
+		}
+		if len(party.Members) == 0 {
+			return party, deleteParty(ctx, nk, partyID)
+		}
+		if lastErr = writeParty(ctx, nk, party, version); lastErr == nil {
+			return party, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to update party: %v", lastErr)
+}
+
+// sendPartyEvent broadcasts an event to everyone connected to the party stream
+func sendPartyEvent(nk nkruntime.NakamaModule, event *PartyEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nk.StreamSend(PARTY_STREAM_MODE, event.PartyID, "", "", string(data), nil, true)
+}
+
+// joinPartyStream subscribes the calling socket session to the party stream, if there is one
+func joinPartyStream(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, partyID string) {
+	sessionID := sessionIDFromContext(ctx)
+	if sessionID == "" {
+		return
+	}
+	if _, err := nk.StreamUserJoin(PARTY_STREAM_MODE, partyID, "", "", userIDFromContext(ctx), sessionID, false, false, ""); err != nil {
+		logger.Warn("Failed to join party stream %s: %v", partyID, err)
+	}
+}
+
+// partyOnlineMembers lists the members currently connected to the party stream
+func partyOnlineMembers(nk nkruntime.NakamaModule, partyID string) []string {
+	presences, err := nk.StreamUserList(PARTY_STREAM_MODE, partyID, "", "", true, true)
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(presences))
+	online := make([]string, 0, len(presences))
+	for _, p := range presences {
+		if !seen[p.GetUserId()] {
+			seen[p.GetUserId()] = true
+			online = append(online, p.GetUserId())
+		}
+	}
+	return online
+}
+
+// RpcPartyCreate creates a new party led by the caller
+func RpcPartyCreate(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PartyResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Label   string `json:"label"`
+		MaxSize int    `json:"maxSize"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(PartyResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+
+	maxSize := request.MaxSize
+	if maxSize <= 0 {
+		maxSize = PARTY_DEFAULT_MAX_SIZE
+	}
+	if maxSize > PARTY_MAX_SIZE_LIMIT {
+		return marshalResponse(PartyResponse{Success: false, Error: fmt.Sprintf("maxSize cannot exceed %d", PARTY_MAX_SIZE_LIMIT), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	party := &Party{
+		ID:        uuid.New().String(),
+		Label:     request.Label,
+		LeaderID:  userID,
+		Members:   []string{userID},
+		MaxSize:   maxSize,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := writeParty(ctx, nk, party, "*"); err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: fmt.Sprintf("Failed to create party: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	joinPartyStream(ctx, logger, nk, party.ID)
+	logger.Info("Party %s created by %s", party.ID, userID)
+
+	return marshalResponse(PartyResponse{Success: true, Party: party, Online: partyOnlineMembers(nk, party.ID)})
+}
+
+// RpcPartyJoin adds the caller to an existing party
+func RpcPartyJoin(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PartyResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		PartyID string `json:"partyId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.PartyID == "" {
+		return marshalResponse(PartyResponse{Success: false, Error: "Missing required field: partyId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	party, err := updateParty(ctx, nk, request.PartyID, func(p *Party) error {
+		if p.hasMember(userID) {
+			return nil
+		}
+		if len(p.Members) >= p.MaxSize {
+			return errorWithCode(ERROR_CODE_REJECTED, "party is full")
+		}
+		p.Members = append(p.Members, userID)
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	joinPartyStream(ctx, logger, nk, party.ID)
+	logger.Info("User %s joined party %s", userID, party.ID)
+
+	return marshalResponse(PartyResponse{Success: true, Party: party, Online: partyOnlineMembers(nk, party.ID)})
+}
+
+// RpcPartyLeave removes the caller from a party, handing leadership over or disbanding it as needed
+func RpcPartyLeave(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PartyResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		PartyID string `json:"partyId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.PartyID == "" {
+		return marshalResponse(PartyResponse{Success: false, Error: "Missing required field: partyId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	party, err := updateParty(ctx, nk, request.PartyID, func(p *Party) error {
+		if !p.hasMember(userID) {
+			return errorWithCode(ERROR_CODE_NOT_A_MEMBER, "not a party member")
+		}
+		p.removeMember(userID)
+		if p.LeaderID == userID && len(p.Members) > 0 {
+			p.LeaderID = p.Members[0]
+		}
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	if len(party.Members) == 0 {
+		logger.Info("Party %s disbanded", party.ID)
+		return marshalResponse(PartyResponse{Success: true})
+	}
+
+	// Drop every session of the leaving user from the party stream
+	if presences, err := nk.StreamUserList(PARTY_STREAM_MODE, party.ID, "", "", true, true); err == nil {
+		for _, p := range presences {
+			if p.GetUserId() == userID {
+				_ = nk.StreamUserLeave(PARTY_STREAM_MODE, party.ID, "", "", userID, p.GetSessionId())
+			}
+		}
+	}
+	logger.Info("User %s left party %s", userID, party.ID)
+
+	return marshalResponse(PartyResponse{Success: true, Party: party})
+}
+
+// RpcPartyGet returns a party and which of its members are currently online
+func RpcPartyGet(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+
+	var request struct {
+		PartyID string `json:"partyId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.PartyID == "" {
+		return marshalResponse(PartyResponse{Success: false, Error: "Missing required field: partyId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	party, _, err := readParty(ctx, nk, request.PartyID)
+	if err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if party == nil || (userID != "" && !party.hasMember(userID)) {
+		return marshalResponse(PartyResponse{Success: false, Error: "Party not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	return marshalResponse(PartyResponse{Success: true, Party: party, Online: partyOnlineMembers(nk, party.ID)})
+}
+
+// RpcPartySendMessage relays a chat message to everyone connected to the party stream
+func RpcPartySendMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PartyResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		PartyID string                 `json:"partyId"`
+		Content map[string]interface{} `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.PartyID == "" || len(request.Content) == 0 {
+		return marshalResponse(PartyResponse{Success: false, Error: "Missing required fields: partyId or content", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	party, _, err := readParty(ctx, nk, request.PartyID)
+	if err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if party == nil || !party.hasMember(userID) {
+		return marshalResponse(PartyResponse{Success: false, Error: "Party not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	event := &PartyEvent{
+		Type:      "message",
+		PartyID:   party.ID,
+		SenderID:  userID,
+		Username:  usernameFromContext(ctx),
+		Content:   request.Content,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := sendPartyEvent(nk, event); err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: fmt.Sprintf("Failed to send party message: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	return marshalResponse(PartyResponse{Success: true})
+}
+
+// RpcPartyConvertToGroup turns a party into a permanent Nakama group owned by the party leader
+func RpcPartyConvertToGroup(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PartyResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		PartyID     string `json:"partyId"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Open        bool   `json:"open"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.PartyID == "" || request.Name == "" {
+		return marshalResponse(PartyResponse{Success: false, Error: "Missing required fields: partyId or name", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	party, _, err := readParty(ctx, nk, request.PartyID)
+	if err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if party == nil || !party.hasMember(userID) {
+		return marshalResponse(PartyResponse{Success: false, Error: "Party not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	if party.LeaderID != userID {
+		return marshalResponse(PartyResponse{Success: false, Error: "Only the party leader can convert the party", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	group, err := nk.GroupCreate(ctx, userID, request.Name, userID, "", request.Description, "", request.Open, map[string]interface{}{"fromParty": party.ID}, 0)
+	if err != nil {
+		return marshalResponse(PartyResponse{Success: false, Error: fmt.Sprintf("Failed to create group: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	others := make([]string, 0, len(party.Members))
+	for _, m := range party.Members {
+		if m != userID {
+			others = append(others, m)
+		}
+	}
+	if len(others) > 0 {
+		if err := nk.GroupUsersAdd(ctx, userID, group.Id, others); err != nil {
+			logger.Error("Failed to add party members to group %s: %v", group.Id, err)
+		}
+	}
+
+	event := &PartyEvent{
+		Type:      "converted",
+		PartyID:   party.ID,
+		SenderID:  userID,
+		Content:   map[string]interface{}{"groupId": group.Id},
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := sendPartyEvent(nk, event); err != nil {
+		logger.Warn("Failed to announce party conversion: %v", err)
+	}
+	if err := deleteParty(ctx, nk, party.ID); err != nil {
+		logger.Warn("Failed to clean up converted party %s: %v", party.ID, err)
+	}
+
+	logger.Info("Party %s converted to group %s", party.ID, group.Id)
+	return marshalResponse(PartyResponse{Success: true, GroupID: group.Id})
+}
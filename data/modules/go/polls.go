@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	POLL_COLLECTION     = "polls"
+	POLL_WRITE_ATTEMPTS = 3
+	POLL_MIN_OPTIONS    = 2
+	POLL_MAX_OPTIONS    = 10
+	POLL_MAX_QUESTION   = 300
+	POLL_MAX_OPTION     = 100
+	// POLL_MAX_DURATION_SECONDS is how far in the future closesAt may be
+	POLL_MAX_DURATION_SECONDS = 30 * 24 * 3600
+	// POLL_MESSAGE_TYPE is the content type of the message create_poll sends
+	POLL_MESSAGE_TYPE = "poll"
+)
+
+// PollOption is one answer of a poll
+type PollOption struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// Poll is the system-owned record of a poll, keyed by poll ID. Votes maps each voter to the options they chose,
+// so every user has at most one ballot.
+type Poll struct {
+	ID             string              `json:"id"`
+	ChannelID      string              `json:"channelId"`
+	MessageID      string              `json:"messageId,omitempty"`
+	CreatorID      string              `json:"creatorId"`
+	Question       string              `json:"question"`
+	Options        []PollOption        `json:"options"`
+	MultipleChoice bool                `json:"multipleChoice,omitempty"`
+	Anonymous      bool                `json:"anonymous,omitempty"`
+	Votes          map[string][]string `json:"votes"`
+	CreatedAt      int64               `json:"createdAt"`
+	// ClosesAt is when voting ends, 0 for a poll that stays open
+	ClosesAt int64 `json:"closesAt,omitempty"`
+}
+
+// PollOptionResult is the tally of one option
+type PollOptionResult struct {
+	ID    string `json:"id"`
+	Text  string `json:"text"`
+	Votes int    `json:"votes"`
+	// Voters lists who chose the option, omitted for anonymous polls
+	Voters []string `json:"voters,omitempty"`
+}
+
+// PollResults is the current state of a poll as clients see it
+type PollResults struct {
+	PollID         string              `json:"pollId"`
+	ChannelID      string              `json:"channelId"`
+	MessageID      string              `json:"messageId,omitempty"`
+	Question       string              `json:"question"`
+	Options        []*PollOptionResult `json:"options"`
+	TotalVoters    int                 `json:"totalVoters"`
+	MultipleChoice bool                `json:"multipleChoice,omitempty"`
+	Anonymous      bool                `json:"anonymous,omitempty"`
+	ClosesAt       int64               `json:"closesAt,omitempty"`
+	Closed         bool                `json:"closed"`
+}
+
+// PollResponse represents the response for poll RPCs
+type PollResponse struct {
+	Success bool         `json:"success"`
+	Results *PollResults `json:"results,omitempty"`
+	// MyVotes are the options the caller chose
+	MyVotes []string `json:"myVotes,omitempty"`
+	Code    string   `json:"code,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// isClosed reports whether voting on a poll has ended
+func (p *Poll) isClosed() bool {
+	return p.ClosesAt > 0 && time.Now().Unix() >= p.ClosesAt
+}
+
+// results tallies the votes of a poll
+func (p *Poll) results() *PollResults {
+	results := &PollResults{
+		PollID:         p.ID,
+		ChannelID:      p.ChannelID,
+		MessageID:      p.MessageID,
+		Question:       p.Question,
+		Options:        make([]*PollOptionResult, 0, len(p.Options)),
+		TotalVoters:    len(p.Votes),
+		MultipleChoice: p.MultipleChoice,
+		Anonymous:      p.Anonymous,
+		ClosesAt:       p.ClosesAt,
+		Closed:         p.isClosed(),
+	}
+	byID := make(map[string]*PollOptionResult, len(p.Options))
+	for _, option := range p.Options {
+		result := &PollOptionResult{ID: option.ID, Text: option.Text}
+		byID[option.ID] = result
+		results.Options = append(results.Options, result)
+	}
+	for voterID, choices := range p.Votes {
+		for _, id := range choices {
+			if result := byID[id]; result != nil {
+				result.Votes++
+				if !p.Anonymous {
+					result.Voters = append(result.Voters, voterID)
+				}
+			}
+		}
+	}
+	return results
+}
+
+// readPoll loads a poll, nil if there is none
+func readPoll(ctx context.Context, nk nkruntime.NakamaModule, pollID string) (*Poll, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: POLL_COLLECTION, Key: pollID}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read poll: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	var poll Poll
+	if err := json.Unmarshal([]byte(objects[0].Value), &poll); err != nil {
+		return nil, "", fmt.Errorf("failed to decode poll: %v", err)
+	}
+	if poll.Votes == nil {
+		poll.Votes = map[string][]string{}
+	}
+	return &poll, objects[0].Version, nil
+}
+
+// writePoll stores a poll; version "*" creates it
+func writePoll(ctx context.Context, nk nkruntime.NakamaModule, poll *Poll, version string) error {
+	value, _ := json.Marshal(poll)
+	_, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      POLL_COLLECTION,
+		Key:             poll.ID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// updatePoll applies fn to a poll, retrying on concurrent votes
+func updatePoll(ctx context.Context, nk nkruntime.NakamaModule, pollID string, fn func(*Poll) error) (*Poll, error) {
+	var lastErr error
+	for attempt := 0; attempt < POLL_WRITE_ATTEMPTS; attempt++ {
+		poll, version, err := readPoll(ctx, nk, pollID)
+		if err != nil {
+			return nil, err
+		}
+		if poll == nil {
+			return nil, errorWithCode(ERROR_CODE_NOT_FOUND, "Poll not found")
+		}
+		if err := fn(poll); err != nil {
+			return nil, err
+		}
+		if lastErr = writePoll(ctx, nk, poll, version); lastErr == nil {
+			return poll, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to update poll: %v", lastErr)
+}
+
+// readMemberPoll loads a poll the caller can see, as a member of its channel
+func readMemberPoll(ctx context.Context, nk nkruntime.NakamaModule, userID, pollID string) (*Poll, error) {
+	if _, err := uuid.Parse(pollID); err != nil {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid pollId")
+	}
+	poll, _, err := readPoll(ctx, nk, pollID)
+	if err != nil {
+		return nil, err
+	}
+	if poll == nil {
+		return nil, errorWithCode(ERROR_CODE_NOT_FOUND, "Poll not found")
+	}
+	member, err := isChannelMember(ctx, nk, poll.ChannelID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, errorWithCode(ERROR_CODE_NOT_A_MEMBER, "Not a member of this channel")
+	}
+	return poll, nil
+}
+
+// sendPollEvent tells the channel a poll's results changed
+func sendPollEvent(logger nkruntime.Logger, nk nkruntime.NakamaModule, poll *Poll) {
+	event := &ChannelEvent{
+		Type:      "poll_updated",
+		ChannelID: poll.ChannelID,
+		MessageID: poll.MessageID,
+		Content:   poll.results(),
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := sendChannelEvent(nk, event); err != nil {
+		logger.Warn("Failed to send poll_updated event for %s: %v", poll.ID, err)
+	}
+}
+
+// RpcCreatePoll stores a poll and sends it to the channel as a message from the caller
+func RpcCreatePoll(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PollResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID      string   `json:"channelId"`
+		Question       string   `json:"question"`
+		Options        []string `json:"options"`
+		MultipleChoice bool     `json:"multipleChoice"`
+		Anonymous      bool     `json:"anonymous"`
+		ClosesAt       int64    `json:"closesAt"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PollResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	request.Question = strings.TrimSpace(request.Question)
+	if request.ChannelID == "" || request.Question == "" || len(request.Options) == 0 {
+		return marshalResponse(PollResponse{Success: false, Error: "Missing required fields: channelId, question, or options", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if utf8.RuneCountInString(request.Question) > POLL_MAX_QUESTION {
+		return marshalResponse(PollResponse{Success: false, Error: fmt.Sprintf("question cannot exceed %d characters", POLL_MAX_QUESTION), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Options) < POLL_MIN_OPTIONS || len(request.Options) > POLL_MAX_OPTIONS {
+		return marshalResponse(PollResponse{Success: false, Error: fmt.Sprintf("options must be between %d and %d answers", POLL_MIN_OPTIONS, POLL_MAX_OPTIONS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	now := time.Now().Unix()
+	if request.ClosesAt != 0 && (request.ClosesAt <= now || request.ClosesAt > now+POLL_MAX_DURATION_SECONDS) {
+		return marshalResponse(PollResponse{Success: false, Error: "closesAt must be in the next 30 days", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	poll := &Poll{
+		ID:             uuid.New().String(),
+		ChannelID:      request.ChannelID,
+		CreatorID:      userID,
+		Question:       request.Question,
+		Options:        make([]PollOption, 0, len(request.Options)),
+		MultipleChoice: request.MultipleChoice,
+		Anonymous:      request.Anonymous,
+		Votes:          map[string][]string{},
+		CreatedAt:      now,
+		ClosesAt:       request.ClosesAt,
+	}
+	seen := map[string]bool{}
+	for i, text := range request.Options {
+		text = strings.TrimSpace(text)
+		if text == "" || utf8.RuneCountInString(text) > POLL_MAX_OPTION {
+			return marshalResponse(PollResponse{Success: false, Error: fmt.Sprintf("options must be 1 to %d characters", POLL_MAX_OPTION), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		if seen[strings.ToLower(text)] {
+			return marshalResponse(PollResponse{Success: false, Error: fmt.Sprintf("Invalid options: %q is listed twice", text), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		seen[strings.ToLower(text)] = true
+		poll.Options = append(poll.Options, PollOption{ID: fmt.Sprintf("%d", i+1), Text: text})
+	}
+
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil {
+		return marshalResponse(PollResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if !member {
+		return marshalResponse(PollResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+
+	// The poll exists before its message, so nobody can see the message and fail to vote
+	if err := writePoll(ctx, nk, poll, "*"); err != nil {
+		return marshalResponse(PollResponse{Success: false, Error: fmt.Sprintf("Failed to store poll: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	// The question is the message's text, so it is filtered, indexed and previewed like any other
+	content := map[string]interface{}{
+		"type":           POLL_MESSAGE_TYPE,
+		"pollId":         poll.ID,
+		"text":           poll.Question,
+		"options":        poll.Options,
+		"multipleChoice": poll.MultipleChoice,
+		"anonymous":      poll.Anonymous,
+	}
+	if poll.ClosesAt > 0 {
+		content["closesAt"] = poll.ClosesAt
+	}
+	message, err := sendMessageAs(ctx, logger, db, nk, userID, usernameFromContext(ctx), request.ChannelID, content)
+	if err != nil {
+		if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: POLL_COLLECTION, Key: poll.ID}}); err != nil {
+			logger.Warn("Failed to delete poll %s of a message that was not sent: %v", poll.ID, err)
+		}
+		return marshalResponse(PollResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	if updated, err := updatePoll(ctx, nk, poll.ID, func(p *Poll) error {
+		p.MessageID = message.MessageID
+		if text, ok := content["text"].(string); ok {
+			p.Question = text
+		}
+		return nil
+	}); err != nil {
+		logger.Warn("Failed to link poll %s to message %s: %v", poll.ID, message.MessageID, err)
+	} else {
+		poll = updated
+	}
+	return marshalResponse(PollResponse{Success: true, Results: poll.results()})
+}
+
+// RpcVotePoll replaces the caller's ballot with the given options; no options withdraws the vote.
+// Every change is broadcast to the channel as a poll_updated event with the new tally.
+func RpcVotePoll(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PollResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		PollID    string   `json:"pollId"`
+		OptionIDs []string `json:"optionIds"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PollResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.PollID == "" {
+		return marshalResponse(PollResponse{Success: false, Error: "Missing required field: pollId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if _, err := readMemberPoll(ctx, nk, userID, request.PollID); err != nil {
+		return marshalResponse(PollResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	changed := false
+	poll, err := updatePoll(ctx, nk, request.PollID, func(p *Poll) error {
+		if p.isClosed() {
+			return errorWithCode(ERROR_CODE_REJECTED, "Poll is closed")
+		}
+		if len(request.OptionIDs) > 1 && !p.MultipleChoice {
+			return errorWithCode(ERROR_CODE_REJECTED, "This poll allows a single option")
+		}
+		valid := make(map[string]bool, len(p.Options))
+		for _, option := range p.Options {
+			valid[option.ID] = true
+		}
+		choices := make([]string, 0, len(request.OptionIDs))
+		chosen := map[string]bool{}
+		for _, id := range request.OptionIDs {
+			if !valid[id] {
+				return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Unknown option: %s", id)
+			}
+			if !chosen[id] {
+				chosen[id] = true
+				choices = append(choices, id)
+			}
+		}
+
+		previous := p.Votes[userID]
+		changed = len(previous) != len(choices)
+		for _, id := range previous {
+			changed = changed || !chosen[id]
+		}
+		if len(choices) == 0 {
+			delete(p.Votes, userID)
+		} else {
+			p.Votes[userID] = choices
+		}
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(PollResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	if changed {
+		sendPollEvent(logger, nk, poll)
+	}
+	return marshalResponse(PollResponse{Success: true, Results: poll.results(), MyVotes: poll.Votes[userID]})
+}
+
+// RpcGetPollResults returns the tally of a poll and the caller's own votes to channel members
+func RpcGetPollResults(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PollResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		PollID string `json:"pollId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PollResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.PollID == "" {
+		return marshalResponse(PollResponse{Success: false, Error: "Missing required field: pollId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	poll, err := readMemberPoll(ctx, nk, userID, request.PollID)
+	if err != nil {
+		return marshalResponse(PollResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(PollResponse{Success: true, Results: poll.results(), MyVotes: poll.Votes[userID]})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/heroiclabs/nakama-common/api"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	PRESENCE_COLLECTION = "presence"
+	PRESENCE_KEY        = "status"
+	// PRESENCE_STREAM_MODE is the stream each session joins to receive its user's friends' presence changes,
+	// with the user's ID as subject
+	PRESENCE_STREAM_MODE = 102
+	// NOTIFICATION_STREAM_MODE is Nakama's own stream that every socket session of a user is on
+	NOTIFICATION_STREAM_MODE   = 0
+	PRESENCE_MAX_USERS         = 100
+	PRESENCE_FRIENDS_PAGE_SIZE = 100
+)
+
+// PresenceStatus is the stored status of a user, saved when their first session starts and their last one ends
+type PresenceStatus struct {
+	Online bool `json:"online"`
+	// LastSeen is when the user last connected or disconnected, in Unix seconds
+	LastSeen int64 `json:"lastSeen"`
+}
+
+// UserPresence is the presence of one user as returned by get_presence and published to friends
+type UserPresence struct {
+	Type     string `json:"type,omitempty"`
+	UserID   string `json:"userId"`
+	Username string `json:"username,omitempty"`
+	Online   bool   `json:"online"`
+	LastSeen int64  `json:"lastSeen,omitempty"`
+}
+
+// PresenceResponse represents the response for presence RPCs
+type PresenceResponse struct {
+	Success   bool            `json:"success"`
+	Presences []*UserPresence `json:"presences,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Code      string          `json:"code,omitempty"`
+}
+
+// writePresence stores a user's status
+func writePresence(ctx context.Context, nk nkruntime.NakamaModule, userID string, presence *PresenceStatus) error {
+	value, err := json.Marshal(presence)
+	if err != nil {
+		return fmt.Errorf("failed to encode presence: %v", err)
+	}
+	_, err = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      PRESENCE_COLLECTION,
+		Key:             PRESENCE_KEY,
+		UserID:          userID,
+		Value:           string(value),
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}})
+	return err
+}
+
+// otherSessions counts the socket sessions of a user besides sessionID
+func otherSessions(nk nkruntime.NakamaModule, userID, sessionID string) (int, error) {
+	presences, err := nk.StreamUserList(NOTIFICATION_STREAM_MODE, userID, "", "", true, true)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, p := range presences {
+		if p.GetSessionId() != sessionID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// publishPresence sends a presence change to every session of the user's mutual friends
+func publishPresence(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, presence *UserPresence) {
+	data, err := json.Marshal(presence)
+	if err != nil {
+		logger.Warn("Failed to encode presence of %s: %v", presence.UserID, err)
+		return
+	}
+
+	state := FRIEND_STATE_MUTUAL
+	cursor := ""
+	for {
+		friends, next, err := nk.FriendsList(ctx, presence.UserID, PRESENCE_FRIENDS_PAGE_SIZE, &state, cursor)
+		if err != nil {
+			logger.Warn("Failed to list friends of %s: %v", presence.UserID, err)
+			return
+		}
+		for _, f := range friends {
+			if f.User == nil {
+				continue
+			}
+			if err := nk.StreamSend(PRESENCE_STREAM_MODE, f.User.Id, "", "", string(data), nil, true); err != nil {
+				logger.Warn("Failed to publish presence of %s to %s: %v", presence.UserID, f.User.Id, err)
+			}
+		}
+		if next == "" {
+			return
+		}
+		cursor = next
+	}
+}
+
+// PresenceSessionStart returns the session start handler that subscribes the session to its presence stream
+// and marks the user online when it is their first session
+func PresenceSessionStart(nk nkruntime.NakamaModule) func(ctx context.Context, logger nkruntime.Logger, evt *api.Event) {
+	return func(ctx context.Context, logger nkruntime.Logger, evt *api.Event) {
+		userID := userIDFromContext(ctx)
+		sessionID := sessionIDFromContext(ctx)
+		if userID == "" || sessionID == "" {
+			return
+		}
+		if _, err := nk.StreamUserJoin(PRESENCE_STREAM_MODE, userID, "", "", userID, sessionID, true, false, ""); err != nil {
+			logger.Warn("Failed to join presence stream of %s: %v", userID, err)
+		}
+
+		others, err := otherSessions(nk, userID, sessionID)
+		if err != nil {
+			logger.Warn("Failed to list sessions of %s: %v", userID, err)
+		}
+		now := time.Now().Unix()
+		if err := writePresence(ctx, nk, userID, &PresenceStatus{Online: true, LastSeen: now}); err != nil {
+			logger.Warn("Failed to store presence of %s: %v", userID, err)
+		}
+		if others == 0 {
+			publishPresence(ctx, logger, nk, &UserPresence{Type: "presence", UserID: userID, Username: usernameFromContext(ctx), Online: true, LastSeen: now})
+		}
+	}
+}
+
+// PresenceSessionEnd returns the session end handler that marks the user offline when their last session ends
+func PresenceSessionEnd(nk nkruntime.NakamaModule) func(ctx context.Context, logger nkruntime.Logger, evt *api.Event) {
+	return func(ctx context.Context, logger nkruntime.Logger, evt *api.Event) {
+		userID := userIDFromContext(ctx)
+		if userID == "" {
+			return
+		}
+		others, err := otherSessions(nk, userID, sessionIDFromContext(ctx))
+		if err != nil {
+			logger.Warn("Failed to list sessions of %s: %v", userID, err)
+			return
+		}
+		if others > 0 {
+			return
+		}
+
+		now := time.Now().Unix()
+		if err := writePresence(ctx, nk, userID, &PresenceStatus{Online: false, LastSeen: now}); err != nil {
+			logger.Warn("Failed to store presence of %s: %v", userID, err)
+		}
+		publishPresence(ctx, logger, nk, &UserPresence{Type: "presence", UserID: userID, Username: usernameFromContext(ctx), Online: false, LastSeen: now})
+	}
+}
+
+// RpcGetPresence returns whether each of a batch of users is online and when they were last seen.
+// Online comes from the users' live sessions, so it stays right even if the server stopped before storing an offline status.
+func RpcGetPresence(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	var request struct {
+		UserIDs []string `json:"userIds"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PresenceResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.UserIDs) == 0 {
+		return marshalResponse(PresenceResponse{Success: false, Error: "Missing required field: userIds", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.UserIDs) > PRESENCE_MAX_USERS {
+		return marshalResponse(PresenceResponse{Success: false, Error: fmt.Sprintf("At most %d userIds per request", PRESENCE_MAX_USERS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	reads := make([]*nkruntime.StorageRead, 0, len(request.UserIDs))
+	seen := make(map[string]bool, len(request.UserIDs))
+	for _, id := range request.UserIDs {
+		if seen[id] {
+			continue
+		}
+		if _, err := uuid.Parse(id); err != nil {
+			return marshalResponse(PresenceResponse{Success: false, Error: fmt.Sprintf("Invalid userId: %s", id), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		seen[id] = true
+		reads = append(reads, &nkruntime.StorageRead{Collection: PRESENCE_COLLECTION, Key: PRESENCE_KEY, UserID: id})
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return marshalResponse(PresenceResponse{Success: false, Error: fmt.Sprintf("Failed to read presence: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	stored := make(map[string]*PresenceStatus, len(objects))
+	for _, o := range objects {
+		var presence PresenceStatus
+		if err := json.Unmarshal([]byte(o.Value), &presence); err == nil {
+			stored[o.UserId] = &presence
+		}
+	}
+
+	presences := make([]*UserPresence, 0, len(reads))
+	for _, r := range reads {
+		presence := &UserPresence{UserID: r.UserID}
+		if p := stored[r.UserID]; p != nil {
+			presence.LastSeen = p.LastSeen
+		}
+		if count, err := nk.StreamCount(NOTIFICATION_STREAM_MODE, r.UserID, "", ""); err == nil {
+			presence.Online = count > 0
+		}
+		presences = append(presences, presence)
+	}
+
+	return marshalResponse(PresenceResponse{Success: true, Presences: presences})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// PROFANITY_COLLECTION holds the system-owned word list, editable from the Nakama console
+	PROFANITY_COLLECTION  = "content_filter"
+	PROFANITY_KEY         = "profanity"
+	PROFANITY_MODE_MASK   = "mask"
+	PROFANITY_MODE_REJECT = "reject"
+	// PROFANITY_REFRESH is how long a loaded word list is used before storage is read again
+	PROFANITY_REFRESH = time.Minute
+
+	ERROR_CODE_MESSAGE_REJECTED = "MESSAGE_REJECTED"
+)
+
+// ProfanityConfig is the stored filter configuration; both fields fall back to PROFANITY_WORDS and PROFANITY_MODE
+type ProfanityConfig struct {
+	Words []string `json:"words"`
+	Mode  string   `json:"mode,omitempty"`
+}
+
+// profanityFilter caches the merged env and storage word list
+type profanityFilter struct {
+	mu       sync.Mutex
+	words    map[string]bool
+	mode     string
+	loadedAt time.Time
+}
+
+var profanity = &profanityFilter{}
+
+// load returns the current word list and mode, re-reading storage at most once per PROFANITY_REFRESH
+func (f *profanityFilter) load(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule) (map[string]bool, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.words != nil && time.Since(f.loadedAt) < PROFANITY_REFRESH {
+		return f.words, f.mode
+	}
+
+	words := make(map[string]bool)
+	for _, w := range serverConfig.ProfanityWords {
+		words[strings.ToLower(w)] = true
+	}
+	mode := serverConfig.ProfanityMode
+
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: PROFANITY_COLLECTION, Key: PROFANITY_KEY}})
+	if err != nil {
+		// Keep using the previous list rather than letting everything through
+		logger.Warn("Failed to read profanity word list: %v", err)
+		if f.words != nil {
+			return f.words, f.mode
+		}
+	}
+	for _, object := range objects {
+		var config ProfanityConfig
+		if err := json.Unmarshal([]byte(object.Value), &config); err != nil {
+			logger.Warn("Ignoring unreadable profanity word list: %v", err)
+			continue
+		}
+		for _, w := range config.Words {
+			if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+				words[w] = true
+			}
+		}
+		if config.Mode != "" {
+			mode = config.Mode
+		}
+	}
+	if mode != PROFANITY_MODE_REJECT {
+		mode = PROFANITY_MODE_MASK
+	}
+
+	f.words, f.mode, f.loadedAt = words, mode, time.Now()
+	return f.words, f.mode
+}
+
+// filterText masks every whole word of text found in words, matching case-insensitively
+func filterText(text string, words map[string]bool) (string, []string) {
+	runes := []rune(text)
+	var matched []string
+	for start := 0; start < len(runes); {
+		if !isWordRune(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && isWordRune(runes[end]) {
+			end++
+		}
+		if word := strings.ToLower(string(runes[start:end])); words[word] {
+			matched = append(matched, word)
+			for i := start; i < end; i++ {
+				runes[i] = '*'
+			}
+		}
+		start = end
+	}
+	if matched == nil {
+		return text, nil
+	}
+	return string(runes), matched
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\''
+}
+
+// filterMessageContent masks blocked words in the text fields of decoded message content, in place
+func filterMessageContent(content map[string]interface{}, words map[string]bool) []string {
+	var matched []string
+	for _, field := range MESSAGE_TEXT_FIELDS {
+		text, ok := content[field].(string)
+		if !ok {
+			continue
+		}
+		masked, terms := filterText(text, words)
+		if terms != nil {
+			content[field] = masked
+			matched = append(matched, terms...)
+		}
+	}
+	return matched
+}
+
+// applyProfanityFilter masks blocked words in a message's content and reports whether anything changed.
+// In reject mode it returns a *MessageRejectedError instead, and the message must not be sent.
+func applyProfanityFilter(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, content map[string]interface{}) (bool, error) {
+	words, mode := profanity.load(ctx, logger, nk)
+	if len(words) == 0 {
+		return false, nil
+	}
+	matched := filterMessageContent(content, words)
+	if matched == nil {
+		return false, nil
+	}
+	if mode == PROFANITY_MODE_REJECT {
+		return false, &MessageRejectedError{Code: ERROR_CODE_MESSAGE_REJECTED, Message: "Message contains blocked words", Terms: matched}
+	}
+	return true, nil
+}
+
+// filterProfanity is the send check that runs the profanity filter
+func filterProfanity(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, senderID, channelID string, content map[string]interface{}) (bool, error) {
+	return applyProfanityFilter(ctx, logger, nk, content)
+}
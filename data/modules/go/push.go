@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	PUSH_COLLECTION       = "push_tokens"
+	PUSH_KEY              = "devices"
+	PUSH_WRITE_ATTEMPTS   = 3
+	PUSH_MAX_DEVICES      = 10
+	PUSH_MAX_TOKEN_LENGTH = 4096
+	// PUSH_MAX_RECIPIENTS caps the group members looked at for one message
+	PUSH_MAX_RECIPIENTS = 500
+	PUSH_TIMEOUT        = 10 * time.Second
+)
+
+// PushDevice is one registered device of a user
+type PushDevice struct {
+	Token     string `json:"token"`
+	Platform  string `json:"platform"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+// PushDevices is the per-user record of registered devices, newest first
+type PushDevices struct {
+	Devices []PushDevice `json:"devices"`
+}
+
+// PushMessage is the platform-neutral content of a push
+type PushMessage struct {
+	Title string
+	Body  string
+	Data  map[string]string
+}
+
+// PushProvider delivers pushes to one platform
+type PushProvider interface {
+	Name() string
+	Send(ctx context.Context, token string, message *PushMessage) error
+}
+
+// errPushTokenInvalid is returned by providers when the token was uninstalled or never existed; it is then forgotten
+var errPushTokenInvalid = errors.New("push token is no longer valid")
+
+// PUSH_PROVIDERS maps device platforms to their constructors. A constructor returns nil when the platform is not configured.
+var PUSH_PROVIDERS = map[string]func() (PushProvider, error){
+	"fcm":  newFCMProvider,
+	"apns": newAPNSProvider,
+}
+
+// pushProviders holds the configured providers by platform, set once by InitializePushProviders
+var pushProviders = map[string]PushProvider{}
+
+// PushResponse represents the response for push token RPCs
+type PushResponse struct {
+	Success bool   `json:"success"`
+	Devices int    `json:"devices"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// InitializePushProviders sets up every platform that has credentials configured
+func InitializePushProviders(logger nkruntime.Logger) {
+	for platform, factory := range PUSH_PROVIDERS {
+		provider, err := factory()
+		if err != nil {
+			logger.Error("Push provider %s disabled: %v", platform, err)
+			continue
+		}
+		if provider != nil {
+			pushProviders[platform] = provider
+			logger.Info("Push provider enabled: %s", provider.Name())
+		}
+	}
+}
+
+// readPushDevices loads the registered devices of the given users, keyed by user ID
+func readPushDevices(ctx context.Context, nk nkruntime.NakamaModule, userIDs []string) (map[string]*PushDevices, map[string]string, error) {
+	reads := make([]*nkruntime.StorageRead, 0, len(userIDs))
+	for _, id := range userIDs {
+		reads = append(reads, &nkruntime.StorageRead{Collection: PUSH_COLLECTION, Key: PUSH_KEY, UserID: id})
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read push tokens: %v", err)
+	}
+	devices := make(map[string]*PushDevices, len(objects))
+	versions := make(map[string]string, len(objects))
+	for _, object := range objects {
+		var d PushDevices
+		if err := json.Unmarshal([]byte(object.Value), &d); err != nil {
+			continue
+		}
+		devices[object.UserId] = &d
+		versions[object.UserId] = object.Version
+	}
+	return devices, versions, nil
+}
+
+// updatePushDevices applies fn to a user's devices, retrying on concurrent modification
+func updatePushDevices(ctx context.Context, nk nkruntime.NakamaModule, userID string, fn func(*PushDevices)) (*PushDevices, error) {
+	var lastErr error
+	for attempt := 0; attempt < PUSH_WRITE_ATTEMPTS; attempt++ {
+		stored, versions, err := readPushDevices(ctx, nk, []string{userID})
+		if err != nil {
+			return nil, err
+		}
+		devices, version := stored[userID], versions[userID]
+		if devices == nil {
+			devices = &PushDevices{}
+			version = "*"
+		}
+		fn(devices)
+
+		value, _ := json.Marshal(devices)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      PUSH_COLLECTION,
+			Key:             PUSH_KEY,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return devices, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to update push tokens: %v", lastErr)
+}
+
+// removePushToken drops a token from a user's devices
+func removePushToken(ctx context.Context, nk nkruntime.NakamaModule, userID, token string) (*PushDevices, error) {
+	return updatePushDevices(ctx, nk, userID, func(d *PushDevices) {
+		kept := d.Devices[:0]
+		for _, device := range d.Devices {
+			if device.Token != token {
+				kept = append(kept, device)
+			}
+		}
+		d.Devices = kept
+	})
+}
+
+// RpcRegisterPushToken stores the caller's device token; registering it again refreshes it
+func RpcRegisterPushToken(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PushResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Token    string `json:"token"`
+		Platform string `json:"platform"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PushResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Token == "" || request.Platform == "" {
+		return marshalResponse(PushResponse{Success: false, Error: "Missing required fields: token or platform", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if _, ok := PUSH_PROVIDERS[request.Platform]; !ok {
+		return marshalResponse(PushResponse{Success: false, Error: fmt.Sprintf("Unsupported platform: %s", request.Platform), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Token) > PUSH_MAX_TOKEN_LENGTH {
+		return marshalResponse(PushResponse{Success: false, Error: "Invalid token", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	devices, err := updatePushDevices(ctx, nk, userID, func(d *PushDevices) {
+		registered := []PushDevice{{Token: request.Token, Platform: request.Platform, UpdatedAt: time.Now().Unix()}}
+		for _, device := range d.Devices {
+			if device.Token != request.Token && len(registered) < PUSH_MAX_DEVICES {
+				registered = append(registered, device)
+			}
+		}
+		d.Devices = registered
+	})
+	if err != nil {
+		return marshalResponse(PushResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(PushResponse{Success: true, Devices: len(devices.Devices)})
+}
+
+// RpcUnregisterPushToken forgets a device token, for example on logout
+func RpcUnregisterPushToken(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(PushResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(PushResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Token == "" {
+		return marshalResponse(PushResponse{Success: false, Error: "Missing required field: token", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	devices, err := removePushToken(ctx, nk, userID, request.Token)
+	if err != nil {
+		return marshalResponse(PushResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(PushResponse{Success: true, Devices: len(devices.Devices)})
+}
+
+// channelPushRecipients lists the users who receive every message of a channel.
+// Rooms have no member list, so only mentioned users are pushed there.
+func channelPushRecipients(ctx context.Context, nk nkruntime.NakamaModule, ref *ChannelRef) ([]string, error) {
+	switch ref.Mode {
+	case STREAM_MODE_DM:
+		return []string{ref.Subject, ref.Subcontext}, nil
+	case STREAM_MODE_GROUP:
+		var members []string
+		cursor := ""
+		for len(members) < PUSH_MAX_RECIPIENTS {
+			users, next, err := nk.GroupUsersList(ctx, ref.Subject, GROUP_LIST_PAGE_SIZE, nil, cursor)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list group members: %v", err)
+			}
+			for _, u := range users {
+				if u.User != nil && u.State != nil && u.State.Value <= GROUP_STATE_MEMBER {
+					members = append(members, u.User.Id)
+				}
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		return members, nil
+	}
+	return nil, nil
+}
+
+// pushSentMessage is the sent-message hook that pushes a message to recipients with no session on the channel stream
+func pushSentMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage) {
+	if len(pushProviders) == 0 {
+		return
+	}
+	ref, err := parseChannelID(message.ChannelID)
+	if err != nil {
+		return
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal([]byte(message.Content), &content); err != nil {
+		return
+	}
+	level := CHANNEL_NOTIFY_ALL
+	if settings, _, err := readChannelSettings(ctx, nk, message.ChannelID); err == nil && settings.NotificationLevel != "" {
+		level = settings.NotificationLevel
+	}
+	if level == CHANNEL_NOTIFY_NONE {
+		return
+	}
+
+	var members []string
+	if level == CHANNEL_NOTIFY_ALL {
+		if members, err = channelPushRecipients(ctx, nk, ref); err != nil {
+			logger.Warn("Failed to list push recipients of %s: %v", message.ChannelID, err)
+		}
+	}
+	mentioned := make(map[string]bool)
+	for _, id := range resolveMentions(ctx, logger, nk, message, content) {
+		mentioned[id] = true
+		members = append(members, id)
+	}
+
+	// Anyone with a session on the stream sees the message live
+	online := make(map[string]bool)
+	if presences, err := nk.StreamUserList(ref.Mode, ref.Subject, ref.Subcontext, ref.Label, true, true); err == nil {
+		for _, p := range presences {
+			online[p.GetUserId()] = true
+		}
+	}
+	recipients := make([]string, 0, len(members))
+	seen := map[string]bool{message.SenderID: true}
+	for _, id := range members {
+		if !seen[id] && !online[id] {
+			seen[id] = true
+			recipients = append(recipients, id)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	devices, _, err := readPushDevices(ctx, nk, recipients)
+	if err != nil {
+		logger.Warn("Failed to load push tokens for %s: %v", message.MessageID, err)
+		return
+	}
+	filterPushDevices(ctx, logger, nk, message.ChannelID, devices, mentioned)
+	if len(devices) == 0 {
+		return
+	}
+
+	body := messagePreview(content)
+	if body == "" {
+		body = "Sent an attachment"
+	}
+	data := map[string]string{"channelId": message.ChannelID, "messageId": message.MessageID, "senderId": message.SenderID}
+
+	// Deliver in the background so a slow push service does not hold up the sender
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), PUSH_TIMEOUT)
+		defer cancel()
+		sendPushes(ctx, logger, nk, "message "+message.MessageID, devices, func(userID string) *PushMessage {
+			push := &PushMessage{Title: message.Username, Body: body, Data: data}
+			if mentioned[userID] {
+				push.Title = fmt.Sprintf("%s mentioned you", message.Username)
+			}
+			return push
+		})
+	}()
+}
+
+// sendPushes sends each user's push, built by pushFor, to all of their devices. Tokens the platform reports
+// as invalid are forgotten. subject names what is pushed in the logs.
+func sendPushes(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, subject string, devices map[string]*PushDevices, pushFor func(userID string) *PushMessage) {
+	for userID, d := range devices {
+		push := pushFor(userID)
+		for _, device := range d.Devices {
+			provider, ok := pushProviders[device.Platform]
+			if !ok {
+				continue
+			}
+			err := provider.Send(ctx, device.Token, push)
+			if errors.Is(err, errPushTokenInvalid) {
+				if _, err := removePushToken(ctx, nk, userID, device.Token); err != nil {
+					logger.Warn("Failed to forget invalid push token of %s: %v", userID, err)
+				}
+			} else if err != nil {
+				logger.Warn("Failed to push %s to %s: %v", subject, userID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FCM_SCOPE         = "https://www.googleapis.com/auth/firebase.messaging"
+	FCM_TOKEN_URI     = "https://oauth2.googleapis.com/token"
+	FCM_SEND_URL      = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+	APNS_HOST         = "https://api.push.apple.com"
+	APNS_SANDBOX_HOST = "https://api.sandbox.push.apple.com"
+	// APNS_JWT_LIFETIME stays under Apple's one hour limit; tokens must not be refreshed more than every 20 minutes
+	APNS_JWT_LIFETIME = 50 * time.Minute
+)
+
+// signJWT builds a compact JWT from the header and claims, signing with sign
+func signJWT(header, claims interface{}, sign func(digest []byte) ([]byte, error)) (string, error) {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parsePKCS8Key decodes a PEM encoded PKCS#8 private key, as shipped in FCM service accounts and APNs .p8 files
+func parsePKCS8Key(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM key found")
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// fcmProvider sends through the FCM HTTP v1 API using a service account (FCM_SERVICE_ACCOUNT_FILE)
+type fcmProvider struct {
+	projectID   string
+	clientEmail string
+	tokenURI    string
+	key         *rsa.PrivateKey
+	client      *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func newFCMProvider() (PushProvider, error) {
+	path := serverConfig.FCMServiceAccountFile
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FCM_SERVICE_ACCOUNT_FILE: %v", err)
+	}
+	var account struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("invalid service account file: %v", err)
+	}
+	parsed, err := parsePKCS8Key([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid service account key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("service account key is not an RSA key")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = FCM_TOKEN_URI
+	}
+	return &fcmProvider{
+		projectID:   account.ProjectID,
+		clientEmail: account.ClientEmail,
+		tokenURI:    account.TokenURI,
+		key:         key,
+		client:      &http.Client{Timeout: PUSH_TIMEOUT},
+	}, nil
+}
+
+func (p *fcmProvider) Name() string { return "fcm" }
+
+// token returns a cached OAuth access token, exchanging a freshly signed assertion when it is about to expire
+func (p *fcmProvider) token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.accessToken != "" && time.Until(p.expiresAt) > time.Minute {
+		return p.accessToken, nil
+	}
+
+	now := time.Now().Unix()
+	assertion, err := signJWT(
+		map[string]string{"alg": "RS256", "typ": "JWT"},
+		map[string]interface{}{"iss": p.clientEmail, "scope": FCM_SCOPE, "aud": p.tokenURI, "iat": now, "exp": now + 3600},
+		func(digest []byte) ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest)
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token exchange failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token exchange returned status %d", resp.StatusCode)
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid token response: %v", err)
+	}
+	p.accessToken = result.AccessToken
+	p.expiresAt = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return p.accessToken, nil
+}
+
+func (p *fcmProvider) Send(ctx context.Context, token string, message *PushMessage) error {
+	accessToken, err := p.token(ctx)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        token,
+			"notification": map[string]string{"title": message.Title, "body": message.Body},
+			"data":         message.Data,
+			"android":      map[string]string{"priority": "high"},
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(FCM_SEND_URL, p.projectID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("FCM unavailable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	// UNREGISTERED comes back as 404, a malformed token as 400 INVALID_ARGUMENT
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode == http.StatusNotFound || bytes.Contains(respBody, []byte("UNREGISTERED")) {
+		return errPushTokenInvalid
+	}
+	return fmt.Errorf("FCM returned status %d: %s", resp.StatusCode, respBody)
+}
+
+// apnsProvider sends through APNs with token based authentication (APNS_KEY_FILE, APNS_KEY_ID, APNS_TEAM_ID, APNS_TOPIC)
+type apnsProvider struct {
+	host   string
+	keyID  string
+	teamID string
+	topic  string
+	key    *ecdsa.PrivateKey
+	client *http.Client
+
+	mu       sync.Mutex
+	jwt      string
+	issuedAt time.Time
+}
+
+func newAPNSProvider() (PushProvider, error) {
+	path := serverConfig.APNSKeyFile
+	if path == "" {
+		return nil, nil
+	}
+	keyID, teamID, topic := serverConfig.APNSKeyID, serverConfig.APNSTeamID, serverConfig.APNSTopic
+	if keyID == "" || teamID == "" || topic == "" {
+		return nil, fmt.Errorf("APNS_KEY_ID, APNS_TEAM_ID and APNS_TOPIC are required")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read APNS_KEY_FILE: %v", err)
+	}
+	parsed, err := parsePKCS8Key(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid APNs key: %v", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("APNs key is not an EC key")
+	}
+	host := APNS_HOST
+	if serverConfig.APNSSandbox {
+		host = APNS_SANDBOX_HOST
+	}
+	// APNs only speaks HTTP/2, which the default transport negotiates over TLS
+	return &apnsProvider{host: host, keyID: keyID, teamID: teamID, topic: topic, key: key, client: &http.Client{Timeout: PUSH_TIMEOUT}}, nil
+}
+
+func (p *apnsProvider) Name() string { return "apns" }
+
+// token returns the cached provider JWT, signing a new one when it gets old
+func (p *apnsProvider) token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.jwt != "" && time.Since(p.issuedAt) < APNS_JWT_LIFETIME {
+		return p.jwt, nil
+	}
+	now := time.Now()
+	jwt, err := signJWT(
+		map[string]string{"alg": "ES256", "kid": p.keyID},
+		map[string]interface{}{"iss": p.teamID, "iat": now.Unix()},
+		func(digest []byte) ([]byte, error) {
+			r, s, err := ecdsa.Sign(rand.Reader, p.key, digest)
+			if err != nil {
+				return nil, err
+			}
+			// JWS wants the raw 64 byte r||s form rather than ASN.1
+			signature := make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+			return signature, nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	p.jwt, p.issuedAt = jwt, now
+	return jwt, nil
+}
+
+func (p *apnsProvider) Send(ctx context.Context, token string, message *PushMessage) error {
+	jwt, err := p.token()
+	if err != nil {
+		return err
+	}
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{"title": message.Title, "body": message.Body},
+			"sound": "default",
+		},
+	}
+	for k, v := range message.Data {
+		payload[k] = v
+	}
+	body, _ := json.Marshal(payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.host+"/3/device/"+url.PathEscape(token), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+jwt)
+	req.Header.Set("apns-topic", p.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("APNs unavailable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var result struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&result)
+	if resp.StatusCode == http.StatusGone || result.Reason == "BadDeviceToken" || result.Reason == "Unregistered" {
+		return errPushTokenInvalid
+	}
+	return fmt.Errorf("APNs returned status %d: %s", resp.StatusCode, result.Reason)
+}
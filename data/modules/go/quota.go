@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	QUOTA_COLLECTION                 = "upload_quota"
+	QUOTA_KEY                        = "usage"
+	QUOTA_WRITE_ATTEMPTS             = 3
+	UPLOAD_DEFAULT_DAILY_QUOTA       = 200 * 1024 * 1024
+	UPLOAD_DEFAULT_RATE_PER_MINUTE   = 20
+	ERROR_CODE_UPLOAD_QUOTA_EXCEEDED = "UPLOAD_QUOTA_EXCEEDED"
+	ERROR_CODE_UPLOAD_RATE_LIMITED   = "UPLOAD_RATE_LIMITED"
+)
+
+// UploadUsage is a user's upload accounting for the current UTC day and minute
+type UploadUsage struct {
+	Day         string `json:"day"`
+	Bytes       int64  `json:"bytes"`
+	Uploads     int    `json:"uploads"`
+	MinuteStart int64  `json:"minuteStart"`
+	MinuteCount int    `json:"minuteCount"`
+}
+
+// QuotaError is returned when an upload would exceed a limit; Code is passed on to the client
+type QuotaError struct {
+	Code    string
+	Message string
+}
+
+func (e *QuotaError) Error() string { return e.Message }
+
+// reserveUploadQuota charges an upload of size bytes to the user, or returns a *QuotaError if it would exceed
+// UPLOAD_DAILY_QUOTA_BYTES or UPLOAD_RATE_LIMIT_PER_MINUTE (0 for unlimited). Server-to-server uploads are not metered.
+func (s *Services) reserveUploadQuota(ctx context.Context, nk nkruntime.NakamaModule, userID string, size int64) error {
+	if userID == "" {
+		return nil
+	}
+	quota, rate := s.Config.UploadDailyQuotaBytes, s.Config.UploadRateLimitPerMinute
+
+	var lastErr error
+	for attempt := 0; attempt < QUOTA_WRITE_ATTEMPTS; attempt++ {
+		usage := UploadUsage{}
+		version := "*"
+		objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: QUOTA_COLLECTION, Key: QUOTA_KEY, UserID: userID}})
+		if err != nil {
+			return err
+		}
+		if len(objects) > 0 {
+			if err := json.Unmarshal([]byte(objects[0].Value), &usage); err != nil {
+				return err
+			}
+			version = objects[0].Version
+		}
+
+		now := s.Clock.Now().UTC()
+		if today := now.Format("2006-01-02"); usage.Day != today {
+			usage.Day, usage.Bytes, usage.Uploads = today, 0, 0
+		}
+		if minute := now.Truncate(time.Minute).Unix(); usage.MinuteStart != minute {
+			usage.MinuteStart, usage.MinuteCount = minute, 0
+		}
+
+		if rate > 0 && usage.MinuteCount >= rate {
+			return &QuotaError{Code: ERROR_CODE_UPLOAD_RATE_LIMITED, Message: fmt.Sprintf("Too many uploads, the limit is %d per minute", rate)}
+		}
+		if quota > 0 && usage.Bytes+size > quota {
+			return &QuotaError{Code: ERROR_CODE_UPLOAD_QUOTA_EXCEEDED, Message: fmt.Sprintf("Daily upload quota exceeded: %d of %d bytes used", usage.Bytes, quota)}
+		}
+		usage.Bytes += size
+		usage.Uploads++
+		usage.MinuteCount++
+
+		value, _ := json.Marshal(usage)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      QUOTA_COLLECTION,
+			Key:             QUOTA_KEY,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to update upload quota: %v", lastErr)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	REACTION_COLLECTION        = "reactions"
+	REACTION_WRITE_ATTEMPTS    = 3
+	REACTION_MAX_EMOJI_BYTES   = 32
+	REACTION_MAX_PER_USER      = 20
+	REACTION_MAX_DISTINCT      = 50
+	REACTION_LIST_MAX_MESSAGES = 100
+)
+
+// MessageReactions holds every reaction on one message, emoji to the IDs of the users who reacted
+type MessageReactions struct {
+	ChannelID string              `json:"channelId"`
+	MessageID string              `json:"messageId"`
+	Reactions map[string][]string `json:"reactions"`
+	// Super holds, per emoji, the users whose reaction is a super reaction bought with wallet_spend
+	Super map[string][]string `json:"super,omitempty"`
+}
+
+// ReactionResponse represents the response for reaction RPCs
+type ReactionResponse struct {
+	Success   bool                           `json:"success"`
+	MessageID string                         `json:"messageId,omitempty"`
+	Reactions map[string][]string            `json:"reactions,omitempty"`
+	Super     map[string][]string            `json:"super,omitempty"`
+	Messages  map[string]map[string][]string `json:"messages,omitempty"`
+	// SuperMessages holds the super reactions of list_reactions, keyed by message ID
+	SuperMessages map[string]map[string][]string `json:"superMessages,omitempty"`
+	Error         string                         `json:"error,omitempty"`
+	Code          string                         `json:"code,omitempty"`
+}
+
+// ReactionRequest is the payload of add_reaction and remove_reaction
+type ReactionRequest struct {
+	ChannelID string `json:"channelId"`
+	MessageID string `json:"messageId"`
+	Emoji     string `json:"emoji"`
+	// Super makes the reaction a super reaction, using up a super_reaction entitlement. Only add_reaction reads it.
+	Super bool `json:"super,omitempty"`
+}
+
+// validEmoji accepts a short printable string without whitespace, such as an emoji or a :shortcode:
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > REACTION_MAX_EMOJI_BYTES || !utf8.ValidString(emoji) {
+		return false
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasUser reports whether userID is in a reaction's user list
+func hasUser(users []string, userID string) bool {
+	for _, id := range users {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutUser returns a reaction's user list without userID
+func withoutUser(users []string, userID string) []string {
+	kept := make([]string, 0, len(users))
+	for _, id := range users {
+		if id != userID {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// readReactions loads the reactions of the given messages, keyed by message ID
+func readReactions(ctx context.Context, nk nkruntime.NakamaModule, messageIDs []string) (map[string]*MessageReactions, map[string]string, error) {
+	reads := make([]*nkruntime.StorageRead, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		reads = append(reads, &nkruntime.StorageRead{Collection: REACTION_COLLECTION, Key: id})
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read reactions: %v", err)
+	}
+
+	reactions := make(map[string]*MessageReactions, len(objects))
+	versions := make(map[string]string, len(objects))
+	for _, object := range objects {
+		var r MessageReactions
+		if err := json.Unmarshal([]byte(object.Value), &r); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode reactions: %v", err)
+		}
+		reactions[object.Key] = &r
+		versions[object.Key] = object.Version
+	}
+	return reactions, versions, nil
+}
+
+// updateReactions applies fn to a message's reactions, retrying on concurrent modification.
+// Records are keyed by message ID and remember their channel, so a message ID cannot be reused across channels.
+func updateReactions(ctx context.Context, nk nkruntime.NakamaModule, channelID, messageID string, fn func(*MessageReactions) error) (*MessageReactions, error) {
+	var lastErr error
+	for attempt := 0; attempt < REACTION_WRITE_ATTEMPTS; attempt++ {
+		stored, versions, err := readReactions(ctx, nk, []string{messageID})
+		if err != nil {
+			return nil, err
+		}
+		reactions, version := stored[messageID], versions[messageID]
+		if reactions == nil {
+			reactions = &MessageReactions{ChannelID: channelID, MessageID: messageID, Reactions: map[string][]string{}}
+			version = "*"
+		}
+		if reactions.ChannelID != channelID {
+			return nil, errorWithCode(ERROR_CODE_NOT_FOUND, "message not found")
+		}
+		if err := fn(reactions); err != nil {
+			return nil, err
+		}
+
+		value, _ := json.Marshal(reactions)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      REACTION_COLLECTION,
+			Key:             messageID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return reactions, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to update reactions: %v", lastErr)
+}
+
+// parseReactionRequest decodes and validates an add_reaction/remove_reaction payload and checks channel membership
+func parseReactionRequest(ctx context.Context, nk nkruntime.NakamaModule, userID, payload string) (*ReactionRequest, error) {
+	var request ReactionRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Failed to parse request: %v", err)
+	}
+	if request.ChannelID == "" || request.MessageID == "" || request.Emoji == "" {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Missing required fields: channelId, messageId, or emoji")
+	}
+	if !validEmoji(request.Emoji) {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid emoji")
+	}
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, errorWithCode(ERROR_CODE_NOT_A_MEMBER, "Not a member of this channel")
+	}
+	return &request, nil
+}
+
+// RpcAddReaction adds the caller's reaction to a message and tells the channel. A super reaction takes a
+// super_reaction entitlement first, given back when the reaction is refused or already was a super reaction.
+func RpcAddReaction(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ReactionResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	request, err := parseReactionRequest(ctx, nk, userID, payload)
+	if err != nil {
+		return marshalResponse(ReactionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if request.Super {
+		if err := consumeEntitlement(ctx, nk, userID, WALLET_ITEM_SUPER_REACTION); err != nil {
+			return marshalResponse(ReactionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+	}
+
+	added, superAdded := false, false
+	reactions, err := updateReactions(ctx, nk, request.ChannelID, request.MessageID, func(r *MessageReactions) error {
+		added, superAdded = false, false
+		users := r.Reactions[request.Emoji]
+		if hasUser(users, userID) {
+			if request.Super && !hasUser(r.Super[request.Emoji], userID) {
+				addSuperReaction(r, request.Emoji, userID)
+				superAdded = true
+			}
+			return nil
+		}
+		if users == nil && len(r.Reactions) >= REACTION_MAX_DISTINCT {
+			return errorWithCode(ERROR_CODE_REJECTED, "too many different reactions on this message")
+		}
+		mine := 0
+		for _, ids := range r.Reactions {
+			for _, id := range ids {
+				if id == userID {
+					mine++
+				}
+			}
+		}
+		if mine >= REACTION_MAX_PER_USER {
+			return errorWithCode(ERROR_CODE_REJECTED, "you can add at most %d reactions to a message", REACTION_MAX_PER_USER)
+		}
+		r.Reactions[request.Emoji] = append(users, userID)
+		added = true
+		if request.Super {
+			addSuperReaction(r, request.Emoji, userID)
+			superAdded = true
+		}
+		return nil
+	})
+	if request.Super && !superAdded {
+		refundEntitlement(ctx, logger, nk, userID, WALLET_ITEM_SUPER_REACTION)
+	}
+	if err != nil {
+		return marshalResponse(ReactionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	if added || superAdded {
+		sendReactionEvent(ctx, logger, nk, "reaction_added", request, superAdded)
+	}
+	return marshalResponse(ReactionResponse{Success: true, MessageID: request.MessageID, Reactions: reactions.Reactions, Super: reactions.Super})
+}
+
+// addSuperReaction marks a user's reaction as a super reaction
+func addSuperReaction(r *MessageReactions, emoji, userID string) {
+	if r.Super == nil {
+		r.Super = map[string][]string{}
+	}
+	r.Super[emoji] = append(r.Super[emoji], userID)
+}
+
+// RpcRemoveReaction removes the caller's reaction from a message and tells the channel
+func RpcRemoveReaction(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ReactionResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	request, err := parseReactionRequest(ctx, nk, userID, payload)
+	if err != nil {
+		return marshalResponse(ReactionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	removed := false
+	reactions, err := updateReactions(ctx, nk, request.ChannelID, request.MessageID, func(r *MessageReactions) error {
+		users := r.Reactions[request.Emoji]
+		removed = hasUser(users, userID)
+		if kept := withoutUser(users, userID); len(kept) == 0 {
+			delete(r.Reactions, request.Emoji)
+		} else {
+			r.Reactions[request.Emoji] = kept
+		}
+		// A super reaction goes with the reaction; its entitlement is not given back
+		if kept := withoutUser(r.Super[request.Emoji], userID); len(kept) == 0 {
+			delete(r.Super, request.Emoji)
+		} else {
+			r.Super[request.Emoji] = kept
+		}
+		return nil
+	})
+	if err != nil {
+		return marshalResponse(ReactionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	if removed {
+		sendReactionEvent(ctx, logger, nk, "reaction_removed", request, false)
+	}
+	return marshalResponse(ReactionResponse{Success: true, MessageID: request.MessageID, Reactions: reactions.Reactions, Super: reactions.Super})
+}
+
+// sendReactionEvent tells everyone in the channel about a reaction change so their UI updates live
+func sendReactionEvent(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, eventType string, request *ReactionRequest, super bool) {
+	content := map[string]interface{}{"emoji": request.Emoji}
+	if super {
+		content["super"] = true
+	}
+	event := &ChannelEvent{
+		Type:      eventType,
+		ChannelID: request.ChannelID,
+		MessageID: request.MessageID,
+		SenderID:  userIDFromContext(ctx),
+		Username:  usernameFromContext(ctx),
+		Content:   content,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := sendChannelEvent(nk, event); err != nil {
+		logger.Warn("Failed to send %s event for %s: %v", eventType, request.MessageID, err)
+	}
+}
+
+// RpcListReactions returns the reactions of a page of messages in one channel
+func RpcListReactions(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+
+	var request struct {
+		ChannelID  string   `json:"channelId"`
+		MessageIDs []string `json:"messageIds"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ReactionResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" || len(request.MessageIDs) == 0 {
+		return marshalResponse(ReactionResponse{Success: false, Error: "Missing required fields: channelId or messageIds", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.MessageIDs) > REACTION_LIST_MAX_MESSAGES {
+		return marshalResponse(ReactionResponse{Success: false, Error: fmt.Sprintf("messageIds cannot exceed %d", REACTION_LIST_MAX_MESSAGES), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if userID != "" {
+		member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+		if err != nil {
+			return marshalResponse(ReactionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		if !member {
+			return marshalResponse(ReactionResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+		}
+	}
+
+	ids := make([]string, 0, len(request.MessageIDs))
+	for _, id := range request.MessageIDs {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	stored, _, err := readReactions(ctx, nk, ids)
+	if err != nil {
+		return marshalResponse(ReactionResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	messages := make(map[string]map[string][]string, len(stored))
+	var super map[string]map[string][]string
+	for id, r := range stored {
+		if r.ChannelID == request.ChannelID && len(r.Reactions) > 0 {
+			messages[id] = r.Reactions
+			if len(r.Super) > 0 {
+				if super == nil {
+					super = map[string]map[string][]string{}
+				}
+				super[id] = r.Super
+			}
+		}
+	}
+	return marshalResponse(ReactionResponse{Success: true, Messages: messages, SuperMessages: super})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWithoutUser(t *testing.T) {
+	tests := []struct {
+		name  string
+		users []string
+		want  []string
+	}{
+		{"nil list", nil, []string{}},
+		{"user not there", []string{"u2", "u3"}, []string{"u2", "u3"}},
+		{"user removed", []string{"u2", "u1", "u3"}, []string{"u2", "u3"}},
+		{"only user", []string{"u1"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withoutUser(tt.users, "u1"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withoutUser(%v) = %v, want %v", tt.users, got, tt.want)
+			}
+			if hasUser(withoutUser(tt.users, "u1"), "u1") {
+				t.Errorf("hasUser after withoutUser(%v) = true", tt.users)
+			}
+		})
+	}
+}
+
+func TestAddSuperReaction(t *testing.T) {
+	r := &MessageReactions{Reactions: map[string][]string{"👍": {"u1", "u2"}}}
+	addSuperReaction(r, "👍", "u1")
+	addSuperReaction(r, "👍", "u2")
+	addSuperReaction(r, "🎉", "u1")
+	want := map[string][]string{"👍": {"u1", "u2"}, "🎉": {"u1"}}
+	if !reflect.DeepEqual(r.Super, want) {
+		t.Errorf("super = %v, want %v", r.Super, want)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	READ_STATE_COLLECTION   = "read_state"
+	READ_STATE_MAX_CHANNELS = 50
+	// UNREAD_COUNT_MAX caps how far back unread messages are counted; clients show it as "99+"
+	UNREAD_COUNT_MAX = 100
+	// MESSAGE_CODE_CHAT is the code of user chat messages; other codes are edits, removals and group notices
+	MESSAGE_CODE_CHAT = 0
+)
+
+// ReadCursor is a user's last-read position in a channel
+type ReadCursor struct {
+	ChannelID  string `json:"channelId"`
+	MessageID  string `json:"messageId"`
+	CreateTime int64  `json:"createTime"`
+	ReadAt     int64  `json:"readAt"`
+}
+
+// ChannelReadState is the read state of one channel returned by get_read_state
+type ChannelReadState struct {
+	ChannelID    string      `json:"channelId"`
+	LastRead     *ReadCursor `json:"lastRead,omitempty"`
+	UnreadCount  int         `json:"unreadCount"`
+	UnreadCapped bool        `json:"unreadCapped,omitempty"`
+	// PeerLastRead is the other user's cursor in a direct chat, for "seen" markers
+	PeerLastRead *ReadCursor `json:"peerLastRead,omitempty"`
+	Error        string      `json:"error,omitempty"`
+	Code         string      `json:"code,omitempty"`
+}
+
+// ReadStateResponse represents the response for mark_read and get_read_state
+type ReadStateResponse struct {
+	Success  bool               `json:"success"`
+	LastRead *ReadCursor        `json:"lastRead,omitempty"`
+	Channels []ChannelReadState `json:"channels,omitempty"`
+	Error    string             `json:"error,omitempty"`
+	Code     string             `json:"code,omitempty"`
+}
+
+// readCursors loads a user's read cursors for the given channels, keyed by channel ID
+func readCursors(ctx context.Context, nk nkruntime.NakamaModule, userID string, channelIDs []string) (map[string]*ReadCursor, map[string]string, error) {
+	reads := make([]*nkruntime.StorageRead, 0, len(channelIDs))
+	for _, id := range channelIDs {
+		reads = append(reads, &nkruntime.StorageRead{Collection: READ_STATE_COLLECTION, Key: id, UserID: userID})
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read read state: %v", err)
+	}
+	cursors := make(map[string]*ReadCursor, len(objects))
+	versions := make(map[string]string, len(objects))
+	for _, object := range objects {
+		var cursor ReadCursor
+		if err := json.Unmarshal([]byte(object.Value), &cursor); err != nil {
+			continue
+		}
+		cursors[object.Key] = &cursor
+		versions[object.Key] = object.Version
+	}
+	return cursors, versions, nil
+}
+
+// countUnread counts chat messages from other users newer than the cursor, stopping at UNREAD_COUNT_MAX
+func countUnread(ctx context.Context, nk nkruntime.NakamaModule, userID, channelID string, cursor *ReadCursor) (int, bool, error) {
+	count := 0
+	page := ""
+	for {
+		// Newest first
+		messages, next, _, err := nk.ChannelMessagesList(ctx, channelID, UNREAD_COUNT_MAX, false, page)
+		if err != nil {
+			return 0, false, err
+		}
+		for _, m := range messages {
+			if cursor != nil && (m.MessageId == cursor.MessageID || (m.CreateTime != nil && m.CreateTime.Seconds < cursor.CreateTime)) {
+				return count, false, nil
+			}
+			if (m.Code != nil && m.Code.Value != MESSAGE_CODE_CHAT) || m.SenderId == userID {
+				continue
+			}
+			count++
+			if count >= UNREAD_COUNT_MAX {
+				return count, true, nil
+			}
+		}
+		if next == "" || len(messages) == 0 {
+			return count, false, nil
+		}
+		page = next
+	}
+}
+
+// dmPeer returns the other user of a direct channel, "" for rooms and groups
+func dmPeer(channelID, userID string) string {
+	ref, err := parseChannelID(channelID)
+	if err != nil || ref.Mode != STREAM_MODE_DM {
+		return ""
+	}
+	if ref.Subject == userID {
+		return ref.Subcontext
+	}
+	return ref.Subject
+}
+
+// RpcMarkRead moves the caller's read cursor in a channel forward and tells the channel
+func RpcMarkRead(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ReadStateResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID  string `json:"channelId"`
+		MessageID  string `json:"messageId"`
+		CreateTime int64  `json:"createTime"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ReadStateResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" || request.MessageID == "" {
+		return marshalResponse(ReadStateResponse{Success: false, Error: "Missing required fields: channelId or messageId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil {
+		return marshalResponse(ReadStateResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if !member {
+		return marshalResponse(ReadStateResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+
+	now := time.Now().Unix()
+	cursor := &ReadCursor{ChannelID: request.ChannelID, MessageID: request.MessageID, CreateTime: request.CreateTime, ReadAt: now}
+	if cursor.CreateTime <= 0 || cursor.CreateTime > now {
+		cursor.CreateTime = now
+	}
+
+	stored, versions, err := readCursors(ctx, nk, userID, []string{request.ChannelID})
+	if err != nil {
+		return marshalResponse(ReadStateResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	// Cursors only move forward, so a late call from another device cannot mark messages unread again
+	if previous := stored[request.ChannelID]; previous != nil && (previous.MessageID == cursor.MessageID || previous.CreateTime > cursor.CreateTime) {
+		return marshalResponse(ReadStateResponse{Success: true, LastRead: previous})
+	}
+
+	version := versions[request.ChannelID]
+	if version == "" {
+		version = "*"
+	}
+	value, _ := json.Marshal(cursor)
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      READ_STATE_COLLECTION,
+		Key:             request.ChannelID,
+		UserID:          userID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}}); err != nil {
+		return marshalResponse(ReadStateResponse{Success: false, Error: fmt.Sprintf("Failed to save read state: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	event := &ChannelEvent{
+		Type:      "read",
+		ChannelID: request.ChannelID,
+		MessageID: request.MessageID,
+		SenderID:  userID,
+		Username:  usernameFromContext(ctx),
+		CreatedAt: now,
+	}
+	if err := sendChannelEvent(nk, event); err != nil {
+		logger.Warn("Failed to send read receipt for %s: %v", request.ChannelID, err)
+	}
+	return marshalResponse(ReadStateResponse{Success: true, LastRead: cursor})
+}
+
+// RpcGetReadState returns the caller's read cursor and unread count for a batch of channels
+func RpcGetReadState(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ReadStateResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelIDs []string `json:"channelIds"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ReadStateResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.ChannelIDs) == 0 {
+		return marshalResponse(ReadStateResponse{Success: false, Error: "Missing required field: channelIds", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.ChannelIDs) > READ_STATE_MAX_CHANNELS {
+		return marshalResponse(ReadStateResponse{Success: false, Error: fmt.Sprintf("channelIds cannot exceed %d", READ_STATE_MAX_CHANNELS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	cursors, _, err := readCursors(ctx, nk, userID, request.ChannelIDs)
+	if err != nil {
+		return marshalResponse(ReadStateResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	channels := make([]ChannelReadState, 0, len(request.ChannelIDs))
+	for _, channelID := range request.ChannelIDs {
+		state := ChannelReadState{ChannelID: channelID, LastRead: cursors[channelID]}
+
+		member, err := isChannelMember(ctx, nk, channelID, userID)
+		if err != nil || !member {
+			state.Error = "Not a member of this channel"
+			state.Code = ERROR_CODE_NOT_A_MEMBER
+			channels = append(channels, state)
+			continue
+		}
+
+		state.UnreadCount, state.UnreadCapped, err = countUnread(ctx, nk, userID, channelID, state.LastRead)
+		if err != nil {
+			state.Error = fmt.Sprintf("Failed to count unread messages: %v", err)
+			state.Code = ERROR_CODE_INTERNAL
+		}
+		if peer := dmPeer(channelID, userID); peer != "" {
+			if peerCursors, _, err := readCursors(ctx, nk, peer, []string{channelID}); err == nil {
+				state.PeerLastRead = peerCursors[channelID]
+			}
+		}
+		channels = append(channels, state)
+	}
+
+	return marshalResponse(ReadStateResponse{Success: true, Channels: channels})
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// Open reports live in REPORT_COLLECTION and move to REPORT_RESOLVED_COLLECTION once handled,
+	// so the admin queue lists only what still needs attention
+	REPORT_COLLECTION          = "reports"
+	REPORT_RESOLVED_COLLECTION = "reports_resolved"
+	REPORT_MAX_DETAILS         = 500
+	REPORT_LIST_DEFAULT_LIMIT  = 50
+	REPORT_LIST_MAX_LIMIT      = 100
+
+	REPORT_TYPE_MESSAGE = "message"
+	REPORT_TYPE_USER    = "user"
+
+	REPORT_STATUS_OPEN      = "open"
+	REPORT_STATUS_ACTIONED  = "actioned"
+	REPORT_STATUS_DISMISSED = "dismissed"
+)
+
+// REPORT_REASONS are the reason codes clients may send
+var REPORT_REASONS = map[string]bool{
+	"spam":          true,
+	"harassment":    true,
+	"hate":          true,
+	"sexual":        true,
+	"violence":      true,
+	"self_harm":     true,
+	"impersonation": true,
+	"other":         true,
+}
+
+// Report is a user's complaint about a message or another user
+type Report struct {
+	ReportID     string `json:"reportId"`
+	Type         string `json:"type"`
+	ReporterID   string `json:"reporterId"`
+	TargetUserID string `json:"targetUserId"`
+	ChannelID    string `json:"channelId,omitempty"`
+	MessageID    string `json:"messageId,omitempty"`
+	// MessageContent is a copy taken when the report was made, so editing or deleting the message hides nothing
+	MessageContent string `json:"messageContent,omitempty"`
+	Reason         string `json:"reason"`
+	Details        string `json:"details,omitempty"`
+	Status         string `json:"status"`
+	CreatedAt      int64  `json:"createdAt"`
+	ResolvedAt     int64  `json:"resolvedAt,omitempty"`
+	ResolvedBy     string `json:"resolvedBy,omitempty"`
+	Note           string `json:"note,omitempty"`
+}
+
+// ReportResponse represents the response for report RPCs
+type ReportResponse struct {
+	Success  bool      `json:"success"`
+	ReportID string    `json:"reportId,omitempty"`
+	Reports  []*Report `json:"reports,omitempty"`
+	Cursor   string    `json:"cursor,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Code     string    `json:"code,omitempty"`
+}
+
+// reportWrite builds the storage write of a report in the given collection
+func reportWrite(collection string, report *Report) *nkruntime.StorageWrite {
+	value, _ := json.Marshal(report)
+	return &nkruntime.StorageWrite{
+		Collection:      collection,
+		Key:             report.ReportID,
+		Value:           string(value),
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}
+}
+
+// validateReportReason checks the reason code and details shared by both report RPCs
+func validateReportReason(reason, details string) error {
+	if !REPORT_REASONS[reason] {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid reason: %s", reason)
+	}
+	if len(details) > REPORT_MAX_DETAILS {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "details cannot exceed %d bytes", REPORT_MAX_DETAILS)
+	}
+	return nil
+}
+
+// fileReport stores a new open report. Reports filed by the server itself have no reporterId.
+func fileReport(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, report *Report) error {
+	report.ReportID = uuid.New().String()
+	report.Status = REPORT_STATUS_OPEN
+	report.CreatedAt = time.Now().Unix()
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{reportWrite(REPORT_COLLECTION, report)}); err != nil {
+		return fmt.Errorf("failed to save report: %v", err)
+	}
+	logger.Info("Report %s filed by %s against %s (%s)", report.ReportID, report.ReporterID, report.TargetUserID, report.Reason)
+	publishEvent(WEBHOOK_EVENT_REPORT_CREATED, report)
+	return nil
+}
+
+// saveReport stores a new open report and answers the report RPC
+func saveReport(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, report *Report) (string, error) {
+	if err := fileReport(ctx, logger, nk, report); err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(ReportResponse{Success: true, ReportID: report.ReportID})
+}
+
+// RpcReportMessage reports a message in a channel the caller belongs to
+func RpcReportMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ReportResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+		MessageID string `json:"messageId"`
+		Reason    string `json:"reason"`
+		Details   string `json:"details"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" || request.MessageID == "" || request.Reason == "" {
+		return marshalResponse(ReportResponse{Success: false, Error: "Missing required fields: channelId, messageId, or reason", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := validateReportReason(request.Reason, request.Details); err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil || !member {
+		return marshalResponse(ReportResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+
+	message, err := readChannelMessage(ctx, db, request.ChannelID, request.MessageID)
+	if err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if message == nil {
+		return marshalResponse(ReportResponse{Success: false, Error: "Message not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+	if message.SenderID == userID {
+		return marshalResponse(ReportResponse{Success: false, Error: "You cannot report your own message", Code: ERROR_CODE_REJECTED})
+	}
+
+	return saveReport(ctx, logger, nk, &Report{
+		Type:           REPORT_TYPE_MESSAGE,
+		ReporterID:     userID,
+		TargetUserID:   message.SenderID,
+		ChannelID:      request.ChannelID,
+		MessageID:      request.MessageID,
+		MessageContent: message.Content,
+		Reason:         request.Reason,
+		Details:        request.Details,
+	})
+}
+
+// RpcReportUser reports another user, for example for their profile or behaviour across chats
+func RpcReportUser(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ReportResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UserID  string `json:"userId"`
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UserID == "" || request.Reason == "" {
+		return marshalResponse(ReportResponse{Success: false, Error: "Missing required fields: userId or reason", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := validateReportReason(request.Reason, request.Details); err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if request.UserID == userID {
+		return marshalResponse(ReportResponse{Success: false, Error: "You cannot report yourself", Code: ERROR_CODE_REJECTED})
+	}
+	if found, err := existingUsers(ctx, nk, []string{request.UserID}); err != nil || len(found) == 0 {
+		return marshalResponse(ReportResponse{Success: false, Error: "User not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	return saveReport(ctx, logger, nk, &Report{
+		Type:         REPORT_TYPE_USER,
+		ReporterID:   userID,
+		TargetUserID: request.UserID,
+		Reason:       request.Reason,
+		Details:      request.Details,
+	})
+}
+
+// RpcListReports pages through open reports, or handled ones with {"status": "resolved"}. Admin only.
+func RpcListReports(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(ReportResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		Status string `json:"status"`
+		Limit  int    `json:"limit"`
+		Cursor string `json:"cursor"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(ReportResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	collection := REPORT_COLLECTION
+	switch request.Status {
+	case "", REPORT_STATUS_OPEN:
+	case "resolved":
+		collection = REPORT_RESOLVED_COLLECTION
+	default:
+		return marshalResponse(ReportResponse{Success: false, Error: "status must be open or resolved", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Limit <= 0 {
+		request.Limit = REPORT_LIST_DEFAULT_LIMIT
+	}
+	if request.Limit > REPORT_LIST_MAX_LIMIT {
+		request.Limit = REPORT_LIST_MAX_LIMIT
+	}
+
+	objects, cursor, err := nk.StorageList(ctx, "", "", collection, request.Limit, request.Cursor)
+	if err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: fmt.Sprintf("Failed to list reports: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	reports := make([]*Report, 0, len(objects))
+	for _, object := range objects {
+		var report Report
+		if err := json.Unmarshal([]byte(object.Value), &report); err != nil {
+			logger.Warn("Skipping unreadable report %s: %v", object.Key, err)
+			continue
+		}
+		reports = append(reports, &report)
+	}
+
+	return marshalResponse(ReportResponse{Success: true, Reports: reports, Cursor: cursor})
+}
+
+// RpcResolveReport closes an open report as actioned or dismissed. Admin only.
+func RpcResolveReport(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(ReportResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		ReportID   string `json:"reportId"`
+		Resolution string `json:"resolution"`
+		Note       string `json:"note"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ReportID == "" || request.Resolution == "" {
+		return marshalResponse(ReportResponse{Success: false, Error: "Missing required fields: reportId or resolution", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Resolution != REPORT_STATUS_ACTIONED && request.Resolution != REPORT_STATUS_DISMISSED {
+		return marshalResponse(ReportResponse{Success: false, Error: "resolution must be actioned or dismissed", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: REPORT_COLLECTION, Key: request.ReportID}})
+	if err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: fmt.Sprintf("Failed to read report: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	if len(objects) == 0 {
+		return marshalResponse(ReportResponse{Success: false, Error: "Report not found or already resolved", Code: ERROR_CODE_NOT_FOUND})
+	}
+	var report Report
+	if err := json.Unmarshal([]byte(objects[0].Value), &report); err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: fmt.Sprintf("Failed to decode report: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	report.Status = request.Resolution
+	report.ResolvedAt = time.Now().Unix()
+	report.ResolvedBy = userIDFromContext(ctx)
+	report.Note = request.Note
+
+	// Archive and remove in one call; the version check stops two admins resolving the same report
+	if _, _, err := nk.MultiUpdate(ctx, nil, []*nkruntime.StorageWrite{reportWrite(REPORT_RESOLVED_COLLECTION, &report)}, []*nkruntime.StorageDelete{{
+		Collection: REPORT_COLLECTION,
+		Key:        report.ReportID,
+		Version:    objects[0].Version,
+	}}, nil, false); err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: fmt.Sprintf("Failed to resolve report: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	logger.Info("Report %s %s by %s", report.ReportID, report.Status, report.ResolvedBy)
+	return marshalResponse(ReportResponse{Success: true, ReportID: report.ReportID})
+}
+
+// RpcBanUser bans an account and disconnects its sessions. Admin only.
+func RpcBanUser(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(ReportResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		UserID string `json:"userId"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UserID == "" {
+		return marshalResponse(ReportResponse{Success: false, Error: "Missing required field: userId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UserID == userIDFromContext(ctx) {
+		return marshalResponse(ReportResponse{Success: false, Error: "You cannot ban yourself", Code: ERROR_CODE_REJECTED})
+	}
+
+	if err := nk.UsersBanId(ctx, []string{request.UserID}); err != nil {
+		return marshalResponse(ReportResponse{Success: false, Error: fmt.Sprintf("Failed to ban user: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	logger.Info("User %s banned by %s: %s", request.UserID, userIDFromContext(ctx), request.Reason)
+	publishEvent(WEBHOOK_EVENT_USER_BANNED, map[string]interface{}{
+		"userId":   request.UserID,
+		"bannedBy": userIDFromContext(ctx),
+		"reason":   request.Reason,
+	})
+	return marshalResponse(ReportResponse{Success: true})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	STORAGE_RETRY_DEFAULT_ATTEMPTS = 3
+	STORAGE_RETRY_BASE_DELAY       = 100 * time.Millisecond
+	STORAGE_RETRY_MAX_DELAY        = 2 * time.Second
+	// STORAGE_BREAKER_DEFAULT_FAILURES consecutive failed operations open the circuit
+	STORAGE_BREAKER_DEFAULT_FAILURES         = 5
+	STORAGE_BREAKER_DEFAULT_COOLDOWN_SECONDS = 30
+)
+
+// errStorageCircuitOpen is returned without calling storage while the circuit breaker is open
+var errStorageCircuitOpen = errors.New("object storage unavailable, retrying later")
+
+// circuitBreaker stops calls to a failing dependency for a cooldown, then lets a single trial call through
+// (half-open) whose outcome closes or re-opens it
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openUntil time.Time
+	trial     bool
+}
+
+// allow reports whether a call may go ahead
+func (c *circuitBreaker) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < c.threshold {
+		return true
+	}
+	if time.Now().Before(c.openUntil) || c.trial {
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+// release ends an allowed call without an outcome, such as one its caller gave up on
+func (c *circuitBreaker) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+}
+
+// record counts the outcome of an allowed call and reports whether it changed the circuit's state
+func (c *circuitBreaker) record(failed bool) (opened, closed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wasOpen := c.failures >= c.threshold
+	c.trial = false
+	if !failed {
+		c.failures = 0
+		return false, wasOpen
+	}
+	c.failures++
+	if c.failures >= c.threshold {
+		c.openUntil = time.Now().Add(c.cooldown)
+		return !wasOpen, false
+	}
+	return false, false
+}
+
+// resilientBackend retries transient storage failures with exponential backoff and full jitter, and
+// short-circuits every call while storage keeps failing. Retries stop when the caller's context would
+// expire before the next attempt.
+type resilientBackend struct {
+	StorageBackend
+	logger    nkruntime.Logger
+	attempts  int
+	retryable func(error) bool
+	breaker   *circuitBreaker
+}
+
+// newResilientBackend wraps a backend with the STORAGE_RETRY_ATTEMPTS, STORAGE_BREAKER_FAILURES and
+// STORAGE_BREAKER_COOLDOWN_SECONDS policy; retryable tells transient errors from final ones
+func newResilientBackend(logger nkruntime.Logger, backend StorageBackend, retryable func(error) bool) *resilientBackend {
+	return &resilientBackend{
+		StorageBackend: backend,
+		logger:         logger,
+		attempts:       serverConfig.StorageRetryAttempts,
+		retryable:      retryable,
+		breaker: &circuitBreaker{
+			threshold: serverConfig.StorageBreakerFailures,
+			cooldown:  time.Duration(serverConfig.StorageBreakerCooldownSeconds) * time.Second,
+		},
+	}
+}
+
+// retryDelay is the full-jitter exponential backoff before retry n (1-based)
+func retryDelay(n int) time.Duration {
+	ceiling := STORAGE_RETRY_BASE_DELAY << uint(n-1)
+	if ceiling <= 0 || ceiling > STORAGE_RETRY_MAX_DELAY {
+		ceiling = STORAGE_RETRY_MAX_DELAY
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// do runs op under the retry policy and circuit breaker. rewind prepares a request body for another
+// attempt and returns false when it cannot, which makes the first failure final.
+func (b *resilientBackend) do(ctx context.Context, operation string, rewind func() bool, op func() error) error {
+	if !b.breaker.allow() {
+		return errStorageCircuitOpen
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = op(); err == nil || !b.retryable(err) || attempt >= b.attempts || (rewind != nil && !rewind()) {
+			break
+		}
+		delay := retryDelay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			b.breaker.release()
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	// Only outages count against the circuit; a missing object says nothing about storage health
+	opened, closed := b.breaker.record(err != nil && b.retryable(err))
+	if opened {
+		b.logger.Error("Object storage circuit opened after %s failed: %v", operation, err)
+	} else if closed {
+		b.logger.Info("Object storage circuit closed")
+	}
+	if metrics != nil && (opened || closed) {
+		state := 0.0
+		if opened {
+			state = 1
+		}
+		metrics.MetricsGaugeSet("storage_circuit_open", map[string]string{"backend": b.Name()}, state)
+	}
+	return err
+}
+
+// seekRewind rewinds a request body to its start, if it is seekable
+func seekRewind(data io.Reader) func() bool {
+	return func() bool {
+		seeker, ok := data.(io.Seeker)
+		if !ok {
+			return false
+		}
+		_, err := seeker.Seek(0, io.SeekStart)
+		return err == nil
+	}
+}
+
+func (b *resilientBackend) EnsureBucket(ctx context.Context, logger nkruntime.Logger, bucket string) error {
+	return b.do(ctx, "ensure_bucket", nil, func() error {
+		return b.StorageBackend.EnsureBucket(ctx, logger, bucket)
+	})
+}
+
+func (b *resilientBackend) SetBucketLifecycle(ctx context.Context, logger nkruntime.Logger, bucket string, rules BucketLifecycle) error {
+	return b.do(ctx, "set_bucket_lifecycle", nil, func() error {
+		return b.StorageBackend.SetBucketLifecycle(ctx, logger, bucket, rules)
+	})
+}
+
+func (b *resilientBackend) PutObject(ctx context.Context, bucket, key string, data io.Reader, size int64, contentType string) error {
+	return b.do(ctx, "put_object", seekRewind(data), func() error {
+		return b.StorageBackend.PutObject(ctx, bucket, key, data, size, contentType)
+	})
+}
+
+func (b *resilientBackend) GetObject(ctx context.Context, bucket, key string) (io.ReadSeekCloser, error) {
+	var object io.ReadSeekCloser
+	err := b.do(ctx, "get_object", nil, func() (err error) {
+		object, err = b.StorageBackend.GetObject(ctx, bucket, key)
+		return err
+	})
+	return object, err
+}
+
+func (b *resilientBackend) StatObject(ctx context.Context, bucket, key string) (*StoredObject, error) {
+	var info *StoredObject
+	err := b.do(ctx, "stat_object", nil, func() (err error) {
+		info, err = b.StorageBackend.StatObject(ctx, bucket, key)
+		return err
+	})
+	return info, err
+}
+
+func (b *resilientBackend) RemoveObject(ctx context.Context, bucket, key string) error {
+	return b.do(ctx, "remove_object", nil, func() error {
+		return b.StorageBackend.RemoveObject(ctx, bucket, key)
+	})
+}
+
+func (b *resilientBackend) ListObjects(ctx context.Context, bucket, prefix string, fn func(*StoredObject) bool) error {
+	// A listing is only retried before any object was handed to fn, so none is seen twice
+	listed := false
+	return b.do(ctx, "list_objects", func() bool { return !listed }, func() error {
+		return b.StorageBackend.ListObjects(ctx, bucket, prefix, func(object *StoredObject) bool {
+			listed = true
+			return fn(object)
+		})
+	})
+}
+
+func (b *resilientBackend) PresignGet(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	var url string
+	err := b.do(ctx, "presign_get", nil, func() (err error) {
+		url, err = b.StorageBackend.PresignGet(ctx, bucket, key, expiry)
+		return err
+	})
+	return url, err
+}
+
+func (b *resilientBackend) PresignPut(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	var url string
+	err := b.do(ctx, "presign_put", nil, func() (err error) {
+		url, err = b.StorageBackend.PresignPut(ctx, bucket, key, expiry)
+		return err
+	})
+	return url, err
+}
+
+func (b *resilientBackend) NewMultipartUpload(ctx context.Context, bucket, key, contentType string) (string, error) {
+	var uploadID string
+	err := b.do(ctx, "new_multipart_upload", nil, func() (err error) {
+		uploadID, err = b.StorageBackend.NewMultipartUpload(ctx, bucket, key, contentType)
+		return err
+	})
+	return uploadID, err
+}
+
+func (b *resilientBackend) PutObjectPart(ctx context.Context, bucket, key, uploadID string, number int, data io.Reader, size int64) (string, error) {
+	var etag string
+	err := b.do(ctx, "put_object_part", seekRewind(data), func() (err error) {
+		etag, err = b.StorageBackend.PutObjectPart(ctx, bucket, key, uploadID, number, data, size)
+		return err
+	})
+	return etag, err
+}
+
+func (b *resilientBackend) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []ObjectPart) error {
+	return b.do(ctx, "complete_multipart_upload", nil, func() error {
+		return b.StorageBackend.CompleteMultipartUpload(ctx, bucket, key, uploadID, parts)
+	})
+}
+
+func (b *resilientBackend) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	return b.do(ctx, "abort_multipart_upload", nil, func() error {
+		return b.StorageBackend.AbortMultipartUpload(ctx, bucket, key, uploadID)
+	})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	SEARCH_DEFAULT_LIMIT = 20
+	SEARCH_MAX_LIMIT     = 100
+	SEARCH_MAX_QUERY     = 256
+)
+
+// messageSearchEnabled is set once the search table exists; until then messages are not indexed
+var messageSearchEnabled bool
+
+// searchSchema creates message_search, a copy of the searchable text of chat messages with a GIN full-text index.
+// It is kept up to date by indexSentMessage, edit_message and delete_message. Documents use the "simple"
+// text search configuration, which does no stemming and so works for any language.
+var searchSchema = []string{
+	`CREATE TABLE IF NOT EXISTS message_search (
+		message_id        UUID PRIMARY KEY,
+		channel_id        VARCHAR(256) NOT NULL,
+		stream_mode       SMALLINT NOT NULL,
+		stream_subject    VARCHAR(64) NOT NULL DEFAULT '',
+		stream_descriptor VARCHAR(64) NOT NULL DEFAULT '',
+		sender_id         VARCHAR(64) NOT NULL DEFAULT '',
+		username          VARCHAR(128) NOT NULL DEFAULT '',
+		body              TEXT NOT NULL,
+		document          TSVECTOR NOT NULL,
+		create_time       TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS message_search_document_idx ON message_search USING GIN (document)`,
+	`CREATE INDEX IF NOT EXISTS message_search_channel_time_idx ON message_search (channel_id, create_time DESC, message_id DESC)`,
+}
+
+// searchBackfill copies chat messages sent before the index existed, using the same channel ID encoding as Nakama
+const searchBackfill = `
+INSERT INTO message_search (message_id, channel_id, stream_mode, stream_subject, stream_descriptor, sender_id, username, body, document, create_time)
+SELECT id, channel_id, stream_mode, subject, descriptor, sender, username, body, to_tsvector('simple', body), create_time FROM (
+	SELECT id, stream_mode, username, create_time,
+		stream_mode::TEXT || '.' || subject || '.' || descriptor || '.' || stream_label AS channel_id, subject, descriptor, sender,
+		concat_ws(' ', content->>'message', content->>'text', content->>'caption') AS body
+	FROM (
+		SELECT id, stream_mode, stream_label, username, content, create_time,
+			CASE WHEN stream_subject::TEXT = '00000000-0000-0000-0000-000000000000' THEN '' ELSE stream_subject::TEXT END AS subject,
+			CASE WHEN stream_descriptor::TEXT = '00000000-0000-0000-0000-000000000000' THEN '' ELSE stream_descriptor::TEXT END AS descriptor,
+			CASE WHEN sender_id::TEXT = '00000000-0000-0000-0000-000000000000' THEN '' ELSE sender_id::TEXT END AS sender
+		FROM message WHERE code = 0
+	) m
+) t WHERE body <> ''
+ON CONFLICT (message_id) DO NOTHING`
+
+// SearchHit is one message matching a search
+type SearchHit struct {
+	MessageID string `json:"messageId"`
+	ChannelID string `json:"channelId"`
+	SenderID  string `json:"senderId"`
+	Username  string `json:"username"`
+	Body      string `json:"body"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// SearchResponse represents the response for search_messages
+type SearchResponse struct {
+	Success bool         `json:"success"`
+	Results []*SearchHit `json:"results,omitempty"`
+	Cursor  string       `json:"cursor,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Code    string       `json:"code,omitempty"`
+}
+
+// searchCursor is the position after the last hit of a page; results are ordered newest first
+type searchCursor struct {
+	CreateTime int64  `json:"t"`
+	MessageID  string `json:"id"`
+}
+
+// InitializeMessageSearch creates the search table and, when it is new, fills it from existing messages
+func InitializeMessageSearch(ctx context.Context, logger nkruntime.Logger, db *sql.DB) error {
+	var existing sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('message_search')::TEXT").Scan(&existing); err != nil {
+		return fmt.Errorf("failed to check search table: %v", err)
+	}
+	for _, statement := range searchSchema {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create search table: %v", err)
+		}
+	}
+	messageSearchEnabled = true
+	if existing.Valid {
+		return nil
+	}
+
+	result, err := db.ExecContext(ctx, searchBackfill)
+	if err != nil {
+		return fmt.Errorf("failed to index existing messages: %v", err)
+	}
+	count, _ := result.RowsAffected()
+	logger.Info("Message search index created with %d existing messages", count)
+	return nil
+}
+
+// searchableText joins the user-written text fields of message content
+func searchableText(content string) string {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &decoded); err != nil {
+		return ""
+	}
+	parts := make([]string, 0, len(MESSAGE_TEXT_FIELDS))
+	for _, field := range MESSAGE_TEXT_FIELDS {
+		if text, ok := decoded[field].(string); ok && text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// indexSentMessage is the sent-message hook that adds a message's text to the search index
+func indexSentMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage) {
+	if !messageSearchEnabled {
+		return
+	}
+	body := searchableText(message.Content)
+	if body == "" {
+		return
+	}
+	ref, err := parseChannelID(message.ChannelID)
+	if err != nil {
+		return
+	}
+	if _, err := db.ExecContext(ctx, `
+INSERT INTO message_search (message_id, channel_id, stream_mode, stream_subject, stream_descriptor, sender_id, username, body, document, create_time)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, to_tsvector('simple', $8), to_timestamp($9))
+ON CONFLICT (message_id) DO NOTHING`,
+		message.MessageID, message.ChannelID, ref.Mode, ref.Subject, ref.Subcontext, message.SenderID, message.Username, body, message.CreatedAt,
+	); err != nil {
+		logger.Warn("Failed to index message %s: %v", message.MessageID, err)
+	}
+}
+
+// reindexMessage replaces the indexed text of an edited message
+func reindexMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, messageID string, content map[string]interface{}) {
+	if !messageSearchEnabled {
+		return
+	}
+	encoded, _ := json.Marshal(content)
+	body := searchableText(string(encoded))
+	var err error
+	if body == "" {
+		_, err = db.ExecContext(ctx, "DELETE FROM message_search WHERE message_id = $1", messageID)
+	} else {
+		_, err = db.ExecContext(ctx, "UPDATE message_search SET body = $2, document = to_tsvector('simple', $2) WHERE message_id = $1", messageID, body)
+	}
+	if err != nil {
+		logger.Warn("Failed to reindex message %s: %v", messageID, err)
+	}
+}
+
+// unindexMessage removes a deleted message from the search index
+func unindexMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, messageID string) {
+	if !messageSearchEnabled {
+		return
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM message_search WHERE message_id = $1", messageID); err != nil {
+		logger.Warn("Failed to unindex message %s: %v", messageID, err)
+	}
+}
+
+// userGroupIDs lists the groups a user is a full member of
+func userGroupIDs(ctx context.Context, nk nkruntime.NakamaModule, userID string) ([]string, error) {
+	var ids []string
+	cursor := ""
+	for {
+		groups, next, err := nk.UserGroupsList(ctx, userID, GROUP_LIST_PAGE_SIZE, nil, cursor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list user groups: %v", err)
+		}
+		for _, g := range groups {
+			if g.Group != nil && g.State != nil && g.State.Value <= GROUP_STATE_MEMBER {
+				ids = append(ids, g.Group.Id)
+			}
+		}
+		if next == "" {
+			return ids, nil
+		}
+		cursor = next
+	}
+}
+
+// RpcSearchMessages runs a full-text search over the messages the caller can read, newest first.
+// Without channelId it searches rooms, the caller's groups and the caller's direct chats.
+func RpcSearchMessages(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(SearchResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	if !messageSearchEnabled {
+		return marshalResponse(SearchResponse{Success: false, Error: "Search is unavailable", Code: ERROR_CODE_REJECTED})
+	}
+
+	var request struct {
+		Query     string `json:"query"`
+		ChannelID string `json:"channelId"`
+		SenderID  string `json:"senderId"`
+		From      int64  `json:"from"`
+		To        int64  `json:"to"`
+		Limit     int    `json:"limit"`
+		Cursor    string `json:"cursor"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(SearchResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	request.Query = strings.TrimSpace(request.Query)
+	if request.Query == "" {
+		return marshalResponse(SearchResponse{Success: false, Error: "Missing required field: query", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Query) > SEARCH_MAX_QUERY {
+		return marshalResponse(SearchResponse{Success: false, Error: fmt.Sprintf("query cannot exceed %d bytes", SEARCH_MAX_QUERY), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Limit <= 0 {
+		request.Limit = SEARCH_DEFAULT_LIMIT
+	}
+	if request.Limit > SEARCH_MAX_LIMIT {
+		request.Limit = SEARCH_MAX_LIMIT
+	}
+
+	query := strings.Builder{}
+	query.WriteString(`SELECT message_id::TEXT, channel_id, sender_id, username, body, create_time FROM message_search
+WHERE document @@ plainto_tsquery('simple', $1)`)
+	args := []interface{}{request.Query}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if request.ChannelID != "" {
+		member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+		if err != nil {
+			return marshalResponse(SearchResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		if !member {
+			return marshalResponse(SearchResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+		}
+		query.WriteString(" AND channel_id = " + arg(request.ChannelID))
+	} else {
+		groups, err := userGroupIDs(ctx, nk, userID)
+		if err != nil {
+			return marshalResponse(SearchResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		uid := arg(userID)
+		query.WriteString(fmt.Sprintf(" AND (stream_mode = %d OR (stream_mode = %d AND (stream_subject = %s OR stream_descriptor = %s))",
+			STREAM_MODE_CHANNEL, STREAM_MODE_DM, uid, uid))
+		if len(groups) > 0 {
+			placeholders := make([]string, 0, len(groups))
+			for _, id := range groups {
+				placeholders = append(placeholders, arg(id))
+			}
+			query.WriteString(fmt.Sprintf(" OR (stream_mode = %d AND stream_subject IN (%s))", STREAM_MODE_GROUP, strings.Join(placeholders, ", ")))
+		}
+		query.WriteString(")")
+	}
+	if request.SenderID != "" {
+		query.WriteString(" AND sender_id = " + arg(request.SenderID))
+	}
+	if request.From > 0 {
+		query.WriteString(" AND create_time >= to_timestamp(" + arg(request.From) + ")")
+	}
+	if request.To > 0 {
+		query.WriteString(" AND create_time < to_timestamp(" + arg(request.To) + ")")
+	}
+	if request.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(request.Cursor)
+		var cursor searchCursor
+		if err == nil {
+			err = json.Unmarshal(raw, &cursor)
+		}
+		if err != nil || cursor.MessageID == "" {
+			return marshalResponse(SearchResponse{Success: false, Error: "Invalid cursor", Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		t := arg(time.UnixMicro(cursor.CreateTime).UTC())
+		query.WriteString(fmt.Sprintf(" AND (create_time < %s OR (create_time = %s AND message_id < %s))", t, t, arg(cursor.MessageID)))
+	}
+	// One extra row tells whether there is another page
+	query.WriteString(" ORDER BY create_time DESC, message_id DESC LIMIT " + arg(request.Limit+1))
+
+	rows, err := db.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		logger.Error("Message search failed: %v", err)
+		return marshalResponse(SearchResponse{Success: false, Error: "Search failed", Code: ERROR_CODE_INTERNAL})
+	}
+	defer rows.Close()
+
+	results := make([]*SearchHit, 0, request.Limit)
+	var last time.Time
+	next := ""
+	for rows.Next() {
+		if len(results) == request.Limit {
+			encoded, _ := json.Marshal(searchCursor{CreateTime: last.UnixMicro(), MessageID: results[len(results)-1].MessageID})
+			next = base64.RawURLEncoding.EncodeToString(encoded)
+			break
+		}
+		var hit SearchHit
+		if err := rows.Scan(&hit.MessageID, &hit.ChannelID, &hit.SenderID, &hit.Username, &hit.Body, &last); err != nil {
+			logger.Error("Failed to read search result: %v", err)
+			return marshalResponse(SearchResponse{Success: false, Error: "Search failed", Code: ERROR_CODE_INTERNAL})
+		}
+		hit.CreatedAt = last.Unix()
+		results = append(results, &hit)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("Message search failed: %v", err)
+		return marshalResponse(SearchResponse{Success: false, Error: "Search failed", Code: ERROR_CODE_INTERNAL})
+	}
+
+	return marshalResponse(SearchResponse{Success: true, Results: results, Cursor: next})
+}
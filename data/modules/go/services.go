@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Clock tells the current time
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// StorageProvider hands out the storage backend to use for a call
+type StorageProvider interface {
+	Backend(logger nkruntime.Logger) (StorageBackend, error)
+}
+
+// configuredStorage is the backend selected by STORAGE_BACKEND, built on first use and replaced by reload_storage
+type configuredStorage struct{}
+
+func (configuredStorage) Backend(logger nkruntime.Logger) (StorageBackend, error) {
+	return getStorageBackend(logger)
+}
+
+// Services are what the media RPCs depend on besides the arguments Nakama passes every call, the logger among
+// them. InitModule wires them to the configured backend, the system clock and the loaded configuration, and
+// registers the handlers as methods; tests wire them to an in-memory backend and a stopped clock.
+type Services struct {
+	Storage StorageProvider
+	Clock   Clock
+	Config  *Config
+	// UploadSlots holds one token per inline upload in progress, sized by UPLOAD_MAX_CONCURRENT
+	UploadSlots chan struct{}
+}
+
+// newServices returns the services of a running server with the given configuration
+func newServices(config *Config) *Services {
+	return &Services{
+		Storage:     configuredStorage{},
+		Clock:       systemClock{},
+		Config:      config,
+		UploadSlots: make(chan struct{}, config.UploadMaxConcurrent),
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden responses in testdata")
+
+// testNow is where the stopped clock of a test harness starts
+var testNow = time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+const (
+	testOwnerID = "9f1c2b7e-3d4a-4e5f-8a6b-7c8d9e0f1a2b"
+	testOtherID = "0b6e4c1d-2f3a-4b5c-9d8e-7f6a5b4c3d2e"
+	testAdminID = "5a4b3c2d-1e0f-4a9b-8c7d-6e5f4a3b2c1d"
+)
+
+// stoppedClock only moves when a test advances it
+type stoppedClock struct {
+	now time.Time
+}
+
+func (c *stoppedClock) Now() time.Time { return c.now }
+
+func (c *stoppedClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// fakeS3 is an in-memory object store that signs URLs against the test clock, so responses are reproducible.
+// An error in failures is returned by the operation of that name instead of running it.
+type fakeS3 struct {
+	*memoryBackend
+	clock    Clock
+	failures map[string]error
+}
+
+func newFakeS3(clock Clock) *fakeS3 {
+	return &fakeS3{memoryBackend: &memoryBackend{store: newMemoryStore()}, clock: clock, failures: map[string]error{}}
+}
+
+func (f *fakeS3) Name() string { return "fake-s3" }
+
+func (f *fakeS3) EnsureBucket(ctx context.Context, logger nkruntime.Logger, bucket string) error {
+	if err := f.failures["EnsureBucket"]; err != nil {
+		return err
+	}
+	return f.memoryBackend.EnsureBucket(ctx, logger, bucket)
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, bucket, key string, data io.Reader, size int64, contentType string) error {
+	if err := f.failures["PutObject"]; err != nil {
+		return err
+	}
+	return f.memoryBackend.PutObject(ctx, bucket, key, data, size, contentType)
+}
+
+func (f *fakeS3) StatObject(ctx context.Context, bucket, key string) (*StoredObject, error) {
+	if err := f.failures["StatObject"]; err != nil {
+		return nil, err
+	}
+	return f.memoryBackend.StatObject(ctx, bucket, key)
+}
+
+func (f *fakeS3) RemoveObject(ctx context.Context, bucket, key string) error {
+	if err := f.failures["RemoveObject"]; err != nil {
+		return err
+	}
+	return f.memoryBackend.RemoveObject(ctx, bucket, key)
+}
+
+func (f *fakeS3) PresignGet(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	if err := f.failures["PresignGet"]; err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"X-Amz-Date":    {f.clock.Now().UTC().Format("20060102T150405Z")},
+		"X-Amz-Expires": {strconv.Itoa(int(expiry.Seconds()))},
+	}
+	return (&url.URL{Scheme: "https", Host: "s3.test", Path: "/" + bucket + "/" + key, RawQuery: query.Encode()}).String(), nil
+}
+
+// seed stores an object directly, creating its bucket
+func (f *fakeS3) seed(t *testing.T, bucket, key string, data []byte) {
+	t.Helper()
+	if err := f.memoryBackend.EnsureBucket(context.Background(), newTestLogger(), bucket); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.memoryBackend.PutObject(context.Background(), bucket, key, bytes.NewReader(data), int64(len(data)), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// object returns the stored bytes of an object, nil if there is none
+func (f *fakeS3) object(bucket, key string) []byte {
+	f.store.Lock()
+	defer f.store.Unlock()
+	if object, ok := f.store.buckets[bucket][key]; ok {
+		return object.data
+	}
+	return nil
+}
+
+// fixedStorage always hands out the same backend, or the same error
+type fixedStorage struct {
+	backend StorageBackend
+	err     error
+}
+
+func (p fixedStorage) Backend(logger nkruntime.Logger) (StorageBackend, error) {
+	return p.backend, p.err
+}
+
+// fakeNakama keeps storage objects in memory with Nakama's version checks. Calling any other module
+// function panics on the nil embedded interface, which shows a test reached code it did not set up.
+type fakeNakama struct {
+	nkruntime.NakamaModule
+	mu       sync.Mutex
+	objects  map[string]*api.StorageObject
+	versions int
+	// writeErr fails every storage write when set
+	writeErr error
+}
+
+func newFakeNakama() *fakeNakama {
+	return &fakeNakama{objects: map[string]*api.StorageObject{}}
+}
+
+func storageID(collection, key, userID string) string {
+	return collection + "/" + key + "/" + userID
+}
+
+func (nk *fakeNakama) StorageRead(ctx context.Context, reads []*nkruntime.StorageRead) ([]*api.StorageObject, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	var objects []*api.StorageObject
+	for _, read := range reads {
+		if object, ok := nk.objects[storageID(read.Collection, read.Key, read.UserID)]; ok {
+			objects = append(objects, &api.StorageObject{
+				Collection:      object.Collection,
+				Key:             object.Key,
+				UserId:          object.UserId,
+				Value:           object.Value,
+				Version:         object.Version,
+				PermissionRead:  object.PermissionRead,
+				PermissionWrite: object.PermissionWrite,
+			})
+		}
+	}
+	return objects, nil
+}
+
+// StorageWrite applies all writes or none: "*" only creates, any other non-empty version must match
+func (nk *fakeNakama) StorageWrite(ctx context.Context, writes []*nkruntime.StorageWrite) ([]*api.StorageObjectAck, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	if nk.writeErr != nil {
+		return nil, nk.writeErr
+	}
+	for _, write := range writes {
+		current, exists := nk.objects[storageID(write.Collection, write.Key, write.UserID)]
+		if (write.Version == "*" && exists) || (write.Version != "" && write.Version != "*" && (!exists || current.Version != write.Version)) {
+			return nil, nkruntime.ErrStorageRejectedVersion
+		}
+	}
+	acks := make([]*api.StorageObjectAck, 0, len(writes))
+	for _, write := range writes {
+		nk.versions++
+		version := fmt.Sprint(nk.versions)
+		nk.objects[storageID(write.Collection, write.Key, write.UserID)] = &api.StorageObject{
+			Collection:      write.Collection,
+			Key:             write.Key,
+			UserId:          write.UserID,
+			Value:           write.Value,
+			Version:         version,
+			PermissionRead:  int32(write.PermissionRead),
+			PermissionWrite: int32(write.PermissionWrite),
+		}
+		acks = append(acks, &api.StorageObjectAck{Collection: write.Collection, Key: write.Key, UserId: write.UserID, Version: version})
+	}
+	return acks, nil
+}
+
+func (nk *fakeNakama) StorageDelete(ctx context.Context, deletes []*nkruntime.StorageDelete) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	for _, del := range deletes {
+		current, exists := nk.objects[storageID(del.Collection, del.Key, del.UserID)]
+		if del.Version != "" && (!exists || current.Version != del.Version) {
+			return nkruntime.ErrStorageRejectedVersion
+		}
+	}
+	for _, del := range deletes {
+		delete(nk.objects, storageID(del.Collection, del.Key, del.UserID))
+	}
+	return nil
+}
+
+// MultiUpdate applies the storage writes, then the deletes
+func (nk *fakeNakama) MultiUpdate(ctx context.Context, accountUpdates []*nkruntime.AccountUpdate, storageWrites []*nkruntime.StorageWrite, storageDeletes []*nkruntime.StorageDelete, walletUpdates []*nkruntime.WalletUpdate, updateLedger bool) ([]*api.StorageObjectAck, []*nkruntime.WalletUpdateResult, error) {
+	acks, err := nk.StorageWrite(ctx, storageWrites)
+	if err != nil {
+		return nil, nil, err
+	}
+	return acks, nil, nk.StorageDelete(ctx, storageDeletes)
+}
+
+func (nk *fakeNakama) MetricsCounterAdd(name string, tags map[string]string, delta int64) {}
+
+// attachment returns the stored attachment record of an object, nil if there is none
+func (nk *fakeNakama) attachment(t *testing.T, ownerID, objectKey string) *Attachment {
+	t.Helper()
+	attachment, _, err := readAttachment(context.Background(), nk, ownerID, objectKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attachment
+}
+
+// testHarness runs the media RPCs against a fake S3, a fake Nakama and a stopped clock
+type testHarness struct {
+	services *Services
+	s3       *fakeS3
+	nk       *fakeNakama
+	clock    *stoppedClock
+	logger   *testLogger
+}
+
+// newTestHarness loads the configuration from env, on top of STORAGE_BACKEND=memory, and installs it as the
+// server configuration for the code that still reads it, restoring everything when the test ends
+func newTestHarness(t *testing.T, env map[string]string) *testHarness {
+	t.Helper()
+	merged := map[string]string{"STORAGE_BACKEND": "memory"}
+	for k, v := range env {
+		merged[k] = v
+	}
+	previousEnv, previousConfig, previousURLs := runtimeEnv, serverConfig, imageURLs
+	t.Cleanup(func() {
+		runtimeEnv, serverConfig, imageURLs = previousEnv, previousConfig, previousURLs
+	})
+
+	config, err := LoadConfig(context.WithValue(context.Background(), nkruntime.RUNTIME_CTX_ENV, merged))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	serverConfig = config
+	imageURLs = &imageURLCache{entries: map[string]*IssuedURL{}}
+
+	clock := &stoppedClock{now: testNow}
+	s3 := newFakeS3(clock)
+	return &testHarness{
+		services: &Services{Storage: fixedStorage{backend: s3}, Clock: clock, Config: config, UploadSlots: make(chan struct{}, 1)},
+		s3:       s3,
+		nk:       newFakeNakama(),
+		clock:    clock,
+		logger:   newTestLogger(),
+	}
+}
+
+// rpcHandler is the signature Nakama calls RPCs with
+type rpcHandler func(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error)
+
+// call runs an RPC as userID, or server to server when userID is ""
+func (h *testHarness) call(t *testing.T, rpc rpcHandler, userID, payload string) string {
+	t.Helper()
+	ctx := context.Background()
+	if userID != "" {
+		ctx = context.WithValue(ctx, nkruntime.RUNTIME_CTX_USER_ID, userID)
+	}
+	out, err := rpc(ctx, h.logger, nil, h.nk, payload)
+	if err != nil {
+		t.Fatalf("rpc failed: %v", err)
+	}
+	return out
+}
+
+// saveAttachment stores an attachment record as if its upload had happened
+func (h *testHarness) saveAttachment(t *testing.T, attachment *Attachment) {
+	t.Helper()
+	if _, err := h.nk.StorageWrite(context.Background(), []*nkruntime.StorageWrite{attachmentWrite(attachment, "")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPNG encodes a small opaque image
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadPayload builds an upload_image request for data
+func uploadPayload(data []byte, contentType, fileName string) string {
+	payload, _ := json.Marshal(map[string]string{
+		"imageData":   base64.StdEncoding.EncodeToString(data),
+		"contentType": contentType,
+		"fileName":    fileName,
+	})
+	return string(payload)
+}
+
+// decodeResponse reads the success flag and error code of an RPC response
+func decodeResponse(t *testing.T, out string) (bool, string) {
+	t.Helper()
+	var response struct {
+		Success bool   `json:"success"`
+		Code    string `json:"code"`
+	}
+	if err := json.Unmarshal([]byte(out), &response); err != nil {
+		t.Fatalf("response %q is not JSON: %v", out, err)
+	}
+	return response.Success, response.Code
+}
+
+// assertGolden compares an RPC response with testdata/<test name>.json. Run the tests with -update to
+// rewrite the files after an intended change.
+func assertGolden(t *testing.T, out string) {
+	t.Helper()
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, []byte(out), "", "  "); err != nil {
+		t.Fatalf("response %q is not JSON: %v", out, err)
+	}
+	indented.WriteByte('\n')
+
+	golden := filepath.Join("testdata", t.Name()+".json")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, indented.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("failed to read golden response, run with -update to create it: %v", err)
+	}
+	if !bytes.Equal(indented.Bytes(), want) {
+		t.Errorf("response differs from %s\ngot:\n%s\nwant:\n%s", golden, indented.Bytes(), want)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	// SPAM_MUTE_COLLECTION holds one object per muted user, readable by that user so clients can show the mute
+	SPAM_MUTE_COLLECTION                  = "spam_mutes"
+	SPAM_MUTE_KEY                         = "mute"
+	SPAM_DEFAULT_RATE_PER_MINUTE          = 30
+	SPAM_DEFAULT_BURST                    = 10
+	SPAM_DEFAULT_DUPLICATE_WINDOW_SECONDS = 60
+	SPAM_DEFAULT_DUPLICATE_MAX            = 3
+	SPAM_DEFAULT_MAX_LINKS                = 5
+	SPAM_DEFAULT_MUTE_AFTER               = 3
+	SPAM_DEFAULT_REPORT_AFTER             = 6
+	SPAM_DEFAULT_MUTE_MINUTES             = 10
+	// SPAM_STRIKE_WINDOW is how long a sender must stay clean for their strikes to be forgotten
+	SPAM_STRIKE_WINDOW = time.Hour
+	// SPAM_MAX_RECENT bounds the fingerprints kept per sender for duplicate detection
+	SPAM_MAX_RECENT        = 20
+	METRIC_SPAM_REJECTIONS = "spam_rejections_total"
+
+	ERROR_CODE_MESSAGE_RATE_LIMITED = "MESSAGE_RATE_LIMITED"
+	ERROR_CODE_SPAM_DETECTED        = "SPAM_DETECTED"
+	ERROR_CODE_MUTED                = "MUTED"
+)
+
+// Spam verdicts, also the "reason" of the rejection metric
+const (
+	SPAM_REASON_RATE      = "rate"
+	SPAM_REASON_DUPLICATE = "duplicate"
+	SPAM_REASON_LINKS     = "links"
+	SPAM_REASON_MUTED     = "muted"
+)
+
+// spamLinkPattern counts links for the link-heavy heuristic, including bare "www." hosts that clients linkify
+var spamLinkPattern = regexp.MustCompile(`(?i)(?:https?://|www\.)[^\s<>"]+`)
+
+// SpamMute is a user's mute, stored so it holds on every node and across restarts
+type SpamMute struct {
+	MutedUntil int64  `json:"mutedUntil"`
+	MutedAt    int64  `json:"mutedAt"`
+	Reason     string `json:"reason"`
+}
+
+// SpamResponse represents the response for unmute_user
+type SpamResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// spamVerdict is a message judged to be spam, with the sender's strikes including this one
+type spamVerdict struct {
+	reason  string
+	strikes int
+	wait    time.Duration
+}
+
+// spamFingerprint is a recent message of a sender, for duplicate detection
+type spamFingerprint struct {
+	hash [32]byte
+	at   time.Time
+}
+
+// spamSender is what the detector remembers about one sender
+type spamSender struct {
+	tokens     float64
+	refilledAt time.Time
+	recent     []spamFingerprint
+	strikes    int
+	lastStrike time.Time
+}
+
+// spamDetector keeps each sender's token bucket, recent messages and strikes. Like slow mode it is per node:
+// a sender spread over several nodes gets each node's allowance, which still stops floods.
+type spamDetector struct {
+	mu        sync.Mutex
+	senders   map[string]*spamSender
+	lastPrune time.Time
+}
+
+var spamState = &spamDetector{senders: map[string]*spamSender{}}
+
+// spamFingerprintOf normalizes case and whitespace, so trivially varied copies still count as duplicates
+func spamFingerprintOf(text string) [32]byte {
+	return sha256.Sum256([]byte(strings.Join(strings.Fields(strings.ToLower(text)), " ")))
+}
+
+// inspect judges a message and records it. A clean message uses a token and is remembered for duplicate
+// detection; a message judged to be spam uses neither and adds a strike.
+func (d *spamDetector) inspect(userID, text string, links int, now time.Time) *spamVerdict {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastPrune) > SPAM_STRIKE_WINDOW {
+		for id, s := range d.senders {
+			if now.Sub(s.refilledAt) > SPAM_STRIKE_WINDOW && now.Sub(s.lastStrike) > SPAM_STRIKE_WINDOW {
+				delete(d.senders, id)
+			}
+		}
+		d.lastPrune = now
+	}
+
+	rate, burst := float64(serverConfig.SpamRatePerMinute)/60, float64(serverConfig.SpamBurst)
+	s, ok := d.senders[userID]
+	if !ok {
+		s = &spamSender{tokens: burst, refilledAt: now}
+		d.senders[userID] = s
+	}
+	s.tokens += now.Sub(s.refilledAt).Seconds() * rate
+	if s.tokens > burst {
+		s.tokens = burst
+	}
+	s.refilledAt = now
+
+	window := time.Duration(serverConfig.SpamDuplicateWindowSeconds) * time.Second
+	kept := s.recent[:0]
+	for _, f := range s.recent {
+		if now.Sub(f.at) < window {
+			kept = append(kept, f)
+		}
+	}
+	s.recent = kept
+
+	verdict := &spamVerdict{}
+	fingerprint := spamFingerprintOf(text)
+	if rate > 0 && s.tokens < 1 {
+		verdict.reason = SPAM_REASON_RATE
+		verdict.wait = time.Duration((1 - s.tokens) / rate * float64(time.Second))
+	} else if limit := serverConfig.SpamMaxLinks; limit > 0 && links > limit {
+		verdict.reason = SPAM_REASON_LINKS
+	} else if limit := serverConfig.SpamDuplicateMax; limit > 0 && strings.TrimSpace(text) != "" {
+		copies := 0
+		for _, f := range s.recent {
+			if f.hash == fingerprint {
+				copies++
+			}
+		}
+		if copies >= limit {
+			verdict.reason = SPAM_REASON_DUPLICATE
+			// The oldest copy leaving the window makes room again
+			for _, f := range s.recent {
+				if f.hash == fingerprint {
+					verdict.wait = window - now.Sub(f.at)
+					break
+				}
+			}
+		}
+	}
+
+	if verdict.reason == "" {
+		if rate > 0 {
+			s.tokens--
+		}
+		if strings.TrimSpace(text) != "" {
+			s.recent = append(s.recent, spamFingerprint{hash: fingerprint, at: now})
+			if len(s.recent) > SPAM_MAX_RECENT {
+				s.recent = s.recent[len(s.recent)-SPAM_MAX_RECENT:]
+			}
+		}
+		return nil
+	}
+	if now.Sub(s.lastStrike) > SPAM_STRIKE_WINDOW {
+		s.strikes = 0
+	}
+	s.strikes++
+	s.lastStrike = now
+	verdict.strikes = s.strikes
+	return verdict
+}
+
+// forget drops what the detector remembers about a sender
+func (d *spamDetector) forget(userID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.senders, userID)
+}
+
+// messageText joins the user-written text fields of decoded message content
+func messageText(content map[string]interface{}) string {
+	parts := make([]string, 0, len(MESSAGE_TEXT_FIELDS))
+	for _, field := range MESSAGE_TEXT_FIELDS {
+		if text, ok := content[field].(string); ok && text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// readSpamMute loads a user's mute, nil when they were never muted
+func readSpamMute(ctx context.Context, nk nkruntime.NakamaModule, userID string) (*SpamMute, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: SPAM_MUTE_COLLECTION, Key: SPAM_MUTE_KEY, UserID: userID}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mute: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	var mute SpamMute
+	if err := json.Unmarshal([]byte(objects[0].Value), &mute); err != nil {
+		return nil, fmt.Errorf("failed to decode mute: %v", err)
+	}
+	return &mute, nil
+}
+
+// muteSender mutes a user for SPAM_MUTE_MINUTES
+func muteSender(ctx context.Context, nk nkruntime.NakamaModule, userID, reason string, now time.Time) (*SpamMute, error) {
+	mute := &SpamMute{
+		MutedUntil: now.Add(time.Duration(serverConfig.SpamMuteMinutes) * time.Minute).Unix(),
+		MutedAt:    now.Unix(),
+		Reason:     reason,
+	}
+	value, _ := json.Marshal(mute)
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      SPAM_MUTE_COLLECTION,
+		Key:             SPAM_MUTE_KEY,
+		UserID:          userID,
+		Value:           string(value),
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}}); err != nil {
+		return nil, fmt.Errorf("failed to save mute: %v", err)
+	}
+	return mute, nil
+}
+
+// mutedError is the rejection of a message from a muted user
+func mutedError(mute *SpamMute, now time.Time) *MessageRejectedError {
+	return &MessageRejectedError{
+		Code:       ERROR_CODE_MUTED,
+		Message:    "You are muted for sending spam",
+		RetryAfter: mute.MutedUntil - now.Unix(),
+	}
+}
+
+func countSpamRejection(reason string) {
+	if metrics == nil {
+		return
+	}
+	metrics.MetricsCounterAdd(METRIC_SPAM_REJECTIONS, map[string]string{"reason": reason}, 1)
+}
+
+// checkSpam is the send check that turns away floods, repeated messages and link-heavy messages. Every
+// rejection is a strike; SPAM_MUTE_AFTER strikes within an hour mute the sender and SPAM_REPORT_AFTER file a
+// spam report for moderators. Server messages and admins are not checked. It runs after the other checks
+// that can reject a message, so messages held back by slow mode, for example, do not use up the sender's
+// allowance. Only the premium sticker charge comes later.
+func checkSpam(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, senderID, channelID string, content map[string]interface{}) (bool, error) {
+	if senderID == "" || !serverConfig.SpamFilter || serverConfig.AdminUserIDs[senderID] {
+		return false, nil
+	}
+	now := time.Now()
+
+	mute, err := readSpamMute(ctx, nk, senderID)
+	if err != nil {
+		logger.Warn("Failed to check mute of %s: %v", senderID, err)
+	} else if mute != nil && mute.MutedUntil > now.Unix() {
+		countSpamRejection(SPAM_REASON_MUTED)
+		return false, mutedError(mute, now)
+	}
+
+	text := messageText(content)
+	verdict := spamState.inspect(senderID, text, len(spamLinkPattern.FindAllString(text, -1)), now)
+	if verdict == nil {
+		return false, nil
+	}
+	countSpamRejection(verdict.reason)
+	logger.Info("Message from %s in %s rejected as spam (%s), strike %d", senderID, channelID, verdict.reason, verdict.strikes)
+
+	if after := serverConfig.SpamReportAfter; after > 0 && verdict.strikes == after {
+		report := &Report{
+			Type:           REPORT_TYPE_USER,
+			TargetUserID:   senderID,
+			ChannelID:      channelID,
+			MessageContent: text,
+			Reason:         "spam",
+			Details:        fmt.Sprintf("Filed automatically after %d spam rejections within an hour, the last for %s", verdict.strikes, verdict.reason),
+		}
+		if err := fileReport(ctx, logger, nk, report); err != nil {
+			logger.Error("Failed to report spammer %s: %v", senderID, err)
+		}
+	}
+	if after := serverConfig.SpamMuteAfter; after > 0 && verdict.strikes >= after {
+		mute, err := muteSender(ctx, nk, senderID, verdict.reason, now)
+		if err != nil {
+			logger.Error("Failed to mute spammer %s: %v", senderID, err)
+		} else {
+			logger.Info("User %s muted until %d for spam", senderID, mute.MutedUntil)
+			return false, mutedError(mute, now)
+		}
+	}
+
+	switch verdict.reason {
+	case SPAM_REASON_RATE:
+		seconds := int64((verdict.wait + time.Second - 1) / time.Second)
+		return false, &MessageRejectedError{Code: ERROR_CODE_MESSAGE_RATE_LIMITED, Message: fmt.Sprintf("Too many messages, wait %d seconds", seconds), RetryAfter: seconds}
+	case SPAM_REASON_DUPLICATE:
+		return false, &MessageRejectedError{Code: ERROR_CODE_SPAM_DETECTED, Message: "Message repeats one you just sent", RetryAfter: int64((verdict.wait + time.Second - 1) / time.Second)}
+	default:
+		return false, &MessageRejectedError{Code: ERROR_CODE_SPAM_DETECTED, Message: fmt.Sprintf("Message has more than %d links", serverConfig.SpamMaxLinks)}
+	}
+}
+
+// RpcUnmuteUser lifts a spam mute and clears the user's strikes. Admin only.
+func RpcUnmuteUser(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(SpamResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		UserID string `json:"userId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(SpamResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UserID == "" {
+		return marshalResponse(SpamResponse{Success: false, Error: "Missing required field: userId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: SPAM_MUTE_COLLECTION, Key: SPAM_MUTE_KEY, UserID: request.UserID}}); err != nil {
+		return marshalResponse(SpamResponse{Success: false, Error: fmt.Sprintf("Failed to unmute user: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	spamState.forget(request.UserID)
+	logger.Info("User %s unmuted by %s", request.UserID, userIDFromContext(ctx))
+	return marshalResponse(SpamResponse{Success: true})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// withSpamConfig runs a test with the given spam settings in serverConfig
+func withSpamConfig(t *testing.T, config Config) {
+	previous := serverConfig
+	serverConfig = &config
+	t.Cleanup(func() { serverConfig = previous })
+}
+
+func TestSpamDetectorInspect(t *testing.T) {
+	withSpamConfig(t, Config{
+		SpamRatePerMinute:          60,
+		SpamBurst:                  3,
+		SpamDuplicateWindowSeconds: 60,
+		SpamDuplicateMax:           2,
+		SpamMaxLinks:               2,
+	})
+	start := time.Unix(1700000000, 0)
+
+	type message struct {
+		text   string
+		links  int
+		after  time.Duration
+		reason string
+		wait   time.Duration
+	}
+	tests := []struct {
+		name     string
+		messages []message
+		strikes  int
+	}{
+		{
+			name: "within burst",
+			messages: []message{
+				{text: "one"}, {text: "two"}, {text: "three"},
+			},
+		},
+		{
+			name: "burst exhausted",
+			messages: []message{
+				{text: "one"}, {text: "two"}, {text: "three"},
+				{text: "four", reason: SPAM_REASON_RATE, wait: time.Second},
+			},
+			strikes: 1,
+		},
+		{
+			name: "tokens refill",
+			messages: []message{
+				{text: "one"}, {text: "two"}, {text: "three"},
+				{text: "four", after: time.Second},
+			},
+		},
+		{
+			name: "too many links",
+			messages: []message{
+				{text: "see these", links: 2},
+				{text: "and these", links: 3, reason: SPAM_REASON_LINKS},
+			},
+			strikes: 1,
+		},
+		{
+			name: "duplicates ignore case and spacing",
+			messages: []message{
+				{text: "Buy now"},
+				{text: "buy   NOW", after: 2 * time.Second},
+				{text: "buy now", after: 2 * time.Second, reason: SPAM_REASON_DUPLICATE, wait: 56 * time.Second},
+			},
+			strikes: 1,
+		},
+		{
+			name: "duplicates leave the window",
+			messages: []message{
+				{text: "hello"},
+				{text: "hello", after: 2 * time.Second},
+				{text: "hello", after: time.Minute},
+			},
+		},
+		{
+			name: "empty text is never a duplicate",
+			messages: []message{
+				{text: ""}, {text: " ", after: time.Second}, {text: "", after: time.Second},
+			},
+		},
+		{
+			name: "strikes add up",
+			messages: []message{
+				{text: "a", links: 3, reason: SPAM_REASON_LINKS},
+				{text: "b", links: 3, reason: SPAM_REASON_LINKS},
+				{text: "c", links: 3, reason: SPAM_REASON_LINKS},
+			},
+			strikes: 3,
+		},
+		{
+			name: "strikes are forgotten after an hour",
+			messages: []message{
+				{text: "a", links: 3, reason: SPAM_REASON_LINKS},
+				{text: "b", links: 3, after: SPAM_STRIKE_WINDOW + time.Second, reason: SPAM_REASON_LINKS},
+			},
+			strikes: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector := &spamDetector{senders: map[string]*spamSender{}}
+			now := start
+			var last *spamVerdict
+			for i, m := range tt.messages {
+				now = now.Add(m.after)
+				last = detector.inspect("user-1", m.text, m.links, now)
+				reason := ""
+				if last != nil {
+					reason = last.reason
+				}
+				if reason != m.reason {
+					t.Fatalf("message %d: reason = %q, want %q", i, reason, m.reason)
+				}
+				if last != nil && m.wait != 0 && last.wait != m.wait {
+					t.Errorf("message %d: wait = %v, want %v", i, last.wait, m.wait)
+				}
+			}
+			strikes := 0
+			if last != nil {
+				strikes = last.strikes
+			}
+			if strikes != tt.strikes {
+				t.Errorf("strikes = %d, want %d", strikes, tt.strikes)
+			}
+		})
+	}
+}
+
+func TestSpamDetectorSendersAreSeparate(t *testing.T) {
+	withSpamConfig(t, Config{SpamRatePerMinute: 60, SpamBurst: 1})
+	detector := &spamDetector{senders: map[string]*spamSender{}}
+	now := time.Unix(1700000000, 0)
+
+	if v := detector.inspect("user-1", "hi", 0, now); v != nil {
+		t.Fatalf("first message of user-1 rejected: %+v", v)
+	}
+	if v := detector.inspect("user-1", "again", 0, now); v == nil || v.reason != SPAM_REASON_RATE {
+		t.Fatalf("second message of user-1 = %+v, want a rate verdict", v)
+	}
+	if v := detector.inspect("user-2", "hi", 0, now); v != nil {
+		t.Fatalf("first message of user-2 rejected: %+v", v)
+	}
+	detector.forget("user-1")
+	if v := detector.inspect("user-1", "back", 0, now); v != nil {
+		t.Fatalf("message after forget rejected: %+v", v)
+	}
+}
+
+func TestSpamFingerprintOf(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"hello world", "HELLO   world", true},
+		{" hello\tworld\n", "hello world", true},
+		{"hello world", "hello  worlds", false},
+		{"", "   ", true},
+	}
+	for _, tt := range tests {
+		if same := spamFingerprintOf(tt.a) == spamFingerprintOf(tt.b); same != tt.same {
+			t.Errorf("fingerprints of %q and %q equal = %v, want %v", tt.a, tt.b, same, tt.same)
+		}
+	}
+}
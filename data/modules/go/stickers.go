@@ -0,0 +1,637 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	STICKER_COLLECTION     = "sticker_packs"
+	STICKER_WRITE_ATTEMPTS = 3
+	// STICKER_PACK_DEFAULT_MAX_BYTES is the largest zip upload_sticker_pack accepts, unless STICKER_PACK_MAX_BYTES is set
+	STICKER_PACK_DEFAULT_MAX_BYTES = 16 * 1024 * 1024
+	STICKER_PACK_MAX_STICKERS      = 120
+	STICKER_PACK_MAX_NAME          = 64
+	STICKER_LIST_DEFAULT_LIMIT     = 20
+	STICKER_LIST_MAX_LIMIT         = 100
+	// STICKER_MESSAGE_TYPE is the content type of messages sent by send_sticker
+	STICKER_MESSAGE_TYPE = "sticker"
+	// STICKER_ACK_TIMEOUT is how long a premium sticker charged for a socket send waits for Nakama to store the message
+	STICKER_ACK_TIMEOUT = 30 * time.Second
+)
+
+// STICKER_FILE_TYPES maps the file extensions read from a pack's zip to their content types
+var STICKER_FILE_TYPES = map[string]string{
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+}
+
+// stickerIDPattern is the form of pack and sticker IDs, which appear in object keys and messages
+var stickerIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// unsafeStickerIDChars are replaced when a sticker ID is derived from its file name
+var unsafeStickerIDChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// Sticker is one image of a pack. Object keys are derived from the image's hash, so they never change content
+// and can be cached forever.
+type Sticker struct {
+	ID          string            `json:"id"`
+	ObjectKey   string            `json:"objectKey"`
+	ContentType string            `json:"contentType"`
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	Animated    bool              `json:"animated,omitempty"`
+	Thumbnails  map[string]string `json:"thumbnails,omitempty"`
+}
+
+// StickerPack is the system-owned record of a sticker pack, keyed by pack ID.
+// Every sticker sent from a premium pack uses up one premium_sticker entitlement.
+type StickerPack struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Stickers  []*Sticker `json:"stickers"`
+	Premium   bool       `json:"premium,omitempty"`
+	CreatedBy string     `json:"createdBy,omitempty"`
+	CreatedAt int64      `json:"createdAt"`
+	UpdatedAt int64      `json:"updatedAt"`
+}
+
+// StickerView is a sticker as clients see it, with the URLs of the image and its thumbnails
+type StickerView struct {
+	ID            string            `json:"id"`
+	URL           string            `json:"url"`
+	ContentType   string            `json:"contentType"`
+	Width         int               `json:"width,omitempty"`
+	Height        int               `json:"height,omitempty"`
+	Animated      bool              `json:"animated,omitempty"`
+	ThumbnailURLs map[string]string `json:"thumbnailUrls,omitempty"`
+	// ExpiresAt is when the URLs stop working, omitted for static URLs
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+}
+
+// StickerPackView is a sticker pack as clients see it
+type StickerPackView struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	Stickers  []*StickerView `json:"stickers"`
+	Premium   bool           `json:"premium,omitempty"`
+	UpdatedAt int64          `json:"updatedAt"`
+}
+
+// StickerResponse represents the response for sticker RPCs
+type StickerResponse struct {
+	Success   bool               `json:"success"`
+	Pack      *StickerPackView   `json:"pack,omitempty"`
+	Packs     []*StickerPackView `json:"packs,omitempty"`
+	Cursor    string             `json:"cursor,omitempty"`
+	MessageID string             `json:"messageId,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	Code      string             `json:"code,omitempty"`
+}
+
+// stickerPackMaxBytes is the largest zip accepted by upload_sticker_pack
+func stickerPackMaxBytes() int {
+	return serverConfig.StickerPackMaxBytes
+}
+
+// stickerExtension is the file extension sticker objects of a content type are stored with
+func stickerExtension(contentType string) string {
+	if contentType == "image/jpeg" {
+		return ".jpg"
+	}
+	return "." + strings.TrimPrefix(contentType, "image/")
+}
+
+// stickerURL returns the URL of an object in the sticker bucket. With STICKER_BASE_URL set, such as a CDN in front
+// of the bucket, URLs are static; otherwise they are presigned and expire like image URLs.
+func stickerURL(ctx context.Context, backend StorageBackend, objectKey string) (string, int64, error) {
+	if base := serverConfig.StickerBaseURL; base != "" {
+		return strings.TrimSuffix(base, "/") + "/" + objectKey, 0, nil
+	}
+	expiry := imageURLExpiry()
+	url, err := backend.PresignGet(ctx, serverConfig.StickerBucket, objectKey, expiry)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to generate presigned URL: %v", err)
+	}
+	return url, time.Now().Add(expiry).Unix(), nil
+}
+
+// viewSticker adds the URLs of a sticker's image and thumbnails
+func viewSticker(ctx context.Context, backend StorageBackend, sticker *Sticker) (*StickerView, error) {
+	view := &StickerView{ID: sticker.ID, ContentType: sticker.ContentType, Width: sticker.Width, Height: sticker.Height, Animated: sticker.Animated}
+	var err error
+	if view.URL, view.ExpiresAt, err = stickerURL(ctx, backend, sticker.ObjectKey); err != nil {
+		return nil, err
+	}
+	for name, key := range sticker.Thumbnails {
+		url, _, err := stickerURL(ctx, backend, key)
+		if err != nil {
+			return nil, err
+		}
+		if view.ThumbnailURLs == nil {
+			view.ThumbnailURLs = map[string]string{}
+		}
+		view.ThumbnailURLs[name] = url
+	}
+	return view, nil
+}
+
+// viewStickerPack adds the URLs of every sticker of a pack
+func viewStickerPack(ctx context.Context, backend StorageBackend, pack *StickerPack) (*StickerPackView, error) {
+	view := &StickerPackView{ID: pack.ID, Name: pack.Name, Stickers: make([]*StickerView, 0, len(pack.Stickers)), Premium: pack.Premium, UpdatedAt: pack.UpdatedAt}
+	for _, sticker := range pack.Stickers {
+		stickerView, err := viewSticker(ctx, backend, sticker)
+		if err != nil {
+			return nil, err
+		}
+		view.Stickers = append(view.Stickers, stickerView)
+	}
+	return view, nil
+}
+
+// readStickerPack loads a sticker pack, nil if there is none
+func readStickerPack(ctx context.Context, nk nkruntime.NakamaModule, packID string) (*StickerPack, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: STICKER_COLLECTION, Key: packID}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read sticker pack: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	var pack StickerPack
+	if err := json.Unmarshal([]byte(objects[0].Value), &pack); err != nil {
+		return nil, "", fmt.Errorf("failed to decode sticker pack: %v", err)
+	}
+	return &pack, objects[0].Version, nil
+}
+
+// stickerFile is an image read from a pack's zip
+type stickerFile struct {
+	ID          string
+	ContentType string
+	Data        []byte
+}
+
+// readStickerZip extracts the images of a pack's zip, ordered by file name. Sticker IDs are the file names
+// without extension; folders, hidden files and other file types are skipped.
+func readStickerZip(data []byte) ([]*stickerFile, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid zip: %v", err)
+	}
+	maxBytes := imageMaxBytes()
+	seen := map[string]bool{}
+	var files []*stickerFile
+	entries := append([]*zip.File{}, archive.File...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	for _, f := range entries {
+		base := path.Base(f.Name)
+		contentType, ok := STICKER_FILE_TYPES[strings.ToLower(path.Ext(base))]
+		if f.FileInfo().IsDir() || strings.HasPrefix(base, ".") || strings.HasPrefix(f.Name, "__MACOSX/") || !ok {
+			continue
+		}
+		id := strings.Trim(unsafeStickerIDChars.ReplaceAllString(strings.ToLower(strings.TrimSuffix(base, path.Ext(base))), "_"), "_-")
+		if len(id) > 64 {
+			id = id[:64]
+		}
+		if !stickerIDPattern.MatchString(id) {
+			return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid sticker file name: %s", f.Name)
+		}
+		if seen[id] {
+			return nil, errorWithCode(ERROR_CODE_REJECTED, "Duplicate sticker %s in the pack", id)
+		}
+		seen[id] = true
+		if len(seen) > STICKER_PACK_MAX_STICKERS {
+			return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "At most %d stickers per pack", STICKER_PACK_MAX_STICKERS)
+		}
+		// The declared size of a zip entry can lie, so reading stops at the limit either way
+		if f.UncompressedSize64 > uint64(maxBytes) {
+			return nil, errorWithCode(ERROR_CODE_PAYLOAD_TOO_LARGE, "Sticker %s exceeds the maximum size of %d bytes", id, maxBytes)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid zip entry %s: %v", f.Name, err)
+		}
+		content, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+		r.Close()
+		if err != nil {
+			return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid zip entry %s: %v", f.Name, err)
+		}
+		if int64(len(content)) > maxBytes {
+			return nil, errorWithCode(ERROR_CODE_PAYLOAD_TOO_LARGE, "Sticker %s exceeds the maximum size of %d bytes", id, maxBytes)
+		}
+		files = append(files, &stickerFile{ID: id, ContentType: contentType, Data: content})
+	}
+	if len(files) == 0 {
+		return nil, errorWithCode(ERROR_CODE_REJECTED, "The zip contains no PNG, GIF, WebP or JPEG images")
+	}
+	return files, nil
+}
+
+// storeSticker validates an image, runs it through the sticker pipeline and uploads it and its thumbnails
+func storeSticker(ctx context.Context, logger nkruntime.Logger, backend StorageBackend, packID string, file *stickerFile) (*Sticker, error) {
+	contentType, err := validateImage(bytes.NewReader(file.Data), file.ContentType, int64(len(file.Data)))
+	if err != nil {
+		return nil, errorWithCode(ERROR_CODE_REJECTED, "sticker %s: %v", file.ID, err)
+	}
+	asset := newImageAsset(file.Data, contentType)
+	asset.ChannelType = "sticker"
+	animated := asset.IsAnimated()
+	if err := runImagePipeline(ctx, logger, imagePipelineFor("sticker"), asset); err != nil {
+		return nil, errorWithCode(ERROR_CODE_REJECTED, "sticker %s: %v", file.ID, err)
+	}
+	if asset.isFlagged() {
+		return nil, errorWithCode(ERROR_CODE_REJECTED, "sticker %s was flagged by moderation: %s", file.ID, asset.Moderation.Reason)
+	}
+
+	sum := sha256.Sum256(asset.Data)
+	sticker := &Sticker{
+		ID:          file.ID,
+		ObjectKey:   fmt.Sprintf("%s/%s%s", packID, hex.EncodeToString(sum[:12]), stickerExtension(asset.ContentType)),
+		ContentType: asset.ContentType,
+		Animated:    animated,
+	}
+	if width, ok := asset.Metadata["width"].(int); ok {
+		sticker.Width = width
+	}
+	if height, ok := asset.Metadata["height"].(int); ok {
+		sticker.Height = height
+	}
+	if sticker.Width == 0 {
+		sticker.Width, sticker.Height, _ = imageDimensions(bytes.NewReader(asset.Data), asset.ContentType)
+	}
+	if err := backend.PutObject(ctx, serverConfig.StickerBucket, sticker.ObjectKey, bytes.NewReader(asset.Data), int64(len(asset.Data)), asset.ContentType); err != nil {
+		return nil, errorWithCode(ERROR_CODE_STORAGE_UNAVAILABLE, "Failed to upload sticker %s: %v", file.ID, err)
+	}
+	for name, derivative := range asset.Derivatives {
+		key := packID + "/" + thumbnailKey(path.Base(sticker.ObjectKey), derivative)
+		if err := backend.PutObject(ctx, serverConfig.StickerBucket, key, bytes.NewReader(derivative.Data), int64(len(derivative.Data)), derivative.ContentType); err != nil {
+			return nil, errorWithCode(ERROR_CODE_STORAGE_UNAVAILABLE, "Failed to upload %s thumbnail of sticker %s: %v", name, file.ID, err)
+		}
+		if sticker.Thumbnails == nil {
+			sticker.Thumbnails = map[string]string{}
+		}
+		sticker.Thumbnails[name] = key
+	}
+	return sticker, nil
+}
+
+// stickerObjectKeys lists the objects of a pack's stickers and their thumbnails
+func stickerObjectKeys(pack *StickerPack) map[string]bool {
+	keys := map[string]bool{}
+	if pack == nil {
+		return keys
+	}
+	for _, sticker := range pack.Stickers {
+		keys[sticker.ObjectKey] = true
+		for _, key := range sticker.Thumbnails {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// RpcUploadStickerPack creates or replaces a sticker pack from a zip of images (admin only).
+// Every image goes through validation and the IMAGE_PIPELINE_STICKER pipeline before it is stored.
+func RpcUploadStickerPack(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(StickerResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		PackID  string `json:"packId"`
+		Name    string `json:"name"`
+		Premium bool   `json:"premium"`
+		ZipData string `json:"zipData"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.PackID == "" || request.Name == "" || request.ZipData == "" {
+		return marshalResponse(StickerResponse{Success: false, Error: "Missing required fields: packId, name, or zipData", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if !stickerIDPattern.MatchString(request.PackID) {
+		return marshalResponse(StickerResponse{Success: false, Error: "Invalid packId: use up to 64 lowercase letters, digits, _ and -", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len([]rune(request.Name)) > STICKER_PACK_MAX_NAME {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("name cannot exceed %d characters", STICKER_PACK_MAX_NAME), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if base64.StdEncoding.DecodedLen(len(request.ZipData)) > stickerPackMaxBytes() {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Sticker pack exceeds the maximum size of %d bytes", stickerPackMaxBytes()), Code: ERROR_CODE_PAYLOAD_TOO_LARGE})
+	}
+	data, err := base64.StdEncoding.DecodeString(request.ZipData)
+	if err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Failed to decode base64 data: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	files, err := readStickerZip(data)
+	if err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	backend, err := getStorageBackend(logger)
+	if err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	if err := backend.EnsureBucket(ctx, logger, serverConfig.StickerBucket); err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Failed to ensure bucket exists: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	stickers := make([]*Sticker, 0, len(files))
+	for _, file := range files {
+		sticker, err := storeSticker(ctx, logger, backend, request.PackID, file)
+		if err != nil {
+			return marshalResponse(StickerResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		stickers = append(stickers, sticker)
+	}
+
+	var pack, previous *StickerPack
+	var lastErr error
+	for attempt := 0; attempt < STICKER_WRITE_ATTEMPTS; attempt++ {
+		var version string
+		previous, version, err = readStickerPack(ctx, nk, request.PackID)
+		if err != nil {
+			return marshalResponse(StickerResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		now := time.Now().Unix()
+		pack = &StickerPack{ID: request.PackID, Name: request.Name, Stickers: stickers, Premium: request.Premium, CreatedBy: userIDFromContext(ctx), CreatedAt: now, UpdatedAt: now}
+		if previous == nil {
+			version = "*"
+		} else {
+			pack.CreatedBy, pack.CreatedAt = previous.CreatedBy, previous.CreatedAt
+		}
+		value, _ := json.Marshal(pack)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      STICKER_COLLECTION,
+			Key:             request.PackID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			break
+		}
+	}
+	if lastErr != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Failed to store sticker pack: %v", lastErr), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	// Images dropped from a replaced pack are removed; unchanged ones kept their hash-based keys
+	kept := stickerObjectKeys(pack)
+	for key := range stickerObjectKeys(previous) {
+		if kept[key] {
+			continue
+		}
+		if err := backend.RemoveObject(ctx, serverConfig.StickerBucket, key); err != nil {
+			logger.Warn("Failed to remove replaced sticker %s: %v", key, err)
+		}
+	}
+
+	view, err := viewStickerPack(ctx, backend, pack)
+	if err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	logger.Info("Sticker pack %s stored with %d stickers", pack.ID, len(pack.Stickers))
+	return marshalResponse(StickerResponse{Success: true, Pack: view})
+}
+
+// RpcListStickerPacks pages through the sticker packs with the URLs of their stickers
+func RpcListStickerPacks(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	var request struct {
+		Limit  int    `json:"limit"`
+		Cursor string `json:"cursor"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.Limit <= 0 {
+		request.Limit = STICKER_LIST_DEFAULT_LIMIT
+	}
+	if request.Limit > STICKER_LIST_MAX_LIMIT {
+		request.Limit = STICKER_LIST_MAX_LIMIT
+	}
+
+	objects, cursor, err := nk.StorageList(ctx, "", "", STICKER_COLLECTION, request.Limit, request.Cursor)
+	if err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Failed to list sticker packs: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	backend, err := getStorageBackend(logger)
+	if err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	packs := make([]*StickerPackView, 0, len(objects))
+	for _, object := range objects {
+		var pack StickerPack
+		if err := json.Unmarshal([]byte(object.Value), &pack); err != nil {
+			logger.Warn("Skipping unreadable sticker pack %s: %v", object.Key, err)
+			continue
+		}
+		view, err := viewStickerPack(ctx, backend, &pack)
+		if err != nil {
+			return marshalResponse(StickerResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		packs = append(packs, view)
+	}
+	return marshalResponse(StickerResponse{Success: true, Packs: packs, Cursor: cursor})
+}
+
+// RpcSendSticker sends a sticker to a channel as the caller. The message content carries the pack and sticker
+// IDs next to a URL, so clients that know the pack can show it from their own cache.
+func RpcSendSticker(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(StickerResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+		PackID    string `json:"packId"`
+		StickerID string `json:"stickerId"`
+		ReplyTo   string `json:"replyTo"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" || request.PackID == "" || request.StickerID == "" {
+		return marshalResponse(StickerResponse{Success: false, Error: "Missing required fields: channelId, packId, or stickerId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if !member {
+		return marshalResponse(StickerResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+
+	var sticker *Sticker
+	if stickerIDPattern.MatchString(request.PackID) {
+		pack, _, err := readStickerPack(ctx, nk, request.PackID)
+		if err != nil {
+			return marshalResponse(StickerResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		for i := 0; pack != nil && i < len(pack.Stickers); i++ {
+			if pack.Stickers[i].ID == request.StickerID {
+				sticker = pack.Stickers[i]
+			}
+		}
+	}
+	if sticker == nil {
+		return marshalResponse(StickerResponse{Success: false, Error: "Sticker not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	backend, err := getStorageBackend(logger)
+	if err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	url, _, err := stickerURL(ctx, backend, sticker.ObjectKey)
+	if err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	content := map[string]interface{}{
+		"type":      STICKER_MESSAGE_TYPE,
+		"packId":    request.PackID,
+		"stickerId": sticker.ID,
+		"url":       url,
+		"width":     sticker.Width,
+		"height":    sticker.Height,
+		"animated":  sticker.Animated,
+	}
+	if request.ReplyTo != "" {
+		content[THREAD_REPLY_FIELD] = request.ReplyTo
+	}
+
+	message, err := sendMessageAs(ctx, logger, db, nk, userID, usernameFromContext(ctx), request.ChannelID, content)
+	if err != nil {
+		return marshalResponse(StickerResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(StickerResponse{Success: true, MessageID: message.MessageID})
+}
+
+// premiumStickerPack returns the pack of sticker message content when that pack is premium, nil otherwise
+func premiumStickerPack(ctx context.Context, nk nkruntime.NakamaModule, content map[string]interface{}) (*StickerPack, error) {
+	if kind, _ := content["type"].(string); kind != STICKER_MESSAGE_TYPE {
+		return nil, nil
+	}
+	packID, _ := content["packId"].(string)
+	if !stickerIDPattern.MatchString(packID) {
+		return nil, nil
+	}
+	pack, _, err := readStickerPack(ctx, nk, packID)
+	if err != nil || pack == nil || !pack.Premium {
+		return nil, err
+	}
+	return pack, nil
+}
+
+// chargePremiumSticker is the send check that takes a premium_sticker entitlement for a sticker from a premium
+// pack. It looks at the content rather than the RPC, so sticker content sent straight over the socket pays too.
+// It runs last, so a message another check rejects is never charged.
+func chargePremiumSticker(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, senderID, channelID string, content map[string]interface{}) (bool, error) {
+	if senderID == "" {
+		return false, nil
+	}
+	pack, err := premiumStickerPack(ctx, nk, content)
+	if err == nil && pack != nil {
+		err = consumeEntitlement(ctx, nk, senderID, WALLET_ITEM_PREMIUM_STICKER)
+	}
+	if err == nil {
+		return false, nil
+	}
+	if errorCodeOf(err) == ERROR_CODE_REJECTED {
+		return false, &MessageRejectedError{Code: ERROR_CODE_REJECTED, Message: err.Error()}
+	}
+	logger.Error("Failed to charge premium sticker for %s: %v", senderID, err)
+	return false, &MessageRejectedError{Code: ERROR_CODE_INTERNAL, Message: "Failed to send premium sticker, please try again"}
+}
+
+// refundPremiumSticker gives back the entitlement chargePremiumSticker took for a message that was then not sent
+func refundPremiumSticker(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, senderID string, content map[string]interface{}) {
+	if pack, err := premiumStickerPack(ctx, nk, content); err == nil && pack != nil {
+		refundEntitlement(ctx, logger, nk, senderID, WALLET_ITEM_PREMIUM_STICKER)
+	}
+}
+
+// unackedStickers holds a refund timer per premium sticker charged in BeforeChannelMessageSend, keyed by the
+// sender, channel and content Nakama goes on to store. Nakama calls no hook when that send fails, so a charge
+// AfterChannelMessageSend does not settle within STICKER_ACK_TIMEOUT is refunded. Both hooks of a socket send
+// run on the node holding the session, so memory is enough.
+var unackedStickers = struct {
+	sync.Mutex
+	charges map[string][]*time.Timer
+}{charges: map[string][]*time.Timer{}}
+
+func stickerChargeKey(senderID, channelID, content string) string {
+	return senderID + "\x00" + channelID + "\x00" + content
+}
+
+// awaitStickerAck refunds a premium sticker charged for a socket send unless settleStickerCharge is called for it in time
+func awaitStickerAck(logger nkruntime.Logger, nk nkruntime.NakamaModule, senderID, channelID, content string) {
+	key := stickerChargeKey(senderID, channelID, content)
+	unackedStickers.Lock()
+	defer unackedStickers.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(STICKER_ACK_TIMEOUT, func() {
+		unackedStickers.Lock()
+		pending := false
+		timers := unackedStickers.charges[key]
+		for i, t := range timers {
+			if t == timer {
+				timers, pending = append(timers[:i:i], timers[i+1:]...), true
+				break
+			}
+		}
+		if len(timers) == 0 {
+			delete(unackedStickers.charges, key)
+		} else {
+			unackedStickers.charges[key] = timers
+		}
+		unackedStickers.Unlock()
+
+		if pending {
+			logger.Warn("Premium sticker sent by %s to %s was never stored, refunding it", senderID, channelID)
+			refundEntitlement(context.Background(), logger, nk, senderID, WALLET_ITEM_PREMIUM_STICKER)
+		}
+	})
+	unackedStickers.charges[key] = append(unackedStickers.charges[key], timer)
+}
+
+// settleStickerCharge keeps the oldest charge waiting for a message Nakama has now stored
+func settleStickerCharge(senderID, channelID, content string) {
+	key := stickerChargeKey(senderID, channelID, content)
+	unackedStickers.Lock()
+	defer unackedStickers.Unlock()
+	timers := unackedStickers.charges[key]
+	if len(timers) == 0 {
+		return
+	}
+	timers[0].Stop()
+	if len(timers) == 1 {
+		delete(unackedStickers.charges, key)
+	} else {
+		unackedStickers.charges[key] = timers[1:]
+	}
+}
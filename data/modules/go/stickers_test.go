@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestSettleStickerCharge(t *testing.T) {
+	h := newTestHarness(t, nil)
+	content := `{"type":"sticker","packId":"cats","stickerId":"wave"}`
+	key := stickerChargeKey(testOwnerID, "2...general", content)
+	pending := func() int {
+		unackedStickers.Lock()
+		defer unackedStickers.Unlock()
+		return len(unackedStickers.charges[key])
+	}
+
+	// The same sticker sent twice in a row is charged and settled once per send
+	awaitStickerAck(h.logger, h.nk, testOwnerID, "2...general", content)
+	awaitStickerAck(h.logger, h.nk, testOwnerID, "2...general", content)
+	settleStickerCharge(testOwnerID, "2...general", content)
+	if n := pending(); n != 1 {
+		t.Fatalf("%d charges pending after one ack, want 1", n)
+	}
+	settleStickerCharge(testOwnerID, "2...general", content)
+	settleStickerCharge(testOwnerID, "2...general", content)
+	if n := pending(); n != 0 {
+		t.Errorf("%d charges pending after both acks, want 0", n)
+	}
+	if lines := h.logger.Lines(); len(lines) != 0 {
+		t.Errorf("settled charges logged %q", lines)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+// StoredObject describes an object in a bucket
+type StoredObject struct {
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+}
+
+// ObjectPart is an uploaded part of a multipart upload
+type ObjectPart struct {
+	Number int
+	ETag   string
+}
+
+// StorageBackend is the object store uploads are kept in
+type StorageBackend interface {
+	// Name identifies the backend in logs
+	Name() string
+	// EnsureBucket makes sure a bucket exists, creating it where the backend allows
+	EnsureBucket(ctx context.Context, logger nkruntime.Logger, bucket string) error
+	// PutObject stores data under key. A size of -1 streams data of unknown length until EOF.
+	PutObject(ctx context.Context, bucket, key string, data io.Reader, size int64, contentType string) error
+	GetObject(ctx context.Context, bucket, key string) (io.ReadSeekCloser, error)
+	StatObject(ctx context.Context, bucket, key string) (*StoredObject, error)
+	RemoveObject(ctx context.Context, bucket, key string) error
+	// ListObjects calls fn for every object in the bucket whose key starts with prefix until fn returns false
+	ListObjects(ctx context.Context, bucket, prefix string, fn func(*StoredObject) bool) error
+	PresignGet(ctx context.Context, bucket, key string, expiry time.Duration) (string, error)
+	PresignPut(ctx context.Context, bucket, key string, expiry time.Duration) (string, error)
+	// NewMultipartUpload starts an upload assembled from parts and returns the backend's upload ID
+	NewMultipartUpload(ctx context.Context, bucket, key, contentType string) (string, error)
+	// PutObjectPart stores one part of a multipart upload and returns its ETag
+	PutObjectPart(ctx context.Context, bucket, key, uploadID string, number int, data io.Reader, size int64) (string, error)
+	// CompleteMultipartUpload assembles the parts, in part number order, into the object
+	CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []ObjectPart) error
+	AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error
+	// SetBucketLifecycle replaces the expiry and tiering rules of a bucket, where the backend allows
+	SetBucketLifecycle(ctx context.Context, logger nkruntime.Logger, bucket string, rules BucketLifecycle) error
+}
+
+// BucketLifecycle is the expiry and tiering applied to every object of a bucket; a rule with 0 days is off
+type BucketLifecycle struct {
+	// ExpireDays deletes objects this many days after they were written
+	ExpireDays int `json:"expireDays,omitempty"`
+	// TransitionDays moves objects to the remote tier TransitionTier this many days after they were written
+	TransitionDays int    `json:"transitionDays,omitempty"`
+	TransitionTier string `json:"transitionTier,omitempty"`
+}
+
+// VIDEO_EXTENSIONS are the extensions video objects are stored with, which route them to the video bucket
+var VIDEO_EXTENSIONS = map[string]bool{".mp4": true, ".webm": true}
+
+// bucketForKey returns the bucket an image, video, avatar or quarantined object is stored in. Thumbnails,
+// posters and variants stay with the images.
+func (c *Config) bucketForKey(key string) string {
+	switch {
+	case strings.HasPrefix(key, AVATAR_PREFIX):
+		return c.AvatarBucket
+	case strings.HasPrefix(key, QUARANTINE_PREFIX):
+		return c.QuarantineBucket
+	case isDerivativeKey(key):
+		return c.Bucket
+	case VIDEO_EXTENSIONS[strings.ToLower(path.Ext(key))]:
+		return c.VideoBucket
+	}
+	return c.Bucket
+}
+
+func bucketForKey(key string) string {
+	return serverConfig.bucketForKey(key)
+}
+
+// ConfigureBuckets creates the buckets and applies their lifecycle rules at startup
+func ConfigureBuckets(ctx context.Context, logger nkruntime.Logger) error {
+	backend, err := getStorageBackend(logger)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range serverConfig.Buckets {
+		if err := backend.EnsureBucket(ctx, logger, bucket.Name); err != nil {
+			return fmt.Errorf("failed to ensure bucket %s exists: %v", bucket.Name, err)
+		}
+		if err := backend.SetBucketLifecycle(ctx, logger, bucket.Name, bucket.Lifecycle); err != nil {
+			return fmt.Errorf("failed to set lifecycle of bucket %s: %v", bucket.Name, err)
+		}
+	}
+	return nil
+}
+
+// STORAGE_SETTINGS are the env vars a storage backend is built from. A backend is rebuilt when one of them,
+// or a secret file named by its _FILE variant, changes.
+var STORAGE_SETTINGS = []string{
+	"STORAGE_BACKEND",
+	"MINIO_ENDPOINT", "MINIO_ACCESS_KEY", "MINIO_SECRET_KEY", "MINIO_USE_SSL",
+	"AWS_REGION", "S3_ENDPOINT",
+	"GCS_HMAC_ACCESS_ID", "GCS_HMAC_SECRET", "GCS_REGION",
+}
+
+const STORAGE_DEFAULT_RELOAD_INTERVAL_SECONDS = 60
+
+// storage holds the backend RPCs share. It is only read and replaced under the lock, so concurrent RPCs
+// create a single backend and always see a complete one.
+var storage struct {
+	sync.RWMutex
+	backend StorageBackend
+	// settings fingerprints the STORAGE_SETTINGS backend was built from
+	settings string
+}
+
+// STORAGE_BACKENDS maps the STORAGE_BACKEND values to their constructors
+var STORAGE_BACKENDS = map[string]func(logger nkruntime.Logger) (StorageBackend, error){
+	"minio":  newMinioBackend,
+	"s3":     newS3Backend,
+	"gcs":    newGCSBackend,
+	"memory": newMemoryBackend,
+}
+
+// storageSettings fingerprints the current STORAGE_SETTINGS without keeping the secrets themselves
+func storageSettings() string {
+	values := make([]string, len(STORAGE_SETTINGS))
+	for i, name := range STORAGE_SETTINGS {
+		values[i] = envSecret(name, "")
+	}
+	return hashedStorageKey(strings.Join(values, "\x00"))
+}
+
+// newStorageBackend creates the backend selected by STORAGE_BACKEND, MinIO by default
+func newStorageBackend(logger nkruntime.Logger) (StorageBackend, error) {
+	name := strings.ToLower(envSecret("STORAGE_BACKEND", "minio"))
+	factory, ok := STORAGE_BACKENDS[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND: %s", name)
+	}
+	backend, err := factory(logger)
+	if err != nil {
+		return nil, err
+	}
+	// Metrics see every attempt, the retry layer the outcome of each call
+	return newResilientBackend(logger, &meteredBackend{backend}, isRetryableStorageError), nil
+}
+
+// getStorageBackend returns the storage backend, creating it on first use. A failed creation is retried by the next call.
+func getStorageBackend(logger nkruntime.Logger) (StorageBackend, error) {
+	storage.RLock()
+	backend := storage.backend
+	storage.RUnlock()
+	if backend != nil {
+		return backend, nil
+	}
+
+	storage.Lock()
+	defer storage.Unlock()
+	if storage.backend != nil {
+		return storage.backend, nil
+	}
+	settings := storageSettings()
+	backend, err := newStorageBackend(logger)
+	if err != nil {
+		return nil, err
+	}
+	storage.backend, storage.settings = backend, settings
+	logger.Info("Storage backend initialized: %s", backend.Name())
+	return backend, nil
+}
+
+// reloadStorageBackend replaces the storage backend when its settings changed since it was created, or always
+// with force. Calls already running finish on the old backend. It reports whether the backend was replaced.
+func reloadStorageBackend(logger nkruntime.Logger, force bool) (bool, error) {
+	storage.Lock()
+	defer storage.Unlock()
+	settings := storageSettings()
+	if storage.backend == nil || (!force && settings == storage.settings) {
+		return false, nil
+	}
+	backend, err := newStorageBackend(logger)
+	if err != nil {
+		return false, err
+	}
+	storage.backend, storage.settings = backend, settings
+	logger.Info("Storage backend reloaded: %s", backend.Name())
+	return true, nil
+}
+
+// StartStorageReload rebuilds the storage backend when its settings or secret files change, checking every
+// STORAGE_RELOAD_INTERVAL_SECONDS; 0 disables it
+func StartStorageReload(logger nkruntime.Logger) {
+	seconds := serverConfig.StorageReloadIntervalSeconds
+	if seconds <= 0 {
+		logger.Info("Storage credential reload disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(seconds) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := reloadStorageBackend(logger, false); err != nil {
+				// The current backend stays in use until the new settings work
+				logger.Error("Failed to reload storage backend: %v", err)
+			}
+		}
+	}()
+	logger.Info("Storage credential reload checked every %d seconds", seconds)
+}
+
+// StorageReloadResponse represents the response for reload_storage_backend
+type StorageReloadResponse struct {
+	Success  bool   `json:"success"`
+	Backend  string `json:"backend,omitempty"`
+	Reloaded bool   `json:"reloaded"`
+	Error    string `json:"error,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
+// RpcReloadStorageBackend rebuilds the storage backend from the current settings and secret files (admin only),
+// e.g. right after rotating credentials. With {"ifChanged": true} it only does so when they changed.
+func RpcReloadStorageBackend(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	if !isAdmin(ctx) {
+		return marshalResponse(StorageReloadResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+
+	var request struct {
+		IfChanged bool `json:"ifChanged"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(StorageReloadResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+
+	// A backend that was never created is simply created from the current settings
+	if _, err := getStorageBackend(logger); err != nil {
+		return marshalResponse(StorageReloadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	reloaded, err := reloadStorageBackend(logger, !request.IfChanged)
+	if err != nil {
+		return marshalResponse(StorageReloadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	backend, _ := getStorageBackend(logger)
+	return marshalResponse(StorageReloadResponse{Success: true, Backend: backend.Name(), Reloaded: reloaded})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+// memoryObject is an object held by the memory backend
+type memoryObject struct {
+	data []byte
+	info StoredObject
+}
+
+// memoryUpload is a multipart upload in progress on the memory backend
+type memoryUpload struct {
+	bucket, key, contentType string
+	parts                    map[int][]byte
+}
+
+// memoryStore is the content of the memory backend. It is shared by every backend instance so a reload keeps it.
+type memoryStore struct {
+	sync.Mutex
+	buckets   map[string]map[string]*memoryObject
+	lifecycle map[string]BucketLifecycle
+	uploads   map[string]*memoryUpload
+	nextID    int
+}
+
+var sharedMemoryStore = newMemoryStore()
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		buckets:   map[string]map[string]*memoryObject{},
+		lifecycle: map[string]BucketLifecycle{},
+		uploads:   map[string]*memoryUpload{},
+	}
+}
+
+// memoryBackend keeps objects in the Nakama process, for local development and scripted checks without MinIO.
+// Objects are lost on restart and are not shared between nodes. Presigned URLs use the memory:// scheme, which
+// clients cannot fetch, so only uploads and downloads made through the module's RPCs work end to end.
+type memoryBackend struct {
+	store *memoryStore
+}
+
+// newMemoryBackend creates the in-process backend selected with STORAGE_BACKEND=memory
+func newMemoryBackend(logger nkruntime.Logger) (StorageBackend, error) {
+	logger.Warn("Storage backend memory keeps objects in this process only; do not use it in production")
+	return &memoryBackend{store: sharedMemoryStore}, nil
+}
+
+func (b *memoryBackend) Name() string { return "memory" }
+
+// objects returns a bucket's objects; the store lock must be held
+func (b *memoryBackend) objects(bucket string) (map[string]*memoryObject, error) {
+	objects, ok := b.store.buckets[bucket]
+	if !ok {
+		return nil, fmt.Errorf("bucket %s does not exist", bucket)
+	}
+	return objects, nil
+}
+
+// put stores data as an object; the store lock must be held
+func (b *memoryBackend) put(bucket, key string, data []byte, contentType string) error {
+	objects, err := b.objects(bucket)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	objects[key] = &memoryObject{data: data, info: StoredObject{
+		Key:          key,
+		Size:         int64(len(data)),
+		ETag:         hex.EncodeToString(sum[:]),
+		ContentType:  contentType,
+		LastModified: time.Now().UTC(),
+	}}
+	return nil
+}
+
+func (b *memoryBackend) EnsureBucket(ctx context.Context, logger nkruntime.Logger, bucket string) error {
+	b.store.Lock()
+	defer b.store.Unlock()
+	if _, ok := b.store.buckets[bucket]; !ok {
+		b.store.buckets[bucket] = map[string]*memoryObject{}
+		logger.Info("Created memory bucket: %s", bucket)
+	}
+	return nil
+}
+
+// SetBucketLifecycle only records the rules; objects are never expired or moved
+func (b *memoryBackend) SetBucketLifecycle(ctx context.Context, logger nkruntime.Logger, bucket string, rules BucketLifecycle) error {
+	b.store.Lock()
+	defer b.store.Unlock()
+	if _, err := b.objects(bucket); err != nil {
+		return err
+	}
+	b.store.lifecycle[bucket] = rules
+	return nil
+}
+
+func (b *memoryBackend) PutObject(ctx context.Context, bucket, key string, data io.Reader, size int64, contentType string) error {
+	var content []byte
+	var err error
+	if size < 0 {
+		content, err = io.ReadAll(data)
+	} else {
+		content = make([]byte, size)
+		_, err = io.ReadFull(data, content)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read object data: %v", err)
+	}
+	b.store.Lock()
+	defer b.store.Unlock()
+	return b.put(bucket, key, content, contentType)
+}
+
+func (b *memoryBackend) GetObject(ctx context.Context, bucket, key string) (io.ReadSeekCloser, error) {
+	b.store.Lock()
+	defer b.store.Unlock()
+	objects, err := b.objects(bucket)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := objects[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s not found", key)
+	}
+	return nopSeekCloser{bytes.NewReader(object.data)}, nil
+}
+
+func (b *memoryBackend) StatObject(ctx context.Context, bucket, key string) (*StoredObject, error) {
+	b.store.Lock()
+	defer b.store.Unlock()
+	objects, err := b.objects(bucket)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := objects[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s not found", key)
+	}
+	info := object.info
+	return &info, nil
+}
+
+// RemoveObject succeeds for missing objects, as S3 does
+func (b *memoryBackend) RemoveObject(ctx context.Context, bucket, key string) error {
+	b.store.Lock()
+	defer b.store.Unlock()
+	objects, err := b.objects(bucket)
+	if err != nil {
+		return err
+	}
+	delete(objects, key)
+	return nil
+}
+
+// ListObjects lists in key order, like S3. fn is called without the lock held so it may use the backend.
+func (b *memoryBackend) ListObjects(ctx context.Context, bucket, prefix string, fn func(*StoredObject) bool) error {
+	b.store.Lock()
+	objects, err := b.objects(bucket)
+	if err != nil {
+		b.store.Unlock()
+		return err
+	}
+	listed := make([]StoredObject, 0, len(objects))
+	for key, object := range objects {
+		if strings.HasPrefix(key, prefix) {
+			listed = append(listed, object.info)
+		}
+	}
+	b.store.Unlock()
+
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Key < listed[j].Key })
+	for i := range listed {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fn(&listed[i]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// presign builds the placeholder URL returned for presigned requests
+func (b *memoryBackend) presign(method, bucket, key string, expiry time.Duration) string {
+	query := url.Values{"method": {method}, "expires": {fmt.Sprint(time.Now().Add(expiry).Unix())}}
+	return (&url.URL{Scheme: "memory", Host: bucket, Path: "/" + key, RawQuery: query.Encode()}).String()
+}
+
+func (b *memoryBackend) PresignGet(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	return b.presign("GET", bucket, key, expiry), nil
+}
+
+func (b *memoryBackend) PresignPut(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	return b.presign("PUT", bucket, key, expiry), nil
+}
+
+func (b *memoryBackend) NewMultipartUpload(ctx context.Context, bucket, key, contentType string) (string, error) {
+	b.store.Lock()
+	defer b.store.Unlock()
+	if _, err := b.objects(bucket); err != nil {
+		return "", err
+	}
+	b.store.nextID++
+	uploadID := fmt.Sprintf("memory-%d", b.store.nextID)
+	b.store.uploads[uploadID] = &memoryUpload{bucket: bucket, key: key, contentType: contentType, parts: map[int][]byte{}}
+	return uploadID, nil
+}
+
+func (b *memoryBackend) PutObjectPart(ctx context.Context, bucket, key, uploadID string, number int, data io.Reader, size int64) (string, error) {
+	content := make([]byte, size)
+	if _, err := io.ReadFull(data, content); err != nil {
+		return "", fmt.Errorf("failed to read part data: %v", err)
+	}
+	b.store.Lock()
+	defer b.store.Unlock()
+	upload, ok := b.store.uploads[uploadID]
+	if !ok || upload.bucket != bucket || upload.key != key {
+		return "", fmt.Errorf("multipart upload %s not found", uploadID)
+	}
+	upload.parts[number] = content
+	sum := md5.Sum(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (b *memoryBackend) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []ObjectPart) error {
+	b.store.Lock()
+	defer b.store.Unlock()
+	upload, ok := b.store.uploads[uploadID]
+	if !ok || upload.bucket != bucket || upload.key != key {
+		return fmt.Errorf("multipart upload %s not found", uploadID)
+	}
+	var content []byte
+	for _, part := range parts {
+		data, ok := upload.parts[part.Number]
+		if !ok {
+			return fmt.Errorf("part %d of multipart upload %s not found", part.Number, uploadID)
+		}
+		sum := md5.Sum(data)
+		if etag := hex.EncodeToString(sum[:]); part.ETag != etag && strings.Trim(part.ETag, `"`) != etag {
+			return fmt.Errorf("part %d of multipart upload %s has a different ETag", part.Number, uploadID)
+		}
+		content = append(content, data...)
+	}
+	if err := b.put(bucket, key, content, upload.contentType); err != nil {
+		return err
+	}
+	delete(b.store.uploads, uploadID)
+	return nil
+}
+
+func (b *memoryBackend) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	b.store.Lock()
+	defer b.store.Unlock()
+	delete(b.store.uploads, uploadID)
+	return nil
+}
+
+// nopSeekCloser gives a bytes.Reader the Close of an object reader
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
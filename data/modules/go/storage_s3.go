@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+// s3Backend talks to any S3 compatible API: MinIO, AWS S3, and GCS through its XML interoperability API
+type s3Backend struct {
+	name   string
+	client *minio.Client
+	region string
+	// manageBuckets lets the module create missing buckets and manage their public read policy (local MinIO only)
+	manageBuckets bool
+	// revoked holds the existing buckets whose public read policy was already removed
+	revoked sync.Map
+}
+
+// disableClientRetries is set once, before the first client exists, since minio.MaxRetry is read by every request
+var disableClientRetries sync.Once
+
+// newS3Client creates a client that makes a single attempt per request. Retries are left to resilientBackend,
+// so they follow its policy and every outage reaches the circuit breaker.
+func newS3Client(endpoint string, opts *minio.Options) (*minio.Client, error) {
+	disableClientRetries.Do(func() { minio.MaxRetry = 1 })
+	return minio.New(endpoint, opts)
+}
+
+// isRetryableStorageError reports whether a storage error may go away on its own: network failures,
+// throttling and server errors. Missing objects, denied access and cancelled requests are final.
+func isRetryableStorageError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var response minio.ErrorResponse
+	if errors.As(err, &response) {
+		switch response.Code {
+		case "RequestTimeout", "Throttling", "SlowDown", "InternalError", "ServiceUnavailable", "XMinioServerNotInitialized":
+			return true
+		}
+		return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// newMinioBackend connects to MinIO using MINIO_ENDPOINT, MINIO_ACCESS_KEY, MINIO_SECRET_KEY and MINIO_USE_SSL.
+// The keys may also be read from files named by MINIO_ACCESS_KEY_FILE and MINIO_SECRET_KEY_FILE.
+func newMinioBackend(logger nkruntime.Logger) (StorageBackend, error) {
+	endpoint := envSecret("MINIO_ENDPOINT", "")
+	if endpoint == "" {
+		endpoint = "minio:9000"
+	}
+
+	accessKey := envSecret("MINIO_ACCESS_KEY", "minioadmin")
+	secretKey := envSecret("MINIO_SECRET_KEY", "minioadmin")
+
+	useSSL := envSecret("MINIO_USE_SSL", "") == "true"
+
+	logger.Info("Initializing Minio client with endpoint: %s", endpoint)
+
+	// Parse endpoint
+	endpointParts := strings.Split(endpoint, ":")
+	endPoint := endpointParts[0]
+	port := 9000
+	if len(endpointParts) > 1 {
+		if p, err := strconv.Atoi(endpointParts[1]); err == nil {
+			port = p
+		}
+	}
+
+	endpointURL := fmt.Sprintf("%s:%d", endPoint, port)
+	client, err := newS3Client(endpointURL, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+		Region: "us-east-1",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Minio client: %v", err)
+	}
+	return &s3Backend{name: "minio", client: client, region: "us-east-1", manageBuckets: true}, nil
+}
+
+// newS3Backend connects to AWS S3. Credentials come from AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY,
+// the shared credentials file, or the instance/pod role (IRSA, ECS, EC2), in that order.
+func newS3Backend(logger nkruntime.Logger) (StorageBackend, error) {
+	region := envSecret("AWS_REGION", "us-east-1")
+	endpoint := envSecret("S3_ENDPOINT", "s3.amazonaws.com")
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+	})
+
+	logger.Info("Initializing S3 client with endpoint: %s (%s)", endpoint, region)
+	client, err := newS3Client(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: true,
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %v", err)
+	}
+	return &s3Backend{name: "s3", client: client, region: region}, nil
+}
+
+// newGCSBackend connects to Google Cloud Storage through its S3 compatible XML API using the
+// HMAC key of a service account (GCS_HMAC_ACCESS_ID, GCS_HMAC_SECRET, or their _FILE variants)
+func newGCSBackend(logger nkruntime.Logger) (StorageBackend, error) {
+	accessID := envSecret("GCS_HMAC_ACCESS_ID", "")
+	secret := envSecret("GCS_HMAC_SECRET", "")
+	if accessID == "" || secret == "" {
+		return nil, fmt.Errorf("GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET are required for the gcs backend")
+	}
+	region := envSecret("GCS_REGION", "auto")
+
+	logger.Info("Initializing GCS client (%s)", region)
+	client, err := newS3Client("storage.googleapis.com", &minio.Options{
+		Creds:  credentials.NewStaticV4(accessID, secret, ""),
+		Secure: true,
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %v", err)
+	}
+	return &s3Backend{name: "gcs", client: client, region: region}, nil
+}
+
+func (b *s3Backend) Name() string { return b.name }
+
+// EnsureBucket creates missing buckets on MinIO; on S3 and GCS buckets are provisioned ahead of time
+func (b *s3Backend) EnsureBucket(ctx context.Context, logger nkruntime.Logger, bucket string) error {
+	exists, err := b.client.BucketExists(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("failed to check bucket existence: %w", err)
+	}
+	if exists {
+		// A bucket created in public mode, or before only media buckets were public, keeps its policy until revoked
+		if b.manageBuckets && !bucketPublic(bucket) {
+			if _, done := b.revoked.LoadOrStore(bucket, true); !done {
+				b.setBucketPolicy(ctx, logger, bucket)
+			}
+		}
+		return nil
+	}
+	if !b.manageBuckets {
+		return fmt.Errorf("bucket %s does not exist on %s, create it before starting the server", bucket, b.name)
+	}
+
+	logger.Info("Bucket %s does not exist, creating...", bucket)
+	err = b.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: b.region})
+	if err != nil {
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+	logger.Info("Bucket %s created successfully", bucket)
+
+	b.setBucketPolicy(ctx, logger, bucket)
+	return nil
+}
+
+// setBucketPolicy allows public reads of a media bucket in public mode, and removes the policy of the others
+func (b *s3Backend) setBucketPolicy(ctx context.Context, logger nkruntime.Logger, bucket string) {
+	policy := ""
+	if bucketPublic(bucket) {
+		policy = `{
+		"Version": "2012-10-17",
+		"Statement": [
+			{
+				"Effect": "Allow",
+				"Principal": {"AWS": ["*"]},
+				"Action": ["s3:GetObject"],
+				"Resource": ["arn:aws:s3:::` + bucket + `/*"]
+			}
+		]
+	}`
+	}
+	if err := b.client.SetBucketPolicy(ctx, bucket, policy); err != nil {
+		logger.Warn("Failed to set bucket policy: %v", err)
+	} else if policy == "" {
+		logger.Info("Bucket policy removed for %s (private bucket)", bucket)
+	} else {
+		logger.Info("Bucket policy set for %s", bucket)
+	}
+}
+
+// SetBucketLifecycle replaces the bucket's lifecycle configuration on local MinIO; no rules removes it.
+// Tiering needs the tier to be set up on MinIO first (mc ilm tier add).
+func (b *s3Backend) SetBucketLifecycle(ctx context.Context, logger nkruntime.Logger, bucket string, rules BucketLifecycle) error {
+	if !b.manageBuckets {
+		if rules.ExpireDays > 0 || rules.TransitionDays > 0 {
+			logger.Info("Lifecycle rules for %s are not managed on %s, configure them on the bucket", bucket, b.name)
+		}
+		return nil
+	}
+	config := lifecycle.NewConfiguration()
+	if rules.ExpireDays > 0 {
+		config.Rules = append(config.Rules, lifecycle.Rule{
+			ID:         "expire",
+			Status:     "Enabled",
+			Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(rules.ExpireDays)},
+		})
+	}
+	if rules.TransitionDays > 0 {
+		config.Rules = append(config.Rules, lifecycle.Rule{
+			ID:         "transition",
+			Status:     "Enabled",
+			Transition: lifecycle.Transition{Days: lifecycle.ExpirationDays(rules.TransitionDays), StorageClass: rules.TransitionTier},
+		})
+	}
+	if err := b.client.SetBucketLifecycle(ctx, bucket, config); err != nil {
+		return err
+	}
+	if len(config.Rules) > 0 {
+		logger.Info("Bucket lifecycle set for %s: expire after %d days, transition to %q after %d days",
+			bucket, rules.ExpireDays, rules.TransitionTier, rules.TransitionDays)
+	}
+	return nil
+}
+
+func (b *s3Backend) PutObject(ctx context.Context, bucket, key string, data io.Reader, size int64, contentType string) error {
+	opts := minio.PutObjectOptions{ContentType: contentType}
+	if size < 0 {
+		// minio-go buffers a whole part in memory when the size is unknown, keep parts at the smallest size
+		opts.PartSize = MULTIPART_MIN_PART_BYTES
+	}
+	_, err := b.client.PutObject(ctx, bucket, key, data, size, opts)
+	return err
+}
+
+func (b *s3Backend) GetObject(ctx context.Context, bucket, key string) (io.ReadSeekCloser, error) {
+	return b.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+}
+
+func (b *s3Backend) StatObject(ctx context.Context, bucket, key string) (*StoredObject, error) {
+	info, err := b.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return storedObjectFromInfo(info), nil
+}
+
+func (b *s3Backend) RemoveObject(ctx context.Context, bucket, key string) error {
+	return b.client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (b *s3Backend) ListObjects(ctx context.Context, bucket, prefix string, fn func(*StoredObject) bool) error {
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for info := range b.client.ListObjects(listCtx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return info.Err
+		}
+		if !fn(storedObjectFromInfo(info)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (b *s3Backend) PresignGet(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	u, err := b.client.PresignedGetObject(ctx, bucket, key, expiry, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (b *s3Backend) PresignPut(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	u, err := b.client.PresignedPutObject(ctx, bucket, key, expiry)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (b *s3Backend) NewMultipartUpload(ctx context.Context, bucket, key, contentType string) (string, error) {
+	core := minio.Core{Client: b.client}
+	return core.NewMultipartUpload(ctx, bucket, key, minio.PutObjectOptions{ContentType: contentType})
+}
+
+func (b *s3Backend) PutObjectPart(ctx context.Context, bucket, key, uploadID string, number int, data io.Reader, size int64) (string, error) {
+	core := minio.Core{Client: b.client}
+	part, err := core.PutObjectPart(ctx, bucket, key, uploadID, number, data, size, minio.PutObjectPartOptions{})
+	if err != nil {
+		return "", err
+	}
+	return part.ETag, nil
+}
+
+func (b *s3Backend) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []ObjectPart) error {
+	completed := make([]minio.CompletePart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, minio.CompletePart{PartNumber: part.Number, ETag: part.ETag})
+	}
+	core := minio.Core{Client: b.client}
+	_, err := core.CompleteMultipartUpload(ctx, bucket, key, uploadID, completed, minio.PutObjectOptions{})
+	return err
+}
+
+func (b *s3Backend) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	core := minio.Core{Client: b.client}
+	return core.AbortMultipartUpload(ctx, bucket, key, uploadID)
+}
+
+func storedObjectFromInfo(info minio.ObjectInfo) *StoredObject {
+	return &StoredObject{
+		Key:          info.Key,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+	}
+}
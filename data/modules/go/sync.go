@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	SYNC_MAX_CHANNELS  = 50
+	SYNC_DEFAULT_LIMIT = 100
+	SYNC_MAX_LIMIT     = 500
+	// SYNC_CURSOR_LAG keeps a cursor that far behind the server's clock, so writes still committing when a sync
+	// runs are picked up by the next one; clients see them twice at most
+	SYNC_CURSOR_LAG = 2 * time.Second
+)
+
+// ChannelSyncRequest is the position of one channel to sync from: the cursor returned by the last sync, or on the
+// first sync the unix time the client last saw the channel
+type ChannelSyncRequest struct {
+	ChannelID string `json:"channelId"`
+	Since     int64  `json:"since"`
+	Cursor    string `json:"cursor"`
+}
+
+// ChannelSync holds what changed in a channel since its cursor. Messages are new and edited ones alike, ordered by
+// their last change, so clients upsert them by ID.
+type ChannelSync struct {
+	ChannelID string           `json:"channelId"`
+	Messages  []*ThreadMessage `json:"messages,omitempty"`
+	// Deleted lists the IDs of messages removed since the cursor
+	Deleted []string `json:"deleted,omitempty"`
+	// Reactions holds the current reactions of every message whose reactions changed, keyed by message ID
+	Reactions map[string]map[string][]string `json:"reactions,omitempty"`
+	// SuperReactions holds the super reactions of those messages that have any
+	SuperReactions map[string]map[string][]string `json:"superReactions,omitempty"`
+	Cursor         string                         `json:"cursor,omitempty"`
+	// HasMore is set when a change list was cut at the limit; sync again from Cursor for the rest
+	HasMore bool   `json:"hasMore,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// SyncResponse represents the response for sync_since
+type SyncResponse struct {
+	Success  bool           `json:"success"`
+	Channels []*ChannelSync `json:"channels,omitempty"`
+	// URLs are fresh URLs for the images of the returned messages and the requested objectKeys
+	URLs      map[string]*IssuedURL `json:"urls,omitempty"`
+	URLErrors map[string]string     `json:"urlErrors,omitempty"`
+	Error     string                `json:"error,omitempty"`
+	Code      string                `json:"code,omitempty"`
+}
+
+// syncCursor is the last change a client has seen in a channel. Changes are ordered by update time, message
+// changes at the same time by ID; an empty ID starts at the first change at that time.
+type syncCursor struct {
+	UpdateTime int64  `json:"t"`
+	MessageID  string `json:"id,omitempty"`
+}
+
+func encodeSyncCursor(cursor syncCursor) string {
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeSyncCursor(value string) (*syncCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	var cursor syncCursor
+	if err == nil {
+		err = json.Unmarshal(raw, &cursor)
+	}
+	if err != nil || cursor.UpdateTime <= 0 {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// syncChannelMessages lists up to limit messages of a channel created or edited after the cursor, and the
+// position of the last one when there were more
+func syncChannelMessages(ctx context.Context, db *sql.DB, ref *ChannelRef, cursor *syncCursor, limit int) ([]*ThreadMessage, *syncCursor, error) {
+	subject, descriptor := messageStreamColumns(ref)
+	after := cursor.MessageID
+	if after == "" {
+		after = NIL_UUID
+	}
+	t := time.UnixMicro(cursor.UpdateTime).UTC()
+	// One extra row tells whether there are more changes
+	rows, err := db.QueryContext(ctx, `
+SELECT id::TEXT, sender_id::TEXT, username, content::TEXT, create_time, update_time FROM message
+WHERE stream_mode = $1 AND stream_subject = $2 AND stream_descriptor = $3 AND stream_label = $4
+AND (update_time > $5 OR (update_time = $5 AND id > $6))
+ORDER BY update_time ASC, id ASC LIMIT $7`,
+		ref.Mode, subject, descriptor, ref.Label, t, after, limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]*ThreadMessage, 0, limit)
+	var last time.Time
+	var next *syncCursor
+	for rows.Next() {
+		if len(messages) == limit {
+			next = &syncCursor{UpdateTime: last.UnixMicro(), MessageID: messages[len(messages)-1].MessageID}
+			break
+		}
+		var message ThreadMessage
+		var content string
+		var created time.Time
+		if err := rows.Scan(&message.MessageID, &message.SenderID, &message.Username, &content, &created, &last); err != nil {
+			return nil, nil, err
+		}
+		message.Content = json.RawMessage(content)
+		message.CreatedAt = created.Unix()
+		message.UpdatedAt = last.Unix()
+		messages = append(messages, &message)
+	}
+	return messages, next, rows.Err()
+}
+
+// syncChannelRecords lists the values of up to limit system-owned records of a collection that belong to a
+// channel and changed at or after t, and the update time to resume from when there were more
+func syncChannelRecords(ctx context.Context, db *sql.DB, collection, channelID string, t time.Time, limit int) ([]string, *time.Time, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT value::TEXT, update_time FROM storage
+WHERE collection = $1 AND user_id = $2 AND update_time >= $3 AND value->>'channelId' = $4
+ORDER BY update_time ASC LIMIT $5`,
+		collection, NIL_UUID, t, channelID, limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	values := make([]string, 0, limit)
+	for rows.Next() {
+		var value string
+		var updated time.Time
+		if err := rows.Scan(&value, &updated); err != nil {
+			return nil, nil, err
+		}
+		if len(values) == limit {
+			return values, &updated, nil
+		}
+		values = append(values, value)
+	}
+	return values, nil, rows.Err()
+}
+
+// syncChannel collects the changes of one channel after a cursor
+func syncChannel(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, userID string, request *ChannelSyncRequest, limit int, now time.Time) *ChannelSync {
+	result := &ChannelSync{ChannelID: request.ChannelID}
+	ref, err := parseChannelID(request.ChannelID)
+	if err != nil {
+		result.Error, result.Code = fmt.Sprintf("Invalid channelId: %v", err), ERROR_CODE_PAYLOAD_INVALID
+		return result
+	}
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil {
+		result.Error, result.Code = err.Error(), errorCodeOf(err)
+		return result
+	}
+	if !member {
+		result.Error, result.Code = "Not a member of this channel", ERROR_CODE_NOT_A_MEMBER
+		return result
+	}
+
+	cursor := &syncCursor{UpdateTime: time.Unix(request.Since, 0).UnixMicro()}
+	if request.Cursor != "" {
+		if cursor, err = decodeSyncCursor(request.Cursor); err != nil {
+			result.Error, result.Code = err.Error(), errorCodeOf(err)
+			return result
+		}
+	} else if request.Since <= 0 {
+		result.Error, result.Code = "Missing required field: since or cursor", ERROR_CODE_PAYLOAD_INVALID
+		return result
+	}
+	t := time.UnixMicro(cursor.UpdateTime).UTC()
+
+	messages, next, err := syncChannelMessages(ctx, db, ref, cursor, limit)
+	if err != nil {
+		logger.Error("Failed to sync messages of %s: %v", request.ChannelID, err)
+		result.Error, result.Code = "Failed to sync messages", ERROR_CODE_INTERNAL
+		return result
+	}
+	result.Messages = messages
+
+	// Deleted messages only remain as their edit history, whose update time is the deletion
+	histories, historyMore, err := syncChannelRecords(ctx, db, MESSAGE_HISTORY_COLLECTION, request.ChannelID, t, limit)
+	if err != nil {
+		logger.Error("Failed to sync deletions of %s: %v", request.ChannelID, err)
+		result.Error, result.Code = "Failed to sync deletions", ERROR_CODE_INTERNAL
+		return result
+	}
+	for _, value := range histories {
+		var history MessageHistory
+		if json.Unmarshal([]byte(value), &history) == nil && history.DeletedAt != 0 {
+			result.Deleted = append(result.Deleted, history.MessageID)
+		}
+	}
+
+	reactions, reactionsMore, err := syncChannelRecords(ctx, db, REACTION_COLLECTION, request.ChannelID, t, limit)
+	if err != nil {
+		logger.Error("Failed to sync reactions of %s: %v", request.ChannelID, err)
+		result.Error, result.Code = "Failed to sync reactions", ERROR_CODE_INTERNAL
+		return result
+	}
+	for _, value := range reactions {
+		var r MessageReactions
+		if json.Unmarshal([]byte(value), &r) == nil {
+			if result.Reactions == nil {
+				result.Reactions = map[string]map[string][]string{}
+			}
+			result.Reactions[r.MessageID] = r.Reactions
+			if len(r.Super) > 0 {
+				if result.SuperReactions == nil {
+					result.SuperReactions = map[string]map[string][]string{}
+				}
+				result.SuperReactions[r.MessageID] = r.Super
+			}
+		}
+	}
+
+	// A cut list resumes from the earliest point any list stopped at, so nothing is skipped; the lists that were
+	// complete then return some changes again
+	if next == nil {
+		next = &syncCursor{UpdateTime: now.Add(-SYNC_CURSOR_LAG).UnixMicro()}
+		if next.UpdateTime < cursor.UpdateTime {
+			next.UpdateTime = cursor.UpdateTime
+		}
+	} else {
+		result.HasMore = true
+	}
+	for _, more := range []*time.Time{historyMore, reactionsMore} {
+		if more != nil && more.UnixMicro() <= next.UpdateTime {
+			next = &syncCursor{UpdateTime: more.UnixMicro()}
+			result.HasMore = true
+		}
+	}
+	result.Cursor = encodeSyncCursor(*next)
+	return result
+}
+
+// RpcSyncSince returns, in one call, everything that changed in the caller's channels while it was offline:
+// new and edited messages, deletions, reaction changes and fresh URLs for the images of those messages
+func (s *Services) RpcSyncSince(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(SyncResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Channels []*ChannelSyncRequest `json:"channels"`
+		Limit    int                   `json:"limit"`
+		// ObjectKeys are images the client holds URLs for that should be refreshed as well
+		ObjectKeys []string `json:"objectKeys"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(SyncResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Channels) == 0 {
+		return marshalResponse(SyncResponse{Success: false, Error: "Missing required field: channels", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.Channels) > SYNC_MAX_CHANNELS {
+		return marshalResponse(SyncResponse{Success: false, Error: fmt.Sprintf("At most %d channels per request", SYNC_MAX_CHANNELS), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(request.ObjectKeys) > IMAGE_URL_BATCH_MAX {
+		return marshalResponse(SyncResponse{Success: false, Error: fmt.Sprintf("At most %d objectKeys per request", IMAGE_URL_BATCH_MAX), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Limit <= 0 {
+		request.Limit = SYNC_DEFAULT_LIMIT
+	}
+	if request.Limit > SYNC_MAX_LIMIT {
+		request.Limit = SYNC_MAX_LIMIT
+	}
+
+	now := s.Clock.Now()
+	response := SyncResponse{Success: true, Channels: make([]*ChannelSync, 0, len(request.Channels))}
+	objectKeys := append([]string{}, request.ObjectKeys...)
+	seen := map[string]bool{}
+	for _, key := range objectKeys {
+		seen[key] = true
+	}
+	for _, channel := range request.Channels {
+		if channel == nil || channel.ChannelID == "" {
+			return marshalResponse(SyncResponse{Success: false, Error: "Missing required field: channelId", Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		result := syncChannel(ctx, logger, db, nk, userID, channel, request.Limit, now)
+		response.Channels = append(response.Channels, result)
+		for _, message := range result.Messages {
+			var body struct {
+				ObjectKey string `json:"objectKey"`
+			}
+			if json.Unmarshal(message.Content, &body) == nil && body.ObjectKey != "" && !seen[body.ObjectKey] {
+				seen[body.ObjectKey] = true
+				objectKeys = append(objectKeys, body.ObjectKey)
+			}
+		}
+	}
+
+	// The messages are already synced, so URLs that cannot be issued are reported without failing the call
+	if len(objectKeys) > 0 {
+		urls, failures, err := s.issueImageURLs(ctx, logger, db, nk, objectKeys)
+		if err != nil {
+			logger.Warn("Failed to issue image URLs during sync: %v", err)
+			failures = map[string]string{}
+			for _, key := range objectKeys {
+				failures[key] = err.Error()
+			}
+		}
+		response.URLs = urls
+		if len(failures) > 0 {
+			response.URLErrors = failures
+		}
+	}
+	return marshalResponse(response)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	THREAD_COLLECTION     = "message_threads"
+	THREAD_WRITE_ATTEMPTS = 3
+	// THREAD_REPLY_FIELD is the message content field a reply names the message it answers in
+	THREAD_REPLY_FIELD = "replyTo"
+	// THREAD_ROOT_FIELD is set by the server on every reply to the first message of its thread
+	THREAD_ROOT_FIELD = "threadId"
+	// THREAD_MAX_PARTICIPANTS caps the users notified of new replies, the most recently active are kept
+	THREAD_MAX_PARTICIPANTS    = 50
+	THREAD_DEFAULT_LIMIT       = 50
+	THREAD_MAX_LIMIT           = 100
+	NOTIFICATION_CODE_THREAD   = 104
+	ERROR_CODE_REPLY_NOT_FOUND = "REPLY_TARGET_NOT_FOUND"
+	ERROR_CODE_REPLY_INVALID   = "REPLY_TARGET_INVALID"
+)
+
+// MessageThread tracks the replies to a message, keyed by the ID of the thread's first message
+type MessageThread struct {
+	ChannelID  string `json:"channelId"`
+	RootID     string `json:"rootId"`
+	ReplyCount int    `json:"replyCount"`
+	// Participants are the root's author and everyone who replied, least recently active first
+	Participants []string `json:"participants"`
+	LastReplyID  string   `json:"lastReplyId,omitempty"`
+	LastReplyAt  int64    `json:"lastReplyAt,omitempty"`
+}
+
+// ThreadMessage is a message of a thread as returned by get_thread
+type ThreadMessage struct {
+	MessageID string          `json:"messageId"`
+	SenderID  string          `json:"senderId"`
+	Username  string          `json:"username"`
+	Content   json.RawMessage `json:"content"`
+	CreatedAt int64           `json:"createdAt"`
+	UpdatedAt int64           `json:"updatedAt"`
+}
+
+// ThreadResponse represents the response for get_thread
+type ThreadResponse struct {
+	Success bool `json:"success"`
+	// Parent is the thread's first message, omitted once it has been deleted
+	Parent       *ThreadMessage   `json:"parent,omitempty"`
+	Replies      []*ThreadMessage `json:"replies,omitempty"`
+	ReplyCount   int              `json:"replyCount"`
+	Participants []string         `json:"participants,omitempty"`
+	Cursor       string           `json:"cursor,omitempty"`
+	Error        string           `json:"error,omitempty"`
+	Code         string           `json:"code,omitempty"`
+}
+
+// threadCursor is the position after the last reply of a page; replies are ordered oldest first
+type threadCursor struct {
+	CreateTime int64  `json:"t"`
+	MessageID  string `json:"id"`
+}
+
+// threadRootOf returns the thread a message belongs to, "" when it is not a reply
+func threadRootOf(content map[string]interface{}) string {
+	root, _ := content[THREAD_ROOT_FIELD].(string)
+	return root
+}
+
+// checkReplyTo is the send check that validates the message a reply names and files the reply under that
+// message's thread. A reply to a reply joins the thread of the message it answers, so threads stay flat.
+func checkReplyTo(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, senderID, channelID string, content map[string]interface{}) (bool, error) {
+	// The thread is the server's to assign
+	_, changed := content[THREAD_ROOT_FIELD]
+	delete(content, THREAD_ROOT_FIELD)
+
+	value, ok := content[THREAD_REPLY_FIELD]
+	if !ok {
+		return changed, nil
+	}
+	replyTo, _ := value.(string)
+	if _, err := uuid.Parse(replyTo); err != nil {
+		return false, &MessageRejectedError{Code: ERROR_CODE_REPLY_INVALID, Message: "replyTo must be a message ID"}
+	}
+
+	parent, err := readChannelMessage(ctx, db, channelID, replyTo)
+	if err != nil {
+		return false, err
+	}
+	if parent == nil {
+		return false, &MessageRejectedError{Code: ERROR_CODE_REPLY_NOT_FOUND, Message: "The message you are replying to does not exist"}
+	}
+
+	root := replyTo
+	var parentContent map[string]interface{}
+	if json.Unmarshal([]byte(parent.Content), &parentContent) == nil && threadRootOf(parentContent) != "" {
+		root = threadRootOf(parentContent)
+	}
+	content[THREAD_ROOT_FIELD] = root
+	return true, nil
+}
+
+// keepThreadFields carries the reply fields of a message's original content over to an edit, so edits cannot
+// move a message between threads
+func keepThreadFields(original string, content map[string]interface{}) {
+	delete(content, THREAD_REPLY_FIELD)
+	delete(content, THREAD_ROOT_FIELD)
+	var stored map[string]interface{}
+	if json.Unmarshal([]byte(original), &stored) != nil || threadRootOf(stored) == "" {
+		return
+	}
+	content[THREAD_REPLY_FIELD] = stored[THREAD_REPLY_FIELD]
+	content[THREAD_ROOT_FIELD] = stored[THREAD_ROOT_FIELD]
+}
+
+// readThread loads a thread's record, nil if its first message has no replies
+func readThread(ctx context.Context, nk nkruntime.NakamaModule, rootID string) (*MessageThread, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: THREAD_COLLECTION, Key: rootID}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read thread: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, "", nil
+	}
+	var thread MessageThread
+	if err := json.Unmarshal([]byte(objects[0].Value), &thread); err != nil {
+		return nil, "", fmt.Errorf("failed to decode thread: %v", err)
+	}
+	return &thread, objects[0].Version, nil
+}
+
+// updateThread applies fn to a thread's record, retrying on concurrent modification. A new thread starts with
+// the root's author as its only participant.
+func updateThread(ctx context.Context, db *sql.DB, nk nkruntime.NakamaModule, channelID, rootID string, fn func(*MessageThread)) (*MessageThread, error) {
+	var lastErr error
+	for attempt := 0; attempt < THREAD_WRITE_ATTEMPTS; attempt++ {
+		thread, version, err := readThread(ctx, nk, rootID)
+		if err != nil {
+			return nil, err
+		}
+		if thread == nil {
+			thread = &MessageThread{ChannelID: channelID, RootID: rootID}
+			version = "*"
+			if root, err := readChannelMessage(ctx, db, channelID, rootID); err == nil && root != nil && root.SenderID != "" {
+				thread.Participants = []string{root.SenderID}
+			}
+		}
+		if thread.ChannelID != channelID {
+			return nil, errorWithCode(ERROR_CODE_NOT_FOUND, "thread not found")
+		}
+		fn(thread)
+
+		value, _ := json.Marshal(thread)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      THREAD_COLLECTION,
+			Key:             rootID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return thread, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to update thread: %v", lastErr)
+}
+
+// touchParticipant moves a user to the end of the participant list, dropping the least recently active beyond the cap
+func (t *MessageThread) touchParticipant(userID string) {
+	participants := make([]string, 0, len(t.Participants)+1)
+	for _, id := range t.Participants {
+		if id != userID {
+			participants = append(participants, id)
+		}
+	}
+	participants = append(participants, userID)
+	if len(participants) > THREAD_MAX_PARTICIPANTS {
+		participants = participants[len(participants)-THREAD_MAX_PARTICIPANTS:]
+	}
+	t.Participants = participants
+}
+
+// sendThreadEvent tells the channel that a thread's reply count changed
+func sendThreadEvent(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, eventType string, thread *MessageThread, messageID string) {
+	event := &ChannelEvent{
+		Type:      eventType,
+		ChannelID: thread.ChannelID,
+		MessageID: messageID,
+		SenderID:  userIDFromContext(ctx),
+		Username:  usernameFromContext(ctx),
+		Content:   map[string]interface{}{"threadId": thread.RootID, "replyCount": thread.ReplyCount},
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := sendChannelEvent(nk, event); err != nil {
+		logger.Warn("Failed to send %s event for %s: %v", eventType, messageID, err)
+	}
+}
+
+// trackThreadReply is the sent-message hook that records a reply in its thread and tells the thread's
+// participants, including those who are not looking at the channel
+func trackThreadReply(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage) {
+	var content map[string]interface{}
+	if err := json.Unmarshal([]byte(message.Content), &content); err != nil {
+		return
+	}
+	rootID := threadRootOf(content)
+	if rootID == "" {
+		return
+	}
+
+	var notify []string
+	thread, err := updateThread(ctx, db, nk, message.ChannelID, rootID, func(t *MessageThread) {
+		notify = append(notify[:0], t.Participants...)
+		t.ReplyCount++
+		t.LastReplyID = message.MessageID
+		t.LastReplyAt = message.CreatedAt
+		if message.SenderID != "" {
+			t.touchParticipant(message.SenderID)
+		}
+	})
+	if err != nil {
+		logger.Warn("Failed to record reply %s in thread %s: %v", message.MessageID, rootID, err)
+		return
+	}
+	sendThreadEvent(ctx, logger, nk, "thread_reply", thread, message.MessageID)
+
+	preview := messagePreview(content)
+	notifications := make([]*nkruntime.NotificationSend, 0, len(notify))
+	for _, id := range notify {
+		if id == message.SenderID {
+			continue
+		}
+		// Someone who left the channel must not keep reading it through the thread
+		if member, err := isChannelMember(ctx, nk, message.ChannelID, id); err != nil || !member {
+			continue
+		}
+		if blocked, err := hasBlocked(ctx, nk, id, message.SenderID); err != nil || blocked {
+			continue
+		}
+		notifications = append(notifications, &nkruntime.NotificationSend{
+			UserID:  id,
+			Subject: fmt.Sprintf("%s replied in a thread", message.Username),
+			Content: map[string]interface{}{
+				"channelId":  message.ChannelID,
+				"threadId":   rootID,
+				"messageId":  message.MessageID,
+				"senderId":   message.SenderID,
+				"username":   message.Username,
+				"preview":    preview,
+				"replyCount": thread.ReplyCount,
+			},
+			Code:   NOTIFICATION_CODE_THREAD,
+			Sender: message.SenderID,
+			// Live only: get_thread has the replies for anyone who was offline
+			Persistent: false,
+		})
+	}
+	if len(notifications) == 0 {
+		return
+	}
+	if err := nk.NotificationsSend(ctx, notifications); err != nil {
+		logger.Warn("Failed to notify participants of thread %s: %v", rootID, err)
+	}
+}
+
+// untrackThreadReply takes a deleted reply out of its thread's count
+func untrackThreadReply(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, channelID, messageID, content string) {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &decoded); err != nil {
+		return
+	}
+	rootID := threadRootOf(decoded)
+	if rootID == "" {
+		return
+	}
+	if thread, _, err := readThread(ctx, nk, rootID); err != nil || thread == nil {
+		return
+	}
+	thread, err := updateThread(ctx, db, nk, channelID, rootID, func(t *MessageThread) {
+		if t.ReplyCount > 0 {
+			t.ReplyCount--
+		}
+	})
+	if err != nil {
+		logger.Warn("Failed to remove reply %s from thread %s: %v", messageID, rootID, err)
+		return
+	}
+	sendThreadEvent(ctx, logger, nk, "thread_reply_deleted", thread, messageID)
+}
+
+// scanThreadMessage reads one row of the message table
+func scanThreadMessage(row interface{ Scan(...interface{}) error }) (*ThreadMessage, time.Time, error) {
+	var message ThreadMessage
+	var content string
+	var created, updated time.Time
+	if err := row.Scan(&message.MessageID, &message.SenderID, &message.Username, &content, &created, &updated); err != nil {
+		return nil, created, err
+	}
+	message.Content = json.RawMessage(content)
+	message.CreatedAt = created.Unix()
+	message.UpdatedAt = updated.Unix()
+	return &message, created, nil
+}
+
+// RpcGetThread returns a message and a page of the replies in its thread, oldest first
+func RpcGetThread(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ThreadResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+		MessageID string `json:"messageId"`
+		Limit     int    `json:"limit"`
+		Cursor    string `json:"cursor"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ThreadResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" || request.MessageID == "" {
+		return marshalResponse(ThreadResponse{Success: false, Error: "Missing required fields: channelId or messageId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if _, err := uuid.Parse(request.MessageID); err != nil {
+		return marshalResponse(ThreadResponse{Success: false, Error: "Invalid messageId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Limit <= 0 {
+		request.Limit = THREAD_DEFAULT_LIMIT
+	}
+	if request.Limit > THREAD_MAX_LIMIT {
+		request.Limit = THREAD_MAX_LIMIT
+	}
+
+	ref, err := parseChannelID(request.ChannelID)
+	if err != nil {
+		return marshalResponse(ThreadResponse{Success: false, Error: fmt.Sprintf("Invalid channelId: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil {
+		return marshalResponse(ThreadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if !member {
+		return marshalResponse(ThreadResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+	subject, descriptor := messageStreamColumns(ref)
+
+	const columns = `SELECT id::TEXT, sender_id::TEXT, username, content::TEXT, create_time, update_time FROM message
+WHERE stream_mode = $1 AND stream_subject = $2 AND stream_descriptor = $3 AND stream_label = $4`
+	args := []interface{}{ref.Mode, subject, descriptor, ref.Label}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	// The first message may be a reply itself; its thread is then the one to show
+	var parent *ThreadMessage
+	rootID := request.MessageID
+	parent, _, err = scanThreadMessage(db.QueryRowContext(ctx, columns+" AND id = $5", append(args, request.MessageID)...))
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("Failed to read thread %s: %v", request.MessageID, err)
+		return marshalResponse(ThreadResponse{Success: false, Error: "Failed to read thread", Code: ERROR_CODE_INTERNAL})
+	}
+	if parent != nil {
+		var content map[string]interface{}
+		if json.Unmarshal(parent.Content, &content) == nil && threadRootOf(content) != "" {
+			rootID = threadRootOf(content)
+			parent, _, err = scanThreadMessage(db.QueryRowContext(ctx, columns+" AND id = $5", append(args, rootID)...))
+			if err != nil && err != sql.ErrNoRows {
+				logger.Error("Failed to read thread %s: %v", rootID, err)
+				return marshalResponse(ThreadResponse{Success: false, Error: "Failed to read thread", Code: ERROR_CODE_INTERNAL})
+			}
+		}
+	}
+
+	thread, _, err := readThread(ctx, nk, rootID)
+	if err != nil {
+		return marshalResponse(ThreadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if thread != nil && thread.ChannelID != request.ChannelID {
+		thread = nil
+	}
+	if parent == nil && thread == nil {
+		return marshalResponse(ThreadResponse{Success: false, Error: "Message not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	query := columns + " AND content->>'" + THREAD_ROOT_FIELD + "' = " + arg(rootID)
+	if request.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(request.Cursor)
+		var cursor threadCursor
+		if err == nil {
+			err = json.Unmarshal(raw, &cursor)
+		}
+		if err != nil || cursor.MessageID == "" {
+			return marshalResponse(ThreadResponse{Success: false, Error: "Invalid cursor", Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		t := arg(time.UnixMicro(cursor.CreateTime).UTC())
+		query += fmt.Sprintf(" AND (create_time > %s OR (create_time = %s AND id > %s))", t, t, arg(cursor.MessageID))
+	}
+	// One extra row tells whether there is another page
+	query += " ORDER BY create_time ASC, id ASC LIMIT " + arg(request.Limit+1)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Error("Failed to list replies of %s: %v", rootID, err)
+		return marshalResponse(ThreadResponse{Success: false, Error: "Failed to read thread", Code: ERROR_CODE_INTERNAL})
+	}
+	defer rows.Close()
+
+	replies := make([]*ThreadMessage, 0, request.Limit)
+	var last time.Time
+	next := ""
+	for rows.Next() {
+		if len(replies) == request.Limit {
+			encoded, _ := json.Marshal(threadCursor{CreateTime: last.UnixMicro(), MessageID: replies[len(replies)-1].MessageID})
+			next = base64.RawURLEncoding.EncodeToString(encoded)
+			break
+		}
+		reply, created, err := scanThreadMessage(rows)
+		if err != nil {
+			logger.Error("Failed to read reply of %s: %v", rootID, err)
+			return marshalResponse(ThreadResponse{Success: false, Error: "Failed to read thread", Code: ERROR_CODE_INTERNAL})
+		}
+		last = created
+		replies = append(replies, reply)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("Failed to list replies of %s: %v", rootID, err)
+		return marshalResponse(ThreadResponse{Success: false, Error: "Failed to read thread", Code: ERROR_CODE_INTERNAL})
+	}
+
+	response := ThreadResponse{Success: true, Parent: parent, Replies: replies, Cursor: next}
+	if thread != nil {
+		response.ReplyCount = thread.ReplyCount
+		response.Participants = thread.Participants
+	}
+	return marshalResponse(response)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strconv"
+	"strings"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	THUMBNAIL_PREFIX        = "thumbnails/"
+	THUMBNAIL_DEFAULT_SIZES = "small:128,medium:512"
+	THUMBNAIL_JPEG_QUALITY  = 80
+)
+
+// ImageDerivative is an extra rendition of an upload stored next to the original
+type ImageDerivative struct {
+	Data        []byte
+	ContentType string
+	Extension   string
+	Size        int
+}
+
+// thumbnailStage renders downscaled copies of the image, configured by THUMBNAIL_SIZES ("name:px,...")
+type thumbnailStage struct {
+	sizes map[string]int
+}
+
+func newThumbnailStage() (ImageStage, error) {
+	spec := serverConfig.ThumbnailSizes
+	sizes := map[string]int{}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid THUMBNAIL_SIZES entry: %q", entry)
+		}
+		px, err := strconv.Atoi(parts[1])
+		if err != nil || px <= 0 {
+			return nil, fmt.Errorf("invalid thumbnail size: %q", entry)
+		}
+		sizes[parts[0]] = px
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("THUMBNAIL_SIZES is empty")
+	}
+	return &thumbnailStage{sizes: sizes}, nil
+}
+
+func (s *thumbnailStage) Name() string { return "thumbnails" }
+
+func (s *thumbnailStage) Process(ctx context.Context, logger nkruntime.Logger, asset *ImageAsset) error {
+	if asset.IsWebP() {
+		return nil
+	}
+	if err := asset.Decode(); err != nil {
+		return err
+	}
+	b := asset.Image.Bounds()
+
+	for name, px := range s.sizes {
+		width, height := fitWithin(b.Dx(), b.Dy(), px)
+		thumb := resizeImage(asset.Image, width, height)
+
+		// The standard library has no WebP encoder, so thumbnails keep JPEG for photos and PNG for everything else
+		var buf bytes.Buffer
+		derivative := &ImageDerivative{Size: px}
+		if asset.Format == "jpeg" {
+			if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: THUMBNAIL_JPEG_QUALITY}); err != nil {
+				return fmt.Errorf("failed to encode %s thumbnail: %v", name, err)
+			}
+			derivative.ContentType, derivative.Extension = "image/jpeg", ".jpg"
+		} else {
+			if err := png.Encode(&buf, thumb); err != nil {
+				return fmt.Errorf("failed to encode %s thumbnail: %v", name, err)
+			}
+			derivative.ContentType, derivative.Extension = "image/png", ".png"
+		}
+		derivative.Data = buf.Bytes()
+
+		if asset.Derivatives == nil {
+			asset.Derivatives = map[string]*ImageDerivative{}
+		}
+		asset.Derivatives[name] = derivative
+	}
+	return nil
+}
+
+// thumbnailKey places a derivative under the thumbnails/ prefix, mirroring the original's key
+func thumbnailKey(objectKey string, derivative *ImageDerivative) string {
+	base := strings.TrimSuffix(objectKey, path.Ext(objectKey))
+	return fmt.Sprintf("%s%s_%d%s", THUMBNAIL_PREFIX, base, derivative.Size, derivative.Extension)
+}
+
+// storeDerivatives uploads every derivative of an asset and returns their object keys by name
+func (s *Services) storeDerivatives(ctx context.Context, logger nkruntime.Logger, objectKey string, asset *ImageAsset) (map[string]string, error) {
+	if len(asset.Derivatives) == 0 {
+		return nil, nil
+	}
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize storage backend: %v", err)
+	}
+	keys := make(map[string]string, len(asset.Derivatives))
+	for name, derivative := range asset.Derivatives {
+		key := thumbnailKey(objectKey, derivative)
+		if err := backend.PutObject(ctx, s.Config.bucketForKey(key), key, bytes.NewReader(derivative.Data), int64(len(derivative.Data)), derivative.ContentType); err != nil {
+			return nil, fmt.Errorf("failed to upload %s thumbnail: %v", name, err)
+		}
+		keys[name] = key
+	}
+	logger.Info("Stored %d thumbnails for %s", len(keys), objectKey)
+	return keys, nil
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	TRANSLATION_COLLECTION       = "message_translations"
+	TRANSLATION_USAGE_COLLECTION = "translation_usage"
+	TRANSLATION_USAGE_KEY        = "usage"
+	TRANSLATION_WRITE_ATTEMPTS   = 3
+	TRANSLATION_TIMEOUT          = 10 * time.Second
+	// TRANSLATION_MAX_LANGUAGES bounds the cached languages of one message, the oldest is dropped beyond it
+	TRANSLATION_MAX_LANGUAGES           = 20
+	TRANSLATION_DEFAULT_MAX_CHARS       = 5000
+	TRANSLATION_DEFAULT_RATE_PER_MINUTE = 20
+	// TRANSLATION_LANGUAGE_FIELD is the account metadata field holding a user's target language
+	TRANSLATION_LANGUAGE_FIELD        = "translationLanguage"
+	DEEPL_API_URL                     = "https://api.deepl.com/v2/translate"
+	DEEPL_FREE_API_URL                = "https://api-free.deepl.com/v2/translate"
+	GOOGLE_TRANSLATE_API_URL          = "https://translation.googleapis.com/language/translate/v2"
+	ERROR_CODE_TRANSLATION_RATE_LIMIT = "TRANSLATION_RATE_LIMITED"
+)
+
+// translationLanguagePattern accepts BCP 47 style tags such as "de", "pt-br" or "zh-hant", after lowercasing
+var translationLanguagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})?$`)
+
+// TranslationProvider translates message texts. Translate returns one translation per text, in order, and the
+// source language it detected, "" when it cannot tell.
+type TranslationProvider interface {
+	Name() string
+	Translate(ctx context.Context, texts []string, target string) ([]string, string, error)
+}
+
+// TRANSLATION_PROVIDERS maps the TRANSLATION_PROVIDER values to their constructors
+var TRANSLATION_PROVIDERS = map[string]func() (TranslationProvider, error){
+	"deepl":          newDeepLTranslator,
+	"google":         newGoogleTranslator,
+	"libretranslate": newLibreTranslator,
+}
+
+// translationProvider is the configured provider, nil when translation is off
+var translationProvider TranslationProvider
+
+// MessageTranslation is one message translated into one language
+type MessageTranslation struct {
+	Language       string            `json:"language"`
+	SourceLanguage string            `json:"sourceLanguage,omitempty"`
+	Fields         map[string]string `json:"fields"`
+	Provider       string            `json:"provider"`
+	TranslatedAt   int64             `json:"translatedAt"`
+}
+
+// cachedTranslations holds the translations of a message, keyed by message ID. SourceHash is the hash of the
+// text they were made from, so translations of an edited message are not served.
+type cachedTranslations struct {
+	ChannelID    string                `json:"channelId"`
+	SourceHash   string                `json:"sourceHash"`
+	Translations []*MessageTranslation `json:"translations"`
+}
+
+// TranslationUsage counts a user's provider calls in the current minute
+type TranslationUsage struct {
+	MinuteStart int64 `json:"minuteStart"`
+	MinuteCount int   `json:"minuteCount"`
+}
+
+// TranslationResponse represents the response for translation RPCs
+type TranslationResponse struct {
+	Success     bool                `json:"success"`
+	MessageID   string              `json:"messageId,omitempty"`
+	Language    string              `json:"language,omitempty"`
+	Translation *MessageTranslation `json:"translation,omitempty"`
+	Cached      bool                `json:"cached,omitempty"`
+	Code        string              `json:"code,omitempty"`
+	Error       string              `json:"error,omitempty"`
+}
+
+// InitializeTranslation builds the provider named by TRANSLATION_PROVIDER, leaving translation off when it is empty
+func InitializeTranslation(logger nkruntime.Logger) error {
+	name := serverConfig.TranslationProvider
+	if name == "" {
+		logger.Info("Message translation disabled")
+		return nil
+	}
+	factory, ok := TRANSLATION_PROVIDERS[name]
+	if !ok {
+		return fmt.Errorf("unknown TRANSLATION_PROVIDER: %s", name)
+	}
+	provider, err := factory()
+	if err != nil {
+		return err
+	}
+	translationProvider = provider
+	logger.Info("Message translation enabled with %s", name)
+	return nil
+}
+
+// normalizeLanguage lowercases a language tag and checks its shape, "" if it is not one
+func normalizeLanguage(language string) string {
+	language = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(language), "_", "-"))
+	if !translationLanguagePattern.MatchString(language) {
+		return ""
+	}
+	return language
+}
+
+// translationLanguage returns the language a user reads translations in: the preference in their account
+// metadata, then their account language
+func translationLanguage(ctx context.Context, nk nkruntime.NakamaModule, userID string) (string, error) {
+	account, err := nk.AccountGetId(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to read account: %v", err)
+	}
+	if account.User == nil {
+		return "", nil
+	}
+	var metadata map[string]interface{}
+	if json.Unmarshal([]byte(account.User.Metadata), &metadata) == nil {
+		if language, ok := metadata[TRANSLATION_LANGUAGE_FIELD].(string); ok && normalizeLanguage(language) != "" {
+			return normalizeLanguage(language), nil
+		}
+	}
+	return normalizeLanguage(account.User.LangTag), nil
+}
+
+// messageTexts returns the user-written text fields of a message and the hash of their contents
+func messageTexts(content string) (map[string]string, string) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &fields); err != nil {
+		return nil, ""
+	}
+	texts := map[string]string{}
+	hash := sha256.New()
+	for _, field := range MESSAGE_TEXT_FIELDS {
+		if text, ok := fields[field].(string); ok && strings.TrimSpace(text) != "" {
+			texts[field] = text
+			hash.Write([]byte(field + "\x00" + text + "\x00"))
+		}
+	}
+	return texts, hex.EncodeToString(hash.Sum(nil))
+}
+
+// readTranslations loads the cached translations of a message with their storage version, "*" when there are none
+func readTranslations(ctx context.Context, nk nkruntime.NakamaModule, messageID string) (*cachedTranslations, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: TRANSLATION_COLLECTION, Key: messageID}})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(objects) == 0 {
+		return nil, "*", nil
+	}
+	var cached cachedTranslations
+	if err := json.Unmarshal([]byte(objects[0].Value), &cached); err != nil {
+		return nil, objects[0].Version, nil
+	}
+	return &cached, objects[0].Version, nil
+}
+
+// cacheTranslation adds a translation to the message's cache. A concurrent write wins, the translation is
+// simply made again on a later miss.
+func cacheTranslation(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, channelID, messageID, sourceHash string, translation *MessageTranslation) {
+	cached, version, err := readTranslations(ctx, nk, messageID)
+	if err != nil {
+		logger.Warn("Failed to read translations of %s: %v", messageID, err)
+		return
+	}
+	if cached == nil || cached.SourceHash != sourceHash {
+		cached = &cachedTranslations{ChannelID: channelID, SourceHash: sourceHash}
+	}
+	kept := []*MessageTranslation{}
+	for _, t := range cached.Translations {
+		if t.Language != translation.Language {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) >= TRANSLATION_MAX_LANGUAGES {
+		kept = kept[len(kept)-TRANSLATION_MAX_LANGUAGES+1:]
+	}
+	cached.Translations = append(kept, translation)
+
+	value, _ := json.Marshal(cached)
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      TRANSLATION_COLLECTION,
+		Key:             messageID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  0,
+		PermissionWrite: 0,
+	}}); err != nil {
+		logger.Warn("Failed to cache translation of %s: %v", messageID, err)
+	}
+}
+
+// dropTranslations forgets the cached translations of an edited or deleted message
+func dropTranslations(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, messageID string) {
+	if err := nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: TRANSLATION_COLLECTION, Key: messageID}}); err != nil {
+		logger.Warn("Failed to delete translations of message %s: %v", messageID, err)
+	}
+}
+
+// reserveTranslation counts a provider call against the user's per-minute limit
+func reserveTranslation(ctx context.Context, nk nkruntime.NakamaModule, userID string) error {
+	rate := serverConfig.TranslationRateLimitPerMinute
+	if rate <= 0 {
+		return nil
+	}
+	var lastErr error
+	for attempt := 0; attempt < TRANSLATION_WRITE_ATTEMPTS; attempt++ {
+		usage := TranslationUsage{}
+		version := "*"
+		objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: TRANSLATION_USAGE_COLLECTION, Key: TRANSLATION_USAGE_KEY, UserID: userID}})
+		if err != nil {
+			return err
+		}
+		if len(objects) > 0 {
+			if err := json.Unmarshal([]byte(objects[0].Value), &usage); err != nil {
+				return err
+			}
+			version = objects[0].Version
+		}
+
+		if minute := time.Now().Truncate(time.Minute).Unix(); usage.MinuteStart != minute {
+			usage.MinuteStart, usage.MinuteCount = minute, 0
+		}
+		if usage.MinuteCount >= rate {
+			return &QuotaError{Code: ERROR_CODE_TRANSLATION_RATE_LIMIT, Message: fmt.Sprintf("Too many translations, the limit is %d per minute", rate)}
+		}
+		usage.MinuteCount++
+
+		value, _ := json.Marshal(usage)
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+			Collection:      TRANSLATION_USAGE_COLLECTION,
+			Key:             TRANSLATION_USAGE_KEY,
+			UserID:          userID,
+			Value:           string(value),
+			Version:         version,
+			PermissionRead:  1,
+			PermissionWrite: 0,
+		}}); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to update translation usage: %v", lastErr)
+}
+
+// RpcTranslateMessage translates a message into the requested language, or the caller's preferred one.
+// Translations are cached per message and language; only provider calls count against the rate limit.
+func RpcTranslateMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(TranslationResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+	if translationProvider == nil {
+		return marshalResponse(TranslationResponse{Success: false, Error: "Message translation is not enabled", Code: ERROR_CODE_REJECTED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+		MessageID string `json:"messageId"`
+		Language  string `json:"language"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(TranslationResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" || request.MessageID == "" {
+		return marshalResponse(TranslationResponse{Success: false, Error: "Missing required fields: channelId or messageId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	language := normalizeLanguage(request.Language)
+	if request.Language == "" {
+		preferred, err := translationLanguage(ctx, nk, userID)
+		if err != nil {
+			return marshalResponse(TranslationResponse{Success: false, Error: fmt.Sprintf("Failed to read language preference: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+		language = preferred
+	}
+	if language == "" {
+		return marshalResponse(TranslationResponse{Success: false, Error: "Invalid language", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil || !member {
+		return marshalResponse(TranslationResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+	message, err := readChannelMessage(ctx, db, request.ChannelID, request.MessageID)
+	if err != nil {
+		return marshalResponse(TranslationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if message == nil {
+		return marshalResponse(TranslationResponse{Success: false, Error: "Message not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	texts, sourceHash := messageTexts(message.Content)
+	if len(texts) == 0 {
+		return marshalResponse(TranslationResponse{Success: false, Error: "Message has no text to translate", Code: ERROR_CODE_REJECTED})
+	}
+	chars := 0
+	for _, text := range texts {
+		chars += utf8.RuneCountInString(text)
+	}
+	if chars > serverConfig.TranslationMaxChars {
+		return marshalResponse(TranslationResponse{Success: false, Error: fmt.Sprintf("Message exceeds the translation limit of %d characters", serverConfig.TranslationMaxChars), Code: ERROR_CODE_PAYLOAD_TOO_LARGE})
+	}
+
+	if cached, _, err := readTranslations(ctx, nk, request.MessageID); err != nil {
+		logger.Warn("Failed to read translations of %s: %v", request.MessageID, err)
+	} else if cached != nil && cached.SourceHash == sourceHash {
+		for _, translation := range cached.Translations {
+			if translation.Language == language {
+				return marshalResponse(TranslationResponse{Success: true, MessageID: request.MessageID, Language: language, Translation: translation, Cached: true})
+			}
+		}
+	}
+
+	if err := reserveTranslation(ctx, nk, userID); err != nil {
+		return marshalResponse(TranslationResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	fields := make([]string, 0, len(texts))
+	sources := make([]string, 0, len(texts))
+	for _, field := range MESSAGE_TEXT_FIELDS {
+		if text, ok := texts[field]; ok {
+			fields = append(fields, field)
+			sources = append(sources, text)
+		}
+	}
+	translated, sourceLanguage, err := translationProvider.Translate(ctx, sources, language)
+	if err == nil && len(translated) != len(sources) {
+		err = fmt.Errorf("expected %d translations, got %d", len(sources), len(translated))
+	}
+	if err != nil {
+		logger.Error("Translation of %s into %s with %s failed: %v", request.MessageID, language, translationProvider.Name(), err)
+		return marshalResponse(TranslationResponse{Success: false, Error: fmt.Sprintf("Failed to translate message: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	translation := &MessageTranslation{
+		Language:       language,
+		SourceLanguage: normalizeLanguage(sourceLanguage),
+		Fields:         map[string]string{},
+		Provider:       translationProvider.Name(),
+		TranslatedAt:   time.Now().Unix(),
+	}
+	for i, field := range fields {
+		translation.Fields[field] = translated[i]
+	}
+	cacheTranslation(ctx, logger, nk, request.ChannelID, request.MessageID, sourceHash, translation)
+
+	return marshalResponse(TranslationResponse{Success: true, MessageID: request.MessageID, Language: language, Translation: translation})
+}
+
+// RpcSetTranslationLanguage stores the caller's translation language in their account metadata; an empty
+// language clears it, falling back to the account language
+func RpcSetTranslationLanguage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(TranslationResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Language string `json:"language"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(TranslationResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	language := normalizeLanguage(request.Language)
+	if request.Language != "" && language == "" {
+		return marshalResponse(TranslationResponse{Success: false, Error: "Invalid language", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	account, err := nk.AccountGetId(ctx, userID)
+	if err != nil || account.User == nil {
+		return marshalResponse(TranslationResponse{Success: false, Error: fmt.Sprintf("Failed to read account: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	// Metadata is replaced as a whole, so the other fields are carried over
+	metadata := map[string]interface{}{}
+	if account.User.Metadata != "" {
+		if err := json.Unmarshal([]byte(account.User.Metadata), &metadata); err != nil {
+			return marshalResponse(TranslationResponse{Success: false, Error: fmt.Sprintf("Failed to decode account metadata: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+	}
+	if language == "" {
+		delete(metadata, TRANSLATION_LANGUAGE_FIELD)
+	} else {
+		metadata[TRANSLATION_LANGUAGE_FIELD] = language
+	}
+	if err := nk.AccountUpdateId(ctx, userID, "", metadata, "", "", "", "", ""); err != nil {
+		return marshalResponse(TranslationResponse{Success: false, Error: fmt.Sprintf("Failed to update account: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	if language == "" {
+		language = normalizeLanguage(account.User.LangTag)
+	}
+	return marshalResponse(TranslationResponse{Success: true, Language: language})
+}
+
+// postTranslation sends a JSON request to a translation API and decodes its JSON answer into out
+func postTranslation(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, body, out interface{}) error {
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("translation service unavailable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("translation service returned status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out); err != nil {
+		return fmt.Errorf("invalid translation service response: %v", err)
+	}
+	return nil
+}
+
+// languageTag formats a normalized language with an uppercase region, as in "pt-BR"
+func languageTag(language string) string {
+	if base, region, ok := strings.Cut(language, "-"); ok && len(region) == 2 {
+		return base + "-" + strings.ToUpper(region)
+	}
+	return language
+}
+
+// deeplTranslator uses the DeepL API (DEEPL_API_KEY). Free plan keys, ending in ":fx", go to the free endpoint.
+type deeplTranslator struct {
+	endpoint string
+	key      string
+	client   *http.Client
+}
+
+func newDeepLTranslator() (TranslationProvider, error) {
+	key := serverConfig.DeepLAPIKey
+	if key == "" {
+		return nil, fmt.Errorf("DEEPL_API_KEY is not set")
+	}
+	endpoint := serverConfig.DeepLAPIURL
+	if endpoint == "" {
+		endpoint = DEEPL_API_URL
+		if strings.HasSuffix(key, ":fx") {
+			endpoint = DEEPL_FREE_API_URL
+		}
+	}
+	return &deeplTranslator{endpoint: endpoint, key: key, client: &http.Client{Timeout: TRANSLATION_TIMEOUT}}, nil
+}
+
+func (t *deeplTranslator) Name() string { return "deepl" }
+
+func (t *deeplTranslator) Translate(ctx context.Context, texts []string, target string) ([]string, string, error) {
+	var result struct {
+		Translations []struct {
+			DetectedSourceLanguage string `json:"detected_source_language"`
+			Text                   string `json:"text"`
+		} `json:"translations"`
+	}
+	err := postTranslation(ctx, t.client, t.endpoint, map[string]string{"Authorization": "DeepL-Auth-Key " + t.key},
+		map[string]interface{}{"text": texts, "target_lang": strings.ToUpper(target)}, &result)
+	if err != nil {
+		return nil, "", err
+	}
+	translated := make([]string, 0, len(result.Translations))
+	source := ""
+	for _, tr := range result.Translations {
+		translated = append(translated, tr.Text)
+		if source == "" {
+			source = tr.DetectedSourceLanguage
+		}
+	}
+	return translated, source, nil
+}
+
+// googleTranslator uses the Google Cloud Translation v2 API with an API key (GOOGLE_TRANSLATE_API_KEY)
+type googleTranslator struct {
+	key    string
+	client *http.Client
+}
+
+func newGoogleTranslator() (TranslationProvider, error) {
+	if serverConfig.GoogleTranslateAPIKey == "" {
+		return nil, fmt.Errorf("GOOGLE_TRANSLATE_API_KEY is not set")
+	}
+	return &googleTranslator{key: serverConfig.GoogleTranslateAPIKey, client: &http.Client{Timeout: TRANSLATION_TIMEOUT}}, nil
+}
+
+func (t *googleTranslator) Name() string { return "google" }
+
+func (t *googleTranslator) Translate(ctx context.Context, texts []string, target string) ([]string, string, error) {
+	var result struct {
+		Data struct {
+			Translations []struct {
+				TranslatedText         string `json:"translatedText"`
+				DetectedSourceLanguage string `json:"detectedSourceLanguage"`
+			} `json:"translations"`
+		} `json:"data"`
+	}
+	err := postTranslation(ctx, t.client, GOOGLE_TRANSLATE_API_URL+"?key="+url.QueryEscape(t.key), nil,
+		map[string]interface{}{"q": texts, "target": languageTag(target), "format": "text"}, &result)
+	if err != nil {
+		return nil, "", err
+	}
+	translated := make([]string, 0, len(result.Data.Translations))
+	source := ""
+	for _, tr := range result.Data.Translations {
+		translated = append(translated, tr.TranslatedText)
+		if source == "" {
+			source = tr.DetectedSourceLanguage
+		}
+	}
+	return translated, source, nil
+}
+
+// libreTranslator uses a LibreTranslate server at LIBRETRANSLATE_URL, with LIBRETRANSLATE_API_KEY when it requires one
+type libreTranslator struct {
+	endpoint string
+	key      string
+	client   *http.Client
+}
+
+func newLibreTranslator() (TranslationProvider, error) {
+	if serverConfig.LibreTranslateURL == "" {
+		return nil, fmt.Errorf("LIBRETRANSLATE_URL is not set")
+	}
+	return &libreTranslator{
+		endpoint: strings.TrimSuffix(serverConfig.LibreTranslateURL, "/") + "/translate",
+		key:      serverConfig.LibreTranslateAPIKey,
+		client:   &http.Client{Timeout: TRANSLATION_TIMEOUT},
+	}, nil
+}
+
+func (t *libreTranslator) Name() string { return "libretranslate" }
+
+func (t *libreTranslator) Translate(ctx context.Context, texts []string, target string) ([]string, string, error) {
+	// LibreTranslate knows languages, not regional variants
+	base, _, _ := strings.Cut(target, "-")
+	body := map[string]interface{}{"q": texts, "source": "auto", "target": base, "format": "text"}
+	if t.key != "" {
+		body["api_key"] = t.key
+	}
+	var result struct {
+		TranslatedText   []string `json:"translatedText"`
+		DetectedLanguage []struct {
+			Language string `json:"language"`
+		} `json:"detectedLanguage"`
+	}
+	if err := postTranslation(ctx, t.client, t.endpoint, nil, body, &result); err != nil {
+		return nil, "", err
+	}
+	source := ""
+	if len(result.DetectedLanguage) > 0 {
+		source = result.DetectedLanguage[0].Language
+	}
+	return result.TranslatedText, source, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	TYPING_DEBOUNCE = 3 * time.Second
+	// TYPING_PRUNE_AFTER drops debounce entries of users who stopped typing without saying so
+	TYPING_PRUNE_AFTER = time.Minute
+)
+
+// TypingResponse represents the response for the typing RPC
+type TypingResponse struct {
+	Success bool `json:"success"`
+	// Sent is false when the event was dropped by the debounce
+	Sent  bool   `json:"sent"`
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// typingDebouncer remembers when each user last announced typing in each channel
+type typingDebouncer struct {
+	mu        sync.Mutex
+	last      map[string]time.Time
+	lastPrune time.Time
+}
+
+var typingState = &typingDebouncer{last: map[string]time.Time{}}
+
+// allow reports whether a typing event may be relayed now; a stop event always passes and resets the window
+func (d *typingDebouncer) allow(userID, channelID string, typing bool, now time.Time) bool {
+	key := userID + "|" + channelID
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastPrune) > TYPING_PRUNE_AFTER {
+		for k, t := range d.last {
+			if now.Sub(t) > TYPING_PRUNE_AFTER {
+				delete(d.last, k)
+			}
+		}
+		d.lastPrune = now
+	}
+
+	if !typing {
+		delete(d.last, key)
+		return true
+	}
+	if last, ok := d.last[key]; ok && now.Sub(last) < TYPING_DEBOUNCE {
+		return false
+	}
+	d.last[key] = now
+	return true
+}
+
+// RpcTyping relays "user is typing" to the other members of a channel, at most once per user and channel every 3 seconds
+func RpcTyping(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(TypingResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		ChannelID string `json:"channelId"`
+		Typing    *bool  `json:"typing"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(TypingResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.ChannelID == "" {
+		return marshalResponse(TypingResponse{Success: false, Error: "Missing required field: channelId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	typing := request.Typing == nil || *request.Typing
+
+	now := time.Now()
+	if !typingState.allow(userID, request.ChannelID, typing, now) {
+		return marshalResponse(TypingResponse{Success: true, Sent: false})
+	}
+
+	member, err := isChannelMember(ctx, nk, request.ChannelID, userID)
+	if err != nil {
+		return marshalResponse(TypingResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if !member {
+		return marshalResponse(TypingResponse{Success: false, Error: "Not a member of this channel", Code: ERROR_CODE_NOT_A_MEMBER})
+	}
+
+	eventType := "typing_started"
+	if !typing {
+		eventType = "typing_stopped"
+	}
+	event := &ChannelEvent{
+		Type:      eventType,
+		ChannelID: request.ChannelID,
+		SenderID:  userID,
+		Username:  usernameFromContext(ctx),
+		CreatedAt: now.Unix(),
+	}
+	if err := sendChannelEvent(nk, event); err != nil {
+		return marshalResponse(TypingResponse{Success: false, Error: fmt.Sprintf("Failed to send typing event: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	return marshalResponse(TypingResponse{Success: true, Sent: true})
+}
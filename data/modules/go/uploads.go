@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	PENDING_UPLOAD_COLLECTION = "pending_uploads"
+	UPLOAD_URL_EXPIRY         = 15 * time.Minute
+	UPLOAD_DEFAULT_MAX_BYTES  = 20 * 1024 * 1024
+	// INLINE_UPLOAD_DEFAULT_MAX_BYTES matches Nakama's default max_request_size_bytes
+	INLINE_UPLOAD_DEFAULT_MAX_BYTES = 256 * 1024
+	UPLOAD_MAX_FILE_NAME            = 100
+	// UPLOAD_DEFAULT_MAX_CONCURRENT bounds the inline uploads processed at once, each holds its payload in memory
+	UPLOAD_DEFAULT_MAX_CONCURRENT = 8
+	// UPLOAD_SLOT_WAIT is how long an inline upload waits for a free slot before it is turned away
+	UPLOAD_SLOT_WAIT = 10 * time.Second
+)
+
+// ALLOWED_UPLOAD_CONTENT_TYPES lists the content types accepted for direct uploads
+var ALLOWED_UPLOAD_CONTENT_TYPES = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"video/mp4":  true,
+	"video/webm": true,
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// PendingUpload tracks a presigned PUT until the client confirms it
+type PendingUpload struct {
+	UploadID     string `json:"uploadId"`
+	ObjectKey    string `json:"objectKey"`
+	ContentType  string `json:"contentType"`
+	ExpectedSize int64  `json:"expectedSize"`
+	ChannelID    string `json:"channelId,omitempty"`
+	CreatedAt    int64  `json:"createdAt"`
+	ExpiresAt    int64  `json:"expiresAt"`
+	// Envelope is set when the client uploads ciphertext, see KeyEnvelope
+	Envelope *KeyEnvelope `json:"envelope,omitempty"`
+}
+
+// UploadURLResponse represents the response for request_upload_url
+type UploadURLResponse struct {
+	Success   bool              `json:"success"`
+	UploadID  string            `json:"uploadId,omitempty"`
+	UploadURL string            `json:"uploadUrl,omitempty"`
+	ObjectKey string            `json:"objectKey,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	ExpiresAt int64             `json:"expiresAt,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Code      string            `json:"code,omitempty"`
+}
+
+// UPLOAD_EXTENSIONS are the extensions objects of each accepted content type are stored with
+var UPLOAD_EXTENSIONS = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+}
+
+// uploadObjectKey names an upload after its owner, the upload time and the file name. The extension follows
+// the content type rather than the client, since bucketForKey routes videos by it.
+func uploadObjectKey(userID string, at time.Time, fileName, contentType string) string {
+	name := sanitizeFileName(fileName)
+	current := path.Ext(name)
+	if ext, ok := UPLOAD_EXTENSIONS[contentType]; ok && !strings.EqualFold(current, ext) {
+		name = sanitizeFileName(strings.TrimSuffix(name, current) + ext)
+	} else if !ok && VIDEO_EXTENSIONS[strings.ToLower(current)] {
+		name = sanitizeFileName(strings.TrimSuffix(name, current))
+	}
+	return fmt.Sprintf("%s/%d_%s", userID, at.UnixMilli(), name)
+}
+
+// sanitizeFileName reduces a client supplied file name to a safe object key component
+func sanitizeFileName(name string) string {
+	name = unsafeFileNameChars.ReplaceAllString(path.Base(name), "_")
+	if len(name) > UPLOAD_MAX_FILE_NAME {
+		name = name[len(name)-UPLOAD_MAX_FILE_NAME:]
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "file"
+	}
+	return name
+}
+
+// uploadMaxBytesFor is the size limit for a content type, videos and images having their own
+func (c *Config) uploadMaxBytesFor(contentType string) int64 {
+	if isVideoContentType(contentType) {
+		return c.VideoMaxBytes
+	}
+	if isImageContentType(contentType) {
+		return c.ImageMaxBytes
+	}
+	return c.UploadMaxBytes
+}
+
+// acquireUploadSlot waits for a free upload slot, for at most UPLOAD_SLOT_WAIT. Call the returned func to release it.
+func (s *Services) acquireUploadSlot(ctx context.Context) (func(), error) {
+	wait := time.NewTimer(UPLOAD_SLOT_WAIT)
+	defer wait.Stop()
+	select {
+	case s.UploadSlots <- struct{}{}:
+		return func() { <-s.UploadSlots }, nil
+	case <-wait.C:
+		return nil, errorWithCode(ERROR_CODE_BUSY, "Server busy, too many uploads in progress")
+	case <-ctx.Done():
+		return nil, errorWithCode(ERROR_CODE_BUSY, "Server busy, upload cancelled while waiting: %v", ctx.Err())
+	}
+}
+
+// base64Source decodes an inline upload while it is read, so the decoded image is never held in memory.
+// Seeking back to the start restarts decoding, which lets storage retries replay the upload.
+type base64Source struct {
+	encoded string
+	reader  io.Reader
+	// err is the decoding error hit by the last pass, storage errors otherwise hide it
+	err error
+}
+
+func newBase64Source(encoded string) *base64Source {
+	s := &base64Source{encoded: encoded}
+	s.Seek(0, io.SeekStart)
+	return s
+}
+
+func (s *base64Source) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+func (s *base64Source) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, fmt.Errorf("base64 source can only seek to the start")
+	}
+	s.reader = base64.NewDecoder(base64.StdEncoding, strings.NewReader(s.encoded))
+	s.err = nil
+	return 0, nil
+}
+
+// Size is the exact decoded size, or -1 when line breaks in the payload make it unknown until decoded
+func (s *base64Source) Size() int64 {
+	n := len(s.encoded)
+	if n%4 != 0 || strings.ContainsAny(s.encoded, "\r\n") {
+		return -1
+	}
+	size := int64(n / 4 * 3)
+	if strings.HasSuffix(s.encoded, "==") {
+		size -= 2
+	} else if strings.HasSuffix(s.encoded, "=") {
+		size--
+	}
+	return size
+}
+
+// RpcRequestUploadURL issues a presigned PUT URL so clients can upload large files straight to storage
+func (s *Services) RpcRequestUploadURL(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(UploadURLResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		FileName    string `json:"fileName"`
+		ContentType string `json:"contentType"`
+		Size        int64  `json:"size"`
+		ChannelID   string `json:"channelId"`
+		// Envelope marks the file as ciphertext; fileName and contentType are then ignored
+		Envelope *KeyEnvelope `json:"envelope"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(UploadURLResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Envelope != nil {
+		if err := checkEncryptedUpload(ctx, nk, userID, request.ChannelID, request.Envelope); err != nil {
+			return marshalResponse(UploadURLResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		request.FileName = ENCRYPTED_FILE_EXT
+		request.ContentType = ENCRYPTED_CONTENT_TYPE
+	}
+	if request.FileName == "" || request.ContentType == "" || request.Size <= 0 {
+		return marshalResponse(UploadURLResponse{Success: false, Error: "Missing required fields: fileName, contentType, or size", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if !ALLOWED_UPLOAD_CONTENT_TYPES[request.ContentType] && request.Envelope == nil {
+		return marshalResponse(UploadURLResponse{Success: false, Error: fmt.Sprintf("Unsupported content type: %s", request.ContentType), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if maxBytes := s.Config.uploadMaxBytesFor(request.ContentType); request.Size > maxBytes {
+		return marshalResponse(UploadURLResponse{Success: false, Error: fmt.Sprintf("File exceeds the maximum size of %d bytes", maxBytes), Code: ERROR_CODE_PAYLOAD_TOO_LARGE})
+	}
+	if err := s.reserveUploadQuota(ctx, nk, userID, request.Size); err != nil {
+		return marshalResponse(UploadURLResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return marshalResponse(UploadURLResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	now := s.Clock.Now()
+	objectKey := uploadObjectKey(userID, now, request.FileName, request.ContentType)
+	if request.Envelope != nil {
+		objectKey = encryptedObjectKey(userID, now)
+	}
+	if err := backend.EnsureBucket(ctx, logger, s.Config.bucketForKey(objectKey)); err != nil {
+		return marshalResponse(UploadURLResponse{Success: false, Error: fmt.Sprintf("Failed to ensure bucket exists: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	pending := PendingUpload{
+		UploadID:     uuid.New().String(),
+		ObjectKey:    objectKey,
+		ContentType:  request.ContentType,
+		ExpectedSize: request.Size,
+		ChannelID:    request.ChannelID,
+		CreatedAt:    now.Unix(),
+		ExpiresAt:    now.Add(UPLOAD_URL_EXPIRY).Unix(),
+		Envelope:     request.Envelope,
+	}
+
+	uploadURL, err := backend.PresignPut(ctx, s.Config.bucketForKey(pending.ObjectKey), pending.ObjectKey, UPLOAD_URL_EXPIRY)
+	if err != nil {
+		return marshalResponse(UploadURLResponse{Success: false, Error: fmt.Sprintf("Failed to generate upload URL: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	value, _ := json.Marshal(pending)
+	if _, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{{
+		Collection:      PENDING_UPLOAD_COLLECTION,
+		Key:             pending.UploadID,
+		UserID:          userID,
+		Value:           string(value),
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}}); err != nil {
+		return marshalResponse(UploadURLResponse{Success: false, Error: fmt.Sprintf("Failed to record pending upload: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	logger.Info("Issued upload URL for %s (%d bytes)", pending.ObjectKey, request.Size)
+	return marshalResponse(UploadURLResponse{
+		Success:   true,
+		UploadID:  pending.UploadID,
+		UploadURL: uploadURL,
+		ObjectKey: pending.ObjectKey,
+		Headers:   map[string]string{"Content-Type": pending.ContentType},
+		ExpiresAt: pending.ExpiresAt,
+	})
+}
+
+// verifyPendingUpload loads a pending upload and checks its object reached storage with the declared size.
+// Rejected objects are removed from storage together with their pending record.
+func (s *Services) verifyPendingUpload(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, userID, uploadID string) (*PendingUpload, *StoredObject, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{
+		Collection: PENDING_UPLOAD_COLLECTION,
+		Key:        uploadID,
+		UserID:     userID,
+	}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read pending upload: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, nil, errorWithCode(ERROR_CODE_NOT_FOUND, "Upload not found")
+	}
+	var pending PendingUpload
+	if err := json.Unmarshal([]byte(objects[0].Value), &pending); err != nil {
+		return nil, nil, fmt.Errorf("Failed to decode pending upload: %v", err)
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return nil, nil, errorWithCode(ERROR_CODE_STORAGE_UNAVAILABLE, "Failed to initialize storage backend: %v", err)
+	}
+
+	info, err := backend.StatObject(ctx, s.Config.bucketForKey(pending.ObjectKey), pending.ObjectKey)
+	if err != nil {
+		return nil, nil, errorWithCode(ERROR_CODE_NOT_FOUND, "Object not found in storage, upload the file to uploadUrl first")
+	}
+
+	// Reject anything that does not match what was requested, and drop it from storage
+	if info.Size > s.Config.uploadMaxBytesFor(pending.ContentType) || info.Size != pending.ExpectedSize {
+		s.rejectPendingUpload(ctx, logger, nk, userID, &pending)
+		return nil, nil, errorWithCode(ERROR_CODE_REJECTED, "Uploaded size %d does not match declared size %d", info.Size, pending.ExpectedSize)
+	}
+	if err := s.scanStoredUpload(ctx, logger, nk, userID, &pending, info); err != nil {
+		return nil, nil, err
+	}
+	return &pending, info, nil
+}
+
+// rejectPendingUpload removes an unacceptable upload from storage and forgets its pending record
+func (s *Services) rejectPendingUpload(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, userID string, pending *PendingUpload) {
+	if backend, err := s.Storage.Backend(logger); err != nil {
+		logger.Warn("Failed to remove rejected upload %s: %v", pending.ObjectKey, err)
+	} else if err := backend.RemoveObject(ctx, s.Config.bucketForKey(pending.ObjectKey), pending.ObjectKey); err != nil {
+		logger.Warn("Failed to remove rejected upload %s: %v", pending.ObjectKey, err)
+	}
+	_ = nk.StorageDelete(ctx, []*nkruntime.StorageDelete{{Collection: PENDING_UPLOAD_COLLECTION, Key: pending.UploadID, UserID: userID}})
+}
+
+// recordUpload stores the attachment record and drops the pending record in one transaction
+func recordUpload(ctx context.Context, nk nkruntime.NakamaModule, pending *PendingUpload, attachment *Attachment) error {
+	_, _, err := nk.MultiUpdate(ctx, nil, []*nkruntime.StorageWrite{attachmentWrite(attachment, "")}, []*nkruntime.StorageDelete{{
+		Collection: PENDING_UPLOAD_COLLECTION,
+		Key:        pending.UploadID,
+		UserID:     attachment.OwnerID,
+	}}, nil, false)
+	if err != nil {
+		return err
+	}
+	countUpload(nk, attachment)
+	publishUpload(attachment)
+	return nil
+}
+
+// pendingAttachment builds the attachment record for a verified presigned upload
+func (s *Services) pendingAttachment(userID string, pending *PendingUpload, info *StoredObject) *Attachment {
+	return &Attachment{
+		OwnerID:     userID,
+		ObjectKey:   pending.ObjectKey,
+		Bucket:      s.Config.bucketForKey(pending.ObjectKey),
+		ContentType: pending.ContentType,
+		Size:        info.Size,
+		ETag:        info.ETag,
+		ChannelID:   pending.ChannelID,
+		CreatedAt:   s.Clock.Now().Unix(),
+		Envelope:    pending.Envelope,
+	}
+}
+
+// RpcConfirmUpload verifies a presigned upload reached storage and records its metadata
+func (s *Services) RpcConfirmUpload(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UploadID == "" {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: "Missing required field: uploadId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	pending, info, err := s.verifyPendingUpload(ctx, logger, nk, userID, request.UploadID)
+	if err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if isVideoContentType(pending.ContentType) {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: "Video uploads must be confirmed with upload_video", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if pending.Envelope != nil {
+		return s.confirmEncryptedUpload(ctx, logger, nk, userID, pending, info)
+	}
+	if err := s.validateStoredImage(ctx, logger, nk, userID, pending, info); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	thumbnails, info, err := s.processUploadedImage(ctx, logger, nk, userID, pending, info)
+	if err != nil {
+		if code := moderationErrorCode(err); code != "" {
+			return marshalResponse(ImageUploadResponse{Success: false, Error: err.Error(), Code: code})
+		}
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Image processing failed: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	attachment := s.pendingAttachment(userID, pending, info)
+	if len(thumbnails) > 0 {
+		attachment.Metadata = map[string]interface{}{"thumbnails": thumbnails}
+	}
+	if err := recordUpload(ctx, nk, pending, attachment); err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to record upload: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	// Generate presigned URL (expires in 7 days by default)
+	issued, err := s.presignImageURL(ctx, logger, nk, pending.ObjectKey)
+	if err != nil {
+		return marshalResponse(ImageUploadResponse{Success: false, Error: fmt.Sprintf("Failed to generate presigned URL: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	logger.Info("Confirmed upload %s (%d bytes)", pending.ObjectKey, info.Size)
+	return marshalResponse(ImageUploadResponse{
+		Success:    true,
+		ImageURL:   issued.URL,
+		ObjectKey:  pending.ObjectKey,
+		Thumbnails: thumbnails,
+		Metadata:   map[string]interface{}{"size": info.Size, "contentType": pending.ContentType},
+		ExpiresAt:  issued.ExpiresAt,
+	})
+}
+
+// processUploadedImage runs the exif_strip, moderation and thumbnails stages of the channel's pipeline over a
+// presigned upload. Presigned uploads reach storage before the server sees them, so a stripped copy is written
+// over the original and flagged uploads are moved to quarantine (returning a *ModerationError).
+// Returns the thumbnail keys and the object as now stored; thumbnails are best effort, the rest is not.
+func (s *Services) processUploadedImage(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, userID string, pending *PendingUpload, info *StoredObject) (map[string]string, *StoredObject, error) {
+	stages := imagePipelineFor(channelTypeOf(pending.ChannelID))
+	exifStage, moderationStage, thumbnailStage := pipelineStage(stages, "exif_strip"), pipelineStage(stages, "moderation"), pipelineStage(stages, "thumbnails")
+	if exifStage == nil && moderationStage == nil && thumbnailStage == nil {
+		return nil, info, nil
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return nil, info, err
+	}
+	object, err := backend.GetObject(ctx, s.Config.bucketForKey(pending.ObjectKey), pending.ObjectKey)
+	if err != nil {
+		return nil, info, err
+	}
+	defer object.Close()
+	data, err := io.ReadAll(io.LimitReader(object, s.Config.uploadMaxBytesFor(pending.ContentType)))
+	if err != nil {
+		return nil, info, err
+	}
+
+	asset := newImageAsset(data, pending.ContentType)
+	asset.ChannelID = pending.ChannelID
+	asset.ChannelType = channelTypeOf(pending.ChannelID)
+
+	if exifStage != nil {
+		if err := exifStage.Process(ctx, logger, asset); err != nil {
+			return nil, info, err
+		}
+		if err := asset.Flush(); err != nil {
+			return nil, info, err
+		}
+	}
+
+	if moderationStage != nil {
+		if err := moderationStage.Process(ctx, logger, asset); err != nil {
+			return nil, info, err
+		}
+		if asset.isFlagged() {
+			if err := asset.Flush(); err != nil {
+				return nil, info, err
+			}
+			err := s.quarantineUpload(ctx, logger, nk, userID, pending.ObjectKey, pending.ChannelID, asset)
+			if _, ok := err.(*ModerationError); ok {
+				s.rejectPendingUpload(ctx, logger, nk, userID, pending)
+			}
+			return nil, info, err
+		}
+	}
+
+	// Only write the stripped copy once the upload is known to be kept
+	if exifStage != nil {
+		if !bytes.Equal(asset.Data, data) {
+			if err := backend.PutObject(ctx, s.Config.bucketForKey(pending.ObjectKey), pending.ObjectKey, bytes.NewReader(asset.Data), int64(len(asset.Data)), asset.ContentType); err != nil {
+				return nil, info, fmt.Errorf("failed to store stripped image: %v", err)
+			}
+			if stripped, err := backend.StatObject(ctx, s.Config.bucketForKey(pending.ObjectKey), pending.ObjectKey); err == nil {
+				info = stripped
+			}
+		}
+	}
+
+	if thumbnailStage == nil {
+		return nil, info, nil
+	}
+	if err := thumbnailStage.Process(ctx, logger, asset); err != nil {
+		logger.Warn("Failed to generate thumbnails for %s: %v", pending.ObjectKey, err)
+		return nil, info, nil
+	}
+	thumbnails, err := s.storeDerivatives(ctx, logger, pending.ObjectKey, asset)
+	if err != nil {
+		logger.Warn("Failed to store thumbnails for %s: %v", pending.ObjectKey, err)
+	}
+	return thumbnails, info, nil
+}
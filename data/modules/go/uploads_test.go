@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRpcConfirmUpload(t *testing.T) {
+	image := testPNG(t)
+	tests := []struct {
+		name string
+		// upload is what the client PUTs to the presigned URL, nil when it never uploads
+		upload []byte
+		setup  func(t *testing.T, h *testHarness)
+		code   string
+		// kept is whether the object is still in storage afterwards, and recorded whether it has an attachment record
+		kept     bool
+		recorded bool
+	}{
+		{name: "ok", upload: image, kept: true, recorded: true},
+		{name: "not uploaded", code: ERROR_CODE_NOT_FOUND},
+		{name: "size mismatch", upload: append(append([]byte{}, image...), 0), code: ERROR_CODE_REJECTED},
+		{
+			name:   "storage unavailable",
+			upload: image,
+			setup: func(t *testing.T, h *testHarness) {
+				h.services.Storage = fixedStorage{err: errors.New("no credentials")}
+			},
+			code: ERROR_CODE_STORAGE_UNAVAILABLE,
+			kept: true,
+		},
+		{
+			name:   "presign fails",
+			upload: image,
+			setup:  func(t *testing.T, h *testHarness) { h.s3.failures["PresignGet"] = errors.New("clock skew") },
+			code:   ERROR_CODE_STORAGE_UNAVAILABLE,
+			// The URL is presigned after the upload is recorded, so a retry finds it
+			kept:     true,
+			recorded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHarness(t, nil)
+			requested := h.call(t, h.services.RpcRequestUploadURL, testOwnerID,
+				fmt.Sprintf(`{"fileName":"photo.png","contentType":"image/png","size":%d}`, len(image)))
+			var issued UploadURLResponse
+			if err := json.Unmarshal([]byte(requested), &issued); err != nil || !issued.Success {
+				t.Fatalf("request_upload_url failed: %s", requested)
+			}
+			if want := uploadObjectKey(testOwnerID, testNow, "photo.png", "image/png"); issued.ObjectKey != want {
+				t.Fatalf("objectKey = %s, want %s", issued.ObjectKey, want)
+			}
+			if tt.upload != nil {
+				h.s3.seed(t, h.services.Config.Bucket, issued.ObjectKey, tt.upload)
+			}
+			if tt.setup != nil {
+				tt.setup(t, h)
+			}
+			h.clock.Advance(time.Minute)
+
+			out := h.call(t, h.services.RpcConfirmUpload, testOwnerID, `{"uploadId":"`+issued.UploadID+`"}`)
+			if success, code := decodeResponse(t, out); success != (tt.code == "") || code != tt.code {
+				t.Fatalf("success = %v, code = %q, want code %q: %s", success, code, tt.code, out)
+			}
+			if kept := h.s3.object(h.services.Config.Bucket, issued.ObjectKey) != nil; kept != tt.kept {
+				t.Errorf("object kept = %v, want %v", kept, tt.kept)
+			}
+			attachment := h.nk.attachment(t, testOwnerID, issued.ObjectKey)
+			if !tt.recorded {
+				if attachment != nil {
+					t.Errorf("attachment was recorded: %+v", attachment)
+				}
+				return
+			}
+			if attachment == nil || attachment.CreatedAt != h.clock.Now().Unix() || !bytes.Equal(h.s3.object(attachment.Bucket, attachment.ObjectKey), image) {
+				t.Errorf("attachment = %+v, want one created at %d", attachment, h.clock.Now().Unix())
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	IMAGE_URL_COLLECTION           = "image_urls"
+	IMAGE_URL_DEFAULT_EXPIRY_HOURS = 7 * 24
+	// IMAGE_URL_CACHE_SIZE bounds the in-memory cache; the storage copy is shared by every node
+	IMAGE_URL_CACHE_SIZE = 10000
+	IMAGE_URL_BATCH_MAX  = 100
+)
+
+// IssuedURL is a presigned URL together with the time it stops working
+type IssuedURL struct {
+	URL       string `json:"url"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// ImageURLsResponse represents the response for refresh_image_urls
+type ImageURLsResponse struct {
+	Success bool                  `json:"success"`
+	URLs    map[string]*IssuedURL `json:"urls,omitempty"`
+	// Errors explains, per object key, why no URL was issued
+	Errors map[string]string `json:"errors,omitempty"`
+	// Envelopes holds the key envelopes of encrypted images, for the uploader and channel members
+	Envelopes map[string]*KeyEnvelope `json:"envelopes,omitempty"`
+	Error     string                  `json:"error,omitempty"`
+	Code      string                  `json:"code,omitempty"`
+}
+
+// cachedImageURL is the stored form of an issued URL; storage keys are hashes, so it names its object
+type cachedImageURL struct {
+	ObjectKey string `json:"objectKey"`
+	IssuedURL
+}
+
+// imageURLCache keeps issued URLs in memory by object key
+type imageURLCache struct {
+	mu      sync.Mutex
+	entries map[string]*IssuedURL
+}
+
+var imageURLs = &imageURLCache{entries: map[string]*IssuedURL{}}
+
+// imageURLExpiry is how long media URLs stay valid, IMAGE_URL_EXPIRY_HOURS (7 days by default, 1 hour in private mode)
+func (c *Config) imageURLExpiry() time.Duration {
+	return time.Duration(c.ImageURLExpiryHours) * time.Hour
+}
+
+func imageURLExpiry() time.Duration {
+	return serverConfig.imageURLExpiry()
+}
+
+// isFreshURL reports whether a cached URL has at least half its lifetime left at now, so clients
+// always get a URL that lasts a while rather than one that is about to expire
+func isFreshURL(issued *IssuedURL, now time.Time, expiry time.Duration) bool {
+	return issued != nil && time.Unix(issued.ExpiresAt, 0).Sub(now) > expiry/2
+}
+
+func (c *imageURLCache) get(objectKey string, now time.Time, expiry time.Duration) *IssuedURL {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	issued := c.entries[objectKey]
+	if !isFreshURL(issued, now, expiry) {
+		delete(c.entries, objectKey)
+		return nil
+	}
+	return issued
+}
+
+func (c *imageURLCache) put(objectKey string, issued *IssuedURL, now time.Time, expiry time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= IMAGE_URL_CACHE_SIZE {
+		// Drop stale entries first, and everything if that is not enough
+		for key, entry := range c.entries {
+			if !isFreshURL(entry, now, expiry) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= IMAGE_URL_CACHE_SIZE {
+			c.entries = map[string]*IssuedURL{}
+		}
+	}
+	c.entries[objectKey] = issued
+}
+
+func (c *imageURLCache) forget(objectKeys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range objectKeys {
+		delete(c.entries, key)
+	}
+}
+
+// presignImageURLs returns URLs for objects in the image bucket, reusing ones issued earlier while they are fresh
+func (s *Services) presignImageURLs(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, objectKeys []string) (map[string]*IssuedURL, error) {
+	now, expiry := s.Clock.Now(), s.Config.imageURLExpiry()
+	urls := make(map[string]*IssuedURL, len(objectKeys))
+	var reads []*nkruntime.StorageRead
+	for _, key := range objectKeys {
+		if issued := imageURLs.get(key, now, expiry); issued != nil {
+			urls[key] = issued
+			continue
+		}
+		reads = append(reads, &nkruntime.StorageRead{Collection: IMAGE_URL_COLLECTION, Key: hashedStorageKey(key)})
+	}
+	if len(reads) == 0 {
+		return urls, nil
+	}
+
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		logger.Warn("Failed to read cached image URLs: %v", err)
+	}
+	for _, object := range objects {
+		var cached cachedImageURL
+		if err := json.Unmarshal([]byte(object.Value), &cached); err == nil && isFreshURL(&cached.IssuedURL, now, expiry) {
+			urls[cached.ObjectKey] = &cached.IssuedURL
+			imageURLs.put(cached.ObjectKey, &cached.IssuedURL, now, expiry)
+		}
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize storage backend: %v", err)
+	}
+	var writes []*nkruntime.StorageWrite
+	for _, key := range objectKeys {
+		if urls[key] != nil {
+			continue
+		}
+		url, err := backend.PresignGet(ctx, s.Config.bucketForKey(key), key, expiry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate presigned URL: %v", err)
+		}
+		issued := &IssuedURL{URL: url, ExpiresAt: now.Add(expiry).Unix()}
+		urls[key] = issued
+		imageURLs.put(key, issued, now, expiry)
+
+		value, _ := json.Marshal(cachedImageURL{ObjectKey: key, IssuedURL: *issued})
+		writes = append(writes, &nkruntime.StorageWrite{
+			Collection:      IMAGE_URL_COLLECTION,
+			Key:             hashedStorageKey(key),
+			Value:           string(value),
+			PermissionRead:  0,
+			PermissionWrite: 0,
+		})
+	}
+	if len(writes) > 0 {
+		if _, err := nk.StorageWrite(ctx, writes); err != nil {
+			logger.Warn("Failed to cache image URLs: %v", err)
+		}
+	}
+	return urls, nil
+}
+
+// presignImageURL returns the URL of a single object in the image bucket
+func (s *Services) presignImageURL(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, objectKey string) (*IssuedURL, error) {
+	urls, err := s.presignImageURLs(ctx, logger, nk, []string{objectKey})
+	if err != nil {
+		return nil, err
+	}
+	return urls[objectKey], nil
+}
+
+// forgetImageURLs stops handing out cached URLs for objects that were deleted
+func forgetImageURLs(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, objectKeys ...string) {
+	if len(objectKeys) == 0 {
+		return
+	}
+	imageURLs.forget(objectKeys...)
+	deletes := make([]*nkruntime.StorageDelete, 0, len(objectKeys))
+	for _, key := range objectKeys {
+		deletes = append(deletes, &nkruntime.StorageDelete{Collection: IMAGE_URL_COLLECTION, Key: hashedStorageKey(key)})
+	}
+	if err := nk.StorageDelete(ctx, deletes); err != nil {
+		logger.Warn("Failed to forget cached image URLs: %v", err)
+	}
+}
+
+// deletedObjectKeys reports which of the given object keys have been tombstoned by delete_image, in one storage read
+func deletedObjectKeys(ctx context.Context, nk nkruntime.NakamaModule, objectKeys []string) (map[string]bool, error) {
+	var reads []*nkruntime.StorageRead
+	for _, key := range objectKeys {
+		ownerID := objectOwner(key)
+		if ownerID == "" || isDerivativeKey(key) {
+			continue
+		}
+		reads = append(reads, &nkruntime.StorageRead{Collection: ATTACHMENT_COLLECTION, Key: attachmentKey(key), UserID: ownerID})
+	}
+	deleted := map[string]bool{}
+	if len(reads) == 0 {
+		return deleted, nil
+	}
+	objects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		var attachment Attachment
+		if err := json.Unmarshal([]byte(object.Value), &attachment); err == nil && attachment.DeletedAt != 0 {
+			deleted[attachment.ObjectKey] = true
+		}
+	}
+	return deleted, nil
+}
+
+// issueImageURLs returns URLs for the images the caller may see and, per object key, why the others got none
+func (s *Services) issueImageURLs(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, objectKeys []string) (map[string]*IssuedURL, map[string]string, error) {
+	deleted, err := deletedObjectKeys(ctx, nk, objectKeys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to check images: %v", err)
+	}
+
+	failures := map[string]string{}
+	allowed := make([]string, 0, len(objectKeys))
+	for _, key := range objectKeys {
+		switch {
+		case key == "":
+			continue
+		// Quarantined images are only reachable through list_flagged_uploads
+		case strings.HasPrefix(key, QUARANTINE_PREFIX) && !isAdmin(ctx):
+			failures[key] = "Permission denied"
+		case deleted[key]:
+			failures[key] = "Image has been deleted"
+		default:
+			ok, err := canAccessObject(ctx, db, nk, userIDFromContext(ctx), key)
+			if err != nil {
+				failures[key] = fmt.Sprintf("Failed to check image: %v", err)
+			} else if !ok {
+				failures[key] = "Permission denied"
+			} else {
+				allowed = append(allowed, key)
+			}
+		}
+	}
+
+	if _, err := s.Storage.Backend(logger); err != nil {
+		return nil, nil, errorWithCode(ERROR_CODE_STORAGE_UNAVAILABLE, "Failed to initialize storage backend: %v", err)
+	}
+	urls, err := s.presignImageURLs(ctx, logger, nk, allowed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return urls, failures, nil
+}
+
+// imageURLsResponse answers a batch of object keys with a URL or the reason for refusing it per key, and the
+// envelopes of the encrypted ones. Duplicate keys are answered once.
+func (s *Services) imageURLsResponse(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, objectKeys []string) (string, error) {
+	if len(objectKeys) == 0 {
+		return marshalResponse(ImageURLsResponse{Success: false, Error: "Missing required field: objectKeys", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if len(objectKeys) > IMAGE_URL_BATCH_MAX {
+		return marshalResponse(ImageURLsResponse{Success: false, Error: fmt.Sprintf("At most %d objectKeys per request", IMAGE_URL_BATCH_MAX), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	unique := make([]string, 0, len(objectKeys))
+	seen := map[string]bool{}
+	for _, key := range objectKeys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+
+	urls, failures, err := s.issueImageURLs(ctx, logger, db, nk, unique)
+	if err != nil {
+		return marshalResponse(ImageURLsResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	envelopes := map[string]*KeyEnvelope{}
+	for key := range urls {
+		envelope, _, err := attachmentEnvelope(ctx, db, nk, userIDFromContext(ctx), key)
+		if err != nil {
+			delete(urls, key)
+			failures[key] = fmt.Sprintf("Failed to check image: %v", err)
+		} else if envelope != nil {
+			envelopes[key] = envelope
+		}
+	}
+	return marshalResponse(ImageURLsResponse{Success: true, URLs: urls, Errors: failures, Envelopes: envelopes})
+}
+
+// RpcRefreshImageUrls issues URLs for up to 100 images at once, for clients whose cached URLs are expiring
+func (s *Services) RpcRefreshImageUrls(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	var request struct {
+		ObjectKeys []string `json:"objectKeys"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ImageURLsResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	return s.imageURLsResponse(ctx, logger, db, nk, request.ObjectKeys)
+}
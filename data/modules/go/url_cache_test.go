@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsFreshURL(t *testing.T) {
+	now := time.Unix(1710072000, 0)
+	expiry := 2 * time.Hour
+	tests := []struct {
+		name   string
+		issued *IssuedURL
+		want   bool
+	}{
+		{"none", nil, false},
+		{"just issued", &IssuedURL{ExpiresAt: now.Add(expiry).Unix()}, true},
+		{"over half left", &IssuedURL{ExpiresAt: now.Add(expiry/2 + time.Second).Unix()}, true},
+		{"exactly half left", &IssuedURL{ExpiresAt: now.Add(expiry / 2).Unix()}, false},
+		{"expired", &IssuedURL{ExpiresAt: now.Add(-time.Second).Unix()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isFreshURL(tt.issued, now, expiry); got != tt.want {
+				t.Errorf("isFreshURL = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	IMAGE_DEFAULT_MAX_INPUT_DIMENSION = 8192
+	// IMAGE_SNIFF_BYTES is how much of a file http.DetectContentType looks at
+	IMAGE_SNIFF_BYTES = 512
+)
+
+// ALLOWED_IMAGE_CONTENT_TYPES lists the image types accepted by upload_image and confirm_upload
+var ALLOWED_IMAGE_CONTENT_TYPES = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// imageMaxBytes is the largest image accepted, defaulting to UPLOAD_MAX_BYTES
+func imageMaxBytes() int64 {
+	return serverConfig.ImageMaxBytes
+}
+
+// imageMaxInputDimension is the largest width or height accepted before any resizing
+func imageMaxInputDimension() int {
+	return serverConfig.ImageMaxInputDimension
+}
+
+// isImageContentType reports whether a content type is one of the accepted image types
+func isImageContentType(contentType string) bool {
+	return ALLOWED_IMAGE_CONTENT_TYPES[normalizeImageContentType(contentType)]
+}
+
+// normalizeImageContentType maps common aliases to the type http.DetectContentType reports
+func normalizeImageContentType(contentType string) string {
+	if contentType == "image/jpg" || contentType == "image/pjpeg" {
+		return "image/jpeg"
+	}
+	return contentType
+}
+
+// validateImage checks that r holds an image of the declared type within the size and dimension limits.
+// The type is sniffed from the bytes themselves, so a mislabeled file is rejected. Returns the canonical content type.
+func validateImage(r io.Reader, declared string, size int64) (string, error) {
+	contentType := normalizeImageContentType(declared)
+	if !ALLOWED_IMAGE_CONTENT_TYPES[contentType] {
+		return "", errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Unsupported content type: %s", declared)
+	}
+	if maxBytes := imageMaxBytes(); size > maxBytes {
+		return "", errorWithCode(ERROR_CODE_PAYLOAD_TOO_LARGE, "Image exceeds the maximum size of %d bytes", maxBytes)
+	}
+
+	br := bufio.NewReaderSize(r, IMAGE_SNIFF_BYTES)
+	head, _ := br.Peek(IMAGE_SNIFF_BYTES)
+	if sniffed := http.DetectContentType(head); sniffed != contentType {
+		return "", errorWithCode(ERROR_CODE_REJECTED, "File content (%s) does not match content type %s", sniffed, contentType)
+	}
+
+	width, height, err := imageDimensions(br, contentType)
+	if err != nil {
+		return "", errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid image: %v", err)
+	}
+	if maxDimension := imageMaxInputDimension(); width > maxDimension || height > maxDimension {
+		return "", errorWithCode(ERROR_CODE_REJECTED, "Image dimensions %dx%d exceed the maximum of %d pixels", width, height, maxDimension)
+	}
+	return contentType, nil
+}
+
+// validateStoredImage runs validateImage against an object uploaded through a presigned URL.
+// Rejected objects are removed from storage together with their pending record.
+func (s *Services) validateStoredImage(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, userID string, pending *PendingUpload, info *StoredObject) error {
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return errorWithCode(ERROR_CODE_STORAGE_UNAVAILABLE, "Failed to initialize storage backend: %v", err)
+	}
+	object, err := backend.GetObject(ctx, s.Config.bucketForKey(pending.ObjectKey), pending.ObjectKey)
+	if err != nil {
+		return fmt.Errorf("Failed to read upload: %v", err)
+	}
+	defer object.Close()
+
+	if _, err := validateImage(object, pending.ContentType, info.Size); err != nil {
+		logger.Warn("Rejected upload %s: %v", pending.ObjectKey, err)
+		s.rejectPendingUpload(ctx, logger, nk, userID, pending)
+		return err
+	}
+	return nil
+}
+
+// imageDimensions reads the width and height from the image header without decoding the pixels
+func imageDimensions(r io.Reader, contentType string) (int, int, error) {
+	if contentType == "image/webp" {
+		return webpDimensions(r)
+	}
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// webpDimensions parses the canvas size of a WebP file, which the standard library cannot decode.
+// Handles lossy (VP8), lossless (VP8L) and extended (VP8X) files.
+func webpDimensions(r io.Reader) (int, int, error) {
+	header := make([]byte, 30)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, fmt.Errorf("truncated webp header")
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return 0, 0, fmt.Errorf("not a webp")
+	}
+	chunk := header[20:]
+	switch string(header[12:16]) {
+	case "VP8 ":
+		// Key frame start code, then 14 bit width and height
+		if chunk[3] != 0x9D || chunk[4] != 0x01 || chunk[5] != 0x2A {
+			return 0, 0, fmt.Errorf("invalid vp8 frame")
+		}
+		return int(binary.LittleEndian.Uint16(chunk[6:8]) & 0x3FFF), int(binary.LittleEndian.Uint16(chunk[8:10]) & 0x3FFF), nil
+	case "VP8L":
+		if chunk[0] != 0x2F {
+			return 0, 0, fmt.Errorf("invalid vp8l signature")
+		}
+		bits := binary.LittleEndian.Uint32(chunk[1:5])
+		return int(bits&0x3FFF) + 1, int((bits>>14)&0x3FFF) + 1, nil
+	case "VP8X":
+		width := int(chunk[4]) | int(chunk[5])<<8 | int(chunk[6])<<16
+		height := int(chunk[7]) | int(chunk[8])<<8 | int(chunk[9])<<16
+		return width + 1, height + 1, nil
+	}
+	return 0, 0, fmt.Errorf("unknown webp chunk %q", header[12:16])
+}
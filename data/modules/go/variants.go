@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"path"
+	"strings"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	VARIANT_PREFIX                = "variants/"
+	VARIANT_FIT_CONTAIN           = "contain"
+	VARIANT_FIT_COVER             = "cover"
+	VARIANT_DEFAULT_MAX_DIMENSION = 2048
+	// VARIANT_MAX_PER_IMAGE bounds the variants stored for one upload, each distinct request adds one
+	VARIANT_MAX_PER_IMAGE = 32
+)
+
+// VARIANT_FORMATS maps the formats variants can be rendered in to their content type and extension.
+// The standard library has no WebP encoder, so webp is not offered.
+var VARIANT_FORMATS = map[string][2]string{
+	"jpeg": {"image/jpeg", ".jpg"},
+	"png":  {"image/png", ".png"},
+}
+
+// ImageVariantRequest represents the request payload for get_image_variant. Width or height may be 0 to follow
+// the other one; "cover" fills both exactly by cropping, "contain" fits inside them. Format defaults to jpeg for
+// jpeg originals and png for everything else.
+type ImageVariantRequest struct {
+	ObjectKey string `json:"objectKey"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Fit       string `json:"fit"`
+	Format    string `json:"format"`
+}
+
+// ImageVariantResponse represents the response for get_image_variant
+type ImageVariantResponse struct {
+	Success    bool   `json:"success"`
+	ImageURL   string `json:"imageUrl,omitempty"`
+	ObjectKey  string `json:"objectKey,omitempty"`
+	VariantKey string `json:"variantKey,omitempty"`
+	// ExpiresAt is when ImageURL stops working, in Unix seconds
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
+
+// variantSpec names a variant in its key, e.g. "800x0-contain". It must not contain "_", which
+// derivativeAttachment reads as the end of the original's name.
+func (r *ImageVariantRequest) variantSpec() string {
+	return fmt.Sprintf("%dx%d-%s", r.Width, r.Height, r.Fit)
+}
+
+// variantKey places a variant under the variants/ prefix, mirroring the original's key
+func variantKey(objectKey string, request *ImageVariantRequest) string {
+	base := strings.TrimSuffix(objectKey, path.Ext(objectKey))
+	return fmt.Sprintf("%s%s_%s%s", VARIANT_PREFIX, base, request.variantSpec(), VARIANT_FORMATS[request.Format][1])
+}
+
+// validate normalizes a variant request, filling in the defaults
+func (r *ImageVariantRequest) validate() error {
+	if r.ObjectKey == "" {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Missing required field: objectKey")
+	}
+	if isDerivativeKey(r.ObjectKey) || strings.HasPrefix(r.ObjectKey, QUARANTINE_PREFIX) || strings.HasPrefix(r.ObjectKey, AVATAR_PREFIX) {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid objectKey, variants are rendered from uploaded images")
+	}
+	if VIDEO_EXTENSIONS[strings.ToLower(path.Ext(r.ObjectKey))] || strings.HasSuffix(r.ObjectKey, ENCRYPTED_FILE_EXT) {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid objectKey, only images have variants")
+	}
+	maxDimension := serverConfig.ImageVariantMaxDimension
+	if r.Width < 0 || r.Height < 0 || r.Width > maxDimension || r.Height > maxDimension {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Width and height must be between 0 and %d", maxDimension)
+	}
+	if r.Width == 0 && r.Height == 0 {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Missing required field: width or height")
+	}
+	if r.Fit == "" {
+		r.Fit = VARIANT_FIT_CONTAIN
+	}
+	switch r.Fit {
+	case VARIANT_FIT_CONTAIN:
+	case VARIANT_FIT_COVER:
+		if r.Width == 0 || r.Height == 0 {
+			return errorWithCode(ERROR_CODE_REJECTED, "Fit cover needs both width and height")
+		}
+	default:
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid fit: %s", r.Fit)
+	}
+	if r.Format == "" {
+		r.Format = "png"
+		if ext := strings.ToLower(path.Ext(r.ObjectKey)); ext == ".jpg" || ext == ".jpeg" {
+			r.Format = "jpeg"
+		}
+	}
+	if _, ok := VARIANT_FORMATS[r.Format]; !ok {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Unsupported format: %s", r.Format)
+	}
+	return nil
+}
+
+// variantSize returns the size an image of width x height is scaled to before cropping, and the final size.
+// Variants are never larger than the original.
+func variantSize(width, height int, request *ImageVariantRequest) (int, int, int, int) {
+	w, h := float64(width), float64(height)
+	var scale float64
+	switch {
+	case request.Fit == VARIANT_FIT_COVER:
+		scale = math.Max(float64(request.Width)/w, float64(request.Height)/h)
+	case request.Width == 0:
+		scale = float64(request.Height) / h
+	case request.Height == 0:
+		scale = float64(request.Width) / w
+	default:
+		scale = math.Min(float64(request.Width)/w, float64(request.Height)/h)
+	}
+	cropWidth, cropHeight := request.Width, request.Height
+	if scale > 1 {
+		// Shrink the crop with the image so it keeps the requested aspect ratio
+		cropWidth = int(math.Max(1, math.Round(float64(cropWidth)/scale)))
+		cropHeight = int(math.Max(1, math.Round(float64(cropHeight)/scale)))
+		scale = 1
+	}
+	scaledWidth := int(math.Max(1, math.Round(w*scale)))
+	scaledHeight := int(math.Max(1, math.Round(h*scale)))
+	if request.Fit != VARIANT_FIT_COVER {
+		return scaledWidth, scaledHeight, scaledWidth, scaledHeight
+	}
+	return scaledWidth, scaledHeight, int(math.Min(float64(cropWidth), float64(scaledWidth))), int(math.Min(float64(cropHeight), float64(scaledHeight)))
+}
+
+// renderVariant decodes an original and renders the requested variant of it
+func renderVariant(data []byte, request *ImageVariantRequest) ([]byte, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Invalid image: %v", err)
+	}
+	if format == "jpeg" {
+		src = orientImage(src, jpegOrientation(data))
+	}
+
+	b := src.Bounds()
+	scaledWidth, scaledHeight, width, height := variantSize(b.Dx(), b.Dy(), request)
+	var dst image.Image = resizeImage(src, scaledWidth, scaledHeight)
+	if width != scaledWidth || height != scaledHeight {
+		x0, y0 := (scaledWidth-width)/2, (scaledHeight-height)/2
+		dst = dst.(*image.RGBA).SubImage(image.Rect(x0, y0, x0+width, y0+height))
+	}
+
+	var buf bytes.Buffer
+	switch request.Format {
+	case "jpeg":
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: serverConfig.ImageJPEGQuality}); err != nil {
+			return nil, fmt.Errorf("failed to encode jpeg: %v", err)
+		}
+	default:
+		if err := png.Encode(&buf, dst); err != nil {
+			return nil, fmt.Errorf("failed to encode png: %v", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// attachmentVariants returns the variant keys recorded on an attachment by name
+func attachmentVariants(attachment *Attachment) map[string]interface{} {
+	if variants, ok := attachment.Metadata["variants"].(map[string]interface{}); ok {
+		return variants
+	}
+	return map[string]interface{}{}
+}
+
+// recordVariant adds a variant to its attachment, so it is deleted with the image and kept by the orphan GC
+func recordVariant(ctx context.Context, nk nkruntime.NakamaModule, attachment *Attachment, version, name, key string) error {
+	variants := attachmentVariants(attachment)
+	if _, ok := variants[name]; ok {
+		return nil
+	}
+	variants[name] = key
+	if attachment.Metadata == nil {
+		attachment.Metadata = map[string]interface{}{}
+	}
+	attachment.Metadata["variants"] = variants
+	_, err := nk.StorageWrite(ctx, []*nkruntime.StorageWrite{attachmentWrite(attachment, version)})
+	return err
+}
+
+// RpcGetImageVariant returns a URL for a resized, cropped or converted copy of an image. Variants are rendered
+// on first request and stored under variants/, later requests for the same variant reuse the stored copy.
+func (s *Services) RpcGetImageVariant(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	var request ImageVariantRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(ImageVariantResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := request.validate(); err != nil {
+		return marshalResponse(ImageVariantResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	// Variants are visible to whoever may see the original
+	allowed, err := canAccessObject(ctx, db, nk, userIDFromContext(ctx), request.ObjectKey)
+	if err != nil {
+		return marshalResponse(ImageVariantResponse{Success: false, Error: fmt.Sprintf("Failed to check image: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+	if !allowed {
+		return marshalResponse(ImageVariantResponse{Success: false, Error: "Permission denied", Code: ERROR_CODE_PERMISSION_DENIED})
+	}
+	var attachment *Attachment
+	var version string
+	if ownerID := objectOwner(request.ObjectKey); ownerID != "" {
+		if attachment, version, err = readAttachment(ctx, nk, ownerID, request.ObjectKey); err != nil {
+			return marshalResponse(ImageVariantResponse{Success: false, Error: fmt.Sprintf("Failed to check image: %v", err), Code: ERROR_CODE_INTERNAL})
+		}
+	}
+	if attachment != nil {
+		if attachment.DeletedAt != 0 {
+			return marshalResponse(ImageVariantResponse{Success: false, Error: "Image has been deleted", Code: ERROR_CODE_NOT_FOUND})
+		}
+		if attachment.Envelope != nil || !isImageContentType(attachment.ContentType) {
+			return marshalResponse(ImageVariantResponse{Success: false, Error: "Invalid objectKey, only images have variants", Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return marshalResponse(ImageVariantResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	key := variantKey(request.ObjectKey, &request)
+	name := path.Base(key)[strings.LastIndex(path.Base(key), "_")+1:]
+	if _, err := backend.StatObject(ctx, s.Config.bucketForKey(key), key); err != nil {
+		if attachment != nil {
+			if _, ok := attachmentVariants(attachment)[name]; !ok && len(attachmentVariants(attachment)) >= VARIANT_MAX_PER_IMAGE {
+				return marshalResponse(ImageVariantResponse{Success: false, Error: fmt.Sprintf("At most %d variants can be stored per image, reuse an existing size", VARIANT_MAX_PER_IMAGE), Code: ERROR_CODE_PAYLOAD_INVALID})
+			}
+		}
+
+		// Rendering holds the decoded image in memory, so it shares the upload slots
+		release, err := s.acquireUploadSlot(ctx)
+		if err != nil {
+			return marshalResponse(ImageVariantResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		defer release()
+
+		bucket := s.Config.bucketForKey(request.ObjectKey)
+		if attachment != nil {
+			bucket = attachment.BucketOf(request.ObjectKey)
+		}
+		object, err := backend.GetObject(ctx, bucket, request.ObjectKey)
+		if err != nil {
+			return marshalResponse(ImageVariantResponse{Success: false, Error: fmt.Sprintf("Failed to read image: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+		}
+		data, err := io.ReadAll(io.LimitReader(object, s.Config.ImageMaxBytes))
+		object.Close()
+		if err != nil {
+			return marshalResponse(ImageVariantResponse{Success: false, Error: fmt.Sprintf("Failed to read image: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+		}
+		rendered, err := renderVariant(data, &request)
+		if err != nil {
+			return marshalResponse(ImageVariantResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+
+		if err := backend.PutObject(ctx, s.Config.bucketForKey(key), key, bytes.NewReader(rendered), int64(len(rendered)), VARIANT_FORMATS[request.Format][0]); err != nil {
+			return marshalResponse(ImageVariantResponse{Success: false, Error: fmt.Sprintf("Failed to store variant: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+		}
+		if attachment != nil {
+			if err := recordVariant(ctx, nk, attachment, version, name, key); err != nil {
+				// The orphan GC removes the variant later, it is rendered again when asked for
+				logger.Warn("Failed to record variant %s: %v", key, err)
+			}
+		}
+		logger.Info("Rendered variant %s (%d bytes)", key, len(rendered))
+	}
+
+	issued, err := s.presignImageURL(ctx, logger, nk, key)
+	if err != nil {
+		return marshalResponse(ImageVariantResponse{Success: false, Error: fmt.Sprintf("Failed to generate presigned URL: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	return marshalResponse(ImageVariantResponse{
+		Success:    true,
+		ImageURL:   issued.URL,
+		ObjectKey:  request.ObjectKey,
+		VariantKey: key,
+		ExpiresAt:  issued.ExpiresAt,
+	})
+}
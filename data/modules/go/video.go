@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"path"
+	"strings"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	VIDEO_DEFAULT_MAX_BYTES     = 100 * 1024 * 1024
+	VIDEO_DEFAULT_MAX_DURATION  = 120
+	VIDEO_DEFAULT_MAX_DIMENSION = 3840
+	VIDEO_DEFAULT_CODECS        = "h264,hevc,vp8,vp9,av1"
+	VIDEO_POSTER_MAX_DIMENSION  = 512
+	VIDEO_POSTER_JPEG_QUALITY   = 80
+)
+
+// VideoUploadResponse represents the response for upload_video
+type VideoUploadResponse struct {
+	Success   bool                   `json:"success"`
+	VideoURL  string                 `json:"videoUrl,omitempty"`
+	ObjectKey string                 `json:"objectKey,omitempty"`
+	PosterURL string                 `json:"posterUrl,omitempty"`
+	PosterKey string                 `json:"posterKey,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Code      string                 `json:"code,omitempty"`
+}
+
+func isVideoContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "video/")
+}
+
+// videoCodecAllowed checks a probed codec against VIDEO_ALLOWED_CODECS
+func videoCodecAllowed(codec string) bool {
+	for _, c := range serverConfig.VideoAllowedCodecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// validateVideo enforces the configured duration, dimension and codec limits
+func validateVideo(info *MediaInfo) error {
+	if info.VideoCodec == "" {
+		return errorWithCode(ERROR_CODE_REJECTED, "No video track found")
+	}
+	if !videoCodecAllowed(info.VideoCodec) {
+		return errorWithCode(ERROR_CODE_PAYLOAD_INVALID, "Unsupported video codec: %s", info.VideoCodec)
+	}
+	if info.Duration <= 0 {
+		return errorWithCode(ERROR_CODE_REJECTED, "Video duration is missing from the container")
+	}
+	maxDuration := time.Duration(serverConfig.VideoMaxDurationSeconds) * time.Second
+	if info.Duration > maxDuration {
+		return errorWithCode(ERROR_CODE_REJECTED, "Video is %.1fs long, the maximum is %s", info.Duration.Seconds(), maxDuration)
+	}
+	maxDimension := serverConfig.VideoMaxDimension
+	if info.Width > maxDimension || info.Height > maxDimension {
+		return errorWithCode(ERROR_CODE_REJECTED, "Video is %dx%d, the maximum dimension is %d", info.Width, info.Height, maxDimension)
+	}
+	return nil
+}
+
+// encodePoster scales a client captured frame down to poster size.
+// Decoding video frames needs a native codec library, so the frame comes from the client.
+func encodePoster(data []byte) ([]byte, error) {
+	asset := newImageAsset(data, "")
+	if err := asset.Decode(); err != nil {
+		return nil, err
+	}
+	b := asset.Image.Bounds()
+	width, height := fitWithin(b.Dx(), b.Dy(), VIDEO_POSTER_MAX_DIMENSION)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resizeImage(asset.Image, width, height), &jpeg.Options{Quality: VIDEO_POSTER_JPEG_QUALITY}); err != nil {
+		return nil, fmt.Errorf("failed to encode poster: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// posterKey places a video's poster frame under the thumbnails/ prefix
+func posterKey(objectKey string) string {
+	return THUMBNAIL_PREFIX + strings.TrimSuffix(objectKey, path.Ext(objectKey)) + "_poster.jpg"
+}
+
+// RpcUploadVideo confirms a video sent through request_upload_url, probes its container and stores its poster frame
+func (s *Services) RpcUploadVideo(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(VideoUploadResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		UploadID   string `json:"uploadId"`
+		PosterData string `json:"posterData"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.UploadID == "" {
+		return marshalResponse(VideoUploadResponse{Success: false, Error: "Missing required field: uploadId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	// Check the poster before touching storage so a bad frame can simply be retried
+	var poster []byte
+	if request.PosterData != "" {
+		if base64.StdEncoding.DecodedLen(len(request.PosterData)) > s.Config.InlineUploadMaxBytes {
+			return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Poster exceeds the inline limit of %d bytes", s.Config.InlineUploadMaxBytes), Code: ERROR_CODE_PAYLOAD_TOO_LARGE})
+		}
+		frame, err := base64.StdEncoding.DecodeString(request.PosterData)
+		if err != nil {
+			return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Failed to decode base64 poster: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+		if poster, err = encodePoster(frame); err != nil {
+			return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Invalid poster frame: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+
+	pending, info, err := s.verifyPendingUpload(ctx, logger, nk, userID, request.UploadID)
+	if err != nil {
+		return marshalResponse(VideoUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	if !isVideoContentType(pending.ContentType) {
+		return marshalResponse(VideoUploadResponse{Success: false, Error: "Upload is not a video, use confirm_upload", Code: ERROR_CODE_REJECTED})
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	object, err := backend.GetObject(ctx, s.Config.bucketForKey(pending.ObjectKey), pending.ObjectKey)
+	if err != nil {
+		return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Failed to read video: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	media, err := probeMedia(object, pending.ContentType)
+	object.Close()
+	if err == nil {
+		err = validateVideo(media)
+	}
+	if err != nil {
+		s.rejectPendingUpload(ctx, logger, nk, userID, pending)
+		return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Video rejected: %v", err), Code: ERROR_CODE_REJECTED})
+	}
+
+	metadata := map[string]interface{}{
+		"size":        info.Size,
+		"contentType": pending.ContentType,
+		"duration":    media.Duration.Seconds(),
+		"videoCodec":  media.VideoCodec,
+		"width":       media.Width,
+		"height":      media.Height,
+	}
+	if media.AudioCodec != "" {
+		metadata["audioCodec"] = media.AudioCodec
+	}
+
+	response := VideoUploadResponse{Success: true, ObjectKey: pending.ObjectKey, Metadata: metadata}
+	if poster != nil {
+		response.PosterKey = posterKey(pending.ObjectKey)
+		if err := backend.PutObject(ctx, s.Config.bucketForKey(response.PosterKey), response.PosterKey, bytes.NewReader(poster), int64(len(poster)), "image/jpeg"); err != nil {
+			return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Failed to upload poster: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+		}
+		metadata["posterKey"] = response.PosterKey
+	}
+
+	attachment := s.pendingAttachment(userID, pending, info)
+	attachment.Metadata = metadata
+	if err := recordUpload(ctx, nk, pending, attachment); err != nil {
+		return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Failed to record upload: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	// Generate presigned URLs (expire in 7 days by default)
+	videoURL, err := backend.PresignGet(ctx, s.Config.bucketForKey(pending.ObjectKey), pending.ObjectKey, s.Config.imageURLExpiry())
+	if err != nil {
+		return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Failed to generate presigned URL: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	response.VideoURL = videoURL
+	if response.PosterKey != "" {
+		posterURL, err := backend.PresignGet(ctx, s.Config.bucketForKey(response.PosterKey), response.PosterKey, s.Config.imageURLExpiry())
+		if err != nil {
+			return marshalResponse(VideoUploadResponse{Success: false, Error: fmt.Sprintf("Failed to generate presigned URL: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+		}
+		response.PosterURL = posterURL
+	}
+
+	logger.Info("Video uploaded: %s (%s %dx%d, %.1fs)", pending.ObjectKey, media.VideoCodec, media.Width, media.Height, media.Duration.Seconds())
+	return marshalResponse(response)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	VOICE_DEFAULT_MAX_DURATION = 60
+	VOICE_DEFAULT_BARS         = 64
+	VOICE_MAX_BARS             = 256
+)
+
+// ALLOWED_VOICE_CONTENT_TYPES lists the clip formats upload_voice accepts and their file extensions
+var ALLOWED_VOICE_CONTENT_TYPES = map[string]string{
+	"audio/aac":   ".aac",
+	"audio/mp4":   ".m4a",
+	"audio/m4a":   ".m4a",
+	"audio/x-m4a": ".m4a",
+	"audio/ogg":   ".ogg",
+	"audio/opus":  ".ogg",
+}
+
+// VoiceUploadRequest represents the request payload for upload_voice
+type VoiceUploadRequest struct {
+	AudioData   string `json:"audioData"`
+	ContentType string `json:"contentType"`
+	ChannelID   string `json:"channelId,omitempty"`
+	Bars        int    `json:"bars,omitempty"`
+}
+
+// VoiceUploadResponse represents the response for upload_voice
+type VoiceUploadResponse struct {
+	Success   bool    `json:"success"`
+	AudioURL  string  `json:"audioUrl,omitempty"`
+	ObjectKey string  `json:"objectKey,omitempty"`
+	Duration  float64 `json:"duration,omitempty"`
+	Codec     string  `json:"codec,omitempty"`
+	Waveform  []int   `json:"waveform,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Code      string  `json:"code,omitempty"`
+}
+
+// computeWaveform spreads the packet timeline over the given number of bars and scales them to 0-100.
+// Each bar is the bitrate of the packets inside it, relative to the quietest and loudest bars.
+func computeWaveform(frames []audioFrame, bars int) []int {
+	if len(frames) == 0 {
+		return nil
+	}
+	if bars > len(frames) {
+		bars = len(frames)
+	}
+
+	var total time.Duration
+	for _, f := range frames {
+		total += f.Duration
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	bytesPerBar := make([]float64, bars)
+	timePerBar := make([]float64, bars)
+	var t time.Duration
+	for _, f := range frames {
+		mid := t + f.Duration/2
+		i := int(float64(mid) / float64(total) * float64(bars))
+		if i >= bars {
+			i = bars - 1
+		}
+		bytesPerBar[i] += float64(f.Bytes)
+		timePerBar[i] += f.Duration.Seconds()
+		t += f.Duration
+	}
+
+	rates := make([]float64, bars)
+	low, high := math.MaxFloat64, 0.0
+	for i := range rates {
+		if timePerBar[i] > 0 {
+			rates[i] = bytesPerBar[i] / timePerBar[i]
+		} else if i > 0 {
+			rates[i] = rates[i-1]
+		}
+		low = math.Min(low, rates[i])
+		high = math.Max(high, rates[i])
+	}
+
+	waveform := make([]int, bars)
+	for i, rate := range rates {
+		if high > low {
+			waveform[i] = int(math.Round((rate - low) / (high - low) * 100))
+		} else {
+			// A constant bitrate stream carries no loudness information
+			waveform[i] = 50
+		}
+	}
+	return waveform
+}
+
+// RpcUploadVoice stores a short voice clip in the voice bucket and returns its waveform
+func (s *Services) RpcUploadVoice(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request VoiceUploadRequest
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.AudioData == "" || request.ContentType == "" {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: "Missing required fields: audioData or contentType", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	extension, ok := ALLOWED_VOICE_CONTENT_TYPES[request.ContentType]
+	if !ok {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Unsupported content type: %s", request.ContentType), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if base64.StdEncoding.DecodedLen(len(request.AudioData)) > s.Config.InlineUploadMaxBytes {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Clip exceeds the inline upload limit of %d bytes", s.Config.InlineUploadMaxBytes), Code: ERROR_CODE_PAYLOAD_TOO_LARGE})
+	}
+	bars := request.Bars
+	if bars <= 0 {
+		bars = VOICE_DEFAULT_BARS
+	}
+	if bars > VOICE_MAX_BARS {
+		bars = VOICE_MAX_BARS
+	}
+
+	audioData, err := base64.StdEncoding.DecodeString(request.AudioData)
+	if err != nil {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Failed to decode base64 audio: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	media, err := probeMedia(bytes.NewReader(audioData), request.ContentType)
+	if err != nil {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Invalid audio clip: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if media.AudioCodec != "aac" && media.AudioCodec != "opus" {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Unsupported audio codec: %s", media.AudioCodec), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	maxDuration := time.Duration(s.Config.VoiceMaxDurationSeconds) * time.Second
+	if media.Duration <= 0 || media.Duration > maxDuration {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Clip is %.1fs long, voice messages must be under %s", media.Duration.Seconds(), maxDuration), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if err := s.reserveUploadQuota(ctx, nk, userID, int64(len(audioData))); err != nil {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	objectKey := fmt.Sprintf("%s/%d_voice%s", userID, s.Clock.Now().UnixMilli(), extension)
+	if err := scanUpload(ctx, logger, nk, &MalwareIncident{
+		OwnerID:     userID,
+		ObjectKey:   objectKey,
+		ContentType: request.ContentType,
+		Size:        int64(len(audioData)),
+		ChannelID:   request.ChannelID,
+	}, bytes.NewReader(audioData)); err != nil {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	backend, err := s.Storage.Backend(logger)
+	if err != nil {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Failed to initialize storage backend: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+	if err := backend.EnsureBucket(ctx, logger, s.Config.VoiceBucket); err != nil {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Failed to ensure bucket exists: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	if err := backend.PutObject(ctx, s.Config.VoiceBucket, objectKey, bytes.NewReader(audioData), int64(len(audioData)), request.ContentType); err != nil {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Failed to upload clip: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	waveform := computeWaveform(media.Frames, bars)
+	if err := saveAttachment(ctx, nk, &Attachment{
+		OwnerID:     userID,
+		ObjectKey:   objectKey,
+		Bucket:      s.Config.VoiceBucket,
+		ContentType: request.ContentType,
+		Size:        int64(len(audioData)),
+		ChannelID:   request.ChannelID,
+		Metadata: map[string]interface{}{
+			"duration": media.Duration.Seconds(),
+			"codec":    media.AudioCodec,
+			"waveform": waveform,
+		},
+		CreatedAt: s.Clock.Now().Unix(),
+	}); err != nil {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Failed to record upload: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	// Generate presigned URL (expires in 7 days by default)
+	audioURL, err := backend.PresignGet(ctx, s.Config.VoiceBucket, objectKey, s.Config.imageURLExpiry())
+	if err != nil {
+		return marshalResponse(VoiceUploadResponse{Success: false, Error: fmt.Sprintf("Failed to generate presigned URL: %v", err), Code: ERROR_CODE_STORAGE_UNAVAILABLE})
+	}
+
+	logger.Info("Voice clip uploaded: %s (%s, %.1fs)", objectKey, media.AudioCodec, media.Duration.Seconds())
+	return marshalResponse(VoiceUploadResponse{
+		Success:   true,
+		AudioURL:  audioURL,
+		ObjectKey: objectKey,
+		Duration:  media.Duration.Seconds(),
+		Codec:     media.AudioCodec,
+		Waveform:  waveform,
+	})
+}
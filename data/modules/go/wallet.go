@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	WALLET_CURRENCY           = "coins"
+	WALLET_MAX_GIFT           = 10000
+	WALLET_MAX_SPEND_QUANTITY = 100
+	WALLET_HISTORY_LIMIT      = 100
+
+	// WALLET_ENTITLEMENT_COLLECTION holds one record per user with the items bought and not used yet.
+	// Users can read it; only the server writes it.
+	WALLET_ENTITLEMENT_COLLECTION = "wallet_entitlements"
+	WALLET_ENTITLEMENT_KEY        = "items"
+	WALLET_WRITE_ATTEMPTS         = 3
+
+	WALLET_ITEM_PREMIUM_STICKER = "premium_sticker"
+	WALLET_ITEM_SUPER_REACTION  = "super_reaction"
+
+	NOTIFICATION_CODE_COIN_GIFT = 100
+)
+
+// WALLET_SPEND_CATALOG lists the items coins can be spent on and their unit price
+var WALLET_SPEND_CATALOG = map[string]int64{
+	WALLET_ITEM_PREMIUM_STICKER: 50,
+	WALLET_ITEM_SUPER_REACTION:  10,
+}
+
+// WalletResponse represents the response for wallet RPCs
+type WalletResponse struct {
+	Success      bool                `json:"success"`
+	Balance      int64               `json:"balance"`
+	Entitlements map[string]int64    `json:"entitlements,omitempty"`
+	Items        []WalletLedgerEntry `json:"items,omitempty"`
+	Cursor       string              `json:"cursor,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	Code         string              `json:"code,omitempty"`
+}
+
+// WalletEntitlements counts the catalog items a user has bought and not used yet
+type WalletEntitlements struct {
+	Items map[string]int64 `json:"items"`
+}
+
+// WalletLedgerEntry is a single wallet transaction returned to clients
+type WalletLedgerEntry struct {
+	ID        string                 `json:"id"`
+	Amount    int64                  `json:"amount"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	CreatedAt int64                  `json:"createdAt"`
+}
+
+// walletBalance reads the user's current coin balance
+func walletBalance(ctx context.Context, nk nkruntime.NakamaModule, userID string) (int64, error) {
+	account, err := nk.AccountGetId(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read account: %v", err)
+	}
+	wallet := map[string]int64{}
+	if account.Wallet != "" {
+		if err := json.Unmarshal([]byte(account.Wallet), &wallet); err != nil {
+			return 0, fmt.Errorf("failed to decode wallet: %v", err)
+		}
+	}
+	return wallet[WALLET_CURRENCY], nil
+}
+
+// validateWalletUpdates checks every ledger change before it reaches the wallet.
+// Every update must move a non-zero amount of the known currency and carry a reason.
+func validateWalletUpdates(updates []*nkruntime.WalletUpdate) error {
+	for _, u := range updates {
+		if u.UserID == "" {
+			return fmt.Errorf("wallet update missing user")
+		}
+		if len(u.Changeset) != 1 {
+			return fmt.Errorf("wallet update must change exactly one currency")
+		}
+		amount, ok := u.Changeset[WALLET_CURRENCY]
+		if !ok {
+			return fmt.Errorf("unknown currency")
+		}
+		if amount == 0 {
+			return fmt.Errorf("wallet update amount cannot be zero")
+		}
+		if reason, _ := u.Metadata["reason"].(string); reason == "" {
+			return fmt.Errorf("wallet update missing reason")
+		}
+	}
+	return nil
+}
+
+// applyWalletUpdates validates and applies wallet changes atomically, recording them in the ledger
+func applyWalletUpdates(ctx context.Context, nk nkruntime.NakamaModule, updates []*nkruntime.WalletUpdate) ([]*nkruntime.WalletUpdateResult, error) {
+	if err := validateWalletUpdates(updates); err != nil {
+		return nil, err
+	}
+	results, err := nk.WalletsUpdate(ctx, updates, true)
+	if err != nil {
+		var negative *nkruntime.WalletNegativeError
+		if errors.As(err, &negative) {
+			return nil, errorWithCode(ERROR_CODE_REJECTED, "insufficient coins")
+		}
+		return nil, fmt.Errorf("failed to update wallet: %v", err)
+	}
+	return results, nil
+}
+
+// readEntitlements loads a user's unused items with the record version, "*" when there is none yet
+func readEntitlements(ctx context.Context, nk nkruntime.NakamaModule, userID string) (*WalletEntitlements, string, error) {
+	objects, err := nk.StorageRead(ctx, []*nkruntime.StorageRead{{Collection: WALLET_ENTITLEMENT_COLLECTION, Key: WALLET_ENTITLEMENT_KEY, UserID: userID}})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read entitlements: %v", err)
+	}
+	entitlements := &WalletEntitlements{Items: map[string]int64{}}
+	if len(objects) == 0 {
+		return entitlements, "*", nil
+	}
+	if err := json.Unmarshal([]byte(objects[0].Value), entitlements); err != nil {
+		return nil, "", fmt.Errorf("failed to decode entitlements: %v", err)
+	}
+	if entitlements.Items == nil {
+		entitlements.Items = map[string]int64{}
+	}
+	return entitlements, objects[0].Version, nil
+}
+
+// entitlementWrite stores a user's unused items, conditional on the version they were read at
+func entitlementWrite(userID string, entitlements *WalletEntitlements, version string) *nkruntime.StorageWrite {
+	value, _ := json.Marshal(entitlements)
+	return &nkruntime.StorageWrite{
+		Collection:      WALLET_ENTITLEMENT_COLLECTION,
+		Key:             WALLET_ENTITLEMENT_KEY,
+		UserID:          userID,
+		Value:           string(value),
+		Version:         version,
+		PermissionRead:  1,
+		PermissionWrite: 0,
+	}
+}
+
+// consumeEntitlement uses up one of the user's bought items, failing with REJECTED when none are left
+func consumeEntitlement(ctx context.Context, nk nkruntime.NakamaModule, userID, item string) error {
+	var lastErr error
+	for attempt := 0; attempt < WALLET_WRITE_ATTEMPTS; attempt++ {
+		entitlements, version, err := readEntitlements(ctx, nk, userID)
+		if err != nil {
+			return err
+		}
+		if entitlements.Items[item] <= 0 {
+			return errorWithCode(ERROR_CODE_REJECTED, "no %s left, buy one with wallet_spend", item)
+		}
+		entitlements.Items[item]--
+		if entitlements.Items[item] == 0 {
+			delete(entitlements.Items, item)
+		}
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{entitlementWrite(userID, entitlements, version)}); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to update entitlements: %v", lastErr)
+}
+
+// refundEntitlement gives back an item consumed for an action that then failed
+func refundEntitlement(ctx context.Context, logger nkruntime.Logger, nk nkruntime.NakamaModule, userID, item string) {
+	var lastErr error
+	for attempt := 0; attempt < WALLET_WRITE_ATTEMPTS; attempt++ {
+		entitlements, version, err := readEntitlements(ctx, nk, userID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		entitlements.Items[item]++
+		if _, lastErr = nk.StorageWrite(ctx, []*nkruntime.StorageWrite{entitlementWrite(userID, entitlements, version)}); lastErr == nil {
+			return
+		}
+	}
+	logger.Error("Failed to refund %s to %s: %v", item, userID, lastErr)
+}
+
+// balanceFor picks the caller's updated balance out of wallet update results
+func balanceFor(results []*nkruntime.WalletUpdateResult, userID string) int64 {
+	for _, r := range results {
+		if r.UserID == userID {
+			return r.Updated[WALLET_CURRENCY]
+		}
+	}
+	return 0
+}
+
+// RpcWalletGet returns the caller's coin balance
+func RpcWalletGet(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(WalletResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	balance, err := walletBalance(ctx, nk, userID)
+	if err != nil {
+		return marshalResponse(WalletResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	entitlements, _, err := readEntitlements(ctx, nk, userID)
+	if err != nil {
+		return marshalResponse(WalletResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(WalletResponse{Success: true, Balance: balance, Entitlements: entitlements.Items})
+}
+
+// RpcWalletSpend buys items in the spend catalog. The coins are debited in the same transaction that
+// adds the items to the caller's entitlements, which send_sticker and add_reaction then use up.
+func RpcWalletSpend(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(WalletResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Item     string `json:"item"`
+		Quantity int64  `json:"quantity"`
+		TargetID string `json:"targetId"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(WalletResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	price, ok := WALLET_SPEND_CATALOG[request.Item]
+	if !ok {
+		return marshalResponse(WalletResponse{Success: false, Error: fmt.Sprintf("Unknown item: %s", request.Item), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.Quantity == 0 {
+		request.Quantity = 1
+	}
+	if request.Quantity < 0 || request.Quantity > WALLET_MAX_SPEND_QUANTITY {
+		return marshalResponse(WalletResponse{Success: false, Error: fmt.Sprintf("Quantity must be between 1 and %d", WALLET_MAX_SPEND_QUANTITY), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	metadata := map[string]interface{}{"reason": "spend", "item": request.Item, "quantity": request.Quantity}
+	if request.TargetID != "" {
+		metadata["targetId"] = request.TargetID
+	}
+	updates := []*nkruntime.WalletUpdate{{
+		UserID:    userID,
+		Changeset: map[string]int64{WALLET_CURRENCY: -price * request.Quantity},
+		Metadata:  metadata,
+	}}
+	if err := validateWalletUpdates(updates); err != nil {
+		return marshalResponse(WalletResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	// The version check on the entitlements makes a concurrent spend retry instead of overwriting its items
+	var entitlements *WalletEntitlements
+	var results []*nkruntime.WalletUpdateResult
+	err := fmt.Errorf("too many concurrent updates")
+	for attempt := 0; attempt < WALLET_WRITE_ATTEMPTS && err != nil; attempt++ {
+		var version string
+		entitlements, version, err = readEntitlements(ctx, nk, userID)
+		if err != nil {
+			return marshalResponse(WalletResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+		}
+		entitlements.Items[request.Item] += request.Quantity
+		_, results, err = nk.MultiUpdate(ctx, nil, []*nkruntime.StorageWrite{entitlementWrite(userID, entitlements, version)}, nil, updates, true)
+		if err != nil && !errors.Is(err, nkruntime.ErrStorageRejectedVersion) {
+			break
+		}
+	}
+	var negative *nkruntime.WalletNegativeError
+	if errors.As(err, &negative) {
+		return marshalResponse(WalletResponse{Success: false, Error: "insufficient coins", Code: ERROR_CODE_REJECTED})
+	}
+	if err != nil {
+		logger.Error("Failed to spend coins for %s: %v", userID, err)
+		return marshalResponse(WalletResponse{Success: false, Error: "Failed to spend coins, please try again", Code: ERROR_CODE_INTERNAL})
+	}
+
+	logger.Info("User %s spent %d coins on %d x %s", userID, price*request.Quantity, request.Quantity, request.Item)
+	return marshalResponse(WalletResponse{Success: true, Balance: balanceFor(results, userID), Entitlements: entitlements.Items})
+}
+
+// RpcWalletGift transfers coins from the caller to another user
+func RpcWalletGift(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(WalletResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		RecipientID string `json:"recipientId"`
+		Amount      int64  `json:"amount"`
+		Message     string `json:"message"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return marshalResponse(WalletResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.RecipientID == "" {
+		return marshalResponse(WalletResponse{Success: false, Error: "Missing required field: recipientId", Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+	if request.RecipientID == userID {
+		return marshalResponse(WalletResponse{Success: false, Error: "Cannot gift coins to yourself", Code: ERROR_CODE_REJECTED})
+	}
+	if request.Amount <= 0 || request.Amount > WALLET_MAX_GIFT {
+		return marshalResponse(WalletResponse{Success: false, Error: fmt.Sprintf("Amount must be between 1 and %d", WALLET_MAX_GIFT), Code: ERROR_CODE_PAYLOAD_INVALID})
+	}
+
+	users, err := nk.UsersGetId(ctx, []string{request.RecipientID}, nil)
+	if err != nil || len(users) == 0 {
+		return marshalResponse(WalletResponse{Success: false, Error: "Recipient not found", Code: ERROR_CODE_NOT_FOUND})
+	}
+
+	// Both sides are applied in one transaction so coins are never created or lost
+	results, err := applyWalletUpdates(ctx, nk, []*nkruntime.WalletUpdate{
+		{
+			UserID:    userID,
+			Changeset: map[string]int64{WALLET_CURRENCY: -request.Amount},
+			Metadata:  map[string]interface{}{"reason": "gift_sent", "to": request.RecipientID},
+		},
+		{
+			UserID:    request.RecipientID,
+			Changeset: map[string]int64{WALLET_CURRENCY: request.Amount},
+			Metadata:  map[string]interface{}{"reason": "gift_received", "from": userID},
+		},
+	})
+	if err != nil {
+		return marshalResponse(WalletResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+
+	content := map[string]interface{}{"amount": request.Amount, "message": request.Message}
+	if err := nk.NotificationSend(ctx, request.RecipientID, "You received coins", content, NOTIFICATION_CODE_COIN_GIFT, userID, true); err != nil {
+		logger.Warn("Failed to notify gift recipient %s: %v", request.RecipientID, err)
+	}
+
+	logger.Info("User %s gifted %d coins to %s", userID, request.Amount, request.RecipientID)
+	return marshalResponse(WalletResponse{Success: true, Balance: balanceFor(results, userID)})
+}
+
+// RpcWalletHistory lists the caller's wallet transactions, newest first
+func RpcWalletHistory(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, payload string) (string, error) {
+	userID := userIDFromContext(ctx)
+	if userID == "" {
+		return marshalResponse(WalletResponse{Success: false, Error: "Authentication required", Code: ERROR_CODE_UNAUTHENTICATED})
+	}
+
+	var request struct {
+		Limit  int    `json:"limit"`
+		Cursor string `json:"cursor"`
+	}
+	if payload != "" {
+		if err := json.Unmarshal([]byte(payload), &request); err != nil {
+			return marshalResponse(WalletResponse{Success: false, Error: fmt.Sprintf("Failed to parse request: %v", err), Code: ERROR_CODE_PAYLOAD_INVALID})
+		}
+	}
+	if request.Limit <= 0 || request.Limit > WALLET_HISTORY_LIMIT {
+		request.Limit = WALLET_HISTORY_LIMIT
+	}
+
+	items, cursor, err := nk.WalletLedgerList(ctx, userID, request.Limit, request.Cursor)
+	if err != nil {
+		return marshalResponse(WalletResponse{Success: false, Error: fmt.Sprintf("Failed to list wallet history: %v", err), Code: ERROR_CODE_INTERNAL})
+	}
+
+	entries := make([]WalletLedgerEntry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, WalletLedgerEntry{
+			ID:        item.GetID(),
+			Amount:    item.GetChangeset()[WALLET_CURRENCY],
+			Metadata:  item.GetMetadata(),
+			CreatedAt: item.GetCreateTime(),
+		})
+	}
+
+	balance, err := walletBalance(ctx, nk, userID)
+	if err != nil {
+		return marshalResponse(WalletResponse{Success: false, Error: err.Error(), Code: errorCodeOf(err)})
+	}
+	return marshalResponse(WalletResponse{Success: true, Balance: balance, Items: entries, Cursor: cursor})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	nkruntime "github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	WEBHOOK_TIMEOUT = 10 * time.Second
+	// WEBHOOK_QUEUE_SIZE bounds the deliveries waiting to be sent; events beyond it are dropped
+	WEBHOOK_QUEUE_SIZE           = 1000
+	WEBHOOK_WORKERS              = 4
+	WEBHOOK_DEFAULT_MAX_ATTEMPTS = 5
+	WEBHOOK_RETRY_BASE           = 2 * time.Second
+	WEBHOOK_RETRY_MAX            = 5 * time.Minute
+	WEBHOOK_SIGNATURE_HEADER     = "X-Webhook-Signature"
+	WEBHOOK_EVENT_HEADER         = "X-Webhook-Event"
+	WEBHOOK_ID_HEADER            = "X-Webhook-Id"
+	METRIC_WEBHOOK_DELIVERIES    = "webhook_deliveries_total"
+)
+
+// Webhook event types
+const (
+	WEBHOOK_EVENT_MESSAGE_SENT    = "message_sent"
+	WEBHOOK_EVENT_UPLOAD_CREATED  = "upload_created"
+	WEBHOOK_EVENT_UPLOAD_INFECTED = "upload_infected"
+	WEBHOOK_EVENT_REPORT_CREATED  = "report_created"
+	WEBHOOK_EVENT_USER_BANNED     = "user_banned"
+	WEBHOOK_EVENT_ACCOUNT_DELETED = "account_deleted"
+)
+
+// WEBHOOK_EVENTS are the event types that can be sent, the values WEBHOOK_EVENTS may list
+var WEBHOOK_EVENTS = []string{
+	WEBHOOK_EVENT_MESSAGE_SENT,
+	WEBHOOK_EVENT_UPLOAD_CREATED,
+	WEBHOOK_EVENT_UPLOAD_INFECTED,
+	WEBHOOK_EVENT_REPORT_CREATED,
+	WEBHOOK_EVENT_USER_BANNED,
+	WEBHOOK_EVENT_ACCOUNT_DELETED,
+}
+
+// WebhookEvent is the JSON body POSTed to every webhook URL
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt int64       `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookDelivery is one event on its way to one URL
+type webhookDelivery struct {
+	url     string
+	event   string
+	id      string
+	body    []byte
+	attempt int
+}
+
+// webhookDispatcher signs and sends events from a bounded queue, retrying failed deliveries with backoff
+type webhookDispatcher struct {
+	logger      nkruntime.Logger
+	client      *http.Client
+	urls        []string
+	secret      []byte
+	events      map[string]bool
+	maxAttempts int
+	queue       chan *webhookDelivery
+}
+
+// webhooks is the running dispatcher, nil when no WEBHOOK_URLS are configured
+var webhooks *webhookDispatcher
+
+// InitializeWebhooks starts the delivery workers when WEBHOOK_URLS is set
+func InitializeWebhooks(logger nkruntime.Logger) {
+	if len(serverConfig.WebhookURLs) == 0 {
+		logger.Info("Webhooks disabled")
+		return
+	}
+	d := &webhookDispatcher{
+		logger:      logger,
+		client:      &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		urls:        serverConfig.WebhookURLs,
+		secret:      []byte(serverConfig.WebhookSecret),
+		events:      map[string]bool{},
+		maxAttempts: serverConfig.WebhookMaxAttempts,
+		queue:       make(chan *webhookDelivery, WEBHOOK_QUEUE_SIZE),
+	}
+	for _, event := range serverConfig.WebhookEvents {
+		d.events[event] = true
+	}
+	for i := 0; i < WEBHOOK_WORKERS; i++ {
+		go d.run()
+	}
+	webhooks = d
+	logger.Info("Webhooks enabled for %d URLs", len(d.urls))
+}
+
+// publishEvent queues an event for every webhook URL. It never blocks: when the queue is full the event is
+// dropped and logged, chat must not slow down because a receiver is.
+func publishEvent(eventType string, data interface{}) {
+	d := webhooks
+	if d == nil || (len(d.events) > 0 && !d.events[eventType]) {
+		return
+	}
+	event := &WebhookEvent{ID: uuid.New().String(), Type: eventType, CreatedAt: time.Now().Unix(), Data: data}
+	body, err := json.Marshal(event)
+	if err != nil {
+		d.logger.Error("Failed to encode %s webhook event: %v", eventType, err)
+		return
+	}
+	for _, url := range d.urls {
+		d.enqueue(&webhookDelivery{url: url, event: eventType, id: event.ID, body: body, attempt: 1})
+	}
+}
+
+func (d *webhookDispatcher) enqueue(delivery *webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		d.count(delivery, "dropped")
+		d.logger.Warn("Webhook queue full, dropped %s event %s for %s", delivery.event, delivery.id, delivery.url)
+	}
+}
+
+func (d *webhookDispatcher) run() {
+	for delivery := range d.queue {
+		d.deliver(delivery)
+	}
+}
+
+// deliver sends one attempt. Network errors, 429 and 5xx answers are retried after an exponential backoff,
+// other answers are final. Retries wait on a timer rather than in a worker, so a slow receiver does not hold
+// up the others.
+func (d *webhookDispatcher) deliver(delivery *webhookDelivery) {
+	retry, err := d.send(delivery)
+	if err == nil {
+		d.count(delivery, METRIC_RESULT_OK)
+		return
+	}
+	if !retry || delivery.attempt >= d.maxAttempts {
+		d.count(delivery, "failed")
+		d.logger.Error("Webhook %s event %s to %s failed after %d attempts: %v", delivery.event, delivery.id, delivery.url, delivery.attempt, err)
+		return
+	}
+	d.count(delivery, "retrying")
+	backoff := WEBHOOK_RETRY_BASE << (delivery.attempt - 1)
+	if backoff > WEBHOOK_RETRY_MAX {
+		backoff = WEBHOOK_RETRY_MAX
+	}
+	d.logger.Warn("Webhook %s event %s to %s failed, retrying in %v: %v", delivery.event, delivery.id, delivery.url, backoff, err)
+	delivery.attempt++
+	time.AfterFunc(backoff, func() { d.enqueue(delivery) })
+}
+
+// send POSTs a delivery and reports whether a failure is worth retrying
+func (d *webhookDispatcher) send(delivery *webhookDelivery) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_HEADER, delivery.event)
+	req.Header.Set(WEBHOOK_ID_HEADER, delivery.id)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, signWebhook(d.secret, time.Now().Unix(), delivery.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("receiver answered %s", resp.Status)
+}
+
+func (d *webhookDispatcher) count(delivery *webhookDelivery, result string) {
+	if metrics == nil {
+		return
+	}
+	metrics.MetricsCounterAdd(METRIC_WEBHOOK_DELIVERIES, map[string]string{"event": delivery.event, "result": result}, 1)
+}
+
+// signWebhook returns the signature header value "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">".
+// Receivers recompute the HMAC with the shared secret and reject stale timestamps to stop replays.
+func signWebhook(secret []byte, timestamp int64, body []byte) string {
+	t := strconv.FormatInt(timestamp, 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// publishSentMessage is the sent-message hook that sends message_sent events
+func publishSentMessage(ctx context.Context, logger nkruntime.Logger, db *sql.DB, nk nkruntime.NakamaModule, message *SentMessage) {
+	if webhooks == nil {
+		return
+	}
+	var content interface{} = message.Content
+	if json.Valid([]byte(message.Content)) {
+		content = json.RawMessage(message.Content)
+	}
+	publishEvent(WEBHOOK_EVENT_MESSAGE_SENT, map[string]interface{}{
+		"channelId": message.ChannelID,
+		"messageId": message.MessageID,
+		"senderId":  message.SenderID,
+		"username":  message.Username,
+		"content":   content,
+		"createdAt": message.CreatedAt,
+	})
+}
+
+// publishUpload sends the upload_created event of a recorded attachment. Key envelopes stay out of it.
+func publishUpload(attachment *Attachment) {
+	publishEvent(WEBHOOK_EVENT_UPLOAD_CREATED, map[string]interface{}{
+		"ownerId":     attachment.OwnerID,
+		"objectKey":   attachment.ObjectKey,
+		"contentType": attachment.ContentType,
+		"size":        attachment.Size,
+		"channelId":   attachment.ChannelID,
+		"encrypted":   attachment.Envelope != nil,
+		"createdAt":   attachment.CreatedAt,
+	})
+}